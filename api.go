@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"media_optimizer/pkg/arr"
+	"media_optimizer/pkg/auth"
+	"media_optimizer/pkg/favorites"
+	"media_optimizer/pkg/gpu"
+	"media_optimizer/pkg/jobevents"
+	"media_optimizer/pkg/joblog"
+	"media_optimizer/pkg/jobstore"
+	"media_optimizer/pkg/libscan"
+	"media_optimizer/pkg/mediaopt"
+	"media_optimizer/pkg/notify"
+	"media_optimizer/pkg/openapi"
+	"media_optimizer/pkg/proposals"
+	"media_optimizer/pkg/quarantine"
+	"media_optimizer/pkg/stats"
+)
+
+// apiPrefix is the root of the versioned HTTP API. Breaking changes go into
+// a new version next to it.
+const apiPrefix = "/api/v1"
+
+// legacyAPIPrefix serves the same endpoints as apiPrefix for clients and
+// Sonarr/Radarr connections set up before the API was versioned
+const legacyAPIPrefix = "/api"
+
+// apiVersion is the version of the OpenAPI document
+const apiVersion = "1.0.0"
+
+// apiRoute is a handler of the HTTP API with the endpoints it serves
+type apiRoute struct {
+	// pattern is relative to the API prefix; a trailing slash matches the
+	// whole subtree
+	pattern string
+	// role is required for requests other than GET, which need
+	// auth.Viewer. Routes without a role authorize requests themselves.
+	role      auth.Role
+	handler   http.Handler
+	endpoints []openapi.Endpoint
+}
+
+// registerAPI registers the API routes under apiPrefix and
+// legacyAPIPrefix, along with the OpenAPI document
+func registerAPI(mux *http.ServeMux) {
+	routes := apiRoutes()
+	var endpoints []openapi.Endpoint
+	for _, route := range routes {
+		endpoints = append(endpoints, route.endpoints...)
+	}
+	doc, err := json.Marshal(openapi.Generate(openapi.Info{
+		Title:       "Media Optimizer",
+		Version:     apiVersion,
+		Description: "Browse media, start optimization jobs and follow them. Jobs report their progress over the /ws WebSocket. When users or API keys are configured, requests authenticate with HTTP basic auth or an API key and need the viewer role to read, operator to start or change jobs and admin for rebuilds and notifications.",
+	}, cfg.Proxy.BasePath+apiPrefix, endpoints))
+	if err != nil {
+		// The document only contains types of this package
+		panic(err)
+	}
+
+	for _, route := range routes {
+		handler := route.handler
+		if route.role != "" {
+			handler = requireRole(route.role, handler)
+		}
+		if !mediaBodyRoutes[route.pattern] {
+			handler = limitBody(handler)
+		}
+		// Limited before logging in, which slows down password guessing
+		handler = limiter.Handler(handler)
+		mux.Handle(apiPrefix+route.pattern, handler)
+		mux.Handle(legacyAPIPrefix+route.pattern, handler)
+	}
+	mux.Handle(apiPrefix+"/openapi.json", limiter.Handler(authenticator.Require(auth.Viewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}))))
+}
+
+// mediaBodyRoutes are the routes whose request bodies are media rather than
+// JSON, exempt from limits.maxBodyBytes
+var mediaBodyRoutes = map[string]bool{
+	"/stream/optimize": true,
+	"/upload/":         true,
+}
+
+// limitBody caps the request body at limits.maxBodyBytes. Larger bodies of
+// known length are refused; handlers fail to read others past the limit.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > cfg.Limits.MaxBodyBytes {
+			http.Error(w, fmt.Sprintf("Request body larger than %d bytes", cfg.Limits.MaxBodyBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.Limits.MaxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireRole serves reads to viewers and other requests to users with at
+// least role
+func requireRole(role auth.Role, next http.Handler) http.Handler {
+	read := authenticator.Require(auth.Viewer, next)
+	write := authenticator.Require(role, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			read.ServeHTTP(w, r)
+		} else {
+			write.ServeHTTP(w, r)
+		}
+	})
+}
+
+// apiPath returns the path of an API request relative to its prefix, e.g.
+// "/jobs/abc/log"
+func apiPath(r *http.Request) string {
+	if path, ok := strings.CutPrefix(r.URL.Path, apiPrefix+"/"); ok {
+		return "/" + path
+	}
+	return strings.TrimPrefix(r.URL.Path, legacyAPIPrefix)
+}
+
+// apiRoutes lists the routes of the HTTP API. The request and response
+// values of the endpoints only serve the OpenAPI document, so keep them in
+// step with what the handlers decode and encode.
+func apiRoutes() []apiRoute {
+	jobsQuery := []openapi.Parameter{
+		openapi.Query("status", "string", "Comma separated statuses, e.g. failed,completed"),
+		openapi.Query("kind", "string", "Job kind: video, remux, ladder, image or audio"),
+		openapi.Query("path", "string", "Source path prefix"),
+		openapi.Query("since", "string", "RFC 3339 time or YYYY-MM-DD, on creation time"),
+		openapi.Query("until", "string", "RFC 3339 time or YYYY-MM-DD, on creation time"),
+		openapi.Query("cursor", "string", "nextCursor of the previous page"),
+		openapi.Query("limit", "integer", "Page size, 50 by default and at most 500"),
+		openapi.Query("fields", "string", "Comma separated record fields to return besides id"),
+	}
+	type jobsPage struct {
+		Jobs       []jobstore.Record `json:"jobs"`
+		NextCursor string            `json:"nextCursor,omitempty"`
+	}
+	type scanState struct {
+		Running bool   `json:"running"`
+		Error   string `json:"error,omitempty"`
+	}
+
+	return []apiRoute{
+		{"/browse", auth.Viewer, http.HandlerFunc(handleBrowse), []openapi.Endpoint{{
+			Method: http.MethodPost, Path: "/browse", Tag: "files",
+			Summary:  "List a directory of the media roots or of a storage remote",
+			Request:  BrowseRequest{},
+			Response: BrowsePage{},
+			Errors:   []int{http.StatusBadRequest, http.StatusBadGateway, http.StatusInternalServerError},
+		}}},
+		{"/favorites", auth.Viewer, http.HandlerFunc(handleFavorites), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/favorites", Tag: "files",
+			Summary:     "List the logged in user's favorite directories",
+			Description: "In the order they were added. Without configured users everyone shares the favorites.",
+			Response: struct {
+				Favorites []favorites.Favorite `json:"favorites"`
+			}{},
+		}, {
+			Method: http.MethodPost, Path: "/favorites", Tag: "files",
+			Summary:     "Add a favorite directory",
+			Description: "Answers 201 with the new favorite, or 200 with the existing one when the directory already is a favorite.",
+			Request:     FavoriteRequest{},
+			Response:    favorites.Favorite{},
+			Status:      http.StatusCreated,
+			Errors:      []int{http.StatusBadRequest, http.StatusForbidden},
+		}}},
+		{"/favorites/", auth.Viewer, http.HandlerFunc(handleFavorites), []openapi.Endpoint{{
+			Method: http.MethodDelete, Path: "/favorites/{id}", Tag: "files",
+			Summary: "Remove a favorite directory",
+			Status:  http.StatusNoContent,
+			Errors:  []int{http.StatusNotFound},
+		}}},
+		{"/search", auth.Viewer, http.HandlerFunc(handleSearch), []openapi.Endpoint{{
+			Method: http.MethodPost, Path: "/search", Tag: "files",
+			Summary:  "Search the media roots for files",
+			Request:  SearchRequest{},
+			Response: libscan.SearchResult{},
+			Errors:   []int{http.StatusBadRequest, http.StatusConflict},
+		}}},
+		{"/thumbnail", auth.Viewer, http.HandlerFunc(handleThumbnail), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/thumbnail", Tag: "files",
+			Summary: "Get a thumbnail or preview sprite of a video",
+			Query: []openapi.Parameter{
+				{Name: "path", In: "query", Required: true, Schema: &openapi.Schema{Type: "string"}},
+				openapi.Query("type", "string", "thumbnail (the default) or sprite"),
+			},
+			ContentType: "image/jpeg",
+			Errors:      []int{http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity},
+		}}},
+		{"/optimize", auth.Operator, http.HandlerFunc(handleOptimize), []openapi.Endpoint{{
+			Method: http.MethodPost, Path: "/optimize", Tag: "jobs",
+			Summary:     "Validate a file for optimization, or plan it with dryRun",
+			Description: "The job is started with an optimize message over /ws. A dry run answers with the plan instead.",
+			Request:     OptimizeRequest{},
+			Response: struct {
+				Status        string  `json:"status"`
+				Path          string  `json:"path"`
+				EstimatedCost float64 `json:"estimatedCost,omitempty"`
+			}{},
+			Errors: []int{http.StatusBadRequest, http.StatusPaymentRequired, http.StatusConflict, http.StatusUnprocessableEntity},
+		}}},
+		{"/samples", auth.Operator, http.HandlerFunc(handleSamples), []openapi.Endpoint{{
+			Method: http.MethodPost, Path: "/samples", Tag: "jobs",
+			Summary: "Encode sample clips of a video with a profile",
+			Request: SampleRequest{},
+			Response: struct {
+				Profile string                 `json:"profile"`
+				Samples *mediaopt.SampleReport `json:"samples"`
+			}{},
+			Errors: []int{http.StatusBadRequest, http.StatusUnprocessableEntity},
+		}}},
+		{"/stream/optimize", auth.Operator, http.HandlerFunc(handleStreamOptimize), []openapi.Endpoint{{
+			Method: http.MethodPost, Path: "/stream/optimize", Tag: "jobs",
+			Summary:     "Optimize the request body and stream back fragmented MP4",
+			ContentType: "video/mp4",
+		}}},
+		{"/upload", auth.Operator, http.HandlerFunc(handleUpload), []openapi.Endpoint{{
+			Method: http.MethodPost, Path: "/upload", Tag: "files",
+			Summary:     "Start a chunked upload into the inbox",
+			Description: "Announces the file's name and size. The chunks follow with PUT /upload/{id}. Needs upload.dir.",
+			Request:     UploadRequest{},
+			Response:    UploadState{},
+			Status:      http.StatusCreated,
+			Errors:      []int{http.StatusBadRequest, http.StatusForbidden, http.StatusConflict, http.StatusRequestEntityTooLarge},
+		}}},
+		{"/upload/", auth.Operator, http.HandlerFunc(handleUpload), []openapi.Endpoint{{
+			Method: http.MethodPut, Path: "/upload/{id}", Tag: "files",
+			Summary:     "Send the next chunk of an upload",
+			Description: "The body is the chunk's raw bytes, starting at offset, the upload's received size. A chunk at another offset answers 409 and one past the announced size 413, with the upload's state. A chunk cut short keeps what arrived; resume from received. The last chunk moves the file into the inbox and, with optimize, queues its job.",
+			Query: []openapi.Parameter{
+				{Name: "offset", In: "query", Required: true, Schema: &openapi.Schema{Type: "integer"}},
+			},
+			Response: UploadState{},
+			Errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge},
+		}, {
+			Method: http.MethodGet, Path: "/upload/{id}", Tag: "files",
+			Summary:  "Get an upload's state, e.g. to resume it",
+			Response: UploadState{},
+			Errors:   []int{http.StatusNotFound},
+		}, {
+			Method: http.MethodDelete, Path: "/upload/{id}", Tag: "files",
+			Summary: "Discard an upload",
+			Status:  http.StatusNoContent,
+			Errors:  []int{http.StatusNotFound, http.StatusConflict},
+		}}},
+		{"/archive", auth.Viewer, http.HandlerFunc(handleArchive), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/archive", Tag: "files",
+			Summary:     "Download the outputs of completed jobs and other files as one archive",
+			Description: "Repeat job and path to select several. A directory is archived with its files; hidden files such as partial outputs are left out. Zip entries are stored uncompressed.",
+			Query: []openapi.Parameter{
+				openapi.Query("job", "string", "a completed job whose outputs are archived"),
+				openapi.Query("path", "string", "a file or directory archived as it is"),
+				openapi.Query("format", "string", "zip (the default) or tar"),
+			},
+			ContentType: "application/zip",
+			Errors:      []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict},
+		}, {
+			Method: http.MethodPost, Path: "/archive", Tag: "files",
+			Summary:     "Download the outputs of completed jobs and other files as one archive",
+			Description: "Takes the selection in the body, for selections too long for a URL.",
+			Request:     ArchiveRequest{},
+			ContentType: "application/zip",
+			Errors:      []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict},
+		}}},
+		{"/jobs", auth.Operator, http.HandlerFunc(handleJobs), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/jobs", Tag: "jobs",
+			Summary:  "List the job history, newest first",
+			Query:    jobsQuery,
+			Response: jobsPage{},
+			Errors:   []int{http.StatusBadRequest},
+		}, {
+			Method: http.MethodPost, Path: "/jobs", Tag: "jobs",
+			Summary:     "Queue a job",
+			Description: "Takes the options of /optimize and answers 202 with the job's history record. API keys limited to paths may only queue files under them.",
+			Request:     OptimizeRequest{},
+			Response:    jobstore.Record{},
+			Status:      http.StatusAccepted,
+			Errors:      []int{http.StatusBadRequest, http.StatusPaymentRequired, http.StatusForbidden, http.StatusConflict, http.StatusUnprocessableEntity},
+		}}},
+		{"/jobs/", auth.Operator, http.HandlerFunc(handleJob), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/jobs/{id}/log", Tag: "jobs",
+			Summary:     "Get the log of a job",
+			Description: "With follow=true the entries are streamed as newline-delimited JSON until the job finishes.",
+			Query: []openapi.Parameter{
+				openapi.Query("tail", "integer", "Return only the last entries"),
+				openapi.Query("follow", "boolean", "Stream new entries"),
+			},
+			Response: struct {
+				ID      string         `json:"id"`
+				Entries []joblog.Entry `json:"entries"`
+			}{},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+		}, {
+			Method: http.MethodGet, Path: "/jobs/{id}/events", Tag: "jobs",
+			Summary:     "Get the audit trail of a job",
+			Description: "Events are oldest first: created (with what queued the job), started, stage, retry, cancelled, replaced-original, post-action, quarantined, finished, undone, approved and discarded.",
+			Response: struct {
+				ID     string            `json:"id"`
+				Events []jobevents.Event `json:"events"`
+			}{},
+			Errors: []int{http.StatusNotFound},
+		}, {
+			Method: http.MethodPost, Path: "/jobs/{id}/undo", Tag: "jobs",
+			Summary:  "Restore the original a job replaced",
+			Response: jobstore.Record{},
+			Errors:   []int{http.StatusNotFound, http.StatusConflict, http.StatusGone},
+		}}},
+		{"/quarantine", auth.Operator, http.HandlerFunc(handleQuarantine), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/quarantine", Tag: "jobs",
+			Summary:     "List the outputs awaiting review",
+			Description: "Outputs that failed verification are kept here, under the ID of their job, when quarantine is enabled. Only outputs of sources under the caller's paths are listed.",
+			Response: struct {
+				Entries []quarantine.Entry `json:"entries"`
+			}{},
+		}}},
+		{"/quarantine/", auth.Operator, http.HandlerFunc(handleQuarantine), []openapi.Endpoint{{
+			Method: http.MethodPost, Path: "/quarantine/{id}/approve", Tag: "jobs",
+			Summary:     "Put a quarantined output in place",
+			Description: "The output is moved to where its job would have written it and the job becomes completed.",
+			Response:    quarantine.Entry{},
+			Errors:      []int{http.StatusNotFound, http.StatusForbidden, http.StatusConflict},
+		}, {
+			Method: http.MethodPost, Path: "/quarantine/{id}/discard", Tag: "jobs",
+			Summary:     "Delete a quarantined output",
+			Description: "The job becomes discarded.",
+			Response:    quarantine.Entry{},
+			Errors:      []int{http.StatusNotFound, http.StatusForbidden},
+		}}},
+		{"/proposals", auth.Operator, http.HandlerFunc(handleProposals), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/proposals", Tag: "jobs",
+			Summary:     "List the jobs awaiting approval",
+			Description: "With proposals enabled, the Sonarr/Radarr webhooks and watch folders propose jobs instead of queueing them. Each proposal carries the file's attributes and estimated savings. Rejected proposals stay listed so their files aren't proposed again until they change.",
+			Query: []openapi.Parameter{
+				openapi.Query("status", "string", "pending or rejected"),
+			},
+			Response: struct {
+				Proposals []proposals.Proposal `json:"proposals"`
+			}{},
+		}}},
+		{"/proposals/", auth.Operator, http.HandlerFunc(handleProposals), []openapi.Endpoint{{
+			Method: http.MethodPost, Path: "/proposals/{id}/approve", Tag: "jobs",
+			Summary:     "Approve a proposed job",
+			Description: "Queues the job and answers 202 with its history record. The body may set confirmCost as for POST /jobs.",
+			Response:    jobstore.Record{},
+			Status:      http.StatusAccepted,
+			Errors:      []int{http.StatusBadRequest, http.StatusPaymentRequired, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity},
+		}, {
+			Method: http.MethodPost, Path: "/proposals/{id}/reject", Tag: "jobs",
+			Summary:  "Reject a proposed job",
+			Response: proposals.Proposal{},
+			Errors:   []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict},
+		}}},
+		{"/queue", auth.Operator, http.HandlerFunc(handleQueue), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/queue", Tag: "queue",
+			Summary:     "List the jobs of this run",
+			Description: "Finished jobs stay listed until they are cleared or their file is queued again.",
+			Response:    QueueState{},
+		}}},
+		{"/queue/", auth.Operator, http.HandlerFunc(handleQueue), []openapi.Endpoint{{
+			Method: http.MethodPost, Path: "/queue/pause", Tag: "queue",
+			Summary:     "Pause the queue",
+			Description: "Queued jobs wait and the encoders of running video jobs are stopped until the queue is resumed. Needs access to all paths.",
+			Response:    QueueResponse{},
+			Errors:      []int{http.StatusForbidden},
+		}, {
+			Method: http.MethodPost, Path: "/queue/resume", Tag: "queue",
+			Summary:  "Resume the queue",
+			Response: QueueResponse{},
+			Errors:   []int{http.StatusForbidden},
+		}, {
+			Method: http.MethodPost, Path: "/queue/cancel", Tag: "queue",
+			Summary:     "Cancel all unfinished jobs",
+			Description: "Running image and audio jobs can't be cancelled and are reported with an error.",
+			Response:    QueueResponse{},
+		}, {
+			Method: http.MethodPost, Path: "/queue/clear", Tag: "queue",
+			Summary:  "Remove finished jobs from the queue",
+			Query:    []openapi.Parameter{openapi.Query("status", "string", "Comma separated finished statuses to clear, completed by default")},
+			Response: QueueResponse{},
+			Errors:   []int{http.StatusBadRequest},
+		}, {
+			Method: http.MethodPost, Path: "/queue/retry", Tag: "queue",
+			Summary:     "Queue all failed jobs again",
+			Description: "Each failed job is queued with its original options; retryId is the new job.",
+			Response:    QueueResponse{},
+		}}},
+		{"/history", auth.Viewer, http.HandlerFunc(handleHistory), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/history", Tag: "jobs",
+			Summary: "List the job history with totals over all matching jobs",
+			Query:   jobsQuery,
+			Response: struct {
+				jobsPage
+				Stats stats.Totals `json:"stats"`
+			}{},
+			Errors: []int{http.StatusBadRequest},
+		}}},
+		{"/calendar.ics", auth.Viewer, http.HandlerFunc(handleCalendar), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/calendar.ics", Tag: "jobs",
+			Summary:     "iCal feed of running jobs and their projected completion",
+			ContentType: "text/calendar",
+		}}},
+		{"/stats", auth.Viewer, http.HandlerFunc(handleStats), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/stats", Tag: "jobs",
+			Summary:     "Statistics of the job history",
+			Description: "The failure heatmap covers all finished jobs and the profile results all completed ones, the series the completed and failed jobs by the day, week or month they finished in.",
+			Query: []openapi.Parameter{
+				openapi.Query("bucket", "string", "day (the default), week or month"),
+				openapi.Query("since", "string", "RFC 3339 time or YYYY-MM-DD, 30 days ago by default"),
+				openapi.Query("until", "string", "RFC 3339 time or YYYY-MM-DD, now by default"),
+			},
+			Response: statsResponse{},
+			Errors:   []int{http.StatusBadRequest},
+		}}},
+		{"/library/report", auth.Viewer, http.HandlerFunc(handleLibraryReport), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/library/report", Tag: "library",
+			Summary:     "Get the library report, starting a scan if needed",
+			Description: "Answers 202 while the first scan runs.",
+			Query:       []openapi.Parameter{openapi.Query("refresh", "boolean", "Start a new scan")},
+			Response: struct {
+				scanState
+				Report *libscan.Report `json:"report"`
+			}{},
+			Errors: []int{http.StatusConflict},
+		}}},
+		{"/library/duplicates", auth.Viewer, http.HandlerFunc(handleLibraryDuplicates), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/library/duplicates", Tag: "library",
+			Summary:     "Get the duplicate groups of the library scan",
+			Description: "Answers 202 while the first scan runs.",
+			Query:       []openapi.Parameter{openapi.Query("refresh", "boolean", "Start a new scan")},
+			Response: struct {
+				scanState
+				Duplicates []libscan.DuplicateGroup `json:"duplicates"`
+			}{},
+			Errors: []int{http.StatusConflict},
+		}}},
+		{"/verify", auth.Operator, http.HandlerFunc(handleVerify), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/verify", Tag: "library",
+			Summary:  "Get the latest checksum verification report",
+			Response: verifyState{},
+		}, {
+			Method: http.MethodPost, Path: "/verify", Tag: "library",
+			Summary:  "Start re-hashing the outputs of completed jobs",
+			Status:   http.StatusAccepted,
+			Response: verifyState{},
+			Errors:   []int{http.StatusConflict},
+		}}},
+		{"/gpus", auth.Viewer, http.HandlerFunc(handleGPUs), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/gpus", Tag: "system",
+			Summary: "Hardware encoder sessions in use per GPU",
+			Response: struct {
+				GPUs []gpu.Usage `json:"gpus"`
+			}{},
+		}}},
+		{"/ffmpeg", auth.Viewer, http.HandlerFunc(handleFFmpeg), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/ffmpeg", Tag: "system",
+			Summary:     "The ffmpeg build in use and its video encoders",
+			Description: "videoEncoders tells for each video codec setting, e.g. libsvtav1 for AV1, whether the build can encode it.",
+			Response:    ffmpegStatus{},
+		}}},
+		{"/mounts", auth.Viewer, http.HandlerFunc(handleMounts), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/mounts", Tag: "system",
+			Summary:  "Availability of the network shares",
+			Response: []mountStatus{},
+		}}},
+		{"/provenance", auth.Viewer, http.HandlerFunc(handleProvenance), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/provenance", Tag: "files",
+			Summary:     "What produced a file",
+			Description: "Read from the stamp the optimizer writes into its outputs' container metadata, with the job's history record while it is kept.",
+			Query: []openapi.Parameter{
+				{Name: "path", In: "query", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			},
+			Response: provenance{},
+			Errors:   []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusUnprocessableEntity},
+		}}},
+		{"/me", auth.Viewer, http.HandlerFunc(handleMe), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/me", Tag: "system",
+			Summary:     "The logged in user",
+			Description: "Without configured users everyone is an anonymous admin.",
+			Response:    auth.User{},
+		}}},
+		{"/rebuild", auth.Admin, http.HandlerFunc(handleRebuild), []openapi.Endpoint{{
+			Method: http.MethodPost, Path: "/rebuild", Tag: "system",
+			Summary:  "Update and restart the server",
+			Response: RebuildResponse{},
+			Errors:   []int{http.StatusConflict},
+		}}},
+		{"/notify/targets", auth.Viewer, http.HandlerFunc(handleNotifyTargets), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/notify/targets", Tag: "notifications",
+			Summary: "Names of the notification targets",
+			Response: struct {
+				Targets []string `json:"targets"`
+			}{},
+		}}},
+		{"/notify/test", auth.Admin, http.HandlerFunc(handleNotifyTest), []openapi.Endpoint{{
+			Method: http.MethodPost, Path: "/notify/test", Tag: "notifications",
+			Summary: "Send a test event to a target",
+			Request: struct {
+				Target string `json:"target"`
+			}{},
+			Response: notify.Delivery{},
+			Errors:   []int{http.StatusBadRequest, http.StatusNotFound},
+		}}},
+		// Recorded requests may show what admins configured, so listing them
+		// takes an admin too
+		{"/webhooks/echo", "", authenticator.Require(auth.Admin, notify.NewEcho(webhookEchoLimit)), []openapi.Endpoint{{
+			Method: http.MethodGet, Path: "/webhooks/echo", Tag: "notifications",
+			Summary:  "List the requests recorded by the echo fixture",
+			Response: []notify.EchoRequest{},
+		}, {
+			Method: http.MethodPost, Path: "/webhooks/echo", Tag: "notifications",
+			Summary:  "Record and echo back a webhook request",
+			Request:  map[string]interface{}{},
+			Response: notify.EchoRequest{},
+		}}},
+		{"/webhooks/sonarr", "", handleArrWebhook(arr.Sonarr), arrEndpoint("/webhooks/sonarr", "Sonarr")},
+		{"/webhooks/radarr", "", handleArrWebhook(arr.Radarr), arrEndpoint("/webhooks/radarr", "Radarr")},
+	}
+}
+
+// arrEndpoint documents the webhook of a Sonarr or Radarr connection
+func arrEndpoint(path, app string) []openapi.Endpoint {
+	return []openapi.Endpoint{{
+		Method: http.MethodPost, Path: path, Tag: "webhooks",
+		Summary:     "Queue a file imported by " + app,
+		Description: "Other events are answered with 200 and status ignored.",
+		Request:     map[string]interface{}{},
+		Status:      http.StatusAccepted,
+		Response: struct {
+			Status string `json:"status"`
+			Path   string `json:"path,omitempty"`
+			Event  string `json:"event,omitempty"`
+		}{},
+		Errors: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusUnprocessableEntity},
+	}}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"media_optimizer/pkg/auth"
+	"media_optimizer/pkg/config"
+)
+
+// useFakeFFmpeg puts a fake ffmpeg, a shell script running script, first on
+// the PATH
+func useFakeFFmpeg(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg is a shell script")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatalf("Failed to write fake ffmpeg: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// apiServer serves the API with request bodies limited to maxBody bytes
+func apiServer(t *testing.T, maxBody int64) *httptest.Server {
+	t.Helper()
+	useConfig(t, func(c *config.Config) {
+		c.Limits.MaxBodyBytes = maxBody
+		// No nice or ionice wrapping the fake ffmpeg
+		c.Priority = config.Priority{}
+	})
+	mux := http.NewServeMux()
+	registerAPI(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestStreamOptimizeBody(t *testing.T) {
+	// Echo the input as the optimized output
+	useFakeFFmpeg(t, "exec cat")
+	server := apiServer(t, 1024)
+
+	// Media bodies are exempt from the body limit of the JSON endpoints
+	body := bytes.Repeat([]byte("media"), 10*1024)
+	resp, err := http.Post(server.URL+apiPrefix+"/stream/optimize", "video/x-matroska", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	output, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, resp.StatusCode, output)
+	}
+	if resp.Header.Get("Content-Type") != "video/mp4" {
+		t.Errorf("Expected video/mp4, got %s", resp.Header.Get("Content-Type"))
+	}
+	if !bytes.Equal(output, body) {
+		t.Errorf("Expected the %d byte body streamed back, got %d bytes", len(body), len(output))
+	}
+
+	// Other endpoints keep the limit
+	resp, err = http.Post(server.URL+apiPrefix+"/jobs", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d for a large JSON body, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+}
+
+func TestStreamOptimizeError(t *testing.T) {
+	// Fail before writing any output
+	useFakeFFmpeg(t, "cat >/dev/null; echo 'pipe:0: Invalid data found when processing input' >&2; exit 1")
+	server := apiServer(t, 1024)
+
+	resp, err := http.Post(server.URL+apiPrefix+"/stream/optimize", "video/x-matroska", strings.NewReader("not media"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	output, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusInternalServerError, resp.StatusCode, output)
+	}
+	if !strings.Contains(string(output), "Invalid data found") {
+		t.Errorf("Expected ffmpeg's error in the response, got %q", output)
+	}
+
+	resp, err = http.Get(server.URL + apiPrefix + "/stream/optimize")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d for GET, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func TestWebhookEchoRequiresAdmin(t *testing.T) {
+	var accounts []auth.Account
+	for _, account := range []auth.Account{{Username: "viewer", Role: auth.Viewer}, {Username: "admin", Role: auth.Admin}} {
+		hash, err := auth.HashPassword(account.Username + "-password")
+		if err != nil {
+			t.Fatalf("Failed to hash password: %v", err)
+		}
+		account.PasswordHash = hash
+		accounts = append(accounts, account)
+	}
+	saved := authenticator
+	var err error
+	if authenticator, err = auth.New(accounts, nil); err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	t.Cleanup(func() { authenticator = saved })
+	server := apiServer(t, 1024)
+
+	request := func(method, user string) int {
+		r, _ := http.NewRequest(method, server.URL+apiPrefix+"/webhooks/echo", strings.NewReader(`{}`))
+		r.SetBasicAuth(user, user+"-password")
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	tests := []struct {
+		method, user string
+		status       int
+	}{
+		{http.MethodPost, "admin", http.StatusOK},
+		{http.MethodGet, "admin", http.StatusOK},
+		{http.MethodPost, "viewer", http.StatusForbidden},
+		{http.MethodGet, "viewer", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if status := request(tt.method, tt.user); status != tt.status {
+			t.Errorf("%s by %s: expected status %d, got %d", tt.method, tt.user, tt.status, status)
+		}
+	}
+}
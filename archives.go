@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"media_optimizer/pkg/archive"
+	"media_optimizer/pkg/jobstore"
+	"media_optimizer/pkg/storage"
+)
+
+// ArchiveRequest selects the files of /api/archive
+type ArchiveRequest struct {
+	// Jobs are completed jobs whose outputs are archived
+	Jobs []string `json:"jobs,omitempty"`
+	// Paths are files or directories inside the media roots archived as
+	// they are
+	Paths []string `json:"paths,omitempty"`
+	// Format is "zip" (the default) or "tar"
+	Format string `json:"format,omitempty"`
+}
+
+// handleArchive streams the outputs of the selected jobs and the selected
+// paths as one archive. GET takes the selection as repeated job and path
+// query parameters, for download links; POST takes an ArchiveRequest.
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	var request ArchiveRequest
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		request = ArchiveRequest{Jobs: query["job"], Paths: query["path"], Format: query.Get("format")}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if request.Format == "" {
+		request.Format = archive.FormatZip
+	}
+	if archive.ContentType(request.Format) == "" {
+		http.Error(w, fmt.Sprintf("format must be %q or %q, got %q", archive.FormatZip, archive.FormatTar, request.Format), http.StatusBadRequest)
+		return
+	}
+
+	var paths []string
+	for _, id := range request.Jobs {
+		record, ok := jobStore.Get(id)
+		if !ok {
+			http.Error(w, "job not found: "+id, http.StatusNotFound)
+			return
+		}
+		if !authenticator.AllowedPath(r.Context(), record.SourcePath) {
+			http.Error(w, errPathNotAllowed.Error(), http.StatusForbidden)
+			return
+		}
+		outputs := jobOutputs(record)
+		if len(outputs) == 0 {
+			http.Error(w, fmt.Sprintf("job %s has no local outputs", id), http.StatusConflict)
+			return
+		}
+		for _, output := range outputs {
+			if !authenticator.AllowedPath(r.Context(), output) {
+				http.Error(w, errPathNotAllowed.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		paths = append(paths, outputs...)
+	}
+	for _, raw := range request.Paths {
+		path, err := rootedPath(raw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if !authenticator.AllowedPath(r.Context(), path.String()) {
+			http.Error(w, errPathNotAllowed.Error(), http.StatusForbidden)
+			return
+		}
+		paths = append(paths, path.String())
+	}
+	files, err := archive.Collect(paths)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := archiveName(files, request.Format)
+	w.Header().Set("Content-Type", archive.ContentType(request.Format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if err := archive.Write(r.Context(), w, request.Format, files); err != nil {
+		slog.Warn("Archive download failed", "name", name, "files", len(files), "error", err)
+		// The status line is gone already; abort so the client sees a
+		// truncated download instead of a seemingly complete archive
+		panic(http.ErrAbortHandler)
+	}
+	slog.Info("Archive downloaded", "name", name, "files", len(files), "user", userName(r.Context()))
+}
+
+// jobOutputs returns the local files and directories a completed job wrote
+func jobOutputs(record jobstore.Record) []string {
+	if record.Status != "completed" {
+		return nil
+	}
+	if len(record.Outputs) > 0 {
+		return record.Outputs
+	}
+	if record.OutputPath == "" || storage.IsRemote(record.OutputPath) {
+		return nil
+	}
+	switch filepath.Ext(record.OutputPath) {
+	case ".m3u8", ".mpd":
+		// Packaged outputs are the manifest's whole directory
+		return []string{filepath.Dir(record.OutputPath)}
+	}
+	return []string{record.OutputPath}
+}
+
+// archiveName names the download after the only top-level entry of the
+// archive, or the time for a mixed selection
+func archiveName(files []archive.File, format string) string {
+	top, _, _ := strings.Cut(files[0].Name, "/")
+	for _, f := range files[1:] {
+		if name, _, _ := strings.Cut(f.Name, "/"); name != top {
+			return "media-optimizer-" + time.Now().Format("20060102-150405") + "." + format
+		}
+	}
+	return strings.TrimSuffix(top, filepath.Ext(top)) + "." + format
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"media_optimizer/pkg/config"
+)
+
+func TestArchivePathsInsideRoots(t *testing.T) {
+	dir := t.TempDir()
+	library := filepath.Join(dir, "media")
+	if err := os.MkdirAll(library, 0755); err != nil {
+		t.Fatalf("Failed to create library: %v", err)
+	}
+	movie := filepath.Join(library, "movie.mkv")
+	secret := filepath.Join(dir, "config.json")
+	for _, path := range []string{movie, secret} {
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	download := func(path string) int {
+		query := url.Values{"path": {path}}
+		r := httptest.NewRequest(http.MethodGet, "/api/archive?"+query.Encode(), nil)
+		w := httptest.NewRecorder()
+		handleArchive(w, r)
+		return w.Code
+	}
+
+	useConfig(t, func(c *config.Config) { c.MediaRoots = []string{library} })
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{movie, http.StatusOK},
+		{library, http.StatusOK},
+		{secret, http.StatusForbidden},
+		{filepath.Join(library, "..", "config.json"), http.StatusForbidden},
+		{string(filepath.Separator), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if status := download(tt.path); status != tt.status {
+			t.Errorf("Archive of %s: expected status %d, got %d", tt.path, tt.status, status)
+		}
+	}
+
+	// Without media roots no path may be read back
+	useConfig(t, nil)
+	if status := download(movie); status != http.StatusForbidden {
+		t.Errorf("Archive without media roots: expected status %d, got %d", http.StatusForbidden, status)
+	}
+}
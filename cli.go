@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"media_optimizer/pkg/auth"
+	"media_optimizer/pkg/libscan"
+	"media_optimizer/pkg/mediaopt"
+)
+
+// usage describes the subcommands
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: media-optimizer <command> [arguments]
+
+Commands:
+  serve     run the web server (default)
+  optimize  optimize files or folders and wait for the jobs to finish
+  scan      analyse library roots and print the report as JSON
+  hash-password
+            read a password from stdin and print its hash for auth.users
+  api-key   generate an API key and print it with its hash for auth.apiKeys
+  help      show this help
+
+Run "media-optimizer <command> -h" for the options of a command.
+`)
+}
+
+// parseArgs parses flags that may appear before, between or after the
+// positional arguments, which it returns
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// exitCode maps a flag parsing error to the process exit status
+func exitCode(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	return 2
+}
+
+// runOptimize runs the optimize command: each path is optimized in turn
+// and its job history record printed to stdout as a line of JSON. It exits
+// non-zero when any job failed.
+func runOptimize(args []string) int {
+	flags := flag.NewFlagSet("optimize", flag.ContinueOnError)
+	profile := flags.String("profile", "", "profile for videos instead of the one chosen by policies")
+	mode := flags.String("mode", "", `"remux", "ladder", "image" or "audio"; inferred from the file type when empty`)
+	container := flags.String("container", "mp4", "target container of a remux")
+	targetSize := flags.String("target-size", "", "fit videos into this size, e.g. 4GB")
+	timeout := flags.Int("timeout-minutes", 0, "kill video encodes running longer than this instead of the configured limit")
+	packaging := flags.String("packaging", "", `segment videos and ladders as "hls" or "dash"`)
+	confirmCost := flags.Bool("confirm-cost", false, "run jobs estimated above cloud.confirmAbove")
+	dryRun := flags.Bool("dry-run", false, "print the plan of videos and remuxes without encoding")
+	quiet := flags.Bool("quiet", false, "don't report progress")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: media-optimizer optimize [options] <path>...")
+		flags.PrintDefaults()
+	}
+
+	paths, err := parseArgs(flags, args)
+	if err != nil {
+		return exitCode(err)
+	}
+	if len(paths) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	closer := setup(os.Stderr)
+	defer closer.Close()
+
+	failed := 0
+	for _, path := range paths {
+		request := OptimizeRequest{
+			Path:           path,
+			DryRun:         *dryRun,
+			Mode:           *mode,
+			TargetSize:     *targetSize,
+			Profile:        *profile,
+			TimeoutMinutes: *timeout,
+			Packaging:      *packaging,
+			ConfirmCost:    *confirmCost,
+		}
+		if *mode == KindRemux {
+			request.Container = *container
+		}
+		if err := optimizePath(request, *quiet); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed++
+		}
+	}
+
+	// Let notifications and media server refreshes finish before exiting
+	notifier.Wait()
+	refreshes.Wait()
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// optimizePath runs one optimize request in the foreground
+func optimizePath(request OptimizeRequest, quiet bool) error {
+	out := json.NewEncoder(os.Stdout)
+
+	if request.DryRun {
+		kind, err := validateRequest(&request)
+		if err != nil {
+			return err
+		}
+		if kind != KindVideo && kind != KindRemux {
+			return fmt.Errorf("dry runs only support videos and remuxes")
+		}
+		params, err := dryRunParams(request, kind)
+		if err != nil {
+			return err
+		}
+		report, err := mediaopt.DryRun(params)
+		if err != nil {
+			return err
+		}
+		return out.Encode(report)
+	}
+
+	request.origin = "cli"
+	job, err := newJob(request, nil)
+	if err != nil {
+		return err
+	}
+	if !quiet {
+		job.onProgress = progressPrinter(job.SourcePath)
+	}
+	runJob(job)
+
+	if record, ok := jobStore.Get(job.ID); ok {
+		out.Encode(record)
+	}
+	if job.Status != "completed" {
+		return errors.New(job.Error)
+	}
+	return nil
+}
+
+// progressPrinter returns a progress callback that reports every 10% on
+// stderr, which stays readable when interleaved with the log
+func progressPrinter(path string) func(float64) {
+	last := -1
+	return func(progress float64) {
+		step := int(progress) / 10 * 10
+		if step == last {
+			return
+		}
+		last = step
+		fmt.Fprintf(os.Stderr, "%s: %d%%\n", path, step)
+	}
+}
+
+// runScan runs the scan command over the given roots, or the configured
+// mediaRoots when none are given
+func runScan(args []string) int {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	duplicates := flags.Bool("duplicates", false, "print the duplicate groups instead of the report")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: media-optimizer scan [options] [root...]")
+		flags.PrintDefaults()
+	}
+
+	roots, err := parseArgs(flags, args)
+	if err != nil {
+		return exitCode(err)
+	}
+
+	closer := setup(os.Stderr)
+	defer closer.Close()
+
+	if len(roots) == 0 {
+		roots = cfg.MediaRoots
+	}
+	if len(roots) == 0 {
+		fmt.Fprintln(os.Stderr, "scan: no roots given and no mediaRoots configured")
+		return 2
+	}
+
+	report, err := libscan.Scan(scanOptions(roots))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "scan: %v\n", err)
+		return 1
+	}
+
+	var result interface{} = report
+	if *duplicates {
+		result = report.Duplicates
+		if report.Duplicates == nil {
+			result = []libscan.DuplicateGroup{}
+		}
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	out.Encode(result)
+	return 0
+}
+
+// runHashPassword prints the hash of the password on the first line of
+// stdin, for the passwordHash of a user in the config
+func runHashPassword(args []string) int {
+	flags := flag.NewFlagSet("hash-password", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: media-optimizer hash-password < password-file")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitCode(err)
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		if err == nil {
+			err = errors.New("empty password")
+		}
+		fmt.Fprintf(os.Stderr, "hash-password: %v\n", err)
+		return 1
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "hash-password: %v\n", err)
+		return 1
+	}
+	fmt.Println(hash)
+	return 0
+}
+
+// runAPIKey prints a new API key for a client and the hash to configure in
+// auth.apiKeys. The key itself is not stored anywhere.
+func runAPIKey(args []string) int {
+	flags := flag.NewFlagSet("api-key", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: media-optimizer api-key")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitCode(err)
+	}
+
+	key, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "api-key: %v\n", err)
+		return 1
+	}
+	fmt.Printf("key:     %s\nkeyHash: %s\n", key, hash)
+	return 0
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"media_optimizer/pkg/favorites"
+	"media_optimizer/pkg/storage"
+)
+
+// FavoriteRequest is the payload of POST /api/favorites
+type FavoriteRequest struct {
+	Path string `json:"path"`
+	// Name labels the favorite, by default the directory's name
+	Name string `json:"name,omitempty"`
+}
+
+// handleFavorites serves the logged in user's favorite directories: GET
+// /api/favorites lists them, POST adds one and DELETE /api/favorites/{id}
+// removes one
+func handleFavorites(w http.ResponseWriter, r *http.Request) {
+	user := userName(r.Context())
+	id := strings.TrimPrefix(strings.TrimPrefix(apiPath(r), "/favorites"), "/")
+	if id != "" {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		err := favoriteStore.Remove(id, user)
+		switch {
+		case errors.Is(err, favorites.ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		visible := []favorites.Favorite{}
+		for _, f := range favoriteStore.List(user) {
+			if authenticator.AllowedPath(r.Context(), f.Path) {
+				visible = append(visible, f)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"favorites": visible})
+	case http.MethodPost:
+		var request FavoriteRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		path, err := favoriteDir(request.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !authenticator.AllowedPath(r.Context(), path) {
+			http.Error(w, errPathNotAllowed.Error(), http.StatusForbidden)
+			return
+		}
+		favorite, added, err := favoriteStore.Add(favorites.Favorite{Path: path, Name: strings.TrimSpace(request.Name), User: user})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if added {
+			slog.Info("Favorite added", "path", path, "user", user)
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(favorite)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// favoriteDir returns the clean path of a directory to bookmark: a local
+// directory the server may browse or a directory of a storage remote
+func favoriteDir(raw string) (string, error) {
+	if remotePath, ok, err := storage.ParsePath(raw); ok {
+		if err != nil {
+			return "", err
+		}
+		if _, err := lookupRemote(remotePath); err != nil {
+			return "", err
+		}
+		remotePath.Key = strings.TrimSuffix(remotePath.Key, "/")
+		return remotePath.String(), nil
+	}
+	path, err := resolvePath(raw)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(path.String()); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("not a directory: %s", path.String())
+	}
+	return path.String(), nil
+}
@@ -2,4 +2,7 @@ module media_optimizer
 
 go 1.21.6
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require (
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/text v0.14.0
+)
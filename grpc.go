@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"media_optimizer/pkg/auth"
+	"media_optimizer/pkg/cost"
+	"media_optimizer/pkg/grpcapi"
+	"media_optimizer/pkg/jobstore"
+	"media_optimizer/pkg/mediaopt"
+)
+
+// serveGRPC serves the gRPC API on its own TLS listener. Clients log in with
+// basic auth in the authorization metadata; gRPC clients report a refused
+// login as Unauthenticated.
+func serveGRPC() {
+	server := &http.Server{
+		Addr:    cfg.GRPC.Address,
+		Handler: limiter.Handler(authenticator.Require(auth.Viewer, grpcapi.NewServer(grpcService{}))),
+	}
+	slog.Info("gRPC API starting", "address", cfg.GRPC.Address)
+	if err := server.ListenAndServeTLS(cfg.GRPC.CertFile, cfg.GRPC.KeyFile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// grpcService implements the gRPC API with the logic of the HTTP and
+// WebSocket handlers
+type grpcService struct{}
+
+func (grpcService) Browse(ctx context.Context, req *grpcapi.BrowseRequest) (*grpcapi.BrowseResponse, error) {
+	page, status, err := browse(ctx, BrowseRequest{
+		Path:       req.Path,
+		Sort:       req.Sort,
+		Desc:       req.Desc,
+		Extensions: req.Extensions,
+		Offset:     int(req.Offset),
+		Limit:      int(req.Limit),
+	})
+	if err != nil {
+		return nil, grpcError(status, err)
+	}
+
+	resp := &grpcapi.BrowseResponse{
+		Path:   page.Path,
+		Total:  int32(page.Total),
+		Offset: int32(page.Offset),
+		Limit:  int32(page.Limit),
+	}
+	for _, f := range page.Files {
+		resp.Files = append(resp.Files, &grpcapi.FileInfo{
+			Name:        f.Name,
+			Path:        f.Path,
+			IsDir:       f.IsDir,
+			Size:        f.Size,
+			ModTimeUnix: unixTime(f.ModTime),
+			MediaType:   f.MediaType,
+		})
+	}
+	return resp, nil
+}
+
+func (grpcService) Probe(ctx context.Context, req *grpcapi.ProbeRequest) (*grpcapi.ProbeResponse, error) {
+	path, err := resolvePath(req.Path)
+	if err != nil {
+		return nil, grpcapi.Errorf(grpcapi.InvalidArgument, "%v", err)
+	}
+	if info, err := os.Stat(path.String()); err != nil || info.IsDir() {
+		return nil, grpcapi.Errorf(grpcapi.NotFound, "file not found: %s", req.Path)
+	}
+	if !mediaopt.HasExtension(path.String(), cfg.AllowedExtensions) {
+		return nil, grpcapi.Errorf(grpcapi.InvalidArgument, "not a video file: %s", req.Path)
+	}
+	probe, err := mediaopt.Probe(path.String())
+	if err != nil {
+		return nil, grpcapi.Errorf(grpcapi.Internal, "%v", err)
+	}
+
+	resp := &grpcapi.ProbeResponse{
+		FormatName:      probe.Format.FormatName,
+		DurationSeconds: probe.DurationSeconds(),
+	}
+	resp.Size, _ = strconv.ParseInt(probe.Format.Size, 10, 64)
+	resp.BitRate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	for _, s := range probe.Streams {
+		stream := &grpcapi.Stream{
+			Index:     int32(s.Index),
+			CodecType: s.CodecType,
+			CodecName: s.CodecName,
+			Language:  s.Tags["language"],
+			Width:     int32(s.Width),
+			Height:    int32(s.Height),
+			Channels:  int32(s.Channels),
+		}
+		stream.BitRate, _ = strconv.ParseInt(s.BitRate, 10, 64)
+		resp.Streams = append(resp.Streams, stream)
+	}
+	return resp, nil
+}
+
+func (grpcService) StartJob(ctx context.Context, req *grpcapi.StartJobRequest) (*grpcapi.Job, error) {
+	if !authenticator.Allowed(ctx, auth.Operator) {
+		return nil, grpcapi.Errorf(grpcapi.PermissionDenied, "starting jobs requires the operator role")
+	}
+	request := OptimizeRequest{
+		Path:        req.Path,
+		Mode:        req.Mode,
+		Container:   req.Container,
+		TargetSize:  req.TargetSize,
+		Profile:     req.Profile,
+		Packaging:   req.Packaging,
+		ConfirmCost: req.ConfirmCost,
+	}
+	request.user, _ = auth.FromContext(ctx)
+	request.origin = "grpc"
+	job, err := enqueueJob(request, nil)
+	var conflict *jobConflictError
+	switch {
+	case errors.As(err, &conflict):
+		return nil, grpcapi.Errorf(grpcapi.AlreadyExists, "%v", err)
+	case errors.Is(err, errPathNotAllowed):
+		return nil, grpcapi.Errorf(grpcapi.PermissionDenied, "%v", err)
+	case errors.Is(err, cost.ErrBudgetExceeded):
+		return nil, grpcapi.Errorf(grpcapi.ResourceExhausted, "%v", err)
+	case errors.Is(err, cost.ErrConfirmationRequired):
+		return nil, grpcapi.Errorf(grpcapi.FailedPrecondition, "%v", err)
+	case errors.Is(err, errRecordJob):
+		return nil, grpcapi.Errorf(grpcapi.Internal, "%v", err)
+	case err != nil:
+		return nil, grpcapi.Errorf(grpcapi.InvalidArgument, "%v", err)
+	}
+	slog.Info("Job started over gRPC", "job", job.ID, "path", job.SourcePath, "user", userName(ctx))
+
+	record, ok := jobStore.Get(job.ID)
+	if !ok {
+		// The record may already have been deleted from the history
+		record = jobstore.Record{SourcePath: job.SourcePath, Kind: job.Kind, Status: "queued"}
+	}
+	return jobMessage(record, job), nil
+}
+
+func (grpcService) GetJob(ctx context.Context, req *grpcapi.GetJobRequest) (*grpcapi.Job, error) {
+	record, ok := jobStore.Get(req.ID)
+	if !ok {
+		return nil, grpcapi.Errorf(grpcapi.NotFound, "job not found: %s", req.ID)
+	}
+	return jobMessage(record, activeJob(req.ID)), nil
+}
+
+func (grpcService) ListJobs(ctx context.Context, req *grpcapi.ListJobsRequest) (*grpcapi.ListJobsResponse, error) {
+	query, err := storeQuery(JobsQuery{
+		Status: req.Status,
+		Kind:   req.Kind,
+		Path:   req.Path,
+		Since:  req.Since,
+		Until:  req.Until,
+		Cursor: req.Cursor,
+		Limit:  int(req.Limit),
+	})
+	if err != nil {
+		return nil, grpcapi.Errorf(grpcapi.InvalidArgument, "%v", err)
+	}
+	page, err := jobStore.Query(query)
+	if err != nil {
+		return nil, grpcapi.Errorf(grpcapi.InvalidArgument, "%v", err)
+	}
+
+	resp := &grpcapi.ListJobsResponse{NextCursor: page.NextCursor}
+	for _, record := range page.Records {
+		resp.Jobs = append(resp.Jobs, jobMessage(record, activeJob(record.ID)))
+	}
+	return resp, nil
+}
+
+func (grpcService) WatchJob(ctx context.Context, req *grpcapi.GetJobRequest, send func(*grpcapi.Job) error) error {
+	// Watch before the first snapshot so no update is missed
+	job := activeJob(req.ID)
+	var updates <-chan struct{}
+	if job != nil {
+		ch, stop := watchJob(job)
+		defer stop()
+		updates = ch
+	}
+
+	for {
+		record, ok := jobStore.Get(req.ID)
+		if !ok {
+			return grpcapi.Errorf(grpcapi.NotFound, "job not found: %s", req.ID)
+		}
+		msg := jobMessage(record, job)
+		if err := send(msg); err != nil {
+			return err
+		}
+		if job == nil || jobFinished(msg.Status) {
+			return nil
+		}
+		select {
+		case <-updates:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// activeJob returns the job of this run with the history ID, nil if it
+// isn't one
+func activeJob(id string) *OptimizationJob {
+	activeJobs.RLock()
+	defer activeJobs.RUnlock()
+	return activeJobs.jobs[id]
+}
+
+// jobMessage returns the job's record with the live state of its run, if
+// it is active
+func jobMessage(record jobstore.Record, job *OptimizationJob) *grpcapi.Job {
+	msg := &grpcapi.Job{
+		ID:             record.ID,
+		SourcePath:     record.SourcePath,
+		Kind:           record.Kind,
+		Status:         record.Status,
+		Error:          record.Error,
+		OutputPath:     record.OutputPath,
+		InputBytes:     record.InputBytes,
+		OutputBytes:    record.OutputBytes,
+		CreatedAtUnix:  unixTime(record.CreatedAt),
+		FinishedAtUnix: unixTime(record.FinishedAt),
+	}
+	if job != nil {
+		activeJobs.RLock()
+		msg.Status, msg.Error = job.Status, job.Error
+		msg.Progress = float64(job.Progress)
+		msg.Stage, msg.Speed, msg.FPS = job.Stage, job.Speed, job.FPS
+		elapsed, eta := jobTiming(job, msg.Progress)
+		msg.ElapsedSeconds, msg.ETASeconds = int32(elapsed), int32(eta)
+		msg.Attempt = int32(job.Attempt)
+		activeJobs.RUnlock()
+	}
+	if msg.Status == "completed" {
+		msg.Progress = 100
+	}
+	return msg
+}
+
+// grpcError converts an error of the HTTP handlers' logic, given with its
+// HTTP status, into a gRPC status
+func grpcError(status int, err error) error {
+	code := grpcapi.Internal
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		code = grpcapi.InvalidArgument
+	case http.StatusNotFound:
+		code = grpcapi.NotFound
+	case http.StatusBadGateway:
+		code = grpcapi.Unavailable
+	}
+	return grpcapi.Errorf(code, "%v", err)
+}
+
+// unixTime returns t in seconds since the epoch, zero for the zero time
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -1,19 +1,71 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"media_optimizer/pkg/acme"
+	"media_optimizer/pkg/arr"
+	"media_optimizer/pkg/audioopt"
+	"media_optimizer/pkg/auth"
+	"media_optimizer/pkg/checksum"
+	"media_optimizer/pkg/config"
+	"media_optimizer/pkg/cost"
+	"media_optimizer/pkg/exclude"
+	"media_optimizer/pkg/favorites"
+	"media_optimizer/pkg/ffmpeg"
+	"media_optimizer/pkg/gpu"
+	"media_optimizer/pkg/ical"
+	"media_optimizer/pkg/imageopt"
+	"media_optimizer/pkg/jobevents"
+	"media_optimizer/pkg/joblog"
+	"media_optimizer/pkg/jobstore"
+	"media_optimizer/pkg/libscan"
+	"media_optimizer/pkg/logging"
 	"media_optimizer/pkg/mediaopt"
+	"media_optimizer/pkg/mediapath"
+	"media_optimizer/pkg/mediaserver"
+	"media_optimizer/pkg/netmount"
+	"media_optimizer/pkg/notify"
+	"media_optimizer/pkg/proposals"
+	"media_optimizer/pkg/proxy"
+	"media_optimizer/pkg/quarantine"
+	"media_optimizer/pkg/ratelimit"
 	"media_optimizer/pkg/rebuild"
+	"media_optimizer/pkg/resources"
+	"media_optimizer/pkg/schedule"
+	"media_optimizer/pkg/sidecar"
+	"media_optimizer/pkg/stats"
+	"media_optimizer/pkg/storage"
+	"media_optimizer/pkg/throttle"
+	"media_optimizer/pkg/trash"
+	"media_optimizer/pkg/upload"
+	"media_optimizer/pkg/wsproto"
 
 	"github.com/gorilla/websocket"
 )
@@ -21,286 +73,4587 @@ import (
 //go:embed static/*
 var staticFiles embed.FS
 
+// version is stamped into outputs; release builds set it with
+// -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
 type FileInfo struct {
-	Name  string `json:"name"`
-	Path  string `json:"path"`
-	IsDir bool   `json:"isDir"`
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"isDir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime,omitempty"`
+	// MediaType hints at the pipeline a file goes to: "video", "disc",
+	// "image" or "audio"; empty for directories and other files
+	MediaType string `json:"mediaType,omitempty"`
+	// Folder summarizes the media below a directory in deep listings, nil
+	// while it's being computed
+	Folder *libscan.FolderStats `json:"folder,omitempty"`
+}
+
+// BrowseRequest is the payload of /api/browse
+type BrowseRequest struct {
+	Path string `json:"path"`
+	// Sort orders entries by "name" (the default), "size" or "date", with
+	// directories first
+	Sort string `json:"sort,omitempty"`
+	// Desc reverses the order
+	Desc bool `json:"desc,omitempty"`
+	// Extensions keeps only the files with one of these extensions, e.g.
+	// ".mkv"; directories are always kept
+	Extensions []string `json:"extensions,omitempty"`
+	// Deep adds the size and dominant codecs of the media below each
+	// local directory, computed in the background
+	Deep   bool `json:"deep,omitempty"`
+	Offset int  `json:"offset,omitempty"`
+	Limit  int  `json:"limit,omitempty"`
+}
+
+// SearchRequest is the payload of /api/search
+type SearchRequest struct {
+	// Path limits the search to a directory inside the media roots
+	Path string `json:"path,omitempty"`
+	// Pattern matches file names, as a glob when it has wildcards and as a
+	// substring otherwise
+	Pattern    string   `json:"pattern,omitempty"`
+	Extensions []string `json:"extensions,omitempty"`
+	// MinSize and MaxSize bound the file size, e.g. "700MB"
+	MinSize string `json:"minSize,omitempty"`
+	MaxSize string `json:"maxSize,omitempty"`
+	// VideoCodec probes the files for their video codec, e.g. "mpeg4"
+	VideoCodec string `json:"videoCodec,omitempty"`
+	Limit      int    `json:"limit,omitempty"`
+}
+
+// BrowsePage is one page of a directory listing
+type BrowsePage struct {
+	Path string `json:"path"`
+	// Parent is the path to browse for the directory above, empty at the
+	// top level
+	Parent string     `json:"parent,omitempty"`
+	Files  []FileInfo `json:"files"`
+	// Total counts the entries that passed the filter
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+	// Pending counts the directories of a deep listing whose summary is
+	// still being computed; listing again later fills them in
+	Pending int `json:"pending,omitempty"`
 }
 
+// Job kinds
+const (
+	KindVideo = "video"
+	KindImage = "image"
+	KindAudio = "audio"
+	KindRemux = "remux"
+	// KindLadder encodes several renditions of a video for adaptive streaming
+	KindLadder = "ladder"
+)
+
 type OptimizationJob struct {
-	SourcePath string `json:"sourcePath"`
-	Status     string `json:"status"`
-	Progress   int    `json:"progress"`
-	Error      string `json:"error,omitempty"`
-	WSConn     *websocket.Conn
-	wsMutex    sync.Mutex // Mutex for WebSocket writes
+	// ID identifies the job in the queue, its WebSocket messages and the
+	// job history, where it is the record's ID
+	ID         string    `json:"id"`
+	SourcePath string    `json:"sourcePath"`
+	Kind       string    `json:"kind"`
+	Status     string    `json:"status"`
+	Progress   int       `json:"progress"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"startedAt,omitempty"`
+	// Container is the remux target extension for remux jobs
+	Container string `json:"container,omitempty"`
+	// TargetSize is the requested output size in bytes, zero for none
+	TargetSize int64 `json:"targetSize,omitempty"`
+	// Profile is the optimization profile applied to a video, if any
+	Profile string `json:"profile,omitempty"`
+	// Streams holds a user-edited stream mapping, empty for automatic
+	Streams []mediaopt.StreamMapping `json:"streams,omitempty"`
+	// Renditions reports each output of a ladder job
+	Renditions []RenditionStatus `json:"renditions,omitempty"`
+	// Packaging is the segmented output format, empty for a single file
+	Packaging string `json:"packaging,omitempty"`
+	// Attempt counts the runs of the job, starting at 1
+	Attempt int `json:"attempt,omitempty"`
+	// Speed (relative to playback) and FPS describe the running encode,
+	// ETA is its estimated seconds remaining
+	Speed float64 `json:"speed,omitempty"`
+	FPS   float64 `json:"fps,omitempty"`
+	ETA   int     `json:"eta,omitempty"`
+	// Stage is the step of the pipeline the job is in, e.g. "verify"
+	Stage  string  `json:"stage,omitempty"`
+	WSConn *wsConn `json:"-"`
+	// subscribers are further connections following the job, see
+	// subscribeJobs
+	subscribers []*wsConn
+	// request is the one the job was created for, which a retry repeats
+	request OptimizeRequest
+	// ctx is cancelled when the job is, see cancelJob
+	ctx    context.Context
+	cancel context.CancelFunc
+	// input is the local copy of a remote or staged source while the job
+	// runs
+	input string
+	// watchers are signalled after each update, see watchJob
+	watchers []chan struct{}
+	log      *joblog.Log // the job's own log, nil if it couldn't be opened
+	// onProgress reports progress outside WebSocket, e.g. on the terminal
+	onProgress func(float64)
+}
+
+// remoteRoot is a configured storage remote
+type remoteRoot struct {
+	backend storage.Backend
+	// typ is the remote's storage type, which its paths must name
+	typ string
+	// deleteOriginal replaces sources with their outputs
+	deleteOriginal bool
+}
+
+// StageStatus is the current stage of a job and the job's progress over
+// all of its stages
+type StageStatus struct {
+	Stage    string  `json:"stage"`
+	Progress float64 `json:"progress"`
+}
+
+// RenditionStatus is the progress of one rendition of a ladder job
+type RenditionStatus struct {
+	Name     string `json:"name"`
+	Height   int    `json:"height"`
+	Status   string `json:"status"`
+	Progress int    `json:"progress"`
+}
+
+// OptimizeRequest is the payload of /api/optimize, POST /api/jobs and of
+// WebSocket optimize messages
+type OptimizeRequest struct {
+	Path   string `json:"path"`
+	DryRun bool   `json:"dryRun,omitempty"`
+	// Mode selects the job kind; it is inferred from the file type when
+	// empty and picks between image and audio for directories
+	Mode string `json:"mode,omitempty"`
+	// Container is the target extension of a remux, e.g. "mp4" or "mkv"
+	Container string `json:"container,omitempty"`
+	// TargetSize fits a video into the given size, e.g. "4GB"
+	TargetSize string `json:"targetSize,omitempty"`
+	// Profile overrides the profile selected by the directory policies
+	Profile string `json:"profile,omitempty"`
+	// TimeoutMinutes kills a video, remux or ladder job's encodes after this
+	// long instead of the limit derived from the input's duration
+	TimeoutMinutes int `json:"timeoutMinutes,omitempty"`
+	// Packaging segments the output of a video or ladder job for web
+	// players, "hls" or "dash"
+	Packaging string `json:"packaging,omitempty"`
+	// ConfirmCost accepts a job estimated above cloud.confirmAbove
+	ConfirmCost bool                     `json:"confirmCost,omitempty"`
+	Streams     []mediaopt.StreamMapping `json:"streams,omitempty"`
+
+	// user started the job, set by the server from the login
+	user auth.User
+	// origin is what queued the job, e.g. "websocket" or "sonarr", for its
+	// audit trail
+	origin string
+	// recipe is the watch folder recipe of a watched file's job, nil for
+	// other jobs
+	recipe *config.WatchFolder
+}
+
+// Validate checks the fields WebSocket messages must set, the rest is left
+// to validateRequest
+func (r *OptimizeRequest) Validate() error {
+	if r.Path == "" {
+		return errors.New("path is required")
+	}
+	return nil
+}
+
+// SampleRequest is the payload of /api/samples
+type SampleRequest struct {
+	Path string `json:"path"`
+	// Profile is sampled instead of the one selected by the directory
+	// policies; "default" uses the global settings
+	Profile string `json:"profile,omitempty"`
+	// Clips and Seconds default to mediaopt.DefaultSampleClips and
+	// mediaopt.DefaultSampleSeconds
+	Clips   int     `json:"clips,omitempty"`
+	Seconds float64 `json:"seconds,omitempty"`
+}
+
+// JobsQuery is the filter of GET /api/jobs and of WebSocket jobs messages.
+// Status and Fields are comma separated lists.
+type JobsQuery struct {
+	Status string `json:"status,omitempty"`
+	Kind   string `json:"kind,omitempty"`
+	// Path keeps jobs whose source path starts with it
+	Path   string `json:"path,omitempty"`
+	Since  string `json:"since,omitempty"`
+	Until  string `json:"until,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	Fields string `json:"fields,omitempty"`
+}
+
+// maxSubscribeJobs bounds the jobs of one WebSocket subscribe message
+const maxSubscribeJobs = 100
+
+// SubscribeRequest is the data of WebSocket subscribe messages
+type SubscribeRequest struct {
+	JobIDs []string `json:"jobIds"`
+}
+
+func (r *SubscribeRequest) Validate() error {
+	if len(r.JobIDs) == 0 {
+		return fmt.Errorf("jobIds is required")
+	}
+	if len(r.JobIDs) > maxSubscribeJobs {
+		return fmt.Errorf("at most %d jobIds per message", maxSubscribeJobs)
+	}
+	for _, id := range r.JobIDs {
+		if id == "" {
+			return fmt.Errorf("empty job ID")
+		}
+	}
+	return nil
+}
+
+// JobsPage is a page of job history records
+type JobsPage struct {
+	Jobs       []interface{} `json:"jobs"`
+	NextCursor string        `json:"nextCursor,omitempty"`
 }
 
+// webhookEchoLimit is how many requests the webhook echo endpoint remembers
+const webhookEchoLimit = 20
+
+// jobLogPollInterval is how often a followed job log is checked for output
+const jobLogPollInterval = 500 * time.Millisecond
+
+// mediaServerTimeout bounds the refresh of one media server
+const mediaServerTimeout = time.Minute
+
+// maxWebhookBody caps the size of an incoming Sonarr/Radarr payload
+const maxWebhookBody = 1 << 20
+
+// restartExitDelay is how long a rebuild waits before exiting for a restart
+const restartExitDelay = time.Second
+
+// previewSlots bounds the previews generated at the same time
+var previewSlots = make(chan struct{}, 2)
+
+// trashPurgeInterval is how often originals past the trash retention are
+// deleted
+const trashPurgeInterval = time.Hour
+
+// Stages of a video job around the optimization, which reports its own
+// stages (mediaopt.StageProbe and following)
+const (
+	stageDownload = "download"
+	stageStageIn  = "stage-in"
+	stageOptimize = "optimize"
+	stagePackage  = "package"
+	stageUpload   = "upload"
+	stageStageOut = "stage-out"
+	stageChecksum = "checksum"
+	stageReplace  = "replace"
+	stageRecipe   = "recipe"
+)
+
+// remoteTimeout bounds a metadata request to a storage remote, such as
+// listing a directory
+const remoteTimeout = 30 * time.Second
+
+// Directory listing and search result page sizes
+const (
+	defaultBrowseLimit = 500
+	maxBrowseLimit     = 5000
+)
+
+// folderStatsTTL is how long the media summaries of deep listings are
+// served before being computed again
+const folderStatsTTL = 10 * time.Minute
+
+// Job list page sizes
+const (
+	defaultJobsLimit = 50
+	maxJobsLimit     = 500
+)
+
 type RebuildResponse struct {
-	Status  string `json:"status"`
+	Status string `json:"status"`
+	// Mode is the deployment strategy handling the rebuild
+	Mode    string `json:"mode"`
 	Message string `json:"message"`
 	Error   string `json:"error,omitempty"`
 }
 
+// WSMessage is a message of the server on the /ws WebSocket; see
+// pkg/wsproto for those of clients
 type WSMessage struct {
-	Type     string      `json:"type"`
-	JobID    string      `json:"jobId"`
+	Type string `json:"type"`
+	// ID echoes the id of the client message replied to
+	ID    string `json:"id,omitempty"`
+	JobID string `json:"jobId,omitempty"`
+	// Path is the job's source path
+	Path     string      `json:"path,omitempty"`
 	Status   string      `json:"status,omitempty"`
 	Progress float64     `json:"progress,omitempty"`
 	Error    string      `json:"error,omitempty"`
 	Data     interface{} `json:"data,omitempty"`
+	// Speed, FPS, ETA and Elapsed (both in seconds) detail the progress of
+	// a running job
+	Speed   float64 `json:"speed,omitempty"`
+	FPS     float64 `json:"fps,omitempty"`
+	ETA     int     `json:"eta,omitempty"`
+	Elapsed int     `json:"elapsed,omitempty"`
+	// Code classifies an error reply, one of the wsproto codes
+	Code string `json:"code,omitempty"`
+}
+
+// wsConn is a WebSocket connection shared by its handler and the jobs it
+// started, which only one of may write to at a time
+type wsConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (c *wsConn) send(msg WSMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		slog.Warn("WebSocket write failed", "error", err)
+	}
+}
+
+// sendError replies to the client message id, about path if any, with an
+// error
+func (c *wsConn) sendError(id, path string, err error) {
+	msg := WSMessage{Type: "error", ID: id, Path: path, Status: "rejected", Error: err.Error(), Code: wsproto.CodeRejected}
+	var protoErr *wsproto.Error
+	if errors.As(err, &protoErr) {
+		msg.Code = protoErr.Code
+	}
+	c.send(msg)
 }
 
 var (
+	// upgrader only accepts browsers on pages of the server itself, as
+	// other sites' pages would otherwise act with the user's login. The
+	// host is the one forwarded by trusted proxies.
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow all origins for development
-		},
 	}
+	cfg             = config.Default()
+	excludes        *exclude.Rules // media never scanned, watched or optimized
+	jobStore        *jobstore.Store
+	jobEvents       *jobevents.Log    // audit trail of each job
+	trashStore      *trash.Store      // replaced originals kept for undo
+	quarantineStore *quarantine.Store // rejected outputs kept for review
+	proposalStore   *proposals.Store  // automated jobs awaiting approval
+	favoriteStore   *favorites.Store  // directories bookmarked in the file browser
+	uploadStore     *upload.Store     // files received over the API, nil without upload.dir
+	scanner         *libscan.Scanner
+	folderStats     *libscan.FolderCache // media summaries of deep listings
+	verifier        *checksum.Verifier   // re-hashes recorded outputs on demand
+	notifier        *notify.Notifier
+	deployment      rebuild.Strategy            // carries out /api/rebuild
+	workGate        *schedule.Gate              // holds jobs outside the schedule windows
+	resourceMonitor *resources.Monitor          // holds new jobs while the host is busy, nil if not monitored
+	startGate       *schedule.Gate              // holds new jobs while someone streams with sessions.action hold
+	gpus            *gpu.Pool                   // hardware encoder sessions, nil if none configured
+	mediaServers    []mediaserver.Refresher     // rescanned after each finished job
+	sessionServers  []mediaserver.SessionLister // polled for playback, see watchSessions
+	refreshes       sync.WaitGroup              // media server refreshes in flight
+	lowDiskSpace    int64                       // free bytes below which disk.low is sent
+	mounts          []netmount.Mount            // network shares holding media
+	ffmpegTools     *ffmpeg.Tools               // the ffmpeg in use, nil if none was found
+	remotes         map[string]remoteRoot       // storage remotes by name
+	// authenticator checks the users' logins and roles; it allows
+	// everything when no users are configured
+	authenticator *auth.Authenticator
+	// limiter bounds the rate of API requests and WebSocket messages per
+	// client IP, nil without a limit
+	limiter    *ratelimit.Limiter
 	activeJobs = struct {
 		sync.RWMutex
+		// jobs are keyed by job ID
 		jobs map[string]*OptimizationJob
+		// claimed are the paths of jobs being created, see claimPath
+		claimed map[string]bool
 	}{
-		jobs: make(map[string]*OptimizationJob),
+		jobs:    make(map[string]*OptimizationJob),
+		claimed: make(map[string]bool),
+	}
+	// undo serializes undo requests so one original isn't restored twice
+	undo sync.Mutex
+	// review serializes the approvals and rejections of quarantined outputs
+	// and proposals
+	review sync.Mutex
+	// batch counts the jobs finished since the queue was last empty
+	batch struct {
+		sync.Mutex
+		completed, failed int
+		diskLow           bool // disk.low was sent and space hasn't recovered
 	}
 )
 
 func main() {
-	staticContent, err := fs.Sub(staticFiles, "static")
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		serve(args)
+	case "optimize":
+		os.Exit(runOptimize(args))
+	case "scan":
+		os.Exit(runScan(args))
+	case "hash-password":
+		os.Exit(runHashPassword(args))
+	case "api-key":
+		os.Exit(runAPIKey(args))
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", command)
+		usage()
+		os.Exit(2)
+	}
+}
+
+// setup loads the config and opens the state shared by the server and the
+// command line, logging to console. The returned closer closes the log file.
+func setup(console io.Writer) io.Closer {
+	loaded, err := config.Load(config.Path())
 	if err != nil {
 		log.Fatal(err)
 	}
+	cfg = loaded
+	// The globs were validated with the config
+	excludes, _ = exclude.New(cfg.Exclude)
 
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticContent))))
-	http.HandleFunc("/", handleHome)
-	http.HandleFunc("/ws", handleWebSocket)
-	http.HandleFunc("/api/browse", handleBrowse)
-	http.HandleFunc("/api/optimize", handleOptimize)
-	http.HandleFunc("/api/rebuild", handleRebuild)
-
-	port := 8080
-	log.Printf("Server starting on port %d...\n", port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
+	logFile := cfg.Logging.File
+	if logFile == "" {
+		logFile = mediaopt.DefaultLogFile()
+	}
+	logger, closer, err := logging.New(logging.Options{
+		Level:      cfg.Logging.Level,
+		Format:     cfg.Logging.Format,
+		Console:    console,
+		File:       logFile,
+		MaxSize:    int64(cfg.Logging.MaxSizeMB) << 20,
+		MaxAge:     time.Duration(cfg.Logging.MaxAgeHours) * time.Hour,
+		MaxBackups: cfg.Logging.MaxBackups,
+	})
+	if err != nil {
 		log.Fatal(err)
 	}
-}
+	// Also routes the standard log package through the logger
+	slog.SetDefault(logger)
 
-func handleHome(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFS(staticFiles, "static/index.html"))
-	tmpl.Execute(w, nil)
-}
+	if err := videoEncoding(cfg.Video).Validate(); err != nil {
+		log.Fatalf("Invalid video config: %v", err)
+	}
+	if err := audioEncoding(cfg.Audio).Validate(); err != nil {
+		log.Fatalf("Invalid audio config: %v", err)
+	}
+	if err := processPriority(cfg.Priority).Validate(); err != nil {
+		log.Fatalf("Invalid priority config: %v", err)
+	}
+	if cfg.OutputName != "" {
+		if _, err := mediaopt.ParseOutputName(cfg.OutputName); err != nil {
+			log.Fatalf("Invalid outputName: %v", err)
+		}
+	}
+	if err := mediaopt.ValidateRenditions(ladderRenditions(cfg.Ladder)); err != nil {
+		log.Fatalf("Invalid ladder config: %v", err)
+	}
+	for name, profile := range cfg.Profiles {
+		if profile.Video != nil {
+			if err := videoEncoding(*profile.Video).Validate(); err != nil {
+				log.Fatalf("Invalid video config in profile %q: %v", name, err)
+			}
+		}
+		if profile.Audio != nil {
+			if err := audioEncoding(*profile.Audio).Validate(); err != nil {
+				log.Fatalf("Invalid audio config in profile %q: %v", name, err)
+			}
+		}
+		if profile.Priority != nil {
+			if err := processPriority(*profile.Priority).Validate(); err != nil {
+				log.Fatalf("Invalid priority config in profile %q: %v", name, err)
+			}
+		}
+		if profile.OutputName != "" {
+			if _, err := mediaopt.ParseOutputName(profile.OutputName); err != nil {
+				log.Fatalf("Invalid outputName in profile %q: %v", name, err)
+			}
+		}
+		if profile.Filters != nil {
+			if err := videoFilters(*profile.Filters).Validate(); err != nil {
+				log.Fatalf("Invalid filters in profile %q: %v", name, err)
+			}
+		}
+		if profile.FFmpegArgs != nil {
+			if err := customArgs(*profile.FFmpegArgs).Validate(); err != nil {
+				log.Fatalf("Invalid ffmpegArgs in profile %q: %v", name, err)
+			}
+		}
+	}
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	throttle.Configure(cfg.Throttle.ReadMBps*1e6, cfg.Throttle.WriteMBps*1e6)
+
+	jobStore, err = jobstore.Open(filepath.Join(cfg.DataDir, "jobs.json"))
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
-		return
+		log.Fatal(err)
+	}
+	jobEvents, err = jobevents.Open(filepath.Join(cfg.DataDir, "events.jsonl"))
+	if err != nil {
+		log.Fatal(err)
 	}
-	defer conn.Close()
 
-	// Handle incoming messages
-	for {
-		_, message, err := conn.ReadMessage()
+	trashDir := cfg.Trash.Dir
+	if trashDir == "" {
+		trashDir = filepath.Join(cfg.DataDir, "trash")
+	}
+	trashStore, err = trash.Open(trashDir, time.Duration(cfg.Trash.RetentionDays)*24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	quarantineDir := cfg.Quarantine.Dir
+	if quarantineDir == "" {
+		quarantineDir = filepath.Join(cfg.DataDir, "quarantine")
+	}
+	quarantineStore, err = quarantine.Open(quarantineDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proposalStore, err = proposals.Open(filepath.Join(cfg.DataDir, "proposals.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	favoriteStore, err = favorites.Open(filepath.Join(cfg.DataDir, "favorites.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Upload.Dir != "" {
+		uploadStore, err = upload.Open(cfg.Upload.Dir, time.Duration(cfg.Upload.ExpireHours)*time.Hour)
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
-			}
-			break
+			log.Fatal(err)
 		}
+	}
 
-		// Parse the incoming message
-		var msg WSMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("Failed to parse WebSocket message: %v", err)
-			continue
+	notifier, err = notify.New(cfg.Notify.Targets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Notify.LowDiskSpace != "" {
+		if lowDiskSpace, err = mediaopt.ParseSize(cfg.Notify.LowDiskSpace); err != nil {
+			log.Fatalf("Invalid notify.lowDiskSpace: %v", err)
 		}
-
-		// Handle different message types
-		switch msg.Type {
-		case "optimize":
-			handleOptimizationRequest(conn, msg.Data.(map[string]interface{})["path"].(string))
+	}
+	if cfg.Plex.URL != "" {
+		plex := mediaserver.NewPlex(cfg.Plex.URL, cfg.Plex.Token)
+		mediaServers = append(mediaServers, plex)
+		sessionServers = append(sessionServers, plex)
+	}
+	if cfg.Jellyfin.URL != "" {
+		server, err := mediaserver.NewJellyfin(cfg.Jellyfin.Type, cfg.Jellyfin.URL, cfg.Jellyfin.APIKey, cfg.Jellyfin.DeleteTrickplay)
+		if err != nil {
+			log.Fatal(err)
 		}
+		mediaServers = append(mediaServers, server)
+		sessionServers = append(sessionServers, server)
 	}
-}
 
-func handleOptimizationRequest(conn *websocket.Conn, path string) {
-	// Create new optimization job
-	job := &OptimizationJob{
-		SourcePath: path,
-		Status:     "queued",
-		Progress:   0,
-		WSConn:     conn,
+	if len(cfg.GPUs) > 0 {
+		if gpus, err = gpu.NewPool(cfg.GPUs); err != nil {
+			log.Fatal(err)
+		}
 	}
+	locateFFmpeg()
 
-	// Store job
-	activeJobs.Lock()
-	activeJobs.jobs[path] = job
-	activeJobs.Unlock()
+	for _, m := range cfg.Network.Mounts {
+		mount := netmount.Mount{Path: m.Path, Type: m.Type, Timeout: time.Duration(m.TimeoutSeconds) * time.Second}
+		if err := mount.Check(); err != nil {
+			slog.Warn("Network share unavailable", "path", m.Path, "error", err)
+		}
+		mounts = append(mounts, mount)
+	}
 
-	// Start optimization in background
-	go optimizeMedia(job)
+	remotes = make(map[string]remoteRoot)
+	for _, r := range cfg.Storage.Remotes {
+		backend, err := newBackend(r)
+		if err != nil {
+			log.Fatalf("Invalid storage remote %q: %v", r.Name, err)
+		}
+		remotes[r.Name] = remoteRoot{backend: backend, typ: r.Type, deleteOriginal: r.DeleteOriginal}
+	}
 
-	// Send initial status
-	sendWSUpdate(job, "status", 0)
+	scanner = libscan.NewScanner(scanOptions(cfg.MediaRoots))
+	folderStats = libscan.NewFolderCache(scanOptions(nil), folderStatsTTL)
+	verifier = checksum.NewVerifier(cfg.Checksums.VerifyWorkers, reportChecksumProblems)
+	return closer
 }
 
-func sendWSUpdate(job *OptimizationJob, msgType string, progress float64) {
-	if job.WSConn == nil {
-		return
+// newBackend creates the client of a storage remote
+func newBackend(r config.Remote) (storage.Backend, error) {
+	switch r.Type {
+	case storage.TypeSFTP:
+		if _, err := exec.LookPath("ssh"); err != nil {
+			slog.Warn("SFTP remotes need the ssh client, which was not found", "remote", r.Name)
+		}
+		return storage.NewSFTP(storage.SFTPOptions{
+			Host:     r.Host,
+			Port:     r.Port,
+			Username: r.Username,
+			KeyFile:  r.KeyFile,
+			Dir:      r.Dir,
+		})
+	case storage.TypeWebDAV:
+		return storage.NewWebDAV(storage.WebDAVOptions{
+			URL:      r.Endpoint,
+			Username: r.Username,
+			Password: r.Password,
+		})
 	}
+	return storage.NewS3(storage.S3Options{
+		Endpoint:  r.Endpoint,
+		Region:    r.Region,
+		Bucket:    r.Bucket,
+		Prefix:    r.Prefix,
+		AccessKey: r.AccessKey,
+		SecretKey: r.SecretKey,
+	})
+}
 
-	// Lock the WebSocket for writing
-	job.wsMutex.Lock()
-	defer job.wsMutex.Unlock()
-
-	msg := WSMessage{
-		Type:     msgType,
-		JobID:    job.SourcePath,
-		Status:   job.Status,
-		Progress: progress,
-		Error:    job.Error,
+// lookupRemote returns the remote a path points into. A path naming another
+// storage type than the remote's is rejected, so that "sftp://media/..."
+// can't reach an S3 remote called media.
+func lookupRemote(path storage.Path) (remoteRoot, error) {
+	remote, ok := remotes[path.Root]
+	if !ok {
+		return remoteRoot{}, fmt.Errorf("unknown storage remote: %s", path.Root)
 	}
-
-	if err := job.WSConn.WriteJSON(msg); err != nil {
-		log.Printf("WebSocket write error: %v", err)
+	if remote.typ != path.Type {
+		return remoteRoot{}, fmt.Errorf("storage remote %s is %s, not %s", path.Root, remote.typ, path.Type)
 	}
+	return remote, nil
 }
 
-func handleRebuild(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// locateFFmpeg finds ffmpeg and puts it first in PATH for the encode
+// processes. A missing or unusable ffmpeg is logged rather than fatal so the
+// web interface still starts and shows the failing jobs.
+func locateFFmpeg() {
+	downloadDir := cfg.FFmpeg.DownloadDir
+	if downloadDir == "" {
+		downloadDir = filepath.Join(cfg.DataDir, "bin")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	tools, err := ffmpeg.Locate(ctx, ffmpeg.Options{
+		Dir:         cfg.FFmpeg.Dir,
+		Download:    cfg.FFmpeg.Download,
+		DownloadDir: downloadDir,
+		SHA256:      cfg.FFmpeg.DownloadSHA256,
+		Unverified:  cfg.FFmpeg.DownloadUnverified,
+	})
+	if err != nil {
+		slog.Error("ffmpeg is unavailable, jobs will fail", "error", err)
 		return
 	}
+	if err := tools.AddToPath(); err != nil {
+		slog.Warn("Failed to add ffmpeg to PATH", "dir", filepath.Dir(tools.FFmpeg), "error", err)
+	}
+	slog.Info("Using ffmpeg", "version", tools.Version, "ffmpeg", tools.FFmpeg, "ffprobe", tools.FFprobe)
+	ffmpegTools = tools
 
-	w.Header().Set("Content-Type", "application/json")
-
-	go func() {
-		result := rebuild.ExecuteRebuild()
+	if missing := tools.MissingEncoders(requiredEncoders()...); len(missing) > 0 {
+		slog.Warn("ffmpeg lacks configured encoders, jobs using them will fail", "missing", strings.Join(missing, ", "))
+	}
+}
 
-		if !result.Success {
-			log.Printf("Rebuild failed: %v", result.Error)
-		} else {
-			log.Printf("Rebuild completed: %s", result.Message)
+// requiredEncoders returns the ffmpeg encoders the configuration uses
+func requiredEncoders() []string {
+	encoders := []string{cfg.Video.Codec, audioEncoding(cfg.Audio).Encoder()}
+	for _, profile := range cfg.Profiles {
+		if profile.Video != nil && profile.Video.Codec != "" {
+			encoders = append(encoders, profile.Video.Codec)
 		}
-	}()
-
-	response := RebuildResponse{
-		Status:  "initiated",
-		Message: "Rebuild process has been initiated. Check logs for progress.",
+		if profile.Audio != nil {
+			encoders = append(encoders, audioEncoding(*profile.Audio).Encoder())
+		}
+	}
+	switch cfg.Images.Format {
+	case "avif":
+		encoders = append(encoders, "libaom-av1")
+	default:
+		encoders = append(encoders, "libwebp")
+	}
+	switch cfg.Music.Codec {
+	case "aac":
+		encoders = append(encoders, "aac")
+	case "mp3":
+		encoders = append(encoders, "libmp3lame")
+	default:
+		encoders = append(encoders, "libopus")
 	}
 
-	json.NewEncoder(w).Encode(response)
+	var unique []string
+	seen := make(map[string]bool)
+	for _, name := range encoders {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	return unique
 }
 
-func handleBrowse(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// scanOptions returns the library scan settings for roots
+func scanOptions(roots []string) libscan.Options {
+	return libscan.Options{
+		Roots:           roots,
+		Extensions:      cfg.AllowedExtensions,
+		HighBitrateKbps: cfg.Library.HighBitrateKbps,
+		Workers:         cfg.Library.ScanWorkers,
+		Exclude:         excludes,
 	}
+}
 
-	var request struct {
-		Path string `json:"path"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
+// serve runs the web server
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	port := flags.Int("port", 8080, "port to listen on")
+	flags.Parse(args)
 
-	if request.Path == "" {
-		request.Path = "/"
+	closer := setup(os.Stdout)
+	defer closer.Close()
+
+	// Kill encodes left running by a crashed or restarted instance
+	if n, err := mediaopt.SweepOrphans(); err != nil {
+		slog.Error("Orphan process sweep failed", "error", err)
+	} else if n > 0 {
+		slog.Info("Terminated orphaned processes from a previous instance", "count", n)
 	}
 
-	files, err := listFiles(request.Path)
+	var err error
+	deployment, err = rebuild.NewStrategy(cfg.Deploy.Mode, rebuild.DockerOptions{
+		Image:       cfg.Deploy.Image,
+		Tag:         cfg.Deploy.Tag,
+		RestartCode: cfg.Deploy.RestartCode,
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		log.Fatal(err)
 	}
+	slog.Info("Deployment mode", "mode", deployment.Name())
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(files)
-}
+	windows, err := schedule.New(cfg.Schedule.Windows)
+	if err != nil {
+		log.Fatal(err)
+	}
+	workGate = schedule.NewGate(windows, pauseJobs)
+	if !workGate.IsOpen() {
+		slog.Info("Outside the schedule windows, jobs wait until the next one", "opens", workGate.NextOpen())
+	}
+	go workGate.Run(context.Background())
+	if cfg.Resources.Enabled {
+		startResourceMonitor()
+	}
+	if cfg.Sessions.Enabled {
+		// Pausing blocks the work gate, which pauses running jobs with it
+		gate := workGate
+		if cfg.Sessions.Action == config.SessionsHold {
+			startGate = schedule.NewGate(nil, nil)
+			gate = startGate
+		}
+		go watchSessions(gate)
+	}
+	go purgeTrash()
+	startWatching()
 
-func handleOptimize(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	staticContent, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	var request struct {
-		Path string `json:"path"`
+	authenticator, err = auth.New(cfg.Auth.Users, cfg.Auth.APIKeys)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	if cfg.Limits.RequestsPerSecond > 0 {
+		limiter = ratelimit.New(cfg.Limits.RequestsPerSecond, cfg.Limits.Burst)
 	}
+	// API keys are for automation, so the UI only accepts users
+	viewer := func(h http.Handler) http.Handler { return authenticator.RequireUser(auth.Viewer, h) }
+	http.Handle("/static/", viewer(http.StripPrefix("/static/", http.FileServer(http.FS(staticContent)))))
+	http.Handle("/", viewer(http.HandlerFunc(handleHome)))
+	http.Handle("/ws", limiter.Handler(viewer(http.HandlerFunc(handleWebSocket))))
+	registerAPI(http.DefaultServeMux)
 
-	// Return success response for the HTTP request
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "optimization initiated",
-		"path":   request.Path,
-	})
-}
+	if cfg.GRPC.Address != "" {
+		go serveGRPC()
+	}
 
-func listFiles(path string) ([]FileInfo, error) {
-	var files []FileInfo
+	if err := listen(*port); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	entries, err := os.ReadDir(path)
-	if err != nil {
-		return nil, err
+// listen serves the UI and API on port, over HTTPS when a certificate or
+// ACME is configured
+func listen(port int) error {
+	handler := proxy.StripPrefix(cfg.Proxy.BasePath, http.DefaultServeMux)
+	if len(cfg.Proxy.TrustedProxies) > 0 {
+		trusted, err := proxy.NewTrusted(cfg.Proxy.TrustedProxies)
+		if err != nil {
+			return err
+		}
+		handler = trusted.Handler(handler)
 	}
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: handler}
+	redirect := cfg.TLS.RedirectAddress
 
-	for _, entry := range entries {
-		fullPath := filepath.Join(path, entry.Name())
-		files = append(files, FileInfo{
-			Name:  entry.Name(),
-			Path:  fullPath,
-			IsDir: entry.IsDir(),
+	switch {
+	case len(cfg.TLS.ACME.Domains) > 0:
+		cacheDir := cfg.TLS.ACME.CacheDir
+		if cacheDir == "" {
+			cacheDir = filepath.Join(cfg.DataDir, "acme")
+		}
+		manager, err := acme.NewManager(acme.Options{
+			DirectoryURL: cfg.TLS.ACME.DirectoryURL,
+			Email:        cfg.TLS.ACME.Email,
+			Domains:      cfg.TLS.ACME.Domains,
+			CacheDir:     cacheDir,
 		})
+		if err != nil {
+			return err
+		}
+		go manager.Run(context.Background())
+		if redirect == "" {
+			redirect = ":80"
+		}
+		go serveRedirect(redirect, manager.HTTPHandler(httpsRedirect(port)))
+		server.TLSConfig = &tls.Config{GetCertificate: manager.GetCertificate}
+		slog.Info("Server starting", "port", port, "tls", "acme", "domains", cfg.TLS.ACME.Domains)
+		return server.ListenAndServeTLS("", "")
+
+	case cfg.TLS.CertFile != "":
+		if redirect != "" {
+			go serveRedirect(redirect, httpsRedirect(port))
+		}
+		slog.Info("Server starting", "port", port, "tls", cfg.TLS.CertFile)
+		return server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
 	}
 
-	return files, nil
+	slog.Info("Server starting", "port", port)
+	return server.ListenAndServe()
 }
 
-func optimizeMedia(job *OptimizationJob) {
-	// Update job status
-	activeJobs.Lock()
-	job.Status = "processing"
-	activeJobs.Unlock()
-	sendWSUpdate(job, "status", 0)
+// serveRedirect serves plain HTTP on addr next to the HTTPS server
+func serveRedirect(addr string, handler http.Handler) {
+	slog.Info("Redirecting HTTP to HTTPS", "address", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// httpsRedirect sends requests to the same host and path on the HTTPS port
+func httpsRedirect(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+func handleHome(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFS(staticFiles, "static/index.html"))
+	tmpl.Execute(w, struct{ BasePath string }{cfg.Proxy.BasePath})
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("WebSocket upgrade failed", "error", err)
+		return
+	}
+	defer ws.Close()
+	// Larger messages close the connection
+	ws.SetReadLimit(cfg.Limits.MaxMessageBytes)
+	conn := &wsConn{conn: ws}
+	defer unsubscribeJobs(conn)
+	client := ratelimit.ClientIP(r)
+
+	// Handle incoming messages
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				slog.Warn("WebSocket error", "error", err)
+			}
+			break
+		}
+		if ok, _ := limiter.Allow(client); !ok {
+			conn.sendError("", "", &wsproto.Error{Code: wsproto.CodeRateLimited, Message: "too many messages, slow down"})
+			continue
+		}
+
+		req, err := wsproto.Parse(message)
+		if err != nil {
+			slog.Warn("Invalid WebSocket message", "client", client, "error", err)
+			id := ""
+			if req != nil {
+				id = req.ID
+			}
+			conn.sendError(id, "", err)
+			continue
+		}
+		handleWSRequest(r, conn, req)
+	}
+}
+
+// handleWSRequest answers a valid client message. A panic fails only the
+// message, not the connection.
+func handleWSRequest(r *http.Request, conn *wsConn, req *wsproto.Request) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("WebSocket message handler panicked", "type", req.Type, "panic", p, "stack", string(debug.Stack()))
+			conn.sendError(req.ID, "", &wsproto.Error{Code: wsproto.CodeInternal, Message: "internal error"})
+		}
+	}()
+
+	switch req.Type {
+	case wsproto.TypeOptimize:
+		var request OptimizeRequest
+		if err := req.Decode(&request); err != nil {
+			conn.sendError(req.ID, "", err)
+			return
+		}
+		if !authenticator.Allowed(r.Context(), auth.Operator) {
+			conn.sendError(req.ID, request.Path, &wsproto.Error{Code: wsproto.CodeForbidden, Message: "starting jobs requires the operator role"})
+			return
+		}
+		request.user, _ = auth.FromContext(r.Context())
+		request.origin = "websocket"
+		if _, err := enqueueJob(request, conn); err != nil {
+			slog.Info("Rejected optimization request", "path", request.Path, "error", err)
+			var conflict *jobConflictError
+			if errors.As(err, &conflict) {
+				err = &wsproto.Error{Code: wsproto.CodeConflict, Message: err.Error()}
+			}
+			conn.sendError(req.ID, request.Path, err)
+		}
+	case wsproto.TypeJobs:
+		// All filters are optional, so is the data
+		var query JobsQuery
+		if len(req.Data) > 0 {
+			if err := req.Decode(&query); err != nil {
+				conn.sendError(req.ID, "", err)
+				return
+			}
+		}
+		page, err := queryJobs(query)
+		if err != nil {
+			conn.sendError(req.ID, "", err)
+			return
+		}
+		conn.send(WSMessage{Type: "jobs", ID: req.ID, Data: page})
+	case wsproto.TypeSubscribe:
+		var request SubscribeRequest
+		if err := req.Decode(&request); err != nil {
+			conn.sendError(req.ID, "", err)
+			return
+		}
+		subscribeJobs(conn, req.ID, request.JobIDs)
+	}
+}
 
-	// Create optimization parameters with progress callback
-	params := mediaopt.NewDefaultParams(job.SourcePath)
-	params.OnProgress = func(progress float64) {
+// subscribeJobs attaches conn to the jobs with ids, such as those a client
+// started before it reconnected, and sends each one's latest state. Jobs
+// that already finished are answered from the job history, unknown ones
+// with a not_found error.
+func subscribeJobs(conn *wsConn, id string, ids []string) {
+	for _, jobID := range ids {
 		activeJobs.Lock()
-		job.Progress = int(progress)
+		job, ok := activeJobs.jobs[jobID]
+		var msg WSMessage
+		if ok {
+			if job.WSConn != conn && !subscribed(job, conn) {
+				job.subscribers = append(job.subscribers, conn)
+			}
+			msg = jobUpdate(job, "status", float64(job.Progress))
+		}
 		activeJobs.Unlock()
-		sendWSUpdate(job, "progress", progress)
+		if ok {
+			msg.ID = id
+			conn.send(msg)
+			continue
+		}
+
+		record, ok := jobStore.Get(jobID)
+		if !ok {
+			conn.sendError(id, "", &wsproto.Error{Code: wsproto.CodeNotFound, Message: fmt.Sprintf("no job %s", jobID)})
+			continue
+		}
+		msg = WSMessage{Type: "status", ID: id, JobID: record.ID, Path: record.SourcePath, Status: record.Status, Error: record.Error}
+		if record.Status == "completed" {
+			msg.Progress = 100
+		}
+		conn.send(msg)
 	}
+}
 
-	// Perform optimization
-	result := mediaopt.OptimizeMedia(params)
+// unsubscribeJobs detaches a closed connection from the jobs it subscribed
+// to
+func unsubscribeJobs(conn *wsConn) {
+	activeJobs.Lock()
+	defer activeJobs.Unlock()
+	for _, job := range activeJobs.jobs {
+		for i, c := range job.subscribers {
+			if c == conn {
+				job.subscribers = append(job.subscribers[:i], job.subscribers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// subscribed reports whether conn follows the job. The caller holds
+// activeJobs.
+func subscribed(job *OptimizationJob, conn *wsConn) bool {
+	for _, c := range job.subscribers {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueueJob validates the request and starts its job in the background.
+// Progress is reported on conn, which may be nil for jobs started without a
+// client such as webhook imports.
+func enqueueJob(request OptimizeRequest, conn *wsConn) (*OptimizationJob, error) {
+	job, err := newJob(request, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start optimization in background once the schedule and the host's
+	// resources allow it
+	go func() {
+		waitForSchedule(job)
+		waitForStreams(job)
+		waitForResources(job)
+		runJob(job)
+	}()
+
+	// Send initial status
+	sendWSUpdate(job, "status", 0)
+	return job, nil
+}
+
+// newJob validates the request, records it in the job history and registers
+// it as an active job without starting it
+func newJob(request OptimizeRequest, conn *wsConn) (*OptimizationJob, error) {
+	// Reject unsupported files before a job is created
+	kind, err := validateRequest(&request)
+	if err != nil {
+		return nil, err
+	}
+	path := request.Path
+	if err := claimPath(path); err != nil {
+		return nil, err
+	}
+	defer releasePath(path)
+	estimate, err := checkCost(request, kind)
+	if err != nil {
+		return nil, err
+	}
 
-	// Update job status based on result
+	// The job's ID is its history record's, so a job that can't be
+	// recorded can't be created
+	record, err := jobStore.Create(path, kind)
+	if err != nil {
+		slog.Error("Failed to record job", "path", path, "error", err)
+		return nil, fmt.Errorf("%w: %v", errRecordJob, err)
+	}
+
+	// Create new optimization job
+	job := &OptimizationJob{
+		SourcePath: path,
+		Kind:       kind,
+		Status:     "queued",
+		Progress:   0,
+		Streams:    request.Streams,
+		WSConn:     conn,
+		ID:         record.ID,
+		request:    request,
+	}
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	if kind == KindRemux {
+		job.Container = request.Container
+	}
+	if request.TargetSize != "" {
+		job.TargetSize, _ = mediaopt.ParseSize(request.TargetSize)
+	}
+	job.Packaging = request.Packaging
+	if encodesVideo(kind) {
+		job.Profile = requestProfile(request)
+	}
+	library, _ := mediapath.New(path, cfg.MediaRoots)
+	libraryName := library.Library()
+	if remotePath, ok, _ := storage.ParsePath(path); ok {
+		libraryName = remotePath.Root
+	}
+	updateHistory(job, func(r *jobstore.Record) {
+		r.User = request.user.Name
+		r.Library = libraryName
+		r.Profile = job.Profile
+		r.Cost = estimate
+	})
+	recordEvent(job.ID, jobevents.TypeCreated, request.user.Name, request.origin)
+
+	// Store job, replacing the finished runs of the path so the map keeps
+	// the latest job of each path
 	activeJobs.Lock()
-	if result.Success {
-		job.Status = "completed"
-		job.Progress = 100
-	} else {
-		job.Status = "failed"
-		job.Error = result.Error.Error()
+	for id, other := range activeJobs.jobs {
+		if other.SourcePath == path && jobFinished(other.Status) {
+			delete(activeJobs.jobs, id)
+		}
 	}
+	activeJobs.jobs[job.ID] = job
 	activeJobs.Unlock()
+	return job, nil
+}
 
-	// Final status update
-	sendWSUpdate(job, "status", float64(job.Progress))
+// jobConflictError rejects a job for a path that already has an unfinished
+// job, as both would write the same output
+type jobConflictError struct {
+	path string
+	// id is the existing job's history ID, empty while it is being created
+	id string
+}
 
-	// Log the result
-	if result.Success {
-		log.Printf("Successfully optimized media: %s", job.SourcePath)
+func (e *jobConflictError) Error() string {
+	if e.id == "" {
+		return fmt.Sprintf("a job for %s is already being queued", e.path)
+	}
+	return fmt.Sprintf("job %s for %s is already queued or running", e.id, e.path)
+}
+
+// claimPath reserves path for a job being created until releasePath, or
+// returns a *jobConflictError if it has an unfinished job or is claimed
+func claimPath(path string) error {
+	activeJobs.Lock()
+	defer activeJobs.Unlock()
+	for _, job := range activeJobs.jobs {
+		if job.SourcePath == path && !jobFinished(job.Status) {
+			return &jobConflictError{path: path, id: job.ID}
+		}
+	}
+	if activeJobs.claimed[path] {
+		return &jobConflictError{path: path}
+	}
+	activeJobs.claimed[path] = true
+	return nil
+}
+
+func releasePath(path string) {
+	activeJobs.Lock()
+	delete(activeJobs.claimed, path)
+	activeJobs.Unlock()
+}
+
+// jobFinished reports whether a job in status is over and won't run again
+func jobFinished(status string) bool {
+	return status == "completed" || status == "failed" || status == "attention" || status == "cancelled" || status == "undone" ||
+		status == "quarantined" || status == "discarded" || status == "timed-out"
+}
+
+// unfinishedJobs counts the jobs that are queued, running or waiting to retry
+func unfinishedJobs() int {
+	activeJobs.RLock()
+	defer activeJobs.RUnlock()
+	n := 0
+	for _, job := range activeJobs.jobs {
+		if !jobFinished(job.Status) {
+			n++
+		}
+	}
+	return n
+}
+
+// waitForSchedule blocks a queued job until the schedule window opens and
+// the queue isn't paused, or the job is cancelled
+func waitForSchedule(job *OptimizationJob) {
+	if workGate == nil || workGate.IsOpen() {
+		return
+	}
+	if workGate.Held() {
+		slog.Info("Job waiting for the queue to be resumed", "job", job.ID, "path", job.SourcePath)
+	} else if blocks := workGate.Blocks(); len(blocks) > 0 {
+		slog.Info("Job waiting", "job", job.ID, "path", job.SourcePath, "for", strings.Join(blocks, ", "))
 	} else {
-		log.Printf("Failed to optimize media: %s, Error: %v", job.SourcePath, result.Error)
+		slog.Info("Job waiting for the schedule window", "job", job.ID, "path", job.SourcePath, "opens", workGate.NextOpen())
+	}
+	workGate.Wait(job.ctx)
+}
+
+// blockStreaming is the reason the work is blocked for while someone
+// streams from a media server
+const blockStreaming = "streaming"
+
+// streams are the playback sessions the work last made way for
+var streams struct {
+	sync.Mutex
+	sessions []mediaserver.Session
+}
+
+// watchSessions polls the media servers for playback and blocks gate while
+// anyone streams, lifting the block once nobody has for
+// sessions.resumeAfterSeconds
+func watchSessions(gate *schedule.Gate) {
+	resumeAfter := time.Duration(cfg.Sessions.ResumeAfterSeconds) * time.Second
+	ticker := time.NewTicker(time.Duration(cfg.Sessions.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	failing := map[string]bool{}
+	var blocked bool
+	var lastSeen time.Time
+	for {
+		sessions := pollSessions(failing)
+		streams.Lock()
+		streams.sessions = sessions
+		streams.Unlock()
+
+		switch {
+		case len(sessions) > 0:
+			lastSeen = time.Now()
+			if !blocked {
+				blocked = true
+				s := sessions[0]
+				slog.Info("Media server streaming, making way", "server", s.Server, "user", s.User, "title", s.Title, "streams", len(sessions), "action", cfg.Sessions.Action)
+				gate.Block(blockStreaming, true)
+			}
+		case blocked && time.Since(lastSeen) >= resumeAfter:
+			blocked = false
+			slog.Info("Media server streams ended, resuming work")
+			gate.Block(blockStreaming, false)
+		}
+		<-ticker.C
+	}
+}
+
+// pollSessions returns the streams of every media server that count under
+// sessions.transcodesOnly. A server that can't be asked counts as idle, and
+// its failure is logged once until it answers again.
+func pollSessions(failing map[string]bool) []mediaserver.Session {
+	var counted []mediaserver.Session
+	for _, server := range sessionServers {
+		ctx, cancel := context.WithTimeout(context.Background(), mediaServerTimeout)
+		sessions, err := server.Sessions(ctx)
+		cancel()
+		if err != nil {
+			if !failing[server.Name()] {
+				slog.Warn("Failed to list media server sessions", "server", server.Name(), "error", err)
+			}
+			failing[server.Name()] = true
+			continue
+		}
+		delete(failing, server.Name())
+		for _, s := range sessions {
+			if s.Transcoding || !cfg.Sessions.TranscodesOnly {
+				counted = append(counted, s)
+			}
+		}
+	}
+	return counted
+}
+
+// waitForStreams blocks a queued job while new jobs make way for people
+// streaming, with sessions.action hold, or until the job is cancelled
+func waitForStreams(job *OptimizationJob) {
+	if startGate == nil || startGate.IsOpen() {
+		return
+	}
+	slog.Info("Job waiting for media server streams to end", "job", job.ID, "path", job.SourcePath)
+	startGate.Wait(job.ctx)
+}
+
+// startResourceMonitor samples the host's resources in the background for
+// waitForResources. Jobs aren't held back where they can't be sampled.
+func startResourceMonitor() {
+	limits := resources.Limits{
+		CPU:    cfg.Resources.MaxCPUPercent / 100,
+		Memory: cfg.Resources.MaxMemoryPercent / 100,
+		Disk:   cfg.Resources.MaxDiskPercent / 100,
+	}
+	interval := time.Duration(cfg.Resources.IntervalSeconds) * time.Second
+	monitor, err := resources.NewMonitor(limits, interval, func(pressure []string) {
+		if len(pressure) > 0 {
+			slog.Info("Host under pressure, holding new jobs back", "pressure", strings.Join(pressure, ", "))
+		} else {
+			slog.Info("Host no longer under pressure, starting waiting jobs")
+		}
+	})
+	if err != nil {
+		slog.Warn("Resource monitoring unavailable, jobs start regardless of load", "error", err)
+		return
+	}
+	resourceMonitor = monitor
+	go resourceMonitor.Run(context.Background())
+}
+
+// waitForResources blocks a queued job while the host is under pressure, or
+// until the job is cancelled
+func waitForResources(job *OptimizationJob) {
+	if resourceMonitor.UnderPressure() {
+		_, pressure := resourceMonitor.Latest()
+		slog.Info("Job waiting for resources", "job", job.ID, "path", job.SourcePath, "pressure", strings.Join(pressure, ", "))
+	}
+	resourceMonitor.Wait(job.ctx)
+}
+
+// pauseJobs stops the encoders of running jobs when the schedule window
+// closes or the queue is paused, and continues them when work may go on
+func pauseJobs(open bool) {
+	switch {
+	case open:
+		slog.Info("Resuming jobs")
+	case workGate.Held():
+		slog.Info("Queue paused, pausing running jobs")
+	case len(workGate.Blocks()) > 0:
+		slog.Info("Pausing running jobs", "for", strings.Join(workGate.Blocks(), ", "))
+	default:
+		slog.Info("Schedule window closed, pausing running jobs", "opens", workGate.NextOpen())
+	}
+	if err := mediaopt.SetPaused(!open); err != nil {
+		slog.Error("Failed to pause or resume jobs", "error", err)
+	}
+
+	from, to := "processing", "paused"
+	if open {
+		from, to = to, from
+	}
+	var changed []*OptimizationJob
+	var progress []float64
+	activeJobs.Lock()
+	for _, job := range activeJobs.jobs {
+		if job.Status == from && pausable(job) {
+			job.Status = to
+			changed = append(changed, job)
+			progress = append(progress, float64(job.Progress))
+		}
+	}
+	activeJobs.Unlock()
+	for i, job := range changed {
+		sendWSUpdate(job, "status", progress[i])
+		if job.log != nil {
+			job.log.Printf("Job %s", to)
+		}
+	}
+}
+
+// pausable reports whether the job's encoders are paused outside the
+// schedule. Image and music jobs run many short encodes that aren't tracked.
+func pausable(job *OptimizationJob) bool {
+	return encodesVideo(job.Kind)
+}
+
+// encodesVideo reports whether jobs of kind run the video pipeline
+func encodesVideo(kind string) bool {
+	return kind == KindVideo || kind == KindRemux || kind == KindLadder
+}
+
+// runJob runs the job to completion
+func runJob(job *OptimizationJob) {
+	for attempt := 1; ; attempt++ {
+		if job.ctx.Err() != nil {
+			// Cancelled while queued
+			finishJob(job, errJobCancelled, nil)
+			return
+		}
+		activeJobs.Lock()
+		job.Attempt = attempt
+		activeJobs.Unlock()
+		if err := jobMountError(job); err != nil {
+			// Fail right away rather than block on the share
+			startJob(job)
+			finishJob(job, err, nil)
+		} else {
+			switch job.Kind {
+			case KindImage:
+				optimizeImages(job)
+			case KindAudio:
+				transcodeMusic(job)
+			case KindLadder:
+				encodeLadder(job)
+			default:
+				optimizeMedia(job)
+			}
+		}
+
+		activeJobs.RLock()
+		retryable := job.Status == "retryable"
+		activeJobs.RUnlock()
+		if !retryable {
+			return
+		}
+		delay := retryDelay(attempt)
+		slog.Warn("Retrying job after transient failure", "job", job.ID, "path", job.SourcePath, "attempt", attempt, "in", delay, "error", job.Error)
+		recordEvent(job.ID, jobevents.TypeRetry, "", fmt.Sprintf("attempt %d in %v after: %s", attempt+1, delay, job.Error))
+		select {
+		case <-time.After(delay):
+		case <-job.ctx.Done():
+		}
+		activeJobs.Lock()
+		job.Status, job.Error, job.Progress = "queued", "", 0
+		activeJobs.Unlock()
+		sendWSUpdate(job, "status", 0)
+		waitForSchedule(job)
+		waitForStreams(job)
+		waitForResources(job)
+	}
+}
+
+// retryDelay returns the wait after the given attempt, doubling from
+// retry.backoffSeconds up to retry.maxBackoffSeconds
+func retryDelay(attempt int) time.Duration {
+	delay := time.Duration(cfg.Retry.BackoffSeconds) * time.Second
+	limit := time.Duration(cfg.Retry.MaxBackoffSeconds) * time.Second
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	return min(delay, limit)
+}
+
+// transient reports whether a job error may not happen again on a rerun,
+// unlike e.g. an unsupported codec or a missing file
+func transient(err error) bool {
+	var shareErr *shareError
+	switch {
+	case errors.As(err, &shareErr),
+		errors.Is(err, mediaopt.ErrTransient),
+		errors.Is(err, storage.ErrUnavailable):
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.ESTALE, syscall.EAGAIN, syscall.ECONNRESET, syscall.ETIMEDOUT} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchJob returns a channel signalled after updates of the job and a
+// function to stop watching. Signals are coalesced, so a slow watcher only
+// sees the latest state.
+func watchJob(job *OptimizationJob) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	activeJobs.Lock()
+	job.watchers = append(job.watchers, ch)
+	activeJobs.Unlock()
+	return ch, func() {
+		activeJobs.Lock()
+		defer activeJobs.Unlock()
+		for i, c := range job.watchers {
+			if c == ch {
+				job.watchers = append(job.watchers[:i], job.watchers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// shareError is a job failure while the network share holding the job's
+// files was unavailable
+type shareError struct {
+	err error
+}
+
+func (e *shareError) Error() string {
+	return "network share unavailable: " + e.err.Error()
+}
+
+// jobMountError checks the network share holding the job's source, if any,
+// and returns a *shareError when it is unavailable
+func jobMountError(job *OptimizationJob) error {
+	mount, ok := netmount.Find(mounts, job.SourcePath)
+	if !ok {
+		return nil
+	}
+	if err := mount.Check(); err != nil {
+		return &shareError{err: err}
+	}
+	return nil
+}
+
+func sendWSUpdate(job *OptimizationJob, msgType string, progress float64) {
+	activeJobs.RLock()
+	for _, ch := range job.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// A signal is pending already
+		}
+	}
+	conns := append([]*wsConn{}, job.subscribers...)
+	if job.WSConn != nil {
+		conns = append(conns, job.WSConn)
+	}
+	var msg WSMessage
+	if len(conns) > 0 {
+		msg = jobUpdate(job, msgType, progress)
+	}
+	activeJobs.RUnlock()
+
+	for _, conn := range conns {
+		conn.send(msg)
+	}
+}
+
+// jobUpdate describes the state of the job in a WebSocket message of
+// msgType, at progress. The caller must hold activeJobs, as the job's
+// renditions and timing change while it runs.
+func jobUpdate(job *OptimizationJob, msgType string, progress float64) WSMessage {
+	msg := WSMessage{
+		Type:     msgType,
+		JobID:    job.ID,
+		Path:     job.SourcePath,
+		Status:   job.Status,
+		Progress: progress,
+		Error:    job.Error,
+	}
+	if len(job.Renditions) > 0 {
+		msg.Data = append([]RenditionStatus{}, job.Renditions...)
+	} else if job.Stage != "" && job.Status == "processing" {
+		msg.Data = StageStatus{Stage: job.Stage, Progress: progress}
+	}
+	if msgType == "progress" || job.Status == "processing" {
+		msg.Speed, msg.FPS = job.Speed, job.FPS
+		msg.Elapsed, msg.ETA = jobTiming(job, progress)
+	}
+	return msg
+}
+
+// handleRebuild updates and restarts the server. It refuses while jobs are
+// queued or running, as the restart would kill their encodes.
+func handleRebuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if n := unfinishedJobs(); n > 0 {
+		http.Error(w, fmt.Sprintf("%d jobs are queued or running; wait for them or cancel them before rebuilding", n), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	go func() {
+		result := deployment.Rebuild()
+
+		if !result.Success {
+			slog.Error("Rebuild failed", "mode", deployment.Name(), "error", result.Error)
+			return
+		}
+		slog.Info("Rebuild completed", "mode", deployment.Name(), "message", result.Message)
+		if result.ExitCode != 0 {
+			// Give the response time to reach the client before exiting
+			time.Sleep(restartExitDelay)
+			if n := unfinishedJobs(); n > 0 {
+				slog.Error("Jobs started during the rebuild, not restarting", "jobs", n)
+				return
+			}
+			os.Exit(result.ExitCode)
+		}
+	}()
+
+	response := RebuildResponse{
+		Status:  "initiated",
+		Mode:    deployment.Name(),
+		Message: "Rebuild process has been initiated. Check logs for progress.",
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleLibraryReport returns the latest library scan, starting one if none
+// exists yet or if ?refresh=true is given
+func handleLibraryReport(w http.ResponseWriter, r *http.Request) {
+	serveLibraryScan(w, r, "report", func(report *libscan.Report) interface{} {
+		return report
+	})
+}
+
+// handleLibraryDuplicates lists exact and near-duplicate groups from the
+// latest library scan with the files suggested for deletion
+func handleLibraryDuplicates(w http.ResponseWriter, r *http.Request) {
+	serveLibraryScan(w, r, "duplicates", func(report *libscan.Report) interface{} {
+		if report.Duplicates == nil {
+			return []libscan.DuplicateGroup{}
+		}
+		return report.Duplicates
+	})
+}
+
+// serveLibraryScan writes the scan state along with the part of the latest
+// report selected by extract under the given key
+func serveLibraryScan(w http.ResponseWriter, r *http.Request, key string, extract func(*libscan.Report) interface{}) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(cfg.MediaRoots) == 0 {
+		http.Error(w, "no mediaRoots configured", http.StatusConflict)
+		return
+	}
+
+	report, running, lastErr := scanner.Latest()
+	if (report == nil && !running) || r.URL.Query().Get("refresh") == "true" {
+		running = scanner.Start() || running
+	}
+
+	response := map[string]interface{}{
+		"running": running,
+		key:       nil,
+	}
+	if lastErr != nil {
+		response["error"] = lastErr.Error()
+	}
+	if report != nil {
+		response[key] = extract(report)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report == nil {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleVerify serves the checksum verification scan: POST starts one over
+// every recorded output of a completed job, GET returns the latest report
+func handleVerify(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		status = http.StatusAccepted
+		if !verifier.Start(checksumTargets()) {
+			// The running scan's state is returned with the conflict
+			status = http.StatusConflict
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, running := verifier.Latest()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(verifyState{Running: running, Report: report})
+}
+
+// verifyState is the response of /api/verify
+type verifyState struct {
+	Running bool             `json:"running"`
+	Report  *checksum.Report `json:"report"`
+}
+
+// checksumTargets lists the outputs with a recorded checksum of jobs that
+// are still completed
+func checksumTargets() []checksum.Target {
+	var targets []checksum.Target
+	for _, rec := range jobStore.List() {
+		if rec.Status != "completed" {
+			continue
+		}
+		// Remote outputs would have to be downloaded to be verified
+		if rec.OutputSHA256 != "" && !storage.IsRemote(rec.OutputPath) {
+			targets = append(targets, checksum.Target{JobID: rec.ID, Path: rec.OutputPath, SHA256: rec.OutputSHA256})
+		}
+		for _, rendition := range rec.Renditions {
+			if rendition.SHA256 != "" {
+				targets = append(targets, checksum.Target{JobID: rec.ID, Path: rendition.OutputPath, SHA256: rendition.SHA256})
+			}
+		}
+	}
+	return targets
+}
+
+// reportChecksumProblems flags the jobs whose output no longer matches its
+// checksum and sends checksum.mismatch for each of them
+func reportChecksumProblems(report *checksum.Report) {
+	for _, problem := range report.Problems {
+		if problem.Status != checksum.StatusMismatch {
+			continue
+		}
+		slog.Error("Checksum mismatch", "job", problem.JobID, "path", problem.Path,
+			"expected", problem.SHA256, "actual", problem.Actual)
+		if err := jobStore.Update(problem.JobID, func(r *jobstore.Record) {
+			r.Corrupted = true
+		}); err != nil {
+			slog.Error("Failed to update job history", "job", problem.JobID, "error", err)
+		}
+		notifier.Notify(notify.Event{
+			Type:    notify.EventChecksumMismatch,
+			JobID:   problem.JobID,
+			Path:    problem.Path,
+			Message: fmt.Sprintf("expected sha256 %s, found %s", problem.SHA256, problem.Actual),
+		})
+	}
+}
+
+// statsResponse is the answer of /api/stats
+type statsResponse struct {
+	Failures stats.Heatmap `json:"failures"`
+	// Profiles compares the compression and quality of each profile
+	Profiles []stats.ProfileStats `json:"profiles"`
+	// Bucket is the size of the buckets of Series
+	Bucket string        `json:"bucket"`
+	Series []stats.Point `json:"series"`
+}
+
+// defaultStatsDays is the range of the stats series without since, ending
+// with today
+const defaultStatsDays = 30
+
+// handleStats returns statistics computed from the job history: the failure
+// heatmap, the results per profile and a series of the jobs finished per day, week or month
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	values := r.URL.Query()
+	bucket := values.Get("bucket")
+	if bucket == "" {
+		bucket = stats.BucketDay
+	}
+	since, err := parseQueryTime(values.Get("since"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid since: %v", err), http.StatusBadRequest)
+		return
+	}
+	until, err := parseQueryTime(values.Get("until"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid until: %v", err), http.StatusBadRequest)
+		return
+	}
+	if until.IsZero() {
+		until = time.Now()
+	}
+	if since.IsZero() {
+		year, month, day := until.Date()
+		since = time.Date(year, month, day-defaultStatsDays+1, 0, 0, 0, 0, time.Local)
+	}
+
+	records := jobStore.List()
+	series, err := stats.Series(records, since, until, bucket, time.Local)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := statsResponse{
+		Failures: stats.FailureHeatmap(records),
+		Profiles: stats.ByProfile(records),
+		Bucket:   bucket,
+		Series:   series,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// unknownJobDuration is the calendar length used for jobs that have not
+// reported progress yet
+const unknownJobDuration = time.Hour
+
+// calendarHorizon is how far ahead the calendar lists schedule windows
+const calendarHorizon = 7 * 24 * time.Hour
+
+// handleJobs serves a page of the job history, newest first
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		handleCreateJob(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := jobsQueryFromURL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := queryJobs(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// handleCreateJob serves POST /api/jobs: it queues a job for the request
+// and answers with its history record, for clients without a WebSocket such
+// as post-download scripts
+func handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	var request OptimizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request.user, _ = auth.FromContext(r.Context())
+	request.origin = "api"
+
+	job, err := enqueueJob(request, nil)
+	var conflict *jobConflictError
+	switch {
+	case errors.As(err, &conflict) && conflict.id != "":
+		// The existing job is answered so the client can follow it instead
+		record, _ := jobStore.Get(conflict.id)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(record)
+		return
+	case errors.Is(err, cost.ErrBudgetExceeded):
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+		return
+	case errors.Is(err, cost.ErrConfirmationRequired):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), rejectStatus(err))
+		return
+	}
+	slog.Info("Job queued over the API", "job", job.ID, "path", job.SourcePath, "user", request.user.Name)
+
+	record, ok := jobStore.Get(job.ID)
+	if !ok {
+		// The record may already have been deleted from the history
+		record = jobstore.Record{SourcePath: job.SourcePath, Kind: job.Kind, Status: "queued"}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(record)
+}
+
+// handleJob routes the /api/jobs/{id}/... endpoints
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(apiPath(r), "/jobs/"), "/")
+	switch rest {
+	case "log":
+		handleJobLog(w, r, id)
+	case "undo":
+		handleJobUndo(w, r, id)
+	case "events":
+		handleJobEvents(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleJobLog serves /api/jobs/{id}/log: the job's output as JSON, the last
+// "tail" entries only if given. With follow=true the entries are streamed as
+// newline-delimited JSON until the job finishes.
+func handleJobLog(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := jobStore.Get(id); !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	tail := 0
+	if value := r.URL.Query().Get("tail"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "invalid tail", http.StatusBadRequest)
+			return
+		}
+		tail = n
+	}
+
+	path := joblog.Path(jobLogDir(), id)
+	entries, offset, err := joblog.Tail(path, tail)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []joblog.Entry{}
+	}
+
+	if r.URL.Query().Get("follow") != "true" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "entries": entries})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	ticker := time.NewTicker(jobLogPollInterval)
+	defer ticker.Stop()
+	for {
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		// Read once more after the job finished so its last lines are sent
+		record, ok := jobStore.Get(id)
+		finished := !ok || jobFinished(record.Status)
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		entries, offset, _ = joblog.ReadFrom(path, offset)
+		if finished && len(entries) == 0 {
+			return
+		}
+	}
+}
+
+// handleJobEvents serves /api/jobs/{id}/events: the job's audit trail,
+// oldest first
+func handleJobEvents(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := jobStore.Get(id); !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "events": jobEvents.Events(id)})
+}
+
+// recordEvent adds an event to the audit trail of job id. Failures are only
+// logged: losing an event must never fail a job.
+func recordEvent(id, eventType, user, detail string) {
+	if jobEvents == nil || id == "" {
+		return
+	}
+	if err := jobEvents.Add(jobevents.Event{JobID: id, Type: eventType, User: user, Detail: detail}); err != nil {
+		slog.Warn("Failed to record job event", "job", id, "type", eventType, "error", err)
+	}
+}
+
+// handleJobUndo serves POST /api/jobs/{id}/undo: the original replaced by a
+// completed job is restored from the trash and the optimized file deleted
+func handleJobUndo(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	undo.Lock()
+	defer undo.Unlock()
+	record, ok := jobStore.Get(id)
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	if !authenticator.AllowedPath(r.Context(), record.SourcePath) {
+		http.Error(w, errPathNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+	if !record.ReplacedOriginal {
+		http.Error(w, "job did not replace its original", http.StatusConflict)
+		return
+	}
+	if record.Status != "completed" {
+		http.Error(w, fmt.Sprintf("job is %s", record.Status), http.StatusConflict)
+		return
+	}
+	entry, err := trashStore.Get(id)
+	if errors.Is(err, trash.ErrNotFound) {
+		http.Error(w, "original was purged from the trash", http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The output usually sits at the original's path, so it is moved aside
+	// until the original is back
+	aside := record.OutputPath + ".undo"
+	movedAside := false
+	if record.OutputPath != "" {
+		if err := os.Rename(record.OutputPath, aside); err == nil {
+			movedAside = true
+		} else if !os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("failed to remove optimized file: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := trashStore.Restore(id); err != nil {
+		if movedAside {
+			os.Rename(aside, record.OutputPath)
+		}
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if movedAside {
+		if err := os.Remove(aside); err != nil {
+			slog.Warn("Failed to delete optimized file", "path", aside, "error", err)
+		}
+	}
+
+	if err := jobStore.Update(id, func(r *jobstore.Record) {
+		r.Status = "undone"
+		r.UndoneAt = time.Now()
+	}); err != nil {
+		slog.Error("Failed to update job history", "job", id, "error", err)
+	}
+	slog.Info("Job undone", "job", id, "path", entry.OriginalPath)
+	user, _ := auth.FromContext(r.Context())
+	recordEvent(id, jobevents.TypeUndone, user.Name, "")
+	refreshes.Add(1)
+	go func() {
+		defer refreshes.Done()
+		refreshMediaServers(entry.OriginalPath)
+	}()
+
+	record, _ = jobStore.Get(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
+
+// handleHistory serves a page of the job history together with totals over
+// every record matching the filters
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := jobsQueryFromURL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := queryJobs(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Totals cover all matching records, not just this page
+	all, _ := storeQuery(query)
+	all.Cursor, all.Limit = "", 0
+	matching, err := jobStore.Query(all)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := struct {
+		*JobsPage
+		Stats stats.Totals `json:"stats"`
+	}{page, stats.HistoryTotals(matching.Records)}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// jobsQueryFromURL reads a JobsQuery from the request's query string
+func jobsQueryFromURL(r *http.Request) (JobsQuery, error) {
+	values := r.URL.Query()
+	query := JobsQuery{
+		Status: values.Get("status"),
+		Kind:   values.Get("kind"),
+		Path:   values.Get("path"),
+		Since:  values.Get("since"),
+		Until:  values.Get("until"),
+		Cursor: values.Get("cursor"),
+		Fields: values.Get("fields"),
+	}
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return query, fmt.Errorf("invalid limit")
+		}
+		query.Limit = n
+	}
+	return query, nil
+}
+
+// storeQuery converts a JobsQuery into a job store query, applying the
+// default and maximum page size
+func storeQuery(q JobsQuery) (jobstore.Query, error) {
+	query := jobstore.Query{
+		Kind:       q.Kind,
+		PathPrefix: q.Path,
+		Cursor:     q.Cursor,
+		Limit:      q.Limit,
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultJobsLimit
+	}
+	if query.Limit > maxJobsLimit {
+		query.Limit = maxJobsLimit
+	}
+	if q.Status != "" {
+		query.Status = strings.Split(q.Status, ",")
+	}
+
+	var err error
+	if query.Since, err = parseQueryTime(q.Since); err != nil {
+		return query, fmt.Errorf("invalid since: %v", err)
+	}
+	if query.Until, err = parseQueryTime(q.Until); err != nil {
+		return query, fmt.Errorf("invalid until: %v", err)
+	}
+	return query, nil
+}
+
+// queryJobs runs a job list query, trimming records to the requested fields
+func queryJobs(q JobsQuery) (*JobsPage, error) {
+	query, err := storeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	result, err := jobStore.Query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &JobsPage{Jobs: make([]interface{}, 0, len(result.Records)), NextCursor: result.NextCursor}
+	for _, rec := range result.Records {
+		if q.Fields == "" {
+			page.Jobs = append(page.Jobs, rec)
+			continue
+		}
+		sparse, err := selectFields(rec, strings.Split(q.Fields, ","))
+		if err != nil {
+			return nil, err
+		}
+		page.Jobs = append(page.Jobs, sparse)
+	}
+	return page, nil
+}
+
+// parseQueryTime accepts RFC 3339 timestamps or plain dates; empty is zero
+func parseQueryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// selectFields reduces a record to the given JSON fields. The id is always
+// kept so clients can page and look records up.
+func selectFields(rec jobstore.Record, fields []string) (map[string]json.RawMessage, error) {
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &all); err != nil {
+		return nil, err
+	}
+
+	sparse := map[string]json.RawMessage{"id": all["id"]}
+	for _, f := range fields {
+		if v, ok := all[strings.TrimSpace(f)]; ok {
+			sparse[strings.TrimSpace(f)] = v
+		}
+	}
+	return sparse, nil
+}
+
+// handleGPUs reports the hardware encoder sessions in use on each GPU
+func handleGPUs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	usage := []gpu.Usage{}
+	if gpus != nil {
+		usage = gpus.Usage()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"gpus": usage})
+}
+
+// ffmpegStatus is the answer of /api/ffmpeg
+type ffmpegStatus struct {
+	// Available is false when no usable ffmpeg was found at startup
+	Available bool `json:"available"`
+	*ffmpeg.Tools
+	// VideoEncoders tells for each supported video encoder whether the
+	// build has it
+	VideoEncoders map[string]bool `json:"videoEncoders,omitempty"`
+}
+
+// handleFFmpeg reports the ffmpeg in use and the video encoders it supports,
+// e.g. whether AV1 can be encoded
+func handleFFmpeg(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := ffmpegStatus{Tools: ffmpegTools}
+	if ffmpegTools != nil {
+		status.Available = true
+		status.VideoEncoders = make(map[string]bool)
+		for _, encoder := range mediaopt.VideoEncoders() {
+			status.VideoEncoders[encoder] = ffmpegTools.HasEncoder(encoder)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// mountStatus is the state of a network share reported by /api/mounts
+type mountStatus struct {
+	Path      string `json:"path"`
+	Type      string `json:"type"`
+	Available bool   `json:"available"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleMounts reports whether each configured network share is available
+func handleMounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses := make([]mountStatus, len(mounts))
+	var wg sync.WaitGroup
+	for i, m := range mounts {
+		wg.Add(1)
+		go func(i int, m netmount.Mount) {
+			defer wg.Done()
+			statuses[i] = mountStatus{Path: m.Path, Type: m.Type, Available: true}
+			if err := m.Check(); err != nil {
+				statuses[i].Available, statuses[i].Error = false, err.Error()
+			}
+		}(i, m)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// provenance is what /api/provenance knows about the origin of a file
+type provenance struct {
+	Path  string          `json:"path"`
+	Stamp *mediaopt.Stamp `json:"stamp"`
+	// Job is the stamped job's history record, if it's still known
+	Job *jobstore.Record `json:"job,omitempty"`
+}
+
+// handleProvenance reports what produced a file from the stamp in its
+// container metadata
+func handleProvenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path, err := resolvePath(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authenticator.AllowedPath(r.Context(), path.String()) {
+		http.Error(w, errPathNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+	if info, err := os.Stat(path.String()); err != nil || info.IsDir() {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	probe, err := mediaopt.Probe(path.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	p := provenance{Path: path.String(), Stamp: mediaopt.ReadStamp(probe)}
+	if p.Stamp == nil {
+		http.Error(w, "file was not produced by the optimizer", http.StatusNotFound)
+		return
+	}
+	if record, ok := jobStore.Get(p.Stamp.JobID); ok {
+		p.Job = &record
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// userName returns the user of an authorized request, empty without
+// configured users
+func userName(ctx context.Context) string {
+	user, _ := auth.FromContext(ctx)
+	return user.Name
+}
+
+// handleMe reports the logged in user, for the UI to offer only what their
+// role allows
+func handleMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := auth.FromContext(r.Context())
+	if !ok {
+		user = auth.User{Role: auth.Admin}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// handleNotifyTargets lists the configured notification targets
+func handleNotifyTargets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"targets": notifier.Targets()})
+}
+
+// arrAuthorized reports whether the request carries the webhook credentials
+// of the arr config. Both are compared in full and in constant time, over
+// their hashes so not even their lengths show in the response time.
+func arrAuthorized(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	userSum, wantUser := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(cfg.Arr.Username))
+	passSum, wantPass := sha256.Sum256([]byte(pass)), sha256.Sum256([]byte(cfg.Arr.Password))
+	userOK := subtle.ConstantTimeCompare(userSum[:], wantUser[:])
+	passOK := subtle.ConstantTimeCompare(passSum[:], wantPass[:])
+	return ok && userOK&passOK == 1
+}
+
+// handleArrWebhook queues files imported or upgraded by Sonarr or Radarr
+// with the profile configured for the application
+func handleArrWebhook(app string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if cfg.Arr.Username != "" || cfg.Arr.Password != "" {
+			if !arrAuthorized(r) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="media-optimizer"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		} else {
+			// Without webhook credentials the apps log in as a user
+			var ok bool
+			if r, ok = authenticator.Authorize(w, r, auth.Operator); !ok {
+				return
+			}
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		event, imp, err := arr.Parse(app, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if imp == nil {
+			// Test and other events are acknowledged so the app reports success
+			json.NewEncoder(w).Encode(map[string]string{"status": "ignored", "event": event})
+			return
+		}
+
+		profile := cfg.Arr.SonarrProfile
+		if app == arr.Radarr {
+			profile = cfg.Arr.RadarrProfile
+		}
+		request := OptimizeRequest{
+			Path:    arr.MapPath(imp.Path, cfg.Arr.PathMappings),
+			Profile: profile,
+		}
+		request.user, _ = auth.FromContext(r.Context())
+		request.origin = app
+		if path, err := resolvePath(request.Path); err == nil && excludes.Excluded(path.String()) {
+			// Excluded imports are meant to be left alone, not to fail
+			slog.Info("Ignored excluded import", "app", app, "path", request.Path)
+			json.NewEncoder(w).Encode(map[string]string{"status": "excluded", "path": request.Path})
+			return
+		}
+		if cfg.Proposals.Enabled {
+			proposal, err := proposeJob(request)
+			if errors.Is(err, errProposalRejected) {
+				json.NewEncoder(w).Encode(map[string]string{"status": "rejected", "path": request.Path, "id": proposal.ID})
+				return
+			}
+			if err != nil {
+				slog.Info("Rejected import", "app", app, "path", request.Path, "error", err)
+				http.Error(w, err.Error(), rejectStatus(err))
+				return
+			}
+			slog.Info("Proposed import", "app", app, "title", imp.Title, "path", request.Path, "proposal", proposal.ID)
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]string{"status": "proposed", "path": request.Path, "id": proposal.ID})
+			return
+		}
+		_, err = enqueueJob(request, nil)
+		var conflict *jobConflictError
+		if errors.As(err, &conflict) {
+			// Apps resend imports, e.g. after an upgrade; the job already covers it
+			slog.Info("Import already queued", "app", app, "path", request.Path, "job", conflict.id)
+			json.NewEncoder(w).Encode(map[string]string{"status": "duplicate", "path": request.Path, "id": conflict.id})
+			return
+		}
+		if err != nil {
+			slog.Info("Rejected import", "app", app, "path", request.Path, "error", err)
+			http.Error(w, err.Error(), rejectStatus(err))
+			return
+		}
+		slog.Info("Queued import", "app", app, "title", imp.Title, "path", request.Path)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"status": "queued", "path": request.Path})
+	}
+}
+
+// handleNotifyTest sends a sample event to one target and reports its response
+func handleNotifyTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Target string `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	delivery, err := notifier.Test(r.Context(), request.Target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
+
+// handleCalendar exposes the schedule windows, the running jobs and the
+// queued batch with their projected completion times as an iCal feed so
+// calendar apps can show when the server is busy
+func handleCalendar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	var events []ical.Event
+
+	// Waiting jobs start together once the gates open; while one is held or
+	// blocked there's no telling when
+	resume := now
+	if workGate != nil {
+		// Windows are listed from midnight so today's keep their start and
+		// UID as the feed is refreshed
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		for _, period := range workGate.Schedule().Periods(today, today.Add(calendarHorizon)) {
+			events = append(events, ical.Event{
+				UID:         ical.UID("window", period.Start.UTC().Format("20060102T1504")),
+				Summary:     "Optimization window",
+				Description: "Queued jobs run during this window",
+				Start:       period.Start,
+				End:         period.End,
+			})
+		}
+		if !workGate.IsOpen() {
+			resume = workGate.NextOpen()
+		}
+	}
+	if startGate != nil && !startGate.IsOpen() {
+		resume = time.Time{}
+	}
+	records := jobStore.List()
+	averages := map[string]time.Duration{}
+	counts := map[string]int{}
+	for _, kind := range []string{KindVideo, KindImage, KindAudio, KindRemux, KindLadder} {
+		averages[kind], counts[kind] = stats.AverageDuration(records, kind)
+	}
+
+	var batch ical.Event
+	queued := 0
+	activeJobs.RLock()
+	for _, job := range activeJobs.jobs {
+		name := filepath.Base(job.SourcePath)
+		switch job.Status {
+		case "processing", "paused":
+			end := job.StartedAt.Add(unknownJobDuration)
+			description := "Completion time unknown until progress is reported"
+			if _, eta := jobTiming(job, float64(job.Progress)); eta > 0 {
+				end = now.Add(time.Duration(eta) * time.Second)
+				description = fmt.Sprintf("%d%% complete, projected from elapsed time", job.Progress)
+				if job.ETA > 0 {
+					description = fmt.Sprintf("%d%% complete, projected from the encode speed (%.1fx)", job.Progress, job.Speed)
+				}
+				if job.Status == "paused" && !resume.IsZero() {
+					end = resume.Add(time.Duration(eta) * time.Second)
+					description += ", once it resumes at " + resume.Format("15:04")
+				}
+			}
+			if job.Status == "paused" && resume.IsZero() {
+				description = "Paused until the queue is resumed"
+			}
+			if end.Before(now) {
+				end = now
+			}
+			events = append(events, ical.Event{
+				UID:         ical.UID("job", job.ID),
+				Summary:     "Optimizing " + name,
+				Description: description + "\n" + job.SourcePath,
+				Start:       job.StartedAt,
+				End:         end,
+			})
+		case "queued":
+			if resume.IsZero() {
+				continue
+			}
+			duration, count := averages[job.Kind], counts[job.Kind]
+			description := fmt.Sprintf("Duration projected from the average of %d completed %s jobs", count, job.Kind)
+			if count == 0 {
+				duration = unknownJobDuration
+				description = fmt.Sprintf("Duration unknown until the first %s job completes", job.Kind)
+			}
+			end := resume.Add(duration)
+			events = append(events, ical.Event{
+				UID:         ical.UID("job", job.ID),
+				Summary:     "Queued: " + name,
+				Description: description + "\n" + job.SourcePath,
+				Start:       resume,
+				End:         end,
+			})
+			queued++
+			if end.After(batch.End) {
+				batch.End = end
+			}
+		}
+	}
+	activeJobs.RUnlock()
+
+	if queued > 0 {
+		batch.UID = ical.UID("batch", resume.UTC().Format("20060102T1504"))
+		batch.Summary = fmt.Sprintf("Batch of %d queued jobs", queued)
+		batch.Description = "Projected run of the queued jobs, which start together"
+		batch.Start = resume
+		events = append(events, batch)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if err := ical.Write(w, "Media Optimizer", events); err != nil {
+		slog.Warn("Failed to write calendar", "error", err)
+	}
+}
+
+// handleStreamOptimize optimizes the request body and streams the result
+// back without touching the optimizer's disk
+func handleStreamOptimize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// HTTP/1.x servers stop reading the body once the response starts unless
+	// full duplex is enabled
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil {
+		slog.Warn("Full duplex unavailable for stream request", "error", err)
+	}
+
+	out := &streamWriter{w: w, rc: rc}
+	err := mediaopt.StreamOptimize(r.Context(), r.Body, out, processPriority(cfg.Priority))
+	if err == nil {
+		return
+	}
+
+	slog.Error("Stream optimization failed", "error", err)
+	if !out.started {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The status line is gone already; abort so the client sees a truncated
+	// response instead of a seemingly complete file
+	panic(http.ErrAbortHandler)
+}
+
+// streamWriter sends the response headers on the first write and flushes
+// after every chunk so data reaches the client as ffmpeg produces it
+type streamWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	started bool
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", "video/mp4")
+	}
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, s.rc.Flush()
+}
+
+func handleBrowse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request BrowseRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, status, err := browse(r.Context(), request)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// browse returns the requested page of a directory listing, or an error
+// with the HTTP status it maps to
+func browse(ctx context.Context, request BrowseRequest) (BrowsePage, int, error) {
+	if request.Path == "" {
+		request.Path = "/"
+	}
+	switch request.Sort {
+	case "", "name", "size", "date":
+	default:
+		return BrowsePage{}, http.StatusBadRequest, fmt.Errorf("sort must be \"name\", \"size\" or \"date\", got %q", request.Sort)
+	}
+	if request.Offset < 0 {
+		return BrowsePage{}, http.StatusBadRequest, fmt.Errorf("offset must not be negative")
+	}
+
+	if remotePath, ok, err := storage.ParsePath(request.Path); ok {
+		if err != nil {
+			return BrowsePage{}, http.StatusBadRequest, err
+		}
+		return browseRemote(ctx, remotePath, request)
+	}
+
+	var files []FileInfo
+	top := mediapath.IsTop(request.Path)
+	path, err := mediapath.New(request.Path, cfg.MediaRoots)
+	roots := cfg.RestrictToRoots && (top || !path.Within())
+	switch {
+	case err != nil:
+		return BrowsePage{}, http.StatusBadRequest, err
+	case roots:
+		// Everything above the roots shows the roots themselves
+		files = rootFiles()
+	case top:
+		// Windows has a root per drive, which the top level lists
+		files = append(driveFiles(), remoteRootFiles()...)
+	default:
+		files, err = listFiles(path.String())
+		if err == nil && path.String() == mediapath.Top {
+			files = append(files, remoteRootFiles()...)
+		}
+	}
+	if err != nil {
+		return BrowsePage{}, http.StatusInternalServerError, err
+	}
+	pending := 0
+	if request.Deep {
+		pending = addFolderStats(files)
+	}
+	dir := path.String()
+	if top {
+		dir = mediapath.Top
+	}
+	page := browsePage(dir, files, request)
+	page.Pending = pending
+	switch {
+	case roots:
+	case cfg.RestrictToRoots && path.Rel() == ".":
+		page.Parent = mediapath.Top
+	default:
+		page.Parent = mediapath.Parent(dir)
+	}
+	return page, http.StatusOK, nil
+}
+
+// addFolderStats adds the media summary of each directory of a listing and
+// makes it the directory's size, so sorting by size puts the heaviest
+// folders first. It returns how many are still being computed.
+func addFolderStats(files []FileInfo) int {
+	pending := 0
+	for i := range files {
+		if !files[i].IsDir || storage.IsRemote(files[i].Path) {
+			continue
+		}
+		if files[i].Folder = folderStats.Get(files[i].Path); files[i].Folder != nil {
+			files[i].Size = files[i].Folder.Size
+		} else {
+			pending++
+		}
+	}
+	return pending
+}
+
+// browseRemote lists a directory of a storage remote. Only video files are
+// given a media type as remote sources can't go to the other pipelines.
+func browseRemote(ctx context.Context, dir storage.Path, request BrowseRequest) (BrowsePage, int, error) {
+	remote, err := lookupRemote(dir)
+	if err != nil {
+		return BrowsePage{}, http.StatusNotFound, err
+	}
+	dir.Key = strings.TrimSuffix(dir.Key, "/")
+	prefix := dir.Key
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, remoteTimeout)
+	defer cancel()
+	objects, err := remote.backend.List(ctx, prefix)
+	if err != nil {
+		return BrowsePage{}, http.StatusBadGateway, err
+	}
+	files := make([]FileInfo, 0, len(objects))
+	for _, obj := range objects {
+		key := strings.TrimSuffix(obj.Key, "/")
+		file := FileInfo{
+			Name:    key[strings.LastIndex(key, "/")+1:],
+			Path:    dir.Join(key).String(),
+			IsDir:   obj.IsDir,
+			Size:    obj.Size,
+			ModTime: obj.ModTime,
+		}
+		if !obj.IsDir && mediaType(key) == KindVideo {
+			file.MediaType = KindVideo
+		}
+		files = append(files, file)
+	}
+	page := browsePage(dir.String(), files, request)
+	// The parent of a remote's root is the top level
+	page.Parent = mediapath.Top
+	if i := strings.LastIndex(dir.Key, "/"); i >= 0 {
+		page.Parent = storage.Path{Type: dir.Type, Root: dir.Root, Key: dir.Key[:i]}.String()
+	} else if dir.Key != "" {
+		page.Parent = storage.Path{Type: dir.Type, Root: dir.Root}.String()
+	}
+	return page, http.StatusOK, nil
+}
+
+// browsePage filters and sorts a directory listing and returns the requested
+// page of it
+func browsePage(path string, files []FileInfo, request BrowseRequest) BrowsePage {
+	if len(request.Extensions) > 0 {
+		kept := files[:0]
+		for _, f := range files {
+			if f.IsDir || hasExtension(f.Name, request.Extensions) {
+				kept = append(kept, f)
+			}
+		}
+		files = kept
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if request.Desc {
+			a, b = b, a
+		}
+		switch {
+		case request.Sort == "size" && a.Size != b.Size:
+			return a.Size < b.Size
+		case request.Sort == "date" && !a.ModTime.Equal(b.ModTime):
+			return a.ModTime.Before(b.ModTime)
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+
+	page := BrowsePage{Path: path, Total: len(files), Offset: request.Offset, Limit: request.Limit}
+	if page.Limit <= 0 {
+		page.Limit = defaultBrowseLimit
+	}
+	if page.Limit > maxBrowseLimit {
+		page.Limit = maxBrowseLimit
+	}
+	start := min(page.Offset, len(files))
+	page.Files = files[start:min(start+page.Limit, len(files))]
+	return page
+}
+
+// handleSearch searches the media roots recursively for files by name,
+// extension, size and optionally video codec
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(cfg.MediaRoots) == 0 {
+		http.Error(w, "no mediaRoots configured", http.StatusConflict)
+		return
+	}
+
+	var request SearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := searchOptions(request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A client that gives up stops the walk and the probes
+	result, err := libscan.Search(r.Context(), opts)
+	if err != nil {
+		if r.Context().Err() == nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// searchOptions validates a search request and converts it into options
+// for libscan.Search
+func searchOptions(request SearchRequest) (libscan.SearchOptions, error) {
+	opts := libscan.SearchOptions{
+		Roots:      cfg.MediaRoots,
+		Pattern:    request.Pattern,
+		VideoCodec: request.VideoCodec,
+		Limit:      request.Limit,
+		Workers:    cfg.Library.ScanWorkers,
+		Exclude:    excludes,
+	}
+	if request.Path != "" {
+		path, err := mediapath.Resolve(request.Path, cfg.MediaRoots)
+		if err != nil {
+			return opts, err
+		}
+		opts.Roots = []string{path.String()}
+	}
+	for _, ext := range request.Extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		opts.Extensions = append(opts.Extensions, ext)
+	}
+	var err error
+	if request.MinSize != "" {
+		if opts.MinSize, err = mediaopt.ParseSize(request.MinSize); err != nil {
+			return opts, fmt.Errorf("invalid minSize: %v", err)
+		}
+	}
+	if request.MaxSize != "" {
+		if opts.MaxSize, err = mediaopt.ParseSize(request.MaxSize); err != nil {
+			return opts, fmt.Errorf("invalid maxSize: %v", err)
+		}
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = defaultBrowseLimit
+	}
+	if opts.Limit > maxBrowseLimit {
+		opts.Limit = maxBrowseLimit
+	}
+	return opts, nil
+}
+
+// hasExtension reports whether name ends in one of the extensions, which may
+// be given with or without the dot and in any case
+func hasExtension(name string, extensions []string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range extensions {
+		e = strings.ToLower(e)
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func handleOptimize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request OptimizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	request.user, _ = auth.FromContext(r.Context())
+	kind, err := validateRequest(&request)
+	if err != nil {
+		http.Error(w, err.Error(), rejectStatus(err))
+		return
+	}
+
+	// Report what would happen without producing any output
+	if request.DryRun {
+		params, err := dryRunParams(request, kind)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		report, err := mediaopt.DryRun(params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	estimate, err := checkCost(request, kind)
+	switch {
+	case errors.Is(err, cost.ErrBudgetExceeded):
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+		return
+	case errors.Is(err, cost.ErrConfirmationRequired):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Return success response for the HTTP request
+	response := map[string]interface{}{
+		"status": "optimization initiated",
+		"path":   request.Path,
+	}
+	if estimate > 0 {
+		response["estimatedCost"] = estimate
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleSamples encodes sample clips of a video with a profile so that
+// profiles can be compared before running one across the library
+func handleSamples(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request SampleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Clips < 0 || request.Clips > mediaopt.MaxSampleClips || request.Seconds < 0 || request.Seconds > mediaopt.MaxSampleSeconds {
+		http.Error(w, fmt.Sprintf("clips must be at most %d and seconds at most %.0f", mediaopt.MaxSampleClips, mediaopt.MaxSampleSeconds), http.StatusUnprocessableEntity)
+		return
+	}
+
+	optimize := OptimizeRequest{Path: request.Path, Mode: KindVideo}
+	if request.Profile != "default" {
+		optimize.Profile = request.Profile
+	}
+	optimize.user, _ = auth.FromContext(r.Context())
+	if _, err := validateRequest(&optimize); err != nil {
+		http.Error(w, err.Error(), rejectStatus(err))
+		return
+	}
+	profile := ""
+	if request.Profile != "default" {
+		profile = requestProfile(optimize)
+	}
+	params, err := videoParams(optimize.Path, "", profile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	// A client that gives up stops the encodes
+	params.Context = r.Context()
+
+	opts := mediaopt.SampleOptions{
+		Clips:     request.Clips,
+		Seconds:   request.Seconds,
+		OutputDir: samplesDir(optimize.Path, profile),
+	}
+	if cfg.Verification.Metric != "" {
+		opts.Quality = &mediaopt.QualityCheck{Metric: cfg.Verification.Metric}
+	}
+	slog.Info("Encoding samples", "path", optimize.Path, "profile", profile, "dir", opts.OutputDir)
+	report, err := mediaopt.EncodeSamples(params, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"profile": profile,
+		"samples": report,
+	})
+}
+
+// handleThumbnail serves a JPEG thumbnail (type=thumbnail, the default) or
+// preview sprite (type=sprite) of the video at ?path=, generated on the first
+// request and cached until the file changes. Only files inside the media
+// roots are read.
+func handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	kind := r.URL.Query().Get("type")
+	if kind == "" {
+		kind = mediaopt.PreviewThumbnail
+	}
+	if kind != mediaopt.PreviewThumbnail && kind != mediaopt.PreviewSprite {
+		http.Error(w, fmt.Sprintf("type must be %q or %q", mediaopt.PreviewThumbnail, mediaopt.PreviewSprite), http.StatusBadRequest)
+		return
+	}
+	path, err := rootedPath(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	info, err := os.Stat(path.String())
+	if err != nil || info.IsDir() {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if !mediaopt.HasExtension(path.String(), cfg.AllowedExtensions) {
+		http.Error(w, "not a video file", http.StatusBadRequest)
+		return
+	}
+
+	cached := previewPath(path.String(), kind, info)
+	if _, err := os.Stat(cached); err != nil {
+		select {
+		case previewSlots <- struct{}{}:
+		case <-r.Context().Done():
+			return
+		}
+		err := createPreview(path.String(), cached, kind)
+		<-previewSlots
+		if err != nil {
+			slog.Warn("Failed to create preview", "path", path.String(), "type", kind, "error", err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, cached)
+}
+
+// previewPath is where the preview of a file is cached. The key covers the
+// file's size and modification time so a replaced file gets a new preview.
+func previewPath(path, kind string, info os.FileInfo) string {
+	key := fmt.Sprintf("%s\x00%d\x00%d", path, info.Size(), info.ModTime().UnixNano())
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(cfg.DataDir, "thumbnails", hex.EncodeToString(sum[:16])+"-"+kind+".jpg")
+}
+
+// createPreview writes the preview into the cache unless a concurrent
+// request already did, via a temp file so a failure leaves no partial image
+func createPreview(path, cached, kind string) error {
+	if _, err := os.Stat(cached); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		return err
+	}
+	// Unique so concurrent requests for the same preview don't share it
+	tmp := fmt.Sprintf("%s.%d.tmp.jpg", strings.TrimSuffix(cached, ".jpg"), time.Now().UnixNano())
+	if err := mediaopt.Preview(path, tmp, kind); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, cached)
+}
+
+// samplesDir is where the sample clips of a file and profile are kept.
+// Sampling the same file and profile again replaces them.
+func samplesDir(path, profile string) string {
+	if profile == "" {
+		profile = "default"
+	}
+	// The hash of the whole path keeps files of the same name apart
+	sum := sha256.Sum256([]byte(filepath.Clean(path)))
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) + "-" + hex.EncodeToString(sum[:6])
+	return filepath.Join(cfg.DataDir, "samples", name, profile)
+}
+
+// dryRunParams returns the parameters a dry run of a validated video or remux
+// request is planned with
+func dryRunParams(request OptimizeRequest, kind string) (*mediaopt.OptimizationParams, error) {
+	container := ""
+	if kind == KindRemux {
+		container = request.Container
+	}
+	params, err := videoParams(request.Path, container, requestProfile(request))
+	if err != nil {
+		return nil, err
+	}
+	params.Streams = request.Streams
+	if request.TargetSize != "" {
+		params.TargetSize, _ = mediaopt.ParseSize(request.TargetSize)
+	}
+	return params, nil
+}
+
+// rootFiles lists the media roots as directories
+func rootFiles() []FileInfo {
+	var files []FileInfo
+	for _, root := range cfg.MediaRoots {
+		files = append(files, FileInfo{Name: root, Path: root, IsDir: true})
+	}
+	return append(files, remoteRootFiles()...)
+}
+
+// driveFiles lists the drives of a Windows system as directories
+func driveFiles() []FileInfo {
+	var files []FileInfo
+	for _, drive := range mediapath.Drives() {
+		files = append(files, FileInfo{Name: drive, Path: drive, IsDir: true})
+	}
+	return files
+}
+
+// remoteRootFiles lists the storage remotes as directories
+func remoteRootFiles() []FileInfo {
+	var files []FileInfo
+	for _, r := range cfg.Storage.Remotes {
+		root := storage.Path{Type: r.Type, Root: r.Name}.String()
+		files = append(files, FileInfo{Name: root, Path: root, IsDir: true})
+	}
+	return files
+}
+
+func listFiles(path string) ([]FileInfo, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		fullPath := filepath.Join(path, entry.Name())
+		file := FileInfo{
+			Name:  entry.Name(),
+			Path:  fullPath,
+			IsDir: entry.IsDir(),
+		}
+		// Entries removed since the directory was read are still listed
+		if info, err := entry.Info(); err == nil {
+			file.ModTime = info.ModTime()
+			if !file.IsDir {
+				file.Size = info.Size()
+			}
+		}
+		if !file.IsDir {
+			file.MediaType = mediaType(fullPath)
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// mediaType returns the FileInfo.MediaType of a file from its extension
+func mediaType(path string) string {
+	switch {
+	case imageopt.IsImage(path):
+		return KindImage
+	case audioopt.IsAudio(path):
+		return KindAudio
+	case mediaopt.IsDiscImage(path) && cfg.DiscImages:
+		return "disc"
+	case mediaopt.HasExtension(path, cfg.AcceptedExtensions()):
+		return KindVideo
+	}
+	return ""
+}
+
+// validateJobInput checks that path can be optimized and returns the job kind.
+// Images and lossless audio go to their own pipelines, directories to the one
+// selected by mode (images by default), and everything else must pass the
+// media validation.
+func validateJobInput(path, mode string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("input does not exist: %s", path)
+	}
+
+	kind := KindVideo
+	switch {
+	case info.IsDir():
+		kind = KindImage
+		if mode != "" {
+			kind = mode
+		}
+	case imageopt.IsImage(path):
+		kind = KindImage
+	case audioopt.IsAudio(path):
+		kind = KindAudio
+	}
+
+	if (mode == KindRemux || mode == KindLadder) && kind == KindVideo {
+		kind = mode
+	}
+
+	switch {
+	case mode != "" && mode != kind:
+		return "", fmt.Errorf("cannot run %s mode on %s", mode, path)
+	case info.IsDir() && kind == KindVideo:
+		return "", fmt.Errorf("video mode requires a file: %s", path)
+	case kind == KindLadder && mediaopt.IsDiscImage(path):
+		return "", fmt.Errorf("ladder mode does not support disc images: %s", path)
+	case encodesVideo(kind):
+		return kind, mediaopt.ValidateInput(path, cfg.AcceptedExtensions())
+	case kind != KindImage && kind != KindAudio:
+		return "", fmt.Errorf("unknown mode: %s", mode)
+	}
+	return kind, nil
+}
+
+// errPathNotAllowed rejects a job outside the paths of a scoped API key
+var errPathNotAllowed = errors.New("path not allowed for this API key")
+
+// errExcluded rejects a job of media excluded by the exclude globs or a
+// marker file
+var errExcluded = errors.New("path is excluded from optimization")
+
+// errRecordJob rejects a job the job history failed to record
+var errRecordJob = errors.New("failed to record job")
+
+// errJobCancelled is the error of jobs cancelled through the queue API
+var errJobCancelled = errors.New("cancelled")
+
+// rejectStatus is the HTTP status of a request rejected by validateRequest
+// or newJob
+func rejectStatus(err error) int {
+	var conflict *jobConflictError
+	switch {
+	case errors.Is(err, errPathNotAllowed):
+		return http.StatusForbidden
+	case errors.As(err, &conflict):
+		return http.StatusConflict
+	case errors.Is(err, errRecordJob):
+		return http.StatusInternalServerError
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// validateRequest validates the request's input and, for remux jobs, its
+// target container, and that its user may start jobs of the path. The
+// request's path is replaced by its normalized form.
+func validateRequest(request *OptimizeRequest) (string, error) {
+	var kind string
+	if remotePath, ok, err := storage.ParsePath(request.Path); ok {
+		if err != nil {
+			return "", err
+		}
+		request.Path = remotePath.String()
+		if !request.user.AllowsPath(request.Path) {
+			return "", fmt.Errorf("%w: %s", errPathNotAllowed, request.Path)
+		}
+		// Remote media has no marker files, only the globs apply
+		if excludes.Matches(request.Path) {
+			return "", fmt.Errorf("%w: %s", errExcluded, request.Path)
+		}
+		if kind, err = validateRemoteInput(remotePath, request); err != nil {
+			return "", err
+		}
+	} else {
+		path, err := resolvePath(request.Path)
+		if err != nil {
+			return "", err
+		}
+		request.Path = path.String()
+		if !request.user.AllowsPath(request.Path) {
+			return "", fmt.Errorf("%w: %s", errPathNotAllowed, request.Path)
+		}
+		if excludes.Excluded(request.Path) {
+			return "", fmt.Errorf("%w: %s", errExcluded, request.Path)
+		}
+
+		if kind, err = validateJobInput(request.Path, request.Mode); err != nil {
+			return "", err
+		}
+	}
+	if kind == KindRemux {
+		if _, err := mediaopt.NewRemuxParams(request.Path, request.Container); err != nil {
+			return "", err
+		}
+	}
+	if request.TargetSize != "" {
+		if kind != KindVideo {
+			return "", fmt.Errorf("targetSize only applies to video optimization")
+		}
+		if _, err := mediaopt.ParseSize(request.TargetSize); err != nil {
+			return "", err
+		}
+	}
+	if request.DryRun && kind != KindVideo && kind != KindRemux {
+		return "", fmt.Errorf("dryRun only applies to video and remux jobs")
+	}
+	if request.TimeoutMinutes != 0 {
+		if !encodesVideo(kind) {
+			return "", fmt.Errorf("timeoutMinutes only applies to video, remux and ladder jobs")
+		}
+		if request.TimeoutMinutes < 0 {
+			return "", fmt.Errorf("timeoutMinutes must not be negative, got %d", request.TimeoutMinutes)
+		}
+	}
+	if request.Packaging != "" {
+		if kind != KindVideo && kind != KindLadder {
+			return "", fmt.Errorf("packaging only applies to video and ladder jobs")
+		}
+		if err := mediaopt.ValidatePackaging(request.Packaging); err != nil {
+			return "", err
+		}
+	}
+	if request.Profile != "" {
+		if !encodesVideo(kind) {
+			return "", fmt.Errorf("profile only applies to video optimization")
+		}
+		if _, ok := cfg.Profiles[request.Profile]; !ok {
+			return "", fmt.Errorf("unknown profile: %s", request.Profile)
+		}
+	}
+	return kind, nil
+}
+
+// validateRemoteInput checks that a source in a storage remote exists and
+// can be optimized, and returns the job kind. Remote sources only go through
+// the video and remux pipelines, and can't be probed before they are
+// downloaded.
+func validateRemoteInput(path storage.Path, request *OptimizeRequest) (string, error) {
+	remote, err := lookupRemote(path)
+	if err != nil {
+		return "", err
+	}
+	kind := KindVideo
+	switch {
+	case request.Mode == KindRemux:
+		kind = KindRemux
+	case request.Mode != "" && request.Mode != KindVideo:
+		return "", fmt.Errorf("remote sources only support video and remux jobs")
+	case request.DryRun:
+		return "", fmt.Errorf("dryRun does not support remote sources")
+	case request.Packaging != "":
+		return "", fmt.Errorf("packaging does not support remote sources")
+	case mediaopt.IsDiscImage(path.Key):
+		return "", fmt.Errorf("disc images are not supported in remotes: %s", path)
+	case !mediaopt.HasExtension(path.Key, cfg.AcceptedExtensions()):
+		return "", fmt.Errorf("unsupported file extension %s: allowed extensions are %s", filepath.Ext(path.Key), strings.Join(cfg.AcceptedExtensions(), ", "))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+	if _, err := remote.backend.Stat(ctx, path.Key); err != nil {
+		return "", fmt.Errorf("input does not exist: %s: %v", path, err)
+	}
+	return kind, nil
+}
+
+// checkCost estimates the cost of a video job on the billed backend and
+// enforces the monthly budget and confirmation threshold. It returns zero
+// when cloud pricing isn't configured.
+func checkCost(request OptimizeRequest, kind string) (float64, error) {
+	guard := cost.Guard{
+		PricePerMinute: cfg.Cloud.PricePerMinute,
+		MonthlyBudget:  cfg.Cloud.MonthlyBudget,
+		ConfirmAbove:   cfg.Cloud.ConfirmAbove,
+	}
+	// Remote sources can't be probed before they are downloaded, so they
+	// aren't estimated
+	if !guard.Enabled() || !encodesVideo(kind) || storage.IsRemote(request.Path) {
+		return 0, nil
+	}
+
+	probe, err := mediaopt.Probe(request.Path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to estimate cost: %v", err)
+	}
+	duration := time.Duration(probe.DurationSeconds() * float64(time.Second))
+	estimate := guard.Estimate(duration)
+	spent := cost.MonthSpend(jobStore.List(), time.Now())
+	return estimate, guard.Check(estimate, spent, request.ConfirmCost)
+}
+
+// resolvePath normalizes a path sent by a client, rejecting paths outside
+// the media roots when restrictToRoots is set
+func resolvePath(raw string) (mediapath.MediaPath, error) {
+	if cfg.RestrictToRoots {
+		return mediapath.Resolve(raw, cfg.MediaRoots)
+	}
+	return mediapath.New(raw, cfg.MediaRoots)
+}
+
+// errNoMediaRoots rejects reading files back to clients on a server without
+// media roots
+var errNoMediaRoots = errors.New("no media roots are configured")
+
+// rootedPath normalizes a path of a file whose content is sent back to the
+// client, which must be inside a media root whatever restrictToRoots says
+func rootedPath(raw string) (mediapath.MediaPath, error) {
+	if len(cfg.MediaRoots) == 0 {
+		return mediapath.MediaPath{}, errNoMediaRoots
+	}
+	return mediapath.Resolve(raw, cfg.MediaRoots)
+}
+
+// requestProfile returns the profile named in the request, falling back to
+// the directory policies
+func requestProfile(request OptimizeRequest) string {
+	if request.Profile != "" {
+		return request.Profile
+	}
+	return cfg.ProfileFor(request.Path)
+}
+
+// videoParams returns optimization parameters for a video, remuxing into
+// container when one is given. The named profile's settings replace the
+// global video and HDR ones.
+func videoParams(path, container, profile string) (*mediaopt.OptimizationParams, error) {
+	params := mediaopt.NewDefaultParams(path)
+	if container != "" {
+		var err error
+		if params, err = mediaopt.NewRemuxParams(path, container); err != nil {
+			return nil, err
+		}
+	}
+	params.DetectBurnedSubtitles = cfg.Analysis.BurnedSubtitles
+	if cfg.Analysis.Segments {
+		params.DetectSegments = cfg.Analysis.SegmentMinSeconds
+	}
+	video, audio, hdr, priority, outputName := cfg.Video, cfg.Audio, cfg.HDR, cfg.Priority, cfg.OutputName
+	if p, ok := cfg.Profiles[profile]; ok {
+		if p.Video != nil {
+			video = *p.Video
+		}
+		if p.Audio != nil {
+			audio = *p.Audio
+		}
+		if p.HDR != nil {
+			hdr = *p.HDR
+		}
+		if p.Priority != nil {
+			priority = *p.Priority
+		}
+		if p.OutputName != "" {
+			outputName = p.OutputName
+		}
+		if p.Filters != nil {
+			params.Filters = videoFilters(*p.Filters)
+		}
+		if p.FFmpegArgs != nil {
+			params.CustomArgs = customArgs(*p.FFmpegArgs)
+		}
+		params.MaxHeight = p.MaxHeight
+	} else if profile != "" {
+		return nil, fmt.Errorf("unknown profile: %s", profile)
+	}
+	params.HDR = &mediaopt.HDROptions{Mode: hdr.Mode, ToneMap: hdr.ToneMap}
+	params.Video = videoEncoding(video)
+	// Fail before probing rather than when ffmpeg can't open the encoder
+	if ffmpegTools != nil && video.Transcode && !ffmpegTools.HasEncoder(video.Codec) {
+		return nil, fmt.Errorf("ffmpeg %s was built without the %s encoder; install a build with it or pick another codec", ffmpegTools.Version, video.Codec)
+	}
+	params.Audio = audioEncoding(audio)
+	params.Priority = processPriority(priority)
+	params.GPUs = gpus
+	params.OutputName = outputName
+	params.NameForm = cfg.UnicodeNormalization
+	params.Guardrails = cfg.Guardrails
+	if cfg.Analysis.LanguageTagging {
+		params.Languages = &mediaopt.LanguageTagging{Detector: cfg.Analysis.LanguageDetector}
+	}
+	return params, nil
+}
+
+// ladderRenditions converts the ladder config into renditions, falling back
+// to the default ladder
+func ladderRenditions(l config.Ladder) []mediaopt.Rendition {
+	if len(l.Renditions) == 0 {
+		return mediaopt.DefaultLadder
+	}
+	renditions := make([]mediaopt.Rendition, len(l.Renditions))
+	for i, r := range l.Renditions {
+		renditions[i] = mediaopt.Rendition(r)
+	}
+	return renditions
+}
+
+// audioEncoding converts an audio config into encoder settings
+func audioEncoding(a config.Audio) *mediaopt.AudioEncoding {
+	return &mediaopt.AudioEncoding{
+		Codec:       a.Codec,
+		BitrateKbps: a.BitrateKbps,
+		Layout:      a.Layout,
+		Passthrough: a.Passthrough,
+	}
+}
+
+// processPriority converts a priority config into encode process limits
+func processPriority(p config.Priority) *mediaopt.Priority {
+	return &mediaopt.Priority{
+		Nice:     p.Nice,
+		IOClass:  p.IOClass,
+		IOLevel:  p.IOLevel,
+		CPUQuota: p.CPUQuota,
+		Threads:  p.Threads,
+		ReadRate: p.ReadRate,
+	}
+}
+
+// videoFilters converts a profile's video filters
+func videoFilters(f config.Filters) *mediaopt.VideoFilters {
+	return &mediaopt.VideoFilters{
+		Deinterlace:     f.Deinterlace,
+		Denoise:         f.Denoise,
+		DenoiseStrength: f.DenoiseStrength,
+		Crop:            f.Crop,
+	}
+}
+
+// customArgs converts a profile's extra ffmpeg options
+func customArgs(a config.FFmpegArgs) *mediaopt.CustomArgs {
+	return &mediaopt.CustomArgs{Input: a.Input, Output: a.Output}
+}
+
+// videoEncoding converts a video config into encoder settings
+func videoEncoding(v config.Video) *mediaopt.VideoEncoding {
+	e := &mediaopt.VideoEncoding{
+		Transcode:        v.Transcode,
+		Codec:            v.Codec,
+		Preset:           v.Preset,
+		RateControl:      v.RateControl,
+		CRF:              v.CRF,
+		BitrateKbps:      v.BitrateKbps,
+		MaxBitrateKbps:   v.MaxBitrateKbps,
+		FilmGrain:        v.FilmGrain,
+		FilmGrainDenoise: v.FilmGrainDenoise,
+		Grain:            v.Grain,
+		RowMT:            v.RowMT,
+		TileColumns:      v.TileColumns,
+	}
+	if t := v.PerTitle; t.Enabled {
+		e.PerTitle = &mediaopt.PerTitle{
+			MinCRF:         t.MinCRF,
+			MaxCRF:         t.MaxCRF,
+			MinBitrateKbps: t.MinBitrateKbps,
+			MaxBitrateKbps: t.MaxBitrateKbps,
+		}
+	}
+	return e
+}
+
+// startJob marks the job as processing and announces it
+func startJob(job *OptimizationJob) {
+	activeJobs.Lock()
+	job.Status = "processing"
+	if workGate != nil && !workGate.IsOpen() && pausable(job) {
+		// The window closed while the job was being started
+		job.Status = "paused"
+	}
+	job.StartedAt = time.Now()
+	attempt := job.Attempt
+	activeJobs.Unlock()
+	sendWSUpdate(job, "status", 0)
+	recordEvent(job.ID, jobevents.TypeStarted, "", fmt.Sprintf("attempt %d", max(attempt, 1)))
+	updateHistory(job, func(r *jobstore.Record) {
+		r.Status = "processing"
+		r.StartedAt = time.Now()
+	})
+
+	if job.ID != "" {
+		l, err := joblog.Open(jobLogDir(), job.ID)
+		if err != nil {
+			slog.Error("Failed to open job log", "path", job.SourcePath, "error", err)
+		} else {
+			job.log = l
+			l.Printf("Started %s job for %s", job.Kind, job.SourcePath)
+		}
+	}
+}
+
+// jobLogDir is where the per-job logs are kept
+func jobLogDir() string {
+	return filepath.Join(cfg.DataDir, "logs")
+}
+
+// jobProgress returns a progress callback that updates the job and its client
+func jobProgress(job *OptimizationJob) func(float64) {
+	return func(progress float64) {
+		activeJobs.Lock()
+		job.Progress = int(progress)
+		activeJobs.Unlock()
+		sendWSUpdate(job, "progress", progress)
+		if job.onProgress != nil {
+			job.onProgress(progress)
+		}
+	}
+}
+
+// jobDetail returns a callback recording an encode's speed and estimated
+// time remaining, which the next progress update sends
+func jobDetail(job *OptimizationJob) mediaopt.DetailCallback {
+	return func(detail mediaopt.ProgressDetail) {
+		activeJobs.Lock()
+		job.Speed, job.FPS = detail.Speed, detail.FPS
+		job.ETA = int(detail.Remaining.Seconds())
+		activeJobs.Unlock()
+	}
+}
+
+// clearDetail drops the encode detail once the encode is over
+func clearDetail(job *OptimizationJob) {
+	activeJobs.Lock()
+	job.Speed, job.FPS, job.ETA = 0, 0, 0
+	activeJobs.Unlock()
+}
+
+// jobTiming returns the seconds since the job started and the estimated
+// seconds remaining. Jobs without an encode estimate extrapolate from their
+// progress so far. The caller must hold activeJobs.
+func jobTiming(job *OptimizationJob, progress float64) (elapsed, eta int) {
+	if job.StartedAt.IsZero() {
+		return 0, 0
+	}
+	since := time.Since(job.StartedAt)
+	if job.ETA > 0 {
+		return int(since.Seconds()), job.ETA
+	}
+	if progress > 0 && progress < 100 {
+		eta = int(since.Seconds() * (100 - progress) / progress)
+	}
+	return int(since.Seconds()), eta
+}
+
+// finishJob records the outcome, notifies the client and applies any extra
+// history fields through fn
+func finishJob(job *OptimizationJob, jobErr error, fn func(*jobstore.Record)) {
+	// A failure while the share is down says little about the job itself
+	var shareErr *shareError
+	if jobErr != nil && !errors.As(jobErr, &shareErr) {
+		if err := jobMountError(job); err != nil {
+			jobErr = fmt.Errorf("%w (job error: %v)", err, jobErr)
+		}
+	}
+
+	activeJobs.Lock()
+	job.Speed, job.FPS, job.ETA, job.Stage = 0, 0, 0, ""
+	switch {
+	case jobErr == nil:
+		job.Status = "completed"
+		job.Progress = 100
+	case job.ctx.Err() != nil:
+		// The job's processes were killed, whatever error that caused
+		jobErr = errJobCancelled
+		job.Status = "cancelled"
+		job.Error = jobErr.Error()
+	case errors.Is(jobErr, mediaopt.ErrNeedsAttention):
+		// Retrying won't help; the job needs another profile or mapping
+		job.Status = "attention"
+		job.Error = jobErr.Error()
+	case errors.Is(jobErr, mediaopt.ErrRejected):
+		// The output awaits review
+		job.Status = "quarantined"
+		job.Error = jobErr.Error()
+	case errors.Is(jobErr, mediaopt.ErrTimedOut):
+		// A rerun would most likely hang the same way
+		job.Status = "timed-out"
+		job.Error = jobErr.Error()
+	case transient(jobErr) && job.Attempt <= cfg.Retry.Retries:
+		job.Status = "retryable"
+		job.Error = jobErr.Error()
+	default:
+		job.Status = "failed"
+		job.Error = jobErr.Error()
+	}
+	activeJobs.Unlock()
+
+	// Final status update
+	sendWSUpdate(job, "status", float64(job.Progress))
+	finished := job.Status
+	if job.Error != "" {
+		finished += ": " + job.Error
+	}
+	recordEvent(job.ID, jobevents.TypeFinished, "", finished)
+	output := job.SourcePath
+	updateHistory(job, func(r *jobstore.Record) {
+		r.Status = job.Status
+		r.Error = job.Error
+		r.FinishedAt = time.Now()
+		if fn != nil {
+			fn(r)
+		}
+		if r.OutputPath != "" {
+			output = r.OutputPath
+		}
+	})
+	// Media servers and free space only concern local outputs. Watched jobs
+	// refresh and notify only when their recipe says so.
+	local := !storage.IsRemote(output)
+	recipe := job.request.recipe
+	if jobErr == nil && local && (recipe == nil || recipe.Has(config.WatchRefresh)) {
+		refreshes.Add(1)
+		go func() {
+			defer refreshes.Done()
+			refreshMediaServers(output)
+		}()
+	}
+
+	event := notify.Event{
+		Type:       notify.EventJobCompleted,
+		JobID:      job.ID,
+		SourcePath: job.SourcePath,
+		Kind:       job.Kind,
+		Status:     job.Status,
+		Error:      job.Error,
+	}
+	if jobErr != nil {
+		event.Type = notify.EventJobFailed
+	}
+	// Retried jobs notify once they finally complete or fail, cancelled
+	// ones not at all
+	if job.Status != "retryable" && job.Status != "cancelled" && (recipe == nil || recipe.Has(config.WatchNotify)) {
+		notifier.Notify(event)
+		notifyBatch(jobErr == nil)
+	}
+	if local {
+		checkLowDisk(output)
+	}
+
+	if job.log != nil {
+		if jobErr == nil {
+			job.log.Printf("Job completed: %s", output)
+		} else {
+			job.log.Write(joblog.StreamStderr, "Job failed: "+jobErr.Error())
+		}
+		job.log.Close()
+	}
+
+	// Log the result
+	switch {
+	case jobErr == nil:
+		slog.Info("Job completed", "job", job.ID, "kind", job.Kind, "path", job.SourcePath)
+	case job.Status == "cancelled":
+		slog.Info("Job cancelled", "job", job.ID, "kind", job.Kind, "path", job.SourcePath)
+	case job.Status == "attention":
+		slog.Warn("Job needs attention", "job", job.ID, "kind", job.Kind, "path", job.SourcePath, "error", jobErr)
+	case job.Status == "quarantined":
+		slog.Warn("Job output quarantined", "job", job.ID, "kind", job.Kind, "path", job.SourcePath, "error", jobErr)
+	case job.Status == "timed-out":
+		slog.Error("Job timed out", "job", job.ID, "kind", job.Kind, "path", job.SourcePath, "error", jobErr)
+	default:
+		slog.Error("Job failed", "job", job.ID, "kind", job.Kind, "path", job.SourcePath, "error", jobErr)
+	}
+}
+
+// notifyBatch counts a finished job and sends batch.completed when it was
+// the last of several queued together
+func notifyBatch(completed bool) {
+	batch.Lock()
+	defer batch.Unlock()
+	if completed {
+		batch.completed++
+	} else {
+		batch.failed++
+	}
+
+	activeJobs.RLock()
+	for _, job := range activeJobs.jobs {
+		if job.Status == "queued" || job.Status == "processing" || job.Status == "paused" {
+			activeJobs.RUnlock()
+			return
+		}
+	}
+	activeJobs.RUnlock()
+
+	if batch.completed+batch.failed > 1 {
+		notifier.Notify(notify.Event{
+			Type:      notify.EventBatchCompleted,
+			Completed: batch.completed,
+			Failed:    batch.failed,
+		})
+	}
+	batch.completed, batch.failed = 0, 0
+}
+
+// checkLowDisk sends disk.low once when free space on the volume holding
+// path drops below notify.lowDiskSpace, and again only after it recovered
+func checkLowDisk(path string) {
+	if lowDiskSpace <= 0 {
+		return
+	}
+	dir := path
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		dir = filepath.Dir(path)
+	}
+	free, err := mediaopt.FreeSpace(dir)
+	if err != nil {
+		slog.Warn("Failed to check free space", "dir", dir, "error", err)
+		return
+	}
+
+	batch.Lock()
+	defer batch.Unlock()
+	low := free < uint64(lowDiskSpace)
+	if low && !batch.diskLow {
+		notifier.Notify(notify.Event{Type: notify.EventDiskLow, Path: dir, FreeBytes: free})
+	}
+	batch.diskLow = low
+}
+
+// fileSize returns the size of path, or 0 if it can't be read
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// fileChecksum returns the SHA-256 of path for the job history, or "" when
+// checksums are disabled or the file can't be read
+func fileChecksum(path string) string {
+	if !cfg.Checksums.Enabled {
+		return ""
+	}
+	sum, err := checksum.File(path)
+	if err != nil {
+		slog.Warn("Failed to hash file", "path", path, "error", err)
+		return ""
+	}
+	return sum
+}
+
+// refreshMediaServers tells each media server about a job's output so the
+// new file shows up right away
+func refreshMediaServers(output string) {
+	for _, server := range mediaServers {
+		ctx, cancel := context.WithTimeout(context.Background(), mediaServerTimeout)
+		if err := server.Refresh(ctx, output); err != nil {
+			slog.Warn("Media server refresh failed", "server", server.Name(), "path", output, "error", err)
+		} else {
+			slog.Info("Media server refreshed", "server", server.Name(), "path", output)
+		}
+		cancel()
+	}
+}
+
+func optimizeMedia(job *OptimizationJob) {
+	startJob(job)
+
+	remote := storage.IsRemote(job.SourcePath)
+	staged := !remote && stagedJob(job)
+	// Watched files follow their recipe instead
+	replace := job.Packaging == "" && cfg.ReplaceOriginal && !remote && job.request.recipe == nil
+	pipeline := videoPipeline(job, remote, staged, replace)
+	if remote {
+		pipeline.Start(stageDownload)
+		cleanup, err := downloadSource(job, transferProgress(pipeline.Progress(stageDownload)))
+		if err != nil {
+			finishJob(job, err, nil)
+			return
+		}
+		defer cleanup()
+	}
+	if staged {
+		pipeline.Start(stageStageIn)
+		cleanup, err := stageSource(job, transferProgress(pipeline.Progress(stageStageIn)))
+		if err != nil {
+			finishJob(job, err, nil)
+			return
+		}
+		defer cleanup()
+	}
+
+	params, err := jobParams(job)
+	if err != nil {
+		finishJob(job, err, nil)
+		return
+	}
+	params.OnProgress = pipeline.Progress(stageOptimize)
+	params.OnStage = func(stage string) { setJobStage(job, stage) }
+	params.OnDetail = jobDetail(job)
+	// Rejected outputs are quarantined to be approved next to the source,
+	// which remote and packaged outputs don't end up at
+	if cfg.Quarantine.Enabled && !remote && job.Packaging == "" {
+		params.Quarantine = &mediaopt.QuarantineCheck{MaxDurationChange: cfg.Quarantine.MaxDurationChangePercent / 100}
+	}
+
+	// Perform optimization
+	result := mediaopt.OptimizeMedia(params)
+	clearDetail(job)
+
+	var jobErr error
+	if !result.Success {
+		jobErr = result.Error
+	}
+	if result.Rejected != "" {
+		if err := quarantineOutput(job, params.OutputFile, result.Rejected, staged, jobErr); err != nil {
+			slog.Error("Failed to quarantine output", "path", result.Rejected, "error", err)
+			os.Remove(result.Rejected)
+			jobErr = fmt.Errorf("%v (quarantine failed: %v)", jobErr, err)
+		}
+	}
+	output, outputBytes := params.OutputFile, fileSize(params.OutputFile)
+	if jobErr == nil && job.Packaging != "" {
+		pipeline.Start(stagePackage)
+		var manifest string
+		if manifest, jobErr = packageJob(job, []string{params.OutputFile}, 0); jobErr == nil {
+			output, outputBytes = manifest, dirSize(filepath.Dir(manifest))
+		}
+	}
+	if jobErr == nil && remote {
+		pipeline.Start(stageUpload)
+		output, jobErr = uploadOutput(job, params.OutputFile, transferProgress(pipeline.Progress(stageUpload)))
+	}
+	// Packages are written next to the source already
+	if jobErr == nil && staged && job.Packaging == "" {
+		pipeline.Start(stageStageOut)
+		output, jobErr = unstageOutput(job, params.OutputFile, transferProgress(pipeline.Progress(stageStageOut)))
+	}
+	inputBytes := fileSize(params.InputFile)
+	var inputSum, outputSum string
+	if jobErr == nil {
+		pipeline.Start(stageChecksum)
+		inputSum = fileChecksum(params.InputFile)
+		if job.Packaging == "" {
+			outputSum = fileChecksum(params.OutputFile)
+		}
+	}
+	replaced := false
+	if jobErr == nil && replace {
+		pipeline.Start(stageReplace)
+		if final, err := replaceOriginal(job, output); err != nil {
+			slog.Warn("Failed to replace original", "path", job.SourcePath, "error", err)
+			result.Warnings = append(result.Warnings, fmt.Sprintf("original kept: %v", err))
+		} else {
+			output, replaced = final, true
+			recordEvent(job.ID, jobevents.TypeReplacedOriginal, "", final)
+		}
+	}
+	if recipe := job.request.recipe; jobErr == nil && recipe != nil {
+		pipeline.Start(stageRecipe)
+		final, err := runRecipe(job, recipe, output)
+		if err != nil {
+			slog.Warn("Watch folder recipe failed", "path", job.SourcePath, "error", err)
+			result.Warnings = append(result.Warnings, fmt.Sprintf("recipe incomplete: %v", err))
+		}
+		output = final
+	}
+	if jobErr == nil && !remote && job.Packaging == "" {
+		if err := moveSidecars(job, output); err != nil {
+			slog.Warn("Failed to move sidecars", "path", job.SourcePath, "error", err)
+			result.Warnings = append(result.Warnings, fmt.Sprintf("sidecars incomplete: %v", err))
+		}
+	}
+	finishJob(job, jobErr, func(r *jobstore.Record) {
+		r.OutputPath = output
+		if jobErr == nil {
+			r.InputBytes, r.OutputBytes = inputBytes, outputBytes
+		}
+		r.InputSHA256, r.OutputSHA256 = inputSum, outputSum
+		r.ReplacedOriginal = replaced
+		recordResult(r, result)
+	})
+}
+
+// videoPipeline returns the stages of a video job. The optimization takes
+// most of the progress and the transfers of a remote or staged job a tenth
+// each.
+func videoPipeline(job *OptimizationJob, remote, staged, replace bool) *mediaopt.Pipeline {
+	var stages []mediaopt.Stage
+	if remote {
+		stages = append(stages, mediaopt.Stage{Name: stageDownload, Weight: 10})
+	}
+	if staged {
+		stages = append(stages, mediaopt.Stage{Name: stageStageIn, Weight: 10})
+	}
+	stages = append(stages, mediaopt.Stage{Name: stageOptimize, Weight: 80})
+	if job.Packaging != "" {
+		stages = append(stages, mediaopt.Stage{Name: stagePackage, Weight: 5})
+	}
+	if remote {
+		stages = append(stages, mediaopt.Stage{Name: stageUpload, Weight: 10})
+	}
+	if staged && job.Packaging == "" {
+		stages = append(stages, mediaopt.Stage{Name: stageStageOut, Weight: 10})
+	}
+	if cfg.Checksums.Enabled {
+		stages = append(stages, mediaopt.Stage{Name: stageChecksum, Weight: 2})
+	}
+	if replace {
+		stages = append(stages, mediaopt.Stage{Name: stageReplace, Weight: 1})
+	}
+	if job.request.recipe != nil {
+		stages = append(stages, mediaopt.Stage{Name: stageRecipe, Weight: 1})
+	}
+	progress := jobProgress(job)
+	return mediaopt.NewPipeline(func(stage string, overall float64) {
+		// The optimization reports its own stages through OnStage
+		if stage != stageOptimize {
+			setJobStage(job, stage)
+		}
+		progress(overall)
+	}, stages...)
+}
+
+// setJobStage records the stage a job is in, which its next update sends
+func setJobStage(job *OptimizationJob, stage string) {
+	activeJobs.Lock()
+	changed := job.Stage != stage
+	job.Stage = stage
+	activeJobs.Unlock()
+	if changed && stage != "" {
+		recordEvent(job.ID, jobevents.TypeStage, "", stage)
+	}
+}
+
+// transferProgress reports a transfer's bytes as progress, once per whole
+// percent so large files don't flood the clients with updates
+func transferProgress(report func(float64)) storage.Progress {
+	last := -1
+	return func(done, total int64) {
+		if total <= 0 {
+			return
+		}
+		if percent := int(done * 100 / total); percent != last {
+			last = percent
+			report(float64(percent))
+		}
+	}
+}
+
+// remoteTempDir holds the files of jobs with remote sources while they run
+func remoteTempDir() string {
+	if cfg.Storage.TempDir != "" {
+		return cfg.Storage.TempDir
+	}
+	return filepath.Join(cfg.DataDir, "remote")
+}
+
+// downloadSource copies the remote source of a job into a new directory in
+// remoteTempDir, which the job then reads from. cleanup removes the
+// directory along with the output written next to the copy.
+func downloadSource(job *OptimizationJob, progress storage.Progress) (cleanup func(), err error) {
+	source, _, err := storage.ParsePath(job.SourcePath)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := lookupRemote(source)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(remoteTempDir(), 0755); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(remoteTempDir(), "job-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup = func() {
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Warn("Failed to remove remote job files", "dir", dir, "error", err)
+		}
+	}
+
+	local := filepath.Join(dir, filepath.Base(source.Key))
+	if err := remote.backend.Download(context.Background(), source.Key, local, progress); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to download source: %w", err)
+	}
+	job.input = local
+	if job.log != nil {
+		job.log.Printf("Downloaded %s to %s", job.SourcePath, local)
+	}
+	return cleanup, nil
+}
+
+// uploadOutput uploads the output of a job with a remote source next to the
+// source, or in its place when the remote deletes originals, and returns
+// the output's remote path. The original is only deleted once the output
+// is stored under a different key; failing to delete it doesn't fail the
+// job.
+func uploadOutput(job *OptimizationJob, output string, progress storage.Progress) (string, error) {
+	source, _, err := storage.ParsePath(job.SourcePath)
+	if err != nil {
+		return "", err
+	}
+	remote, err := lookupRemote(source)
+	if err != nil {
+		return "", err
+	}
+	key := source.Key[:strings.LastIndex(source.Key, "/")+1] + filepath.Base(output)
+	if remote.deleteOriginal {
+		key = strings.TrimSuffix(source.Key, filepath.Ext(source.Key)) + filepath.Ext(output)
+	}
+
+	ctx := context.Background()
+	if err := remote.backend.Upload(ctx, output, key, progress); err != nil {
+		return "", fmt.Errorf("failed to upload output: %w", err)
+	}
+	target := source.Join(key).String()
+	if job.log != nil {
+		job.log.Printf("Uploaded output to %s", target)
+	}
+	if remote.deleteOriginal && key != source.Key {
+		if err := remote.backend.Delete(ctx, source.Key); err != nil {
+			slog.Warn("Failed to delete remote original", "path", job.SourcePath, "error", err)
+		} else if job.log != nil {
+			job.log.Printf("Deleted original %s", job.SourcePath)
+		}
+	}
+	return target, nil
+}
+
+// replaceOriginal moves the source of a finished job to the trash and its
+// output into the source's place, keeping the output's extension. It returns
+// the new path of the output.
+func replaceOriginal(job *OptimizationJob, output string) (string, error) {
+	if job.ID == "" {
+		return "", fmt.Errorf("job has no history record to undo it with")
+	}
+	final := strings.TrimSuffix(job.SourcePath, filepath.Ext(job.SourcePath)) + filepath.Ext(output)
+	if final != job.SourcePath {
+		if _, err := os.Lstat(final); err == nil {
+			return "", fmt.Errorf("%s already exists", final)
+		}
+	}
+	if _, err := trashStore.Put(job.ID, job.SourcePath); err != nil {
+		return "", err
+	}
+	if err := os.Rename(output, final); err != nil {
+		if _, restoreErr := trashStore.Restore(job.ID); restoreErr != nil {
+			slog.Error("Failed to restore original from the trash", "path", job.SourcePath, "error", restoreErr)
+		}
+		return "", fmt.Errorf("failed to move %s into place: %v", output, err)
+	}
+	if job.log != nil {
+		job.log.Printf("Replaced original, kept in the trash: %s", job.SourcePath)
+	}
+	return final, nil
+}
+
+// moveSidecars copies or moves the subtitles, NFO files and artwork of a
+// finished job's source next to its output, named after it, as the job's
+// profile configures. Existing files are left alone and folder artwork is
+// always copied, as other videos may share it.
+func moveSidecars(job *OptimizationJob, output string) error {
+	sidecars := cfg.Sidecars
+	if p, ok := cfg.Profiles[job.Profile]; ok && p.Sidecars != nil {
+		sidecars = *p.Sidecars
+	}
+	if sidecars.Mode == config.SidecarsOff {
+		return nil
+	}
+	transfers, err := sidecar.Plan(job.SourcePath, output, sidecars.Extensions)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, t := range transfers {
+		if _, err := os.Lstat(t.To); err == nil {
+			continue
+		}
+		move := sidecars.Mode == config.SidecarsMove && !t.Shared
+		var err error
+		if move {
+			err = moveNew(job.ctx, t.From, t.To)
+		} else {
+			err = copyFile(job.ctx, t.To, t.From, nil)
+		}
+		if err != nil {
+			slog.Warn("Failed to transfer sidecar", "path", t.From, "error", err)
+			failed = append(failed, filepath.Base(t.From))
+			continue
+		}
+		if job.log != nil {
+			verb := "Copied"
+			if move {
+				verb = "Moved"
+			}
+			job.log.Printf("%s sidecar %s to %s", verb, t.From, t.To)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to %s %s", sidecars.Mode, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// purgeTrash deletes originals past the trash retention now and every
+// trashPurgeInterval
+func purgeTrash() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := trashStore.Purge(time.Now())
+		if err != nil {
+			slog.Error("Trash purge failed", "error", err)
+		}
+		for _, entry := range purged {
+			slog.Info("Purged original from the trash", "job", entry.ID, "path", entry.OriginalPath)
+		}
+		<-ticker.C
+	}
+}
+
+// packageJob segments a finished job's MP4 files into its packaging format
+// next to the source and removes them. It returns the manifest path.
+func packageJob(job *OptimizationJob, files []string, segmentSeconds float64) (string, error) {
+	manifest, err := mediaopt.Package(job.ctx, job.ID, files, mediaopt.Packaging{
+		Format:         job.Packaging,
+		SegmentSeconds: segmentSeconds,
+		OutputDir:      mediaopt.PackageDir(job.SourcePath, job.Packaging),
+	})
+	if err != nil {
+		return "", err
+	}
+	if job.log != nil {
+		job.log.Printf("Packaged as %s: %s", job.Packaging, manifest)
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			slog.Warn("Failed to remove packaged file", "path", f, "error", err)
+		}
+	}
+	return manifest, nil
+}
+
+// dirSize returns the total size of the files below dir
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			size += fileSize(path)
+		}
+		return nil
+	})
+	return size
+}
+
+// encodeLadder encodes the configured renditions of a video, reporting the
+// progress of each
+func encodeLadder(job *OptimizationJob) {
+	startJob(job)
+
+	params, err := jobParams(job)
+	if err != nil {
+		finishJob(job, err, nil)
+		return
+	}
+	probe, err := mediaopt.Probe(job.SourcePath)
+	if err != nil {
+		finishJob(job, fmt.Errorf("failed to probe input file: %v", err), nil)
+		return
+	}
+	renditions := mediaopt.LadderRenditions(probe, ladderRenditions(cfg.Ladder))
+
+	activeJobs.Lock()
+	job.Renditions = nil
+	for _, r := range renditions {
+		job.Renditions = append(job.Renditions, RenditionStatus{Name: r.Name, Height: r.Height, Status: "queued"})
+	}
+	activeJobs.Unlock()
+
+	overall := jobProgress(job)
+	ladder := mediaopt.Ladder{
+		Renditions:      renditions,
+		OutputDir:       mediaopt.LadderOutputDir(job.SourcePath),
+		KeyframeSeconds: cfg.Ladder.KeyframeSeconds,
+		OnProgress: func(index int, progress float64) {
+			activeJobs.Lock()
+			job.Renditions[index].Status, job.Renditions[index].Progress = "processing", int(progress)
+			if progress >= 100 {
+				job.Renditions[index].Status = "completed"
+			}
+			activeJobs.Unlock()
+			overall((float64(index)*100 + progress) / float64(len(renditions)))
+		},
+	}
+	result := mediaopt.EncodeLadder(params, ladder)
+
+	var jobErr error
+	if !result.Success {
+		jobErr = result.Error
+	}
+	if jobErr != nil {
+		// The first unfinished rendition is the one that failed
+		activeJobs.Lock()
+		for i := range job.Renditions {
+			if job.Renditions[i].Status != "completed" {
+				job.Renditions[i].Status = "failed"
+				break
+			}
+		}
+		activeJobs.Unlock()
+	}
+
+	// Sizes are taken before packaging removes the files
+	var completed []jobstore.Rendition
+	var files []string
+	for i, rendition := range renditions {
+		if job.Renditions[i].Status != "completed" {
+			break
+		}
+		output := rendition.OutputFile(ladder.OutputDir)
+		completed = append(completed, jobstore.Rendition{
+			Name:        rendition.Name,
+			Height:      rendition.Height,
+			OutputPath:  output,
+			OutputBytes: fileSize(output),
+		})
+		if jobErr == nil && job.Packaging == "" {
+			completed[i].SHA256 = fileChecksum(output)
+		}
+		files = append(files, output)
+	}
+	output := ladder.OutputDir
+	if jobErr == nil && job.Packaging != "" {
+		keyframes := cfg.Ladder.KeyframeSeconds
+		if keyframes <= 0 {
+			keyframes = mediaopt.DefaultKeyframeSeconds
+		}
+		var manifest string
+		if manifest, jobErr = packageJob(job, files, keyframes); jobErr == nil {
+			os.Remove(ladder.OutputDir)
+			output = manifest
+			for i := range completed {
+				completed[i].OutputPath = manifest
+			}
+		}
+	}
+
+	var inputSum string
+	if jobErr == nil {
+		inputSum = fileChecksum(params.InputFile)
+	}
+	finishJob(job, jobErr, func(r *jobstore.Record) {
+		r.OutputPath = output
+		r.InputBytes = fileSize(params.InputFile)
+		r.InputSHA256 = inputSum
+		r.Renditions = completed
+		for _, rendition := range completed {
+			r.OutputBytes += rendition.OutputBytes
+		}
+		recordResult(r, result)
+	})
+}
+
+// jobParams returns the optimization parameters of a video, remux or
+// ladder job with the configured output checks
+func jobParams(job *OptimizationJob) (*mediaopt.OptimizationParams, error) {
+	source := job.SourcePath
+	if job.input != "" {
+		source = job.input
+	}
+	params, err := videoParams(source, job.Container, job.Profile)
+	if err != nil {
+		return nil, err
+	}
+	params.JobID = job.ID
+	params.Context = job.ctx
+	params.Timeout = &mediaopt.Timeout{
+		Max:    time.Duration(job.request.TimeoutMinutes) * time.Minute,
+		Factor: cfg.Timeout.DurationFactor,
+		Min:    time.Duration(cfg.Timeout.MinMinutes) * time.Minute,
+	}
+	params.Streams = job.Streams
+	params.TargetSize = job.TargetSize
+	if cfg.Integrity.Enabled {
+		params.Integrity = &mediaopt.IntegrityCheck{
+			DurationTolerance: cfg.Integrity.DurationToleranceSeconds,
+		}
+	}
+	if cfg.Verification.Metric != "" {
+		params.Quality = &mediaopt.QualityCheck{
+			Metric:    cfg.Verification.Metric,
+			Threshold: cfg.Verification.Threshold,
+			FailBelow: cfg.Verification.FailBelowThreshold,
+		}
+	}
+	if cfg.StampOutputs {
+		params.Stamp = &mediaopt.Stamp{Version: version, Profile: job.Profile, JobID: job.ID}
+	}
+	if job.log != nil {
+		params.OnOutput = job.log.Write
+	}
+	return params, nil
+}
+
+// recordResult copies the warnings, analyses, crop, source attributes and
+// quality score of a video result into its history record
+func recordResult(r *jobstore.Record, result mediaopt.OptimizationResult) {
+	r.Warnings = result.Warnings
+	if result.Segments != nil {
+		for _, seg := range result.Segments.Segments {
+			r.Segments = append(r.Segments, jobstore.Segment(seg))
+		}
+		r.Flagged = len(r.Segments) > 0
+	}
+	if c := result.Crop; c != nil {
+		r.Crop = &jobstore.Crop{Width: c.Width, Height: c.Height, X: c.X, Y: c.Y}
+	}
+	if p := result.Probe; p != nil {
+		r.Source = sourceInfo(p)
+	}
+	if q := result.Quality; q != nil {
+		r.Quality = &jobstore.Quality{
+			Metric:    q.Metric,
+			Score:     q.Score,
+			Threshold: q.Threshold,
+			Passed:    q.Passed,
+		}
+		r.Flagged = r.Flagged || !q.Passed
+	}
+}
+
+// sourceInfo extracts the attributes recorded in job history from a probe
+func sourceInfo(p *mediaopt.ProbeResult) *jobstore.Source {
+	src := &jobstore.Source{Container: p.Format.FormatName}
+	if video := p.StreamsOfType("video"); len(video) > 0 {
+		src.VideoCodec = video[0].CodecName
+		src.Width, src.Height = video[0].Width, video[0].Height
+		src.HDR = video[0].HDRFormat()
+	}
+	for _, a := range p.StreamsOfType("audio") {
+		src.AudioCodecs = append(src.AudioCodecs, a.CodecName)
+	}
+	return src
+}
+
+// optimizeImages recompresses a single image or a folder of images
+func optimizeImages(job *OptimizationJob) {
+	startJob(job)
+
+	params := imageopt.NewDefaultParams(job.SourcePath)
+	params.Exclude = excludes
+	params.NameForm = cfg.UnicodeNormalization
+	params.Format = cfg.Images.Format
+	params.Quality = cfg.Images.Quality
+	params.Workers = cfg.Images.Workers
+	params.OnProgress = jobProgress(job)
+
+	result := imageopt.OptimizeImages(params)
+	slog.Info(result.Message, "job", job.ID)
+
+	var jobErr error
+	if !result.Success {
+		jobErr = result.Error
+	}
+	finishJob(job, jobErr, func(r *jobstore.Record) {
+		r.InputBytes, r.OutputBytes = result.InputBytes, result.OutputBytes
+		if !imageopt.IsImage(job.SourcePath) {
+			r.Outputs = result.Outputs
+			return
+		}
+		r.OutputPath = imageopt.OutputPath(params, job.SourcePath)
+	})
+}
+
+// transcodeMusic converts a lossless track or a music folder to the
+// configured lossy codec
+func transcodeMusic(job *OptimizationJob) {
+	startJob(job)
+
+	params := audioopt.NewDefaultParams(job.SourcePath)
+	params.Exclude = excludes
+	params.NameForm = cfg.UnicodeNormalization
+	params.Codec = cfg.Music.Codec
+	params.Bitrate = cfg.Music.Bitrate
+	params.OutputDir = cfg.Music.OutputDir
+	params.Workers = cfg.Music.Workers
+	params.OnProgress = jobProgress(job)
+
+	result := audioopt.TranscodeMusic(params)
+	slog.Info(result.Message, "job", job.ID)
+
+	var jobErr error
+	if !result.Success {
+		jobErr = result.Error
+	}
+	finishJob(job, jobErr, func(r *jobstore.Record) {
+		r.InputBytes, r.OutputBytes = result.InputBytes, result.OutputBytes
+		if !audioopt.IsAudio(job.SourcePath) {
+			r.Outputs = result.Outputs
+			return
+		}
+		r.OutputPath = audioopt.OutputPath(params, job.SourcePath)
+	})
+}
+
+// updateHistory applies fn to the job's record in the persistent job store
+func updateHistory(job *OptimizationJob, fn func(*jobstore.Record)) {
+	if job.ID == "" {
+		return
+	}
+	if err := jobStore.Update(job.ID, fn); err != nil {
+		slog.Error("Failed to update job history", "path", job.SourcePath, "error", err)
 	}
 }
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"media_optimizer/pkg/arr"
+	"media_optimizer/pkg/config"
+	"media_optimizer/pkg/jobstore"
+	"media_optimizer/pkg/mediapath"
+	"media_optimizer/pkg/schedule"
+	"media_optimizer/pkg/storage"
+
+	"github.com/gorilla/websocket"
+)
+
+// useConfig replaces the server's configuration with the defaults, changed
+// by fn, for the duration of the test
+func useConfig(t *testing.T, fn func(*config.Config)) {
+	t.Helper()
+	saved := cfg
+	cfg = config.Default()
+	if fn != nil {
+		fn(cfg)
+	}
+	t.Cleanup(func() { cfg = saved })
+}
+
+// useActiveJobs starts the test without active or claimed jobs
+func useActiveJobs(t *testing.T) {
+	t.Helper()
+	activeJobs.Lock()
+	jobs, claimed := activeJobs.jobs, activeJobs.claimed
+	activeJobs.jobs = make(map[string]*OptimizationJob)
+	activeJobs.claimed = make(map[string]bool)
+	activeJobs.Unlock()
+	t.Cleanup(func() {
+		activeJobs.Lock()
+		activeJobs.jobs, activeJobs.claimed = jobs, claimed
+		activeJobs.Unlock()
+	})
+}
+
+// wsPair returns the server side of a WebSocket connection and the client
+// connected to it
+func wsPair(t *testing.T) (*wsConn, *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade failed: %v", err)
+			return
+		}
+		conns <- ws
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	ws := <-conns
+	t.Cleanup(func() { ws.Close() })
+	return &wsConn{conn: ws}, client
+}
+
+// useJobStore gives the test an empty job history
+func useJobStore(t *testing.T) *jobstore.Store {
+	t.Helper()
+	store, err := jobstore.Open(filepath.Join(t.TempDir(), "jobs.json"))
+	if err != nil {
+		t.Fatalf("Failed to open job store: %v", err)
+	}
+	saved := jobStore
+	jobStore = store
+	t.Cleanup(func() { jobStore = saved })
+	return store
+}
+
+func TestClaimPathConcurrently(t *testing.T) {
+	useActiveJobs(t)
+	const path = "/media/movie.mkv"
+
+	const submissions = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, submissions)
+	for i := 0; i < submissions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- claimPath(path)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	claimed := 0
+	for err := range errs {
+		var conflict *jobConflictError
+		switch {
+		case err == nil:
+			claimed++
+		case !errors.As(err, &conflict):
+			t.Errorf("Expected a *jobConflictError, got %v", err)
+		case conflict.id != "" || conflict.path != path:
+			t.Errorf("Unexpected conflict with a claim: %+v", conflict)
+		}
+	}
+	if claimed != 1 {
+		t.Fatalf("Expected exactly one claim of %s, got %d", path, claimed)
+	}
+
+	releasePath(path)
+	if err := claimPath(path); err != nil {
+		t.Errorf("Expected claim after release to succeed, got %v", err)
+	}
+}
+
+func TestClaimPathAfterJobFinishes(t *testing.T) {
+	useActiveJobs(t)
+	const path = "/media/movie.mkv"
+	job := &OptimizationJob{ID: "job-1", SourcePath: path, Status: "processing"}
+	activeJobs.jobs[job.ID] = job
+
+	setStatus := func(status string) {
+		activeJobs.Lock()
+		job.Status = status
+		activeJobs.Unlock()
+	}
+	for _, status := range []string{"queued", "processing", "retryable"} {
+		setStatus(status)
+		var conflict *jobConflictError
+		if err := claimPath(path); !errors.As(err, &conflict) || conflict.id != job.ID {
+			t.Errorf("Claim beside a %s job: expected a conflict with %s, got %v", status, job.ID, err)
+		}
+	}
+	if err := claimPath("/media/other.mkv"); err != nil {
+		t.Errorf("Expected claim of another path to succeed, got %v", err)
+	}
+
+	for _, status := range []string{"completed", "failed", "attention", "cancelled", "undone", "quarantined", "discarded", "timed-out"} {
+		if !jobFinished(status) {
+			t.Errorf("Expected %s to be finished", status)
+		}
+		setStatus(status)
+		if err := claimPath(path); err != nil {
+			t.Errorf("Claim after a %s job: expected success, got %v", status, err)
+			continue
+		}
+		releasePath(path)
+	}
+}
+
+func TestJobUpdatesWhileRenditionsChange(t *testing.T) {
+	useActiveJobs(t)
+	conn, client := wsPair(t)
+	job := &OptimizationJob{ID: "ladder", SourcePath: "/media/a.mkv", Status: "processing",
+		Renditions: []RenditionStatus{{Name: "1080p"}, {Name: "720p"}}}
+	activeJobs.Lock()
+	activeJobs.jobs[job.ID] = job
+	activeJobs.Unlock()
+	subscribeJobs(conn, "sub", []string{job.ID})
+
+	const updates = 50
+	received := make(chan []RenditionStatus, updates+1)
+	go func() {
+		for {
+			var msg struct {
+				Data []RenditionStatus `json:"data"`
+			}
+			if err := client.ReadJSON(&msg); err != nil {
+				close(received)
+				return
+			}
+			received <- msg.Data
+		}
+	}()
+
+	// Rendition progress is recorded as the job's updates are sent, as a
+	// ladder encode does
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= updates; i++ {
+			activeJobs.Lock()
+			job.Renditions[i%2].Progress = i
+			activeJobs.Unlock()
+		}
+	}()
+	for i := 1; i <= updates; i++ {
+		sendWSUpdate(job, "progress", float64(i))
+	}
+	wg.Wait()
+
+	for i := 0; i <= updates; i++ {
+		select {
+		case renditions := <-received:
+			if len(renditions) != 2 {
+				t.Fatalf("Update %d: expected 2 renditions, got %v", i, renditions)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Update %d: timed out", i)
+		}
+	}
+}
+
+func TestCreateJobConflict(t *testing.T) {
+	useConfig(t, nil)
+	useActiveJobs(t)
+	store := useJobStore(t)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "photo.jpg")
+	if err := os.WriteFile(file, []byte("jpeg"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	resolved, err := mediapath.New(file, nil)
+	if err != nil {
+		t.Fatalf("Failed to resolve %s: %v", file, err)
+	}
+	path := resolved.String()
+
+	record, err := store.Create(path, KindImage)
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	activeJobs.jobs[record.ID] = &OptimizationJob{ID: record.ID, SourcePath: path, Kind: KindImage, Status: "processing"}
+
+	create := func() *httptest.ResponseRecorder {
+		body := strings.NewReader(`{"path": ` + strconv.Quote(file) + `}`)
+		w := httptest.NewRecorder()
+		handleCreateJob(w, httptest.NewRequest(http.MethodPost, "/api/jobs", body))
+		return w
+	}
+
+	// A running job is answered with its record so the client can follow it
+	w := create()
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusConflict, w.Code, w.Body)
+	}
+	var existing jobstore.Record
+	if err := json.NewDecoder(w.Body).Decode(&existing); err != nil {
+		t.Fatalf("Failed to decode conflict response: %v", err)
+	}
+	if existing.ID != record.ID {
+		t.Errorf("Expected the existing job %s, got %+v", record.ID, existing)
+	}
+
+	// A job still being created has no record yet and is answered as text
+	if err := claimPath("/media/claimed.jpg"); err != nil {
+		t.Fatalf("Failed to claim path: %v", err)
+	}
+	err = claimPath("/media/claimed.jpg")
+	if status := rejectStatus(err); status != http.StatusConflict {
+		t.Errorf("Expected status %d for %v, got %d", http.StatusConflict, err, status)
+	}
+	if !strings.Contains(err.Error(), "already being queued") {
+		t.Errorf("Unexpected conflict message: %v", err)
+	}
+}
+
+func TestRebuildWithActiveJobs(t *testing.T) {
+	useActiveJobs(t)
+	activeJobs.Lock()
+	activeJobs.jobs["done"] = &OptimizationJob{ID: "done", Status: "completed"}
+	activeJobs.jobs["running"] = &OptimizationJob{ID: "running", Status: "processing"}
+	activeJobs.Unlock()
+
+	w := httptest.NewRecorder()
+	handleRebuild(w, httptest.NewRequest(http.MethodPost, "/api/rebuild", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Rebuild with a running job: expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+}
+
+func TestDryRunOnlyForVideo(t *testing.T) {
+	useConfig(t, nil)
+	useActiveJobs(t)
+	photo := filepath.Join(t.TempDir(), "photo.jpg")
+	if err := os.WriteFile(photo, []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"path": %q, "dryRun": true}`, photo)
+	handleOptimize(w, httptest.NewRequest(http.MethodPost, "/api/optimize", strings.NewReader(body)))
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "dryRun") {
+		t.Errorf("Image dry run: expected status %d, got %d: %s", http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	}
+	activeJobs.RLock()
+	defer activeJobs.RUnlock()
+	if len(activeJobs.jobs) != 0 {
+		t.Errorf("Expected no job to be started, got %d", len(activeJobs.jobs))
+	}
+}
+
+func TestCalendar(t *testing.T) {
+	useActiveJobs(t)
+	store := useJobStore(t)
+	windows, err := schedule.New([]schedule.Window{{Days: []string{"mon"}, Start: "01:00", End: "07:00"}})
+	if err != nil {
+		t.Fatalf("Failed to parse windows: %v", err)
+	}
+	saved := workGate
+	workGate = schedule.NewGate(windows, nil)
+	t.Cleanup(func() { workGate = saved })
+
+	done, err := store.Create("/media/done.mkv", KindVideo)
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	started := time.Now().Add(-3 * time.Hour)
+	store.Update(done.ID, func(r *jobstore.Record) {
+		r.Status, r.StartedAt, r.FinishedAt = "completed", started, started.Add(2*time.Hour)
+	})
+	activeJobs.jobs["running"] = &OptimizationJob{ID: "running", SourcePath: "/media/running.mkv", Kind: KindVideo, Status: "processing", Progress: 50, StartedAt: time.Now().Add(-time.Hour)}
+	activeJobs.jobs["waiting"] = &OptimizationJob{ID: "waiting", SourcePath: "/media/waiting.mkv", Kind: KindVideo, Status: "queued"}
+	activeJobs.jobs["photos"] = &OptimizationJob{ID: "photos", SourcePath: "/media/photos", Kind: KindImage, Status: "queued"}
+
+	w := httptest.NewRecorder()
+	handleCalendar(w, httptest.NewRequest(http.MethodGet, "/api/calendar.ics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	feed := w.Body.String()
+	for _, expected := range []string{
+		"SUMMARY:Optimization window",
+		"SUMMARY:Optimizing running.mkv",
+		"SUMMARY:Queued: waiting.mkv",
+		"average of 1 completed video jobs",
+		"SUMMARY:Queued: photos",
+		"Duration unknown until the first image job completes",
+		"SUMMARY:Batch of 2 queued jobs",
+	} {
+		if !strings.Contains(strings.ReplaceAll(feed, "\r\n ", ""), expected) {
+			t.Errorf("Expected %q in the feed:\n%s", expected, feed)
+		}
+	}
+	// One window a week
+	if windows := strings.Count(feed, "SUMMARY:Optimization window"); windows != 1 {
+		t.Errorf("Expected 1 window in the next week, got %d", windows)
+	}
+}
+
+func TestThumbnailOutsideRoots(t *testing.T) {
+	dir := t.TempDir()
+	library := filepath.Join(dir, "media")
+	outside := filepath.Join(dir, "private.mkv")
+	if err := os.WriteFile(outside, []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	thumbnail := func() int {
+		w := httptest.NewRecorder()
+		handleThumbnail(w, httptest.NewRequest(http.MethodGet, "/api/thumbnail?path="+url.QueryEscape(outside), nil))
+		return w.Code
+	}
+
+	useConfig(t, func(c *config.Config) { c.MediaRoots = []string{library} })
+	if status := thumbnail(); status != http.StatusForbidden {
+		t.Errorf("Thumbnail outside the media roots: expected status %d, got %d", http.StatusForbidden, status)
+	}
+	useConfig(t, nil)
+	if status := thumbnail(); status != http.StatusForbidden {
+		t.Errorf("Thumbnail without media roots: expected status %d, got %d", http.StatusForbidden, status)
+	}
+}
+
+func TestSamplesDirKeysOnFullPath(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.DataDir = "/data" })
+
+	movies := samplesDir("/media/movies/Film.mkv", "")
+	if movies != samplesDir("/media/movies/./Film.mkv", "") {
+		t.Errorf("Expected the same file to reuse its directory, got %s", movies)
+	}
+	if movies == samplesDir("/media/tv/Film.mkv", "") {
+		t.Errorf("Expected files of the same name in different folders to be kept apart, got %s for both", movies)
+	}
+	if !strings.HasPrefix(movies, filepath.Join("/data", "samples", "Film-")) || filepath.Base(movies) != "default" {
+		t.Errorf("Expected a directory named after the file and profile, got %s", movies)
+	}
+}
+
+func TestRemoteTypeMismatch(t *testing.T) {
+	saved := remotes
+	remotes = map[string]remoteRoot{"media": {typ: storage.TypeS3}}
+	t.Cleanup(func() { remotes = saved })
+
+	for raw, ok := range map[string]bool{
+		"s3://media/movies/a.mkv":     true,
+		"sftp://media/movies/a.mkv":   false,
+		"webdav://media/movies/a.mkv": false,
+		"s3://other/movies/a.mkv":     false,
+	} {
+		path, _, err := storage.ParsePath(raw)
+		if err != nil {
+			t.Fatalf("ParsePath(%q) failed: %v", raw, err)
+		}
+		if _, err := lookupRemote(path); (err == nil) != ok {
+			t.Errorf("lookupRemote(%q): expected ok %v, got %v", raw, ok, err)
+		}
+		if _, err := favoriteDir(raw); (err == nil) != ok {
+			t.Errorf("favoriteDir(%q): expected ok %v, got %v", raw, ok, err)
+		}
+	}
+}
+
+func TestArrWebhookCredentials(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.Arr.Username = "sonarr"
+		c.Arr.Password = "secret"
+	})
+	tests := []struct {
+		name       string
+		user, pass string
+		basic      bool
+		status     int
+	}{
+		{"valid", "sonarr", "secret", true, http.StatusOK},
+		{"wrong password", "sonarr", "secreT", true, http.StatusUnauthorized},
+		{"wrong user", "radarr", "secret", true, http.StatusUnauthorized},
+		{"password prefix", "sonarr", "secre", true, http.StatusUnauthorized},
+		{"empty credentials", "", "", true, http.StatusUnauthorized},
+		{"no basic auth", "", "", false, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/webhooks/sonarr", strings.NewReader(`{"eventType": "Test"}`))
+		if tt.basic {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+		w := httptest.NewRecorder()
+		handleArrWebhook(arr.Sonarr)(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, w.Code)
+		}
+		if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a basic auth challenge", tt.name)
+		}
+	}
+}
+
+func TestBrowsePageSort(t *testing.T) {
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	listing := func() []FileInfo {
+		return []FileInfo{
+			{Name: "b.mkv", Size: 300, ModTime: day.Add(2 * time.Hour)},
+			{Name: "Shows", IsDir: true, Size: 10, ModTime: day},
+			{Name: "A.mp4", Size: 100, ModTime: day.Add(3 * time.Hour)},
+			{Name: "c.srt", Size: 200, ModTime: day.Add(time.Hour)},
+			{Name: "movies", IsDir: true, Size: 20, ModTime: day.Add(time.Hour)},
+		}
+	}
+	names := func(page BrowsePage) []string {
+		var names []string
+		for _, f := range page.Files {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+
+	tests := []struct {
+		request  BrowseRequest
+		expected []string
+	}{
+		// Directories come first, names compare case-insensitively
+		{BrowseRequest{}, []string{"movies", "Shows", "A.mp4", "b.mkv", "c.srt"}},
+		{BrowseRequest{Sort: "name", Desc: true}, []string{"Shows", "movies", "c.srt", "b.mkv", "A.mp4"}},
+		{BrowseRequest{Sort: "size"}, []string{"Shows", "movies", "A.mp4", "c.srt", "b.mkv"}},
+		{BrowseRequest{Sort: "size", Desc: true}, []string{"movies", "Shows", "b.mkv", "c.srt", "A.mp4"}},
+		{BrowseRequest{Sort: "date"}, []string{"Shows", "movies", "c.srt", "b.mkv", "A.mp4"}},
+		{BrowseRequest{Sort: "date", Desc: true}, []string{"movies", "Shows", "A.mp4", "b.mkv", "c.srt"}},
+		// Directories are kept by the extension filter
+		{BrowseRequest{Extensions: []string{".mkv", ".MP4"}}, []string{"movies", "Shows", "A.mp4", "b.mkv"}},
+	}
+	for _, tt := range tests {
+		page := browsePage("/media", listing(), tt.request)
+		if got := names(page); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%+v: expected %v, got %v", tt.request, tt.expected, got)
+		}
+		if page.Total != len(tt.expected) {
+			t.Errorf("%+v: expected total %d, got %d", tt.request, len(tt.expected), page.Total)
+		}
+	}
+}
+
+func TestBrowsePagination(t *testing.T) {
+	files := make([]FileInfo, maxBrowseLimit+10)
+	for i := range files {
+		files[i] = FileInfo{Name: fmt.Sprintf("%05d.mkv", i)}
+	}
+	listing := func() []FileInfo { return append([]FileInfo{}, files...) }
+
+	tests := []struct {
+		offset, limit int
+		// pageLimit, count and first describe the page served
+		pageLimit, count int
+		first            string
+	}{
+		{0, 0, defaultBrowseLimit, defaultBrowseLimit, "00000.mkv"},
+		{0, -1, defaultBrowseLimit, defaultBrowseLimit, "00000.mkv"},
+		{0, maxBrowseLimit + 1, maxBrowseLimit, maxBrowseLimit, "00000.mkv"},
+		{20, 10, 10, 10, "00020.mkv"},
+		// The last page is short
+		{len(files) - 3, 10, 10, 3, fmt.Sprintf("%05d.mkv", len(files)-3)},
+		// Pages past the end are empty but keep the total
+		{len(files), 10, 10, 0, ""},
+		{len(files) + 100, 10, 10, 0, ""},
+	}
+	for _, tt := range tests {
+		page := browsePage("/media", listing(), BrowseRequest{Offset: tt.offset, Limit: tt.limit})
+		if page.Limit != tt.pageLimit || len(page.Files) != tt.count || page.Total != len(files) || page.Offset != tt.offset {
+			t.Errorf("Offset %d, limit %d: unexpected page of %d files, limit %d, offset %d, total %d",
+				tt.offset, tt.limit, len(page.Files), page.Limit, page.Offset, page.Total)
+			continue
+		}
+		if tt.count > 0 && page.Files[0].Name != tt.first {
+			t.Errorf("Offset %d, limit %d: expected %s first, got %s", tt.offset, tt.limit, tt.first, page.Files[0].Name)
+		}
+	}
+}
+
+func TestBrowseRejectsInvalidPages(t *testing.T) {
+	useConfig(t, nil)
+	dir := t.TempDir()
+	for _, name := range []string{"a.mkv", "b.mkv"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	for _, request := range []BrowseRequest{
+		{Path: dir, Offset: -1},
+		{Path: dir, Sort: "type"},
+	} {
+		if _, status, err := browse(context.Background(), request); err == nil || status != http.StatusBadRequest {
+			t.Errorf("%+v: expected status %d, got %d (%v)", request, http.StatusBadRequest, status, err)
+		}
+	}
+
+	page, status, err := browse(context.Background(), BrowseRequest{Path: dir, Offset: 5})
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("Expected a page past the end to be served, got %d (%v)", status, err)
+	}
+	if len(page.Files) != 0 || page.Total != 2 {
+		t.Errorf("Expected an empty page of 2 files, got %d files of %d", len(page.Files), page.Total)
+	}
+}
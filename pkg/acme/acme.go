@@ -0,0 +1,299 @@
+// Package acme obtains and renews TLS certificates from an ACME CA such as
+// Let's Encrypt (RFC 8555), proving control of the domains with http-01
+// challenges. It covers what the server needs of
+// golang.org/x/crypto/acme/autocert without the dependency.
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LetsEncrypt is the directory of Let's Encrypt's production CA
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+// challengePath is where the CA fetches http-01 key authorizations
+const challengePath = "/.well-known/acme-challenge/"
+
+// Renewal timing
+const (
+	// renewBefore is how long before expiry a certificate is renewed
+	renewBefore = 30 * 24 * time.Hour
+	// renewRetry is the wait after a failed attempt
+	renewRetry = time.Hour
+	// maxCheckInterval bounds the sleep between expiry checks
+	maxCheckInterval = 24 * time.Hour
+	// obtainTimeout bounds one attempt to obtain a certificate
+	obtainTimeout = 5 * time.Minute
+)
+
+// Cache files in Options.CacheDir
+const (
+	accountKeyFile = "account.key"
+	certFile       = "cert.pem"
+	certKeyFile    = "cert.key"
+)
+
+// Options configures a Manager
+type Options struct {
+	// DirectoryURL is the CA's directory, LetsEncrypt if empty
+	DirectoryURL string
+	// Email is the account's contact for expiry notices, optional
+	Email string
+	// Domains are the names the certificate is issued for
+	Domains []string
+	// CacheDir keeps the account key and the certificate across restarts
+	CacheDir string
+	// HTTPClient talks to the CA, http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+// Manager holds a certificate for the domains, obtaining it and renewing it
+// before it expires
+type Manager struct {
+	opts Options
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// tokens maps pending http-01 tokens to their key authorizations
+	tokens map[string]string
+
+	// pollInterval is passed on to the protocol client
+	pollInterval time.Duration
+}
+
+// NewManager returns a manager with the certificate cached in
+// opts.CacheDir, if any. Call Run to obtain and renew it.
+func NewManager(opts Options) (*Manager, error) {
+	if len(opts.Domains) == 0 {
+		return nil, errors.New("acme: no domains")
+	}
+	if opts.DirectoryURL == "" {
+		opts.DirectoryURL = LetsEncrypt
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	if err := os.MkdirAll(opts.CacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("acme: failed to create cache: %v", err)
+	}
+
+	m := &Manager{opts: opts, tokens: map[string]string{}, pollInterval: 2 * time.Second}
+	cert, err := tls.LoadX509KeyPair(m.path(certFile), m.path(certKeyFile))
+	if err == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	switch {
+	case err == nil:
+		m.cert = &cert
+	case !os.IsNotExist(err):
+		slog.Warn("Ignoring the cached certificate", "error", err)
+	}
+	return m, nil
+}
+
+// GetCertificate serves the managed certificate, for tls.Config
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("acme: certificate not obtained yet")
+	}
+	return m.cert, nil
+}
+
+// HTTPHandler answers the CA's http-01 challenges and passes other requests
+// to fallback. It must be reachable on port 80 of the domains.
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, challengePath)
+		if !ok {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		m.mu.RLock()
+		keyAuth, ok := m.tokens[token]
+		m.mu.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+// Run obtains the certificate if there is none or it doesn't cover the
+// domains, then renews it before it expires, until ctx is done
+func (m *Manager) Run(ctx context.Context) {
+	for {
+		wait := m.untilRenewal(time.Now())
+		if wait <= 0 {
+			attempt, cancel := context.WithTimeout(ctx, obtainTimeout)
+			err := m.Renew(attempt)
+			cancel()
+			if err != nil {
+				slog.Error("Failed to obtain certificate", "domains", m.opts.Domains, "error", err, "retry", renewRetry)
+				wait = renewRetry
+			} else {
+				wait = m.untilRenewal(time.Now())
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(min(wait, maxCheckInterval)):
+		}
+	}
+}
+
+// untilRenewal returns how long the certificate may still be used before
+// renewing it, zero or less if it must be renewed now
+func (m *Manager) untilRenewal(now time.Time) time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil || m.cert.Leaf == nil {
+		return 0
+	}
+	for _, domain := range m.opts.Domains {
+		if m.cert.Leaf.VerifyHostname(domain) != nil {
+			return 0
+		}
+	}
+	return m.cert.Leaf.NotAfter.Add(-renewBefore).Sub(now)
+}
+
+// Renew obtains a new certificate for the domains and serves it from then
+// on
+func (m *Manager) Renew(ctx context.Context) error {
+	accountKey, err := m.loadKey(accountKeyFile)
+	if err != nil {
+		return err
+	}
+	c := &client{
+		http:         m.opts.HTTPClient,
+		directoryURL: m.opts.DirectoryURL,
+		key:          accountKey,
+		pollInterval: m.pollInterval,
+	}
+	if err := c.register(ctx, m.opts.Email); err != nil {
+		return err
+	}
+
+	// A new key for every certificate
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.opts.Domains[0]},
+		DNSNames: m.opts.Domains,
+	}, certKey)
+	if err != nil {
+		return err
+	}
+	slog.Info("Requesting certificate", "domains", m.opts.Domains, "ca", m.opts.DirectoryURL)
+	chain, err := c.obtain(ctx, m.opts.Domains, csr, m.publish)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if err != nil {
+		return fmt.Errorf("acme: invalid certificate from the CA: %v", err)
+	}
+	if err := writeFile(m.path(certKeyFile), keyPEM); err != nil {
+		return err
+	}
+	if err := writeFile(m.path(certFile), chain); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+	slog.Info("Obtained certificate", "domains", m.opts.Domains, "expires", cert.Leaf.NotAfter)
+	return nil
+}
+
+// publish serves a key authorization until the returned function is called
+func (m *Manager) publish(token, keyAuth string) func() {
+	m.mu.Lock()
+	m.tokens[token] = keyAuth
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		delete(m.tokens, token)
+		m.mu.Unlock()
+	}
+}
+
+// loadKey reads an ECDSA key from the cache, creating it if missing
+func (m *Manager) loadKey(name string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(m.path(name))
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("acme: no key in %s", m.path(name))
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(m.path(name), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (m *Manager) path(name string) string {
+	return filepath.Join(m.opts.CacheDir, name)
+}
+
+// writeFile replaces a private file in one step, so a crash can't leave a
+// certificate without its key
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("acme: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("acme: %v", err)
+	}
+	return nil
+}
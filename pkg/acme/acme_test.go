@@ -0,0 +1,284 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCA is a minimal ACME server that checks the signature of every
+// request and validates http-01 challenges against a challenge server
+type fakeCA struct {
+	t          *testing.T
+	server     *httptest.Server
+	challenges string
+
+	mu         sync.Mutex
+	accountKey *ecdsa.PublicKey
+	nonces     int
+	// rejectNonce fails the next request with badNonce
+	rejectNonce bool
+	validated   bool
+	issued      []byte
+}
+
+func newFakeCA(t *testing.T, challenges string) *fakeCA {
+	ca := &fakeCA{t: t, challenges: challenges, rejectNonce: true}
+	ca.server = httptest.NewServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.server.Close)
+	return ca
+}
+
+func (ca *fakeCA) url(path string) string {
+	return ca.server.URL + path
+}
+
+func (ca *fakeCA) serve(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(directory{NewNonce: ca.url("/nonce"), NewAccount: ca.url("/account"), NewOrder: ca.url("/order")})
+		return
+	}
+	ca.nonces++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", ca.nonces))
+	if r.URL.Path == "/nonce" {
+		return
+	}
+
+	payload, err := ca.verify(r)
+	if err != nil {
+		ca.t.Errorf("%s: %v", r.URL.Path, err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Problem{Type: "urn:ietf:params:acme:error:malformed", Detail: err.Error()})
+		return
+	}
+	if ca.rejectNonce {
+		ca.rejectNonce = false
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Problem{Type: "urn:ietf:params:acme:error:badNonce"})
+		return
+	}
+
+	order := map[string]interface{}{
+		"status":         "pending",
+		"authorizations": []string{ca.url("/authz")},
+		"finalize":       ca.url("/finalize"),
+	}
+	if ca.validated {
+		order["status"] = "ready"
+	}
+	if ca.issued != nil {
+		order["status"], order["certificate"] = "valid", ca.url("/cert")
+	}
+	authz := map[string]interface{}{
+		"status":     "pending",
+		"identifier": map[string]string{"type": "dns", "value": "media.example.com"},
+		"challenges": []map[string]string{
+			{"type": "dns-01", "url": ca.url("/dns"), "token": "other"},
+			{"type": "http-01", "url": ca.url("/challenge"), "token": "token123"},
+		},
+	}
+	if ca.validated {
+		authz["status"] = "valid"
+	}
+
+	switch r.URL.Path {
+	case "/account":
+		w.Header().Set("Location", ca.url("/account/1"))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+	case "/order":
+		w.Header().Set("Location", ca.url("/order/1"))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(order)
+	case "/order/1":
+		json.NewEncoder(w).Encode(order)
+	case "/authz":
+		json.NewEncoder(w).Encode(authz)
+	case "/challenge":
+		// Validate as the CA would, over plain HTTP
+		resp, err := http.Get(ca.challenges + challengePath + "token123")
+		if err != nil {
+			ca.t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		ca.validated = string(body) == "token123."+thumbprint(ca.accountKey)
+		if !ca.validated {
+			ca.t.Errorf("Expected the key authorization, got %q", body)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"type": "http-01", "status": "processing"})
+	case "/finalize":
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || csr.CheckSignature() != nil {
+			ca.t.Fatalf("Invalid CSR: %v", err)
+		}
+		ca.issued = ca.issue(csr)
+		order["status"] = "processing"
+		json.NewEncoder(w).Encode(order)
+	case "/cert":
+		w.Write(ca.issued)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// verify checks the JWS of a request and returns its payload
+func (ca *fakeCA) verify(r *http.Request) ([]byte, error) {
+	var jws map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, err
+	}
+	enc := base64.RawURLEncoding
+	header, _ := enc.DecodeString(jws["protected"])
+	var protected struct {
+		Alg   string            `json:"alg"`
+		URL   string            `json:"url"`
+		Nonce string            `json:"nonce"`
+		KID   string            `json:"kid"`
+		JWK   map[string]string `json:"jwk"`
+	}
+	if err := json.Unmarshal(header, &protected); err != nil {
+		return nil, err
+	}
+	if protected.URL != ca.url(r.URL.Path) || protected.Nonce == "" || protected.Alg != "ES256" {
+		return nil, fmt.Errorf("bad protected header %s", header)
+	}
+
+	key := ca.accountKey
+	if r.URL.Path == "/account" {
+		x, _ := enc.DecodeString(protected.JWK["x"])
+		y, _ := enc.DecodeString(protected.JWK["y"])
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		ca.accountKey = key
+	} else if protected.KID != ca.url("/account/1") {
+		return nil, fmt.Errorf("expected the account URL as kid, got %q", protected.KID)
+	}
+
+	signature, _ := enc.DecodeString(jws["signature"])
+	digest := sha256Sum(jws["protected"] + "." + jws["payload"])
+	if len(signature) != 64 || !ecdsa.Verify(key, digest, new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return enc.DecodeString(jws["payload"])
+}
+
+// issue signs a short-lived certificate for the CSR with a throwaway CA
+func (ca *fakeCA) issue(csr *x509.CertificateRequest) []byte {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, caTemplate, csr.PublicKey, caKey)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+}
+
+func sha256Sum(s string) []byte {
+	digest := sha256.Sum256([]byte(s))
+	return digest[:]
+}
+
+func TestManager(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Domains: []string{"media.example.com"}, CacheDir: dir, Email: "admin@example.com"}
+	m, err := NewManager(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.pollInterval = time.Millisecond
+	if _, err := m.GetCertificate(nil); err == nil {
+		t.Error("Expected no certificate before one is obtained")
+	}
+	if m.untilRenewal(time.Now()) > 0 {
+		t.Error("Expected a missing certificate to be due")
+	}
+
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://media.example.com"+r.URL.Path, http.StatusMovedPermanently)
+	})
+	challenges := httptest.NewServer(m.HTTPHandler(fallback))
+	defer challenges.Close()
+	ca := newFakeCA(t, challenges.URL)
+	m.opts.DirectoryURL = ca.url("/directory")
+
+	if err := m.Renew(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := m.GetCertificate(nil)
+	if err != nil || cert.Leaf.DNSNames[0] != "media.example.com" {
+		t.Fatalf("Expected the issued certificate, got %v", err)
+	}
+	if wait := m.untilRenewal(time.Now()); wait < 50*24*time.Hour {
+		t.Errorf("Expected the renewal 30 days before expiry, got %v", wait)
+	}
+	if len(m.tokens) != 0 {
+		t.Error("Expected the challenge token to be withdrawn")
+	}
+
+	// Other requests go to the fallback
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(challenges.URL + "/browse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("Expected the fallback's redirect, got %s", resp.Status)
+	}
+
+	// A restart serves the cached certificate
+	m2, err := NewManager(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err := m2.GetCertificate(nil); err != nil || !strings.Contains(cert.Leaf.Subject.CommonName, "media.example.com") {
+		t.Errorf("Expected the cached certificate, got %v", err)
+	}
+
+	// Changing the domains requires a new certificate
+	m3, _ := NewManager(Options{Domains: []string{"other.example.com"}, CacheDir: dir})
+	if m3.untilRenewal(time.Now()) > 0 {
+		t.Error("Expected a certificate not covering the domains to be due")
+	}
+}
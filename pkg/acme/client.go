@@ -0,0 +1,348 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxResponse bounds a response of the CA, a certificate chain being the
+// largest
+const maxResponse = 1 << 20
+
+// badNonceRetries is how often a request rejected for its nonce is resent
+const badNonceRetries = 3
+
+// directory lists the endpoints of a CA
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// Problem is an error reported by the CA (RFC 8555 section 6.7)
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *Problem `json:"error"`
+}
+
+type authorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *Problem `json:"error"`
+}
+
+// client speaks RFC 8555 to a CA with one account key. It isn't safe for
+// concurrent use.
+type client struct {
+	http         *http.Client
+	directoryURL string
+	dir          directory
+	key          *ecdsa.PrivateKey
+	// kid is the account URL, empty until registered
+	kid   string
+	nonce string
+	// pollInterval is the wait between checks of a pending order or
+	// authorization
+	pollInterval time.Duration
+}
+
+// register looks up the CA's endpoints and creates the account of the key,
+// or finds the existing one
+func (c *client) register(ctx context.Context, email string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("acme: failed to fetch directory: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("acme: failed to fetch directory: %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponse)).Decode(&c.dir); err != nil {
+		return fmt.Errorf("acme: invalid directory: %v", err)
+	}
+
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	header, _, err := c.post(ctx, c.dir.NewAccount, account)
+	if err != nil {
+		return err
+	}
+	c.kid = header.Get("Location")
+	if c.kid == "" {
+		return fmt.Errorf("acme: account response without location")
+	}
+	return nil
+}
+
+// obtain orders a certificate for the domains and returns its PEM chain.
+// solve publishes the key authorization of an http-01 challenge token and
+// returns a function withdrawing it.
+func (c *client) obtain(ctx context.Context, domains []string, csr []byte, solve func(token, keyAuth string) func()) ([]byte, error) {
+	var identifiers []map[string]string
+	for _, d := range domains {
+		identifiers = append(identifiers, map[string]string{"type": "dns", "value": d})
+	}
+	var o order
+	header, err := c.postJSON(ctx, c.dir.NewOrder, map[string]interface{}{"identifiers": identifiers}, &o)
+	if err != nil {
+		return nil, err
+	}
+	orderURL := header.Get("Location")
+
+	for _, url := range o.Authorizations {
+		if err := c.authorize(ctx, url, solve); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.wait(ctx, orderURL, &o, func() bool { return o.Status == "pending" }); err != nil {
+		return nil, err
+	}
+	if o.Status != "ready" {
+		return nil, fmt.Errorf("acme: order is %s: %v", o.Status, o.Error)
+	}
+	csrField := map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}
+	if _, err := c.postJSON(ctx, o.Finalize, csrField, &o); err != nil {
+		return nil, err
+	}
+	if err := c.wait(ctx, orderURL, &o, func() bool { return o.Status == "processing" || o.Status == "ready" }); err != nil {
+		return nil, err
+	}
+	if o.Status != "valid" || o.Certificate == "" {
+		return nil, fmt.Errorf("acme: order is %s: %v", o.Status, o.Error)
+	}
+
+	_, chain, err := c.post(ctx, o.Certificate, nil)
+	return chain, err
+}
+
+// authorize completes the http-01 challenge of an authorization
+func (c *client) authorize(ctx context.Context, url string, solve func(token, keyAuth string) func()) error {
+	var authz authorization
+	if _, err := c.postJSON(ctx, url, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	var chal *challenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == "http-01" {
+			chal = &authz.Challenges[i]
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("acme: no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+	withdraw := solve(chal.Token, chal.Token+"."+thumbprint(&c.key.PublicKey))
+	defer withdraw()
+
+	if _, err := c.postJSON(ctx, chal.URL, struct{}{}, chal); err != nil {
+		return err
+	}
+	if err := c.wait(ctx, url, &authz, func() bool { return authz.Status == "pending" }); err != nil {
+		return err
+	}
+	if authz.Status != "valid" {
+		for _, ch := range authz.Challenges {
+			if ch.Error != nil {
+				return fmt.Errorf("acme: validation of %s failed: %v", authz.Identifier.Value, ch.Error)
+			}
+		}
+		return fmt.Errorf("acme: authorization of %s is %s", authz.Identifier.Value, authz.Status)
+	}
+	return nil
+}
+
+// wait fetches url into v until pending returns false
+func (c *client) wait(ctx context.Context, url string, v interface{}, pending func() bool) error {
+	for {
+		if _, err := c.postJSON(ctx, url, nil, v); err != nil {
+			return err
+		}
+		if !pending() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
+
+// postJSON is post decoding the response into out
+func (c *client) postJSON(ctx context.Context, url string, payload, out interface{}) (http.Header, error) {
+	header, body, err := c.post(ctx, url, payload)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return nil, fmt.Errorf("acme: invalid response from %s: %v", url, err)
+	}
+	return header, nil
+}
+
+// post sends payload signed with the account key. A nil payload makes a
+// POST-as-GET request.
+func (c *client) post(ctx context.Context, url string, payload interface{}) (http.Header, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		nonce, err := c.takeNonce(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := c.sign(url, nonce, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, nil, fmt.Errorf("acme: %v", err)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("acme: %v", err)
+		}
+		c.nonce = resp.Header.Get("Replay-Nonce")
+
+		if resp.StatusCode >= 400 {
+			problem := &Problem{Status: resp.StatusCode}
+			if json.Unmarshal(data, problem) != nil || problem.Type == "" {
+				problem.Type, problem.Detail = "http", resp.Status+": "+strings.TrimSpace(string(data))
+			}
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt < badNonceRetries {
+				continue
+			}
+			return nil, nil, problem
+		}
+		return resp.Header, data, nil
+	}
+}
+
+// takeNonce returns the nonce of the last response, or a new one
+func (c *client) takeNonce(ctx context.Context) (string, error) {
+	if nonce := c.nonce; nonce != "" {
+		c.nonce = ""
+		return nonce, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("acme: failed to get a nonce: %v", err)
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("acme: no nonce from %s: %s", c.dir.NewNonce, resp.Status)
+	}
+	return nonce, nil
+}
+
+// sign returns payload as a flattened JWS signed with ES256. Requests
+// before registration carry the public key, later ones the account URL.
+func (c *client) sign(url, nonce string, payload interface{}) ([]byte, error) {
+	protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = jwk(&c.key.PublicKey)
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(header) + "." + enc.EncodeToString(body)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": enc.EncodeToString(header),
+		"payload":   enc.EncodeToString(body),
+		"signature": enc.EncodeToString(signature),
+	})
+}
+
+// jwk returns the JSON Web Key of a P-256 public key
+func jwk(key *ecdsa.PublicKey) map[string]string {
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   base64.RawURLEncoding.EncodeToString(x),
+		"y":   base64.RawURLEncoding.EncodeToString(y),
+	}
+}
+
+// thumbprint returns the RFC 7638 thumbprint of a key, which proves the
+// account's control of a challenge
+func thumbprint(key *ecdsa.PublicKey) string {
+	// Maps marshal with sorted keys, the canonical form the RFC requires
+	data, _ := json.Marshal(jwk(key))
+	digest := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
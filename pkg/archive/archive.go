@@ -0,0 +1,201 @@
+// Package archive streams a set of files as a zip or tar archive, for
+// downloading the outputs of several jobs at once
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Formats
+const (
+	FormatZip = "zip"
+	FormatTar = "tar"
+)
+
+// File is a file to archive under Name, a slash-separated relative path
+type File struct {
+	Path string
+	Name string
+	Size int64
+}
+
+// ContentType returns the MIME type of an archive format, empty for unknown
+// formats
+func ContentType(format string) string {
+	switch format {
+	case FormatZip:
+		return "application/zip"
+	case FormatTar:
+		return "application/x-tar"
+	}
+	return ""
+}
+
+// Collect returns the files to archive for paths, each a file or a
+// directory whose files are added recursively. Hidden files, such as
+// partial outputs, are left out. Names are relative to the deepest
+// directory containing every path, so a selected directory keeps its name.
+func Collect(paths []string) ([]File, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no files selected")
+	}
+	root := filepath.Dir(filepath.Clean(paths[0]))
+	for _, p := range paths[1:] {
+		root = commonDir(root, filepath.Dir(filepath.Clean(p)))
+	}
+
+	seen := make(map[string]bool)
+	var files []File
+	add := func(path string, info fs.FileInfo) error {
+		if seen[path] {
+			return nil
+		}
+		seen[path] = true
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{Path: path, Name: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	}
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not accessible: %v", p, err)
+		}
+		if !info.IsDir() {
+			if err := add(p, info); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != p && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return add(path, info)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files selected")
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// commonDir returns the deepest directory containing both a and b
+func commonDir(a, b string) string {
+	for {
+		rel, err := filepath.Rel(a, b)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return a
+		}
+		parent := filepath.Dir(a)
+		if parent == a {
+			return a
+		}
+		a = parent
+	}
+}
+
+// Write streams files to w as an archive in format. Media is already
+// compressed, so zip entries are stored rather than deflated. Writing stops
+// when ctx is cancelled.
+func Write(ctx context.Context, w io.Writer, format string, files []File) error {
+	switch format {
+	case FormatZip:
+		zw := zip.NewWriter(w)
+		for _, f := range files {
+			info, err := os.Stat(f.Path)
+			if err != nil {
+				return err
+			}
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			header.Name = f.Name
+			header.Method = zip.Store
+			entry, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			if err := copyFile(ctx, entry, f.Path); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	case FormatTar:
+		tw := tar.NewWriter(w)
+		for _, f := range files {
+			info, err := os.Stat(f.Path)
+			if err != nil {
+				return err
+			}
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = f.Name
+			header.Format = tar.FormatPAX
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if err := copyFile(ctx, tw, f.Path); err != nil {
+				return err
+			}
+		}
+		return tw.Close()
+	}
+	return fmt.Errorf("format must be %q or %q, got %q", FormatZip, FormatTar, format)
+}
+
+// copyFile copies the file at path to w
+func copyFile(ctx context.Context, w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, &contextReader{ctx: ctx, r: f})
+	return err
+}
+
+// contextReader fails reads once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,95 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		return path
+	}
+	write("photos/trip/a_optimized.webp", "a")
+	write("photos/trip/day2/b_optimized.webp", "bb")
+	write("photos/trip/.partial-c_optimized.webp", "c")
+	movie := write("movies/movie_optimized.mkv", "movie")
+
+	files, err := Collect([]string{filepath.Join(root, "photos", "trip"), movie, movie})
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	expected := []string{"movies/movie_optimized.mkv", "photos/trip/a_optimized.webp", "photos/trip/day2/b_optimized.webp"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+	if single, _ := Collect([]string{movie}); len(single) != 1 || single[0].Name != "movie_optimized.mkv" || single[0].Size != 5 {
+		t.Errorf("Expected a single file under its name, got %+v", single)
+	}
+	if _, err := Collect([]string{filepath.Join(root, "missing")}); err == nil {
+		t.Error("Expected a missing path to fail")
+	}
+
+	var buf bytes.Buffer
+	if err := Write(context.Background(), &buf, FormatZip, files); err != nil {
+		t.Fatalf("Write zip failed: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Failed to read zip: %v", err)
+	}
+	if len(zr.File) != 3 || zr.File[0].Name != expected[0] || zr.File[0].Method != zip.Store {
+		t.Fatalf("Unexpected zip entries: %+v", zr.File)
+	}
+	rc, _ := zr.File[0].Open()
+	if data, _ := io.ReadAll(rc); string(data) != "movie" {
+		t.Errorf("Expected the file's data in the zip, got %q", data)
+	}
+
+	buf.Reset()
+	if err := Write(context.Background(), &buf, FormatTar, files); err != nil {
+		t.Fatalf("Write tar failed: %v", err)
+	}
+	tr := tar.NewReader(&buf)
+	var tarNames []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar: %v", err)
+		}
+		tarNames = append(tarNames, header.Name)
+	}
+	if !reflect.DeepEqual(tarNames, expected) {
+		t.Errorf("Expected %v in the tar, got %v", expected, tarNames)
+	}
+
+	if err := Write(context.Background(), io.Discard, "rar", files); err == nil {
+		t.Error("Expected an unknown format to fail")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Write(ctx, io.Discard, FormatTar, files); err == nil {
+		t.Error("Expected a cancelled context to stop the archive")
+	}
+}
@@ -0,0 +1,136 @@
+// Package arr parses the import webhooks sent by Sonarr and Radarr
+package arr
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Applications sending webhooks
+const (
+	Sonarr = "sonarr"
+	Radarr = "radarr"
+)
+
+// Event types of interest. Sonarr and Radarr send "Download" for both new
+// imports and upgrades, telling them apart with isUpgrade.
+const (
+	EventDownload = "Download"
+	EventTest     = "Test"
+)
+
+// Import is an imported file announced by a webhook
+type Import struct {
+	App     string
+	Path    string
+	Upgrade bool
+	// Title names the series or movie, for logging
+	Title string
+}
+
+// PathMapping rewrites a path prefix as seen by Sonarr/Radarr into the same
+// location on this server
+type PathMapping struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// file is the imported file, "episodeFile" in Sonarr and "movieFile" in
+// Radarr. Path is only sent by newer versions.
+type file struct {
+	Path         string `json:"path"`
+	RelativePath string `json:"relativePath"`
+}
+
+type payload struct {
+	EventType string `json:"eventType"`
+	IsUpgrade bool   `json:"isUpgrade"`
+	Series    *struct {
+		Title string `json:"title"`
+		Path  string `json:"path"`
+	} `json:"series"`
+	EpisodeFile *file `json:"episodeFile"`
+	Movie       *struct {
+		Title      string `json:"title"`
+		FolderPath string `json:"folderPath"`
+	} `json:"movie"`
+	MovieFile *file `json:"movieFile"`
+}
+
+// Parse decodes a webhook body from app. It returns the event type, and the
+// imported file for Download events.
+func Parse(app string, body []byte) (string, *Import, error) {
+	var p payload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return "", nil, fmt.Errorf("invalid %s payload: %v", app, err)
+	}
+	if p.EventType != EventDownload {
+		return p.EventType, nil, nil
+	}
+
+	imp := &Import{App: app, Upgrade: p.IsUpgrade}
+	var f *file
+	var dir string
+	switch app {
+	case Sonarr:
+		if p.Series != nil {
+			imp.Title, dir = p.Series.Title, p.Series.Path
+		}
+		f = p.EpisodeFile
+	case Radarr:
+		if p.Movie != nil {
+			imp.Title, dir = p.Movie.Title, p.Movie.FolderPath
+		}
+		f = p.MovieFile
+	default:
+		return "", nil, fmt.Errorf("unknown application: %s", app)
+	}
+
+	switch {
+	case f == nil:
+		return "", nil, fmt.Errorf("%s payload has no imported file", app)
+	case f.Path != "":
+		imp.Path = f.Path
+	case dir != "" && f.RelativePath != "":
+		imp.Path = filepath.Join(dir, f.RelativePath)
+	default:
+		return "", nil, fmt.Errorf("%s payload has no file path", app)
+	}
+	return p.EventType, imp, nil
+}
+
+// MapPath applies the first mapping whose From prefix matches path. A From
+// of Sonarr or Radarr running on Windows, such as D:\TV, matches
+// case-insensitively with either separator, and the rest of the path gets
+// slashes, which the server turns into its own separator.
+func MapPath(path string, mappings []PathMapping) string {
+	for _, m := range mappings {
+		to := strings.TrimSuffix(m.To, "/")
+		if windowsPath(m.From) {
+			from := strings.ReplaceAll(strings.TrimRight(m.From, `/\`), `\`, "/")
+			slashed := strings.ReplaceAll(path, `\`, "/")
+			if len(slashed) >= len(from) && strings.EqualFold(slashed[:len(from)], from) &&
+				(len(slashed) == len(from) || slashed[len(from)] == '/') {
+				return to + slashed[len(from):]
+			}
+			continue
+		}
+		from := strings.TrimSuffix(m.From, "/")
+		if path == from || strings.HasPrefix(path, from+"/") {
+			return to + strings.TrimPrefix(path, from)
+		}
+	}
+	return path
+}
+
+// windowsPath reports whether path is a Windows path, with a drive letter
+// or backslashes
+func windowsPath(path string) bool {
+	if len(path) >= 2 && path[1] == ':' && unicode.IsLetter(rune(path[0])) {
+		return true
+	}
+	return strings.Contains(path, `\`)
+}
@@ -0,0 +1,56 @@
+package arr
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	sonarr := `{"eventType": "Download", "isUpgrade": true,
+		"series": {"title": "Show", "path": "/tv/Show"},
+		"episodeFile": {"relativePath": "Season 01/Show - S01E01.mkv"}}`
+	event, imp, err := Parse(Sonarr, []byte(sonarr))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if event != EventDownload || imp.Path != "/tv/Show/Season 01/Show - S01E01.mkv" || !imp.Upgrade {
+		t.Errorf("Unexpected Sonarr import: %s %+v", event, imp)
+	}
+
+	radarr := `{"eventType": "Download",
+		"movie": {"title": "Movie", "folderPath": "/movies/Movie (2019)"},
+		"movieFile": {"path": "/movies/Movie (2019)/Movie.mkv", "relativePath": "Movie.mkv"}}`
+	_, imp, err = Parse(Radarr, []byte(radarr))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if imp.Path != "/movies/Movie (2019)/Movie.mkv" || imp.Title != "Movie" {
+		t.Errorf("Unexpected Radarr import: %+v", imp)
+	}
+
+	event, imp, err = Parse(Radarr, []byte(`{"eventType": "Test"}`))
+	if err != nil || event != EventTest || imp != nil {
+		t.Errorf("Expected test event without import, got %s %+v %v", event, imp, err)
+	}
+	if _, _, err := Parse(Sonarr, []byte(`{"eventType": "Download", "series": {"path": "/tv"}}`)); err == nil {
+		t.Error("Expected error for missing episode file")
+	}
+}
+
+func TestMapPath(t *testing.T) {
+	mappings := []PathMapping{
+		{From: "/tv/", To: "/media/tv"},
+		{From: "/movies", To: "/media/movies"},
+		{From: `D:\Anime\`, To: "/media/anime"},
+		{From: `\\nas\films`, To: "/media/films"},
+	}
+	for input, expected := range map[string]string{
+		"/tv/Show/a.mkv":                "/media/tv/Show/a.mkv",
+		"/movies/M/m.mkv":               "/media/movies/M/m.mkv",
+		"/moviesextra/m.mkv":            "/moviesextra/m.mkv",
+		`d:\anime\Show\S01E01.mkv`:      "/media/anime/Show/S01E01.mkv",
+		`D:\AnimeOld\a.mkv`:             `D:\AnimeOld\a.mkv`,
+		`\\NAS\Films\Film (2020)\f.mkv`: "/media/films/Film (2020)/f.mkv",
+	} {
+		if got := MapPath(input, mappings); got != expected {
+			t.Errorf("MapPath(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+}
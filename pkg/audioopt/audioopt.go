@@ -0,0 +1,301 @@
+package audioopt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"media_optimizer/pkg/exclude"
+	"media_optimizer/pkg/mediapath"
+)
+
+// Supported target codecs
+const (
+	CodecOpus = "opus"
+	CodecAAC  = "aac"
+	CodecMP3  = "mp3"
+)
+
+// defaultWorkers is the number of tracks encoded concurrently
+const defaultWorkers = 4
+
+// Extensions lists the lossless source types. .m4a files are only converted
+// when they contain ALAC.
+var Extensions = []string{".flac", ".wav", ".aiff", ".aif", ".m4a"}
+
+type ProgressCallback func(float64)
+
+// Params configures a music transcoding run
+type Params struct {
+	// Input is a single track or a directory searched recursively
+	Input string
+	// Codec is CodecOpus, CodecAAC or CodecMP3
+	Codec string
+	// Bitrate is passed to the encoder, e.g. "160k"
+	Bitrate string
+	// OutputDir mirrors the input tree under this directory when set;
+	// otherwise tracks are written next to their source
+	OutputDir  string
+	Workers    int
+	OnProgress ProgressCallback
+	// Exclude leaves out the files and directories it excludes when
+	// searching a directory
+	Exclude *exclude.Rules
+	// NameForm is the Unicode normalization form of output names, and of
+	// the directories created under OutputDir, a mediapath form; empty
+	// keeps the spelling of the sources'
+	NameForm string
+}
+
+// Result summarises a music transcoding run
+type Result struct {
+	Success     bool
+	Message     string
+	Error       error
+	Processed   int
+	Failed      int
+	InputBytes  int64
+	OutputBytes int64
+	// Outputs are the files written, sorted
+	Outputs []string
+}
+
+// NewDefaultParams creates default music transcoding parameters
+func NewDefaultParams(input string) *Params {
+	return &Params{
+		Input:   input,
+		Codec:   CodecOpus,
+		Bitrate: "160k",
+		Workers: defaultWorkers,
+	}
+}
+
+// IsAudio reports whether path has a lossless source extension
+func IsAudio(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// extension returns the output file extension for a codec
+func extension(codec string) string {
+	switch codec {
+	case CodecAAC:
+		return ".m4a"
+	case CodecMP3:
+		return ".mp3"
+	default:
+		return ".opus"
+	}
+}
+
+// OutputPath returns where a track is written. Next to the source the name
+// gets the usual _optimized suffix; under OutputDir the relative path and base
+// name are kept.
+func OutputPath(params *Params, input string) string {
+	ext := extension(params.Codec)
+	base := strings.TrimSuffix(input, filepath.Ext(input))
+	if params.OutputDir == "" {
+		return mediapath.NormalizeName(base+"_optimized"+ext, params.NameForm)
+	}
+
+	root := params.Input
+	if info, err := os.Stat(root); err == nil && !info.IsDir() {
+		root = filepath.Dir(root)
+	}
+	rel, err := filepath.Rel(root, base)
+	if err != nil {
+		rel = filepath.Base(base)
+	}
+	return filepath.Join(params.OutputDir, mediapath.Normalize(rel, params.NameForm)) + ext
+}
+
+// TranscodeMusic converts one track or every lossless track below a directory
+func TranscodeMusic(params *Params) Result {
+	switch params.Codec {
+	case CodecOpus, CodecAAC, CodecMP3:
+	default:
+		return Result{Error: fmt.Errorf("unsupported audio codec: %s", params.Codec)}
+	}
+
+	tracks, err := collect(params.Input, params.Exclude)
+	if err != nil {
+		return Result{Error: err}
+	}
+	if len(tracks) == 0 {
+		return Result{Error: fmt.Errorf("no lossless audio found in %s", params.Input)}
+	}
+
+	workers := params.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	var (
+		mu     sync.Mutex
+		result Result
+		done   int
+		wg     sync.WaitGroup
+	)
+	next := make(chan string)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for input := range next {
+				inSize, outSize, err := transcode(input, params)
+
+				mu.Lock()
+				done++
+				if err != nil {
+					result.Failed++
+					log.Printf("Music transcode failed for %s: %v", input, err)
+				} else {
+					result.Processed++
+					result.InputBytes += inSize
+					result.OutputBytes += outSize
+					result.Outputs = append(result.Outputs, OutputPath(params, input))
+				}
+				progress := float64(done) / float64(len(tracks)) * 100
+				mu.Unlock()
+
+				if params.OnProgress != nil {
+					params.OnProgress(progress)
+				}
+			}
+		}()
+	}
+	for _, t := range tracks {
+		next <- t
+	}
+	close(next)
+	wg.Wait()
+
+	sort.Strings(result.Outputs)
+	result.Success = result.Failed == 0
+	result.Message = fmt.Sprintf("Transcoded %d of %d tracks to %s (%d → %d bytes)",
+		result.Processed, len(tracks), params.Codec, result.InputBytes, result.OutputBytes)
+	if !result.Success {
+		result.Error = fmt.Errorf("%d of %d tracks failed", result.Failed, len(tracks))
+	}
+	return result
+}
+
+// collect returns the input itself or every lossless track found below it
+func collect(input string, rules *exclude.Rules) ([]string, error) {
+	info, err := os.Stat(input)
+	if err != nil {
+		return nil, fmt.Errorf("input does not exist: %s", input)
+	}
+	if !info.IsDir() {
+		if !IsAudio(input) || !isLossless(input) {
+			return nil, fmt.Errorf("not a lossless audio file: %s", input)
+		}
+		return []string{input}, nil
+	}
+
+	var tracks []string
+	err = filepath.WalkDir(input, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && rules.SkipDir(path) {
+			return fs.SkipDir
+		}
+		if rules.Matches(path) {
+			return nil
+		}
+		if !d.IsDir() && IsAudio(path) && !strings.Contains(filepath.Base(path), "_optimized.") && isLossless(path) {
+			tracks = append(tracks, path)
+		}
+		return nil
+	})
+	return tracks, err
+}
+
+// isLossless checks the codec of .m4a files, which may hold AAC or ALAC
+func isLossless(path string) bool {
+	if !strings.EqualFold(filepath.Ext(path), ".m4a") {
+		return true
+	}
+	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "a:0",
+		"-show_entries", "stream=codec_name", "-of", "json", path).Output()
+	if err != nil {
+		return false
+	}
+	var probe struct {
+		Streams []struct {
+			CodecName string `json:"codec_name"`
+		} `json:"streams"`
+	}
+	return json.Unmarshal(out, &probe) == nil && len(probe.Streams) > 0 && probe.Streams[0].CodecName == "alac"
+}
+
+// transcode converts a single track and returns the input and output sizes.
+// Tags are copied from the source and embedded cover art is kept; if the
+// target muxer rejects the artwork the track is retried without it.
+func transcode(input string, params *Params) (int64, int64, error) {
+	info, err := os.Stat(input)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	output := OutputPath(params, input)
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return 0, 0, err
+	}
+
+	if err := runFFmpeg(input, output, params, true); err != nil {
+		log.Printf("Retrying %s without cover art: %v", input, err)
+		if err := runFFmpeg(input, output, params, false); err != nil {
+			os.Remove(output)
+			return 0, 0, err
+		}
+	}
+
+	outInfo, err := os.Stat(output)
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.Size(), outInfo.Size(), nil
+}
+
+func runFFmpeg(input, output string, params *Params, coverArt bool) error {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", input,
+		"-map", "0:a:0", "-map_metadata", "0"}
+	if coverArt {
+		args = append(args, "-map", "0:v?", "-c:v", "copy", "-disposition:v", "attached_pic")
+	} else {
+		args = append(args, "-vn")
+	}
+	args = append(args, encoderArgs(params.Codec, params.Bitrate)...)
+	args = append(args, output)
+
+	if out, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// encoderArgs returns the audio encoder options for a codec
+func encoderArgs(codec, bitrate string) []string {
+	switch codec {
+	case CodecAAC:
+		return []string{"-c:a", "aac", "-b:a", bitrate, "-movflags", "+faststart"}
+	case CodecMP3:
+		return []string{"-c:a", "libmp3lame", "-b:a", bitrate, "-id3v2_version", "3"}
+	default:
+		return []string{"-c:a", "libopus", "-b:a", bitrate, "-vbr", "on"}
+	}
+}
@@ -0,0 +1,56 @@
+package audioopt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputPath(t *testing.T) {
+	root := t.TempDir()
+	album := filepath.Join(root, "Artist", "Album")
+	if err := os.MkdirAll(album, 0755); err != nil {
+		t.Fatalf("Failed to create album dir: %v", err)
+	}
+	track := filepath.Join(album, "01 Song.flac")
+
+	params := NewDefaultParams(root)
+	if got := OutputPath(params, track); got != filepath.Join(album, "01 Song_optimized.opus") {
+		t.Errorf("Unexpected in-place output path %s", got)
+	}
+
+	params.Codec = CodecAAC
+	params.OutputDir = "/lossy"
+	if got := OutputPath(params, track); got != "/lossy/Artist/Album/01 Song.m4a" {
+		t.Errorf("Unexpected mirrored output path %s", got)
+	}
+
+	// Names and the directories mirrored under OutputDir take the form
+	params.NameForm = "nfd"
+	track = filepath.Join(root, "Björk", "Homogénic", "01 Jóga.flac")
+	if got := OutputPath(params, track); got != "/lossy/Bjo\u0308rk/Homoge\u0301nic/01 Jo\u0301ga.m4a" {
+		t.Errorf("Expected the mirrored path decomposed, got %q", got)
+	}
+	params.OutputDir = ""
+	track = filepath.Join(album, "02 夜に駆ける 🌙.flac")
+	if got := OutputPath(params, track); got != filepath.Join(album, "02 夜に駆ける 🌙_optimized.m4a") {
+		t.Errorf("Unexpected in-place output path %s", got)
+	}
+}
+
+func TestCollectSkipsNonLossless(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.flac", "b.WAV", "c.mp3", "d_optimized.flac"} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	tracks, err := collect(root, nil)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	if len(tracks) != 2 {
+		t.Errorf("Expected 2 lossless tracks, got %v", tracks)
+	}
+}
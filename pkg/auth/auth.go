@@ -0,0 +1,415 @@
+// Package auth authenticates the users of the web UI and APIs with HTTP basic
+// auth, and automation clients with API keys, and checks their roles.
+// Passwords are stored as PBKDF2-SHA256 hashes, API keys as SHA-256 hashes.
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"media_optimizer/pkg/mediapath"
+)
+
+// Role grants a user a set of actions. Each role includes the ones below it.
+type Role string
+
+const (
+	// Viewer browses media and follows jobs
+	Viewer Role = "viewer"
+	// Operator also starts, cancels and undoes jobs
+	Operator Role = "operator"
+	// Admin also rebuilds the server and manages its integrations
+	Admin Role = "admin"
+)
+
+// rank orders the roles; unknown roles rank below Viewer
+func (r Role) rank() int {
+	switch r {
+	case Viewer:
+		return 1
+	case Operator:
+		return 2
+	case Admin:
+		return 3
+	}
+	return 0
+}
+
+// Valid reports whether r is one of the defined roles
+func (r Role) Valid() bool {
+	return r.rank() > 0
+}
+
+// Allows reports whether r includes the actions of required
+func (r Role) Allows(required Role) bool {
+	return r.Valid() && required.Valid() && r.rank() >= required.rank()
+}
+
+// Account is a configured user
+type Account struct {
+	Username string `json:"username"`
+	// PasswordHash is the output of HashPassword
+	PasswordHash string `json:"passwordHash"`
+	Role         Role   `json:"role"`
+}
+
+// APIKey is a configured key of an automation client, sent in an
+// "Authorization: Bearer <key>" or "X-API-Key" header
+type APIKey struct {
+	// Name identifies the client in the job history
+	Name string `json:"name"`
+	// KeyHash is the hash printed by GenerateAPIKey
+	KeyHash string `json:"keyHash"`
+	Role    Role   `json:"role"`
+	// Paths limits the files the key may start or change jobs of to those
+	// under these prefixes; empty allows all
+	Paths []string `json:"paths"`
+}
+
+// User is an authenticated user or API key
+type User struct {
+	Name string `json:"username"`
+	Role Role   `json:"role"`
+	// APIKey is set for clients logged in with a key
+	APIKey bool `json:"apiKey,omitempty"`
+	// Paths are the prefixes the user's jobs are limited to, if any
+	Paths []string `json:"paths,omitempty"`
+}
+
+// AllowsPath reports whether the user may start or change jobs of path
+func (u User) AllowsPath(path string) bool {
+	if len(u.Paths) == 0 {
+		return true
+	}
+	for _, prefix := range u.Paths {
+		if mediapath.Contains(prefix, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// HeaderAPIKey carries an API key as an alternative to a bearer token
+const HeaderAPIKey = "X-API-Key"
+
+// apiKeyPrefix marks keys made by GenerateAPIKey
+const apiKeyPrefix = "mo_"
+
+// GenerateAPIKey returns a new random key for a client and the hash to
+// configure as its KeyHash
+func GenerateAPIKey() (key, hash string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	key = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	return key, hashAPIKey(key), nil
+}
+
+// hashAPIKey hashes a key. Keys are random, so unlike passwords they need
+// no slow hash.
+func hashAPIKey(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return "sha256$" + hex.EncodeToString(digest[:])
+}
+
+// Realm is sent in basic auth challenges
+const Realm = "media-optimizer"
+
+// Password hashing parameters
+const (
+	hashScheme     = "pbkdf2-sha256"
+	hashIterations = 600000
+	saltSize       = 16
+	keySize        = 32
+)
+
+// HashPassword returns the hash of password to store in an Account, in the
+// form "pbkdf2-sha256$<iterations>$<salt>$<key>"
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, hashIterations, keySize)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", hashScheme, hashIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// passwordHash is a parsed HashPassword result
+type passwordHash struct {
+	iterations int
+	salt, key  []byte
+}
+
+func parseHash(s string) (passwordHash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return passwordHash{}, fmt.Errorf("password hash must have the form %s$<iterations>$<salt>$<key>", hashScheme)
+	}
+	var h passwordHash
+	var err error
+	h.iterations, err = strconv.Atoi(parts[1])
+	if err != nil || h.iterations < 1 {
+		return passwordHash{}, fmt.Errorf("invalid iteration count %q", parts[1])
+	}
+	enc := base64.RawStdEncoding
+	if h.salt, err = enc.DecodeString(parts[2]); err != nil {
+		return passwordHash{}, fmt.Errorf("invalid salt: %v", err)
+	}
+	if h.key, err = enc.DecodeString(parts[3]); err != nil || len(h.key) == 0 {
+		return passwordHash{}, fmt.Errorf("invalid key")
+	}
+	return h, nil
+}
+
+func (h passwordHash) matches(password string) bool {
+	key := pbkdf2([]byte(password), h.salt, h.iterations, len(h.key))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// pbkdf2 derives a key from password with HMAC-SHA256 (RFC 8018)
+func pbkdf2(password, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	u := make([]byte, 0, prf.Size())
+	for block := uint32(1); len(key) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		key = prf.Sum(key)
+		t := key[len(key)-prf.Size():]
+		u = append(u[:0], t...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+	}
+	return key[:size]
+}
+
+// Authenticator checks credentials against the configured accounts and API
+// keys. With neither authentication is disabled and every request is
+// allowed.
+type Authenticator struct {
+	accounts map[string]account
+	// keys maps the hashes of API keys to their clients
+	keys map[string]User
+
+	// verified caches the digests of credentials known to be valid, as
+	// deriving a key takes long by design and the UI sends credentials
+	// with every request
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]User
+}
+
+type account struct {
+	hash passwordHash
+	role Role
+}
+
+// dummyHash is checked for unknown users, so the response time doesn't tell
+// whether a user exists
+var dummyHash = passwordHash{iterations: hashIterations, salt: make([]byte, saltSize), key: make([]byte, keySize)}
+
+// New returns an authenticator for the accounts and API keys
+func New(accounts []Account, keys []APIKey) (*Authenticator, error) {
+	a := &Authenticator{accounts: map[string]account{}, keys: map[string]User{}, verified: map[[sha256.Size]byte]User{}}
+	for _, acc := range accounts {
+		if acc.Username == "" || strings.Contains(acc.Username, ":") {
+			return nil, fmt.Errorf("username must be set and not contain \":\", got %q", acc.Username)
+		}
+		if _, ok := a.accounts[acc.Username]; ok {
+			return nil, fmt.Errorf("duplicate user %q", acc.Username)
+		}
+		if !acc.Role.Valid() {
+			return nil, fmt.Errorf("user %s: role must be %q, %q or %q, got %q", acc.Username, Viewer, Operator, Admin, acc.Role)
+		}
+		hash, err := parseHash(acc.PasswordHash)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", acc.Username, err)
+		}
+		a.accounts[acc.Username] = account{hash: hash, role: acc.Role}
+	}
+
+	names := map[string]bool{}
+	for _, key := range keys {
+		if key.Name == "" || names[key.Name] {
+			return nil, fmt.Errorf("API keys need unique names, got %q", key.Name)
+		}
+		names[key.Name] = true
+		if !key.Role.Valid() {
+			return nil, fmt.Errorf("API key %s: role must be %q, %q or %q, got %q", key.Name, Viewer, Operator, Admin, key.Role)
+		}
+		hash, ok := strings.CutPrefix(key.KeyHash, "sha256$")
+		if _, err := hex.DecodeString(hash); !ok || err != nil || len(hash) != 2*sha256.Size {
+			return nil, fmt.Errorf("API key %s: keyHash must have the form sha256$<hex>", key.Name)
+		}
+		if _, ok := a.keys[key.KeyHash]; ok {
+			return nil, fmt.Errorf("API key %s: duplicate key", key.Name)
+		}
+		for _, path := range key.Paths {
+			if path == "" {
+				return nil, fmt.Errorf("API key %s: empty path", key.Name)
+			}
+		}
+		a.keys[key.KeyHash] = User{Name: key.Name, Role: key.Role, APIKey: true, Paths: key.Paths}
+	}
+	return a, nil
+}
+
+// Enabled reports whether requests must be authenticated
+func (a *Authenticator) Enabled() bool {
+	return a != nil && (len(a.accounts) > 0 || len(a.keys) > 0)
+}
+
+// Authenticate returns the user whose basic auth credentials or API key the
+// request carries
+func (a *Authenticator) Authenticate(r *http.Request) (User, bool) {
+	if key := apiKey(r); key != "" {
+		user, ok := a.keys[hashAPIKey(key)]
+		return user, ok
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return User{}, false
+	}
+	return a.Check(username, password)
+}
+
+// apiKey returns the key of a request, from the X-API-Key header or a
+// bearer token
+func apiKey(r *http.Request) string {
+	if key := r.Header.Get(HeaderAPIKey); key != "" {
+		return key
+	}
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// Check returns the user with the credentials
+func (a *Authenticator) Check(username, password string) (User, bool) {
+	digest := sha256.Sum256([]byte(username + "\x00" + password))
+	a.mu.Lock()
+	user, ok := a.verified[digest]
+	a.mu.Unlock()
+	if ok {
+		return user, true
+	}
+
+	acc, ok := a.accounts[username]
+	if !ok {
+		dummyHash.matches(password)
+		return User{}, false
+	}
+	if !acc.hash.matches(password) {
+		return User{}, false
+	}
+	user = User{Name: username, Role: acc.role}
+	a.mu.Lock()
+	a.verified[digest] = user
+	a.mu.Unlock()
+	return user, true
+}
+
+// Authorize checks that the request comes from a user or API key with at
+// least role and returns the request with the user in its context.
+// Otherwise it answers 401, challenging for credentials, or 403 and returns
+// false.
+func (a *Authenticator) Authorize(w http.ResponseWriter, r *http.Request, role Role) (*http.Request, bool) {
+	return a.authorize(w, r, role, true)
+}
+
+func (a *Authenticator) authorize(w http.ResponseWriter, r *http.Request, role Role, keys bool) (*http.Request, bool) {
+	if !a.Enabled() {
+		return r, true
+	}
+	if !keys && apiKey(r) != "" {
+		http.Error(w, "Forbidden: API keys are only accepted by the API", http.StatusForbidden)
+		return r, false
+	}
+	user, ok := a.Authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+Realm+`", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return r, false
+	}
+	if !user.Role.Allows(role) {
+		http.Error(w, fmt.Sprintf("Forbidden: requires the %s role", role), http.StatusForbidden)
+		return r, false
+	}
+	return r.WithContext(WithUser(r.Context(), user)), true
+}
+
+// Require serves next to users and API keys with at least role
+func (a *Authenticator) Require(role Role, next http.Handler) http.Handler {
+	return a.require(role, next, true)
+}
+
+// RequireUser serves next to users with at least role, for the interactive
+// UI that API keys aren't meant for
+func (a *Authenticator) RequireUser(role Role, next http.Handler) http.Handler {
+	return a.require(role, next, false)
+}
+
+func (a *Authenticator) require(role Role, next http.Handler, keys bool) http.Handler {
+	if !a.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r, ok := a.authorize(w, r, role, keys); ok {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+type contextKey struct{}
+
+// WithUser returns ctx carrying the user
+func WithUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, contextKey{}, user)
+}
+
+// FromContext returns the user of an authorized request
+func FromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(contextKey{}).(User)
+	return user, ok
+}
+
+// Allowed reports whether the user of ctx has at least role. Everything is
+// allowed when a is disabled.
+func (a *Authenticator) Allowed(ctx context.Context, role Role) bool {
+	if !a.Enabled() {
+		return true
+	}
+	user, ok := FromContext(ctx)
+	return ok && user.Role.Allows(role)
+}
+
+// AllowedPath reports whether the user of ctx may start or change jobs of
+// path
+func (a *Authenticator) AllowedPath(ctx context.Context, path string) bool {
+	if !a.Enabled() {
+		return true
+	}
+	user, ok := FromContext(ctx)
+	return ok && user.AllowsPath(path)
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914 section 11 and the PBKDF2-HMAC-SHA256 test vectors
+	for iterations, want := range map[int]string{
+		1: "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b",
+		2: "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43",
+	} {
+		if got := hex.EncodeToString(pbkdf2([]byte("password"), []byte("salt"), iterations, 32)); got != want {
+			t.Errorf("%d iterations: expected %s, got %s", iterations, want, got)
+		}
+	}
+	if got := len(pbkdf2([]byte("password"), []byte("salt"), 1, 40)); got != 40 {
+		t.Errorf("Expected a 40 byte key, got %d bytes", got)
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New([]Account{
+		{Username: "alice", PasswordHash: hash, Role: Admin},
+		{Username: "bob", PasswordHash: hash, Role: Viewer},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, ok := a.Check("alice", "secret"); !ok || user.Role != Admin {
+		t.Errorf("Expected alice to be an admin, got %v %v", user, ok)
+	}
+	// Served from the cache the second time
+	if _, ok := a.Check("alice", "secret"); !ok {
+		t.Error("Expected cached credentials to be accepted")
+	}
+	if _, ok := a.Check("alice", "wrong"); ok {
+		t.Error("Expected a wrong password to be rejected")
+	}
+	if _, ok := a.Check("carol", "secret"); ok {
+		t.Error("Expected an unknown user to be rejected")
+	}
+
+	var seen User
+	handler := a.Require(Operator, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = FromContext(r.Context())
+		if !a.Allowed(r.Context(), Operator) || a.Allowed(r.Context(), "root") {
+			t.Error("Expected the context to carry the role")
+		}
+	}))
+	for _, tt := range []struct {
+		user, password string
+		want           int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"bob", "secret", http.StatusForbidden},
+		{"alice", "secret", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/optimize", nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.user, tt.want, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Error("Expected a basic auth challenge")
+		}
+	}
+	if seen.Name != "alice" {
+		t.Errorf("Expected alice in the request context, got %q", seen.Name)
+	}
+
+	// Without accounts everything is allowed
+	open, _ := New(nil, nil)
+	w := httptest.NewRecorder()
+	open.Require(Admin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	if w.Code != http.StatusOK || !open.Allowed(httptest.NewRequest(http.MethodGet, "/", nil).Context(), Admin) {
+		t.Error("Expected a disabled authenticator to allow everything")
+	}
+
+	for _, accounts := range [][]Account{
+		{{Username: "a", PasswordHash: hash, Role: "root"}},
+		{{Username: "a", PasswordHash: "plain", Role: Viewer}},
+		{{Username: "a:b", PasswordHash: hash, Role: Viewer}},
+		{{Username: "a", PasswordHash: hash, Role: Viewer}, {Username: "a", PasswordHash: hash, Role: Admin}},
+	} {
+		if _, err := New(accounts, nil); err == nil {
+			t.Errorf("Expected %v to be rejected", accounts)
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	key, hash, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwordHash, _ := HashPassword("secret")
+	a, err := New([]Account{{Username: "alice", PasswordHash: passwordHash, Role: Admin}}, []APIKey{
+		{Name: "post-download", KeyHash: hash, Role: Operator, Paths: []string{"/media/downloads/"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen User
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = FromContext(r.Context())
+	})
+	for _, tt := range []struct {
+		name    string
+		header  string
+		value   string
+		handler http.Handler
+		want    int
+	}{
+		{"bearer token", "Authorization", "Bearer " + key, a.Require(Operator, ok), http.StatusOK},
+		{"header", HeaderAPIKey, key, a.Require(Operator, ok), http.StatusOK},
+		{"unknown key", HeaderAPIKey, key + "x", a.Require(Viewer, ok), http.StatusUnauthorized},
+		{"insufficient role", HeaderAPIKey, key, a.Require(Admin, ok), http.StatusForbidden},
+		{"interactive UI", HeaderAPIKey, key, a.RequireUser(Viewer, ok), http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/jobs", nil)
+		r.Header.Set(tt.header, tt.value)
+		w := httptest.NewRecorder()
+		tt.handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, w.Code)
+		}
+	}
+	if seen.Name != "post-download" || !seen.APIKey {
+		t.Errorf("Expected the key's client in the context, got %+v", seen)
+	}
+
+	for path, want := range map[string]bool{
+		"/media/downloads/Film.mkv":     true,
+		"/media/downloads":              true,
+		"/media/downloads-old/Film.mkv": false,
+		"/media/movies/Film.mkv":        false,
+		"/media/downloads/../Film.mkv":  false,
+	} {
+		if seen.AllowsPath(path) != want {
+			t.Errorf("%s: expected allowed %v", path, want)
+		}
+	}
+	if !(User{Name: "alice", Role: Admin}).AllowsPath("/anywhere") {
+		t.Error("Expected users without paths to be allowed everywhere")
+	}
+
+	for _, keys := range [][]APIKey{
+		{{Name: "a", KeyHash: "plain", Role: Viewer}},
+		{{Name: "", KeyHash: hash, Role: Viewer}},
+		{{Name: "a", KeyHash: hash, Role: Viewer}, {Name: "b", KeyHash: hash, Role: Viewer}},
+	} {
+		if _, err := New(nil, keys); err == nil {
+			t.Errorf("Expected %v to be rejected", keys)
+		}
+	}
+}
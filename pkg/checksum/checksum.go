@@ -0,0 +1,186 @@
+// Package checksum hashes job inputs and outputs and re-hashes recorded
+// outputs to detect files that changed on disk, e.g. through bit rot.
+package checksum
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"media_optimizer/pkg/throttle"
+)
+
+// Result statuses
+const (
+	StatusOK       = "ok"
+	StatusMismatch = "mismatch"
+	StatusMissing  = "missing"
+	StatusError    = "error"
+)
+
+// File returns the hex SHA-256 of the file's contents
+func File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, throttle.Reads().Reader(f)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Target is a file with the checksum recorded for it
+type Target struct {
+	JobID  string `json:"jobId"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// Result is the outcome of re-hashing one target
+type Result struct {
+	Target
+	Status string `json:"status"`
+	// Actual is the checksum found on disk for a mismatch
+	Actual string `json:"actual,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report summarizes a verification scan. Problems lists every target that
+// did not verify, ordered by path.
+type Report struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Checked    int       `json:"checked"`
+	OK         int       `json:"ok"`
+	Mismatches int       `json:"mismatches"`
+	Missing    int       `json:"missing"`
+	Errors     int       `json:"errors"`
+	Problems   []Result  `json:"problems"`
+}
+
+// Verify re-hashes the targets with the given number of workers
+func Verify(targets []Target, workers int) *Report {
+	if workers < 1 {
+		workers = 1
+	}
+	report := &Report{StartedAt: time.Now(), Problems: []Result{}}
+
+	work := make(chan Target)
+	results := make(chan Result)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range work {
+				results <- verify(t)
+			}
+		}()
+	}
+	go func() {
+		for _, t := range targets {
+			work <- t
+		}
+		close(work)
+		wg.Wait()
+		close(results)
+	}()
+
+	for r := range results {
+		report.Checked++
+		switch r.Status {
+		case StatusOK:
+			report.OK++
+			continue
+		case StatusMismatch:
+			report.Mismatches++
+		case StatusMissing:
+			report.Missing++
+		default:
+			report.Errors++
+		}
+		report.Problems = append(report.Problems, r)
+	}
+	sort.Slice(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Path < report.Problems[j].Path
+	})
+	report.FinishedAt = time.Now()
+	return report
+}
+
+// verify re-hashes one target
+func verify(t Target) Result {
+	sum, err := File(t.Path)
+	switch {
+	case os.IsNotExist(err):
+		return Result{Target: t, Status: StatusMissing}
+	case err != nil:
+		return Result{Target: t, Status: StatusError, Error: err.Error()}
+	case sum != t.SHA256:
+		return Result{Target: t, Status: StatusMismatch, Actual: sum}
+	}
+	return Result{Target: t, Status: StatusOK}
+}
+
+// Verifier runs verification scans in the background and keeps the latest
+// report
+type Verifier struct {
+	mu      sync.Mutex
+	workers int
+	report  *Report
+	running bool
+	// onFinish is called with each completed report
+	onFinish func(*Report)
+}
+
+// NewVerifier creates a verifier hashing with the given number of workers
+// that passes each finished report to onFinish, if not nil
+func NewVerifier(workers int, onFinish func(*Report)) *Verifier {
+	return &Verifier{workers: workers, onFinish: onFinish}
+}
+
+// Start begins a background scan of the targets. It returns false if one is
+// already running.
+func (v *Verifier) Start(targets []Target) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.running {
+		return false
+	}
+	v.running = true
+
+	go func() {
+		slog.Info("Checksum verification started", "files", len(targets))
+		report := Verify(targets, v.workers)
+		slog.Info("Checksum verification finished", "checked", report.Checked,
+			"mismatches", report.Mismatches, "missing", report.Missing, "errors", report.Errors)
+
+		v.mu.Lock()
+		v.running = false
+		v.report = report
+		v.mu.Unlock()
+		if v.onFinish != nil {
+			v.onFinish(report)
+		}
+	}()
+	return true
+}
+
+// Latest returns the most recent report (nil before the first scan
+// completes) and whether a scan is in progress
+func (v *Verifier) Latest() (*Report, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.report, v.running
+}
@@ -0,0 +1,47 @@
+package checksum
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestVerifierStartWhileRunning(t *testing.T) {
+	// Reading a FIFO blocks until it is opened for writing, which holds the
+	// scan open
+	fifo := filepath.Join(t.TempDir(), "held.mp4")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatalf("Mkfifo failed: %v", err)
+	}
+	finished := make(chan *Report, 1)
+	v := NewVerifier(1, func(r *Report) { finished <- r })
+
+	if !v.Start([]Target{{JobID: "a", Path: fifo, SHA256: "x"}}) {
+		t.Fatal("Expected the first scan to start")
+	}
+	if v.Start(nil) {
+		t.Error("Expected a second scan to be refused while one runs")
+	}
+	if _, running := v.Latest(); !running {
+		t.Error("Expected the scan to be reported as running")
+	}
+
+	w, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open FIFO: %v", err)
+	}
+	w.Close()
+	select {
+	case report := <-finished:
+		if report.Mismatches != 1 {
+			t.Errorf("Expected the held file to mismatch, got %+v", report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Scan did not finish")
+	}
+	if !v.Start(nil) {
+		t.Error("Expected a scan to start once the previous one finished")
+	}
+}
@@ -0,0 +1,39 @@
+package checksum
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.mp4")
+	rotted := filepath.Join(dir, "rotted.mp4")
+	os.WriteFile(good, []byte("hello"), 0644)
+	os.WriteFile(rotted, []byte("hello"), 0644)
+
+	sum, err := File(good)
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+	if sum != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("Unexpected checksum %s", sum)
+	}
+	os.WriteFile(rotted, []byte("hellp"), 0644)
+
+	report := Verify([]Target{
+		{JobID: "a", Path: good, SHA256: sum},
+		{JobID: "b", Path: rotted, SHA256: sum},
+		{JobID: "c", Path: filepath.Join(dir, "gone.mp4"), SHA256: sum},
+	}, 2)
+	if report.Checked != 3 || report.OK != 1 || report.Mismatches != 1 || report.Missing != 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if len(report.Problems) != 2 || report.Problems[0].JobID != "c" || report.Problems[1].Status != StatusMismatch {
+		t.Errorf("Unexpected problems %+v", report.Problems)
+	}
+	if report.Problems[1].Actual == "" || report.Problems[1].Actual == sum {
+		t.Errorf("Expected the actual checksum of the mismatch, got %q", report.Problems[1].Actual)
+	}
+}
@@ -0,0 +1,1324 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"media_optimizer/pkg/arr"
+	"media_optimizer/pkg/auth"
+	"media_optimizer/pkg/exclude"
+	"media_optimizer/pkg/gpu"
+	"media_optimizer/pkg/mediapath"
+	"media_optimizer/pkg/netmount"
+	"media_optimizer/pkg/notify"
+	"media_optimizer/pkg/proxy"
+	"media_optimizer/pkg/schedule"
+	"media_optimizer/pkg/storage"
+)
+
+const (
+	// DefaultPath is the config file looked up in the working directory
+	DefaultPath = "config.json"
+	// EnvPath overrides the config file location
+	EnvPath = "MEDIA_OPTIMIZER_CONFIG"
+)
+
+// Config holds the server settings loaded from config.json
+type Config struct {
+	// AllowedExtensions lists the file extensions accepted for optimization
+	AllowedExtensions []string `json:"allowedExtensions"`
+	// DiscImages enables optimizing the main title of .iso images
+	DiscImages bool `json:"discImages"`
+	// DataDir holds persistent state such as the job history
+	DataDir string `json:"dataDir"`
+	// MediaRoots are the library directories scanned for reports
+	MediaRoots []string `json:"mediaRoots"`
+	// RestrictToRoots rejects browsing and optimizing outside MediaRoots
+	RestrictToRoots bool `json:"restrictToRoots"`
+	// Exclude globs name media never scanned, watched or optimized, like
+	// directories holding an exclude.Marker file
+	Exclude []string `json:"exclude"`
+	// Library configures the library analyzer
+	Library Library `json:"library"`
+	// Images configures recompression of JPEG/PNG images
+	Images Images `json:"images"`
+	// Music configures transcoding of lossless music libraries
+	Music Music `json:"music"`
+	// Integrity configures validation of the output after encoding
+	Integrity Integrity `json:"integrity"`
+	// Verification configures the optional post-encode quality check
+	Verification Verification `json:"verification"`
+	// Notify configures job notifications
+	Notify Notify `json:"notify"`
+	// Analysis enables optional source analysis before encoding
+	Analysis Analysis `json:"analysis"`
+	// HDR configures how HDR video is re-encoded
+	HDR HDR `json:"hdr"`
+	// Video configures video re-encoding
+	Video Video `json:"video"`
+	// Audio configures the kept audio tracks
+	Audio Audio `json:"audio"`
+	// Priority lowers the CPU and I/O priority of encodes
+	Priority Priority `json:"priority"`
+	// Throttle limits the disk bandwidth of the server's file copies
+	Throttle Throttle `json:"throttle"`
+	// Staging copies sources to local storage for transcoding
+	Staging Staging `json:"staging"`
+	// Ladder configures the renditions of ladder jobs
+	Ladder Ladder `json:"ladder"`
+	// GPUs limits the concurrent sessions of hardware video encoders
+	GPUs []gpu.GPU `json:"gpus"`
+	// Schedule limits when queued jobs run
+	Schedule Schedule `json:"schedule"`
+	// Profiles are named sets of overrides for video optimization
+	Profiles map[string]Profile `json:"profiles"`
+	// Policies map directory globs to profiles; the first match wins
+	Policies []Policy `json:"policies"`
+	// Cloud configures the spending limits of a billed transcode backend
+	Cloud Cloud `json:"cloud"`
+	// Arr configures the Sonarr/Radarr import webhooks
+	Arr Arr `json:"arr"`
+	// Watch optimizes the files arriving in ingest folders
+	Watch Watch `json:"watch"`
+	// Plex is refreshed after jobs write their output
+	Plex Plex `json:"plex"`
+	// Jellyfin is a Jellyfin or Emby server refreshed after jobs
+	Jellyfin Jellyfin `json:"jellyfin"`
+	// Sessions yields to people streaming from the Plex and Jellyfin
+	// servers
+	Sessions Sessions `json:"sessions"`
+	// Logging configures the server log
+	Logging Logging `json:"logging"`
+	// Deploy selects how /api/rebuild updates the server
+	Deploy Deploy `json:"deploy"`
+	// FFmpeg configures where ffmpeg and ffprobe are found
+	FFmpeg FFmpeg `json:"ffmpeg"`
+	// OutputName is the Go template naming the output of video and remux
+	// jobs, e.g. "{{.Base}} [{{.VideoCodec}}-{{.Height}}p].{{.Ext}}"; empty
+	// names it <name>_optimized
+	OutputName string `json:"outputName"`
+	// UnicodeNormalization spells the names of the files jobs write in
+	// Unicode normalization form "nfc" or "nfd", e.g. "nfc" for players that
+	// can't find decomposed names written by macOS; empty keeps the
+	// spelling of the source's name
+	UnicodeNormalization string `json:"unicodeNormalization"`
+	// Guardrails decides what happens to video and remux jobs whose sources
+	// have streams the output can't carry safely, such as Dolby Vision
+	// profile 5 video or TrueHD audio copied into MP4: "fallback" applies a
+	// safe alternative where there is one, "attention" stops the job for a
+	// person to look at
+	Guardrails string `json:"guardrails"`
+	// StampOutputs records the version, profile and job in the container
+	// metadata of video and remux outputs, so scans and watch folders skip
+	// them even without the job history
+	StampOutputs bool `json:"stampOutputs"`
+	// ReplaceOriginal puts the optimized output of video and remux jobs in
+	// place of the source, which is moved to the trash
+	ReplaceOriginal bool `json:"replaceOriginal"`
+	// Sidecars configures the subtitles, NFO files and artwork following
+	// outputs that get another name or directory
+	Sidecars Sidecars `json:"sidecars"`
+	// Trash configures where replaced originals are kept
+	Trash Trash `json:"trash"`
+	// Quarantine configures where outputs failing verification are kept
+	// for review
+	Quarantine Quarantine `json:"quarantine"`
+	// Proposals configures the approval of jobs automated sources ask for
+	Proposals Proposals `json:"proposals"`
+	// Upload configures chunked uploads of files over the API
+	Upload Upload `json:"upload"`
+	// Checksums configures the hashing of job inputs and outputs
+	Checksums Checksums `json:"checksums"`
+	// Network configures media roots on network shares
+	Network Network `json:"network"`
+	// Storage configures media roots in object storage, on SSH servers and
+	// on WebDAV shares
+	Storage Storage `json:"storage"`
+	// Retry configures the reruns of jobs that failed for transient reasons
+	Retry Retry `json:"retry"`
+	// Timeout kills video optimizations running far longer than expected
+	Timeout Timeout `json:"timeout"`
+	// Resources holds new jobs back while the host is busy
+	Resources Resources `json:"resources"`
+	// GRPC configures the gRPC API
+	GRPC GRPC `json:"grpc"`
+	// TLS serves the web UI and API over HTTPS
+	TLS TLS `json:"tls"`
+	// Proxy adapts the server to running behind a reverse proxy
+	Proxy Proxy `json:"proxy"`
+	// Auth requires users to log in with a role
+	Auth Auth `json:"auth"`
+	// Limits protect the server from clients sending too much
+	Limits Limits `json:"limits"`
+}
+
+// Limits bound what each client may send to the API and WebSocket
+type Limits struct {
+	// RequestsPerSecond is the sustained rate of API requests and WebSocket
+	// messages allowed per client IP, zero for no limit
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	// Burst is how many requests a client may send at once
+	Burst int `json:"burst"`
+	// MaxBodyBytes caps the body of an API request, except for streamed
+	// media
+	MaxBodyBytes int64 `json:"maxBodyBytes"`
+	// MaxMessageBytes caps a WebSocket message
+	MaxMessageBytes int64 `json:"maxMessageBytes"`
+}
+
+// Auth configures the user accounts and API keys. Without either the server
+// is open to anyone who can reach it.
+type Auth struct {
+	// Users log in with HTTP basic auth; hash their passwords with the
+	// hash-password command
+	Users []auth.Account `json:"users"`
+	// APIKeys authenticate automation clients to the API; create them with
+	// the api-key command
+	APIKeys []auth.APIKey `json:"apiKeys"`
+}
+
+// Proxy configures serving behind a reverse proxy such as nginx or Traefik
+type Proxy struct {
+	// BasePath is the URL prefix the app is served under, e.g. "/optimizer"
+	BasePath string `json:"basePath"`
+	// TrustedProxies are the IPs or CIDR ranges whose X-Forwarded-For,
+	// X-Forwarded-Host and X-Forwarded-Proto headers are honored
+	TrustedProxies []string `json:"trustedProxies"`
+}
+
+// TLS configures HTTPS on the server's port, with the certificate in
+// CertFile and KeyFile or one obtained through ACME. Without either the
+// server speaks plain HTTP.
+type TLS struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ACME obtains and renews the certificate automatically
+	ACME ACME `json:"acme"`
+	// RedirectAddress serves plain HTTP redirecting to HTTPS, e.g. ":80".
+	// ACME answers its challenges there, so it defaults to ":80" with ACME.
+	RedirectAddress string `json:"redirectAddress"`
+}
+
+// ACME requests certificates from Let's Encrypt or another ACME CA
+type ACME struct {
+	// Domains the certificate is issued for; empty disables ACME
+	Domains []string `json:"domains"`
+	// Email receives the CA's expiry notices
+	Email string `json:"email"`
+	// DirectoryURL is the CA, Let's Encrypt by default
+	DirectoryURL string `json:"directoryUrl"`
+	// CacheDir keeps the account key and certificate, by default acme in
+	// DataDir
+	CacheDir string `json:"cacheDir"`
+}
+
+// GRPC configures the gRPC API, served on its own address. It needs a TLS
+// certificate as gRPC runs over HTTP/2, which is only offered over TLS.
+type GRPC struct {
+	// Address to listen on, e.g. ":9090"; empty disables the API
+	Address  string `json:"address"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+// Retry configures automatic reruns. Jobs failing for a reason that may not
+// last, such as an unavailable share or remote, an I/O error or exhausted
+// GPU encoder sessions, are marked retryable and run again after a backoff.
+type Retry struct {
+	// Retries is how often a job is run again, zero to disable retries
+	Retries int `json:"retries"`
+	// BackoffSeconds is the wait before the first retry, doubling for each
+	// further one
+	BackoffSeconds int `json:"backoffSeconds"`
+	// MaxBackoffSeconds caps the wait between retries
+	MaxBackoffSeconds int `json:"maxBackoffSeconds"`
+}
+
+// Timeout bounds how long a video, remux or ladder rendition encode may run,
+// so that a hung ffmpeg doesn't hold a worker forever. Jobs running out of
+// time are killed and marked timed-out.
+type Timeout struct {
+	// DurationFactor allows this multiple of the input's duration, zero for
+	// no limit
+	DurationFactor float64 `json:"durationFactor"`
+	// MinMinutes is the least time allowed, for short inputs
+	MinMinutes int `json:"minMinutes"`
+}
+
+// Resources samples the host's CPU, memory and disk use and holds new jobs
+// back while any is above its limit, e.g. while a media server on the same
+// machine transcodes. Running jobs carry on. Only supported on Linux.
+type Resources struct {
+	Enabled bool `json:"enabled"`
+	// IntervalSeconds is the time between samples. Waiting jobs start one
+	// per sample, each judged by a sample taken after the last started.
+	IntervalSeconds int `json:"intervalSeconds"`
+	// MaxCPUPercent is the share of CPU time in use above which jobs wait,
+	// zero to ignore the CPU
+	MaxCPUPercent float64 `json:"maxCpuPercent"`
+	// MaxMemoryPercent is the share of memory in use above which jobs
+	// wait, zero to ignore memory
+	MaxMemoryPercent float64 `json:"maxMemoryPercent"`
+	// MaxDiskPercent is the share of time the busiest disk may spend
+	// serving requests before jobs wait, zero to ignore disks
+	MaxDiskPercent float64 `json:"maxDiskPercent"`
+}
+
+// Storage configures remote media roots. Sources in a remote are downloaded
+// to TempDir, transcoded there and the output uploaded next to the source.
+type Storage struct {
+	// TempDir holds downloads and outputs in transit, by default remote in
+	// DataDir
+	TempDir string   `json:"tempDir"`
+	Remotes []Remote `json:"remotes"`
+}
+
+// Remote is a bucket, SSH server or WebDAV share used as a media root,
+// addressed as <type>://<name>/<key>
+type Remote struct {
+	Name string `json:"name"`
+	// Type is "s3", "sftp" or "webdav"
+	Type string `json:"type"`
+	// Endpoint is the URL of an S3-compatible server such as MinIO, where
+	// AWS is used when empty, or the base URL of a WebDAV share
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+	Bucket   string `json:"bucket"`
+	// Prefix limits an S3 remote to keys below it, e.g. "media/"
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+	// Host and Port locate an SFTP server, 22 being the default port
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// Username and Password log in to WebDAV; SFTP only uses the username
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// KeyFile is the private key for SFTP, which otherwise uses the ssh
+	// client's configured keys and agent
+	KeyFile string `json:"keyFile"`
+	// Dir is the SFTP directory keys are relative to, by default the login
+	// directory
+	Dir string `json:"dir"`
+	// DeleteOriginal replaces the source object with the output instead of
+	// uploading the output next to it
+	DeleteOriginal bool `json:"deleteOriginal"`
+}
+
+// Network configures the handling of NFS and SMB shares. Jobs failing while
+// their share is unavailable are retried as configured in Retry.
+type Network struct {
+	Mounts []NetworkMount `json:"mounts"`
+}
+
+// NetworkMount is a share holding media, mounted at Path
+type NetworkMount struct {
+	Path string `json:"path"`
+	// Type is "nfs" or "smb"
+	Type string `json:"type"`
+	// TimeoutSeconds bounds the reachability check, 5 seconds by default
+	TimeoutSeconds int `json:"timeoutSeconds"`
+}
+
+// Staging modes
+const (
+	// StagingOff transcodes sources where they are
+	StagingOff = "off"
+	// StagingNetwork stages sources on the network mounts
+	StagingNetwork = "network"
+	// StagingAlways stages every local source
+	StagingAlways = "always"
+)
+
+// Guardrail modes
+const (
+	// GuardrailsFallback fixes unsafe streams where possible
+	GuardrailsFallback = "fallback"
+	// GuardrailsAttention stops jobs with unsafe streams
+	GuardrailsAttention = "attention"
+)
+
+// Sidecar modes
+const (
+	// SidecarsOff leaves sidecars where they are
+	SidecarsOff = "off"
+	// SidecarsCopy copies sidecars next to the output
+	SidecarsCopy = "copy"
+	// SidecarsMove moves sidecars next to the output
+	SidecarsMove = "move"
+)
+
+// Sidecars configures what happens to the files media servers match to a
+// video by name, such as subtitles, NFO files and artwork, when a video or
+// remux output is named or placed differently from its source
+type Sidecars struct {
+	// Mode is SidecarsOff, SidecarsCopy or SidecarsMove
+	Mode string `json:"mode"`
+	// Extensions are the sidecar file types, by default
+	// sidecar.DefaultExtensions
+	Extensions []string `json:"extensions"`
+}
+
+// Staging copies the sources of video jobs to fast local storage before
+// transcoding and writes the output there, copying it next to the source
+// once done. Remote storage sources are always staged in Storage.TempDir.
+type Staging struct {
+	// Mode is StagingOff, StagingNetwork or StagingAlways
+	Mode string `json:"mode"`
+	// Dir holds the staged files, by default staging in DataDir
+	Dir string `json:"dir"`
+}
+
+// Checksums configures SHA-256 recording and verification
+type Checksums struct {
+	// Enabled records the SHA-256 of each job's input and output files
+	Enabled bool `json:"enabled"`
+	// VerifyWorkers is the number of files re-hashed concurrently by a
+	// verification scan
+	VerifyWorkers int `json:"verifyWorkers"`
+}
+
+// Trash configures the store of replaced originals
+type Trash struct {
+	// Dir holds the trashed files, by default trash in DataDir
+	Dir string `json:"dir"`
+	// RetentionDays is how long originals are kept for undo; zero keeps
+	// them until restored or removed by hand
+	RetentionDays int `json:"retentionDays"`
+}
+
+// Quarantine configures the store of outputs that failed verification
+type Quarantine struct {
+	// Enabled keeps outputs failing the integrity, quality or duration
+	// checks for review; otherwise they are deleted
+	Enabled bool `json:"enabled"`
+	// Dir holds the quarantined files, by default quarantine in DataDir
+	Dir string `json:"dir"`
+	// MaxDurationChangePercent quarantines outputs whose duration differs
+	// from the source's by more than this percentage; zero disables the check
+	MaxDurationChangePercent float64 `json:"maxDurationChangePercent"`
+}
+
+// Proposals configures the review of automated jobs
+type Proposals struct {
+	// Enabled has the Sonarr/Radarr webhooks and watch folders propose
+	// their jobs, which start once a user approves them
+	Enabled bool `json:"enabled"`
+}
+
+// Upload configures the inbox receiving files uploaded over the API
+type Upload struct {
+	// Dir is the inbox; uploads are disabled without it
+	Dir string `json:"dir"`
+	// MaxBytes caps the size of an uploaded file; zero allows any size
+	MaxBytes int64 `json:"maxBytes"`
+	// ExpireHours discards uploads that received no chunk for this long
+	ExpireHours int `json:"expireHours"`
+}
+
+// FFmpeg configures the ffmpeg installation. Without Dir the binaries are
+// looked up in PATH and common install locations.
+type FFmpeg struct {
+	// Dir holds the ffmpeg and ffprobe binaries to use
+	Dir string `json:"dir"`
+	// Download fetches a static build on first run when none is found
+	Download bool `json:"download"`
+	// DownloadDir receives the static build, by default bin in DataDir
+	DownloadDir string `json:"downloadDir"`
+	// DownloadSHA256 pins the SHA-256 of each downloaded file, keyed by
+	// "{name}-{platform}", e.g. "ffmpeg-linux-x64"
+	DownloadSHA256 map[string]string `json:"downloadSha256"`
+	// DownloadUnverified allows downloads without a pinned SHA-256
+	DownloadUnverified bool `json:"downloadUnverified"`
+}
+
+// Deploy configures the rebuild strategy. Mode is "auto", "systemd" or
+// "docker"; auto uses docker when running inside a container.
+type Deploy struct {
+	Mode string `json:"mode"`
+	// Image and Tag are pulled by the docker mode before it exits; an empty
+	// Image only restarts the container
+	Image string `json:"image"`
+	Tag   string `json:"tag"`
+	// RestartCode is the exit status the docker mode exits with (default 75)
+	RestartCode int `json:"restartCode"`
+}
+
+// Logging configures the server log and its rotation
+type Logging struct {
+	// Level is "debug", "info", "warn" or "error"
+	Level string `json:"level"`
+	// Format is "text" or "json"
+	Format string `json:"format"`
+	// File defaults to mediaopt.log in the temp directory
+	File string `json:"file"`
+	// The file is rotated when it exceeds MaxSizeMB or MaxAgeHours, and
+	// MaxBackups rotated files are kept
+	MaxSizeMB   int `json:"maxSizeMB"`
+	MaxAgeHours int `json:"maxAgeHours"`
+	MaxBackups  int `json:"maxBackups"`
+}
+
+// Jellyfin configures item refreshes on a Jellyfin or Emby server. The
+// integration is disabled while URL is empty.
+type Jellyfin struct {
+	// Type is "jellyfin" or "emby"
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	APIKey string `json:"apiKey"`
+	// DeleteTrickplay removes trickplay images saved next to the output
+	DeleteTrickplay bool `json:"deleteTrickplay"`
+}
+
+// Plex configures library refreshes on a Plex Media Server. The integration
+// is disabled while URL is empty.
+type Plex struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+// Session actions
+const (
+	// SessionsPause pauses running video encodes and holds new jobs back
+	SessionsPause = "pause"
+	// SessionsHold only holds new jobs back, letting running ones finish
+	SessionsHold = "hold"
+)
+
+// Sessions polls the configured Plex and Jellyfin servers for playback and
+// makes way for it, for servers sharing the machine with the optimizer
+type Sessions struct {
+	Enabled bool `json:"enabled"`
+	// Action is SessionsPause or SessionsHold
+	Action string `json:"action"`
+	// TranscodesOnly ignores streams the server sends as they are, which
+	// barely load it
+	TranscodesOnly bool `json:"transcodesOnly"`
+	// IntervalSeconds is the time between polls
+	IntervalSeconds int `json:"intervalSeconds"`
+	// ResumeAfterSeconds is how long work stays held after the last stream
+	// ends, so that it doesn't start up between two episodes
+	ResumeAfterSeconds int `json:"resumeAfterSeconds"`
+}
+
+// Arr configures the Sonarr/Radarr import webhooks
+type Arr struct {
+	// SonarrProfile and RadarrProfile are applied to imported files; when
+	// empty the directory policies decide
+	SonarrProfile string `json:"sonarrProfile"`
+	RadarrProfile string `json:"radarrProfile"`
+	// PathMappings translate paths as Sonarr/Radarr see them
+	PathMappings []arr.PathMapping `json:"pathMappings"`
+	// Username and Password require basic auth on the webhooks when set
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Watch folder post-actions, run in this order after a job completes
+const (
+	// WatchNotify sends the job's notifications, which watched jobs
+	// otherwise don't
+	WatchNotify = "notify"
+	// WatchRefresh refreshes the media servers, which watched jobs
+	// otherwise don't
+	WatchRefresh = "refresh"
+	// WatchDeleteSource moves the source to the trash
+	WatchDeleteSource = "delete-source"
+	// WatchArchive moves the source into the folder's ArchiveDir
+	WatchArchive = "archive"
+)
+
+// Watch polls ingest folders and queues a video job for each new file once
+// it has stopped growing. Files that already have a job in the history,
+// such as the outputs of earlier jobs, are skipped.
+type Watch struct {
+	// IntervalSeconds is how often the folders are polled
+	IntervalSeconds int `json:"intervalSeconds"`
+	// Folders are the watched folders, each with its recipe
+	Folders []WatchFolder `json:"folders"`
+}
+
+// WatchFolder is a watched folder and the recipe its files follow. Jobs of
+// watched files don't replace their originals; the recipe decides what
+// happens to them.
+type WatchFolder struct {
+	Path string `json:"path"`
+	// Recursive also watches the folder's subdirectories
+	Recursive bool `json:"recursive"`
+	// Profile is applied to the folder's files; when empty the directory
+	// policies decide
+	Profile string `json:"profile"`
+	// Destination is the directory outputs are moved to, keeping their path
+	// below the folder; empty leaves them next to their sources
+	Destination string `json:"destination"`
+	// Actions are the post-actions of completed jobs: WatchNotify,
+	// WatchRefresh, WatchDeleteSource and WatchArchive
+	Actions []string `json:"actions"`
+	// ArchiveDir is where WatchArchive moves sources, keeping their path
+	// below the folder
+	ArchiveDir string `json:"archiveDir"`
+}
+
+// Has reports whether the recipe runs action
+func (f *WatchFolder) Has(action string) bool {
+	for _, a := range f.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Cloud holds the pricing and limits of a transcode backend billed per
+// minute of media. Jobs aren't costed while PricePerMinute is zero.
+type Cloud struct {
+	PricePerMinute float64 `json:"pricePerMinute"`
+	// MonthlyBudget rejects jobs once the month's spend would exceed it
+	MonthlyBudget float64 `json:"monthlyBudget"`
+	// ConfirmAbove requires confirmCost on jobs estimated above it
+	ConfirmAbove float64 `json:"confirmAbove"`
+}
+
+// Profile overrides the global video settings. Sections left out of a
+// profile keep the global values, and fields left out of a section inherit
+// from the global section.
+type Profile struct {
+	Video *Video `json:"video,omitempty"`
+	Audio *Audio `json:"audio,omitempty"`
+	HDR   *HDR   `json:"hdr,omitempty"`
+	// MaxHeight downscales taller video to this height, re-encoding it
+	MaxHeight int `json:"maxHeight,omitempty"`
+	// Priority replaces the global encode priority
+	Priority *Priority `json:"priority,omitempty"`
+	// OutputName replaces the global output naming template
+	OutputName string `json:"outputName,omitempty"`
+	// Sidecars replaces the global sidecar handling
+	Sidecars *Sidecars `json:"sidecars,omitempty"`
+	// Filters deinterlace, denoise or crop video, re-encoding it
+	Filters *Filters `json:"filters,omitempty"`
+	// FFmpegArgs adds ffmpeg options the other settings don't cover
+	FFmpegArgs *FFmpegArgs `json:"ffmpegArgs,omitempty"`
+}
+
+// Filters clean up video, mostly old sources such as DVD rips. Deinterlace
+// is "yadif", or "auto" to deinterlace only interlaced sources, Denoise
+// "hqdn3d" or "nlmeans" at a DenoiseStrength of "light", "medium" (default)
+// or "strong", and Crop "auto" to detect black bars or a fixed
+// "width:height:x:y". Empty values leave the filter off.
+type Filters struct {
+	Deinterlace     string `json:"deinterlace"`
+	Denoise         string `json:"denoise"`
+	DenoiseStrength string `json:"denoiseStrength"`
+	Crop            string `json:"crop"`
+}
+
+// FFmpegArgs are extra ffmpeg options, each entry an option and its value
+// separated by a space, e.g. "-tune film". Input options precede the input
+// and output options follow the generated ones.
+type FFmpegArgs struct {
+	Input  []string `json:"input"`
+	Output []string `json:"output"`
+}
+
+// Ladder lists the renditions encoded by ladder jobs. Without renditions
+// 1080p, 720p and 480p are encoded.
+type Ladder struct {
+	Renditions []Rendition `json:"renditions"`
+	// KeyframeSeconds is the keyframe interval shared by the renditions,
+	// usually the HLS segment length (default 2)
+	KeyframeSeconds float64 `json:"keyframeSeconds"`
+}
+
+// Rendition is one output of a ladder job, scaled to Height and capped at
+// MaxBitrateKbps when set
+type Rendition struct {
+	Name           string `json:"name"`
+	Height         int    `json:"height"`
+	MaxBitrateKbps int    `json:"maxBitrateKbps"`
+}
+
+// Schedule restricts jobs to time windows. Without windows jobs run at any
+// time.
+type Schedule struct {
+	Windows []schedule.Window `json:"windows"`
+}
+
+// Priority limits the resources taken by encode processes. Nice (0-19),
+// IOClass ("idle" or "best-effort") with IOLevel (0-7), CPUQuota (percent of
+// one core), Threads and ReadRate (multiple of playback speed ffmpeg reads
+// the input at) are each disabled by their zero value.
+type Priority struct {
+	Nice     int     `json:"nice"`
+	IOClass  string  `json:"ioClass"`
+	IOLevel  int     `json:"ioLevel"`
+	CPUQuota int     `json:"cpuQuota"`
+	Threads  int     `json:"threads"`
+	ReadRate float64 `json:"readRate"`
+}
+
+// Throttle limits the disk bandwidth of the server's own file copies:
+// transfers to and from remote storage, checksums and moves to the trash.
+// Zero leaves a direction unlimited.
+type Throttle struct {
+	// ReadMBps caps reading files, in megabytes per second
+	ReadMBps float64 `json:"readMBps"`
+	// WriteMBps caps writing files, in megabytes per second
+	WriteMBps float64 `json:"writeMBps"`
+}
+
+// Policy selects the profile for files below a directory. Path is a glob
+// where "*" matches within one directory and "**" across directories, e.g.
+// "/media/kids/**".
+type Policy struct {
+	Path    string `json:"path"`
+	Profile string `json:"profile"`
+}
+
+// Library configures the library analyzer
+type Library struct {
+	// HighBitrateKbps flags files whose overall bitrate exceeds this value
+	HighBitrateKbps int `json:"highBitrateKbps"`
+	// ScanWorkers is the number of files probed concurrently
+	ScanWorkers int `json:"scanWorkers"`
+}
+
+// Images configures the image optimization pipeline
+type Images struct {
+	// Format is "webp" or "avif"
+	Format string `json:"format"`
+	// Quality ranges from 0 (smallest) to 100 (best)
+	Quality int `json:"quality"`
+	// Workers is the number of images encoded concurrently
+	Workers int `json:"workers"`
+}
+
+// Music configures the lossless-to-lossy audio transcoding mode
+type Music struct {
+	// Codec is "opus", "aac" or "mp3"
+	Codec string `json:"codec"`
+	// Bitrate is the target encoder bitrate, e.g. "160k"
+	Bitrate string `json:"bitrate"`
+	// OutputDir mirrors the source tree under this directory; empty writes
+	// each track next to its source
+	OutputDir string `json:"outputDir"`
+	// Workers is the number of tracks encoded concurrently
+	Workers int `json:"workers"`
+}
+
+// Integrity configures the decode pass and duration check run on every output
+type Integrity struct {
+	Enabled bool `json:"enabled"`
+	// DurationToleranceSeconds is the allowed source/output duration difference
+	DurationToleranceSeconds float64 `json:"durationToleranceSeconds"`
+}
+
+// Verification configures quality scoring of the output against the source
+type Verification struct {
+	// Metric is "ssim" or "vmaf"; empty disables verification
+	Metric string `json:"metric"`
+	// Threshold is the minimum acceptable score (0-1 for SSIM, 0-100 for VMAF)
+	Threshold float64 `json:"threshold"`
+	// FailBelowThreshold fails the job rather than flagging it
+	FailBelowThreshold bool `json:"failBelowThreshold"`
+}
+
+// Video configures the video encoder and its rate control
+type Video struct {
+	// Transcode re-encodes video not already in the encoder's format;
+	// otherwise video is copied
+	Transcode bool `json:"transcode"`
+	// Codec is the ffmpeg encoder, "libx265", "libx264", "hevc_nvenc",
+	// "h264_nvenc", "libsvtav1" or "libvpx-vp9", whose output is WebM
+	Codec string `json:"codec"`
+	// Preset is e.g. "medium", 0 (slowest) to 13 for libsvtav1 or 0
+	// (slowest) to 8 for libvpx-vp9
+	Preset string `json:"preset"`
+	// RateControl is "crf", "capped-crf" or "two-pass"
+	RateControl string `json:"rateControl"`
+	CRF         int    `json:"crf"`
+	// BitrateKbps is the average bitrate of two-pass encodes
+	BitrateKbps int `json:"bitrateKbps"`
+	// MaxBitrateKbps caps the bitrate of capped-crf encodes
+	MaxBitrateKbps int `json:"maxBitrateKbps"`
+	// FilmGrain (1-50) has libsvtav1 synthesize the source's grain rather
+	// than encode it; FilmGrainDenoise also removes it from the picture
+	FilmGrain        int  `json:"filmGrain"`
+	FilmGrainDenoise bool `json:"filmGrainDenoise"`
+	// Grain tunes the encoder to keep film grain rather than smear it: x264
+	// and x265 tune for grain, libsvtav1 synthesizes it (at filmGrain, or 8
+	// when unset) and libvpx-vp9 tunes for film
+	Grain bool `json:"grain"`
+	// RowMT and TileColumns (0-6, as a log2) spread libvpx-vp9 encodes over
+	// more threads
+	RowMT       bool `json:"rowMT"`
+	TileColumns int  `json:"tileColumns"`
+	// PerTitle adjusts the CRF or bitrate to each source's complexity
+	PerTitle PerTitle `json:"perTitle"`
+}
+
+// PerTitle measures how hard each source is to encode in the analysis stage
+// and moves the CRF of crf and capped-crf encodes within MinCRF-MaxCRF, or
+// the bitrate of two-pass encodes within MinBitrateKbps-MaxBitrateKbps.
+// Bounds left at zero allow 4 CRF either side of crf, or half to 1.5 times
+// bitrateKbps.
+type PerTitle struct {
+	Enabled        bool `json:"enabled"`
+	MinCRF         int  `json:"minCrf"`
+	MaxCRF         int  `json:"maxCrf"`
+	MinBitrateKbps int  `json:"minBitrateKbps"`
+	MaxBitrateKbps int  `json:"maxBitrateKbps"`
+}
+
+// Audio configures how the kept audio tracks are encoded. Codec is "aac",
+// "ac3", "eac3" or "opus", Layout "mono", "stereo", "5.1", "7.1" or empty to
+// keep the source's channels, and BitrateKbps the bitrate of each track, zero
+// picking one for the codec and channels. Passthrough lists source codecs
+// copied as they are when their channels fit the layout.
+type Audio struct {
+	Codec       string   `json:"codec"`
+	BitrateKbps int      `json:"bitrateKbps"`
+	Layout      string   `json:"layout"`
+	Passthrough []string `json:"passthrough"`
+}
+
+// HDR configures the treatment of HDR10, HLG and Dolby Vision sources when
+// their video is re-encoded
+type HDR struct {
+	// Mode is "preserve" (10-bit BT.2020 with HDR metadata) or "tonemap" (SDR)
+	Mode string `json:"mode"`
+	// ToneMap is the tone-mapping curve, e.g. "hable", "mobius" or "reinhard"
+	ToneMap string `json:"toneMap"`
+}
+
+// Analysis configures optional checks run on the source before encoding
+type Analysis struct {
+	// BurnedSubtitles samples frames for hardcoded subtitles and disables
+	// automatic display of subtitle tracks on sources that have them
+	BurnedSubtitles bool `json:"burnedSubtitles"`
+	// Segments reports long black or silent stretches of the source
+	Segments bool `json:"segments"`
+	// SegmentMinSeconds is the shortest stretch reported
+	SegmentMinSeconds float64 `json:"segmentMinSeconds"`
+	// LanguageTagging infers languages for audio tracks tagged "und"
+	LanguageTagging bool `json:"languageTagging"`
+	// LanguageDetector is an optional command run on an audio sample that
+	// prints the spoken language
+	LanguageDetector string `json:"languageDetector"`
+}
+
+// Notify configures where job notifications are delivered
+type Notify struct {
+	Targets []notify.Target `json:"targets"`
+	// LowDiskSpace sends a disk.low event when a job leaves less than this
+	// free on the output volume, e.g. "50GB"; empty disables the check
+	LowDiskSpace string `json:"lowDiskSpace"`
+}
+
+// Default returns the built-in configuration used when no config file exists
+func Default() *Config {
+	return &Config{
+		AllowedExtensions: []string{
+			".mkv", ".mp4", ".m4v", ".avi", ".mov", ".wmv",
+			".mpg", ".mpeg", ".ts", ".m2ts", ".webm", ".flv",
+		},
+		DataDir: "data",
+		Library: Library{
+			HighBitrateKbps: 20000,
+			ScanWorkers:     4,
+		},
+		Images: Images{
+			Format:  "webp",
+			Quality: 80,
+			Workers: 4,
+		},
+		Music: Music{
+			Codec:   "opus",
+			Bitrate: "160k",
+			Workers: 4,
+		},
+		Analysis: Analysis{
+			SegmentMinSeconds: 2,
+		},
+		Video: Video{
+			Codec:       "libx265",
+			Preset:      "medium",
+			RateControl: "crf",
+			CRF:         26,
+		},
+		Audio: Audio{
+			Codec:       "ac3",
+			BitrateKbps: 384,
+			Layout:      "stereo",
+		},
+		HDR: HDR{
+			Mode:    "preserve",
+			ToneMap: "hable",
+		},
+		Integrity: Integrity{
+			Enabled:                  true,
+			DurationToleranceSeconds: 2,
+		},
+		Jellyfin:     Jellyfin{Type: "jellyfin"},
+		Trash:        Trash{RetentionDays: 30},
+		Quarantine:   Quarantine{MaxDurationChangePercent: 5},
+		Upload:       Upload{ExpireHours: 24},
+		Sidecars:     Sidecars{Mode: SidecarsOff},
+		Staging:      Staging{Mode: StagingOff},
+		Guardrails:   GuardrailsFallback,
+		StampOutputs: true,
+		Retry: Retry{
+			Retries:           3,
+			BackoffSeconds:    30,
+			MaxBackoffSeconds: 1800,
+		},
+		Timeout: Timeout{
+			DurationFactor: 10,
+			MinMinutes:     30,
+		},
+		Sessions: Sessions{
+			Action:             SessionsPause,
+			IntervalSeconds:    30,
+			ResumeAfterSeconds: 300,
+		},
+		Resources: Resources{
+			IntervalSeconds:  10,
+			MaxCPUPercent:    80,
+			MaxMemoryPercent: 90,
+			MaxDiskPercent:   90,
+		},
+		Limits: Limits{
+			RequestsPerSecond: 10,
+			Burst:             50,
+			MaxBodyBytes:      1 << 20,
+			MaxMessageBytes:   64 << 10,
+		},
+		Checksums: Checksums{
+			Enabled:       true,
+			VerifyWorkers: 2,
+		},
+		Logging: Logging{
+			Level:       "info",
+			Format:      "text",
+			MaxSizeMB:   50,
+			MaxAgeHours: 24,
+			MaxBackups:  7,
+		},
+		Deploy: Deploy{Mode: "auto", Tag: "latest", RestartCode: 75},
+		Watch:  Watch{IntervalSeconds: 30},
+	}
+}
+
+// Path returns the config file location, honouring the environment override
+func Path() string {
+	if p := os.Getenv(EnvPath); p != "" {
+		return p
+	}
+	return DefaultPath
+}
+
+// Load reads the config file at path. A missing file yields the defaults,
+// and fields absent from the file keep their default values.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %v", path, err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+	if err := cfg.inheritProfiles(data); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+
+	cfg.normalize()
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// AcceptedExtensions returns the allow-list, including .iso when disc image
+// support is enabled
+func (c *Config) AcceptedExtensions() []string {
+	if !c.DiscImages {
+		return c.AllowedExtensions
+	}
+	for _, ext := range c.AllowedExtensions {
+		if ext == ".iso" {
+			return c.AllowedExtensions
+		}
+	}
+	return append(append([]string{}, c.AllowedExtensions...), ".iso")
+}
+
+// inheritProfiles re-reads each profile's sections on top of a copy of the
+// global ones, so a profile only needs to list the fields it changes
+func (c *Config) inheritProfiles(data []byte) error {
+	var raw struct {
+		Profiles map[string]struct {
+			Video json.RawMessage `json:"video"`
+			Audio json.RawMessage `json:"audio"`
+			HDR   json.RawMessage `json:"hdr"`
+		} `json:"profiles"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	for name, sections := range raw.Profiles {
+		profile := c.Profiles[name]
+		if sections.Video != nil {
+			video := c.Video
+			if err := json.Unmarshal(sections.Video, &video); err != nil {
+				return fmt.Errorf("profile %s: %v", name, err)
+			}
+			profile.Video = &video
+		}
+		if sections.Audio != nil {
+			audio := c.Audio
+			if err := json.Unmarshal(sections.Audio, &audio); err != nil {
+				return fmt.Errorf("profile %s: %v", name, err)
+			}
+			profile.Audio = &audio
+		}
+		if sections.HDR != nil {
+			hdr := c.HDR
+			if err := json.Unmarshal(sections.HDR, &hdr); err != nil {
+				return fmt.Errorf("profile %s: %v", name, err)
+			}
+			profile.HDR = &hdr
+		}
+		c.Profiles[name] = profile
+	}
+	return nil
+}
+
+// validate rejects unknown modes
+func (s Sidecars) validate() error {
+	switch s.Mode {
+	case SidecarsOff, SidecarsCopy, SidecarsMove:
+		return nil
+	}
+	return fmt.Errorf("sidecars.mode must be %q, %q or %q, got %q", SidecarsOff, SidecarsCopy, SidecarsMove, s.Mode)
+}
+
+// validate rejects folders without a path, unknown profiles and actions,
+// and recipes that would both delete and archive their sources
+func (w *Watch) validate(profiles map[string]Profile) error {
+	if len(w.Folders) > 0 && w.IntervalSeconds < 1 {
+		return fmt.Errorf("intervalSeconds must be at least 1, got %d", w.IntervalSeconds)
+	}
+	for _, f := range w.Folders {
+		if f.Path == "" {
+			return fmt.Errorf("folder path is required")
+		}
+		if _, ok := profiles[f.Profile]; f.Profile != "" && !ok {
+			return fmt.Errorf("folder %s refers to unknown profile %q", f.Path, f.Profile)
+		}
+		for _, a := range f.Actions {
+			switch a {
+			case WatchNotify, WatchRefresh, WatchDeleteSource, WatchArchive:
+			default:
+				return fmt.Errorf("folder %s: unknown action %q", f.Path, a)
+			}
+		}
+		if f.Has(WatchDeleteSource) && f.Has(WatchArchive) {
+			return fmt.Errorf("folder %s: %s and %s both remove the source, pick one", f.Path, WatchDeleteSource, WatchArchive)
+		}
+		if f.Has(WatchArchive) && f.ArchiveDir == "" {
+			return fmt.Errorf("folder %s: %s needs archiveDir", f.Path, WatchArchive)
+		}
+	}
+	return nil
+}
+
+// ProfileFor returns the name of the profile whose policy matches path, or
+// "" when no policy applies
+func (c *Config) ProfileFor(path string) string {
+	path = filepath.ToSlash(filepath.Clean(path))
+	for _, p := range c.Policies {
+		if globMatch(p.Path, path) {
+			return p.Profile
+		}
+	}
+	return ""
+}
+
+// globMatch matches path against a glob supporting "**", ignoring case on
+// Windows like its filesystems do
+func globMatch(pattern, path string) bool {
+	var re strings.Builder
+	if runtime.GOOS == "windows" {
+		re.WriteString("(?i)")
+	}
+	re.WriteString("^")
+	pattern = filepath.ToSlash(pattern)
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	matched, _ := regexp.MatchString(re.String(), path)
+	return matched
+}
+
+// normalize lower-cases extensions and ensures they carry a leading dot,
+// and gives the base path a leading slash but no trailing one
+func (c *Config) normalize() {
+	for i, ext := range c.AllowedExtensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext != "" && !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		c.AllowedExtensions[i] = ext
+	}
+	if base := strings.Trim(strings.TrimSpace(c.Proxy.BasePath), "/"); base != "" {
+		c.Proxy.BasePath = "/" + base
+	} else {
+		c.Proxy.BasePath = ""
+	}
+}
+
+// validate rejects settings that cannot work
+func (c *Config) validate() error {
+	switch c.Images.Format {
+	case "webp", "avif":
+	default:
+		return fmt.Errorf("images.format must be \"webp\" or \"avif\", got %q", c.Images.Format)
+	}
+	switch c.Music.Codec {
+	case "opus", "aac", "mp3":
+	default:
+		return fmt.Errorf("music.codec must be \"opus\", \"aac\" or \"mp3\", got %q", c.Music.Codec)
+	}
+	switch c.HDR.Mode {
+	case "preserve", "tonemap":
+	default:
+		return fmt.Errorf("hdr.mode must be \"preserve\" or \"tonemap\", got %q", c.HDR.Mode)
+	}
+	for _, p := range c.Policies {
+		if _, ok := c.Profiles[p.Profile]; !ok {
+			return fmt.Errorf("policy %s refers to unknown profile %q", p.Path, p.Profile)
+		}
+	}
+	if err := c.Watch.validate(c.Profiles); err != nil {
+		return fmt.Errorf("watch: %v", err)
+	}
+	for _, name := range []string{c.Arr.SonarrProfile, c.Arr.RadarrProfile} {
+		if _, ok := c.Profiles[name]; name != "" && !ok {
+			return fmt.Errorf("arr refers to unknown profile %q", name)
+		}
+	}
+	if err := mediapath.ValidateForm(c.UnicodeNormalization); err != nil {
+		return fmt.Errorf("unicodeNormalization: %v", err)
+	}
+	if err := c.Sidecars.validate(); err != nil {
+		return err
+	}
+	for name, p := range c.Profiles {
+		if p.HDR != nil && p.HDR.Mode != "preserve" && p.HDR.Mode != "tonemap" {
+			return fmt.Errorf("profile %s: hdr.mode must be \"preserve\" or \"tonemap\", got %q", name, p.HDR.Mode)
+		}
+		if p.Sidecars != nil {
+			if err := p.Sidecars.validate(); err != nil {
+				return fmt.Errorf("profile %s: %v", name, err)
+			}
+		}
+	}
+	switch c.Logging.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("logging.level must be \"debug\", \"info\", \"warn\" or \"error\", got %q", c.Logging.Level)
+	}
+	if c.Logging.Format != "text" && c.Logging.Format != "json" {
+		return fmt.Errorf("logging.format must be \"text\" or \"json\", got %q", c.Logging.Format)
+	}
+	if c.Ladder.KeyframeSeconds < 0 {
+		return fmt.Errorf("ladder.keyframeSeconds must not be negative, got %v", c.Ladder.KeyframeSeconds)
+	}
+	for _, m := range c.Network.Mounts {
+		mount := netmount.Mount{Path: m.Path, Type: m.Type}
+		if err := mount.Validate(); err != nil {
+			return fmt.Errorf("network: %v", err)
+		}
+		if m.TimeoutSeconds < 0 {
+			return fmt.Errorf("network: mount %s: timeoutSeconds must not be negative", m.Path)
+		}
+	}
+	if c.GRPC.Address != "" && (c.GRPC.CertFile == "" || c.GRPC.KeyFile == "") {
+		return fmt.Errorf("grpc: certFile and keyFile must be set to serve on %s", c.GRPC.Address)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls: certFile and keyFile must be set together")
+	}
+	if c.TLS.CertFile != "" && len(c.TLS.ACME.Domains) > 0 {
+		return fmt.Errorf("tls: set either certFile and keyFile or acme.domains, not both")
+	}
+	for _, domain := range c.TLS.ACME.Domains {
+		if domain == "" || strings.ContainsAny(domain, "/: ") {
+			return fmt.Errorf("tls: acme.domains must be host names, got %q", domain)
+		}
+	}
+	if c.TLS.RedirectAddress != "" && c.TLS.CertFile == "" && len(c.TLS.ACME.Domains) == 0 {
+		return fmt.Errorf("tls: redirectAddress needs a certificate or acme.domains")
+	}
+	if strings.ContainsAny(c.Proxy.BasePath, "?#\\ ") || strings.Contains(c.Proxy.BasePath, "//") || strings.Contains(c.Proxy.BasePath+"/", "/../") {
+		return fmt.Errorf("proxy: basePath must be a plain URL path such as \"/optimizer\", got %q", c.Proxy.BasePath)
+	}
+	if _, err := proxy.NewTrusted(c.Proxy.TrustedProxies); err != nil {
+		return fmt.Errorf("proxy: %v", err)
+	}
+	if _, err := auth.New(c.Auth.Users, c.Auth.APIKeys); err != nil {
+		return fmt.Errorf("auth: %v", err)
+	}
+	if c.Limits.RequestsPerSecond < 0 {
+		return fmt.Errorf("limits.requestsPerSecond must not be negative, got %g", c.Limits.RequestsPerSecond)
+	}
+	if c.Limits.RequestsPerSecond > 0 && c.Limits.Burst < 1 {
+		return fmt.Errorf("limits.burst must be at least 1, got %d", c.Limits.Burst)
+	}
+	if c.Limits.MaxBodyBytes < 1 || c.Limits.MaxMessageBytes < 1 {
+		return fmt.Errorf("limits.maxBodyBytes and limits.maxMessageBytes must be positive")
+	}
+	if c.Retry.Retries < 0 {
+		return fmt.Errorf("retry.retries must not be negative, got %d", c.Retry.Retries)
+	}
+	if c.Retry.BackoffSeconds < 1 {
+		return fmt.Errorf("retry.backoffSeconds must be at least 1, got %d", c.Retry.BackoffSeconds)
+	}
+	if c.Retry.MaxBackoffSeconds < c.Retry.BackoffSeconds {
+		return fmt.Errorf("retry.maxBackoffSeconds must be at least backoffSeconds, got %d", c.Retry.MaxBackoffSeconds)
+	}
+	if c.Timeout.DurationFactor < 0 {
+		return fmt.Errorf("timeout.durationFactor must not be negative, got %g", c.Timeout.DurationFactor)
+	}
+	if c.Timeout.MinMinutes < 0 {
+		return fmt.Errorf("timeout.minMinutes must not be negative, got %d", c.Timeout.MinMinutes)
+	}
+	if c.Resources.Enabled && c.Resources.IntervalSeconds < 1 {
+		return fmt.Errorf("resources.intervalSeconds must be at least 1, got %d", c.Resources.IntervalSeconds)
+	}
+	for name, percent := range map[string]float64{
+		"maxCpuPercent":    c.Resources.MaxCPUPercent,
+		"maxMemoryPercent": c.Resources.MaxMemoryPercent,
+		"maxDiskPercent":   c.Resources.MaxDiskPercent,
+	} {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("resources.%s must be between 0 and 100, got %g", name, percent)
+		}
+	}
+	names := map[string]bool{}
+	for _, r := range c.Storage.Remotes {
+		switch {
+		case r.Name == "" || strings.ContainsAny(r.Name, "/:"):
+			return fmt.Errorf("storage: remote name must be set and not contain \"/\" or \":\", got %q", r.Name)
+		case names[r.Name]:
+			return fmt.Errorf("storage: duplicate remote %q", r.Name)
+		case r.Type == storage.TypeS3 && r.Bucket == "":
+			return fmt.Errorf("storage: remote %s: bucket is required", r.Name)
+		case r.Type == storage.TypeSFTP && r.Host == "":
+			return fmt.Errorf("storage: remote %s: host is required", r.Name)
+		case r.Type == storage.TypeSFTP && (r.Port < 0 || r.Port > 65535):
+			return fmt.Errorf("storage: remote %s: port must be between 1 and 65535, got %d", r.Name, r.Port)
+		case r.Type == storage.TypeWebDAV && r.Endpoint == "":
+			return fmt.Errorf("storage: remote %s: endpoint is required", r.Name)
+		case r.Type != storage.TypeS3 && r.Type != storage.TypeSFTP && r.Type != storage.TypeWebDAV:
+			return fmt.Errorf("storage: remote %s: type must be %q, %q or %q, got %q", r.Name, storage.TypeS3, storage.TypeSFTP, storage.TypeWebDAV, r.Type)
+		}
+		names[r.Name] = true
+	}
+	if c.Throttle.ReadMBps < 0 || c.Throttle.WriteMBps < 0 {
+		return fmt.Errorf("throttle: readMBps and writeMBps must not be negative, got %g and %g", c.Throttle.ReadMBps, c.Throttle.WriteMBps)
+	}
+	switch c.Staging.Mode {
+	case StagingOff, StagingNetwork, StagingAlways:
+	default:
+		return fmt.Errorf("staging.mode must be %q, %q or %q, got %q", StagingOff, StagingNetwork, StagingAlways, c.Staging.Mode)
+	}
+	switch c.Guardrails {
+	case GuardrailsFallback, GuardrailsAttention:
+	default:
+		return fmt.Errorf("guardrails must be %q or %q, got %q", GuardrailsFallback, GuardrailsAttention, c.Guardrails)
+	}
+	if c.Checksums.VerifyWorkers < 1 {
+		return fmt.Errorf("checksums.verifyWorkers must be at least 1, got %d", c.Checksums.VerifyWorkers)
+	}
+	if c.Trash.RetentionDays < 0 {
+		return fmt.Errorf("trash.retentionDays must not be negative, got %d", c.Trash.RetentionDays)
+	}
+	if c.Quarantine.MaxDurationChangePercent < 0 {
+		return fmt.Errorf("quarantine.maxDurationChangePercent must not be negative, got %g", c.Quarantine.MaxDurationChangePercent)
+	}
+	if _, err := gpu.NewPool(c.GPUs); err != nil {
+		return fmt.Errorf("gpus: %v", err)
+	}
+	if _, err := schedule.New(c.Schedule.Windows); err != nil {
+		return fmt.Errorf("schedule: %v", err)
+	}
+	if _, err := exclude.New(c.Exclude); err != nil {
+		return fmt.Errorf("exclude: %v", err)
+	}
+	switch c.Deploy.Mode {
+	case "auto", "systemd", "docker":
+	default:
+		return fmt.Errorf("deploy.mode must be \"auto\", \"systemd\" or \"docker\", got %q", c.Deploy.Mode)
+	}
+	if c.Deploy.RestartCode < 1 || c.Deploy.RestartCode > 255 {
+		return fmt.Errorf("deploy.restartCode must be between 1 and 255, got %d", c.Deploy.RestartCode)
+	}
+	if c.Plex.URL != "" && c.Plex.Token == "" {
+		return fmt.Errorf("plex.token is required with plex.url")
+	}
+	if c.Jellyfin.URL != "" {
+		switch {
+		case c.Jellyfin.Type != "jellyfin" && c.Jellyfin.Type != "emby":
+			return fmt.Errorf("jellyfin.type must be \"jellyfin\" or \"emby\", got %q", c.Jellyfin.Type)
+		case c.Jellyfin.APIKey == "":
+			return fmt.Errorf("jellyfin.apiKey is required with jellyfin.url")
+		}
+	}
+	if c.Sessions.Enabled {
+		switch {
+		case c.Plex.URL == "" && c.Jellyfin.URL == "":
+			return fmt.Errorf("sessions requires plex or jellyfin")
+		case c.Sessions.Action != SessionsPause && c.Sessions.Action != SessionsHold:
+			return fmt.Errorf("sessions.action must be %q or %q, got %q", SessionsPause, SessionsHold, c.Sessions.Action)
+		case c.Sessions.IntervalSeconds < 1:
+			return fmt.Errorf("sessions.intervalSeconds must be at least 1, got %d", c.Sessions.IntervalSeconds)
+		case c.Sessions.ResumeAfterSeconds < 0:
+			return fmt.Errorf("sessions.resumeAfterSeconds must not be negative, got %d", c.Sessions.ResumeAfterSeconds)
+		}
+	}
+	if c.RestrictToRoots && len(c.MediaRoots) == 0 {
+		return fmt.Errorf("restrictToRoots requires mediaRoots")
+	}
+	if c.Cloud.PricePerMinute < 0 || c.Cloud.MonthlyBudget < 0 || c.Cloud.ConfirmAbove < 0 {
+		return fmt.Errorf("cloud prices and limits must not be negative")
+	}
+	switch c.Verification.Metric {
+	case "", "ssim", "vmaf":
+	default:
+		return fmt.Errorf("verification.metric must be \"ssim\" or \"vmaf\", got %q", c.Verification.Metric)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadMissingFileReturnsDefaults(t *testing.T) {
+	cfg, err := Load(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("Expected no error for missing config, got %v", err)
+	}
+
+	if len(cfg.AllowedExtensions) != len(Default().AllowedExtensions) {
+		t.Errorf("Expected default extensions, got %v", cfg.AllowedExtensions)
+	}
+}
+
+func TestLoadNormalizesExtensions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"allowedExtensions": ["MKV", ".Mp4"]}`), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	expected := []string{".mkv", ".mp4"}
+	if len(cfg.AllowedExtensions) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, cfg.AllowedExtensions)
+	}
+	for i, ext := range expected {
+		if cfg.AllowedExtensions[i] != ext {
+			t.Errorf("Expected extension %s, got %s", ext, cfg.AllowedExtensions[i])
+		}
+	}
+}
+
+func TestLoadInvalidJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{not json`), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	if _, err := Load(path); err == nil {
+		t.Error("Expected error for invalid config")
+	}
+}
+
+func TestProfilesAndPolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{
+		"video": {"codec": "libx265", "crf": 26},
+		"profiles": {
+			"kids": {"video": {"transcode": true, "rateControl": "capped-crf", "maxBitrateKbps": 2500}, "maxHeight": 720},
+			"4k": {"video": {"transcode": false}, "audio": {"codec": "eac3", "layout": "", "passthrough": ["eac3", "truehd"]}},
+			"av1": {"video": {"transcode": true, "codec": "libsvtav1", "crf": 30, "filmGrain": 8}},
+			"web": {"video": {"transcode": true, "codec": "libvpx-vp9", "crf": 33, "rowMT": true, "tileColumns": 2}, "audio": {"codec": "opus"}}
+		},
+		"policies": [
+			{"path": "/media/kids/**", "profile": "kids"},
+			{"path": "/media/4k/*.mkv", "profile": "4k"}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	kids := cfg.Profiles["kids"]
+	if kids.Video == nil || kids.Video.Codec != "libx265" || kids.Video.CRF != 26 || kids.Video.MaxBitrateKbps != 2500 {
+		t.Errorf("Expected kids video to inherit global settings, got %+v", kids.Video)
+	}
+	if kids.MaxHeight != 720 || kids.HDR != nil {
+		t.Errorf("Unexpected kids profile %+v", kids)
+	}
+
+	av1 := cfg.Profiles["av1"]
+	if av1.Video == nil || av1.Video.Codec != "libsvtav1" || av1.Video.Preset != "medium" || av1.Video.CRF != 30 || av1.Video.FilmGrain != 8 {
+		t.Errorf("Expected av1 video to override the codec and inherit the preset, got %+v", av1.Video)
+	}
+
+	web := cfg.Profiles["web"]
+	if web.Video == nil || web.Video.Codec != "libvpx-vp9" || !web.Video.RowMT || web.Video.TileColumns != 2 || web.Audio == nil || web.Audio.Codec != "opus" {
+		t.Errorf("Expected web to encode VP9 with Opus audio, got %+v and %+v", web.Video, web.Audio)
+	}
+
+	uhd := cfg.Profiles["4k"]
+	if uhd.Audio == nil || uhd.Audio.Codec != "eac3" || uhd.Audio.BitrateKbps != 384 || uhd.Audio.Layout != "" || len(uhd.Audio.Passthrough) != 2 {
+		t.Errorf("Expected 4k audio to inherit global settings, got %+v", uhd.Audio)
+	}
+
+	for file, expected := range map[string]string{
+		"/media/kids/Show/S01E01.mkv": "kids",
+		"/media/4k/Movie.mkv":         "4k",
+		"/media/4k/Extras/Movie.mkv":  "",
+		"/media/movies/Movie.mkv":     "",
+	} {
+		if got := cfg.ProfileFor(file); got != expected {
+			t.Errorf("ProfileFor(%s) = %q, expected %q", file, got, expected)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(`{"policies": [{"path": "/x/**", "profile": "missing"}]}`), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("Expected error for a policy with an unknown profile")
+	}
+}
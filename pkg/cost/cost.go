@@ -0,0 +1,67 @@
+// Package cost estimates what a job costs on a backend billed per minute of
+// media and enforces the configured spending limits before it is submitted.
+package cost
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"media_optimizer/pkg/jobstore"
+)
+
+// ErrConfirmationRequired is returned for jobs estimated above the
+// confirmation threshold that haven't been confirmed
+var ErrConfirmationRequired = errors.New("job cost requires confirmation")
+
+// ErrBudgetExceeded is returned when a job would take the month's spend over
+// the budget
+var ErrBudgetExceeded = errors.New("monthly budget exceeded")
+
+// Guard holds the pricing and limits of a billed backend. A zero
+// PricePerMinute disables the guard, as do zero limits individually.
+type Guard struct {
+	// PricePerMinute is charged per minute of source duration
+	PricePerMinute float64
+	// MonthlyBudget caps the spend per calendar month
+	MonthlyBudget float64
+	// ConfirmAbove requires confirmation for jobs estimated above it
+	ConfirmAbove float64
+}
+
+// Enabled reports whether jobs are billed
+func (g Guard) Enabled() bool {
+	return g.PricePerMinute > 0
+}
+
+// Estimate returns the cost of processing media of the given duration,
+// rounded up to whole cents
+func (g Guard) Estimate(duration time.Duration) float64 {
+	return math.Ceil(duration.Minutes()*g.PricePerMinute*100) / 100
+}
+
+// Check decides whether a job with the given estimate may be submitted after
+// spent has already been used this month
+func (g Guard) Check(estimate, spent float64, confirmed bool) error {
+	if g.MonthlyBudget > 0 && spent+estimate > g.MonthlyBudget {
+		return fmt.Errorf("%w: %.2f already spent of %.2f, job estimated at %.2f", ErrBudgetExceeded, spent, g.MonthlyBudget, estimate)
+	}
+	if g.ConfirmAbove > 0 && estimate > g.ConfirmAbove && !confirmed {
+		return fmt.Errorf("%w: estimated at %.2f, above %.2f", ErrConfirmationRequired, estimate, g.ConfirmAbove)
+	}
+	return nil
+}
+
+// MonthSpend sums the cost of jobs created in the calendar month of now.
+// Failed jobs count too, since the backend bills the work it did.
+func MonthSpend(records []jobstore.Record, now time.Time) float64 {
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	var spent float64
+	for _, r := range records {
+		if !r.CreatedAt.Before(start) {
+			spent += r.Cost
+		}
+	}
+	return spent
+}
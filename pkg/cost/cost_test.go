@@ -0,0 +1,44 @@
+package cost
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"media_optimizer/pkg/jobstore"
+)
+
+func TestGuard(t *testing.T) {
+	g := Guard{PricePerMinute: 0.015, MonthlyBudget: 20, ConfirmAbove: 1}
+
+	if got := g.Estimate(2 * time.Hour); got != 1.8 {
+		t.Errorf("Estimate(2h) = %v, expected 1.8", got)
+	}
+	if err := g.Check(0.5, 0, false); err != nil {
+		t.Errorf("Expected cheap job to pass, got %v", err)
+	}
+	if err := g.Check(1.8, 0, false); !errors.Is(err, ErrConfirmationRequired) {
+		t.Errorf("Expected confirmation error, got %v", err)
+	}
+	if err := g.Check(1.8, 0, true); err != nil {
+		t.Errorf("Expected confirmed job to pass, got %v", err)
+	}
+	if err := g.Check(1.8, 19, true); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("Expected budget error, got %v", err)
+	}
+	if (Guard{}).Enabled() {
+		t.Error("Expected zero guard to be disabled")
+	}
+}
+
+func TestMonthSpend(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	records := []jobstore.Record{
+		{Cost: 2, CreatedAt: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{Cost: 1.5, Status: "failed", CreatedAt: time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)},
+		{Cost: 7, CreatedAt: time.Date(2024, 2, 29, 23, 0, 0, 0, time.UTC)},
+	}
+	if got := MonthSpend(records, now); got != 3.5 {
+		t.Errorf("MonthSpend = %v, expected 3.5", got)
+	}
+}
@@ -0,0 +1,133 @@
+// Package exclude decides which media must never be touched: paths matching
+// the configured globs and directories opted out with a marker file.
+package exclude
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// Marker is the file that opts the directory holding it, and everything
+// below, out of scans, watch folders and jobs
+const Marker = ".optimize-ignore"
+
+// Rules are the exclusions. A nil *Rules excludes nothing.
+type Rules struct {
+	// paths match whole slash-separated paths, names single path elements
+	paths []*regexp.Regexp
+	names []*regexp.Regexp
+}
+
+// New compiles globs into rules that also honor markers. A glob with a
+// slash matches whole paths, "**" spanning directories, e.g.
+// "/media/home-videos/**"; one without matches any element of a path, e.g.
+// "Extras" or "*.sample.mkv".
+func New(globs []string) (*Rules, error) {
+	r := &Rules{}
+	for _, glob := range globs {
+		if strings.TrimSpace(glob) == "" {
+			return nil, fmt.Errorf("empty exclude glob")
+		}
+		re, err := compile(glob)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude glob %q: %v", glob, err)
+		}
+		if strings.Contains(filepath.ToSlash(glob), "/") {
+			r.paths = append(r.paths, re)
+		} else {
+			r.names = append(r.names, re)
+		}
+	}
+	return r, nil
+}
+
+// Excluded reports whether path, a file or directory, matches a glob or is
+// below a directory holding a marker
+func (r *Rules) Excluded(path string) bool {
+	if r == nil {
+		return false
+	}
+	path = filepath.Clean(path)
+	if r.Matches(path) {
+		return true
+	}
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if r.matchesName(filepath.Base(dir)) || hasMarker(dir) {
+			return true
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return false
+		}
+	}
+}
+
+// SkipDir reports whether a walk should leave out the directory dir, which
+// matches a glob or holds a marker. Walks check each directory they enter,
+// so they needn't look at the directories above.
+func (r *Rules) SkipDir(dir string) bool {
+	if r == nil {
+		return false
+	}
+	return r.Matches(dir) || hasMarker(dir)
+}
+
+// Matches reports whether path matches a glob, without looking for markers
+func (r *Rules) Matches(path string) bool {
+	if r == nil {
+		return false
+	}
+	slashed := filepath.ToSlash(filepath.Clean(path))
+	for _, re := range r.paths {
+		if re.MatchString(slashed) {
+			return true
+		}
+	}
+	return r.matchesName(filepath.Base(path))
+}
+
+// matchesName reports whether a single path element matches a glob
+func (r *Rules) matchesName(name string) bool {
+	for _, re := range r.names {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMarker reports whether dir holds the opt-out marker
+func hasMarker(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, Marker))
+	return err == nil
+}
+
+// compile turns a glob into a regular expression where "**" matches across
+// directories and "*" and "?" within one. On Windows it ignores case like
+// its filesystems do.
+func compile(glob string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	if runtime.GOOS == "windows" {
+		re.WriteString("(?i)")
+	}
+	re.WriteString("^")
+	glob = filepath.ToSlash(glob)
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
@@ -0,0 +1,52 @@
+package exclude
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	root := t.TempDir()
+	home := filepath.Join(root, "home-videos", "2019")
+	if err := os.MkdirAll(home, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "home-videos", Marker), nil, 0644); err != nil {
+		t.Fatalf("Failed to write marker: %v", err)
+	}
+
+	rules, err := New([]string{filepath.ToSlash(root) + "/archive/**", "Extras", "*.sample.mkv"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	for path, expected := range map[string]bool{
+		filepath.Join(root, "movies", "Movie.mkv"):           false,
+		filepath.Join(root, "archive", "Old", "Movie.mkv"):   true,
+		filepath.Join(root, "movies", "Extras", "Clip.mkv"):  true,
+		filepath.Join(root, "movies", "Movie.sample.mkv"):    true,
+		filepath.Join(home, "Birthday.mp4"):                  true,
+		filepath.Join(root, "home-videos"):                   true,
+		filepath.Join(root, "home-videos-other", "Clip.mkv"): false,
+	} {
+		if got := rules.Excluded(path); got != expected {
+			t.Errorf("Excluded(%s) = %v, expected %v", path, got, expected)
+		}
+	}
+
+	// Walks skip marked and matching directories as they enter them
+	if !rules.SkipDir(filepath.Join(root, "home-videos")) || rules.SkipDir(home) {
+		t.Error("Expected only the marked directory itself to be skipped")
+	}
+	if !rules.SkipDir(filepath.Join(root, "movies", "Extras")) {
+		t.Error("Expected a directory matching a name glob to be skipped")
+	}
+
+	var none *Rules
+	if none.Excluded(home) || none.SkipDir(home) || none.Matches(home) {
+		t.Error("Expected nil rules to exclude nothing")
+	}
+	if _, err := New([]string{" "}); err == nil {
+		t.Error("Expected an error for an empty glob")
+	}
+}
@@ -0,0 +1,121 @@
+// Package favorites keeps the directories users bookmarked in the file
+// browser.
+package favorites
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"media_optimizer/pkg/uuid"
+)
+
+// ErrNotFound is returned for favorites that don't exist or belong to
+// another user
+var ErrNotFound = errors.New("favorite not found")
+
+// Favorite is a bookmarked directory of a user
+type Favorite struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// Name labels the favorite, by default the last element of Path
+	Name string `json:"name"`
+	// User added the favorite; empty without configured users, when
+	// everyone shares the favorites
+	User      string    `json:"user,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Store keeps favorites in the order they were added and persists them to
+// a JSON file
+type Store struct {
+	mu        sync.RWMutex
+	path      string
+	favorites []Favorite
+}
+
+// Open loads the store from path, starting empty if the file does not exist
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read favorites %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &s.favorites); err != nil {
+		return nil, fmt.Errorf("failed to parse favorites %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// List returns the favorites of user in the order they were added
+func (s *Store) List(user string) []Favorite {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	favorites := []Favorite{}
+	for _, f := range s.favorites {
+		if f.User == user {
+			favorites = append(favorites, f)
+		}
+	}
+	return favorites
+}
+
+// Add records f for its user and returns it with its ID. If the user
+// already has a favorite for the path, that one is returned and added is
+// false.
+func (s *Store) Add(f Favorite) (favorite Favorite, added bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.favorites {
+		if existing.User == f.User && existing.Path == f.Path {
+			return existing, false, nil
+		}
+	}
+	f.ID = uuid.New()
+	f.CreatedAt = time.Now()
+	if f.Name == "" {
+		f.Name = filepath.Base(f.Path)
+	}
+	s.favorites = append(s.favorites, f)
+	return f, true, s.save()
+}
+
+// Remove deletes the favorite with the given ID of user
+func (s *Store) Remove(id, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, f := range s.favorites {
+		if f.ID == id && f.User == user {
+			s.favorites = append(s.favorites[:i], s.favorites[i+1:]...)
+			return s.save()
+		}
+	}
+	return ErrNotFound
+}
+
+// save writes the store to disk via a temp file and rename. Callers must
+// hold the lock.
+func (s *Store) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create favorites directory: %v", err)
+	}
+	data, err := json.MarshalIndent(s.favorites, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode favorites: %v", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write favorites: %v", err)
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,57 @@
+package favorites
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "favorites.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	movies, added, err := store.Add(Favorite{Path: "/media/movies", User: "alice"})
+	if err != nil || !added {
+		t.Fatalf("Add failed: %v (%v)", err, added)
+	}
+	if movies.ID == "" || movies.Name != "movies" || movies.CreatedAt.IsZero() {
+		t.Errorf("Unexpected favorite %+v", movies)
+	}
+	store.Add(Favorite{Path: "s3://archive/tv", Name: "Archived TV", User: "alice"})
+	store.Add(Favorite{Path: "/media/movies", User: "bob"})
+
+	// Adding a path again returns the existing favorite
+	again, added, _ := store.Add(Favorite{Path: "/media/movies", Name: "Other", User: "alice"})
+	if added || again.ID != movies.ID {
+		t.Errorf("Expected the existing favorite, got %+v (%v)", again, added)
+	}
+
+	// Favorites survive a restart, each user seeing their own in order
+	store, err = Open(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	list := store.List("alice")
+	if len(list) != 2 || list[0].ID != movies.ID || list[1].Name != "Archived TV" {
+		t.Errorf("Expected alice's two favorites in order, got %+v", list)
+	}
+	if list := store.List(""); len(list) != 0 {
+		t.Errorf("Expected no shared favorites, got %+v", list)
+	}
+
+	if err := store.Remove(movies.ID, "bob"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected another user's favorite to be out of reach, got %v", err)
+	}
+	if err := store.Remove(movies.ID, "alice"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if list := store.List("alice"); len(list) != 1 || list[0].Name != "Archived TV" {
+		t.Errorf("Expected the remaining favorite, got %+v", list)
+	}
+	if list := store.List("bob"); len(list) != 1 {
+		t.Errorf("Expected bob's favorite to stay, got %+v", list)
+	}
+}
@@ -0,0 +1,317 @@
+// Package ffmpeg locates the ffmpeg and ffprobe binaries, checks their
+// version and encoders, and can download a static build when none is
+// installed.
+package ffmpeg
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// MinMajorVersion is the oldest ffmpeg release the optimizer is tested with
+const MinMajorVersion = 4
+
+// DefaultDownloadURL is the static build location. {name} is "ffmpeg" or
+// "ffprobe" and {platform} is e.g. "linux-x64"; the file is gzip compressed.
+const DefaultDownloadURL = "https://github.com/eugeneware/ffmpeg-static/releases/download/b6.0/{name}-{platform}.gz"
+
+// searchDirs are common install locations checked after PATH
+var searchDirs = []string{
+	"/usr/local/bin",
+	"/usr/bin",
+	"/opt/homebrew/bin",
+	"/snap/bin",
+	"/usr/lib/jellyfin-ffmpeg",
+}
+
+func init() {
+	if runtime.GOOS == "windows" {
+		searchDirs = []string{`C:\ffmpeg\bin`, `C:\Program Files\ffmpeg\bin`}
+	}
+}
+
+// Options configures how the binaries are found
+type Options struct {
+	// Dir holds ffmpeg and ffprobe and is searched before anything else
+	Dir string
+	// Download fetches a static build into DownloadDir when nothing is found
+	Download    bool
+	DownloadDir string
+	// DownloadURL overrides DefaultDownloadURL
+	DownloadURL string
+	// SHA256 pins the hex SHA-256 of each gzip compressed download, keyed by
+	// "{name}-{platform}" as in the URL, e.g. "ffmpeg-linux-x64"
+	SHA256 map[string]string
+	// Unverified allows downloads without a pinned SHA256
+	Unverified bool
+}
+
+// Tools describes the ffmpeg installation in use
+type Tools struct {
+	FFmpeg  string `json:"ffmpeg"`
+	FFprobe string `json:"ffprobe"`
+	// Version is the version string ffmpeg reports, e.g. "6.0" or
+	// "N-112345-gabcdef" for development builds
+	Version  string          `json:"version"`
+	encoders map[string]bool // names listed by ffmpeg -encoders
+}
+
+// Locate finds ffmpeg and ffprobe in opts.Dir, PATH and the common install
+// locations, in that order, downloading them if allowed and nothing is found.
+// The binaries are then checked to run and report a supported version.
+func Locate(ctx context.Context, opts Options) (*Tools, error) {
+	ffmpegPath, ffprobePath := find(opts.Dir)
+	if ffmpegPath == "" || ffprobePath == "" {
+		if !opts.Download {
+			return nil, fmt.Errorf("ffmpeg and ffprobe not found in PATH or %s; install ffmpeg (e.g. \"apt install ffmpeg\"), set ffmpeg.dir, or enable ffmpeg.download", strings.Join(searchDirs, ", "))
+		}
+		// A build downloaded on an earlier run is reused
+		ffmpegPath, ffprobePath = binary(opts.DownloadDir, "ffmpeg"), binary(opts.DownloadDir, "ffprobe")
+		if ffmpegPath == "" || ffprobePath == "" {
+			if err := Download(ctx, opts); err != nil {
+				return nil, err
+			}
+			ffmpegPath, ffprobePath = find(opts.DownloadDir)
+		}
+		if ffmpegPath == "" || ffprobePath == "" {
+			return nil, fmt.Errorf("downloaded ffmpeg is missing from %s", opts.DownloadDir)
+		}
+	}
+
+	t := &Tools{FFmpeg: ffmpegPath, FFprobe: ffprobePath}
+	if err := t.check(ctx); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// find returns the first directory's ffmpeg and ffprobe, starting with dir
+func find(dir string) (string, string) {
+	if dir != "" {
+		return binary(dir, "ffmpeg"), binary(dir, "ffprobe")
+	}
+	ffmpegPath, err1 := exec.LookPath("ffmpeg")
+	ffprobePath, err2 := exec.LookPath("ffprobe")
+	if err1 == nil && err2 == nil {
+		return ffmpegPath, ffprobePath
+	}
+	for _, d := range searchDirs {
+		if f, p := binary(d, "ffmpeg"), binary(d, "ffprobe"); f != "" && p != "" {
+			return f, p
+		}
+	}
+	return "", ""
+}
+
+// binary returns the path of the named executable in dir, or "" if missing
+func binary(dir, name string) string {
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	path := filepath.Join(dir, name)
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		return ""
+	}
+	return path
+}
+
+// versionPattern extracts the version from the first line of ffmpeg -version
+var versionPattern = regexp.MustCompile(`^ffmpeg version (\S+)`)
+
+// check runs both binaries and loads the encoder list
+func (t *Tools) check(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, t.FFmpeg, "-hide_banner", "-version").Output()
+	if err != nil {
+		return fmt.Errorf("failed to run %s: %v", t.FFmpeg, err)
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	m := versionPattern.FindStringSubmatch(line)
+	if m == nil {
+		return fmt.Errorf("unrecognised ffmpeg version output: %s", line)
+	}
+	t.Version = m[1]
+	if major, ok := majorVersion(t.Version); ok && major < MinMajorVersion {
+		return fmt.Errorf("ffmpeg %s is too old, version %d or newer is required", t.Version, MinMajorVersion)
+	}
+
+	if err := exec.CommandContext(ctx, t.FFprobe, "-hide_banner", "-version").Run(); err != nil {
+		return fmt.Errorf("failed to run %s: %v", t.FFprobe, err)
+	}
+
+	out, err = exec.CommandContext(ctx, t.FFmpeg, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list ffmpeg encoders: %v", err)
+	}
+	t.encoders = parseEncoders(out)
+	return nil
+}
+
+// majorVersion parses the major number of a release version such as "6.0"
+// or "n5.1.2". Development builds have none.
+func majorVersion(version string) (int, bool) {
+	digits, _, _ := strings.Cut(strings.TrimPrefix(version, "n"), ".")
+	major, err := strconv.Atoi(digits)
+	return major, err == nil
+}
+
+// parseEncoders reads the names from ffmpeg -encoders output, whose entries
+// look like " V....D libx265              libx265 H.265 / HEVC"
+func parseEncoders(out []byte) map[string]bool {
+	encoders := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	listing := false
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 1 && fields[0] == "------" {
+			listing = true
+			continue
+		}
+		if listing && len(fields) >= 2 {
+			encoders[fields[1]] = true
+		}
+	}
+	return encoders
+}
+
+// HasEncoder reports whether ffmpeg was built with the named encoder
+func (t *Tools) HasEncoder(name string) bool {
+	return t.encoders[name]
+}
+
+// MissingEncoders returns the names ffmpeg lacks
+func (t *Tools) MissingEncoders(names ...string) []string {
+	var missing []string
+	for _, name := range names {
+		if !t.HasEncoder(name) {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// AddToPath puts the binaries' directory first in PATH so that ffmpeg and
+// ffprobe started by name, including from scripts, resolve to them
+func (t *Tools) AddToPath() error {
+	dir := filepath.Dir(t.FFmpeg)
+	if found, err := exec.LookPath("ffmpeg"); err == nil && filepath.Dir(found) == dir {
+		return nil
+	}
+	return os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// Platform returns the static build name of the current platform
+func Platform() (string, error) {
+	platforms := map[string]string{
+		"linux/amd64":   "linux-x64",
+		"linux/arm64":   "linux-arm64",
+		"darwin/amd64":  "darwin-x64",
+		"darwin/arm64":  "darwin-arm64",
+		"windows/amd64": "win32-x64",
+	}
+	platform, ok := platforms[runtime.GOOS+"/"+runtime.GOARCH]
+	if !ok {
+		return "", fmt.Errorf("no static ffmpeg build for %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+	return platform, nil
+}
+
+// Download fetches static ffmpeg and ffprobe builds for the current
+// platform into opts.DownloadDir. opts.DownloadURL is a template as in
+// DefaultDownloadURL; empty uses the default. Each file must match its
+// opts.SHA256 entry, and files without one are refused unless
+// opts.Unverified is set, so a tampered build is never installed.
+func Download(ctx context.Context, opts Options) error {
+	platform, err := Platform()
+	if err != nil {
+		return err
+	}
+	url := opts.DownloadURL
+	if url == "" {
+		url = DefaultDownloadURL
+	}
+	names := []string{"ffmpeg", "ffprobe"}
+	for _, name := range names {
+		if key := name + "-" + platform; opts.SHA256[key] == "" && !opts.Unverified {
+			return fmt.Errorf("no SHA-256 is pinned for %s; set ffmpeg.downloadSha256 or enable ffmpeg.downloadUnverified", key)
+		}
+	}
+	if err := os.MkdirAll(opts.DownloadDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", opts.DownloadDir, err)
+	}
+	for _, name := range names {
+		src := strings.NewReplacer("{name}", name, "{platform}", platform).Replace(url)
+		dst := filepath.Join(opts.DownloadDir, name)
+		if runtime.GOOS == "windows" {
+			dst += ".exe"
+		}
+		if err := fetch(ctx, src, dst, opts.SHA256[name+"-"+platform]); err != nil {
+			return fmt.Errorf("failed to download %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// fetch downloads the gzip compressed executable at url to dst via a temp
+// file, so an interrupted or mismatching download never leaves a broken
+// binary. A non-empty sum is the expected hex SHA-256 of the compressed file.
+func fetch(ctx context.Context, url, dst, sum string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	hash := sha256.New()
+	body := io.TeeReader(resp.Body, hash)
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("%s is not gzip compressed: %v", url, err)
+	}
+	defer gz.Close()
+
+	tmp := dst + ".download"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, gz); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Anything after the gzip stream is part of the file that was hashed
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); sum != "" && !strings.EqualFold(got, sum) {
+		os.Remove(tmp)
+		return fmt.Errorf("%s has SHA-256 %s, expected %s", url, got, sum)
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,132 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeFFmpeg is a stand-in answering -version and -encoders
+const fakeFFmpeg = `#!/bin/sh
+case "$2" in
+-version) echo "ffmpeg version VERSION Copyright (c) 2000-2023 the FFmpeg developers" ;;
+-encoders) printf 'Encoders:\n V..... = Video\n ------\n V....D libx264              libx264 H.264\n A....D ac3                  ATSC A/52A (AC-3)\n' ;;
+esac
+`
+
+func writeFake(t *testing.T, dir, version string) {
+	t.Helper()
+	script := []byte(strings.Replace(fakeFFmpeg, "VERSION", version, 1))
+	for _, name := range []string{"ffmpeg", "ffprobe"} {
+		if err := os.WriteFile(filepath.Join(dir, name), script, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLocate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses shell scripts as fake binaries")
+	}
+	dir := t.TempDir()
+	writeFake(t, dir, "6.0-static")
+
+	tools, err := Locate(context.Background(), Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Locate failed: %v", err)
+	}
+	if tools.Version != "6.0-static" || tools.FFprobe != filepath.Join(dir, "ffprobe") {
+		t.Errorf("Unexpected tools %+v", tools)
+	}
+	if !tools.HasEncoder("libx264") || !tools.HasEncoder("ac3") {
+		t.Errorf("Expected the listed encoders, got %v", tools.encoders)
+	}
+	if missing := tools.MissingEncoders("libx264", "libx265"); len(missing) != 1 || missing[0] != "libx265" {
+		t.Errorf("Expected libx265 to be missing, got %v", missing)
+	}
+
+	writeFake(t, dir, "3.4.8")
+	if _, err := Locate(context.Background(), Options{Dir: dir}); err == nil {
+		t.Error("Expected an old version to be rejected")
+	}
+	if _, err := Locate(context.Background(), Options{Dir: t.TempDir()}); err == nil {
+		t.Error("Expected an error when the binaries are missing")
+	}
+}
+
+func TestDownload(t *testing.T) {
+	if _, err := Platform(); err != nil || runtime.GOOS == "windows" {
+		t.Skip("no static build or shell for this platform")
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(strings.Replace(fakeFFmpeg, "VERSION", "n6.1", 1)))
+	gz.Close()
+	hash := sha256.Sum256(buf.Bytes())
+	platform, _ := Platform()
+	pinned := map[string]string{
+		"ffmpeg-" + platform:  hex.EncodeToString(hash[:]),
+		"ffprobe-" + platform: hex.EncodeToString(hash[:]),
+	}
+
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	dir := filepath.Join(t.TempDir(), "bin")
+	opts := Options{
+		Dir:         filepath.Join(t.TempDir(), "empty"),
+		Download:    true,
+		DownloadDir: dir,
+		DownloadURL: server.URL + "/{name}-{platform}.gz",
+	}
+	if _, err := Locate(context.Background(), opts); err == nil || len(requested) != 0 {
+		t.Errorf("Expected a download without pinned hashes to be refused, got %v after %v", err, requested)
+	}
+
+	wrong := opts
+	wrong.SHA256 = map[string]string{"ffmpeg-" + platform: strings.Repeat("0", 64), "ffprobe-" + platform: strings.Repeat("0", 64)}
+	if _, err := Locate(context.Background(), wrong); err == nil || !strings.Contains(err.Error(), "SHA-256") {
+		t.Errorf("Expected a mismatching download to be refused, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected a mismatching download to be discarded, got %v", entries)
+	}
+
+	requested = nil
+	opts.SHA256 = pinned
+	tools, err := Locate(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Locate failed: %v", err)
+	}
+	if tools.FFmpeg != filepath.Join(dir, "ffmpeg") || tools.Version != "n6.1" {
+		t.Errorf("Expected the downloaded build, got %+v", tools)
+	}
+	if len(requested) != 2 || !strings.HasPrefix(requested[1], "/ffprobe-") {
+		t.Errorf("Expected ffmpeg and ffprobe to be fetched, got %v", requested)
+	}
+
+	if _, err := Locate(context.Background(), opts); err != nil || len(requested) != 2 {
+		t.Errorf("Expected the earlier download to be reused, got %v after %v", err, requested)
+	}
+
+	unverified := opts
+	unverified.SHA256 = nil
+	unverified.Unverified = true
+	unverified.DownloadDir = filepath.Join(t.TempDir(), "bin")
+	if _, err := Locate(context.Background(), unverified); err != nil {
+		t.Errorf("Expected an unverified download to be allowed on opt-in, got %v", err)
+	}
+}
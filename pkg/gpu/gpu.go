@@ -0,0 +1,93 @@
+// Package gpu hands out hardware encoder sessions so that concurrent jobs
+// stay within each GPU's session limit.
+package gpu
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DefaultSessions is the session limit assumed when a GPU doesn't set one.
+// Consumer NVIDIA cards allow a handful of concurrent NVENC sessions
+// depending on the driver; datacenter cards have no limit.
+const DefaultSessions = 3
+
+// GPU is one encoder device
+type GPU struct {
+	// Index is the device number passed to the encoder, e.g. -gpu for NVENC
+	Index int `json:"index"`
+	// Sessions is the number of concurrent encodes the device allows
+	Sessions int `json:"sessions"`
+}
+
+// Usage reports the sessions of one GPU
+type Usage struct {
+	Index    int `json:"index"`
+	Sessions int `json:"sessions"`
+	InUse    int `json:"inUse"`
+}
+
+// Pool tracks the encoder sessions in use on each GPU
+type Pool struct {
+	mu    sync.Mutex
+	usage []Usage
+}
+
+// NewPool creates a pool for gpus, rejecting duplicate indexes
+func NewPool(gpus []GPU) (*Pool, error) {
+	p := &Pool{}
+	seen := make(map[int]bool)
+	for _, g := range gpus {
+		if seen[g.Index] {
+			return nil, fmt.Errorf("gpu %d is listed twice", g.Index)
+		}
+		if g.Index < 0 || g.Sessions < 0 {
+			return nil, fmt.Errorf("gpu %d: index and sessions must not be negative", g.Index)
+		}
+		seen[g.Index] = true
+		sessions := g.Sessions
+		if sessions == 0 {
+			sessions = DefaultSessions
+		}
+		p.usage = append(p.usage, Usage{Index: g.Index, Sessions: sessions})
+	}
+	return p, nil
+}
+
+// Acquire takes a session on the least busy GPU with one free. It returns
+// the GPU's index and a release function, or ok false when every session is
+// taken. Calling release more than once has no further effect.
+func (p *Pool) Acquire() (index int, release func(), ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	best := -1
+	for i, u := range p.usage {
+		if u.InUse >= u.Sessions {
+			continue
+		}
+		if best < 0 || u.InUse*p.usage[best].Sessions < p.usage[best].InUse*u.Sessions {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, nil, false
+	}
+	p.usage[best].InUse++
+
+	var once sync.Once
+	return p.usage[best].Index, func() {
+		once.Do(func() {
+			p.mu.Lock()
+			p.usage[best].InUse--
+			p.mu.Unlock()
+		})
+	}, true
+}
+
+// Usage returns the current session counts of every GPU
+func (p *Pool) Usage() []Usage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Usage{}, p.usage...)
+}
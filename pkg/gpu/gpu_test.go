@@ -0,0 +1,41 @@
+package gpu
+
+import "testing"
+
+func TestPool(t *testing.T) {
+	p, err := NewPool([]GPU{{Index: 0, Sessions: 2}, {Index: 1}})
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+
+	// Sessions are spread across GPUs by load before any fills up
+	var releases []func()
+	got := make(map[int]int)
+	for i := 0; i < 5; i++ {
+		index, release, ok := p.Acquire()
+		if !ok {
+			t.Fatalf("Expected session %d to be granted", i+1)
+		}
+		got[index]++
+		releases = append(releases, release)
+	}
+	if got[0] != 2 || got[1] != DefaultSessions {
+		t.Errorf("Expected 2 sessions on GPU 0 and %d on GPU 1, got %v", DefaultSessions, got)
+	}
+	if _, _, ok := p.Acquire(); ok {
+		t.Fatal("Expected no session once every GPU is full")
+	}
+
+	releases[0]()
+	releases[0]()
+	if _, _, ok := p.Acquire(); !ok {
+		t.Error("Expected a released session to be granted again")
+	}
+	if _, _, ok := p.Acquire(); ok {
+		t.Error("Expected a double release to free only one session")
+	}
+
+	if _, err := NewPool([]GPU{{Index: 0}, {Index: 0}}); err == nil {
+		t.Error("Expected duplicate GPUs to be rejected")
+	}
+}
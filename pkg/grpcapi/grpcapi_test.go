@@ -0,0 +1,163 @@
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundtrip(t *testing.T) {
+	in := &BrowseResponse{
+		Path: "/media",
+		Files: []*FileInfo{
+			{Name: "a.mkv", Path: "/media/a.mkv", Size: 1 << 40, ModTimeUnix: 1700000000, MediaType: "video"},
+			// Empty elements keep their place
+			{},
+			{Name: "tv", Path: "/media/tv", IsDir: true},
+		},
+		Total: 3,
+		Limit: -1,
+	}
+	out := &BrowseResponse{}
+	if err := out.Unmarshal(in.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Expected %+v, got %+v", in, out)
+	}
+
+	job := &Job{ID: "abc", Progress: 42.5, Speed: 1.25, ETASeconds: 90, Attempt: 2}
+	var decoded Job
+	if err := decoded.Unmarshal(job.Marshal()); err != nil || decoded != *job {
+		t.Errorf("Expected %+v, got %+v (%v)", job, decoded, err)
+	}
+
+	// Unknown fields are skipped, wrong wire types rejected
+	var e encoder
+	e.string(99, "future")
+	e.string(1, "abc")
+	if err := decoded.Unmarshal(e.b); err != nil || decoded.ID != "abc" {
+		t.Errorf("Expected unknown fields to be skipped, got %v", err)
+	}
+	e = encoder{}
+	e.int(1, 5)
+	if err := decoded.Unmarshal(e.b); err == nil {
+		t.Error("Expected a varint for a string field to be rejected")
+	}
+	if err := decoded.Unmarshal([]byte{0x0a, 0x05, 'a'}); err == nil {
+		t.Error("Expected a truncated message to be rejected")
+	}
+}
+
+type fakeService struct {
+	Service
+}
+
+func (fakeService) GetJob(ctx context.Context, req *GetJobRequest) (*Job, error) {
+	if req.ID != "abc" {
+		return nil, Errorf(NotFound, "job %s not found", req.ID)
+	}
+	return &Job{ID: req.ID, Status: "processing"}, nil
+}
+
+func (fakeService) WatchJob(ctx context.Context, req *GetJobRequest, send func(*Job) error) error {
+	for _, p := range []float64{10, 50, 100} {
+		if err := send(&Job{ID: req.ID, Progress: p}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// call invokes a method and returns the response messages and the status
+func call(t *testing.T, client *http.Client, url, method string, req message) ([][]byte, string, string) {
+	t.Helper()
+	payload := req.Marshal()
+	frame := make([]byte, 5)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	httpReq, _ := http.NewRequest(http.MethodPost, url+"/"+ServiceName+"/"+method, bytes.NewReader(append(frame, payload...)))
+	httpReq.Header.Set("Content-Type", "application/grpc")
+	httpReq.Header.Set("Grpc-Timeout", "10S")
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("Expected a gRPC response over HTTP/2, got %s %s", resp.Proto, resp.Header.Get("Content-Type"))
+	}
+
+	var messages [][]byte
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(resp.Body, header[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		m := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(resp.Body, m); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, m)
+	}
+	return messages, resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+}
+
+func TestServer(t *testing.T) {
+	server := httptest.NewUnstartedServer(NewServer(fakeService{}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	client := server.Client()
+
+	messages, code, _ := call(t, client, server.URL, "GetJob", &GetJobRequest{ID: "abc"})
+	var job Job
+	if code != "0" || len(messages) != 1 || job.Unmarshal(messages[0]) != nil || job.Status != "processing" {
+		t.Fatalf("Expected the job with status 0, got %d messages and status %s", len(messages), code)
+	}
+
+	messages, code, msg := call(t, client, server.URL, "GetJob", &GetJobRequest{ID: "100% missing"})
+	if code != "5" || len(messages) != 0 || msg != "job 100%25 missing not found" {
+		t.Errorf("Expected NOT_FOUND with an encoded message, got %s %q", code, msg)
+	}
+
+	messages, code, _ = call(t, client, server.URL, "WatchJob", &GetJobRequest{ID: "abc"})
+	if code != "0" || len(messages) != 3 {
+		t.Fatalf("Expected 3 updates, got %d with status %s", len(messages), code)
+	}
+	job.Unmarshal(messages[2])
+	if job.Progress != 100 {
+		t.Errorf("Expected the last update at 100%%, got %v", job.Progress)
+	}
+
+	if _, code, _ := call(t, client, server.URL, "Rebuild", &GetJobRequest{}); code != "12" {
+		t.Errorf("Expected UNIMPLEMENTED for an unknown method, got %s", code)
+	}
+
+	// HTTP/1 clients are turned away
+	tlsConfig := client.Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	plain := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := plain.Post(server.URL+"/"+ServiceName+"/GetJob", "application/grpc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusHTTPVersionNotSupported {
+		t.Errorf("Expected HTTP/1 to be rejected, got %s", resp.Status)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	for value, ok := range map[string]bool{"30S": true, "500m": true, "1H": true, "S": false, "10x": false, "123456789S": false} {
+		if _, err := parseTimeout(value); (err == nil) != ok {
+			t.Errorf("parseTimeout(%q) error = %v", value, err)
+		}
+	}
+}
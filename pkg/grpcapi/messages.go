@@ -0,0 +1,460 @@
+package grpcapi
+
+// The messages of optimizer.proto. Field numbers must match the schema.
+
+// BrowseRequest lists a directory
+type BrowseRequest struct {
+	Path       string
+	Sort       string
+	Desc       bool
+	Extensions []string
+	Offset     int32
+	Limit      int32
+}
+
+func (m *BrowseRequest) Marshal() []byte {
+	var e encoder
+	e.string(1, m.Path)
+	e.string(2, m.Sort)
+	e.bool(3, m.Desc)
+	e.strings(4, m.Extensions)
+	e.int(5, int64(m.Offset))
+	e.int(6, int64(m.Limit))
+	return e.b
+}
+
+func (m *BrowseRequest) Unmarshal(b []byte) error {
+	return decode(b, func(field int, v value) error {
+		switch field {
+		case 1:
+			return v.setString(&m.Path)
+		case 2:
+			return v.setString(&m.Sort)
+		case 3:
+			return v.setBool(&m.Desc)
+		case 4:
+			return v.appendString(&m.Extensions)
+		case 5:
+			return v.setInt32(&m.Offset)
+		case 6:
+			return v.setInt32(&m.Limit)
+		}
+		return nil
+	})
+}
+
+// FileInfo is an entry of a directory
+type FileInfo struct {
+	Name        string
+	Path        string
+	IsDir       bool
+	Size        int64
+	ModTimeUnix int64
+	MediaType   string
+}
+
+func (m *FileInfo) Marshal() []byte {
+	var e encoder
+	e.string(1, m.Name)
+	e.string(2, m.Path)
+	e.bool(3, m.IsDir)
+	e.int(4, m.Size)
+	e.int(5, m.ModTimeUnix)
+	e.string(6, m.MediaType)
+	return e.b
+}
+
+func (m *FileInfo) Unmarshal(b []byte) error {
+	return decode(b, func(field int, v value) error {
+		switch field {
+		case 1:
+			return v.setString(&m.Name)
+		case 2:
+			return v.setString(&m.Path)
+		case 3:
+			return v.setBool(&m.IsDir)
+		case 4:
+			return v.setInt64(&m.Size)
+		case 5:
+			return v.setInt64(&m.ModTimeUnix)
+		case 6:
+			return v.setString(&m.MediaType)
+		}
+		return nil
+	})
+}
+
+// BrowseResponse is a page of a directory listing
+type BrowseResponse struct {
+	Path   string
+	Files  []*FileInfo
+	Total  int32
+	Offset int32
+	Limit  int32
+}
+
+func (m *BrowseResponse) Marshal() []byte {
+	var e encoder
+	e.string(1, m.Path)
+	for _, f := range m.Files {
+		e.message(2, f)
+	}
+	e.int(3, int64(m.Total))
+	e.int(4, int64(m.Offset))
+	e.int(5, int64(m.Limit))
+	return e.b
+}
+
+func (m *BrowseResponse) Unmarshal(b []byte) error {
+	return decode(b, func(field int, v value) error {
+		switch field {
+		case 1:
+			return v.setString(&m.Path)
+		case 2:
+			f := &FileInfo{}
+			m.Files = append(m.Files, f)
+			return v.message(f)
+		case 3:
+			return v.setInt32(&m.Total)
+		case 4:
+			return v.setInt32(&m.Offset)
+		case 5:
+			return v.setInt32(&m.Limit)
+		}
+		return nil
+	})
+}
+
+// ProbeRequest names the file to probe
+type ProbeRequest struct {
+	Path string
+}
+
+func (m *ProbeRequest) Marshal() []byte {
+	var e encoder
+	e.string(1, m.Path)
+	return e.b
+}
+
+func (m *ProbeRequest) Unmarshal(b []byte) error {
+	return decode(b, func(field int, v value) error {
+		if field == 1 {
+			return v.setString(&m.Path)
+		}
+		return nil
+	})
+}
+
+// Stream is a stream of a probed file
+type Stream struct {
+	Index     int32
+	CodecType string
+	CodecName string
+	Language  string
+	Width     int32
+	Height    int32
+	Channels  int32
+	BitRate   int64
+}
+
+func (m *Stream) Marshal() []byte {
+	var e encoder
+	e.int(1, int64(m.Index))
+	e.string(2, m.CodecType)
+	e.string(3, m.CodecName)
+	e.string(4, m.Language)
+	e.int(5, int64(m.Width))
+	e.int(6, int64(m.Height))
+	e.int(7, int64(m.Channels))
+	e.int(8, m.BitRate)
+	return e.b
+}
+
+func (m *Stream) Unmarshal(b []byte) error {
+	return decode(b, func(field int, v value) error {
+		switch field {
+		case 1:
+			return v.setInt32(&m.Index)
+		case 2:
+			return v.setString(&m.CodecType)
+		case 3:
+			return v.setString(&m.CodecName)
+		case 4:
+			return v.setString(&m.Language)
+		case 5:
+			return v.setInt32(&m.Width)
+		case 6:
+			return v.setInt32(&m.Height)
+		case 7:
+			return v.setInt32(&m.Channels)
+		case 8:
+			return v.setInt64(&m.BitRate)
+		}
+		return nil
+	})
+}
+
+// ProbeResponse describes the container and streams of a file
+type ProbeResponse struct {
+	FormatName      string
+	DurationSeconds float64
+	Size            int64
+	BitRate         int64
+	Streams         []*Stream
+}
+
+func (m *ProbeResponse) Marshal() []byte {
+	var e encoder
+	e.string(1, m.FormatName)
+	e.double(2, m.DurationSeconds)
+	e.int(3, m.Size)
+	e.int(4, m.BitRate)
+	for _, s := range m.Streams {
+		e.message(5, s)
+	}
+	return e.b
+}
+
+func (m *ProbeResponse) Unmarshal(b []byte) error {
+	return decode(b, func(field int, v value) error {
+		switch field {
+		case 1:
+			return v.setString(&m.FormatName)
+		case 2:
+			return v.setDouble(&m.DurationSeconds)
+		case 3:
+			return v.setInt64(&m.Size)
+		case 4:
+			return v.setInt64(&m.BitRate)
+		case 5:
+			s := &Stream{}
+			m.Streams = append(m.Streams, s)
+			return v.message(s)
+		}
+		return nil
+	})
+}
+
+// StartJobRequest queues a job like the optimize WebSocket message
+type StartJobRequest struct {
+	Path        string
+	Mode        string
+	Container   string
+	TargetSize  string
+	Profile     string
+	Packaging   string
+	ConfirmCost bool
+}
+
+func (m *StartJobRequest) Marshal() []byte {
+	var e encoder
+	e.string(1, m.Path)
+	e.string(2, m.Mode)
+	e.string(3, m.Container)
+	e.string(4, m.TargetSize)
+	e.string(5, m.Profile)
+	e.string(6, m.Packaging)
+	e.bool(7, m.ConfirmCost)
+	return e.b
+}
+
+func (m *StartJobRequest) Unmarshal(b []byte) error {
+	return decode(b, func(field int, v value) error {
+		switch field {
+		case 1:
+			return v.setString(&m.Path)
+		case 2:
+			return v.setString(&m.Mode)
+		case 3:
+			return v.setString(&m.Container)
+		case 4:
+			return v.setString(&m.TargetSize)
+		case 5:
+			return v.setString(&m.Profile)
+		case 6:
+			return v.setString(&m.Packaging)
+		case 7:
+			return v.setBool(&m.ConfirmCost)
+		}
+		return nil
+	})
+}
+
+// GetJobRequest names a job by its ID
+type GetJobRequest struct {
+	ID string
+}
+
+func (m *GetJobRequest) Marshal() []byte {
+	var e encoder
+	e.string(1, m.ID)
+	return e.b
+}
+
+func (m *GetJobRequest) Unmarshal(b []byte) error {
+	return decode(b, func(field int, v value) error {
+		if field == 1 {
+			return v.setString(&m.ID)
+		}
+		return nil
+	})
+}
+
+// Job is a job of the history, with its progress while it runs
+type Job struct {
+	ID             string
+	SourcePath     string
+	Kind           string
+	Status         string
+	Progress       float64
+	Error          string
+	Stage          string
+	Speed          float64
+	FPS            float64
+	ETASeconds     int32
+	ElapsedSeconds int32
+	Attempt        int32
+	OutputPath     string
+	InputBytes     int64
+	OutputBytes    int64
+	CreatedAtUnix  int64
+	FinishedAtUnix int64
+}
+
+func (m *Job) Marshal() []byte {
+	var e encoder
+	e.string(1, m.ID)
+	e.string(2, m.SourcePath)
+	e.string(3, m.Kind)
+	e.string(4, m.Status)
+	e.double(5, m.Progress)
+	e.string(6, m.Error)
+	e.string(7, m.Stage)
+	e.double(8, m.Speed)
+	e.double(9, m.FPS)
+	e.int(10, int64(m.ETASeconds))
+	e.int(11, int64(m.ElapsedSeconds))
+	e.int(12, int64(m.Attempt))
+	e.string(13, m.OutputPath)
+	e.int(14, m.InputBytes)
+	e.int(15, m.OutputBytes)
+	e.int(16, m.CreatedAtUnix)
+	e.int(17, m.FinishedAtUnix)
+	return e.b
+}
+
+func (m *Job) Unmarshal(b []byte) error {
+	return decode(b, func(field int, v value) error {
+		switch field {
+		case 1:
+			return v.setString(&m.ID)
+		case 2:
+			return v.setString(&m.SourcePath)
+		case 3:
+			return v.setString(&m.Kind)
+		case 4:
+			return v.setString(&m.Status)
+		case 5:
+			return v.setDouble(&m.Progress)
+		case 6:
+			return v.setString(&m.Error)
+		case 7:
+			return v.setString(&m.Stage)
+		case 8:
+			return v.setDouble(&m.Speed)
+		case 9:
+			return v.setDouble(&m.FPS)
+		case 10:
+			return v.setInt32(&m.ETASeconds)
+		case 11:
+			return v.setInt32(&m.ElapsedSeconds)
+		case 12:
+			return v.setInt32(&m.Attempt)
+		case 13:
+			return v.setString(&m.OutputPath)
+		case 14:
+			return v.setInt64(&m.InputBytes)
+		case 15:
+			return v.setInt64(&m.OutputBytes)
+		case 16:
+			return v.setInt64(&m.CreatedAtUnix)
+		case 17:
+			return v.setInt64(&m.FinishedAtUnix)
+		}
+		return nil
+	})
+}
+
+// ListJobsRequest selects a page of the job history
+type ListJobsRequest struct {
+	Status string
+	Kind   string
+	Path   string
+	Since  string
+	Until  string
+	Cursor string
+	Limit  int32
+}
+
+func (m *ListJobsRequest) Marshal() []byte {
+	var e encoder
+	e.string(1, m.Status)
+	e.string(2, m.Kind)
+	e.string(3, m.Path)
+	e.string(4, m.Since)
+	e.string(5, m.Until)
+	e.string(6, m.Cursor)
+	e.int(7, int64(m.Limit))
+	return e.b
+}
+
+func (m *ListJobsRequest) Unmarshal(b []byte) error {
+	return decode(b, func(field int, v value) error {
+		switch field {
+		case 1:
+			return v.setString(&m.Status)
+		case 2:
+			return v.setString(&m.Kind)
+		case 3:
+			return v.setString(&m.Path)
+		case 4:
+			return v.setString(&m.Since)
+		case 5:
+			return v.setString(&m.Until)
+		case 6:
+			return v.setString(&m.Cursor)
+		case 7:
+			return v.setInt32(&m.Limit)
+		}
+		return nil
+	})
+}
+
+// ListJobsResponse is a page of the job history
+type ListJobsResponse struct {
+	Jobs       []*Job
+	NextCursor string
+}
+
+func (m *ListJobsResponse) Marshal() []byte {
+	var e encoder
+	for _, j := range m.Jobs {
+		e.message(1, j)
+	}
+	e.string(2, m.NextCursor)
+	return e.b
+}
+
+func (m *ListJobsResponse) Unmarshal(b []byte) error {
+	return decode(b, func(field int, v value) error {
+		switch field {
+		case 1:
+			j := &Job{}
+			m.Jobs = append(m.Jobs, j)
+			return v.message(j)
+		case 2:
+			return v.setString(&m.NextCursor)
+		}
+		return nil
+	})
+}
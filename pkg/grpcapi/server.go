@@ -0,0 +1,260 @@
+// Package grpcapi serves the optimizer's API over gRPC. The gRPC libraries
+// aren't used: the protocol is implemented on top of net/http's HTTP/2
+// support, with the messages of optimizer.proto encoded in messages.go.
+// Clients are generated from optimizer.proto as usual.
+package grpcapi
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServiceName is the fully qualified name of the Optimizer service
+const ServiceName = "mediaoptimizer.v1.Optimizer"
+
+// maxMessageSize bounds a request message
+const maxMessageSize = 4 << 20
+
+// Code is a gRPC status code
+type Code int
+
+// Status codes used by the API
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	AlreadyExists      Code = 6
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+)
+
+// Error is a failed call with its status code. Other errors returned by a
+// Service are sent with the code Unknown.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("grpc: %s (code %d)", e.Message, e.Code)
+}
+
+// Errorf returns an *Error with the code and a formatted message
+func Errorf(code Code, format string, args ...interface{}) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Service implements the Optimizer service
+type Service interface {
+	Browse(ctx context.Context, req *BrowseRequest) (*BrowseResponse, error)
+	Probe(ctx context.Context, req *ProbeRequest) (*ProbeResponse, error)
+	StartJob(ctx context.Context, req *StartJobRequest) (*Job, error)
+	GetJob(ctx context.Context, req *GetJobRequest) (*Job, error)
+	ListJobs(ctx context.Context, req *ListJobsRequest) (*ListJobsResponse, error)
+	// WatchJob calls send with each state of the job until it finishes,
+	// the client goes away or send fails
+	WatchJob(ctx context.Context, req *GetJobRequest, send func(*Job) error) error
+}
+
+type message interface {
+	Marshal() []byte
+}
+
+type server struct {
+	svc Service
+}
+
+// NewServer returns a handler serving svc to gRPC clients. gRPC runs over
+// HTTP/2, which net/http only offers over TLS.
+func NewServer(svc Service) http.Handler {
+	return &server{svc: svc}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && !strings.HasPrefix(ct, "application/grpc+proto") && !strings.HasPrefix(ct, "application/grpc;") {
+		http.Error(w, "unsupported content type "+ct, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	ctx := r.Context()
+	if value := r.Header.Get("Grpc-Timeout"); value != "" {
+		timeout, err := parseTimeout(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	err := s.call(ctx, w, r)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	code, msg := status(err)
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(code)))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", encodeMessage(msg))
+	}
+}
+
+// call reads the request of the method named in the path, runs it and
+// writes its response
+func (s *server) call(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	method, ok := strings.CutPrefix(r.URL.Path, "/"+ServiceName+"/")
+	if !ok {
+		return Errorf(Unimplemented, "unknown service in %s", r.URL.Path)
+	}
+	switch method {
+	case "Browse":
+		req := &BrowseRequest{}
+		return unary(w, r, req, func() (message, error) { return s.svc.Browse(ctx, req) })
+	case "Probe":
+		req := &ProbeRequest{}
+		return unary(w, r, req, func() (message, error) { return s.svc.Probe(ctx, req) })
+	case "StartJob":
+		req := &StartJobRequest{}
+		return unary(w, r, req, func() (message, error) { return s.svc.StartJob(ctx, req) })
+	case "GetJob":
+		req := &GetJobRequest{}
+		return unary(w, r, req, func() (message, error) { return s.svc.GetJob(ctx, req) })
+	case "ListJobs":
+		req := &ListJobsRequest{}
+		return unary(w, r, req, func() (message, error) { return s.svc.ListJobs(ctx, req) })
+	case "WatchJob":
+		req := &GetJobRequest{}
+		if err := readMessage(r.Body, req); err != nil {
+			return err
+		}
+		return s.svc.WatchJob(ctx, req, func(job *Job) error {
+			return writeMessage(w, job)
+		})
+	}
+	return Errorf(Unimplemented, "unknown method %s", method)
+}
+
+// unary reads req, runs fn and writes its response
+func unary(w http.ResponseWriter, r *http.Request, req interface{ Unmarshal([]byte) error }, fn func() (message, error)) error {
+	if err := readMessage(r.Body, req); err != nil {
+		return err
+	}
+	resp, err := fn()
+	if err != nil {
+		return err
+	}
+	return writeMessage(w, resp)
+}
+
+// readMessage reads a length-prefixed message from the request body
+func readMessage(body io.Reader, m interface{ Unmarshal([]byte) error }) error {
+	var header [5]byte
+	if _, err := io.ReadFull(body, header[:]); err != nil {
+		return Errorf(InvalidArgument, "missing request message: %v", err)
+	}
+	if header[0] != 0 {
+		return Errorf(Unimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxMessageSize {
+		return Errorf(ResourceExhausted, "request message of %d bytes exceeds %d", size, maxMessageSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(body, payload); err != nil {
+		return Errorf(InvalidArgument, "truncated request message: %v", err)
+	}
+	if err := m.Unmarshal(payload); err != nil {
+		return Errorf(InvalidArgument, "invalid request message: %v", err)
+	}
+	return nil
+}
+
+// writeMessage writes a length-prefixed message and sends it right away
+func writeMessage(w http.ResponseWriter, m message) error {
+	payload := m.Marshal()
+	frame := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	if _, err := w.Write(append(frame, payload...)); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// status returns the status code and message of a call's error
+func status(err error) (Code, string) {
+	var rpcErr *Error
+	switch {
+	case err == nil:
+		return OK, ""
+	case errors.As(err, &rpcErr):
+		return rpcErr.Code, rpcErr.Message
+	case errors.Is(err, context.DeadlineExceeded):
+		return DeadlineExceeded, err.Error()
+	case errors.Is(err, context.Canceled):
+		return Canceled, err.Error()
+	}
+	return Unknown, err.Error()
+}
+
+// parseTimeout parses a grpc-timeout header, e.g. "30S" or "500m"
+func parseTimeout(value string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	if len(value) < 2 || len(value) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+	unit, ok := units[value[len(value)-1]]
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// encodeMessage percent-encodes a status message for the grpc-message
+// trailer
+func encodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,200 @@
+package grpcapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("protobuf: truncated message")
+
+// encoder appends the fields of a protobuf message. Scalars with their zero
+// value are left out, as proto3 does.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) tag(field, wire int) {
+	e.b = binary.AppendUvarint(e.b, uint64(field)<<3|uint64(wire))
+}
+
+func (e *encoder) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) strings(field int, values []string) {
+	for _, s := range values {
+		// Repeated elements are written even when empty
+		e.tag(field, wireBytes)
+		e.b = binary.AppendUvarint(e.b, uint64(len(s)))
+		e.b = append(e.b, s...)
+	}
+}
+
+// int writes an int32 or int64 field; negative values take ten bytes
+func (e *encoder) int(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.b = binary.AppendUvarint(e.b, uint64(v))
+}
+
+func (e *encoder) bool(field int, v bool) {
+	if v {
+		e.tag(field, wireVarint)
+		e.b = append(e.b, 1)
+	}
+}
+
+func (e *encoder) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireFixed64)
+	e.b = binary.LittleEndian.AppendUint64(e.b, math.Float64bits(v))
+}
+
+// message writes an embedded message, which is always written so that
+// repeated elements keep their position
+func (e *encoder) message(field int, m interface{ Marshal() []byte }) {
+	b := m.Marshal()
+	e.tag(field, wireBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// value is a decoded field
+type value struct {
+	wire  int
+	n     uint64 // varint and fixed values
+	bytes []byte // length-delimited values
+}
+
+// The setters store a field's value after checking its wire type, so that
+// a client built from a different version of the schema fails instead of
+// reading garbage
+
+func (v value) setString(dst *string) error {
+	if err := v.expect(wireBytes); err != nil {
+		return err
+	}
+	*dst = string(v.bytes)
+	return nil
+}
+
+func (v value) appendString(dst *[]string) error {
+	if err := v.expect(wireBytes); err != nil {
+		return err
+	}
+	*dst = append(*dst, string(v.bytes))
+	return nil
+}
+
+func (v value) setInt32(dst *int32) error {
+	if err := v.expect(wireVarint); err != nil {
+		return err
+	}
+	*dst = int32(v.n)
+	return nil
+}
+
+func (v value) setInt64(dst *int64) error {
+	if err := v.expect(wireVarint); err != nil {
+		return err
+	}
+	*dst = int64(v.n)
+	return nil
+}
+
+func (v value) setBool(dst *bool) error {
+	if err := v.expect(wireVarint); err != nil {
+		return err
+	}
+	*dst = v.n != 0
+	return nil
+}
+
+func (v value) setDouble(dst *float64) error {
+	if err := v.expect(wireFixed64); err != nil {
+		return err
+	}
+	*dst = math.Float64frombits(v.n)
+	return nil
+}
+
+// message decodes an embedded message into m
+func (v value) message(m interface{ Unmarshal([]byte) error }) error {
+	if err := v.expect(wireBytes); err != nil {
+		return err
+	}
+	return m.Unmarshal(v.bytes)
+}
+
+func (v value) expect(wire int) error {
+	if v.wire != wire {
+		return fmt.Errorf("protobuf: wire type %d, want %d", v.wire, wire)
+	}
+	return nil
+}
+
+// decode calls fn with each field of the message in b. Groups aren't
+// supported; they are deprecated and unused by this API.
+func decode(b []byte, fn func(field int, v value) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+		field, wire := int(key>>3), int(key&7)
+		if field == 0 {
+			return errors.New("protobuf: invalid field number 0")
+		}
+
+		v := value{wire: wire}
+		switch wire {
+		case wireVarint:
+			if v.n, n = binary.Uvarint(b); n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			v.n, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			v.n, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return errTruncated
+			}
+			v.bytes, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type %d", wire)
+		}
+		if err := fn(field, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
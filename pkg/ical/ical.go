@@ -0,0 +1,87 @@
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// maxLineOctets is the RFC 5545 limit for content lines before folding
+const maxLineOctets = 75
+
+const timeFormat = "20060102T150405Z"
+
+// Event is a single VEVENT entry
+type Event struct {
+	UID         string
+	Summary     string
+	Description string
+	Start       time.Time
+	End         time.Time
+}
+
+// Write renders the events as an iCalendar (RFC 5545) document
+func Write(w io.Writer, name string, events []Event) error {
+	bw := bufio.NewWriter(w)
+	line := func(s string) {
+		bw.WriteString(fold(s))
+		bw.WriteString("\r\n")
+	}
+
+	now := time.Now().UTC().Format(timeFormat)
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//media_optimizer//EN")
+	line("CALSCALE:GREGORIAN")
+	line("X-WR-CALNAME:" + escape(name))
+	for _, e := range events {
+		line("BEGIN:VEVENT")
+		line("UID:" + escape(e.UID))
+		line("DTSTAMP:" + now)
+		line("DTSTART:" + e.Start.UTC().Format(timeFormat))
+		line("DTEND:" + e.End.UTC().Format(timeFormat))
+		line("SUMMARY:" + escape(e.Summary))
+		if e.Description != "" {
+			line("DESCRIPTION:" + escape(e.Description))
+		}
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return bw.Flush()
+}
+
+// escape encodes TEXT values per RFC 5545 section 3.3.11
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// fold splits lines longer than 75 octets, continuing with a leading space,
+// without breaking UTF-8 sequences
+func fold(s string) string {
+	if len(s) <= maxLineOctets {
+		return s
+	}
+
+	var b strings.Builder
+	limit := maxLineOctets
+	width := 0
+	for _, r := range s {
+		n := len(string(r))
+		if width+n > limit {
+			b.WriteString("\r\n ")
+			width = 0
+			// Continuation lines lose one octet to the leading space
+			limit = maxLineOctets - 1
+		}
+		b.WriteRune(r)
+		width += n
+	}
+	return b.String()
+}
+
+// UID builds a globally unique identifier for an event
+func UID(kind, id string) string {
+	return fmt.Sprintf("%s-%s@media-optimizer", kind, id)
+}
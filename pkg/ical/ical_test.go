@@ -0,0 +1,45 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := []Event{{
+		UID:     UID("job", "1"),
+		Summary: "Optimizing movie, part 1; extended",
+		Start:   start,
+		End:     start.Add(time.Hour),
+	}}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, "Media Optimizer", events); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	out := buf.String()
+
+	for _, expected := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"DTSTART:20240102T030405Z\r\n",
+		"DTEND:20240102T040405Z\r\n",
+		`SUMMARY:Optimizing movie\, part 1\; extended`,
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	long := "DESCRIPTION:" + strings.Repeat("é", 60)
+	for i, line := range strings.Split(fold(long), "\r\n") {
+		if len(line) > maxLineOctets {
+			t.Errorf("Line %d is %d octets, longer than %d", i, len(line), maxLineOctets)
+		}
+	}
+}
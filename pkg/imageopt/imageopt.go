@@ -0,0 +1,230 @@
+package imageopt
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"media_optimizer/pkg/exclude"
+	"media_optimizer/pkg/mediapath"
+)
+
+// Supported output formats
+const (
+	FormatWebP = "webp"
+	FormatAVIF = "avif"
+)
+
+// defaultWorkers is the number of images encoded concurrently
+const defaultWorkers = 4
+
+// Extensions lists the image types accepted for recompression
+var Extensions = []string{".jpg", ".jpeg", ".png"}
+
+type ProgressCallback func(float64)
+
+// Params configures an image optimization run
+type Params struct {
+	// Input is a single image or a directory searched recursively
+	Input string
+	// Format is FormatWebP or FormatAVIF
+	Format string
+	// Quality ranges from 0 (smallest) to 100 (best)
+	Quality    int
+	Workers    int
+	OnProgress ProgressCallback
+	// Exclude leaves out the files and directories it excludes when
+	// searching a directory
+	Exclude *exclude.Rules
+	// NameForm is the Unicode normalization form of output names, a
+	// mediapath form; empty keeps the spelling of the sources'
+	NameForm string
+}
+
+// Result summarises an image optimization run
+type Result struct {
+	Success     bool
+	Message     string
+	Error       error
+	Processed   int
+	Failed      int
+	InputBytes  int64
+	OutputBytes int64
+	// Outputs are the files written, sorted
+	Outputs []string
+}
+
+// NewDefaultParams creates default image optimization parameters
+func NewDefaultParams(input string) *Params {
+	return &Params{
+		Input:   input,
+		Format:  FormatWebP,
+		Quality: 80,
+		Workers: defaultWorkers,
+	}
+}
+
+// IsImage reports whether path has a supported image extension
+func IsImage(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// OutputPath returns the destination for an image in the format of params
+func OutputPath(params *Params, input string) string {
+	return mediapath.NormalizeName(strings.TrimSuffix(input, filepath.Ext(input))+"_optimized."+params.Format, params.NameForm)
+}
+
+// OptimizeImages recompresses one image or every image below a directory
+func OptimizeImages(params *Params) Result {
+	if params.Format != FormatWebP && params.Format != FormatAVIF {
+		return Result{Error: fmt.Errorf("unsupported image format: %s", params.Format)}
+	}
+
+	images, err := collect(params.Input, params.Exclude)
+	if err != nil {
+		return Result{Error: err}
+	}
+	if len(images) == 0 {
+		return Result{Error: fmt.Errorf("no images found in %s", params.Input)}
+	}
+
+	workers := params.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	var (
+		mu     sync.Mutex
+		result Result
+		done   int
+		wg     sync.WaitGroup
+	)
+	next := make(chan string)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for input := range next {
+				inSize, outSize, err := encode(input, params)
+
+				mu.Lock()
+				done++
+				if err != nil {
+					result.Failed++
+					log.Printf("Image optimization failed for %s: %v", input, err)
+				} else {
+					result.Processed++
+					result.InputBytes += inSize
+					result.OutputBytes += outSize
+					result.Outputs = append(result.Outputs, OutputPath(params, input))
+				}
+				progress := float64(done) / float64(len(images)) * 100
+				mu.Unlock()
+
+				if params.OnProgress != nil {
+					params.OnProgress(progress)
+				}
+			}
+		}()
+	}
+	for _, img := range images {
+		next <- img
+	}
+	close(next)
+	wg.Wait()
+
+	sort.Strings(result.Outputs)
+	result.Success = result.Failed == 0
+	result.Message = fmt.Sprintf("Optimized %d of %d images to %s (%d → %d bytes)",
+		result.Processed, len(images), params.Format, result.InputBytes, result.OutputBytes)
+	if !result.Success {
+		result.Error = fmt.Errorf("%d of %d images failed", result.Failed, len(images))
+	}
+	return result
+}
+
+// collect returns the input itself or every image found below it
+func collect(input string, rules *exclude.Rules) ([]string, error) {
+	info, err := os.Stat(input)
+	if err != nil {
+		return nil, fmt.Errorf("input does not exist: %s", input)
+	}
+	if !info.IsDir() {
+		if !IsImage(input) {
+			return nil, fmt.Errorf("not a supported image: %s", input)
+		}
+		return []string{input}, nil
+	}
+
+	var images []string
+	err = filepath.WalkDir(input, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && rules.SkipDir(path) {
+			return fs.SkipDir
+		}
+		if rules.Matches(path) {
+			return nil
+		}
+		// Skip outputs of earlier runs
+		if !d.IsDir() && IsImage(path) && !strings.Contains(filepath.Base(path), "_optimized.") {
+			images = append(images, path)
+		}
+		return nil
+	})
+	return images, err
+}
+
+// encode converts a single image and returns the input and output sizes
+func encode(input string, params *Params) (int64, int64, error) {
+	info, err := os.Stat(input)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	output := OutputPath(params, input)
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", input}
+	args = append(args, encoderArgs(params.Format, params.Quality)...)
+	args = append(args, output)
+
+	if out, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+		os.Remove(output)
+		return 0, 0, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	outInfo, err := os.Stat(output)
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.Size(), outInfo.Size(), nil
+}
+
+// encoderArgs maps the 0-100 quality scale onto each encoder's own setting
+func encoderArgs(format string, quality int) []string {
+	if quality < 0 {
+		quality = 0
+	} else if quality > 100 {
+		quality = 100
+	}
+
+	if format == FormatAVIF {
+		// libaom CRF runs from 63 (worst) to 0 (lossless)
+		crf := 63 - quality*63/100
+		return []string{"-c:v", "libaom-av1", "-still-picture", "1", "-crf", strconv.Itoa(crf), "-b:v", "0"}
+	}
+	return []string{"-c:v", "libwebp", "-quality", strconv.Itoa(quality)}
+}
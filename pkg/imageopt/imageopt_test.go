@@ -0,0 +1,47 @@
+package imageopt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCollect(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.jpg", "b.PNG", "c.txt", "d_optimized.webp", "e_optimized.jpg", "sub/f.jpeg"} {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	images, err := collect(root, nil)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	if len(images) != 3 {
+		t.Errorf("Expected 3 images, got %v", images)
+	}
+
+	if _, err := collect(filepath.Join(root, "c.txt"), nil); err == nil {
+		t.Error("Expected error for non-image file")
+	}
+}
+
+func TestEncoderArgs(t *testing.T) {
+	if args := encoderArgs(FormatAVIF, 100); args[5] != "0" {
+		t.Errorf("Expected CRF 0 at quality 100, got %v", args)
+	}
+	if args := encoderArgs(FormatWebP, 150); args[3] != "100" {
+		t.Errorf("Expected quality clamped to 100, got %v", args)
+	}
+	params := NewDefaultParams("/p")
+	if got := OutputPath(params, "/p/pic.jpg"); got != "/p/pic_optimized.webp" {
+		t.Errorf("Unexpected output path %s", got)
+	}
+	params.NameForm = "nfc"
+	if got := OutputPath(params, "/Cafe\u0301/Cafe\u0301 l'été.jpg"); got != "/Cafe\u0301/Café l'été_optimized.webp" {
+		t.Errorf("Expected the name composed, got %s", got)
+	}
+}
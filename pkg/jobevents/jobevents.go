@@ -0,0 +1,137 @@
+// Package jobevents keeps an append-only audit trail of what happened to
+// each job: who or what created it, when it started, the stages it went
+// through, retries, cancellations and replaced originals. Events are
+// appended to one file, one JSON event per line, and never rewritten.
+package jobevents
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Types of events
+const (
+	// TypeCreated is the job being queued, with its origin as detail
+	TypeCreated = "created"
+	// TypeStarted is a run of the job starting, once per attempt
+	TypeStarted = "started"
+	// TypeStage is the job entering a stage of its pipeline
+	TypeStage = "stage"
+	// TypeRetry is a transient failure the job is run again after
+	TypeRetry = "retry"
+	// TypeCancelled is a user cancelling the job
+	TypeCancelled = "cancelled"
+	// TypeReplacedOriginal is the output taking the place of the source
+	TypeReplacedOriginal = "replaced-original"
+	// TypeFinished is the job ending, with its status as detail
+	TypeFinished = "finished"
+	// TypeUndone is a user restoring the original the job replaced
+	TypeUndone = "undone"
+	// TypePostAction is a watch folder recipe moving the output or the
+	// source of a completed job, described by the detail
+	TypePostAction = "post-action"
+	// TypeQuarantined is the output failing verification and being kept for
+	// review, with where it is kept as detail
+	TypeQuarantined = "quarantined"
+	// TypeApproved is a user putting a quarantined output in place
+	TypeApproved = "approved"
+	// TypeDiscarded is a user deleting a quarantined output
+	TypeDiscarded = "discarded"
+)
+
+// maxLine caps the length of an event line read back
+const maxLine = 1 << 20
+
+// Event is one entry of a job's audit trail
+type Event struct {
+	Time  time.Time `json:"time"`
+	JobID string    `json:"jobId"`
+	Type  string    `json:"type"`
+	// User is the login that caused the event, if any
+	User   string `json:"user,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Log appends events to a file and indexes them by job. It is safe for
+// concurrent use.
+type Log struct {
+	mu     sync.RWMutex
+	file   *os.File
+	enc    *json.Encoder
+	events map[string][]Event
+}
+
+// Open loads the events in the file at path and appends new ones to it,
+// creating it if needed. Lines that can't be decoded, such as one cut short
+// by a crash, are skipped.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create event log directory: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log: %v", err)
+	}
+
+	l := &Log{file: f, enc: json.NewEncoder(f), events: make(map[string][]Event)}
+	reader := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// End the partial line so the next event starts its own
+				if _, err := f.WriteString("\n"); err != nil {
+					f.Close()
+					return nil, fmt.Errorf("failed to repair event log %s: %v", path, err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read event log %s: %v", path, err)
+		}
+		if len(line) > maxLine {
+			continue
+		}
+		var e Event
+		if json.Unmarshal(line, &e) == nil && e.JobID != "" {
+			l.events[e.JobID] = append(l.events[e.JobID], e)
+		}
+	}
+	return l, nil
+}
+
+// Add appends an event, stamped with the current time when it has none
+func (l *Log) Add(e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(e); err != nil {
+		return fmt.Errorf("failed to write event: %v", err)
+	}
+	l.events[e.JobID] = append(l.events[e.JobID], e)
+	return nil
+}
+
+// Events returns the events of a job, oldest first
+func (l *Log) Events(jobID string) []Event {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]Event{}, l.events[jobID]...)
+}
+
+// Close closes the file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,51 @@
+package jobevents
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	l.Add(Event{JobID: "a", Type: TypeCreated, User: "alice", Detail: "api"})
+	l.Add(Event{JobID: "b", Type: TypeCreated})
+	l.Add(Event{JobID: "a", Type: TypeStage, Detail: "encode"})
+
+	events := l.Events("a")
+	if len(events) != 2 || events[0].Type != TypeCreated || events[1].Detail != "encode" {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+	if events[0].Time.IsZero() {
+		t.Error("Expected the event to be stamped")
+	}
+	if len(l.Events("missing")) != 0 {
+		t.Error("Expected no events of an unknown job")
+	}
+	l.Close()
+
+	// A line cut short by a crash is skipped and doesn't swallow the next
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"jobId":"a","type":"fin`)
+	f.Close()
+	l, err = Open(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	l.Add(Event{JobID: "a", Type: TypeFinished, Detail: "completed"})
+	l.Close()
+
+	l, err = Open(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer l.Close()
+	events = l.Events("a")
+	if len(events) != 3 || events[2].Type != TypeFinished {
+		t.Errorf("Expected the events to survive a reopen, got %+v", events)
+	}
+}
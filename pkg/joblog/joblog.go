@@ -0,0 +1,129 @@
+// Package joblog keeps the output of each job in its own log file, one JSON
+// entry per line, so a job's ffmpeg output can be read back on its own.
+package joblog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Streams an entry can come from
+const (
+	StreamInfo   = "info"
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// maxLine caps the length of a single read-back line
+const maxLine = 1 << 20
+
+// Entry is one line of job output
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Line   string    `json:"line"`
+}
+
+// Path returns the log file of job id in dir
+func Path(dir, id string) string {
+	return filepath.Join(dir, id+".log")
+}
+
+// Log appends entries to a job's log file. It is safe for concurrent use.
+type Log struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// Open creates or appends to the log of job id in dir
+func Open(dir, id string) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+	f, err := os.OpenFile(Path(dir, id), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job log: %v", err)
+	}
+	return &Log{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write records one line from stream. Errors are ignored: losing log output
+// must never fail a job.
+func (l *Log) Write(stream, line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(Entry{Time: time.Now(), Stream: stream, Line: line})
+}
+
+// Printf records an informational line
+func (l *Log) Printf(format string, v ...interface{}) {
+	l.Write(StreamInfo, fmt.Sprintf(format, v...))
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Tail returns the last n entries of the log at path, all of them when n is
+// not positive, and the offset just past the last complete line read
+func Tail(path string, n int) ([]Entry, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	entries, offset, err := read(f, 0)
+	if n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, offset, err
+}
+
+// ReadFrom returns the complete entries after offset in the log at path and
+// the offset to continue from
+func ReadFrom(path string, offset int64) ([]Entry, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, offset, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+	return read(f, offset)
+}
+
+// read decodes whole lines from r. A trailing partial line, still being
+// written, is left for the next read.
+func read(r io.Reader, offset int64) ([]Entry, int64, error) {
+	var entries []Entry
+	reader := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return entries, offset, nil
+		}
+		if err != nil {
+			return entries, offset, err
+		}
+		offset += int64(len(line))
+		if len(line) > maxLine {
+			continue
+		}
+		var e Entry
+		if json.Unmarshal(line, &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package joblog
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLogTailAndFollow(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, "abc")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer l.Close()
+
+	l.Printf("starting %s", "job")
+	l.Write(StreamStdout, "frame=1")
+	l.Write(StreamStderr, "warning")
+
+	entries, offset, err := Tail(Path(dir, "abc"), 2)
+	if err != nil {
+		t.Fatalf("Tail failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Stream != StreamStdout || entries[1].Line != "warning" {
+		t.Errorf("Unexpected tail %+v", entries)
+	}
+
+	// A partial line is left until it is complete
+	f, _ := os.OpenFile(Path(dir, "abc"), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"stream":"stdout","line":"par`)
+	more, next, err := ReadFrom(Path(dir, "abc"), offset)
+	if err != nil || len(more) != 0 || next != offset {
+		t.Errorf("Expected nothing new, got %+v at %d (%v)", more, next, err)
+	}
+	f.WriteString("tial\"}\n")
+	f.Close()
+	more, _, err = ReadFrom(Path(dir, "abc"), offset)
+	if err != nil || len(more) != 1 || more[0].Line != "partial" {
+		t.Errorf("Expected the completed line, got %+v (%v)", more, err)
+	}
+}
@@ -0,0 +1,327 @@
+package jobstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"media_optimizer/pkg/uuid"
+)
+
+// Quality holds the result of the post-encode quality verification
+type Quality struct {
+	Metric    string  `json:"metric"`
+	Score     float64 `json:"score"`
+	Threshold float64 `json:"threshold"`
+	Passed    bool    `json:"passed"`
+}
+
+// Source describes the probed attributes of a job's input
+type Source struct {
+	Container   string   `json:"container,omitempty"`
+	VideoCodec  string   `json:"videoCodec,omitempty"`
+	AudioCodecs []string `json:"audioCodecs,omitempty"`
+	Width       int      `json:"width,omitempty"`
+	Height      int      `json:"height,omitempty"`
+	HDR         string   `json:"hdr,omitempty"`
+}
+
+// Segment is a black or silent stretch found in the source
+type Segment struct {
+	Kind     string  `json:"kind"`
+	Start    float64 `json:"start"`
+	End      float64 `json:"end"`
+	Duration float64 `json:"duration"`
+}
+
+// Crop is the area of the source's frame kept in the output
+type Crop struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	X      int `json:"x"`
+	Y      int `json:"y"`
+}
+
+// Rendition is one output file of a ladder job
+type Rendition struct {
+	Name        string `json:"name"`
+	Height      int    `json:"height"`
+	OutputPath  string `json:"outputPath"`
+	OutputBytes int64  `json:"outputBytes"`
+	SHA256      string `json:"sha256,omitempty"`
+}
+
+// Record is the persisted history entry for a single optimization job
+type Record struct {
+	ID         string `json:"id"`
+	SourcePath string `json:"sourcePath"`
+	Kind       string `json:"kind,omitempty"`
+	Profile    string `json:"profile,omitempty"`
+	// User started the job, empty without configured users or for jobs
+	// started by the server itself
+	User string `json:"user,omitempty"`
+	// Library is the media root containing the source, if any
+	Library    string    `json:"library,omitempty"`
+	OutputPath string    `json:"outputPath,omitempty"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Flagged    bool      `json:"flagged,omitempty"`
+	Warnings   []string  `json:"warnings,omitempty"`
+	Quality    *Quality  `json:"quality,omitempty"`
+	Source     *Source   `json:"source,omitempty"`
+	Segments   []Segment `json:"segments,omitempty"`
+	// Crop is set when black bars were cropped from the video
+	Crop *Crop `json:"crop,omitempty"`
+	// Renditions lists the completed outputs of a ladder job, whose
+	// OutputPath is their directory
+	Renditions []Rendition `json:"renditions,omitempty"`
+	// Outputs lists the files written by image and music jobs on folders,
+	// which have no OutputPath
+	Outputs []string `json:"outputs,omitempty"`
+	// InputBytes and OutputBytes are the sizes of the processed files
+	InputBytes  int64 `json:"inputBytes,omitempty"`
+	OutputBytes int64 `json:"outputBytes,omitempty"`
+	// InputSHA256 and OutputSHA256 are the checksums of the processed files
+	InputSHA256  string `json:"inputSha256,omitempty"`
+	OutputSHA256 string `json:"outputSha256,omitempty"`
+	// Corrupted is set when a verification scan found that an output no
+	// longer matches its checksum
+	Corrupted bool `json:"corrupted,omitempty"`
+	// Cost is the estimated charge of a job run on a billed backend
+	Cost float64 `json:"cost,omitempty"`
+	// ReplacedOriginal is set when the output took the place of the source,
+	// which was moved to the trash under the record's ID
+	ReplacedOriginal bool `json:"replacedOriginal,omitempty"`
+	// UndoneAt is when the original was restored, leaving status "undone"
+	UndoneAt time.Time `json:"undoneAt,omitempty"`
+	// ReviewedAt is when a quarantined output was approved, leaving status
+	// "completed", or discarded, leaving status "discarded"
+	ReviewedAt time.Time `json:"reviewedAt,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	StartedAt  time.Time `json:"startedAt,omitempty"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+}
+
+// Query selects a page of records, newest first. Zero values disable a filter.
+type Query struct {
+	// Status keeps records in any of the listed states
+	Status []string
+	Kind   string
+	// PathPrefix keeps records whose source path starts with it
+	PathPrefix string
+	// Since and Until bound the creation time (inclusive, exclusive)
+	Since time.Time
+	Until time.Time
+	// Cursor continues after the record with this ID
+	Cursor string
+	Limit  int
+}
+
+// Page is one page of query results
+type Page struct {
+	Records []Record `json:"records"`
+	// NextCursor is set when more records match the query
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// Store keeps job records in memory and persists them to a JSON file
+type Store struct {
+	mu      sync.RWMutex
+	path    string
+	records map[string]*Record
+}
+
+// Open loads the store from path, starting empty if the file does not exist
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		records: make(map[string]*Record),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job store %s: %v", path, err)
+	}
+
+	var records []*Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse job store %s: %v", path, err)
+	}
+	for _, r := range records {
+		s.records[r.ID] = r
+	}
+	return s, nil
+}
+
+// Create adds a new queued record for sourcePath and returns a copy of it.
+// The record is dropped again if it can't be saved.
+func (s *Store) Create(sourcePath, kind string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := &Record{
+		ID:         s.newID(),
+		SourcePath: sourcePath,
+		Kind:       kind,
+		Status:     "queued",
+		CreatedAt:  time.Now(),
+	}
+	s.records[r.ID] = r
+	if err := s.save(); err != nil {
+		delete(s.records, r.ID)
+		return Record{}, err
+	}
+	return *r, nil
+}
+
+// Update applies fn to the record with the given ID and persists the change
+func (s *Store) Update(id string, fn func(*Record)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[id]
+	if !ok {
+		return fmt.Errorf("job %s not found", id)
+	}
+	fn(r)
+	return s.save()
+}
+
+// Get returns a copy of the record with the given ID
+func (s *Store) Get(id string) (Record, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.records[id]
+	if !ok {
+		return Record{}, false
+	}
+	return *r, true
+}
+
+// List returns copies of all records, newest first
+func (s *Store) List() []Record {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.sorted()
+}
+
+// Query returns the records matching q, newest first. The cursor continues
+// after the position of its record, so it stays valid while new jobs are
+// created.
+func (s *Store) Query(q Query) (Page, error) {
+	s.mu.RLock()
+	records := s.sorted()
+	var after *Record
+	if q.Cursor != "" {
+		r, ok := s.records[q.Cursor]
+		if !ok {
+			s.mu.RUnlock()
+			return Page{}, fmt.Errorf("invalid cursor %q", q.Cursor)
+		}
+		copied := *r
+		after = &copied
+	}
+	s.mu.RUnlock()
+
+	page := Page{Records: []Record{}}
+	for _, r := range records {
+		if after != nil && !newer(*after, r) {
+			continue
+		}
+		if !q.matches(r) {
+			continue
+		}
+		if q.Limit > 0 && len(page.Records) == q.Limit {
+			page.NextCursor = page.Records[len(page.Records)-1].ID
+			break
+		}
+		page.Records = append(page.Records, r)
+	}
+	return page, nil
+}
+
+// matches reports whether r passes the query's filters
+func (q Query) matches(r Record) bool {
+	if len(q.Status) > 0 {
+		found := false
+		for _, status := range q.Status {
+			if r.Status == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Kind != "" && r.Kind != q.Kind {
+		return false
+	}
+	if q.PathPrefix != "" && !strings.HasPrefix(r.SourcePath, q.PathPrefix) {
+		return false
+	}
+	if !q.Since.IsZero() && r.CreatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.CreatedAt.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// newID returns a unique identifier, a UUID independent of the source path
+// so reruns and renamed files don't collide
+func (s *Store) newID() string {
+	return uuid.New()
+}
+
+// sorted returns record copies ordered newest first. Callers must hold the lock.
+func (s *Store) sorted() []Record {
+	records := make([]Record, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, *r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return newer(records[i], records[j])
+	})
+	return records
+}
+
+// newer reports whether a sorts before b: created later or, at the same
+// time, with the greater ID. Longer IDs come first, which orders the base 36
+// IDs of older versions among themselves.
+func newer(a, b Record) bool {
+	if a.CreatedAt.Equal(b.CreatedAt) {
+		return len(a.ID) > len(b.ID) || len(a.ID) == len(b.ID) && a.ID > b.ID
+	}
+	return a.CreatedAt.After(b.CreatedAt)
+}
+
+// save writes the store to disk via a temp file and rename so a crash never
+// leaves a truncated history. Callers must hold the lock.
+func (s *Store) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create job store directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode job store: %v", err)
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write job store: %v", err)
+	}
+	return os.Rename(tmp, s.path)
+}
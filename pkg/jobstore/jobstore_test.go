@@ -0,0 +1,133 @@
+package jobstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorePersistsRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	rec, err := store.Create("/media/movie.mkv", "video")
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+
+	err = store.Update(rec.ID, func(r *Record) {
+		r.Status = "completed"
+		r.Quality = &Quality{Metric: "ssim", Score: 0.98, Threshold: 0.95, Passed: true}
+	})
+	if err != nil {
+		t.Fatalf("Failed to update record: %v", err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+
+	got, ok := reopened.Get(rec.ID)
+	if !ok {
+		t.Fatalf("Record %s not found after reopen", rec.ID)
+	}
+	if got.Status != "completed" || got.Quality == nil || got.Quality.Score != 0.98 {
+		t.Errorf("Unexpected record after reopen: %+v", got)
+	}
+
+	if err := store.Update("missing", func(r *Record) {}); err == nil {
+		t.Error("Expected error updating unknown record")
+	}
+}
+
+func TestCreateDropsUnsavedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	// A directory in place of the temp file makes every save fail
+	if err := os.Mkdir(path+".tmp", 0755); err != nil {
+		t.Fatalf("Failed to block temp file: %v", err)
+	}
+
+	rec, err := store.Create("/media/movie.mkv", "video")
+	if err == nil {
+		t.Fatal("Expected error creating a record that can't be saved")
+	}
+	if rec.ID != "" {
+		t.Errorf("Expected no record, got %+v", rec)
+	}
+	if records := store.List(); len(records) != 0 {
+		t.Errorf("Expected the unsaved record to be dropped, got %+v", records)
+	}
+}
+
+func TestQueryPaginatesAndFilters(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "jobs.json"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		rec, err := store.Create("/media/movie.mkv", "video")
+		if err != nil {
+			t.Fatalf("Failed to create record: %v", err)
+		}
+		ids = append(ids, rec.ID)
+	}
+	store.Update(ids[1], func(r *Record) { r.Status = "failed" })
+	store.Update(ids[3], func(r *Record) { r.Status = "failed" })
+
+	page, err := store.Query(Query{Limit: 2})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(page.Records) != 2 || page.Records[0].ID != ids[4] || page.NextCursor != ids[3] {
+		t.Fatalf("Unexpected first page: %+v", page)
+	}
+
+	var seen []string
+	cursor := ""
+	for {
+		page, err := store.Query(Query{Limit: 2, Cursor: cursor})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		for _, r := range page.Records {
+			seen = append(seen, r.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if len(seen) != 5 || seen[4] != ids[0] {
+		t.Errorf("Expected all 5 records across pages, got %v", seen)
+	}
+
+	failed, _ := store.Query(Query{Status: []string{"failed"}})
+	if len(failed.Records) != 2 || failed.Records[0].ID != ids[3] {
+		t.Errorf("Unexpected failed records: %+v", failed.Records)
+	}
+
+	if _, err := store.Query(Query{Cursor: "missing"}); err == nil {
+		t.Error("Expected an error for a cursor of an unknown record")
+	}
+
+	future, _ := store.Query(Query{Since: time.Now().Add(time.Hour)})
+	if len(future.Records) != 0 {
+		t.Errorf("Expected no records created in the future, got %d", len(future.Records))
+	}
+
+	if _, err := store.Query(Query{Cursor: "not a cursor!"}); err == nil {
+		t.Error("Expected error for invalid cursor")
+	}
+}
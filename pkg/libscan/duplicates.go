@@ -0,0 +1,199 @@
+package libscan
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"media_optimizer/pkg/checksum"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Kinds of duplicate groups
+const (
+	DuplicateExact = "exact"
+	DuplicateNear  = "near"
+)
+
+// nearDurationTolerance is the relative duration difference allowed between
+// near-duplicates, enough to absorb different cuts of intros and credits
+const nearDurationTolerance = 0.02
+
+var (
+	yearPattern    = regexp.MustCompile(`(^|[^0-9])((19|20)\d\d)([^0-9]|$)`)
+	releaseTags    = regexp.MustCompile(`(?i)\b(2160p|1080p|1080i|720p|576p|480p|4k|uhd|hdr10?|dv|bluray|blu-ray|bdrip|brrip|remux|web-?dl|webrip|hdtv|dvdrip|x264|x265|h\.?264|h\.?265|hevc|avc|aac|ac3|eac3|dts|truehd|atmos|10bit|proper|repack|extended|optimized)\b.*$`)
+	nonAlnum       = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+	bracketPattern = regexp.MustCompile(`\[[^\]]*\]|\([^)]*\)`)
+)
+
+// DuplicateGroup is a set of files holding the same content
+type DuplicateGroup struct {
+	Kind  string       `json:"kind"`
+	Key   string       `json:"key"`
+	Files []FileReport `json:"files"`
+	// Keep is the file recommended to keep; the rest are deletion candidates
+	Keep       string   `json:"keep"`
+	Candidates []string `json:"candidates"`
+	// Reclaimable is the space freed by deleting every candidate
+	Reclaimable int64 `json:"reclaimable"`
+}
+
+// findDuplicates returns exact duplicates (identical content) followed by
+// near-duplicates (same title and year with matching duration)
+func findDuplicates(files []FileReport) []DuplicateGroup {
+	groups := exactDuplicates(files)
+
+	exact := make(map[string]bool)
+	for _, g := range groups {
+		for _, f := range g.Candidates {
+			exact[f] = true
+		}
+	}
+
+	var remaining []FileReport
+	for _, f := range files {
+		if f.Error == "" && !exact[f.Path] {
+			remaining = append(remaining, f)
+		}
+	}
+	return append(groups, nearDuplicates(remaining)...)
+}
+
+// exactDuplicates hashes only files that share a size with another file
+func exactDuplicates(files []FileReport) []DuplicateGroup {
+	bySize := make(map[int64][]FileReport)
+	for _, f := range files {
+		if f.Size > 0 {
+			bySize[f.Size] = append(bySize[f.Size], f)
+		}
+	}
+
+	var groups []DuplicateGroup
+	for _, sameSize := range bySize {
+		if len(sameSize) < 2 {
+			continue
+		}
+		byHash := make(map[string][]FileReport)
+		for _, f := range sameSize {
+			sum, err := checksum.File(f.Path)
+			if err != nil {
+				continue
+			}
+			byHash[sum] = append(byHash[sum], f)
+		}
+		for sum, same := range byHash {
+			if len(same) > 1 {
+				groups = append(groups, newGroup(DuplicateExact, "sha256:"+sum, same))
+			}
+		}
+	}
+	sortGroups(groups)
+	return groups
+}
+
+// nearDuplicates groups files by normalised title and year, then splits each
+// group into clusters whose durations agree
+func nearDuplicates(files []FileReport) []DuplicateGroup {
+	byTitle := make(map[string][]FileReport)
+	for _, f := range files {
+		if key := titleKey(f.Path); key != "" {
+			byTitle[key] = append(byTitle[key], f)
+		}
+	}
+
+	var groups []DuplicateGroup
+	for key, same := range byTitle {
+		if len(same) < 2 {
+			continue
+		}
+		sort.Slice(same, func(i, j int) bool { return same[i].Duration < same[j].Duration })
+
+		cluster := []FileReport{same[0]}
+		flush := func() {
+			if len(cluster) > 1 {
+				groups = append(groups, newGroup(DuplicateNear, key, cluster))
+			}
+		}
+		for _, f := range same[1:] {
+			if durationsMatch(cluster[0].Duration, f.Duration) {
+				cluster = append(cluster, f)
+				continue
+			}
+			flush()
+			cluster = []FileReport{f}
+		}
+		flush()
+	}
+	sortGroups(groups)
+	return groups
+}
+
+// newGroup picks the file to keep — highest resolution, then highest
+// bitrate — and marks the rest as deletion candidates
+func newGroup(kind, key string, files []FileReport) DuplicateGroup {
+	sort.Slice(files, func(i, j int) bool {
+		pi, pj := files[i].Width*files[i].Height, files[j].Width*files[j].Height
+		if pi != pj {
+			return pi > pj
+		}
+		if files[i].BitrateKbps != files[j].BitrateKbps {
+			return files[i].BitrateKbps > files[j].BitrateKbps
+		}
+		return files[i].Path < files[j].Path
+	})
+
+	g := DuplicateGroup{
+		Kind:  kind,
+		Key:   key,
+		Files: files,
+		Keep:  files[0].Path,
+	}
+	for _, f := range files[1:] {
+		g.Candidates = append(g.Candidates, f.Path)
+		g.Reclaimable += f.Size
+	}
+	return g
+}
+
+// sortGroups orders groups by reclaimable space, largest first
+func sortGroups(groups []DuplicateGroup) {
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Reclaimable > groups[j].Reclaimable })
+}
+
+// titleKey normalises a file name such as "The.Movie.2019.2160p.UHD.mkv"
+// into "the movie (2019)". Names without a year only match other names
+// without one.
+func titleKey(path string) string {
+	// Names are compared composed, as decomposed accents would split words
+	name := norm.NFC.String(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+
+	year := ""
+	if m := yearPattern.FindStringSubmatchIndex(name); m != nil {
+		year = name[m[4]:m[5]]
+		name = name[:m[4]]
+	}
+
+	name = bracketPattern.ReplaceAllString(name, " ")
+	name = strings.NewReplacer(".", " ", "_", " ", "'", "", "’", "").Replace(name)
+	name = releaseTags.ReplaceAllString(name, "")
+	name = strings.TrimSpace(nonAlnum.ReplaceAllString(strings.ToLower(name), " "))
+	if name == "" {
+		return ""
+	}
+	if year != "" {
+		return fmt.Sprintf("%s (%s)", name, year)
+	}
+	return name
+}
+
+// durationsMatch reports whether two durations are within tolerance
+func durationsMatch(a, b float64) bool {
+	if a <= 0 || b <= 0 {
+		return false
+	}
+	return math.Abs(a-b) <= nearDurationTolerance*math.Max(a, b)
+}
@@ -0,0 +1,138 @@
+package libscan
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxFolderCodecs caps the codecs listed per folder
+const maxFolderCodecs = 3
+
+// FolderStats summarizes the media files below a directory
+type FolderStats struct {
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+	// Codecs are the dominant video codecs, largest share of Size first
+	Codecs           []CodecShare `json:"codecs"`
+	EstimatedSavings int64        `json:"estimatedSavings"`
+	ScannedAt        time.Time    `json:"scannedAt"`
+}
+
+// CodecShare is the part of a folder's media in one video codec
+type CodecShare struct {
+	Codec string  `json:"codec"`
+	Files int     `json:"files"`
+	Size  int64   `json:"size"`
+	Share float64 `json:"share"`
+}
+
+// summarize aggregates the probed files of a folder
+func summarize(files []FileReport) *FolderStats {
+	stats := &FolderStats{ScannedAt: time.Now()}
+	codecs := map[string]*CodecShare{}
+	for _, f := range files {
+		stats.Files++
+		stats.Size += f.Size
+		stats.EstimatedSavings += f.EstimatedSavings
+		codec := f.VideoCodec
+		if codec == "" {
+			codec = "unknown"
+		}
+		if codecs[codec] == nil {
+			codecs[codec] = &CodecShare{Codec: codec}
+		}
+		codecs[codec].Files++
+		codecs[codec].Size += f.Size
+	}
+
+	stats.Codecs = []CodecShare{}
+	for _, c := range codecs {
+		if stats.Size > 0 {
+			c.Share = float64(c.Size) / float64(stats.Size)
+		}
+		stats.Codecs = append(stats.Codecs, *c)
+	}
+	sort.Slice(stats.Codecs, func(i, j int) bool {
+		a, b := stats.Codecs[i], stats.Codecs[j]
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		return a.Codec < b.Codec
+	})
+	if len(stats.Codecs) > maxFolderCodecs {
+		stats.Codecs = stats.Codecs[:maxFolderCodecs]
+	}
+	return stats
+}
+
+// FolderCache computes the FolderStats of directories in the background,
+// one directory at a time, and keeps them for a while
+type FolderCache struct {
+	mu      sync.Mutex
+	opts    Options
+	ttl     time.Duration
+	folders map[string]*folderEntry
+	queue   chan string
+}
+
+type folderEntry struct {
+	stats  *FolderStats
+	queued bool
+}
+
+// NewFolderCache creates a cache scanning folders with opts, whose Roots
+// are ignored, and keeping the results for ttl
+func NewFolderCache(opts Options, ttl time.Duration) *FolderCache {
+	c := &FolderCache{opts: opts, ttl: ttl, folders: map[string]*folderEntry{}, queue: make(chan string, 1024)}
+	go c.run()
+	return c
+}
+
+// Get returns the stats of dir, nil until they are first computed. Missing
+// or expired stats are queued for computing; expired ones are returned
+// until replaced.
+func (c *FolderCache) Get(dir string) *FolderStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.folders[dir]
+	if e == nil {
+		e = &folderEntry{}
+		c.folders[dir] = e
+	}
+	if !e.queued && (e.stats == nil || time.Since(e.stats.ScannedAt) > c.ttl) {
+		select {
+		case c.queue <- dir:
+			e.queued = true
+		default:
+			// Full; asked for again by the next listing
+		}
+	}
+	return e.stats
+}
+
+// run computes queued folders until the process exits
+func (c *FolderCache) run() {
+	for dir := range c.queue {
+		opts := c.opts
+		opts.Roots = []string{dir}
+		var stats *FolderStats
+		if paths, err := collect(opts); err != nil {
+			log.Printf("Folder scan failed: %v", err)
+		} else {
+			stats = summarize(probeAll(paths, opts.Workers))
+		}
+
+		c.mu.Lock()
+		e := c.folders[dir]
+		e.queued = false
+		if stats != nil {
+			e.stats = stats
+		} else if e.stats == nil {
+			delete(c.folders, dir)
+		}
+		c.mu.Unlock()
+	}
+}
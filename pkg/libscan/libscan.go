@@ -0,0 +1,333 @@
+package libscan
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"media_optimizer/pkg/exclude"
+	"media_optimizer/pkg/mediaopt"
+)
+
+const (
+	// defaultWorkers is the number of concurrent ffprobe processes
+	defaultWorkers = 4
+	// maxListed caps the per-file lists included in a report
+	maxListed = 100
+)
+
+// histogramBounds are the upper bounds (kbps) of the bitrate histogram buckets
+var histogramBounds = []int{2000, 5000, 10000, 20000, 40000}
+
+// Options configures a library scan
+type Options struct {
+	Roots      []string
+	Extensions []string
+	// HighBitrateKbps flags files whose overall bitrate exceeds this value
+	HighBitrateKbps int
+	Workers         int
+	// Exclude leaves out the files and directories it excludes
+	Exclude *exclude.Rules
+}
+
+// FileReport is the probe summary of a single media file
+type FileReport struct {
+	Path             string   `json:"path"`
+	Size             int64    `json:"size"`
+	Duration         float64  `json:"duration"`
+	Container        string   `json:"container"`
+	VideoCodec       string   `json:"videoCodec"`
+	AudioCodecs      []string `json:"audioCodecs,omitempty"`
+	Width            int      `json:"width,omitempty"`
+	Height           int      `json:"height,omitempty"`
+	BitrateKbps      int      `json:"bitrateKbps"`
+	EstimatedSavings int64    `json:"estimatedSavings"`
+	// Processed is the stamp of a file the optimizer wrote, which isn't a
+	// candidate for optimization
+	Processed *mediaopt.Stamp `json:"processed,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// CodecStats aggregates files sharing a video codec
+type CodecStats struct {
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+}
+
+// Bucket is one bar of the bitrate histogram
+type Bucket struct {
+	Label   string `json:"label"`
+	MinKbps int    `json:"minKbps"`
+	MaxKbps int    `json:"maxKbps,omitempty"`
+	Files   int    `json:"files"`
+	Size    int64  `json:"size"`
+}
+
+// Share describes the largest files and the portion of storage they take up
+type Share struct {
+	Files int          `json:"files"`
+	Size  int64        `json:"size"`
+	Share float64      `json:"share"`
+	Items []FileReport `json:"items"`
+}
+
+// Report is the aggregate result of a library scan
+type Report struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	Roots       []string  `json:"roots"`
+	FileCount   int       `json:"fileCount"`
+	TotalSize   int64     `json:"totalSize"`
+	ProbeErrors int       `json:"probeErrors"`
+	// Processed counts the files the optimizer wrote
+	Processed        int                   `json:"processed"`
+	Codecs           map[string]CodecStats `json:"codecs"`
+	BitrateHistogram []Bucket              `json:"bitrateHistogram"`
+	HighBitrate      []FileReport          `json:"highBitrate"`
+	LargestDecile    Share                 `json:"largestDecile"`
+	EstimatedSavings int64                 `json:"estimatedSavings"`
+	Duplicates       []DuplicateGroup      `json:"-"`
+	Files            []FileReport          `json:"-"`
+}
+
+// Scan walks the roots, probes every matching file and aggregates the results
+func Scan(opts Options) (*Report, error) {
+	paths, err := collect(opts)
+	if err != nil {
+		return nil, err
+	}
+	files := probeAll(paths, opts.Workers)
+	report := aggregate(opts, files)
+	report.Duplicates = findDuplicates(files)
+	return report, nil
+}
+
+// probeAll probes paths with the given number of concurrent workers
+func probeAll(paths []string, workers int) []FileReport {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	files := make([]FileReport, len(paths))
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				files[i] = probeFile(paths[i])
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return files
+}
+
+// collect returns every file below the roots whose extension is allowed
+func collect(opts Options) ([]string, error) {
+	var paths []string
+	for _, root := range opts.Roots {
+		if _, err := os.Stat(root); err != nil {
+			return nil, fmt.Errorf("media root %s is not accessible: %v", root, err)
+		}
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Keep going past unreadable directories
+				log.Printf("Library scan skipping %s: %v", path, err)
+				return nil
+			}
+			if d.IsDir() && opts.Exclude.SkipDir(path) {
+				return fs.SkipDir
+			}
+			if !d.IsDir() && mediaopt.HasExtension(path, opts.Extensions) && !mediaopt.IsPartial(path) && !opts.Exclude.Matches(path) {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// probeFile gathers the report fields for a single file
+func probeFile(path string) FileReport {
+	fr := FileReport{Path: path}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		fr.Error = err.Error()
+		return fr
+	}
+	fr.Size = info.Size()
+
+	probe, err := mediaopt.Probe(path)
+	if err != nil {
+		fr.Error = err.Error()
+		return fr
+	}
+
+	fr.Duration = probe.DurationSeconds()
+	fr.Container = probe.Format.FormatName
+	if br, err := strconv.ParseFloat(probe.Format.BitRate, 64); err == nil {
+		fr.BitrateKbps = int(br / 1000)
+	} else if fr.Duration > 0 {
+		fr.BitrateKbps = int(float64(fr.Size*8) / fr.Duration / 1000)
+	}
+	if video := probe.StreamsOfType("video"); len(video) > 0 {
+		fr.VideoCodec = video[0].CodecName
+		fr.Width, fr.Height = video[0].Width, video[0].Height
+	}
+	for _, a := range probe.StreamsOfType("audio") {
+		fr.AudioCodecs = append(fr.AudioCodecs, a.CodecName)
+	}
+
+	if fr.Processed = mediaopt.ReadStamp(probe); fr.Processed != nil {
+		return fr
+	}
+	if savings := fr.Size - mediaopt.EstimateOutputSize(probe, fr.Size); savings > 0 {
+		fr.EstimatedSavings = savings
+	}
+	return fr
+}
+
+// aggregate builds the report from the per-file results
+func aggregate(opts Options, files []FileReport) *Report {
+	r := &Report{
+		GeneratedAt: time.Now(),
+		Roots:       opts.Roots,
+		Codecs:      make(map[string]CodecStats),
+		Files:       files,
+	}
+
+	lower := 0
+	for _, upper := range histogramBounds {
+		r.BitrateHistogram = append(r.BitrateHistogram, Bucket{
+			Label:   fmt.Sprintf("%d-%d kbps", lower, upper),
+			MinKbps: lower,
+			MaxKbps: upper,
+		})
+		lower = upper
+	}
+	r.BitrateHistogram = append(r.BitrateHistogram, Bucket{
+		Label:   fmt.Sprintf("%d+ kbps", lower),
+		MinKbps: lower,
+	})
+
+	var probed []FileReport
+	for _, f := range files {
+		r.FileCount++
+		r.TotalSize += f.Size
+		if f.Error != "" {
+			r.ProbeErrors++
+			continue
+		}
+		probed = append(probed, f)
+
+		codec := f.VideoCodec
+		if codec == "" {
+			codec = "none"
+		}
+		stats := r.Codecs[codec]
+		stats.Files++
+		stats.Size += f.Size
+		r.Codecs[codec] = stats
+
+		b := sort.SearchInts(histogramBounds, f.BitrateKbps+1)
+		r.BitrateHistogram[b].Files++
+		r.BitrateHistogram[b].Size += f.Size
+
+		if f.Processed != nil {
+			r.Processed++
+			continue
+		}
+		if opts.HighBitrateKbps > 0 && f.BitrateKbps > opts.HighBitrateKbps {
+			r.HighBitrate = append(r.HighBitrate, f)
+		}
+		r.EstimatedSavings += f.EstimatedSavings
+	}
+
+	sort.Slice(r.HighBitrate, func(i, j int) bool {
+		return r.HighBitrate[i].BitrateKbps > r.HighBitrate[j].BitrateKbps
+	})
+	if len(r.HighBitrate) > maxListed {
+		r.HighBitrate = r.HighBitrate[:maxListed]
+	}
+
+	sort.Slice(probed, func(i, j int) bool { return probed[i].Size > probed[j].Size })
+	decile := (len(probed) + 9) / 10
+	for _, f := range probed[:decile] {
+		r.LargestDecile.Files++
+		r.LargestDecile.Size += f.Size
+	}
+	if r.TotalSize > 0 {
+		r.LargestDecile.Share = float64(r.LargestDecile.Size) / float64(r.TotalSize)
+	}
+	r.LargestDecile.Items = probed[:decile]
+	if len(r.LargestDecile.Items) > maxListed {
+		r.LargestDecile.Items = r.LargestDecile.Items[:maxListed]
+	}
+	return r
+}
+
+// Scanner runs library scans in the background and keeps the latest report
+type Scanner struct {
+	mu      sync.Mutex
+	opts    Options
+	report  *Report
+	running bool
+	lastErr error
+}
+
+// NewScanner creates a scanner for the given options
+func NewScanner(opts Options) *Scanner {
+	return &Scanner{opts: opts}
+}
+
+// Start begins a background scan. It returns false if one is already running.
+func (s *Scanner) Start() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return false
+	}
+	s.running = true
+
+	go func() {
+		log.Printf("Library scan started for %v", s.opts.Roots)
+		report, err := Scan(s.opts)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.running = false
+		s.lastErr = err
+		if err != nil {
+			log.Printf("Library scan failed: %v", err)
+			return
+		}
+		s.report = report
+		log.Printf("Library scan finished: %d files, %d probe errors", report.FileCount, report.ProbeErrors)
+	}()
+	return true
+}
+
+// Latest returns the most recent report (nil before the first scan completes),
+// whether a scan is in progress, and the error of the last scan
+func (s *Scanner) Latest() (*Report, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.report, s.running, s.lastErr
+}
@@ -0,0 +1,215 @@
+package libscan
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"media_optimizer/pkg/mediaopt"
+)
+
+func TestAggregate(t *testing.T) {
+	var files []FileReport
+	for i := 1; i <= 10; i++ {
+		files = append(files, FileReport{
+			Path:        filepath.Join("/media", string(rune('a'+i))),
+			Size:        int64(i * 100),
+			VideoCodec:  "h264",
+			BitrateKbps: i * 3000,
+		})
+	}
+	files[9].VideoCodec = "hevc"
+	// Files the optimizer wrote aren't candidates
+	files[8].Processed = &mediaopt.Stamp{Version: "1.4.0"}
+	files = append(files, FileReport{Path: "/media/broken", Size: 50, Error: "ffprobe failed"})
+
+	r := aggregate(Options{HighBitrateKbps: 25000}, files)
+
+	if r.FileCount != 11 || r.ProbeErrors != 1 || r.Processed != 1 {
+		t.Errorf("Expected 11 files with 1 probe error and 1 processed, got %d, %d and %d", r.FileCount, r.ProbeErrors, r.Processed)
+	}
+	if r.Codecs["h264"].Files != 9 || r.Codecs["hevc"].Files != 1 {
+		t.Errorf("Unexpected codec distribution: %+v", r.Codecs)
+	}
+	if len(r.HighBitrate) != 1 || r.HighBitrate[0].BitrateKbps != 30000 {
+		t.Errorf("Expected the unprocessed file above 25000 kbps, got %+v", r.HighBitrate)
+	}
+	if r.LargestDecile.Files != 1 || r.LargestDecile.Size != 1000 {
+		t.Errorf("Expected the single largest file in the top decile, got %+v", r.LargestDecile)
+	}
+
+	var histogramFiles int
+	for _, b := range r.BitrateHistogram {
+		histogramFiles += b.Files
+	}
+	if histogramFiles != 10 {
+		t.Errorf("Expected 10 files in the histogram, got %d", histogramFiles)
+	}
+}
+
+func TestCollectFiltersExtensions(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.mkv", "b.MP4", "c.txt", "sub/d.mkv"} {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	paths, err := collect(Options{Roots: []string{root}, Extensions: []string{".mkv", ".mp4"}})
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	if len(paths) != 3 {
+		t.Errorf("Expected 3 media files, got %v", paths)
+	}
+}
+
+func TestTitleKey(t *testing.T) {
+	tests := map[string]string{
+		"/m/The.Matrix.1999.2160p.UHD.BluRay.x265.mkv": "the matrix (1999)",
+		"/m/The Matrix (1999) [1080p].mp4":             "the matrix (1999)",
+		"/m/home_video_clip.mp4":                       "home video clip",
+		"/m/Ame\u0301lie.2001.1080p.mkv":               "amélie (2001)",
+		"/m/Amélie (2001).mkv":                         "amélie (2001)",
+		"/m/千と千尋の神隠し (2001).mkv":                       "千と千尋の神隠し (2001)",
+		"/m/Schindler's List (1993).mkv":               "schindlers list (1993)",
+		"/m/Schindler’s.List.1993.720p.mkv":            "schindlers list (1993)",
+		"/m/🎬 Home Movie.mp4":                          "home movie",
+	}
+	for path, expected := range tests {
+		if got := titleKey(path); got != expected {
+			t.Errorf("titleKey(%q) = %q, expected %q", path, got, expected)
+		}
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(root, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+
+	copyA := write("Clip.2001.mkv", "same bytes")
+	copyB := write("Clip.2001.copy.mkv", "same bytes")
+	hd := write("Film.2010.1080p.mkv", "hd")
+	uhd := write("Film (2010) 2160p.mkv", "uhd version")
+
+	files := []FileReport{
+		{Path: copyA, Size: 10, Duration: 60, Width: 1920, Height: 1080},
+		{Path: copyB, Size: 10, Duration: 60, Width: 1920, Height: 1080},
+		{Path: hd, Size: 2, Duration: 6000, Width: 1920, Height: 1080},
+		{Path: uhd, Size: 11, Duration: 6030, Width: 3840, Height: 2160},
+	}
+
+	groups := findDuplicates(files)
+	if len(groups) != 2 {
+		t.Fatalf("Expected one exact and one near group, got %+v", groups)
+	}
+
+	if groups[0].Kind != DuplicateExact || len(groups[0].Candidates) != 1 {
+		t.Errorf("Unexpected exact group: %+v", groups[0])
+	}
+	if groups[1].Kind != DuplicateNear || groups[1].Keep != uhd || groups[1].Candidates[0] != hd {
+		t.Errorf("Expected the 4K file to be kept over 1080p, got %+v", groups[1])
+	}
+}
+
+func TestSearch(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "Show", "Season 1"), 0755)
+	for name, size := range map[string]int{
+		"Show/Season 1/Show.S01E01.avi": 100,
+		"Show/Season 1/Show.S01E02.AVI": 300,
+		"Show/Season 1/Show.S01E02.srt": 10,
+		"Movie.2001.mkv":                200,
+		"Ame\u0301lie (2001).mkv":       50,
+	} {
+		os.WriteFile(filepath.Join(root, name), make([]byte, size), 0644)
+	}
+
+	result, err := Search(context.Background(), SearchOptions{Roots: []string{root}, Extensions: []string{".avi"}, MaxSize: 200})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(result.Matches) != 1 || filepath.Base(result.Matches[0].Path) != "Show.S01E01.avi" {
+		t.Errorf("Expected the small AVI only, got %+v", result.Matches)
+	}
+
+	result, _ = Search(context.Background(), SearchOptions{Roots: []string{root}, Pattern: "*s01e02*"})
+	if len(result.Matches) != 2 || result.Truncated {
+		t.Errorf("Expected both files of episode 2, got %+v", result)
+	}
+	result, _ = Search(context.Background(), SearchOptions{Roots: []string{root}, Pattern: "show", Limit: 2})
+	if len(result.Matches) != 2 || !result.Truncated {
+		t.Errorf("Expected the substring search to be truncated at 2, got %+v", result)
+	}
+	// A composed query finds a decomposed name
+	result, _ = Search(context.Background(), SearchOptions{Roots: []string{root}, Pattern: "AMÉLIE"})
+	if len(result.Matches) != 1 {
+		t.Errorf("Expected the decomposed name to match, got %+v", result.Matches)
+	}
+
+	if _, err := Search(context.Background(), SearchOptions{Roots: []string{root}, Pattern: "[a-"}); err == nil {
+		t.Error("Expected an invalid pattern to be rejected")
+	}
+}
+
+func TestSearchCodecLimits(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.mkv", "b.mkv", "c.mkv"} {
+		os.WriteFile(filepath.Join(root, name), []byte("not media"), 0644)
+	}
+
+	// Unprobeable files match no codec, but the cap still truncates
+	result, err := Search(context.Background(), SearchOptions{Roots: []string{root}, VideoCodec: "h264", MaxProbes: 2})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(result.Matches) != 0 || !result.Truncated {
+		t.Errorf("Expected a truncated search without matches, got %+v", result)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Search(ctx, SearchOptions{Roots: []string{root}, VideoCodec: "h264"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled search to fail with context.Canceled, got %v", err)
+	}
+}
+
+func TestFolderStats(t *testing.T) {
+	stats := summarize([]FileReport{
+		{Size: 600, VideoCodec: "h264", EstimatedSavings: 300},
+		{Size: 100, VideoCodec: "h264", EstimatedSavings: 50},
+		{Size: 200, VideoCodec: "hevc"},
+		{Size: 50, VideoCodec: "mpeg4"},
+		{Size: 50, Error: "ffprobe failed"},
+	})
+	if stats.Files != 5 || stats.Size != 1000 || stats.EstimatedSavings != 350 {
+		t.Errorf("Unexpected totals: %+v", stats)
+	}
+	if len(stats.Codecs) != 3 || stats.Codecs[0].Codec != "h264" || stats.Codecs[0].Share != 0.7 || stats.Codecs[1].Codec != "hevc" {
+		t.Errorf("Expected the three largest codecs, got %+v", stats.Codecs)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("a"), 0644)
+	cache := NewFolderCache(Options{Extensions: []string{".mkv"}}, time.Hour)
+	deadline := time.Now().Add(5 * time.Second)
+	var got *FolderStats
+	for got == nil && time.Now().Before(deadline) {
+		got = cache.Get(dir)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got == nil || got.Files != 0 || got.ScannedAt.IsZero() {
+		t.Errorf("Expected the folder to be scanned in the background, got %+v", got)
+	}
+}
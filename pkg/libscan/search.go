@@ -0,0 +1,193 @@
+package libscan
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"media_optimizer/pkg/exclude"
+	"media_optimizer/pkg/mediaopt"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// SearchOptions selects files below the roots. Zero values disable a filter.
+type SearchOptions struct {
+	Roots []string
+	// Pattern matches file names case-insensitively, as a glob when it has
+	// wildcards ("*.s01e*.mkv") and as a substring otherwise
+	Pattern string
+	// Extensions keeps files with one of these lowercase extensions, e.g.
+	// ".avi"
+	Extensions []string
+	MinSize    int64
+	MaxSize    int64
+	// VideoCodec probes the files passing the other filters and keeps those
+	// whose first video stream uses this codec, e.g. "mpeg4"
+	VideoCodec string
+	// MaxProbes caps the files probed for VideoCodec, DefaultMaxProbes when
+	// zero. Files beyond it are left out and the result is truncated.
+	MaxProbes int
+	// Limit stops the search after this many matches
+	Limit   int
+	Workers int
+	// Exclude leaves out the files and directories it excludes
+	Exclude *exclude.Rules
+}
+
+// Match is a file found by Search
+type Match struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+	VideoCodec string    `json:"videoCodec,omitempty"`
+}
+
+// SearchResult lists the matches in walk order
+type SearchResult struct {
+	Matches []Match `json:"matches"`
+	// Truncated is set when more files matched than the limit
+	Truncated bool `json:"truncated"`
+}
+
+// DefaultMaxProbes is the number of files a codec search probes at most
+const DefaultMaxProbes = 2000
+
+// Search walks the roots for files matching opts. Walking and probing stop
+// with ctx's error once it is done.
+func Search(ctx context.Context, opts SearchOptions) (*SearchResult, error) {
+	maxProbes := opts.MaxProbes
+	if maxProbes <= 0 {
+		maxProbes = DefaultMaxProbes
+	}
+	// Names are compared composed, matching them however the client and the
+	// filesystem spell accents
+	pattern := strings.ToLower(norm.NFC.String(opts.Pattern))
+	glob := strings.ContainsAny(pattern, "*?[")
+	if glob {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", opts.Pattern, err)
+		}
+	}
+
+	result := &SearchResult{Matches: []Match{}}
+	var candidates []Match
+	for _, root := range opts.Roots {
+		if _, err := os.Stat(root); err != nil {
+			return nil, fmt.Errorf("media root %s is not accessible: %v", root, err)
+		}
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				log.Printf("Search skipping %s: %v", path, err)
+				return nil
+			}
+			if d.IsDir() && opts.Exclude.SkipDir(path) {
+				return fs.SkipDir
+			}
+			if d.IsDir() || mediaopt.IsPartial(path) || opts.Exclude.Matches(path) {
+				return nil
+			}
+			name := strings.ToLower(norm.NFC.String(d.Name()))
+			if glob {
+				if ok, _ := filepath.Match(pattern, name); !ok {
+					return nil
+				}
+			} else if !strings.Contains(name, pattern) {
+				return nil
+			}
+			if len(opts.Extensions) > 0 && !mediaopt.HasExtension(path, opts.Extensions) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if opts.MinSize > 0 && info.Size() < opts.MinSize || opts.MaxSize > 0 && info.Size() > opts.MaxSize {
+				return nil
+			}
+
+			candidates = append(candidates, Match{Path: path, Size: info.Size(), ModTime: info.ModTime()})
+			// Without probing, the walk can stop once the limit is exceeded
+			if opts.VideoCodec == "" && opts.Limit > 0 && len(candidates) > opts.Limit {
+				return fs.SkipAll
+			}
+			if opts.VideoCodec != "" && len(candidates) > maxProbes {
+				return fs.SkipAll
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.VideoCodec != "" {
+		if len(candidates) > maxProbes {
+			candidates, result.Truncated = candidates[:maxProbes], true
+		}
+		var err error
+		if candidates, err = filterCodec(ctx, candidates, opts.VideoCodec, opts.Workers); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Limit > 0 && len(candidates) > opts.Limit {
+		candidates, result.Truncated = candidates[:opts.Limit], true
+	}
+	result.Matches = append(result.Matches, candidates...)
+	return result, nil
+}
+
+// filterCodec probes the files and keeps those whose first video stream
+// uses codec, in their original order
+func filterCodec(ctx context.Context, files []Match, codec string, workers int) ([]Match, error) {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				probe, err := mediaopt.ProbeContext(ctx, files[i].Path)
+				if err != nil {
+					continue
+				}
+				if video := probe.StreamsOfType("video"); len(video) > 0 {
+					files[i].VideoCodec = video[0].CodecName
+				}
+			}
+		}()
+	}
+dispatch:
+	for i := range files {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(next)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var kept []Match
+	for _, f := range files {
+		if strings.EqualFold(f.VideoCodec, codec) {
+			kept = append(kept, f)
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,183 @@
+// Package logging sets up the structured logger shared by the server and
+// its packages, writing to the console and a size and age rotated log file.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configures the logger
+type Options struct {
+	// Level is "debug", "info", "warn" or "error"
+	Level string
+	// Format is "text" or "json"
+	Format string
+	// Console receives the log besides File; nil means stdout
+	Console io.Writer
+	// File is the log file; empty logs to the console only
+	File string
+	// MaxSize rotates the file once it grows beyond this many bytes
+	MaxSize int64
+	// MaxAge rotates the file once it is older than this
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files kept
+	MaxBackups int
+}
+
+// ParseLevel converts a level name into a slog level
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("unknown log level %q", name)
+	}
+	return level, nil
+}
+
+// New creates a logger from opts. The returned closer closes the log file.
+func New(opts Options) (*slog.Logger, io.Closer, error) {
+	level, err := ParseLevel(opts.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	console := opts.Console
+	if console == nil {
+		console = os.Stdout
+	}
+	out := console
+	var closer io.Closer = io.NopCloser(nil)
+	if opts.File != "" {
+		file, err := NewRotatingFile(opts.File, opts.MaxSize, opts.MaxAge, opts.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = io.MultiWriter(console, file)
+		closer = file
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch opts.Format {
+	case "json":
+		handler = slog.NewJSONHandler(out, handlerOpts)
+	case "text", "":
+		handler = slog.NewTextHandler(out, handlerOpts)
+	default:
+		closer.Close()
+		return nil, nil, fmt.Errorf("unknown log format %q", opts.Format)
+	}
+	return slog.New(handler), closer, nil
+}
+
+// RotatingFile is an io.Writer appending to a file that is renamed with a
+// timestamp suffix once it exceeds its size or age limit
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+// NewRotatingFile opens path for appending. Zero limits disable size or age
+// based rotation; a zero maxBackups keeps every rotated file.
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.due(int64(len(b))) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// due reports whether writing n more bytes should go to a new file
+func (r *RotatingFile) due(n int64) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.maxSize > 0 && r.size+n > r.maxSize {
+		return true
+	}
+	return r.maxAge > 0 && time.Since(r.created) > r.maxAge
+}
+
+// open opens the log file, taking its age from the modification time of an
+// existing file since creation times aren't portable
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size, r.created = f, info.Size(), time.Now()
+	if info.Size() > 0 {
+		r.created = info.ModTime()
+	}
+	return nil
+}
+
+// rotate renames the current file and starts a new one
+func (r *RotatingFile) rotate() error {
+	r.file.Close()
+	ext := filepath.Ext(r.path)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(r.path, ext), time.Now().Format("20060102T150405.000"), ext)
+	if err := os.Rename(r.path, backup); err != nil {
+		return fmt.Errorf("failed to rotate log file: %v", err)
+	}
+	r.prune()
+	return r.open()
+}
+
+// prune deletes the oldest rotated files beyond maxBackups
+func (r *RotatingFile) prune() {
+	if r.maxBackups <= 0 {
+		return
+	}
+	ext := filepath.Ext(r.path)
+	backups, _ := filepath.Glob(strings.TrimSuffix(r.path, ext) + "-*" + ext)
+	// Timestamps sort chronologically
+	sort.Strings(backups)
+	for len(backups) > r.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	r, err := NewRotatingFile(path, 100, 0, 2)
+	if err != nil {
+		t.Fatalf("NewRotatingFile failed: %v", err)
+	}
+	defer r.Close()
+
+	line := strings.Repeat("x", 59) + "\n"
+	for i := 0; i < 5; i++ {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		// Backup names have millisecond resolution
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	backups, _ := filepath.Glob(filepath.Join(dir, "app-*.log"))
+	if len(backups) != 2 {
+		t.Errorf("Expected 2 kept backups, got %v", backups)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != line {
+		t.Errorf("Expected the current file to hold one line, got %q", data)
+	}
+}
+
+func TestNew(t *testing.T) {
+	logger, closer, err := New(Options{Level: "warn", Format: "json", File: filepath.Join(t.TempDir(), "a.log")})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer closer.Close()
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("Expected debug to be disabled at warn level")
+	}
+
+	if _, _, err := New(Options{Level: "loud"}); err == nil {
+		t.Error("Expected error for an unknown level")
+	}
+	if _, _, err := New(Options{Level: "info", Format: "xml"}); err == nil {
+		t.Error("Expected error for an unknown format")
+	}
+}
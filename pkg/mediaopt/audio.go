@@ -0,0 +1,209 @@
+package mediaopt
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// audioEncoders maps the supported audio codecs to their ffmpeg encoder
+var audioEncoders = map[string]string{
+	"aac":  "aac",
+	"ac3":  "ac3",
+	"eac3": "eac3",
+	"opus": "libopus",
+}
+
+// audioMaxChannels is the most channels each codec's encoder writes
+var audioMaxChannels = map[string]int{
+	"aac":  8,
+	"ac3":  6,
+	"eac3": 6,
+	"opus": 8,
+}
+
+// audioLayouts maps the channel layouts audio can be mixed to to their
+// channel count
+var audioLayouts = map[string]int{
+	"mono":   1,
+	"stereo": 2,
+	"5.1":    6,
+	"7.1":    8,
+}
+
+// audioBitrates holds the default bitrate in kbps of each codec for mono,
+// stereo and surround audio, by channel count
+var audioBitrates = map[string]map[int]int{
+	"aac":  {1: 96, 2: 192, 6: 384, 8: 512},
+	"ac3":  {1: 192, 2: 384, 6: 640},
+	"eac3": {1: 128, 2: 224, 6: 640},
+	"opus": {1: 64, 2: 128, 6: 256, 8: 384},
+}
+
+// DefaultAudio is the audio encoding of plans without audio settings: the
+// stereo AC3 downmix the pipeline always made
+var DefaultAudio = AudioEncoding{Codec: TargetAudioCodec, Layout: "stereo", BitrateKbps: TargetAudioBitrate / 1000}
+
+// AudioEncoding configures how the kept audio tracks are written
+type AudioEncoding struct {
+	// Codec is "aac", "ac3", "eac3" or "opus"
+	Codec string `json:"codec"`
+	// BitrateKbps is the bitrate of each re-encoded track; zero picks one
+	// for the codec and channel count
+	BitrateKbps int `json:"bitrateKbps,omitempty"`
+	// Layout is "mono", "stereo", "5.1" or "7.1"; empty keeps the source's
+	// channels, up to the most the codec can carry
+	Layout string `json:"layout,omitempty"`
+	// Passthrough lists source codecs copied as they are, e.g. "eac3" for a
+	// receiver that decodes it, as long as their channels fit Layout
+	Passthrough []string `json:"passthrough,omitempty"`
+}
+
+// Validate checks that the settings describe a usable encode
+func (a *AudioEncoding) Validate() error {
+	if _, ok := audioEncoders[a.Codec]; !ok {
+		return fmt.Errorf("unsupported audio codec %q", a.Codec)
+	}
+	if a.BitrateKbps < 0 {
+		return fmt.Errorf("audio bitrate must not be negative")
+	}
+	if a.Layout != "" {
+		channels, ok := audioLayouts[a.Layout]
+		if !ok {
+			return fmt.Errorf("unknown audio layout %q", a.Layout)
+		}
+		if channels > audioMaxChannels[a.Codec] {
+			return fmt.Errorf("%s can't carry %s audio", a.Codec, a.Layout)
+		}
+	}
+	for _, codec := range a.Passthrough {
+		if codec == "" {
+			return fmt.Errorf("empty audio passthrough codec")
+		}
+	}
+	return nil
+}
+
+// Encoder returns the ffmpeg encoder of the codec
+func (a *AudioEncoding) Encoder() string {
+	return audioEncoders[a.Codec]
+}
+
+// channels returns the channel count audio with source channels is mixed to
+func (a *AudioEncoding) channels(source int) int {
+	if n, ok := audioLayouts[a.Layout]; ok {
+		return n
+	}
+	if source <= 0 {
+		return 2
+	}
+	return min(source, audioMaxChannels[a.Codec])
+}
+
+// passthrough reports whether a source track is copied rather than
+// re-encoded
+func (a *AudioEncoding) passthrough(codec string, channels int) bool {
+	if n, ok := audioLayouts[a.Layout]; ok && channels > n {
+		return false
+	}
+	for _, c := range a.Passthrough {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// bitrate returns the bitrate in kbps of a re-encoded track with channels
+func (a *AudioEncoding) bitrate(channels int) int {
+	if a.BitrateKbps > 0 {
+		return a.BitrateKbps
+	}
+	if channels <= 0 {
+		channels = 2
+	}
+	rates := audioBitrates[a.Codec]
+	if kbps, ok := rates[channels]; ok {
+		return kbps
+	}
+	// Layouts without a default take the rate of the next larger one
+	best := 0
+	for n, kbps := range rates {
+		if n >= channels && (best == 0 || kbps < best) {
+			best = kbps
+		}
+	}
+	if best == 0 {
+		best = rates[2]
+	}
+	return best
+}
+
+// audioFormat returns the codec an audio encoder produces, e.g. "opus" for
+// "libopus"
+func audioFormat(encoder string) string {
+	for codec, e := range audioEncoders {
+		if e == encoder {
+			return codec
+		}
+	}
+	return encoder
+}
+
+// audioTitle is the title written on a track re-encoded to channels
+func audioTitle(channels int) string {
+	switch channels {
+	case 1:
+		return "Mono Optimized"
+	case 2:
+		return optimizedAudioTitle
+	case 6:
+		return "5.1 Optimized"
+	case 8:
+		return "7.1 Optimized"
+	}
+	return strconv.Itoa(channels) + "ch Optimized"
+}
+
+// applyAudioEncoding sets the codec, channels and title of the audio tracks
+// the plan re-encodes, and copies those that may pass through
+func (p *Plan) applyAudioEncoding(a *AudioEncoding, probe *ProbeResult) {
+	p.Audio = a
+	sources := make(map[int]ProbeStream)
+	for _, s := range probe.Streams {
+		sources[s.Index] = s
+	}
+	for i, m := range p.Streams {
+		if m.Type != "audio" || m.Action != ActionTranscode {
+			continue
+		}
+		src := sources[m.InputIndex]
+		if a.passthrough(src.CodecName, src.Channels) {
+			p.Streams[i].Action = ActionCopy
+			p.Streams[i].TargetCodec = src.CodecName
+			p.Streams[i].Channels = 0
+			p.Streams[i].Title = src.Tags["title"]
+			p.Streams[i].Reason = "audio passthrough"
+			continue
+		}
+		p.transcodeAudio(i, a, src.Channels)
+	}
+}
+
+// transcodeAudio re-encodes the plan's stream i, which has source channels,
+// with a
+func (p *Plan) transcodeAudio(i int, a *AudioEncoding, source int) {
+	channels := a.channels(source)
+	p.Streams[i].Action = ActionTranscode
+	p.Streams[i].TargetCodec = a.Encoder()
+	p.Streams[i].Channels = channels
+	p.Streams[i].Title = audioTitle(channels)
+}
+
+// audioBitrate returns the bitrate in kbps of a re-encoded audio track
+func (p *Plan) audioBitrate(m StreamMapping) int {
+	a := p.Audio
+	if a == nil {
+		a = &DefaultAudio
+	}
+	return a.bitrate(m.Channels)
+}
@@ -0,0 +1,156 @@
+package mediaopt
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+const (
+	// burnInSamples is the number of frames inspected across the duration
+	burnInSamples = 12
+	// textEdgeDensity is the mean edge luma above which the subtitle band
+	// is considered to contain text
+	textEdgeDensity = 6.0
+	// textEdgeContrast is how much busier the subtitle band must be than a
+	// band from the middle of the frame, so detailed scenes aren't mistaken
+	// for text
+	textEdgeContrast = 1.8
+	// burnInRatio is the share of sampled frames that must show text
+	burnInRatio = 0.4
+)
+
+// Frame bands compared by the detector, as ffmpeg crop expressions
+const (
+	subtitleBand = "crop=iw*0.8:ih*0.15:iw*0.1:ih*0.8"
+	middleBand   = "crop=iw*0.8:ih*0.15:iw*0.1:ih*0.425"
+)
+
+var yavgPattern = regexp.MustCompile(`lavfi\.signalstats\.YAVG=([0-9.]+)`)
+
+// BurnedSubtitleReport is the outcome of burned-in subtitle detection
+type BurnedSubtitleReport struct {
+	Detected bool `json:"detected"`
+	// Confidence is the share of sampled frames that looked like they
+	// carried text in the subtitle area
+	Confidence     float64 `json:"confidence"`
+	SampledFrames  int     `json:"sampledFrames"`
+	FramesWithText int     `json:"framesWithText"`
+}
+
+// edgeSample is the edge density of the subtitle and middle bands of a frame
+type edgeSample struct {
+	subtitle float64
+	middle   float64
+}
+
+// DetectBurnedSubtitles samples frames across the video and compares edge
+// density in the lower area where subtitles are drawn against the middle of
+// the frame. Hardcoded subtitles show up as dense, high-contrast edges that
+// recur in the same band across many frames. This is a heuristic, not OCR.
+func DetectBurnedSubtitles(path string, duration float64) (*BurnedSubtitleReport, error) {
+	if duration <= 0 {
+		return nil, fmt.Errorf("unknown duration, cannot sample frames")
+	}
+
+	var samples []edgeSample
+	for i := 0; i < burnInSamples; i++ {
+		// Skip the first and last 10%, where titles and credits live
+		at := duration * (0.1 + 0.8*float64(i)/float64(burnInSamples-1))
+		subtitle, err := edgeDensity(path, at, subtitleBand)
+		if err != nil {
+			return nil, err
+		}
+		middle, err := edgeDensity(path, at, middleBand)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, edgeSample{subtitle: subtitle, middle: middle})
+	}
+	return classifyEdgeSamples(samples), nil
+}
+
+// classifyEdgeSamples decides whether enough frames carry text
+func classifyEdgeSamples(samples []edgeSample) *BurnedSubtitleReport {
+	report := &BurnedSubtitleReport{SampledFrames: len(samples)}
+	for _, s := range samples {
+		if s.subtitle >= textEdgeDensity && s.subtitle >= s.middle*textEdgeContrast {
+			report.FramesWithText++
+		}
+	}
+	if report.SampledFrames > 0 {
+		report.Confidence = float64(report.FramesWithText) / float64(report.SampledFrames)
+	}
+	report.Detected = report.Confidence >= burnInRatio
+	return report
+}
+
+// edgeDensity returns the mean luma of the edge-detected band of the frame at
+// the given time
+func edgeDensity(path string, at float64, band string) (float64, error) {
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-nostats",
+		"-ss", strconv.FormatFloat(at, 'f', 3, 64),
+		"-i", path,
+		"-frames:v", "1",
+		"-vf", band+",edgedetect=low=0.2:high=0.5,signalstats,metadata=print:key=lavfi.signalstats.YAVG",
+		"-f", "null", "-",
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("frame sampling failed at %.1fs: %v", at, err)
+	}
+
+	m := yavgPattern.FindSubmatch(output)
+	if m == nil {
+		return 0, fmt.Errorf("no edge statistics for frame at %.1fs", at)
+	}
+	return strconv.ParseFloat(string(m[1]), 64)
+}
+
+// analyzeBurnedSubtitles runs detection when requested and adjusts the plan
+// for sources that have hardcoded subtitles. Detection failures are logged
+// and never fail the job.
+func analyzeBurnedSubtitles(params *OptimizationParams, input string, probe *ProbeResult, plan *Plan) *BurnedSubtitleReport {
+	if !params.DetectBurnedSubtitles || len(probe.StreamsOfType("video")) == 0 {
+		return nil
+	}
+
+	report, err := DetectBurnedSubtitles(input, probe.DurationSeconds())
+	if err != nil {
+		logError("Burned-in subtitle detection failed for %s: %v", params.InputFile, err)
+		return nil
+	}
+	if report.Detected {
+		warning := suppressSubtitleDisplay(plan)
+		plan.Warnings = append(plan.Warnings, warning)
+		logInfo("%s: %s (confidence %.2f)", params.InputFile, warning, report.Confidence)
+	}
+	return report
+}
+
+// suppressSubtitleDisplay clears default and forced flags on kept subtitle
+// streams so players don't draw a second layer over burned-in subtitles.
+// The tracks themselves are kept. It returns the plan's warning, if any.
+func suppressSubtitleDisplay(plan *Plan) string {
+	suppressed := 0
+	for i, m := range plan.Streams {
+		if m.Type != "subtitle" || m.Action == ActionDrop {
+			continue
+		}
+		var kept []string
+		for _, d := range m.Disposition {
+			if d != "default" && d != "forced" {
+				kept = append(kept, d)
+			}
+		}
+		if len(kept) != len(m.Disposition) {
+			suppressed++
+		}
+		plan.Streams[i].Disposition = kept
+	}
+	if suppressed == 0 {
+		return "source appears to have burned-in subtitles"
+	}
+	return fmt.Sprintf("source appears to have burned-in subtitles; automatic display was disabled on %d subtitle track(s)", suppressed)
+}
@@ -0,0 +1,183 @@
+package mediaopt
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+)
+
+// Complexity analysis: a fast reference encode of a few short clips, whose
+// size per pixel tells how hard the source is to compress
+const (
+	complexitySamples = 4
+	complexityFrames  = 96
+	// referenceBitsPerPixel is the reference encode's usual size for live
+	// action without notable grain
+	referenceBitsPerPixel = 0.1
+	// crfPerDoubling is the CRF taken off for each doubling of the size
+	crfPerDoubling = 2
+	// defaultCRFRange and the bitrate factors bound the adjustment when
+	// PerTitle leaves the bounds out
+	defaultCRFRange         = 4
+	defaultMinBitrateFactor = 0.5
+	defaultMaxBitrateFactor = 1.5
+)
+
+// PerTitle adjusts the rate control of re-encoded video to the complexity of
+// each source: simple content such as animation gets a higher CRF or a lower
+// bitrate, busy and grainy content a lower CRF or a higher bitrate
+type PerTitle struct {
+	// MinCRF and MaxCRF bound the CRF of crf and capped-crf encodes; both
+	// zero allow defaultCRFRange either side of the configured CRF
+	MinCRF int `json:"minCrf,omitempty"`
+	MaxCRF int `json:"maxCrf,omitempty"`
+	// MinBitrateKbps and MaxBitrateKbps bound the bitrate of two-pass
+	// encodes; both zero allow half to 1.5 times the configured bitrate
+	MinBitrateKbps int `json:"minBitrateKbps,omitempty"`
+	MaxBitrateKbps int `json:"maxBitrateKbps,omitempty"`
+}
+
+// Validate checks that the bounds are usable
+func (t *PerTitle) Validate() error {
+	if t.MinCRF < 0 || t.MaxCRF < t.MinCRF {
+		return fmt.Errorf("per-title CRF bounds must satisfy 0 <= minCrf <= maxCrf")
+	}
+	if t.MinBitrateKbps < 0 || t.MaxBitrateKbps < t.MinBitrateKbps {
+		return fmt.Errorf("per-title bitrate bounds must satisfy 0 <= minBitrateKbps <= maxBitrateKbps")
+	}
+	return nil
+}
+
+// crfBounds returns the CRF range around crf
+func (t *PerTitle) crfBounds(crf int) (int, int) {
+	if t.MinCRF == 0 && t.MaxCRF == 0 {
+		return max(crf-defaultCRFRange, 0), crf + defaultCRFRange
+	}
+	return t.MinCRF, t.MaxCRF
+}
+
+// bitrateBounds returns the bitrate range around kbps
+func (t *PerTitle) bitrateBounds(kbps int) (int, int) {
+	if t.MinBitrateKbps == 0 && t.MaxBitrateKbps == 0 {
+		return int(float64(kbps) * defaultMinBitrateFactor), int(float64(kbps) * defaultMaxBitrateFactor)
+	}
+	return t.MinBitrateKbps, t.MaxBitrateKbps
+}
+
+// Complexity is how hard the source was measured to be to encode
+type Complexity struct {
+	// BitsPerPixel is the size of the reference encode per pixel of each
+	// frame, around 0.1 for typical live action
+	BitsPerPixel float64 `json:"bitsPerPixel"`
+}
+
+// perTitle reports whether the plan adjusts its rate control to the source
+func (p *Plan) perTitle() bool {
+	if p.Encoding == nil || p.Encoding.PerTitle == nil {
+		return false
+	}
+	for _, m := range p.Streams {
+		if m.Type == "video" && m.Action == ActionTranscode {
+			return true
+		}
+	}
+	return false
+}
+
+// adjust returns a copy of e with its CRF or bitrate moved by the measured
+// complexity, within the PerTitle bounds
+func (c *Complexity) adjust(e *VideoEncoding) *VideoEncoding {
+	adjusted := *e
+	ratio := math.Log2(c.BitsPerPixel / referenceBitsPerPixel)
+	switch e.RateControl {
+	case RateTwoPass:
+		lo, hi := e.PerTitle.bitrateBounds(e.BitrateKbps)
+		kbps := int(math.Round(float64(e.BitrateKbps) * math.Exp2(ratio/2)))
+		adjusted.BitrateKbps = min(max(kbps, lo), hi)
+	default:
+		lo, hi := e.PerTitle.crfBounds(e.CRF)
+		crf := e.CRF - int(math.Round(ratio*crfPerDoubling))
+		adjusted.CRF = min(max(crf, lo), hi)
+	}
+	return &adjusted
+}
+
+// describeRate returns the rate control for logs
+func (e *VideoEncoding) describeRate() string {
+	if e.RateControl == RateTwoPass {
+		return fmt.Sprintf("%d kbps", e.BitrateKbps)
+	}
+	return fmt.Sprintf("CRF %d", e.CRF)
+}
+
+// measureComplexity encodes short clips of the first video stream at evenly
+// spread points of the input with a fast reference encoder and returns
+// their size per pixel
+func measureComplexity(path string, probe *ProbeResult) (*Complexity, error) {
+	video := probe.StreamsOfType("video")
+	if len(video) == 0 || video[0].Width <= 0 || video[0].Height <= 0 {
+		return nil, fmt.Errorf("no video to analyse")
+	}
+
+	duration, fps := probe.DurationSeconds(), probe.VideoFrameRate()
+	var bytes, frames int64
+	for i := 0; i < complexitySamples; i++ {
+		start := 0.0
+		if duration > 0 {
+			start = duration * float64(i+1) / float64(complexitySamples+1)
+		}
+		args := []string{"-hide_banner", "-nostats", "-v", "error", "-ss", formatSeconds(start), "-i", path,
+			"-map", "0:v:0", "-frames:v", strconv.Itoa(complexityFrames),
+			"-c:v", "libx264", "-preset", "ultrafast", "-crf", "23",
+			"-an", "-sn", "-dn", "-f", "h264", "-"}
+		cmd := exec.Command("ffmpeg", args...)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, fmt.Errorf("complexity analysis failed: %v", err)
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("complexity analysis failed: %v", err)
+		}
+		n, copyErr := io.Copy(io.Discard, stdout)
+		if err := cmd.Wait(); err != nil {
+			return nil, fmt.Errorf("complexity analysis failed: %v", err)
+		}
+		if copyErr != nil {
+			return nil, fmt.Errorf("complexity analysis failed: %v", copyErr)
+		}
+		encoded := int64(complexityFrames)
+		if duration > 0 && fps > 0 {
+			// Clips of short sources end before the frame limit
+			encoded = min(encoded, int64((duration-start)*fps))
+		}
+		bytes += n
+		frames += encoded
+	}
+	if bytes == 0 || frames <= 0 {
+		return nil, fmt.Errorf("complexity analysis encoded no video")
+	}
+	pixels := float64(video[0].Width) * float64(video[0].Height) * float64(frames)
+	return &Complexity{BitsPerPixel: float64(bytes) * 8 / pixels}, nil
+}
+
+// analyzeComplexity measures the source and adjusts the plan's rate control
+// when it asks for per-title encoding. Failures are logged and the
+// configured rate control is kept.
+func analyzeComplexity(params *OptimizationParams, input string, probe *ProbeResult, plan *Plan) {
+	if !plan.perTitle() {
+		return
+	}
+	complexity, err := measureComplexity(input, probe)
+	if err != nil {
+		logError("Complexity analysis failed for %s: %v", params.InputFile, err)
+		plan.Warnings = append(plan.Warnings, "complexity analysis failed; the configured rate control is used")
+		return
+	}
+	plan.Complexity = complexity
+	plan.Encoding = complexity.adjust(plan.Encoding)
+	msg := fmt.Sprintf("%.3f bits per pixel, encoding at %s", complexity.BitsPerPixel, plan.Encoding.describeRate())
+	logInfo("%s: %s", params.InputFile, msg)
+	params.output("info", "Complexity: "+msg)
+}
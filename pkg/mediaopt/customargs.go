@@ -0,0 +1,117 @@
+package mediaopt
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CustomArgs are extra ffmpeg options for needs the structured settings
+// don't cover yet. Each entry is one option and its value, if any, separated
+// by the first space, e.g. "-tune film" or "-metadata title=Director's Cut".
+// Input options precede the input, output options follow the plan's and so
+// override them.
+type CustomArgs struct {
+	Input  []string `json:"input,omitempty"`
+	Output []string `json:"output,omitempty"`
+}
+
+// blockedOptions are the ffmpeg options custom arguments may not set: those
+// reading or writing files other than the job's, running commands, or
+// taking over what the server manages, such as stream mapping and progress
+// reporting. Stream specifiers are ignored, so "map" also blocks "-map:v".
+var blockedOptions = map[string]bool{
+	"i": true, "y": true, "n": true, "map": true, "filter_script": true,
+	"filter_complex": true, "filter_complex_script": true, "lavfi": true,
+	"attach": true, "dump_attachment": true, "pass": true, "passlogfile": true,
+	"progress": true, "report": true, "vstats": true, "vstats_file": true,
+	"sdp_file": true, "protocol_whitelist": true, "protocol_blacklist": true,
+	"hls_segment_filename": true, "segment_list": true, "master_pl_name": true,
+	"init_seg_name": true, "media_seg_name": true,
+}
+
+// blockedFilters read files or take commands from outside the job
+var blockedFilters = regexp.MustCompile(`(^|[,;\[\]=\s])(a?movie|a?sendcmd|a?zmq)\s*(=|,|;|$)`)
+
+// optionName matches an option with an optional stream specifier. It leaves
+// out ffmpeg 6's "-/option", which reads the value from a file.
+var optionName = regexp.MustCompile(`^-([a-zA-Z0-9_][a-zA-Z0-9_-]*)(:\S*)?$`)
+
+// pathValue matches absolute and home paths anywhere in a value, e.g.
+// "/etc" or "subtitles=/media/other.srt", but not "scale=iw/2"
+var pathValue = regexp.MustCompile(`(^|[=:,;'"\[\s])[/~]`)
+
+// Validate checks that the entries are well-formed options that aren't
+// blocked
+func (c *CustomArgs) Validate() error {
+	for _, entries := range [][]string{c.Input, c.Output} {
+		for _, entry := range entries {
+			if err := validateCustomArg(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateCustomArg(entry string) error {
+	name, value, _ := strings.Cut(strings.TrimSpace(entry), " ")
+	value = strings.TrimSpace(value)
+	m := optionName.FindStringSubmatch(name)
+	if m == nil {
+		return fmt.Errorf("custom argument %q must start with an option such as -tune", entry)
+	}
+	if blockedOptions[m[1]] {
+		return fmt.Errorf("custom argument option %s is not allowed", name)
+	}
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return fmt.Errorf("custom argument %q contains a control character", entry)
+	}
+	// Paths and URLs would let an option read or write other files
+	if pathValue.MatchString(value) || strings.Contains(value, "..") || strings.Contains(value, "://") || strings.Contains(value, `\`) {
+		return fmt.Errorf("custom argument %q must not contain a path or URL", entry)
+	}
+	if blockedFilters.MatchString(value) {
+		return fmt.Errorf("custom argument %q uses a filter that is not allowed", entry)
+	}
+	return nil
+}
+
+// customArgs splits entries into ffmpeg arguments
+func customArgs(entries []string) []string {
+	var args []string
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(strings.TrimSpace(entry), " ")
+		args = append(args, name)
+		if value = strings.TrimSpace(value); ok && value != "" {
+			args = append(args, value)
+		}
+	}
+	return args
+}
+
+// inputArgsEnv passes the options preceding the input to the optimization
+// script, one argument per line
+const inputArgsEnv = "MEDIA_OPTIMIZER_INPUT_ARGS"
+
+// inputArgs returns the options preceding the input of an encode: the read
+// rate of the priority and the custom ones
+func inputArgs(params *OptimizationParams, plan *Plan) []string {
+	return append(params.Priority.inputArgs(), plan.InputArgs()...)
+}
+
+// InputArgs returns the custom options preceding the input
+func (p *Plan) InputArgs() []string {
+	if p.CustomArgs == nil {
+		return nil
+	}
+	return customArgs(p.CustomArgs.Input)
+}
+
+// customOutputArgs returns the custom options following the plan's
+func (p *Plan) customOutputArgs() []string {
+	if p.CustomArgs == nil {
+		return nil
+	}
+	return customArgs(p.CustomArgs.Output)
+}
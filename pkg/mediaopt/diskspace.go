@@ -0,0 +1,135 @@
+package mediaopt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// TargetAudioBitrate is the bitrate of each re-encoded audio track (bits/s)
+	TargetAudioBitrate = 384000
+	// diskSpaceMargin pads the size estimate to cover container overhead
+	diskSpaceMargin = 1.1
+)
+
+// EstimateOutputSize predicts the size in bytes of the optimized file. Video is
+// copied, so its share of the input is kept, while audio is re-encoded at
+// TargetAudioBitrate per track. Falls back to the input size when ffprobe
+// reports too little to work with.
+func EstimateOutputSize(probe *ProbeResult, inputSize int64) int64 {
+	duration := probe.DurationSeconds()
+	if duration <= 0 {
+		return inputSize
+	}
+
+	var videoBits float64
+	for _, s := range probe.StreamsOfType("video") {
+		if br, err := strconv.ParseFloat(s.BitRate, 64); err == nil {
+			videoBits += br * duration
+		}
+	}
+
+	// MKV rarely reports per-stream bitrates, so derive video from the
+	// container bitrate minus the source audio
+	if videoBits == 0 {
+		total, err := strconv.ParseFloat(probe.Format.BitRate, 64)
+		if err != nil || total <= 0 {
+			return inputSize
+		}
+		var audioRate float64
+		for _, s := range probe.StreamsOfType("audio") {
+			if br, err := strconv.ParseFloat(s.BitRate, 64); err == nil {
+				audioRate += br
+			}
+		}
+		videoBits = (total - audioRate) * duration
+	}
+
+	audioBits := float64(len(probe.StreamsOfType("audio"))) * TargetAudioBitrate * duration
+	return int64((videoBits + audioBits) / 8)
+}
+
+// estimateSize predicts the output size for params. A remux copies every
+// stream, so the output is about as large as the input, and a target size
+// encode is as large as requested.
+func estimateSize(params *OptimizationParams, probe *ProbeResult, inputSize int64) int64 {
+	if params.Remux {
+		return inputSize
+	}
+	if params.TargetSize > 0 {
+		return params.TargetSize
+	}
+	return EstimateOutputSize(probe, inputSize)
+}
+
+// CheckDiskSpace verifies that the destination volume can hold the estimated
+// output, which is encoded next to its final path
+func CheckDiskSpace(params *OptimizationParams, probe *ProbeResult) error {
+	info, err := os.Stat(params.InputFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat input file: %v", err)
+	}
+
+	required := uint64(float64(estimateSize(params, probe, info.Size())) * diskSpaceMargin)
+	dir := filepath.Dir(params.OutputFile)
+	free, err := freeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check free space on %s: %v", dir, err)
+	}
+	if free < required {
+		return fmt.Errorf("insufficient disk space on %s: need %s, have %s free",
+			dir, formatBytes(required), formatBytes(free))
+	}
+	return nil
+}
+
+// FreeSpace returns the bytes available on the volume holding dir
+func FreeSpace(dir string) (uint64, error) {
+	return freeSpace(dir)
+}
+
+// sizeUnits are the suffixes accepted by ParseSize
+var sizeUnits = []struct {
+	suffix string
+	factor float64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"tb", 1e12},
+	{"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"t", 1e12},
+	{"b", 1},
+}
+
+// ParseSize parses sizes such as "4GB", "700 MB" or "4.5GiB" into bytes.
+// Decimal units are powers of 1000, as on disc and drive labels.
+func ParseSize(s string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	factor := 1.0
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v, factor = strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * factor), nil
+}
+
+// formatBytes renders a byte count using binary units
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
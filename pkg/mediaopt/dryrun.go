@@ -0,0 +1,138 @@
+package mediaopt
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// sampleDuration is the length in seconds of the sample encode used for estimates
+const sampleDuration = 30.0
+
+// DryRunReport describes what an optimization would do without producing output
+type DryRunReport struct {
+	InputFile              string  `json:"inputFile"`
+	OutputFile             string  `json:"outputFile"`
+	Plan                   *Plan   `json:"plan"`
+	Summary                string  `json:"summary"`
+	Duration               float64 `json:"duration"`
+	InputSize              int64   `json:"inputSize"`
+	EstimatedSize          int64   `json:"estimatedSize"`
+	EstimatedSavings       int64   `json:"estimatedSavings"`
+	SampleSeconds          float64 `json:"sampleSeconds"`
+	EncodeSpeed            float64 `json:"encodeSpeed"`
+	EstimatedEncodeSeconds float64 `json:"estimatedEncodeSeconds"`
+	// BurnedSubtitles is set when burned-in subtitle detection ran
+	BurnedSubtitles *BurnedSubtitleReport `json:"burnedSubtitles,omitempty"`
+	// Segments is set when black/silent segment detection ran
+	Segments *SegmentReport `json:"segments,omitempty"`
+}
+
+// DryRun probes the input, builds the plan and runs a short sample encode to
+// estimate output size and encode time. Nothing is written next to the input.
+func DryRun(params *OptimizationParams) (*DryRunReport, error) {
+	info, err := os.Stat(params.InputFile)
+	if err != nil {
+		return nil, fmt.Errorf("input file does not exist: %s", params.InputFile)
+	}
+
+	input := params.InputFile
+	if IsDiscImage(params.InputFile) {
+		disc, err := OpenDiscImage(params.InputFile, params.TempDir)
+		if err != nil {
+			return nil, err
+		}
+		defer disc.Close()
+		input = disc.Input
+	}
+
+	probe, err := Probe(input)
+	if err != nil {
+		return nil, err
+	}
+
+	languages := tagLanguages(params.Languages, input, params.InputFile, probe)
+	plan, err := buildPlan(params, probe)
+	if err != nil {
+		return nil, err
+	}
+	plan.markLanguageSources(languages)
+	if err := applyOutputName(params, plan, probe); err != nil {
+		return nil, err
+	}
+	burnIn := analyzeBurnedSubtitles(params, input, probe, plan)
+	segments := analyzeSegments(params, input, probe, plan)
+	analyzeCrop(params, input, probe, plan)
+	analyzeInterlace(params, input, probe, plan)
+	analyzeComplexity(params, input, probe, plan)
+	report := &DryRunReport{
+		InputFile:       params.InputFile,
+		OutputFile:      params.OutputFile,
+		Plan:            plan,
+		Summary:         plan.Summary(),
+		Duration:        probe.DurationSeconds(),
+		InputSize:       info.Size(),
+		EstimatedSize:   estimateSize(params, probe, info.Size()),
+		BurnedSubtitles: burnIn,
+		Segments:        segments,
+	}
+
+	if report.Duration > 0 {
+		if err := sampleEncode(input, params.TempDir, plan, report); err != nil {
+			// The probe-based estimate is still useful on its own
+			logError("Sample encode failed for %s: %v", params.InputFile, err)
+		}
+	}
+
+	report.EstimatedSavings = report.InputSize - report.EstimatedSize
+	return report, nil
+}
+
+// sampleEncode encodes a short segment from the middle of the input and
+// extrapolates size and speed to the full duration
+func sampleEncode(input, tempDir string, plan *Plan, report *DryRunReport) error {
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+
+	length := sampleDuration
+	start := (report.Duration - length) / 2
+	if report.Duration <= length {
+		length = report.Duration
+		start = 0
+	}
+
+	samplePath := filepath.Join(tempDir, fmt.Sprintf("sample_%d.%s", time.Now().UnixNano(), plan.Container))
+	defer os.Remove(samplePath)
+
+	args := []string{
+		"-v", "error", "-y",
+		"-ss", formatSeconds(start),
+		"-t", formatSeconds(length),
+		"-i", input,
+	}
+	args = append(args, plan.OutputArgs()...)
+	args = append(args, samplePath)
+
+	began := time.Now()
+	if output, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	elapsed := time.Since(began).Seconds()
+
+	info, err := os.Stat(samplePath)
+	if err != nil {
+		return fmt.Errorf("sample output missing: %v", err)
+	}
+
+	scale := report.Duration / length
+	report.SampleSeconds = length
+	report.EstimatedSize = int64(float64(info.Size()) * scale)
+	if elapsed > 0 {
+		report.EncodeSpeed = length / elapsed
+		report.EstimatedEncodeSeconds = elapsed * scale
+	}
+	return nil
+}
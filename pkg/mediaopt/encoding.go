@@ -0,0 +1,670 @@
+package mediaopt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"media_optimizer/pkg/gpu"
+)
+
+// Video rate control modes
+const (
+	// RateCRF is constant quality; output size follows the content
+	RateCRF = "crf"
+	// RateCappedCRF is constant quality with a VBV bitrate ceiling
+	RateCappedCRF = "capped-crf"
+	// RateTwoPass is two-pass VBR at an average bitrate
+	RateTwoPass = "two-pass"
+)
+
+// encoderFormats maps supported video encoders to the codec they produce
+var encoderFormats = map[string]string{
+	"libx265":    "hevc",
+	"hevc":       "hevc",
+	"libx264":    "h264",
+	"h264":       "h264",
+	"hevc_nvenc": "hevc",
+	"h264_nvenc": "h264",
+	"libsvtav1":  "av1",
+	"libvpx-vp9": "vp9",
+}
+
+// SVT-AV1 limits
+const (
+	// svtMaxPreset is SVT-AV1's fastest preset, 0 being the slowest
+	svtMaxPreset = 13
+	svtMaxCRF    = 63
+	// MaxFilmGrain is the strongest film grain synthesis
+	MaxFilmGrain = 50
+	// grainFilmGrain is the film grain synthesis of Grain encodes that
+	// don't set FilmGrain, suiting typical 35mm grain
+	grainFilmGrain = 8
+)
+
+// svtPresets maps the x264 preset names to the SVT-AV1 preset of a similar
+// trade-off, so a profile switching to AV1 may keep the global preset
+var svtPresets = map[string]int{
+	"ultrafast": 12,
+	"superfast": 11,
+	"veryfast":  10,
+	"faster":    9,
+	"fast":      8,
+	"medium":    6,
+	"slow":      5,
+	"slower":    4,
+	"veryslow":  2,
+	"placebo":   0,
+}
+
+// libvpx-vp9 limits
+const (
+	// vpxMaxCPUUsed is libvpx's fastest -cpu-used, 0 being the slowest
+	vpxMaxCPUUsed = 8
+	vpxMaxCRF     = 63
+	// MaxTileColumns is the most tile columns, as a log2, VP9 allows
+	MaxTileColumns = 6
+)
+
+// vpxCPUUsed maps the x264 preset names to the libvpx -cpu-used of a
+// similar trade-off
+var vpxCPUUsed = map[string]int{
+	"ultrafast": 8,
+	"superfast": 7,
+	"veryfast":  6,
+	"faster":    5,
+	"fast":      4,
+	"medium":    3,
+	"slow":      2,
+	"slower":    1,
+	"veryslow":  0,
+	"placebo":   0,
+}
+
+// softwareEncoders maps hardware encoders to the software encoder used when
+// no hardware session is free
+var softwareEncoders = map[string]string{
+	"hevc_nvenc": "libx265",
+	"h264_nvenc": "libx264",
+}
+
+// nvencPreset matches the NVENC-only presets p1 (fastest) to p7 (slowest)
+var nvencPreset = regexp.MustCompile(`^p[1-7]$`)
+
+// VideoEncoding configures how video streams are re-encoded
+type VideoEncoding struct {
+	// Transcode re-encodes video that isn't already in Codec's format. When
+	// false video is copied unless a stream mapping asks for a transcode.
+	Transcode bool `json:"transcode"`
+	// Codec is the ffmpeg encoder, e.g. "libx265", "libx264", the NVENC
+	// hardware encoders "hevc_nvenc" and "h264_nvenc", "libsvtav1" for
+	// AV1 or "libvpx-vp9" for VP9, which is written as WebM
+	Codec string `json:"codec"`
+	// Preset is the encoder's speed preset, e.g. "medium", or 0 (slowest)
+	// to 13 for SVT-AV1 and the -cpu-used of 0 (slowest) to 8 for
+	// libvpx-vp9, which both take the x264 names too
+	Preset string `json:"preset,omitempty"`
+	// RateControl is RateCRF, RateCappedCRF or RateTwoPass
+	RateControl string `json:"rateControl"`
+	CRF         int    `json:"crf,omitempty"`
+	// BitrateKbps is the average bitrate of a two-pass encode
+	BitrateKbps int `json:"bitrateKbps,omitempty"`
+	// MaxBitrateKbps is the ceiling of a capped-CRF encode
+	MaxBitrateKbps int `json:"maxBitrateKbps,omitempty"`
+	// FilmGrain has SVT-AV1 strip the grain before encoding and synthesize
+	// it again on playback, at a strength from 1 to MaxFilmGrain; zero
+	// encodes the grain as is
+	FilmGrain int `json:"filmGrain,omitempty"`
+	// FilmGrainDenoise removes the grain from the encoded picture rather
+	// than only modelling it, which saves more bits but softens detail
+	FilmGrainDenoise bool `json:"filmGrainDenoise,omitempty"`
+	// Grain tunes the encoder for grainy film rather than smoothing the
+	// grain away: x264 and x265 use their grain tuning, SVT-AV1 synthesizes
+	// the grain (at FilmGrain, or grainFilmGrain when unset) and libvpx-vp9
+	// tunes for film
+	Grain bool `json:"grain,omitempty"`
+	// RowMT has libvpx-vp9 encode rows of a tile in parallel, using more
+	// threads without changing the output much
+	RowMT bool `json:"rowMT,omitempty"`
+	// TileColumns splits libvpx-vp9 frames into 2^TileColumns columns, up to
+	// MaxTileColumns, which threads encode and players decode in parallel
+	TileColumns int `json:"tileColumns,omitempty"`
+	// PerTitle adjusts the CRF or bitrate to each source's complexity,
+	// measured in the analysis stage; nil encodes every source alike
+	PerTitle *PerTitle `json:"perTitle,omitempty"`
+}
+
+// Validate checks that the settings describe a usable encode
+func (e *VideoEncoding) Validate() error {
+	if _, ok := encoderFormats[e.Codec]; !ok {
+		return fmt.Errorf("unsupported video encoder %q", e.Codec)
+	}
+	switch e.RateControl {
+	case RateCRF:
+	case RateCappedCRF:
+		if e.MaxBitrateKbps <= 0 {
+			return fmt.Errorf("capped-crf requires a maximum bitrate")
+		}
+	case RateTwoPass:
+		if e.BitrateKbps <= 0 {
+			return fmt.Errorf("two-pass requires a bitrate")
+		}
+	default:
+		return fmt.Errorf("unknown rate control %q", e.RateControl)
+	}
+	if isSVTAV1(e.Codec) {
+		if _, ok := svtPreset(e.Preset); !ok {
+			return fmt.Errorf("SVT-AV1 preset must be 0 to %d or an x264 preset name, got %q", svtMaxPreset, e.Preset)
+		}
+		if e.CRF < 0 || e.CRF > svtMaxCRF {
+			return fmt.Errorf("SVT-AV1 CRF must be 0 to %d", svtMaxCRF)
+		}
+	}
+	if isVPX(e.Codec) {
+		if _, ok := vpxPreset(e.Preset); !ok {
+			return fmt.Errorf("libvpx-vp9 preset must be 0 to %d or an x264 preset name, got %q", vpxMaxCPUUsed, e.Preset)
+		}
+		if e.CRF < 0 || e.CRF > vpxMaxCRF {
+			return fmt.Errorf("libvpx-vp9 CRF must be 0 to %d", vpxMaxCRF)
+		}
+	}
+	if e.RowMT || e.TileColumns != 0 {
+		if !isVPX(e.Codec) {
+			return fmt.Errorf("row-mt and tile columns require libvpx-vp9")
+		}
+		if e.TileColumns < 0 || e.TileColumns > MaxTileColumns {
+			return fmt.Errorf("tile columns must be 0 to %d", MaxTileColumns)
+		}
+	}
+	if e.Grain && isNVENC(e.Codec) {
+		return fmt.Errorf("NVENC has no grain tuning; use a software encoder for grainy sources")
+	}
+	if e.PerTitle != nil {
+		if err := e.PerTitle.Validate(); err != nil {
+			return err
+		}
+	}
+	if e.FilmGrain != 0 || e.FilmGrainDenoise {
+		if !isSVTAV1(e.Codec) {
+			return fmt.Errorf("film grain synthesis requires libsvtav1")
+		}
+		if e.FilmGrain < 0 || e.FilmGrain > MaxFilmGrain {
+			return fmt.Errorf("film grain must be 0 to %d", MaxFilmGrain)
+		}
+	}
+	return nil
+}
+
+// VideoEncoders returns the video encoders a VideoEncoding may use, sorted
+func VideoEncoders() []string {
+	var encoders []string
+	for encoder := range encoderFormats {
+		// "hevc" and "h264" name the formats' default encoders
+		if encoder != encoderFormats[encoder] {
+			encoders = append(encoders, encoder)
+		}
+	}
+	sort.Strings(encoders)
+	return encoders
+}
+
+// isX265 reports whether encoder is driven through -x265-params
+func isX265(encoder string) bool {
+	return encoder == "libx265" || encoder == "hevc"
+}
+
+// escapeParam escapes a value of a key=value:key=value option list such as
+// -x265-params, so paths with colons, quotes or backslashes in them stay
+// one value
+func escapeParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`, `=`, `\=`, `'`, `\'`).Replace(value)
+}
+
+// isSVTAV1 reports whether encoder is driven through -svtav1-params
+func isSVTAV1(encoder string) bool {
+	return encoder == "libsvtav1"
+}
+
+// svtPreset returns the SVT-AV1 preset number of preset, "" leaving
+// SVT-AV1's default
+func svtPreset(preset string) (string, bool) {
+	if preset == "" {
+		return "", true
+	}
+	if n, ok := svtPresets[preset]; ok {
+		return strconv.Itoa(n), true
+	}
+	n, err := strconv.Atoi(preset)
+	return preset, err == nil && n >= 0 && n <= svtMaxPreset
+}
+
+// isVPX reports whether encoder is libvpx, which is written as WebM
+func isVPX(encoder string) bool {
+	return encoder == "libvpx-vp9"
+}
+
+// vpxPreset returns the libvpx -cpu-used of preset, "" leaving libvpx's
+// default
+func vpxPreset(preset string) (string, bool) {
+	if preset == "" {
+		return "", true
+	}
+	if n, ok := vpxCPUUsed[preset]; ok {
+		return strconv.Itoa(n), true
+	}
+	n, err := strconv.Atoi(preset)
+	return preset, err == nil && n >= 0 && n <= vpxMaxCPUUsed
+}
+
+// isNVENC reports whether encoder runs on an NVIDIA GPU
+func isNVENC(encoder string) bool {
+	_, ok := softwareEncoders[encoder]
+	return ok
+}
+
+// hardwareEncode reports whether the plan re-encodes video on a GPU
+func (p *Plan) hardwareEncode() bool {
+	for _, m := range p.Streams {
+		if m.Type == "video" && m.Action == ActionTranscode && isNVENC(m.TargetCodec) {
+			return true
+		}
+	}
+	return false
+}
+
+// assignGPU takes an encoder session from pool for a plan that encodes on a
+// GPU. When every session is taken the video is encoded in software instead
+// of failing to open the encoder. The returned function releases the
+// session. A nil pool leaves sessions unmanaged.
+func (p *Plan) assignGPU(pool *gpu.Pool) func() {
+	if pool == nil || !p.hardwareEncode() {
+		return func() {}
+	}
+	if index, release, ok := pool.Acquire(); ok {
+		p.GPU = &index
+		return release
+	}
+
+	// The HDR warnings depend on the encoder and are made again below
+	stale := p.hdrWarnings()
+	for i, m := range p.Streams {
+		if software, ok := softwareEncoders[m.TargetCodec]; ok && m.Action == ActionTranscode {
+			p.Streams[i].TargetCodec = software
+			p.VideoCodec = software
+		}
+	}
+	if p.Encoding != nil {
+		encoding := *p.Encoding
+		encoding.Codec = softwareEncoders[encoding.Codec]
+		if nvencPreset.MatchString(encoding.Preset) {
+			encoding.Preset = "medium"
+		}
+		p.Encoding = &encoding
+	}
+	p.Warnings = slices.DeleteFunc(p.Warnings, func(w string) bool { return slices.Contains(stale, w) })
+	p.Warnings = append(p.Warnings, p.hdrWarnings()...)
+	p.Warnings = append(p.Warnings, "all GPU encoder sessions are in use; encoding with "+p.VideoCodec+" instead")
+	return func() {}
+}
+
+// applyVideoEncoding switches the first kept video stream to a transcode when
+// the settings ask for it and the source isn't in the target format already
+func (p *Plan) applyVideoEncoding(e *VideoEncoding) {
+	p.Encoding = e
+	if !e.Transcode {
+		return
+	}
+	for i, m := range p.Streams {
+		if m.Type != "video" || m.Action != ActionCopy {
+			continue
+		}
+		if m.SourceCodec != encoderFormats[e.Codec] {
+			p.Streams[i].Action = ActionTranscode
+			p.Streams[i].TargetCodec = e.Codec
+			p.VideoCodec = e.Codec
+		}
+		return
+	}
+}
+
+// limitHeight re-encodes the first kept video stream when it is taller than
+// maxHeight so it can be downscaled
+func (p *Plan) limitHeight(maxHeight int, probe *ProbeResult, base *VideoEncoding) {
+	p.MaxHeight = maxHeight
+	heights := make(map[int]int)
+	for _, s := range probe.Streams {
+		heights[s.Index] = s.Height
+	}
+
+	for i, m := range p.Streams {
+		if m.Type != "video" || m.Action == ActionDrop {
+			continue
+		}
+		if m.Action == ActionCopy && heights[m.InputIndex] > maxHeight {
+			codec := "libx265"
+			if base != nil {
+				codec = base.Codec
+			}
+			p.Streams[i].Action = ActionTranscode
+			p.Streams[i].TargetCodec = codec
+			p.VideoCodec = codec
+		}
+		return
+	}
+}
+
+// alignKeyframes re-encodes the first kept video stream with a keyframe
+// every seconds. Copied video keeps the source's irregular keyframes, so it is
+// re-encoded too.
+func (p *Plan) alignKeyframes(seconds float64, base *VideoEncoding) {
+	p.KeyframeSeconds = seconds
+	for i, m := range p.Streams {
+		if m.Type != "video" || m.Action == ActionDrop {
+			continue
+		}
+		if m.Action == ActionCopy {
+			codec := "libx265"
+			if base != nil {
+				codec = base.Codec
+			}
+			p.Streams[i].Action = ActionTranscode
+			p.Streams[i].TargetCodec = codec
+			p.VideoCodec = codec
+		}
+		return
+	}
+}
+
+// twoPass reports whether the plan re-encodes video in two passes. NVENC
+// analyses the video within a single run instead, and SVT-AV1, whose
+// statistics ffmpeg can't pass between runs, encodes the bitrate as
+// single-pass VBR.
+func (p *Plan) twoPass() bool {
+	if p.Encoding == nil || p.Encoding.RateControl != RateTwoPass {
+		return false
+	}
+	for _, m := range p.Streams {
+		if m.Type == "video" && m.Action == ActionTranscode && !isNVENC(m.TargetCodec) && !isSVTAV1(m.TargetCodec) {
+			return true
+		}
+	}
+	return false
+}
+
+// videoArgs returns the encoder options of a transcoded video stream. pass is
+// 1 or 2 for the passes of a two-pass encode and 0 otherwise.
+func (p *Plan) videoArgs(m StreamMapping, idx string, pass int) []string {
+	var args, x265, svtav1 []string
+	if e := p.Encoding; e != nil {
+		preset := e.Preset
+		if isSVTAV1(m.TargetCodec) {
+			preset, _ = svtPreset(preset)
+		}
+		switch {
+		case isVPX(m.TargetCodec):
+			args = append(args, p.vpxArgs(idx)...)
+		case preset != "":
+			args = append(args, "-preset:"+idx, preset)
+		}
+		switch {
+		case isNVENC(m.TargetCodec):
+			args = append(args, p.nvencArgs(idx)...)
+		case isVPX(m.TargetCodec) && e.RateControl == RateCappedCRF:
+			// libvpx caps constrained quality at its target bitrate
+			args = append(args,
+				"-crf:"+idx, strconv.Itoa(e.CRF),
+				"-b:"+idx, fmt.Sprintf("%dk", e.MaxBitrateKbps))
+		case isVPX(m.TargetCodec) && e.RateControl == RateCRF:
+			// Without a zero bitrate libvpx treats the CRF as a floor
+			args = append(args, "-crf:"+idx, strconv.Itoa(e.CRF), "-b:"+idx, "0")
+		case e.RateControl == RateCappedCRF:
+			args = append(args,
+				"-crf:"+idx, strconv.Itoa(e.CRF),
+				"-maxrate:"+idx, fmt.Sprintf("%dk", e.MaxBitrateKbps),
+				"-bufsize:"+idx, fmt.Sprintf("%dk", 2*e.MaxBitrateKbps))
+		case e.RateControl == RateTwoPass:
+			args = append(args, "-b:"+idx, fmt.Sprintf("%dk", e.BitrateKbps))
+			if pass > 0 && isX265(m.TargetCodec) {
+				x265 = append(x265, "pass="+strconv.Itoa(pass), "stats="+escapeParam(p.PassLogFile))
+			} else if pass > 0 {
+				args = append(args, "-pass:"+idx, strconv.Itoa(pass), "-passlogfile:"+idx, p.PassLogFile)
+			}
+		default:
+			args = append(args, "-crf:"+idx, strconv.Itoa(e.CRF))
+		}
+		if e.Grain {
+			args = append(args, grainArgs(m.TargetCodec, idx)...)
+		}
+		filmGrain := e.FilmGrain
+		if filmGrain == 0 && e.Grain {
+			filmGrain = grainFilmGrain
+		}
+		if filmGrain > 0 {
+			denoise := "0"
+			if e.FilmGrainDenoise {
+				denoise = "1"
+			}
+			svtav1 = append(svtav1, "film-grain="+strconv.Itoa(filmGrain), "film-grain-denoise="+denoise)
+		}
+	}
+
+	if p.KeyframeSeconds > 0 {
+		expr := "expr:gte(t,n_forced*" + strconv.FormatFloat(p.KeyframeSeconds, 'f', -1, 64) + ")"
+		args = append(args, "-force_key_frames:"+idx, expr)
+	}
+
+	hdr, toneMap, hdrX265 := p.hdrArgs(m, idx)
+	args = append(args, hdr...)
+	x265 = append(x265, hdrX265...)
+	svtav1 = append(svtav1, svtHDRParams(m, hdr != nil && toneMap == "")...)
+	if p.Threads > 0 {
+		// x265 sizes its thread pool itself and ignores -threads
+		x265 = append(x265, "pools="+strconv.Itoa(p.Threads))
+	}
+	filters := p.filterChain()
+	if toneMap != "" {
+		filters = append(filters, toneMap)
+	}
+	if p.MaxHeight > 0 {
+		// Scale only ever shrinks; the width follows the aspect ratio
+		filters = append(filters, fmt.Sprintf("scale=-2:'min(%d,ih)'", p.MaxHeight))
+	}
+	if len(filters) > 0 {
+		args = append(args, "-filter:"+idx, strings.Join(filters, ","))
+	}
+	if len(x265) > 0 && isX265(m.TargetCodec) {
+		args = append(args, "-x265-params:"+idx, strings.Join(x265, ":"))
+	}
+	if len(svtav1) > 0 && isSVTAV1(m.TargetCodec) {
+		args = append(args, "-svtav1-params:"+idx, strings.Join(svtav1, ":"))
+	}
+	return args
+}
+
+// nvencArgs returns the NVENC rate control options, where -cq takes the
+// place of -crf, and the GPU the session was assigned on
+func (p *Plan) nvencArgs(idx string) []string {
+	e := p.Encoding
+	args := []string{"-rc:" + idx, "vbr"}
+	switch e.RateControl {
+	case RateCappedCRF:
+		args = append(args,
+			"-cq:"+idx, strconv.Itoa(e.CRF),
+			"-maxrate:"+idx, fmt.Sprintf("%dk", e.MaxBitrateKbps),
+			"-bufsize:"+idx, fmt.Sprintf("%dk", 2*e.MaxBitrateKbps))
+	case RateTwoPass:
+		args = append(args, "-multipass:"+idx, "fullres", "-b:"+idx, fmt.Sprintf("%dk", e.BitrateKbps))
+	default:
+		args = append(args, "-cq:"+idx, strconv.Itoa(e.CRF), "-b:"+idx, "0")
+	}
+	if p.GPU != nil {
+		args = append(args, "-gpu:"+idx, strconv.Itoa(*p.GPU))
+	}
+	return args
+}
+
+// grainArgs returns the grain tuning of encoder. SVT-AV1 is tuned through
+// its film grain synthesis instead.
+func grainArgs(encoder, idx string) []string {
+	switch {
+	case isX265(encoder), encoder == "libx264", encoder == "h264":
+		return []string{"-tune:" + idx, "grain"}
+	case isVPX(encoder):
+		return []string{"-tune-content:" + idx, "film"}
+	}
+	return nil
+}
+
+// vpxArgs returns the libvpx-vp9 speed and threading options, which it takes
+// in place of -preset
+func (p *Plan) vpxArgs(idx string) []string {
+	e := p.Encoding
+	args := []string{"-deadline:" + idx, "good"}
+	if cpuUsed, _ := vpxPreset(e.Preset); cpuUsed != "" {
+		args = append(args, "-cpu-used:"+idx, cpuUsed)
+	}
+	if e.RowMT {
+		args = append(args, "-row-mt:"+idx, "1")
+	}
+	if e.TileColumns > 0 {
+		args = append(args, "-tile-columns:"+idx, strconv.Itoa(e.TileColumns))
+	}
+	return args
+}
+
+// FirstPassArgs returns the ffmpeg output options of the analysis pass of a
+// two-pass encode. Only video is encoded and the output is discarded.
+func (p *Plan) FirstPassArgs() []string {
+	var args []string
+	out := 0
+	for _, m := range p.Streams {
+		if m.Type != "video" || m.Action == ActionDrop {
+			continue
+		}
+		idx := strconv.Itoa(out)
+		args = append(args, "-map", "0:"+strconv.Itoa(m.InputIndex))
+		if m.Action == ActionCopy {
+			args = append(args, "-c:"+idx, "copy")
+		} else {
+			args = append(args, "-c:"+idx, m.TargetCodec)
+			args = append(args, p.videoArgs(m, idx, 1)...)
+		}
+		out++
+	}
+	args = append(args, p.threadArgs()...)
+	return append(args, "-an", "-sn", "-dn", "-f", "null")
+}
+
+// runFirstPass runs the analysis pass of a two-pass encode as a tracked
+// process so it can be cancelled like the main encode
+func runFirstPass(params *OptimizationParams, input string, plan *Plan, probe *ProbeResult, progress ProgressCallback) error {
+	args := append([]string{"-hide_banner", "-nostats", "-progress", "pipe:1", "-y"}, inputArgs(params, plan)...)
+	args = append(args, "-i", input)
+	args = append(args, plan.FirstPassArgs()...)
+	args = append(args, os.DevNull)
+
+	logInfo("Running first pass for %s", params.InputFile)
+	cmd := params.Priority.command(params.context(), "ffmpeg", args...)
+	cmd.Stderr = &lineWriter{stream: "stderr", params: params}
+	parser := newProgressParser(time.Now())
+	parser.duration = probe.DurationSeconds()
+	parser.frameRate = probe.VideoFrameRate()
+	cmd.Stdout = &lineWriter{stream: "stdout", params: params, onLine: func(line string) {
+		if detail, ok := parser.line(line, time.Now()); ok {
+			progress(detail.Percent)
+		}
+	}}
+	proc, err := startProcess(params.processKey(), cmd)
+	if err != nil {
+		return fmt.Errorf("failed to start first pass: %v", err)
+	}
+	defer func() {
+		activeProcesses.Lock()
+		delete(activeProcesses.procs, params.processKey())
+		activeProcesses.Unlock()
+	}()
+	if err := proc.wait(); err != nil {
+		return fmt.Errorf("first pass failed: %v", err)
+	}
+	return nil
+}
+
+// removePassLogs deletes the stats files written by both passes
+func removePassLogs(prefix string) {
+	matches, _ := filepath.Glob(prefix + "*")
+	for _, m := range matches {
+		os.Remove(m)
+	}
+}
+
+const (
+	// containerOverhead is the share of a target size reserved for muxing
+	containerOverhead = 0.02
+	// minVideoBitrateKbps is the lowest video bitrate a target size may
+	// leave before it is rejected as unreachable
+	minVideoBitrateKbps = 150
+)
+
+// fitToSize re-encodes the first kept video stream with two-pass VBR at the
+// bitrate that makes the output about target bytes, after subtracting the
+// kept audio and container overhead from the budget
+func (p *Plan) fitToSize(target int64, probe *ProbeResult, base *VideoEncoding) error {
+	duration := probe.DurationSeconds()
+	if duration <= 0 {
+		return fmt.Errorf("target size needs the source duration, which is unknown")
+	}
+
+	bitrates := make(map[int]float64)
+	for _, s := range probe.Streams {
+		if br, err := strconv.ParseFloat(s.BitRate, 64); err == nil {
+			bitrates[s.Index] = br
+		}
+	}
+
+	video := -1
+	var audioBits float64
+	for i, m := range p.Streams {
+		switch {
+		case m.Action == ActionDrop:
+		case m.Type == "video" && video < 0:
+			video = i
+		case m.Type == "audio" && m.Action == ActionTranscode:
+			audioBits += float64(p.audioBitrate(m)) * 1000 * duration
+		case m.Type == "audio":
+			audioBits += bitrates[m.InputIndex] * duration
+		}
+	}
+	if video < 0 {
+		return fmt.Errorf("target size requires a video stream")
+	}
+
+	budget := float64(target)*8*(1-containerOverhead) - audioBits
+	kbps := int(budget / duration / 1000)
+	if kbps < minVideoBitrateKbps {
+		return fmt.Errorf("target size %s is too small for %.0f minutes of video", formatBytes(uint64(target)), duration/60)
+	}
+
+	encoding := VideoEncoding{Codec: "libx265", Preset: "medium"}
+	if base != nil {
+		encoding = *base
+	}
+	encoding.RateControl = RateTwoPass
+	encoding.BitrateKbps = kbps
+	// The size is fixed, whatever the content
+	encoding.PerTitle = nil
+	p.Encoding = &encoding
+
+	m := &p.Streams[video]
+	if m.Action == ActionCopy {
+		m.Action = ActionTranscode
+		m.TargetCodec = encoding.Codec
+	}
+	p.VideoCodec = m.TargetCodec
+	return nil
+}
@@ -0,0 +1,410 @@
+package mediaopt
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// Deinterlacing filters
+const (
+	// DeinterlaceYadif deinterlaces every frame with yadif, one output frame
+	// per input frame
+	DeinterlaceYadif = "yadif"
+	// DeinterlaceAuto deinterlaces with yadif only when the source is
+	// interlaced, going by its field order and an idet scan
+	DeinterlaceAuto = "auto"
+)
+
+// Denoise filters
+const (
+	// DenoiseHQDN3D is the fast spatio-temporal denoiser
+	DenoiseHQDN3D = "hqdn3d"
+	// DenoiseNLMeans is the slower non-local means denoiser, which keeps
+	// more detail
+	DenoiseNLMeans = "nlmeans"
+)
+
+// Denoise strengths
+const (
+	DenoiseLight  = "light"
+	DenoiseMedium = "medium"
+	DenoiseStrong = "strong"
+)
+
+// CropAuto detects black bars with a cropdetect pass before encoding
+const CropAuto = "auto"
+
+// denoiseFilters holds the filter of each denoiser at each strength
+var denoiseFilters = map[string]map[string]string{
+	DenoiseHQDN3D: {
+		DenoiseLight:  "hqdn3d=2:1.5:3:2.25",
+		DenoiseMedium: "hqdn3d=4:3:6:4.5",
+		DenoiseStrong: "hqdn3d=8:6:12:9",
+	},
+	DenoiseNLMeans: {
+		DenoiseLight:  "nlmeans=s=1.5",
+		DenoiseMedium: "nlmeans=s=3",
+		DenoiseStrong: "nlmeans=s=5",
+	},
+}
+
+const (
+	// cropSamples is the number of points of the source cropdetect looks at
+	cropSamples = 5
+	// cropSampleSeconds is how long cropdetect looks at each point
+	cropSampleSeconds = 2
+	// cropLimit is the luma level up to which pixels count as black bars
+	cropLimit = 24
+	// interlaceSamples is the number of points of the source idet looks at
+	interlaceSamples = 3
+	// interlaceFrames is how many frames idet looks at each point
+	interlaceFrames = 250
+	// interlacedShare is the share of frames idet must find interlaced for
+	// the source to be deinterlaced
+	interlacedShare = 0.1
+	// cropMinBars is the least a crop must remove from the width or height;
+	// thinner edges are encoder padding or noise rather than bars
+	cropMinBars = 8
+)
+
+var (
+	cropValue   = regexp.MustCompile(`^(\d+):(\d+):(\d+):(\d+)$`)
+	cropPattern = regexp.MustCompile(`crop=(\d+):(\d+):(\d+):(\d+)`)
+	idetPattern = regexp.MustCompile(`Multi frame detection:\s*TFF:\s*(\d+)\s*BFF:\s*(\d+)\s*Progressive:\s*(\d+)`)
+)
+
+// VideoFilters cleans up re-encoded video, mostly for old sources such as
+// DVD rips. Any filter re-encodes video that would otherwise be copied.
+type VideoFilters struct {
+	// Deinterlace is DeinterlaceYadif, DeinterlaceAuto or empty to leave
+	// frames as they are
+	Deinterlace string `json:"deinterlace,omitempty"`
+	// Denoise is DenoiseHQDN3D, DenoiseNLMeans or empty for no denoising
+	Denoise string `json:"denoise,omitempty"`
+	// DenoiseStrength is DenoiseLight, DenoiseMedium or DenoiseStrong; empty
+	// means medium
+	DenoiseStrength string `json:"denoiseStrength,omitempty"`
+	// Crop is CropAuto to remove black bars, a fixed "width:height:x:y"
+	// area, or empty to keep the whole frame
+	Crop string `json:"crop,omitempty"`
+}
+
+// Validate checks that the filters are known
+func (f *VideoFilters) Validate() error {
+	switch f.Deinterlace {
+	case "", DeinterlaceYadif, DeinterlaceAuto:
+	default:
+		return fmt.Errorf("unknown deinterlace filter %q", f.Deinterlace)
+	}
+	if f.Denoise != "" {
+		if _, ok := denoiseFilters[f.Denoise]; !ok {
+			return fmt.Errorf("unknown denoise filter %q", f.Denoise)
+		}
+	}
+	switch f.DenoiseStrength {
+	case "", DenoiseLight, DenoiseMedium, DenoiseStrong:
+	default:
+		return fmt.Errorf("unknown denoise strength %q", f.DenoiseStrength)
+	}
+	if f.Crop != "" && f.Crop != CropAuto {
+		if _, err := ParseCrop(f.Crop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// empty reports whether no filter is set
+func (f *VideoFilters) empty() bool {
+	return f.Deinterlace == "" && f.Denoise == "" && f.Crop == ""
+}
+
+// Crop is the area of the frame kept by cropping
+type Crop struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	X      int `json:"x"`
+	Y      int `json:"y"`
+}
+
+// ParseCrop parses a "width:height:x:y" crop area
+func ParseCrop(s string) (*Crop, error) {
+	m := cropValue.FindStringSubmatch(s)
+	if m == nil {
+		return nil, fmt.Errorf("invalid crop %q, want auto or width:height:x:y", s)
+	}
+	c := &Crop{}
+	c.Width, _ = strconv.Atoi(m[1])
+	c.Height, _ = strconv.Atoi(m[2])
+	c.X, _ = strconv.Atoi(m[3])
+	c.Y, _ = strconv.Atoi(m[4])
+	if c.Width == 0 || c.Height == 0 {
+		return nil, fmt.Errorf("invalid crop %q: empty area", s)
+	}
+	return c, nil
+}
+
+func (c *Crop) String() string {
+	return fmt.Sprintf("%d:%d:%d:%d", c.Width, c.Height, c.X, c.Y)
+}
+
+// applyFilters re-encodes the first kept video stream so the filters can
+// run on it. A fixed crop is planned straight away, an automatic one once
+// detected. Automatic deinterlacing is dropped for sources the container
+// declares progressive and otherwise decided by an idet scan.
+func (p *Plan) applyFilters(f *VideoFilters, probe *ProbeResult, base *VideoEncoding) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	filters := *f
+	if video := probe.StreamsOfType("video"); filters.Deinterlace == DeinterlaceAuto &&
+		len(video) > 0 && video[0].FieldOrder == "progressive" {
+		filters.Deinterlace = ""
+	}
+	if filters.empty() {
+		return nil
+	}
+	p.Filters = &filters
+	if filters.Crop != "" && filters.Crop != CropAuto {
+		p.Crop, _ = ParseCrop(filters.Crop)
+	}
+	for i, m := range p.Streams {
+		if m.Type != "video" || m.Action == ActionDrop {
+			continue
+		}
+		if m.Action == ActionCopy {
+			codec := "libx265"
+			if base != nil {
+				codec = base.Codec
+			}
+			p.Streams[i].Action = ActionTranscode
+			p.Streams[i].TargetCodec = codec
+			p.VideoCodec = codec
+		}
+		return nil
+	}
+	return nil
+}
+
+// autoCrop reports whether the crop is detected before encoding
+func (p *Plan) autoCrop() bool {
+	return p.Filters != nil && p.Filters.Crop == CropAuto
+}
+
+// autoDeinterlace reports whether an idet scan decides on deinterlacing
+func (p *Plan) autoDeinterlace() bool {
+	return p.Filters != nil && p.Filters.Deinterlace == DeinterlaceAuto
+}
+
+// filterChain returns the cleanup filters of re-encoded video, in the order
+// they run: deinterlacing first, as the others need whole frames, then
+// cropping, so the denoiser skips the bars
+func (p *Plan) filterChain() []string {
+	f := p.Filters
+	if f == nil {
+		return nil
+	}
+	var chain []string
+	// An undecided automatic deinterlace errs on the side of yadif, which
+	// leaves progressive frames mostly untouched
+	if f.Deinterlace != "" {
+		chain = append(chain, DeinterlaceYadif)
+	}
+	if p.Crop != nil {
+		chain = append(chain, "crop="+p.Crop.String())
+	}
+	if f.Denoise != "" {
+		strength := f.DenoiseStrength
+		if strength == "" {
+			strength = DenoiseMedium
+		}
+		chain = append(chain, denoiseFilters[f.Denoise][strength])
+	}
+	return chain
+}
+
+// detectCrop runs cropdetect on the first video stream at evenly spread
+// points of the input and settles on the crop, see settleCrop. It returns nil
+// when there are no bars to remove.
+func detectCrop(path string, probe *ProbeResult) (*Crop, error) {
+	video := probe.StreamsOfType("video")
+	if len(video) == 0 {
+		return nil, fmt.Errorf("no video to analyse")
+	}
+
+	duration := probe.DurationSeconds()
+	readings := make([]*Crop, cropSamples)
+	for i := range readings {
+		start := 0.0
+		if duration > 0 {
+			start = duration * float64(i+1) / float64(cropSamples+1)
+		}
+		args := []string{"-hide_banner", "-nostats", "-ss", formatSeconds(start), "-i", path,
+			"-map", "0:v:0", "-t", strconv.Itoa(cropSampleSeconds),
+			"-vf", fmt.Sprintf("cropdetect=limit=%d:round=2:reset=0", cropLimit),
+			"-an", "-sn", "-dn", "-f", "null", "-"}
+		output, err := exec.Command("ffmpeg", args...).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("crop detection failed: %v", err)
+		}
+		readings[i] = lastCrop(string(output))
+	}
+	return settleCrop(readings, video[0].Width, video[0].Height)
+}
+
+// settleCrop returns the smallest area holding the picture at every point
+// cropdetect read, so a scene that fills more of the frame is never cut.
+// Dark scenes give no reading (nil), and bars are only trusted when most
+// points gave one. It returns nil when the bars are too thin to remove.
+func settleCrop(readings []*Crop, width, height int) (*Crop, error) {
+	var found *Crop
+	n := 0
+	for _, c := range readings {
+		if c == nil {
+			continue
+		}
+		n++
+		if found == nil {
+			found = c
+			continue
+		}
+		found = found.union(c)
+	}
+	if n*2 <= len(readings) {
+		return nil, fmt.Errorf("crop detection found the picture at only %d of %d points", n, len(readings))
+	}
+	if width-found.Width < cropMinBars && height-found.Height < cropMinBars {
+		return nil, nil
+	}
+	return found, nil
+}
+
+// lastCrop returns the final, settled area cropdetect logged, nil if none
+func lastCrop(log string) *Crop {
+	matches := cropPattern.FindAllStringSubmatch(log, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	c, err := ParseCrop(matches[len(matches)-1][0][len("crop="):])
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+// union returns the smallest area holding both c and o
+func (c *Crop) union(o *Crop) *Crop {
+	x, y := min(c.X, o.X), min(c.Y, o.Y)
+	return &Crop{
+		Width:  max(c.X+c.Width, o.X+o.Width) - x,
+		Height: max(c.Y+c.Height, o.Y+o.Height) - y,
+		X:      x,
+		Y:      y,
+	}
+}
+
+// withCrop returns a copy of f cropping to c in place of an automatic crop,
+// keeping the whole frame when c is nil
+func (f *VideoFilters) withCrop(c *Crop) *VideoFilters {
+	fixed := *f
+	fixed.Crop = ""
+	if c != nil {
+		fixed.Crop = c.String()
+	}
+	return &fixed
+}
+
+// analyzeCrop detects the black bars to crop when the filters ask for it.
+// Failures are logged and the frame is left whole.
+func analyzeCrop(params *OptimizationParams, input string, probe *ProbeResult, plan *Plan) {
+	if !plan.autoCrop() {
+		return
+	}
+	crop, err := detectCrop(input, probe)
+	if err != nil {
+		logError("Crop detection failed for %s: %v", params.InputFile, err)
+		plan.Warnings = append(plan.Warnings, "crop detection failed; the frame is not cropped")
+		return
+	}
+	if crop == nil {
+		logInfo("%s: no black bars to crop", params.InputFile)
+		return
+	}
+	plan.Crop = crop
+	logInfo("%s: cropping to %s", params.InputFile, crop)
+	params.output("info", "Crop: "+crop.String())
+}
+
+// detectInterlace runs idet on the first video stream at evenly spread
+// points of the input and reports whether enough frames were interlaced to
+// deinterlace the whole video, with the share of them
+func detectInterlace(path string, probe *ProbeResult) (bool, float64, error) {
+	if len(probe.StreamsOfType("video")) == 0 {
+		return false, 0, fmt.Errorf("no video to analyse")
+	}
+
+	duration := probe.DurationSeconds()
+	var interlaced, total int
+	for i := 0; i < interlaceSamples; i++ {
+		start := 0.0
+		if duration > 0 {
+			start = duration * float64(i+1) / float64(interlaceSamples+1)
+		}
+		args := []string{"-hide_banner", "-nostats", "-ss", formatSeconds(start), "-i", path,
+			"-map", "0:v:0", "-frames:v", strconv.Itoa(interlaceFrames), "-vf", "idet",
+			"-an", "-sn", "-dn", "-f", "null", "-"}
+		output, err := exec.Command("ffmpeg", args...).CombinedOutput()
+		if err != nil {
+			return false, 0, fmt.Errorf("interlace detection failed: %v", err)
+		}
+		n, classified := parseIdet(string(output))
+		interlaced += n
+		total += classified
+	}
+	if total == 0 {
+		return false, 0, fmt.Errorf("interlace detection classified no frames")
+	}
+	share := float64(interlaced) / float64(total)
+	return share >= interlacedShare, share, nil
+}
+
+// parseIdet returns the frames idet's multi-frame detection found
+// interlaced, either field first, and the frames it classified. Undetermined
+// frames are left out.
+func parseIdet(log string) (interlaced, total int) {
+	m := idetPattern.FindStringSubmatch(log)
+	if m == nil {
+		return 0, 0
+	}
+	tff, _ := strconv.Atoi(m[1])
+	bff, _ := strconv.Atoi(m[2])
+	progressive, _ := strconv.Atoi(m[3])
+	return tff + bff, tff + bff + progressive
+}
+
+// analyzeInterlace settles an automatic deinterlace with an idet scan.
+// When the scan fails the video is deinterlaced, which does less harm to
+// progressive frames than combing does to interlaced ones.
+func analyzeInterlace(params *OptimizationParams, input string, probe *ProbeResult, plan *Plan) {
+	if !plan.autoDeinterlace() {
+		return
+	}
+	interlaced, share, err := detectInterlace(input, probe)
+	if err != nil {
+		logError("Interlace detection failed for %s: %v", params.InputFile, err)
+		plan.Warnings = append(plan.Warnings, "interlace detection failed; the video is deinterlaced")
+		plan.Filters.Deinterlace = DeinterlaceYadif
+		return
+	}
+	msg := fmt.Sprintf("%.0f%% of sampled frames interlaced", share*100)
+	if interlaced {
+		plan.Filters.Deinterlace = DeinterlaceYadif
+		msg += ", deinterlacing"
+	} else {
+		plan.Filters.Deinterlace = ""
+	}
+	logInfo("%s: %s", params.InputFile, msg)
+	params.output("info", "Interlace: "+msg)
+}
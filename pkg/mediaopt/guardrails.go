@@ -0,0 +1,168 @@
+package mediaopt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Guardrail modes, deciding what happens to a plan with streams the output
+// can't carry safely
+const (
+	// GuardFallback applies the issue's fallback, stopping the job only when
+	// there is none
+	GuardFallback = "fallback"
+	// GuardAttention stops the job on any issue
+	GuardAttention = "attention"
+)
+
+// ErrNeedsAttention marks jobs stopped before encoding because the source
+// has streams the pipeline can't handle safely, which need a different
+// profile or stream mapping rather than a retry
+var ErrNeedsAttention = errors.New("needs attention")
+
+// losslessFallback re-encodes audio MP4 can't carry when the plan has no
+// audio settings, keeping up to 5.1 channels
+var losslessFallback = AudioEncoding{Codec: "eac3"}
+
+// guardIssue is a stream the plan would write unsafely. fallback makes it
+// safe, or is nil when nothing can.
+type guardIssue struct {
+	problem  string
+	fallback func()
+	// outcome describes the plan after the fallback
+	outcome string
+}
+
+// DolbyVisionProfile returns the Dolby Vision profile of the stream, zero
+// when it has none
+func (s ProbeStream) DolbyVisionProfile() int {
+	for _, sd := range s.SideData {
+		if sd["side_data_type"] == "DOVI configuration record" {
+			return int(rational(sd["dv_profile"]))
+		}
+	}
+	return 0
+}
+
+// mp4UnsafeAudio reports whether MP4 and MOV can't reliably carry a copy of
+// audio in codec: TrueHD is experimental there and PCM unsupported
+func mp4UnsafeAudio(codec string) bool {
+	return codec == "truehd" || codec == "mlp" || strings.HasPrefix(codec, "pcm_")
+}
+
+// applyGuardrails looks for streams the plan would turn into broken output
+// and applies their fallbacks, adding a warning for each. It returns an
+// ErrNeedsAttention error instead when mode is GuardAttention or an issue
+// has no fallback.
+func (p *Plan) applyGuardrails(mode string, params *OptimizationParams, probe *ProbeResult) error {
+	switch mode {
+	case "", GuardFallback, GuardAttention:
+	default:
+		return fmt.Errorf("unknown guardrail mode %q", mode)
+	}
+
+	var stops []string
+	for _, issue := range p.guardIssues(params, probe) {
+		if mode == GuardAttention || issue.fallback == nil {
+			stops = append(stops, issue.problem)
+			continue
+		}
+		issue.fallback()
+		p.Warnings = append(p.Warnings, issue.problem+"; "+issue.outcome)
+	}
+	if len(stops) > 0 {
+		return fmt.Errorf("%w: %s", ErrNeedsAttention, strings.Join(stops, "; "))
+	}
+	return nil
+}
+
+// guardIssues lists the unsafe streams of the plan
+func (p *Plan) guardIssues(params *OptimizationParams, probe *ProbeResult) []guardIssue {
+	sources := make(map[int]ProbeStream)
+	for _, s := range probe.Streams {
+		sources[s.Index] = s
+	}
+	mp4Family := p.Container == "mp4" || p.Container == "mov"
+
+	var issues []guardIssue
+	keptAudio := false
+	for i, m := range p.Streams {
+		i, src := i, sources[m.InputIndex]
+		switch {
+		case m.Action == ActionDrop:
+			continue
+
+		case m.Type == "video" && m.Action == ActionTranscode && src.DolbyVisionProfile() == 5:
+			// Profile 5 has no HDR10 base layer; decoders without Dolby
+			// Vision see its IPT colour space as green and purple
+			issue := guardIssue{problem: fmt.Sprintf("stream %d is Dolby Vision profile 5, which can't be re-encoded without wrong colours", m.InputIndex)}
+			// WebM can't carry the copied HEVC
+			if params.TargetSize == 0 && params.KeyframeSeconds == 0 && p.Container != WebMContainer {
+				issue.outcome = "the video is copied instead"
+				issue.fallback = func() {
+					p.Streams[i].Action = ActionCopy
+					p.Streams[i].TargetCodec = p.Streams[i].SourceCodec
+					p.VideoCodec = p.Streams[i].SourceCodec
+				}
+			}
+			issues = append(issues, issue)
+
+		case m.Type == "audio" && m.Action == ActionCopy && mp4Family && mp4UnsafeAudio(m.SourceCodec):
+			a := p.Audio
+			if a == nil {
+				a = &losslessFallback
+			}
+			issues = append(issues, guardIssue{
+				problem:  fmt.Sprintf("stream %d is %s audio, which %s can't carry reliably", m.InputIndex, m.SourceCodec, p.Container),
+				outcome:  fmt.Sprintf("it is re-encoded to %s instead", a.Codec),
+				fallback: func() { p.transcodeAudio(i, a, src.Channels) },
+			})
+
+		case m.Type == "subtitle" && m.Action == ActionCopy && mp4Family && m.SourceCodec != "mov_text":
+			issue := guardIssue{problem: fmt.Sprintf("stream %d is %s subtitles, which %s can't carry", m.InputIndex, m.SourceCodec, p.Container)}
+			if textSubtitleCodecs[m.SourceCodec] {
+				issue.outcome = "they are converted to mov_text instead"
+				issue.fallback = func() {
+					p.Streams[i].Action = ActionTranscode
+					p.Streams[i].TargetCodec = "mov_text"
+				}
+			} else {
+				issue.outcome = "they are dropped"
+				issue.fallback = func() {
+					p.Streams[i].Action = ActionDrop
+					p.Streams[i].TargetCodec = ""
+					p.Streams[i].Reason = "subtitle format not supported by " + p.Container
+				}
+			}
+			issues = append(issues, issue)
+		}
+		if m.Type == "audio" {
+			keptAudio = true
+		}
+	}
+
+	// The language rule drops every track of sources without one in the
+	// target language, which would leave the output silent. User mappings
+	// are taken as meant.
+	if audio := probe.StreamsOfType("audio"); !keptAudio && len(audio) > 0 && len(params.Streams) == 0 {
+		first := audio[0]
+		issues = append(issues, guardIssue{
+			problem: fmt.Sprintf("no audio track is in %q", TargetAudioLanguage),
+			outcome: fmt.Sprintf("stream %d is kept instead", first.Index),
+			fallback: func() {
+				a := p.Audio
+				if a == nil {
+					a = &DefaultAudio
+				}
+				for i, m := range p.Streams {
+					if m.InputIndex == first.Index {
+						p.transcodeAudio(i, a, first.Channels)
+						p.Streams[i].Reason = "no audio track in the target language"
+					}
+				}
+			},
+		})
+	}
+	return issues
+}
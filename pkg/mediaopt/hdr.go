@@ -0,0 +1,220 @@
+package mediaopt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// HDR formats reported for video streams
+const (
+	HDR10       = "hdr10"
+	HLG         = "hlg"
+	DolbyVision = "dolby_vision"
+)
+
+// HDR handling modes for re-encoded video
+const (
+	HDRPreserve = "preserve"
+	HDRToneMap  = "tonemap"
+)
+
+// DefaultToneMap is the tone-mapping curve used when none is configured
+const DefaultToneMap = "hable"
+
+// HDROptions configures how HDR video is treated when it is re-encoded.
+// Copied video streams keep their HDR metadata untouched.
+type HDROptions struct {
+	// Mode is HDRPreserve or HDRToneMap
+	Mode string
+	// ToneMap is the ffmpeg tonemap algorithm (hable, mobius, reinhard, ...)
+	ToneMap string
+}
+
+// HDRFormat classifies the stream's dynamic range, returning "" for SDR
+func (s ProbeStream) HDRFormat() string {
+	for _, sd := range s.SideData {
+		if sd["side_data_type"] == "DOVI configuration record" {
+			return DolbyVision
+		}
+	}
+	switch s.ColorTransfer {
+	case "smpte2084":
+		return HDR10
+	case "arib-std-b67":
+		return HLG
+	}
+	return ""
+}
+
+// masterDisplay formats the stream's mastering display metadata for x265,
+// which expects chromaticity in 0.00002 and luminance in 0.0001 units
+func (s ProbeStream) masterDisplay() string {
+	for _, sd := range s.SideData {
+		if sd["side_data_type"] != "Mastering display metadata" {
+			continue
+		}
+		v := func(key string, scale float64) int64 {
+			return int64(rational(sd[key])*scale + 0.5)
+		}
+		return fmt.Sprintf("G(%d,%d)B(%d,%d)R(%d,%d)WP(%d,%d)L(%d,%d)",
+			v("green_x", 50000), v("green_y", 50000),
+			v("blue_x", 50000), v("blue_y", 50000),
+			v("red_x", 50000), v("red_y", 50000),
+			v("white_point_x", 50000), v("white_point_y", 50000),
+			v("max_luminance", 10000), v("min_luminance", 10000))
+	}
+	return ""
+}
+
+// contentLightLevel returns the stream's MaxCLL,MaxFALL for x265
+func (s ProbeStream) contentLightLevel() string {
+	for _, sd := range s.SideData {
+		if sd["side_data_type"] == "Content light level metadata" {
+			return fmt.Sprintf("%d,%d", int64(rational(sd["max_content"])), int64(rational(sd["max_average"])))
+		}
+	}
+	return ""
+}
+
+// rational parses ffprobe side data values, which are numbers or "num/den"
+func rational(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case string:
+		num, den, found := strings.Cut(n, "/")
+		x, _ := strconv.ParseFloat(num, 64)
+		if !found {
+			return x
+		}
+		d, _ := strconv.ParseFloat(den, 64)
+		if d == 0 {
+			return 0
+		}
+		return x / d
+	}
+	return 0
+}
+
+// hdrInfo carries the HDR facts of a source stream into its mapping
+func hdrInfo(m *StreamMapping, s ProbeStream) {
+	if s.CodecType != "video" {
+		return
+	}
+	m.HDR = s.HDRFormat()
+	if m.HDR != "" {
+		m.colorTransfer = s.ColorTransfer
+		m.masterDisplay = s.masterDisplay()
+		m.maxCLL = s.contentLightLevel()
+	}
+}
+
+// hdrArgs returns the per-stream options that keep or tone-map HDR when a
+// video stream is re-encoded, the tone-mapping filter chain if any, and the
+// matching x265 parameters
+func (p *Plan) hdrArgs(m StreamMapping, idx string) ([]string, string, []string) {
+	if m.HDR == "" || m.Type != "video" || m.Action != ActionTranscode {
+		return nil, "", nil
+	}
+
+	if p.HDRMode == HDRToneMap {
+		curve := p.ToneMap
+		if curve == "" {
+			curve = DefaultToneMap
+		}
+		filter := "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709," +
+			"tonemap=tonemap=" + curve + ":desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+		return []string{
+			"-color_primaries:" + idx, "bt709",
+			"-color_trc:" + idx, "bt709",
+			"-colorspace:" + idx, "bt709",
+		}, filter, nil
+	}
+
+	transfer := m.colorTransfer
+	if transfer == "" {
+		transfer = "smpte2084"
+	}
+	pixFmt := "yuv420p10le"
+	if isNVENC(m.TargetCodec) {
+		pixFmt = "p010le"
+	}
+	args := []string{
+		"-pix_fmt:" + idx, pixFmt,
+		"-color_primaries:" + idx, "bt2020",
+		"-color_trc:" + idx, transfer,
+		"-colorspace:" + idx, "bt2020nc",
+	}
+	x265 := []string{"hdr-opt=1", "repeat-headers=1", "colorprim=bt2020",
+		"transfer=" + transfer, "colormatrix=bt2020nc"}
+	if m.masterDisplay != "" {
+		x265 = append(x265, "master-display="+m.masterDisplay)
+	}
+	if m.maxCLL != "" {
+		x265 = append(x265, "max-cll="+m.maxCLL)
+	}
+	return args, "", x265
+}
+
+// svtHDRParams returns the SVT-AV1 parameters writing the HDR metadata of a
+// stream whose HDR is preserved
+func svtHDRParams(m StreamMapping, preserved bool) []string {
+	if !preserved || !isSVTAV1(m.TargetCodec) {
+		return nil
+	}
+	params := []string{"enable-hdr=1"}
+	if display := svtMasterDisplay(m.masterDisplay); display != "" {
+		params = append(params, "mastering-display="+display)
+	}
+	if m.maxCLL != "" {
+		params = append(params, "content-light="+m.maxCLL)
+	}
+	return params
+}
+
+// svtMasterDisplay converts mastering display metadata from x265's integer
+// units to the plain chromaticity and nits SVT-AV1 expects, "" if display
+// can't be parsed
+func svtMasterDisplay(display string) string {
+	var gx, gy, bx, by, rx, ry, wx, wy, maxL, minL float64
+	n, err := fmt.Sscanf(display, "G(%g,%g)B(%g,%g)R(%g,%g)WP(%g,%g)L(%g,%g)",
+		&gx, &gy, &bx, &by, &rx, &ry, &wx, &wy, &maxL, &minL)
+	if err != nil || n != 10 {
+		return ""
+	}
+	c := func(v float64) string { return strconv.FormatFloat(v/50000, 'f', 4, 64) }
+	l := func(v float64) string { return strconv.FormatFloat(v/10000, 'f', 4, 64) }
+	return fmt.Sprintf("G(%s,%s)B(%s,%s)R(%s,%s)WP(%s,%s)L(%s,%s)",
+		c(gx), c(gy), c(bx), c(by), c(rx), c(ry), c(wx), c(wy), l(maxL), l(minL))
+}
+
+// hdrWarnings lists HDR streams whose handling may not be faithful
+func (p *Plan) hdrWarnings() []string {
+	var warnings []string
+	for _, m := range p.Streams {
+		if m.HDR != "" && m.Action == ActionTranscode && isNVENC(m.TargetCodec) && p.HDRMode != HDRToneMap {
+			warnings = append(warnings, fmt.Sprintf("stream %d is HDR; NVENC keeps its colour signalling but not the mastering display and light level metadata", m.InputIndex))
+		}
+		if m.HDR != DolbyVision || m.Action != ActionTranscode {
+			continue
+		}
+		if p.HDRMode == HDRToneMap {
+			warnings = append(warnings, fmt.Sprintf("stream %d is Dolby Vision; tone-mapping uses its HDR10 base layer", m.InputIndex))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("stream %d is Dolby Vision; re-encoding keeps the HDR10 base layer only", m.InputIndex))
+		}
+	}
+	return warnings
+}
+
+// hasDolbyVisionCopy reports whether a Dolby Vision stream is copied, which
+// needs unofficial MP4 boxes to keep its configuration record
+func (p *Plan) hasDolbyVisionCopy() bool {
+	for _, m := range p.Streams {
+		if m.HDR == DolbyVision && m.Action == ActionCopy {
+			return true
+		}
+	}
+	return false
+}
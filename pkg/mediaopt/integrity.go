@@ -0,0 +1,76 @@
+package mediaopt
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os/exec"
+	"strings"
+)
+
+// maxDecodeErrors caps how many decoder error lines are quoted in a failure
+const maxDecodeErrors = 5
+
+// IntegrityCheck configures validation of the encoded output
+type IntegrityCheck struct {
+	// DurationTolerance is the allowed difference in seconds between the
+	// source and output durations
+	DurationTolerance float64
+}
+
+// validateIntegrity confirms the output decodes cleanly, still contains the
+// stream types the plan keeps, and has not been truncated
+func validateIntegrity(check *IntegrityCheck, source *ProbeResult, plan *Plan, outputFile string) error {
+	logInfo("Validating integrity of %s", outputFile)
+
+	output, err := Probe(outputFile)
+	if err != nil {
+		return fmt.Errorf("output cannot be probed: %v", err)
+	}
+	if err := checkOutputProbe(check, source, output, plan); err != nil {
+		return err
+	}
+	return decodeCheck(outputFile)
+}
+
+// checkOutputProbe compares the probe of the output with the source's: every
+// stream type the plan keeps must be present and the durations must agree
+// within the tolerance
+func checkOutputProbe(check *IntegrityCheck, source, output *ProbeResult, plan *Plan) error {
+	for _, m := range plan.Streams {
+		if m.Action != ActionDrop && len(output.StreamsOfType(m.Type)) == 0 {
+			return fmt.Errorf("output is missing its %s stream", m.Type)
+		}
+	}
+
+	srcDuration, outDuration := source.DurationSeconds(), output.DurationSeconds()
+	if srcDuration > 0 && math.Abs(srcDuration-outDuration) > check.DurationTolerance {
+		return fmt.Errorf("output duration %.2fs differs from source %.2fs by more than %.2fs",
+			outDuration, srcDuration, check.DurationTolerance)
+	}
+	return nil
+}
+
+// decodeCheck decodes every stream of the file and fails on any decoder error
+func decodeCheck(path string) error {
+	cmd := exec.Command("ffmpeg", "-v", "error", "-nostats", "-i", path, "-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	runErr := cmd.Run()
+	errors := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if len(errors) == 1 && errors[0] == "" {
+		errors = nil
+	}
+
+	if runErr == nil && len(errors) == 0 {
+		return nil
+	}
+	if len(errors) > maxDecodeErrors {
+		errors = append(errors[:maxDecodeErrors], fmt.Sprintf("... and %d more", len(errors)-maxDecodeErrors))
+	}
+	if len(errors) == 0 {
+		return fmt.Errorf("decode pass failed: %v", runErr)
+	}
+	return fmt.Errorf("decode pass reported errors: %s", strings.Join(errors, "; "))
+}
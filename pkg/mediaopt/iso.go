@@ -0,0 +1,149 @@
+package mediaopt
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DiscSource is an ffmpeg input resolved from a disc image
+type DiscSource struct {
+	// Input is the path or protocol URL handed to ffmpeg
+	Input string
+	// Method records how the image was opened ("mount" or "bluray")
+	Method     string
+	mountPoint string
+}
+
+var vobPattern = regexp.MustCompile(`(?i)^VTS_(\d\d)_([1-9])\.VOB$`)
+
+// IsDiscImage reports whether path looks like an optical disc image
+func IsDiscImage(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".iso")
+}
+
+// OpenDiscImage resolves the main title of an ISO image. On Linux the image is
+// loop mounted read-only and the largest Blu-ray stream or DVD title set is
+// selected; otherwise, or if mounting fails, ffmpeg's bluray: protocol is used
+// when the local build was compiled with libbluray.
+func OpenDiscImage(path, tempDir string) (*DiscSource, error) {
+	var mountErr error
+	if runtime.GOOS == "linux" {
+		src, err := mountDiscImage(path, tempDir)
+		if err == nil {
+			return src, nil
+		}
+		mountErr = err
+		logError("Loop mount of %s failed: %v", path, err)
+	}
+
+	if hasBlurayProtocol() {
+		return &DiscSource{Input: "bluray:" + path, Method: "bluray"}, nil
+	}
+
+	if mountErr != nil {
+		return nil, fmt.Errorf("cannot open disc image (mount failed: %v; ffmpeg lacks bluray support)", mountErr)
+	}
+	return nil, fmt.Errorf("cannot open disc image: ffmpeg lacks bluray support")
+}
+
+// Close releases the loop mount, if any
+func (d *DiscSource) Close() {
+	if d.mountPoint == "" {
+		return
+	}
+	if output, err := exec.Command("umount", d.mountPoint).CombinedOutput(); err != nil {
+		logError("Failed to unmount %s: %v: %s", d.mountPoint, err, strings.TrimSpace(string(output)))
+		return
+	}
+	os.Remove(d.mountPoint)
+}
+
+func mountDiscImage(path, tempDir string) (*DiscSource, error) {
+	mountPoint := filepath.Join(tempDir, fmt.Sprintf("iso_%d", time.Now().UnixNano()))
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return nil, err
+	}
+
+	if output, err := exec.Command("mount", "-o", "loop,ro", path, mountPoint).CombinedOutput(); err != nil {
+		os.Remove(mountPoint)
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	src := &DiscSource{Method: "mount", mountPoint: mountPoint}
+	input, err := findMainTitle(mountPoint)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	src.Input = input
+	logInfo("Mounted %s at %s, main title: %s", path, mountPoint, input)
+	return src, nil
+}
+
+// findMainTitle picks the largest Blu-ray stream or DVD title set on a mounted disc
+func findMainTitle(root string) (string, error) {
+	if streams, err := os.ReadDir(filepath.Join(root, "BDMV", "STREAM")); err == nil {
+		var best string
+		var bestSize int64
+		for _, e := range streams {
+			if !strings.EqualFold(filepath.Ext(e.Name()), ".m2ts") {
+				continue
+			}
+			if info, err := e.Info(); err == nil && info.Size() > bestSize {
+				best, bestSize = filepath.Join(root, "BDMV", "STREAM", e.Name()), info.Size()
+			}
+		}
+		if best != "" {
+			return best, nil
+		}
+	}
+
+	if vobs, err := os.ReadDir(filepath.Join(root, "VIDEO_TS")); err == nil {
+		titleSets := make(map[string][]string)
+		sizes := make(map[string]int64)
+		for _, e := range vobs {
+			m := vobPattern.FindStringSubmatch(e.Name())
+			if m == nil {
+				continue
+			}
+			if info, err := e.Info(); err == nil {
+				titleSets[m[1]] = append(titleSets[m[1]], filepath.Join(root, "VIDEO_TS", e.Name()))
+				sizes[m[1]] += info.Size()
+			}
+		}
+		var best string
+		for title := range titleSets {
+			if best == "" || sizes[title] > sizes[best] {
+				best = title
+			}
+		}
+		if best != "" {
+			parts := titleSets[best]
+			sort.Strings(parts)
+			return "concat:" + strings.Join(parts, "|"), nil
+		}
+	}
+
+	return "", fmt.Errorf("no Blu-ray or DVD title found in disc image")
+}
+
+// hasBlurayProtocol checks whether the local ffmpeg was built with libbluray
+func hasBlurayProtocol() bool {
+	output, err := exec.Command("ffmpeg", "-hide_banner", "-protocols").Output()
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.TrimSpace(line) == "bluray" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package mediaopt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultKeyframeSeconds is the keyframe interval of ladder renditions, a
+// common HLS segment length
+const DefaultKeyframeSeconds = 2.0
+
+// Rendition is one output of a bitrate ladder
+type Rendition struct {
+	// Name identifies the rendition and names its file, e.g. "720p"
+	Name   string `json:"name"`
+	Height int    `json:"height"`
+	// MaxBitrateKbps caps the video bitrate; zero keeps the configured rate
+	// control
+	MaxBitrateKbps int `json:"maxBitrateKbps,omitempty"`
+}
+
+// DefaultLadder is used when no renditions are configured
+var DefaultLadder = []Rendition{
+	{Name: "1080p", Height: 1080, MaxBitrateKbps: 6000},
+	{Name: "720p", Height: 720, MaxBitrateKbps: 3500},
+	{Name: "480p", Height: 480, MaxBitrateKbps: 1500},
+}
+
+// Ladder configures a multi-rendition encode
+type Ladder struct {
+	Renditions []Rendition
+	// OutputDir receives one file per rendition, see Rendition.OutputFile
+	OutputDir string
+	// KeyframeSeconds aligns keyframes across the renditions; zero uses
+	// DefaultKeyframeSeconds
+	KeyframeSeconds float64
+	// OnProgress reports the progress (0-100) of the rendition at index. A
+	// rendition is reported at 100 once its output is complete.
+	OnProgress func(index int, progress float64)
+}
+
+// ValidateRenditions checks that renditions have unique file names and
+// positive heights
+func ValidateRenditions(renditions []Rendition) error {
+	seen := make(map[string]bool)
+	for _, r := range renditions {
+		switch {
+		case r.Name == "" || strings.ContainsAny(r.Name, `/\`) || r.Name == "." || r.Name == "..":
+			return fmt.Errorf("invalid rendition name %q", r.Name)
+		case seen[r.Name]:
+			return fmt.Errorf("rendition %s is listed twice", r.Name)
+		case r.Height <= 0:
+			return fmt.Errorf("rendition %s: height must be positive", r.Name)
+		case r.MaxBitrateKbps < 0:
+			return fmt.Errorf("rendition %s: maxBitrateKbps must not be negative", r.Name)
+		}
+		seen[r.Name] = true
+	}
+	return nil
+}
+
+// LadderRenditions returns the renditions worth encoding from the probed
+// source. Renditions taller than the source would only repeat it at a higher
+// bitrate and are left out, except that the smallest is kept when the source
+// is shorter than all of them.
+func LadderRenditions(probe *ProbeResult, renditions []Rendition) []Rendition {
+	height := 0
+	if video := probe.StreamsOfType("video"); len(video) > 0 {
+		height = video[0].Height
+	}
+	if height == 0 {
+		return renditions
+	}
+
+	var kept []Rendition
+	smallest := -1
+	for i, r := range renditions {
+		if r.Height <= height {
+			kept = append(kept, r)
+		}
+		if smallest < 0 || r.Height < renditions[smallest].Height {
+			smallest = i
+		}
+	}
+	if len(kept) == 0 && smallest >= 0 {
+		kept = append(kept, renditions[smallest])
+	}
+	return kept
+}
+
+// LadderOutputDir is the default directory of the renditions of input
+func LadderOutputDir(input string) string {
+	return strings.TrimSuffix(input, filepath.Ext(input)) + "_renditions"
+}
+
+// OutputFile is the path of the rendition in dir
+func (r Rendition) OutputFile(dir string) string {
+	return filepath.Join(dir, r.Name+"."+TargetContainer)
+}
+
+// EncodeLadder encodes every rendition of the ladder from the input of
+// params, one after another, stopping at the first failure. Each rendition is
+// scaled to its height with keyframes at the same times so players can switch
+// between them. The result carries the source probe and the analyses, which
+// only run for the first rendition.
+func EncodeLadder(params *OptimizationParams, ladder Ladder) OptimizationResult {
+	if len(ladder.Renditions) == 0 {
+		return OptimizationResult{Error: fmt.Errorf("no renditions to encode")}
+	}
+	keyframes := ladder.KeyframeSeconds
+	if keyframes <= 0 {
+		keyframes = DefaultKeyframeSeconds
+	}
+	if err := os.MkdirAll(ladder.OutputDir, 0755); err != nil {
+		return OptimizationResult{Error: fmt.Errorf("failed to create %s: %v", ladder.OutputDir, err)}
+	}
+
+	var result OptimizationResult
+	var warnings []string
+	seen := make(map[string]bool)
+	for i, r := range ladder.Renditions {
+		rendition := renditionParams(params, r, ladder.OutputDir, keyframes)
+		if i > 0 {
+			rendition.DetectBurnedSubtitles = false
+			rendition.DetectSegments = 0
+			// Every rendition keeps the area detected for the first
+			if rendition.Filters != nil && rendition.Filters.Crop == CropAuto {
+				rendition.Filters = rendition.Filters.withCrop(result.Crop)
+			}
+		}
+		index := i
+		rendition.OnProgress = func(progress float64) {
+			if ladder.OnProgress != nil {
+				ladder.OnProgress(index, progress)
+			}
+		}
+
+		logInfo("Encoding rendition %s of %s", r.Name, params.InputFile)
+		params.output("info", fmt.Sprintf("Rendition %s (%d/%d)", r.Name, i+1, len(ladder.Renditions)))
+		outcome := OptimizeMedia(rendition)
+		for _, w := range outcome.Warnings {
+			if !seen[w] {
+				seen[w] = true
+				warnings = append(warnings, w)
+			}
+		}
+		if i == 0 {
+			result = outcome
+		}
+		if !outcome.Success {
+			result.Success = false
+			result.Error = fmt.Errorf("rendition %s: %w", r.Name, outcome.Error)
+			result.Warnings = warnings
+			return result
+		}
+		rendition.OnProgress(100)
+	}
+
+	result.Success = true
+	result.Message = fmt.Sprintf("Encoded %d renditions of %s", len(ladder.Renditions), params.InputFile)
+	result.Warnings = warnings
+	return result
+}
+
+// renditionParams derives the parameters of one rendition from the base
+// parameters. Quality checks are skipped because the metrics compare frames
+// of the source's size.
+func renditionParams(params *OptimizationParams, r Rendition, dir string, keyframes float64) *OptimizationParams {
+	p := *params
+	p.OutputFile = r.OutputFile(dir)
+	p.OutputName = ""
+	p.MaxHeight = r.Height
+	p.KeyframeSeconds = keyframes
+	p.TargetSize = 0
+	p.Quality = nil
+
+	video := VideoEncoding{Codec: "libx265", RateControl: RateCRF, CRF: 26}
+	if params.Video != nil {
+		video = *params.Video
+	}
+	video.Transcode = true
+	if r.MaxBitrateKbps > 0 {
+		video.RateControl = RateCappedCRF
+		video.MaxBitrateKbps = r.MaxBitrateKbps
+	}
+	p.Video = &video
+	return &p
+}
@@ -0,0 +1,207 @@
+package mediaopt
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Sources of an inferred stream language
+const (
+	LanguageFromTitle    = "title"
+	LanguageFromFilename = "filename"
+	LanguageFromDetector = "detector"
+)
+
+const (
+	// undetermined is the ISO 639-2 code for an unknown language
+	undetermined = "und"
+	// languageSampleSeconds is the length of audio handed to a detector
+	languageSampleSeconds = 30
+)
+
+// languageCodes maps language names and ISO 639 codes to the ISO 639-2/B
+// codes used in Matroska and MP4 tags. Two-letter codes are only trusted from
+// a detector since they collide with ordinary words in titles and filenames,
+// and three-letter codes only where they stand alone.
+var languageCodes = map[string]string{
+	"english": "eng", "eng": "eng",
+	"french": "fre", "francais": "fre", "fre": "fre", "fra": "fre",
+	"german": "ger", "deutsch": "ger", "ger": "ger", "deu": "ger",
+	"spanish": "spa", "espanol": "spa", "castellano": "spa", "spa": "spa",
+	"italian": "ita", "italiano": "ita", "ita": "ita",
+	"japanese": "jpn", "jpn": "jpn",
+	"korean": "kor", "kor": "kor",
+	"chinese": "chi", "mandarin": "chi", "cantonese": "chi", "chi": "chi", "zho": "chi",
+	"russian": "rus", "rus": "rus",
+	"portuguese": "por", "por": "por",
+	"dutch": "dut", "nederlands": "dut", "dut": "dut", "nld": "dut",
+	"swedish": "swe", "swe": "swe",
+	"norwegian": "nor", "nor": "nor",
+	"danish": "dan", "dan": "dan",
+	"finnish": "fin", "fin": "fin",
+	"polish": "pol", "pol": "pol",
+	"hindi": "hin", "hin": "hin",
+	"arabic": "ara", "ara": "ara",
+	"turkish": "tur", "tur": "tur",
+}
+
+// twoLetterCodes maps ISO 639-1 codes, as printed by most detectors
+var twoLetterCodes = map[string]string{
+	"en": "eng", "fr": "fre", "de": "ger", "es": "spa", "it": "ita",
+	"ja": "jpn", "ko": "kor", "zh": "chi", "ru": "rus", "pt": "por",
+	"nl": "dut", "sv": "swe", "no": "nor", "da": "dan", "fi": "fin",
+	"pl": "pol", "hi": "hin", "ar": "ara", "tr": "tur",
+}
+
+var wordPattern = regexp.MustCompile(`[\p{L}]+`)
+
+// LanguageTagging configures inference of languages for untagged audio
+type LanguageTagging struct {
+	// Detector is an optional command that is given the path of a short WAV
+	// sample as its last argument and prints a language code
+	Detector string
+}
+
+// isUndetermined reports whether a language tag carries no information
+func isUndetermined(lang string) bool {
+	return lang == "" || lang == undetermined
+}
+
+// languageFromText finds a single language named in text by its full name,
+// or given as token, a three-letter code the caller found on its own in the
+// text. Codes elsewhere in the text are ignored, as they collide with words
+// such as "spa" or "dan". Ambiguous text yields "".
+func languageFromText(text, token string) string {
+	found := ""
+	if len(token) == 3 {
+		found = languageCodes[strings.ToLower(token)]
+	}
+	for _, word := range wordPattern.FindAllString(strings.ToLower(text), -1) {
+		code, ok := languageCodes[word]
+		if !ok || len(word) == 3 {
+			continue
+		}
+		if found != "" && found != code {
+			return ""
+		}
+		found = code
+	}
+	return found
+}
+
+// languageFromFilename finds a single language in a file name. A code is
+// only taken from the dot-separated token before the extension, as in
+// "Movie.2019.ENG.mkv" or "Movie.fin.srt".
+func languageFromFilename(filename string) string {
+	base := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	token := ""
+	if i := strings.LastIndex(base, "."); i >= 0 {
+		token = base[i+1:]
+	}
+	return languageFromText(base, token)
+}
+
+// normalizeLanguage converts a detector's output to an ISO 639-2/B code
+func normalizeLanguage(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if c, ok := twoLetterCodes[code]; ok {
+		return c
+	}
+	return languageCodes[code]
+}
+
+// tagLanguages infers languages for audio streams tagged "und" or not at all
+// and writes them into the probe, so the plan selects and tags the tracks as
+// if the source had been labelled. It returns the inferred sources by stream
+// index. Title tags are tried first, then the filename when it is the only
+// untagged track, then the detector.
+func tagLanguages(opts *LanguageTagging, input, filename string, probe *ProbeResult) map[int]string {
+	if opts == nil {
+		return nil
+	}
+	sources := make(map[int]string)
+
+	var untagged []int
+	for i, s := range probe.Streams {
+		if s.CodecType == "audio" && isUndetermined(s.Tags["language"]) {
+			untagged = append(untagged, i)
+		}
+	}
+
+	for _, i := range untagged {
+		s := &probe.Streams[i]
+		// A title may be the bare code, e.g. "ENG"
+		title := s.Tags["title"]
+		lang, source := languageFromText(title, strings.TrimSpace(title)), LanguageFromTitle
+		if lang == "" && len(untagged) == 1 {
+			lang, source = languageFromFilename(filename), LanguageFromFilename
+		}
+		if lang == "" && opts.Detector != "" {
+			detected, err := detectLanguage(opts.Detector, input, s.Index, probe.DurationSeconds())
+			if err != nil {
+				logError("Language detection failed for stream %d of %s: %v", s.Index, filename, err)
+			}
+			lang, source = detected, LanguageFromDetector
+		}
+		if lang == "" {
+			continue
+		}
+
+		if s.Tags == nil {
+			s.Tags = make(map[string]string)
+		}
+		s.Tags["language"] = lang
+		sources[s.Index] = source
+		logInfo("Tagged audio stream %d of %s as %s (from %s)", s.Index, filename, lang, source)
+	}
+	return sources
+}
+
+// detectLanguage extracts a mono 16 kHz sample of the stream from a third
+// of the way in and runs the detector command on it
+func detectLanguage(detector, input string, index int, duration float64) (string, error) {
+	fields := strings.Fields(detector)
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	sample := filepath.Join(os.TempDir(), fmt.Sprintf("langsample_%d.wav", time.Now().UnixNano()))
+	defer os.Remove(sample)
+
+	start := duration / 3
+	extract := exec.Command("ffmpeg", "-v", "error", "-y",
+		"-ss", fmt.Sprintf("%.3f", start),
+		"-i", input,
+		"-map", fmt.Sprintf("0:%d", index),
+		"-t", fmt.Sprint(languageSampleSeconds),
+		"-ac", "1", "-ar", "16000",
+		sample,
+	)
+	if out, err := extract.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("sample extraction failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	out, err := exec.Command(fields[0], append(fields[1:], sample)...).Output()
+	if err != nil {
+		return "", fmt.Errorf("detector failed: %v", err)
+	}
+	lang := normalizeLanguage(string(out))
+	if lang == "" {
+		return "", fmt.Errorf("detector returned unknown language %q", strings.TrimSpace(string(out)))
+	}
+	return lang, nil
+}
+
+// markLanguageSources records on the plan which stream languages were inferred
+func (p *Plan) markLanguageSources(sources map[int]string) {
+	for i, m := range p.Streams {
+		if source, ok := sources[m.InputIndex]; ok {
+			p.Streams[i].LanguageSource = source
+		}
+	}
+}
@@ -2,58 +2,169 @@ package mediaopt
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
+	"runtime"
 	"strings"
 	"sync"
+	"time"
+
+	"media_optimizer/pkg/gpu"
 )
 
 type OptimizationResult struct {
 	Success bool
 	Message string
 	Error   error
+	// Quality is set when a quality check was requested
+	Quality *QualityResult
+	// Probe holds the input's probe data once it has been read
+	Probe *ProbeResult
+	// BurnedSubtitles is set when burned-in subtitle detection ran
+	BurnedSubtitles *BurnedSubtitleReport
+	// Segments is set when black/silent segment detection ran
+	Segments *SegmentReport
+	// Crop is the area of the frame the output kept, nil when uncropped
+	Crop *Crop
+	// Warnings are carried over from the plan
+	Warnings []string
+	// Rejected is where an output that failed verification was kept, with
+	// an ErrRejected error, when quarantining
+	Rejected string
 }
 
 type ProgressCallback func(float64)
 
+// OutputCallback receives each line the encoder writes, tagged with the
+// stream ("stdout" or "stderr") it came from
+type OutputCallback func(stream, line string)
+
 type OptimizationParams struct {
+	// JobID keys the processes of the optimization for SetPaused; the input
+	// file does when empty
+	JobID string
+	// Context stops the optimization when done, killing its processes; nil
+	// never does
+	Context context.Context
+	// Timeout kills the optimization once it runs too long, failing it with
+	// ErrTimedOut; nil lets it run as long as it takes
+	Timeout    *Timeout
 	InputFile  string
 	OutputFile string
+	// OutputName renames OutputFile once the plan is known, a template of
+	// OutputName fields; empty keeps OutputFile
+	OutputName string
+	// NameForm is the Unicode normalization form of the output's name, a
+	// mediapath form; empty keeps the spelling of the source's
+	NameForm   string
 	TempDir    string
 	OnProgress ProgressCallback
+	// OnDetail receives ffmpeg's frame counters, speed and the estimated
+	// time remaining with each progress update when set
+	OnDetail DetailCallback
+	// OnStage is told each stage of the optimization as it begins, while
+	// OnProgress reports the progress over all stages
+	OnStage StageCallback
+	// OnOutput receives the encoder's output lines when set
+	OnOutput OutputCallback
+	// Streams overrides the automatic stream mapping when non-empty
+	Streams []StreamMapping
+	// Integrity enables decode and duration validation of the output when non-nil
+	Integrity *IntegrityCheck
+	// Quality enables post-encode verification when non-nil
+	Quality *QualityCheck
+	// Quarantine keeps outputs failing verification for review instead of
+	// deleting them when non-nil
+	Quarantine *QuarantineCheck
+	// Remux copies every stream into the container of OutputFile instead of
+	// applying the optimization plan
+	Remux bool
+	// HDR controls re-encoding of HDR video; nil preserves HDR
+	HDR *HDROptions
+	// MaxHeight downscales taller video, re-encoding it; zero keeps the size
+	MaxHeight int
+	// Filters deinterlace, denoise or crop video, re-encoding it; nil
+	// leaves frames as they are
+	Filters *VideoFilters
+	// CustomArgs adds ffmpeg options the other settings don't cover
+	CustomArgs *CustomArgs
+	// TargetSize is the desired output size in bytes. Video is re-encoded
+	// in two passes at the bitrate that fits; zero disables the mode.
+	TargetSize int64
+	// Languages infers languages for untagged audio when non-nil
+	Languages *LanguageTagging
+	// Video configures re-encoded video; nil copies video unless a stream
+	// mapping asks for a transcode, using the encoder defaults
+	Video *VideoEncoding
+	// Audio configures the kept audio tracks; nil downmixes them to
+	// DefaultAudio
+	Audio *AudioEncoding
+	// DetectBurnedSubtitles samples frames for hardcoded subtitles before
+	// encoding
+	DetectBurnedSubtitles bool
+	// DetectSegments reports black and silent stretches of at least this
+	// many seconds in the source; zero disables the analysis
+	DetectSegments float64
+	// Priority lowers the CPU and I/O priority of the encode; nil runs it
+	// unrestricted
+	Priority *Priority
+	// GPUs hands out hardware encoder sessions; nil leaves them unmanaged
+	GPUs *gpu.Pool
+	// Guardrails is GuardFallback (the default when empty) or GuardAttention,
+	// deciding whether streams the output can't carry safely are fixed or
+	// stop the job with ErrNeedsAttention
+	Guardrails string
+	// Stamp records what produced the output in its container metadata;
+	// nil writes none
+	Stamp *Stamp
+	// KeyframeSeconds re-encodes video with a keyframe at this interval, so
+	// that renditions of a ladder can be segmented at the same points; zero
+	// leaves keyframe placement to the encoder
+	KeyframeSeconds float64
 }
 
-var (
-	activeProcesses struct {
-		sync.Mutex
-		procs map[string]*exec.Cmd
-	}
-	logFile *os.File
-)
+var activeProcesses struct {
+	sync.Mutex
+	procs map[string]*trackedProcess
+	// paused is set while job processes are held stopped by SetPaused
+	paused bool
+	// timers are the time limits of running optimizations, which stop
+	// while paused
+	timers map[*pausableTimer]struct{}
+}
 
 func init() {
-	activeProcesses.procs = make(map[string]*exec.Cmd)
+	activeProcesses.procs = make(map[string]*trackedProcess)
+	activeProcesses.timers = make(map[*pausableTimer]struct{})
+}
 
-	logDir := filepath.Join(os.TempDir(), "ffmpeg_processing")
-	os.MkdirAll(logDir, 0755)
-	logPath := filepath.Join(logDir, "mediaopt.log")
-	var err error
-	logFile, err = os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Printf("Failed to open log file: %v", err)
-		return
+// DefaultLogFile is the log file used unless configured otherwise
+func DefaultLogFile() string {
+	return filepath.Join(os.TempDir(), "ffmpeg_processing", "mediaopt.log")
+}
+
+// processKey registers the optimization's processes in activeProcesses
+func (p *OptimizationParams) processKey() string {
+	if p.JobID != "" {
+		return p.JobID
 	}
-	log.SetOutput(logFile)
+	return p.InputFile
 }
 
 // NewDefaultParams creates default optimization parameters
 func NewDefaultParams(inputFile string) *OptimizationParams {
 	ext := filepath.Ext(inputFile)
 	base := inputFile[:len(inputFile)-len(ext)]
+	if IsDiscImage(inputFile) {
+		// The main title is remuxed out of the image into a regular file
+		ext = "." + TargetContainer
+	}
 	outputFile := base + "_optimized" + ext
 	tempDir := filepath.Join(os.TempDir(), "ffmpeg_processing")
 
@@ -64,48 +175,213 @@ func NewDefaultParams(inputFile string) *OptimizationParams {
 	}
 }
 
-// CleanupProcess ensures the script process is properly terminated
-func CleanupProcess(inputFile string) {
-	activeProcesses.Lock()
-	defer activeProcesses.Unlock()
+// context returns the optimization's context
+func (p *OptimizationParams) context() context.Context {
+	if p.Context == nil {
+		return context.Background()
+	}
+	return p.Context
+}
 
-	if cmd, exists := activeProcesses.procs[inputFile]; exists {
-		if cmd.Process != nil {
-			logInfo("Cleaning up process for %s", inputFile)
-			// Kill the process group to ensure all child processes are terminated
-			if pgid, err := os.FindProcess(-cmd.Process.Pid); err == nil {
-				pgid.Kill()
-			}
-			cmd.Process.Kill()
-			// Wait for process to finish
-			cmd.Wait()
+// buildPlan derives the plan from the probe, applying any user mappings
+func buildPlan(params *OptimizationParams, probe *ProbeResult) (*Plan, error) {
+	plan := BuildPlan(probe)
+	if params.Remux {
+		container, err := remuxContainer(params.OutputFile)
+		if err != nil {
+			return nil, err
+		}
+		plan = BuildRemuxPlan(probe, container)
+	}
+	if params.Video != nil && !params.Remux {
+		if err := params.Video.Validate(); err != nil {
+			return nil, err
+		}
+		plan.applyVideoEncoding(params.Video)
+	}
+	if params.Audio != nil && !params.Remux {
+		if err := params.Audio.Validate(); err != nil {
+			return nil, err
+		}
+		plan.applyAudioEncoding(params.Audio, probe)
+	}
+	if len(params.Streams) > 0 {
+		if err := plan.ApplyMappings(params.Streams, probe); err != nil {
+			return nil, fmt.Errorf("invalid stream mapping: %v", err)
+		}
+	}
+	if params.MaxHeight > 0 && !params.Remux {
+		plan.limitHeight(params.MaxHeight, probe, params.Video)
+	}
+	if params.Filters != nil && !params.Remux {
+		if err := plan.applyFilters(params.Filters, probe, params.Video); err != nil {
+			return nil, err
+		}
+	}
+	if params.KeyframeSeconds > 0 && !params.Remux {
+		plan.alignKeyframes(params.KeyframeSeconds, params.Video)
+	}
+
+	if params.TargetSize > 0 && !params.Remux {
+		if err := plan.fitToSize(params.TargetSize, probe, params.Video); err != nil {
+			return nil, err
+		}
+	}
+	if !params.Remux {
+		plan.applyWebM(probe)
+	}
+
+	plan.HDRMode = HDRPreserve
+	if params.HDR != nil {
+		switch params.HDR.Mode {
+		case HDRPreserve, HDRToneMap:
+			plan.HDRMode = params.HDR.Mode
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown HDR mode: %s", params.HDR.Mode)
+		}
+		plan.ToneMap = params.HDR.ToneMap
+	}
+	if params.Priority != nil {
+		if err := params.Priority.Validate(); err != nil {
+			return nil, err
+		}
+		plan.Threads = params.Priority.Threads
+	}
+	if params.CustomArgs != nil {
+		if err := params.CustomArgs.Validate(); err != nil {
+			return nil, err
 		}
-		delete(activeProcesses.procs, inputFile)
+		plan.CustomArgs = params.CustomArgs
+	}
+	plan.Stamp = params.Stamp
+	if err := plan.applyGuardrails(params.Guardrails, params, probe); err != nil {
+		return nil, err
+	}
+	plan.Warnings = append(plan.Warnings, plan.hdrWarnings()...)
+	return plan, nil
+}
+
+// output passes an encoder output line to OnOutput
+func (p *OptimizationParams) output(stream, line string) {
+	if p.OnOutput != nil {
+		p.OnOutput(stream, line)
 	}
 }
 
-// Logging functions
+// pipeline returns the stages of an optimization following the plan,
+// reporting to OnStage and OnProgress
+func (p *OptimizationParams) pipeline(plan *Plan) *Pipeline {
+	stages := []Stage{{StageProbe, 1}}
+	if p.DetectBurnedSubtitles || p.DetectSegments > 0 || plan.autoCrop() || plan.autoDeinterlace() || plan.perTitle() {
+		stages = append(stages, Stage{StageAnalyze, 4})
+	}
+	if plan.twoPass() {
+		stages = append(stages, Stage{StageFirstPass, 30})
+	}
+	stages = append(stages, Stage{StageEncode, 60})
+	// Quality scoring decodes both files, integrity only the output
+	switch {
+	case p.Quality != nil:
+		stages = append(stages, Stage{StageVerify, 20})
+	case p.Integrity != nil:
+		stages = append(stages, Stage{StageVerify, 5})
+	}
+
+	// The probe stage was reported before the plan existed
+	last := StageProbe
+	return NewPipeline(func(stage string, progress float64) {
+		if stage != last {
+			last = stage
+			p.stage(stage)
+		}
+		if p.OnProgress != nil {
+			p.OnProgress(progress)
+		}
+	}, stages...)
+}
+
+func (p *OptimizationParams) stage(name string) {
+	if p.OnStage != nil {
+		p.OnStage(name)
+	}
+}
+
+// lineWriter splits written bytes into lines for an OutputCallback
+type lineWriter struct {
+	stream string
+	params *OptimizationParams
+	buf    []byte
+	// onLine also receives each line when set
+	onLine func(string)
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		line := strings.TrimRight(string(w.buf[:i]), "\r")
+		w.params.output(w.stream, line)
+		if w.onLine != nil {
+			w.onLine(line)
+		}
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// Logging functions. They go to the default slog logger, which the server
+// configures, tagged with the package.
 func logError(format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
-	log.Printf("ERROR: %s", msg)
-	fmt.Printf("ERROR: %s\n", msg)
+	slog.Error(fmt.Sprintf(format, v...), "pkg", "mediaopt")
 }
 
 func logInfo(format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
-	log.Printf("INFO: %s", msg)
-	fmt.Printf("INFO: %s\n", msg)
+	slog.Info(fmt.Sprintf(format, v...), "pkg", "mediaopt")
 }
 
 func logDebug(format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
-	log.Printf("DEBUG: %s", msg)
-	fmt.Printf("DEBUG: %s\n", msg)
+	slog.Debug(fmt.Sprintf(format, v...), "pkg", "mediaopt")
+}
+
+// encodeCommand returns the command encoding input into partial with the
+// plan's options: the optimization script at scriptPath, or ffmpeg itself
+// without one
+func encodeCommand(params *OptimizationParams, scriptPath, input, partial string, plan *Plan) *exec.Cmd {
+	if scriptPath == "" {
+		args := append([]string{"-hide_banner", "-nostats", "-progress", "pipe:1"}, inputArgs(params, plan)...)
+		args = append(append(append(args, "-i", input), plan.OutputArgs()...), partial)
+		return params.Priority.command(params.context(), "ffmpeg", args...)
+	}
+	scriptArgs := append([]string{scriptPath, input, partial}, plan.OutputArgs()...)
+	cmd := params.Priority.command(params.context(), "/bin/bash", scriptArgs...)
+	if args := inputArgs(params, plan); len(args) > 0 {
+		cmd.Env = append(os.Environ(), inputArgsEnv+"="+strings.Join(args, "\n"))
+	}
+	return cmd
 }
 
-func OptimizeMedia(params *OptimizationParams) OptimizationResult {
+func OptimizeMedia(params *OptimizationParams) (outcome OptimizationResult) {
+	// Attach the probe and analysis to every outcome so failures can be
+	// attributed to source properties
+	var (
+		probe    *ProbeResult
+		burnIn   *BurnedSubtitleReport
+		segments *SegmentReport
+		crop     *Crop
+		warnings []string
+	)
+	defer func() {
+		outcome.Probe = probe
+		outcome.BurnedSubtitles = burnIn
+		outcome.Segments = segments
+		outcome.Crop = crop
+		outcome.Warnings = warnings
+	}()
+
 	logInfo("Starting optimization for %s", params.InputFile)
-	logInfo("Log file location: %s", filepath.Join(params.TempDir, "mediaopt.log"))
 
 	if _, err := os.Stat(params.InputFile); os.IsNotExist(err) {
 		return OptimizationResult{
@@ -114,20 +390,24 @@ func OptimizeMedia(params *OptimizationParams) OptimizationResult {
 		}
 	}
 
-	// Ensure the scripts directory exists and the script is executable
-	scriptPath := filepath.Join("scripts", "optimize_media.sh")
-	if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
-		return OptimizationResult{
-			Success: false,
-			Error:   fmt.Errorf("optimization script not found: %s", scriptPath),
+	// Ensure the scripts directory exists and the script is executable.
+	// Windows has no bash to run it, so ffmpeg is run directly there.
+	var scriptPath string
+	if runtime.GOOS != "windows" {
+		scriptPath = filepath.Join("scripts", "optimize_media.sh")
+		if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
+			return OptimizationResult{
+				Success: false,
+				Error:   fmt.Errorf("optimization script not found: %s", scriptPath),
+			}
 		}
-	}
 
-	// Make script executable
-	if err := os.Chmod(scriptPath, 0755); err != nil {
-		return OptimizationResult{
-			Success: false,
-			Error:   fmt.Errorf("failed to make script executable: %v", err),
+		// Make script executable
+		if err := os.Chmod(scriptPath, 0755); err != nil {
+			return OptimizationResult{
+				Success: false,
+				Error:   fmt.Errorf("failed to make script executable: %v", err),
+			}
 		}
 	}
 
@@ -139,21 +419,108 @@ func OptimizeMedia(params *OptimizationParams) OptimizationResult {
 		}
 	}
 
-	// Execute the optimization script
-	cmd := exec.Command("/bin/bash", scriptPath, params.InputFile)
+	// Disc images are opened to expose their main title to ffmpeg
+	input := params.InputFile
+	if IsDiscImage(params.InputFile) {
+		disc, err := OpenDiscImage(params.InputFile, params.TempDir)
+		if err != nil {
+			return OptimizationResult{
+				Success: false,
+				Error:   err,
+			}
+		}
+		defer disc.Close()
+		input = disc.Input
+		logInfo("Using %s input %s for disc image %s", disc.Method, input, params.InputFile)
+	}
 
-	// Track the process
-	activeProcesses.Lock()
-	activeProcesses.procs[params.InputFile] = cmd
-	activeProcesses.Unlock()
+	// Fail fast rather than letting ffmpeg run out of space mid-encode
+	params.stage(StageProbe)
+	probe, err := Probe(input)
+	if err != nil {
+		return OptimizationResult{
+			Success: false,
+			Error:   fmt.Errorf("failed to probe input file: %v", err),
+		}
+	}
+	// A hung encoder is killed once the time allowed for the input is up,
+	// not counting the time the job spends paused
+	if limit := params.Timeout.limit(probe.DurationSeconds()); limit > 0 {
+		ctx, cancel := withTimeLimit(params.context(), limit, fmt.Errorf("%w after %v", ErrTimedOut, limit))
+		defer cancel()
+		defer func(parent context.Context) { params.Context = parent }(params.Context)
+		params.Context = ctx
+		defer func() {
+			if cause := context.Cause(ctx); outcome.Error != nil && errors.Is(cause, ErrTimedOut) {
+				outcome.Error = cause
+			}
+		}()
+	}
+	if err := CheckDiskSpace(params, probe); err != nil {
+		return OptimizationResult{
+			Success: false,
+			Error:   err,
+		}
+	}
 
-	// Clean up when done
+	languages := tagLanguages(params.Languages, input, params.InputFile, probe)
+	plan, err := buildPlan(params, probe)
+	if err != nil {
+		return OptimizationResult{
+			Success: false,
+			Error:   err,
+		}
+	}
+	plan.markLanguageSources(languages)
+	if err := applyOutputName(params, plan, probe); err != nil {
+		return OptimizationResult{
+			Success: false,
+			Error:   err,
+		}
+	}
+	pipeline := params.pipeline(plan)
+	pipeline.Start(StageAnalyze)
+	burnIn = analyzeBurnedSubtitles(params, input, probe, plan)
+	segments = analyzeSegments(params, input, probe, plan)
+	analyzeCrop(params, input, probe, plan)
+	analyzeInterlace(params, input, probe, plan)
+	analyzeComplexity(params, input, probe, plan)
+	crop = plan.Crop
+	// Hardware encodes need a free GPU session or fall back to software
+	releaseGPU := plan.assignGPU(params.GPUs)
+	defer releaseGPU()
+	warnings = plan.Warnings
+	logInfo("Plan for %s: %s", params.InputFile, plan.Summary())
+	params.output("info", "Plan: "+plan.Summary())
+
+	// Two-pass encodes analyse the video first; the script runs the second pass
+	if plan.twoPass() {
+		plan.PassLogFile = filepath.Join(params.TempDir, fmt.Sprintf("pass_%d", time.Now().UnixNano()))
+		defer removePassLogs(plan.PassLogFile)
+		pipeline.Start(StageFirstPass)
+		if err := runFirstPass(params, input, plan, probe, pipeline.Progress(StageFirstPass)); err != nil {
+			return OptimizationResult{
+				Success: false,
+				Error:   err,
+			}
+		}
+	}
+
+	// The output is written under a partial name and only put in place once
+	// verified, so players never see an incomplete file
+	partial := PartialPath(params.OutputFile)
+	os.Remove(partial)
+	placed := false
 	defer func() {
-		activeProcesses.Lock()
-		delete(activeProcesses.procs, params.InputFile)
-		activeProcesses.Unlock()
+		if !placed {
+			os.Remove(partial)
+		}
 	}()
 
+	// Execute the optimization script with the plan's ffmpeg output options
+	pipeline.Start(StageEncode)
+	cmd := encodeCommand(params, scriptPath, input, partial, plan)
+
 	// Capture stdout and stderr
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -171,54 +538,66 @@ func OptimizeMedia(params *OptimizationParams) OptimizationResult {
 		}
 	}
 
-	// Start the command
-	if err := cmd.Start(); err != nil {
+	// Start the command in its own process group and track it
+	proc, err := startProcess(params.processKey(), cmd)
+	if err != nil {
 		return OptimizationResult{
 			Success: false,
 			Error:   fmt.Errorf("failed to start optimization script: %v", err),
 		}
 	}
 
+	// Clean up when done
+	defer func() {
+		activeProcesses.Lock()
+		delete(activeProcesses.procs, params.processKey())
+		activeProcesses.Unlock()
+	}()
+
 	// Create channels for monitoring
 	doneChan := make(chan struct{})
-	progressChan := make(chan float64)
+	progressChan := make(chan ProgressDetail)
 
 	// Monitor stdout
 	go func() {
 		scanner := bufio.NewScanner(stdout)
-		var totalDuration float64
+		parser := newProgressParser(time.Now())
+		parser.frameRate = probe.VideoFrameRate()
+		if scriptPath == "" {
+			// The script reports the duration; ffmpeg alone doesn't
+			parser.duration = probe.DurationSeconds()
+		}
 		for scanner.Scan() {
 			text := scanner.Text()
-			logInfo("Script output: %s", text)
-			if strings.HasPrefix(text, "total_duration=") {
-				durationStr := strings.TrimPrefix(text, "total_duration=")
-				totalDuration, _ = strconv.ParseFloat(durationStr, 64)
-			}
-			if strings.HasPrefix(text, "out_time_ms=") && totalDuration > 0 {
-				timeStr := strings.TrimPrefix(text, "out_time_ms=")
-				timeMs, _ := strconv.ParseInt(timeStr, 10, 64)
-				timeSec := float64(timeMs) / 1000000.0
-				progress := (timeSec / totalDuration) * 100
-				progressChan <- progress
+			logDebug("Script output: %s", text)
+			params.output("stdout", text)
+			if detail, ok := parser.line(text, time.Now()); ok {
+				progressChan <- detail
 			}
 		}
 	}()
 
 	// Monitor stderr
+	var tail outputTail
 	go func() {
 		scanner := bufio.NewScanner(stderr)
 		for scanner.Scan() {
-			logError("Script error: %s", scanner.Text())
+			logDebug("Script error: %s", scanner.Text())
+			params.output("stderr", scanner.Text())
+			tail.add(scanner.Text())
 		}
 	}()
 
 	// Monitor progress if callback is provided
-	if params.OnProgress != nil {
+	if params.OnProgress != nil || params.OnDetail != nil {
 		go func() {
 			for {
 				select {
-				case progress := <-progressChan:
-					params.OnProgress(progress)
+				case detail := <-progressChan:
+					pipeline.Update(StageEncode, detail.Percent)
+					if params.OnDetail != nil {
+						params.OnDetail(detail)
+					}
 				case <-doneChan:
 					return
 				}
@@ -227,27 +606,81 @@ func OptimizeMedia(params *OptimizationParams) OptimizationResult {
 	}
 
 	// Wait for completion
-	err = cmd.Wait()
+	err = proc.wait()
 	close(doneChan)
 
 	if err != nil {
+		if line, ok := tail.transientLine(); ok {
+			err = fmt.Errorf("%v: %w: %s", err, ErrTransient, line)
+		}
 		return OptimizationResult{
 			Success: false,
-			Error:   fmt.Errorf("optimization failed: %v", err),
+			Error:   fmt.Errorf("optimization failed: %w", err),
 		}
 	}
 
 	// Check if output file exists
-	expectedOutput := strings.TrimSuffix(params.InputFile, filepath.Ext(params.InputFile)) + "_optimized" + filepath.Ext(params.InputFile)
-	if _, err := os.Stat(expectedOutput); os.IsNotExist(err) {
+	if _, err := os.Stat(partial); os.IsNotExist(err) {
 		return OptimizationResult{
 			Success: false,
-			Error:   fmt.Errorf("output file was not created: %s", expectedOutput),
+			Error:   fmt.Errorf("output file was not created: %s", params.OutputFile),
+		}
+	}
+
+	// reject fails the optimization on an output that didn't pass
+	// verification, keeping the output when quarantining
+	reject := func(result OptimizationResult, err error) OptimizationResult {
+		result.Success = false
+		result.Error = err
+		if params.Quarantine != nil {
+			placed = true
+			result.Rejected = partial
+			result.Error = fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+		return result
+	}
+
+	// Make sure the output is complete before anything relies on it
+	pipeline.Start(StageVerify)
+	if params.Integrity != nil {
+		if err := validateIntegrity(params.Integrity, probe, plan, partial); err != nil {
+			logError("Integrity check failed for %s: %v", params.OutputFile, err)
+			return reject(OptimizationResult{}, fmt.Errorf("integrity check failed: %v", err))
+		}
+	}
+	if params.Quarantine != nil {
+		if err := params.Quarantine.checkDuration(probe, partial); err != nil {
+			logError("Duration check failed for %s: %v", params.OutputFile, err)
+			return reject(OptimizationResult{}, err)
 		}
 	}
 
-	return OptimizationResult{
+	result := OptimizationResult{
 		Success: true,
 		Message: fmt.Sprintf("Successfully optimized %s", params.InputFile),
 	}
+
+	// Optionally score the output against the source
+	if params.Quality != nil {
+		quality, err := verifyQuality(params.Quality, input, partial)
+		if err != nil {
+			return OptimizationResult{
+				Success: false,
+				Error:   fmt.Errorf("quality verification failed: %v", err),
+			}
+		}
+		result.Quality = quality
+		if !quality.Passed && params.Quality.FailBelow {
+			return reject(result, fmt.Errorf("%s score %.4f is below threshold %.4f", quality.Metric, quality.Score, quality.Threshold))
+		}
+	}
+
+	if err := placeOutput(partial, params.OutputFile); err != nil {
+		return OptimizationResult{
+			Success: false,
+			Error:   fmt.Errorf("failed to put the output in place: %v", err),
+		}
+	}
+	placed = true
+	return result
 }
@@ -1,11 +1,18 @@
 package mediaopt
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"syscall"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"media_optimizer/pkg/gpu"
 )
 
 func TestNewDefaultParams(t *testing.T) {
@@ -26,35 +33,36 @@ func TestNewDefaultParams(t *testing.T) {
 	}
 }
 
-func TestCleanupProcess(t *testing.T) {
-	// Create a test command that sleeps
-	cmd := exec.Command("ping", "127.0.0.1", "-n", "10")
+func TestStartProcessCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// Add it to active processes
-	activeProcesses.Lock()
-	activeProcesses.procs["test"] = cmd
-	activeProcesses.Unlock()
+	// Create a test command that sleeps
+	cmd := exec.CommandContext(ctx, "sleep", "10")
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "ping", "127.0.0.1", "-n", "10")
+	}
 
-	// Start the command
-	if err := cmd.Start(); err != nil {
+	proc, err := startProcess("test", cmd)
+	if err != nil {
 		t.Fatalf("Failed to start test command: %v", err)
 	}
+	defer func() {
+		activeProcesses.Lock()
+		delete(activeProcesses.procs, "test")
+		activeProcesses.Unlock()
+	}()
 
-	// Call cleanup
-	CleanupProcess("test")
-
-	// Verify process was cleaned up
-	activeProcesses.Lock()
-	_, exists := activeProcesses.procs["test"]
-	activeProcesses.Unlock()
+	cancel()
 
-	if exists {
-		t.Error("Process should have been removed from active processes")
+	// Verify process was terminated and reaped
+	select {
+	case <-proc.done:
+	case <-time.After(terminateGracePeriod):
+		t.Fatal("Process should have been terminated")
 	}
-
-	// Verify process was terminated using syscall.Signal
-	if err := cmd.Process.Signal(syscall.Signal(0)); err == nil {
-		t.Error("Process should have been terminated")
+	if !proc.cancelled.Load() {
+		t.Error("Process should be marked as cancelled")
 	}
 }
 
@@ -113,3 +121,1611 @@ exit 1  # Simulate failure for test
 		t.Error("Expected failure with non-existent file")
 	}
 }
+
+func TestValidateInputRejectsExtension(t *testing.T) {
+	allowed := []string{".mkv", ".mp4"}
+
+	if !HasExtension("/media/Movie.MKV", allowed) {
+		t.Error("Expected upper-case extension to be accepted")
+	}
+
+	for _, path := range []string{"/media/disc.iso", "/media/setup.exe", "/media/noext"} {
+		if err := ValidateInput(path, allowed); err == nil {
+			t.Errorf("Expected %s to be rejected", path)
+		}
+	}
+}
+
+func TestEstimateOutputSize(t *testing.T) {
+	probe := &ProbeResult{
+		Format: ProbeFormat{Duration: "100", BitRate: "8000000"},
+		Streams: []ProbeStream{
+			{CodecType: "video"},
+			{CodecType: "audio", BitRate: "640000"},
+		},
+	}
+
+	// (8000000-640000)*100/8 video + 384000*100/8 audio
+	expected := int64(92000000 + 4800000)
+	if got := EstimateOutputSize(probe, 1); got != expected {
+		t.Errorf("Expected estimate %d, got %d", expected, got)
+	}
+
+	if got := EstimateOutputSize(&ProbeResult{}, 42); got != 42 {
+		t.Errorf("Expected fallback to input size, got %d", got)
+	}
+}
+
+func TestBuildPlan(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams []ProbeStream
+		// expected holds the mapping fields the plan decides; the rest are
+		// copied from the probe
+		expected []StreamMapping
+		// normalize is whether dynaudnorm precedes the volume boost
+		normalize bool
+	}{
+		{
+			name: "HEVC with a second language",
+			streams: []ProbeStream{
+				{Index: 0, CodecType: "video", CodecName: "hevc"},
+				{Index: 1, CodecType: "audio", CodecName: "dts", Tags: map[string]string{"language": "eng"}},
+				{Index: 2, CodecType: "audio", CodecName: "ac3", Tags: map[string]string{"language": "fre"}},
+				{Index: 3, CodecType: "subtitle", CodecName: "subrip"},
+			},
+			expected: []StreamMapping{
+				{Type: "video", SourceCodec: "hevc", TargetCodec: "hevc", Action: ActionCopy},
+				{Type: "audio", SourceCodec: "dts", TargetCodec: "ac3", Action: ActionTranscode, Channels: 2, Language: "eng"},
+				{Type: "audio", SourceCodec: "ac3", Action: ActionDrop, Language: "fre"},
+				{Type: "subtitle", SourceCodec: "subrip", Action: ActionDrop},
+			},
+			normalize: true,
+		},
+		{
+			name: "H.264 with subtitles and attachments",
+			streams: []ProbeStream{
+				{Index: 0, CodecType: "video", CodecName: "h264"},
+				{Index: 1, CodecType: "audio", CodecName: "aac", Channels: 2, Tags: map[string]string{"language": "eng"}},
+				{Index: 2, CodecType: "subtitle", CodecName: "subrip", Tags: map[string]string{"language": "eng"}},
+				{Index: 3, CodecType: "subtitle", CodecName: "hdmv_pgs_subtitle", Tags: map[string]string{"language": "eng"}},
+				{Index: 4, CodecType: "attachment", CodecName: "ttf"},
+			},
+			expected: []StreamMapping{
+				{Type: "video", SourceCodec: "h264", TargetCodec: "h264", Action: ActionCopy},
+				{Type: "audio", SourceCodec: "aac", TargetCodec: "ac3", Action: ActionTranscode, Channels: 2, Language: "eng"},
+				{Type: "subtitle", SourceCodec: "subrip", Action: ActionDrop, Language: "eng"},
+				{Type: "subtitle", SourceCodec: "hdmv_pgs_subtitle", Action: ActionDrop, Language: "eng"},
+				{Type: "attachment", SourceCodec: "ttf", Action: ActionDrop},
+			},
+		},
+		{
+			name: "English track after another language",
+			streams: []ProbeStream{
+				{Index: 0, CodecType: "video", CodecName: "mpeg4"},
+				{Index: 1, CodecType: "audio", CodecName: "mp3", Tags: map[string]string{"language": "jpn"}},
+				{Index: 2, CodecType: "audio", CodecName: "truehd", Channels: 8, Tags: map[string]string{"language": "eng"}},
+			},
+			expected: []StreamMapping{
+				{Type: "video", SourceCodec: "mpeg4", TargetCodec: "mpeg4", Action: ActionCopy},
+				{Type: "audio", SourceCodec: "mp3", Action: ActionDrop, Language: "jpn"},
+				{Type: "audio", SourceCodec: "truehd", TargetCodec: "ac3", Action: ActionTranscode, Channels: 2, Language: "eng"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		plan := BuildPlan(&ProbeResult{Streams: tt.streams})
+		if len(plan.Streams) != len(tt.expected) {
+			t.Fatalf("%s: expected %d streams, got %d", tt.name, len(tt.expected), len(plan.Streams))
+		}
+		for i, want := range tt.expected {
+			got := plan.Streams[i]
+			if got.InputIndex != i || got.Type != want.Type || got.SourceCodec != want.SourceCodec {
+				t.Errorf("%s: stream %d: expected input %d %s %s, got %d %s %s", tt.name, i, i, want.Type, want.SourceCodec, got.InputIndex, got.Type, got.SourceCodec)
+			}
+			if got.Action != want.Action || got.TargetCodec != want.TargetCodec {
+				t.Errorf("%s: stream %d: expected %s to %q, got %s to %q", tt.name, i, want.Action, want.TargetCodec, got.Action, got.TargetCodec)
+			}
+			if got.Channels != want.Channels || got.Language != want.Language {
+				t.Errorf("%s: stream %d: expected %d channels in %q, got %d in %q", tt.name, i, want.Channels, want.Language, got.Channels, got.Language)
+			}
+			if (got.Action == ActionDrop) != (got.Reason != "") {
+				t.Errorf("%s: stream %d: expected a reason exactly for drops, got %s with %q", tt.name, i, got.Action, got.Reason)
+			}
+		}
+		if normalized := strings.HasPrefix(plan.AudioFilter, "dynaudnorm"); normalized != tt.normalize {
+			t.Errorf("%s: expected normalization %v, got filter %q", tt.name, tt.normalize, plan.AudioFilter)
+		}
+	}
+}
+
+func TestIntegrityProbeCheck(t *testing.T) {
+	source := &ProbeResult{
+		Format: ProbeFormat{Duration: "3600.00"},
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "h264"},
+			{Index: 1, CodecType: "audio", CodecName: "aac"},
+			{Index: 2, CodecType: "subtitle", CodecName: "subrip"},
+		},
+	}
+	// The subtitles are dropped, so the output needn't have any
+	plan := &Plan{Streams: []StreamMapping{
+		{InputIndex: 0, Type: "video", Action: ActionCopy},
+		{InputIndex: 1, Type: "audio", Action: ActionTranscode},
+		{InputIndex: 2, Type: "subtitle", Action: ActionDrop},
+	}}
+	check := &IntegrityCheck{DurationTolerance: 2}
+	output := func(duration string, types ...string) *ProbeResult {
+		probe := &ProbeResult{Format: ProbeFormat{Duration: duration}}
+		for i, codecType := range types {
+			probe.Streams = append(probe.Streams, ProbeStream{Index: i, CodecType: codecType})
+		}
+		return probe
+	}
+
+	tests := []struct {
+		name   string
+		output *ProbeResult
+		err    string
+	}{
+		{"same duration", output("3600.00", "video", "audio"), ""},
+		{"within tolerance", output("3598.50", "video", "audio"), ""},
+		{"at tolerance", output("3602.00", "video", "audio"), ""},
+		{"truncated", output("3597.90", "video", "audio"), "differs from source"},
+		{"longer", output("3610.00", "video", "audio"), "differs from source"},
+		{"missing audio", output("3600.00", "video"), "missing its audio stream"},
+	}
+	for _, tt := range tests {
+		err := checkOutputProbe(check, source, tt.output, plan)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: expected the output to pass, got %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.err, err)
+		}
+	}
+
+	// A source of unknown duration can't be compared
+	unknown := *source
+	unknown.Format.Duration = ""
+	if err := checkOutputProbe(check, &unknown, output("12.00", "video", "audio"), plan); err != nil {
+		t.Errorf("Expected no duration check without a source duration, got %v", err)
+	}
+}
+
+func TestFindMainTitle(t *testing.T) {
+	root := t.TempDir()
+	videoTS := filepath.Join(root, "VIDEO_TS")
+	if err := os.MkdirAll(videoTS, 0755); err != nil {
+		t.Fatalf("Failed to create VIDEO_TS: %v", err)
+	}
+
+	files := map[string]int{
+		"VTS_01_0.VOB": 10,
+		"VTS_01_1.VOB": 50,
+		"VTS_02_1.VOB": 100,
+		"VTS_02_2.VOB": 100,
+	}
+	for name, size := range files {
+		if err := os.WriteFile(filepath.Join(videoTS, name), make([]byte, size), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	input, err := findMainTitle(root)
+	if err != nil {
+		t.Fatalf("Expected a main title, got error: %v", err)
+	}
+
+	expected := "concat:" + filepath.Join(videoTS, "VTS_02_1.VOB") + "|" + filepath.Join(videoTS, "VTS_02_2.VOB")
+	if input != expected {
+		t.Errorf("Expected %s, got %s", expected, input)
+	}
+
+	if params := NewDefaultParams("/media/movie.iso"); filepath.Base(params.OutputFile) != "movie_optimized.mp4" {
+		t.Errorf("Expected mp4 output for disc image, got %s", params.OutputFile)
+	}
+}
+
+func TestApplyMappings(t *testing.T) {
+	probe := &ProbeResult{
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "h264"},
+			{Index: 1, CodecType: "audio", CodecName: "dts", Tags: map[string]string{"language": "eng"}},
+			{Index: 2, CodecType: "audio", CodecName: "ac3", Tags: map[string]string{"language": "jpn"}},
+			{Index: 3, CodecType: "subtitle", CodecName: "subrip"},
+		},
+	}
+
+	plan := BuildPlan(probe)
+	err := plan.ApplyMappings([]StreamMapping{
+		{InputIndex: 0, Action: ActionCopy},
+		{InputIndex: 2, Action: ActionCopy, Language: "jpn", Disposition: []string{"default"}},
+		{InputIndex: 3, Action: ActionTranscode, TargetCodec: "mov_text", Disposition: []string{"forced"}},
+	}, probe)
+	if err != nil {
+		t.Fatalf("ApplyMappings failed: %v", err)
+	}
+
+	args := strings.Join(plan.OutputArgs(), " ")
+	for _, expected := range []string{
+		"-map 0:0 -c:0 copy",
+		"-map 0:2 -c:1 copy -metadata:s:1 language=jpn -disposition:1 default",
+		"-map 0:3 -c:2 mov_text -disposition:2 forced",
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("Expected args to contain %q, got %s", expected, args)
+		}
+	}
+	if strings.Contains(args, "0:1") {
+		t.Errorf("Unmapped stream 1 should be dropped, got %s", args)
+	}
+
+	invalid := [][]StreamMapping{
+		{{InputIndex: 9, Action: ActionCopy}},
+		{{InputIndex: 1, Action: ActionTranscode}},
+		{{InputIndex: 1, Action: "mangle"}},
+		{{InputIndex: 1, Action: ActionCopy}, {InputIndex: 1, Action: ActionCopy}},
+		{{InputIndex: 1, Action: ActionCopy, Disposition: []string{"loud"}}},
+	}
+	for _, mappings := range invalid {
+		if err := BuildPlan(probe).ApplyMappings(mappings, probe); err == nil {
+			t.Errorf("Expected error for mapping %+v", mappings)
+		}
+	}
+}
+
+func TestBuildRemuxPlan(t *testing.T) {
+	probe := &ProbeResult{
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "h264"},
+			{Index: 1, CodecType: "audio", CodecName: "dts"},
+			{Index: 2, CodecType: "subtitle", CodecName: "subrip"},
+			{Index: 3, CodecType: "subtitle", CodecName: "hdmv_pgs_subtitle"},
+			{Index: 4, CodecType: "attachment", CodecName: "ttf"},
+		},
+	}
+
+	mp4 := BuildRemuxPlan(probe, "mp4")
+	expected := []string{ActionCopy, ActionCopy, ActionTranscode, ActionDrop, ActionDrop}
+	for i, m := range mp4.Streams {
+		if m.Action != expected[i] {
+			t.Errorf("mp4 stream %d: expected %s, got %s", i, expected[i], m.Action)
+		}
+	}
+	if mp4.Streams[2].TargetCodec != "mov_text" {
+		t.Errorf("Expected subrip to become mov_text, got %s", mp4.Streams[2].TargetCodec)
+	}
+
+	mkv := BuildRemuxPlan(probe, "matroska")
+	for _, m := range mkv.Streams {
+		if m.Action != ActionCopy {
+			t.Errorf("mkv stream %d: expected copy, got %s", m.InputIndex, m.Action)
+		}
+	}
+	if args := strings.Join(mkv.OutputArgs(), " "); strings.Contains(args, "movflags") {
+		t.Errorf("Matroska output should not get movflags, got %s", args)
+	}
+
+	params, err := NewRemuxParams("/media/movie.avi", "MKV")
+	if err != nil {
+		t.Fatalf("NewRemuxParams failed: %v", err)
+	}
+	if params.OutputFile != "/media/movie_optimized.mkv" || !params.Remux {
+		t.Errorf("Unexpected remux params %+v", params)
+	}
+	if _, err := NewRemuxParams("/media/movie.avi", "avi"); err == nil {
+		t.Error("Expected error for unsupported container")
+	}
+}
+
+func TestBurnedSubtitleClassification(t *testing.T) {
+	textFrame := edgeSample{subtitle: 14, middle: 4}
+	busyFrame := edgeSample{subtitle: 14, middle: 12}
+	quietFrame := edgeSample{subtitle: 1, middle: 1}
+
+	report := classifyEdgeSamples([]edgeSample{textFrame, textFrame, busyFrame, quietFrame, textFrame})
+	if !report.Detected || report.FramesWithText != 3 {
+		t.Errorf("Expected detection with 3 text frames, got %+v", report)
+	}
+
+	report = classifyEdgeSamples([]edgeSample{textFrame, busyFrame, busyFrame, quietFrame, quietFrame})
+	if report.Detected {
+		t.Errorf("Busy scenes should not be mistaken for subtitles, got %+v", report)
+	}
+
+	plan := &Plan{Streams: []StreamMapping{
+		{InputIndex: 0, Type: "video", Action: ActionCopy, Disposition: []string{"default"}},
+		{InputIndex: 1, Type: "subtitle", Action: ActionCopy, Disposition: []string{"default", "forced", "hearing_impaired"}},
+	}}
+	suppressSubtitleDisplay(plan)
+	if d := plan.Streams[1].Disposition; len(d) != 1 || d[0] != "hearing_impaired" {
+		t.Errorf("Expected only hearing_impaired to remain, got %v", d)
+	}
+	if d := plan.Streams[0].Disposition; len(d) != 1 {
+		t.Errorf("Video disposition should be untouched, got %v", d)
+	}
+}
+
+func TestHDRHandling(t *testing.T) {
+	hdr10 := ProbeStream{
+		Index: 0, CodecType: "video", CodecName: "hevc", ColorTransfer: "smpte2084",
+		SideData: []map[string]interface{}{
+			{
+				"side_data_type": "Mastering display metadata",
+				"red_x":          "34000/50000", "red_y": "16000/50000",
+				"green_x": "13250/50000", "green_y": "34500/50000",
+				"blue_x": "7500/50000", "blue_y": "3000/50000",
+				"white_point_x": "15635/50000", "white_point_y": "16450/50000",
+				"max_luminance": "10000000/10000", "min_luminance": "50/10000",
+			},
+			{"side_data_type": "Content light level metadata", "max_content": float64(1000), "max_average": float64(400)},
+		},
+	}
+	dv := ProbeStream{Index: 0, CodecType: "video", CodecName: "hevc", ColorTransfer: "smpte2084",
+		SideData: []map[string]interface{}{{"side_data_type": "DOVI configuration record"}}}
+
+	if f := hdr10.HDRFormat(); f != HDR10 {
+		t.Errorf("Expected hdr10, got %q", f)
+	}
+	if f := (ProbeStream{ColorTransfer: "arib-std-b67"}).HDRFormat(); f != HLG {
+		t.Errorf("Expected hlg, got %q", f)
+	}
+	if f := dv.HDRFormat(); f != DolbyVision {
+		t.Errorf("Expected dolby_vision, got %q", f)
+	}
+
+	probe := &ProbeResult{Streams: []ProbeStream{hdr10}}
+	reencode := []StreamMapping{{InputIndex: 0, Action: ActionTranscode, TargetCodec: "libx265"}}
+
+	plan, err := buildPlan(&OptimizationParams{Streams: reencode}, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	args := strings.Join(plan.OutputArgs(), " ")
+	for _, expected := range []string{
+		"-pix_fmt:0 yuv420p10le",
+		"-color_trc:0 smpte2084",
+		"master-display=G(13250,34500)B(7500,3000)R(34000,16000)WP(15635,16450)L(10000000,50)",
+		"max-cll=1000,400",
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("Expected preserve args to contain %q, got %s", expected, args)
+		}
+	}
+
+	plan, err = buildPlan(&OptimizationParams{Streams: reencode, HDR: &HDROptions{Mode: HDRToneMap, ToneMap: "mobius"}}, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	args = strings.Join(plan.OutputArgs(), " ")
+	if !strings.Contains(args, "tonemap=tonemap=mobius") || !strings.Contains(args, "-color_trc:0 bt709") {
+		t.Errorf("Expected tone-mapping args, got %s", args)
+	}
+
+	plan, _ = buildPlan(&OptimizationParams{}, &ProbeResult{Streams: []ProbeStream{dv}})
+	if args := strings.Join(plan.OutputArgs(), " "); !strings.Contains(args, "-strict unofficial") {
+		t.Errorf("Copied Dolby Vision into MP4 needs unofficial mode, got %s", args)
+	}
+}
+
+func TestParseSegments(t *testing.T) {
+	log := `[blackdetect @ 0x1] black_start:0 black_end:3.5 black_duration:3.5
+[silencedetect @ 0x2] silence_start: 120.25
+[silencedetect @ 0x2] silence_end: 130.75 | silence_duration: 10.5
+[blackdetect @ 0x1] black_start:1200.1 black_end:1205.1 black_duration:5
+[silencedetect @ 0x2] silence_start: 1790
+`
+	report := parseSegments(log, 1800)
+	if len(report.Segments) != 4 {
+		t.Fatalf("Expected 4 segments, got %+v", report.Segments)
+	}
+	if s := report.Segments[1]; s.Kind != SegmentSilent || s.Start != 120.25 || s.Duration != 10.5 {
+		t.Errorf("Unexpected silent segment %+v", s)
+	}
+	if s := report.Segments[3]; s.End != 1800 {
+		t.Errorf("Trailing silence should end at the duration, got %+v", s)
+	}
+	if report.Longest != 10.5 {
+		t.Errorf("Expected longest 10.5, got %v", report.Longest)
+	}
+}
+
+func TestVideoRateControl(t *testing.T) {
+	probe := &ProbeResult{Streams: []ProbeStream{
+		{Index: 0, CodecType: "video", CodecName: "mpeg2video"},
+		{Index: 1, CodecType: "audio", CodecName: "dts", Tags: map[string]string{"language": "eng"}},
+	}}
+
+	capped := &VideoEncoding{Transcode: true, Codec: "libx265", RateControl: RateCappedCRF, CRF: 24, MaxBitrateKbps: 8000}
+	plan, err := buildPlan(&OptimizationParams{Video: capped}, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	args := strings.Join(plan.OutputArgs(), " ")
+	if !strings.Contains(args, "-c:0 libx265 -crf:0 24 -maxrate:0 8000k -bufsize:0 16000k") {
+		t.Errorf("Unexpected capped-crf args %s", args)
+	}
+
+	twoPass := &VideoEncoding{Transcode: true, Codec: "libx264", RateControl: RateTwoPass, BitrateKbps: 4000}
+	plan, err = buildPlan(&OptimizationParams{Video: twoPass}, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	if !plan.twoPass() {
+		t.Fatal("Expected a two-pass plan")
+	}
+	plan.PassLogFile = "/tmp/pass"
+	first := strings.Join(plan.FirstPassArgs(), " ")
+	if !strings.Contains(first, "-b:0 4000k -pass:0 1 -passlogfile:0 /tmp/pass") || !strings.Contains(first, "-an") {
+		t.Errorf("Unexpected first pass args %s", first)
+	}
+	if second := strings.Join(plan.OutputArgs(), " "); !strings.Contains(second, "-pass:0 2") {
+		t.Errorf("Expected second pass args, got %s", second)
+	}
+
+	// x265 takes the stats file in its option list, where the path is escaped
+	twoPass.Codec = "libx265"
+	plan, _ = buildPlan(&OptimizationParams{Video: twoPass}, probe)
+	plan.PassLogFile = `/mnt/D:\temp/it's/pass`
+	if first := strings.Join(plan.FirstPassArgs(), " "); !strings.Contains(first, `pass=1:stats=/mnt/D\:\\temp/it\'s/pass`) {
+		t.Errorf("Expected the stats path escaped, got %s", first)
+	}
+
+	// Video already in the target format is copied
+	hevc := &ProbeResult{Streams: []ProbeStream{{Index: 0, CodecType: "video", CodecName: "hevc"}}}
+	plan, _ = buildPlan(&OptimizationParams{Video: capped}, hevc)
+	if plan.Streams[0].Action != ActionCopy || plan.twoPass() {
+		t.Errorf("Expected HEVC source to be copied, got %+v", plan.Streams[0])
+	}
+
+	if err := (&VideoEncoding{Codec: "libx265", RateControl: RateTwoPass}).Validate(); err == nil {
+		t.Error("Expected two-pass without bitrate to be rejected")
+	}
+}
+
+func TestAV1Encoding(t *testing.T) {
+	probe := &ProbeResult{Streams: []ProbeStream{{Index: 0, CodecType: "video", CodecName: "h264"}}}
+	av1 := &VideoEncoding{Transcode: true, Codec: "libsvtav1", Preset: "6", RateControl: RateCRF, CRF: 30, FilmGrain: 8}
+	plan, err := buildPlan(&OptimizationParams{Video: av1}, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	args := strings.Join(plan.OutputArgs(), " ")
+	if !strings.Contains(args, "-c:0 libsvtav1 -preset:0 6 -crf:0 30 -svtav1-params:0 film-grain=8:film-grain-denoise=0") {
+		t.Errorf("Unexpected SVT-AV1 args %s", args)
+	}
+	if name := plan.outputName("/media/a.mkv", "/media/a.mp4", probe); name.VideoCodec != "av1" {
+		t.Errorf("Expected the output to be named av1, got %q", name.VideoCodec)
+	}
+
+	// AV1 sources are copied
+	plan, _ = buildPlan(&OptimizationParams{Video: av1}, &ProbeResult{Streams: []ProbeStream{{Index: 0, CodecType: "video", CodecName: "av1"}}})
+	if plan.Streams[0].Action != ActionCopy {
+		t.Errorf("Expected an AV1 source to be copied, got %+v", plan.Streams[0])
+	}
+
+	// HDR metadata is converted to SVT-AV1's units
+	hdr := ProbeStream{Index: 0, CodecType: "video", CodecName: "hevc", ColorTransfer: "smpte2084",
+		SideData: []map[string]interface{}{
+			{
+				"side_data_type": "Mastering display metadata",
+				"red_x":          "34000/50000", "red_y": "16000/50000",
+				"green_x": "13250/50000", "green_y": "34500/50000",
+				"blue_x": "7500/50000", "blue_y": "3000/50000",
+				"white_point_x": "15635/50000", "white_point_y": "16450/50000",
+				"max_luminance": "10000000/10000", "min_luminance": "50/10000",
+			},
+			{"side_data_type": "Content light level metadata", "max_content": float64(1000), "max_average": float64(400)},
+		}}
+	crf := &VideoEncoding{Transcode: true, Codec: "libsvtav1", RateControl: RateCRF, CRF: 28}
+	plan, _ = buildPlan(&OptimizationParams{Video: crf}, &ProbeResult{Streams: []ProbeStream{hdr}})
+	args = strings.Join(plan.OutputArgs(), " ")
+	expected := "-svtav1-params:0 enable-hdr=1:mastering-display=G(0.2650,0.6900)B(0.1500,0.0600)R(0.6800,0.3200)WP(0.3127,0.3290)L(1000.0000,0.0050):content-light=1000,400"
+	if !strings.Contains(args, expected) || strings.Contains(args, "x265-params") {
+		t.Errorf("Expected SVT-AV1 HDR params, got %s", args)
+	}
+
+	// A bitrate target is a single VBR pass
+	vbr := &VideoEncoding{Transcode: true, Codec: "libsvtav1", RateControl: RateTwoPass, BitrateKbps: 3000}
+	plan, _ = buildPlan(&OptimizationParams{Video: vbr}, probe)
+	if plan.twoPass() || !strings.Contains(strings.Join(plan.OutputArgs(), " "), "-b:0 3000k") {
+		t.Errorf("Expected single-pass VBR, got %s", strings.Join(plan.OutputArgs(), " "))
+	}
+
+	// A profile may keep an x264 preset name
+	named := &VideoEncoding{Transcode: true, Codec: "libsvtav1", Preset: "slow", RateControl: RateCRF, CRF: 30}
+	plan, err = buildPlan(&OptimizationParams{Video: named}, probe)
+	if err != nil || !strings.Contains(strings.Join(plan.OutputArgs(), " "), "-preset:0 5 ") {
+		t.Errorf("Expected slow to map to preset 5, got %v", err)
+	}
+
+	for _, e := range []VideoEncoding{
+		{Codec: "libsvtav1", RateControl: RateCRF, Preset: "p7"},
+		{Codec: "libsvtav1", RateControl: RateCRF, Preset: "14"},
+		{Codec: "libsvtav1", RateControl: RateCRF, CRF: 64},
+		{Codec: "libsvtav1", RateControl: RateCRF, FilmGrain: 51},
+		{Codec: "libx265", RateControl: RateCRF, FilmGrain: 8},
+	} {
+		if err := e.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", e)
+		}
+	}
+	if encoders := VideoEncoders(); len(encoders) != 6 || encoders[2] != "libsvtav1" {
+		t.Errorf("Unexpected encoders %v", encoders)
+	}
+}
+
+func TestGrain(t *testing.T) {
+	probe := &ProbeResult{Streams: []ProbeStream{{Index: 0, CodecType: "video", CodecName: "mpeg2video"}}}
+	for codec, expected := range map[string]string{
+		"libx265":    "-c:0 libx265 -crf:0 22 -tune:0 grain",
+		"libx264":    "-c:0 libx264 -crf:0 22 -tune:0 grain",
+		"libsvtav1":  "-svtav1-params:0 film-grain=8:film-grain-denoise=0",
+		"libvpx-vp9": "-tune-content:0 film",
+	} {
+		e := &VideoEncoding{Transcode: true, Codec: codec, RateControl: RateCRF, CRF: 22, Grain: true}
+		plan, err := buildPlan(&OptimizationParams{Video: e}, probe)
+		if err != nil {
+			t.Fatalf("buildPlan failed for %s: %v", codec, err)
+		}
+		if args := strings.Join(plan.OutputArgs(), " "); !strings.Contains(args, expected) {
+			t.Errorf("Expected %q for %s, got %s", expected, codec, args)
+		}
+	}
+
+	// A set film grain strength wins
+	e := &VideoEncoding{Transcode: true, Codec: "libsvtav1", RateControl: RateCRF, CRF: 30, Grain: true, FilmGrain: 20}
+	plan, _ := buildPlan(&OptimizationParams{Video: e}, probe)
+	if args := strings.Join(plan.OutputArgs(), " "); !strings.Contains(args, "film-grain=20:") || strings.Contains(args, "-tune") {
+		t.Errorf("Expected film grain 20 without a tune, got %s", args)
+	}
+
+	if err := (&VideoEncoding{Codec: "hevc_nvenc", RateControl: RateCRF, Grain: true}).Validate(); err == nil {
+		t.Error("Expected grain tuning to be rejected for NVENC")
+	}
+}
+
+func TestStamp(t *testing.T) {
+	probe := &ProbeResult{Streams: []ProbeStream{{Index: 0, CodecType: "video", CodecName: "h264"}}}
+	stamp := &Stamp{Version: "1.4.0", Profile: "kids", JobID: "job1"}
+	plan, err := buildPlan(&OptimizationParams{Stamp: stamp}, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	plan.Container = "mp4"
+	args := strings.Join(plan.OutputArgs(), " ")
+	expected := `-metadata MEDIA_OPTIMIZER={"version":"1.4.0","profile":"kids","jobId":"job1"}`
+	if !strings.Contains(args, expected) || !strings.Contains(args, "+faststart+use_metadata_tags") {
+		t.Errorf("Expected the stamp and MP4 metadata tags, got %s", args)
+	}
+
+	// Matroska reports the tag as written, MP4 may lower-case it
+	for _, key := range []string{"MEDIA_OPTIMIZER", "media_optimizer"} {
+		read := ReadStamp(&ProbeResult{Format: ProbeFormat{Tags: map[string]string{key: `{"version":"1.4.0","profile":"kids","jobId":"job1"}`}}})
+		if read == nil || *read != *stamp {
+			t.Errorf("Expected the stamp back from %s, got %+v", key, read)
+		}
+	}
+	if ReadStamp(&ProbeResult{Format: ProbeFormat{Tags: map[string]string{"title": "Movie"}}}) != nil {
+		t.Error("Expected no stamp for an unstamped file")
+	}
+}
+
+func TestPerTitle(t *testing.T) {
+	crf := &VideoEncoding{Transcode: true, Codec: "libx265", RateControl: RateCRF, CRF: 24, PerTitle: &PerTitle{}}
+	for _, tc := range []struct {
+		bpp      float64
+		expected int
+	}{
+		{0.1, 24},   // the reference keeps the CRF
+		{0.025, 28}, // animation: two halvings raise it by 4
+		{0.4, 20},   // grain: two doublings lower it by 4
+		{3.2, 20},   // capped at 4 below
+	} {
+		if got := (&Complexity{BitsPerPixel: tc.bpp}).adjust(crf).CRF; got != tc.expected {
+			t.Errorf("Expected CRF %d at %v bits per pixel, got %d", tc.expected, tc.bpp, got)
+		}
+	}
+	if crf.CRF != 24 {
+		t.Error("Expected the settings to be copied, not changed")
+	}
+
+	bounded := *crf
+	bounded.PerTitle = &PerTitle{MinCRF: 22, MaxCRF: 25}
+	if got := (&Complexity{BitsPerPixel: 0.025}).adjust(&bounded).CRF; got != 25 {
+		t.Errorf("Expected the CRF to stop at maxCrf, got %d", got)
+	}
+
+	vbr := &VideoEncoding{Codec: "libx265", RateControl: RateTwoPass, BitrateKbps: 4000, PerTitle: &PerTitle{}}
+	if got := (&Complexity{BitsPerPixel: 0.025}).adjust(vbr).BitrateKbps; got != 2000 {
+		t.Errorf("Expected half the bitrate for simple content, got %d", got)
+	}
+	if got := (&Complexity{BitsPerPixel: 0.2}).adjust(vbr).BitrateKbps; got != 5657 {
+		t.Errorf("Expected the bitrate to grow with the square root, got %d", got)
+	}
+
+	// Only plans re-encoding video are analysed, and never for a target size
+	probe := &ProbeResult{Format: ProbeFormat{Duration: "600"}, Streams: []ProbeStream{{Index: 0, CodecType: "video", CodecName: "h264"}}}
+	plan, _ := buildPlan(&OptimizationParams{Video: crf}, probe)
+	if !plan.perTitle() {
+		t.Error("Expected a transcode to be analysed")
+	}
+	plan, _ = buildPlan(&OptimizationParams{Video: crf}, &ProbeResult{Streams: []ProbeStream{{Index: 0, CodecType: "video", CodecName: "hevc"}}})
+	if plan.perTitle() {
+		t.Error("Expected copied video not to be analysed")
+	}
+	plan, _ = buildPlan(&OptimizationParams{Video: crf, TargetSize: 1 << 30}, probe)
+	if plan.perTitle() {
+		t.Error("Expected a target size not to be adjusted")
+	}
+
+	for _, bounds := range []PerTitle{{MinCRF: 30, MaxCRF: 20}, {MinBitrateKbps: -1}} {
+		e := VideoEncoding{Codec: "libx265", RateControl: RateCRF, PerTitle: &bounds}
+		if err := e.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", bounds)
+		}
+	}
+}
+
+func TestVP9WebM(t *testing.T) {
+	probe := &ProbeResult{Streams: []ProbeStream{
+		{Index: 0, CodecType: "video", CodecName: "h264"},
+		{Index: 1, CodecType: "audio", CodecName: "ac3", Channels: 6, Tags: map[string]string{"language": "eng"}},
+		{Index: 2, CodecType: "subtitle", CodecName: "subrip"},
+		{Index: 3, CodecType: "subtitle", CodecName: "hdmv_pgs_subtitle"},
+	}}
+	vp9 := &VideoEncoding{Transcode: true, Codec: "libvpx-vp9", Preset: "medium", RateControl: RateCRF, CRF: 33, RowMT: true, TileColumns: 2}
+	mappings := []StreamMapping{
+		{InputIndex: 0, Action: ActionTranscode, TargetCodec: "libvpx-vp9"},
+		{InputIndex: 1, Action: ActionTranscode, TargetCodec: "aac"},
+		{InputIndex: 2, Action: ActionCopy},
+		{InputIndex: 3, Action: ActionCopy},
+	}
+	params := &OptimizationParams{Video: vp9, Audio: &AudioEncoding{Codec: "ac3", Layout: "stereo"}, Streams: mappings}
+	plan, err := buildPlan(params, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	if plan.Container != WebMContainer {
+		t.Fatalf("Expected a WebM container, got %q", plan.Container)
+	}
+	args := strings.Join(plan.OutputArgs(), " ")
+	for _, expected := range []string{
+		"-c:0 libvpx-vp9 -deadline:0 good -cpu-used:0 3 -row-mt:0 1 -tile-columns:0 2 -crf:0 33 -b:0 0",
+		"-c:1 libopus -b:1 128k -ac:1 2",
+		"-c:2 webvtt",
+		"-f webm",
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("Expected %q in %s", expected, args)
+		}
+	}
+	if strings.Contains(args, "-preset") || strings.Contains(args, "movflags") {
+		t.Errorf("Unexpected MP4 or preset options in %s", args)
+	}
+	if plan.Streams[3].Action != ActionDrop {
+		t.Errorf("Expected image subtitles to be dropped, got %+v", plan.Streams[3])
+	}
+	if output := plan.containerExtension("/media/a_optimized.mkv"); output != "/media/a_optimized.webm" {
+		t.Errorf("Expected a .webm output, got %s", output)
+	}
+
+	// Constrained quality caps the bitrate with -b
+	capped := &VideoEncoding{Transcode: true, Codec: "libvpx-vp9", RateControl: RateCappedCRF, CRF: 31, MaxBitrateKbps: 2000}
+	plan, _ = buildPlan(&OptimizationParams{Video: capped}, probe)
+	if args := strings.Join(plan.OutputArgs(), " "); !strings.Contains(args, "-crf:0 31 -b:0 2000k") || strings.Contains(args, "maxrate") {
+		t.Errorf("Unexpected constrained quality args %s", args)
+	}
+
+	// Without a VP9 encode the output stays MP4
+	plan, _ = buildPlan(&OptimizationParams{Video: vp9}, &ProbeResult{Streams: []ProbeStream{{Index: 0, CodecType: "video", CodecName: "vp9"}}})
+	if plan.Container != TargetContainer || plan.containerExtension("/media/a.mkv") != "/media/a.mkv" {
+		t.Errorf("Expected a copied VP9 source to stay in %s, got %s", TargetContainer, plan.Container)
+	}
+
+	for _, e := range []VideoEncoding{
+		{Codec: "libvpx-vp9", RateControl: RateCRF, Preset: "9"},
+		{Codec: "libvpx-vp9", RateControl: RateCRF, CRF: 64},
+		{Codec: "libvpx-vp9", RateControl: RateCRF, TileColumns: 7},
+		{Codec: "libx264", RateControl: RateCRF, RowMT: true},
+	} {
+		if err := e.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", e)
+		}
+	}
+}
+
+func TestTagLanguages(t *testing.T) {
+	if lang := languageFromText("Commentary - English 5.1", ""); lang != "eng" {
+		t.Errorf("Expected eng from title, got %q", lang)
+	}
+	if lang := languageFromText("ENG", "ENG"); lang != "eng" {
+		t.Errorf("Expected eng from a bare code title, got %q", lang)
+	}
+	if lang := languageFromText("Spa Day commentary", "Spa Day commentary"); lang != "" {
+		t.Errorf("Codes inside a title should not yield a language, got %q", lang)
+	}
+	if lang := languageFromText("English / French", ""); lang != "" {
+		t.Errorf("Ambiguous text should not yield a language, got %q", lang)
+	}
+	for filename, expected := range map[string]string{
+		"/media/Movie.2019.ENG.mkv":    "eng",
+		"/media/Movie.fin.srt":         "fin",
+		"/media/Movie.English.mkv":     "eng",
+		"/media/Final.Destination.mkv": "",
+		"/media/Spa Day.mkv":           "",
+		"/media/Spa.Day.2019.mkv":      "",
+		"/media/Dan.In.Real.Life.mkv":  "",
+		"/media/Movie.ENG.1080p.mkv":   "",
+		"/media/Movie.German.fre.mkv":  "",
+		"/media/Tur":                   "",
+	} {
+		if lang := languageFromFilename(filename); lang != expected {
+			t.Errorf("languageFromFilename(%q): expected %q, got %q", filename, expected, lang)
+		}
+	}
+	if lang := normalizeLanguage("de\n"); lang != "ger" {
+		t.Errorf("Expected ger from detector output, got %q", lang)
+	}
+
+	probe := &ProbeResult{Streams: []ProbeStream{
+		{Index: 0, CodecType: "video", CodecName: "h264"},
+		{Index: 1, CodecType: "audio", CodecName: "ac3", Tags: map[string]string{"language": "und"}},
+		{Index: 2, CodecType: "audio", CodecName: "ac3", Tags: map[string]string{"language": "jpn"}},
+	}}
+	sources := tagLanguages(&LanguageTagging{}, "in.mkv", "/media/Movie.2019.1080p.ENG.mkv", probe)
+	if sources[1] != LanguageFromFilename || probe.Streams[1].Tags["language"] != "eng" {
+		t.Errorf("Expected stream 1 tagged eng from filename, got %v %v", sources, probe.Streams[1].Tags)
+	}
+
+	plan := BuildPlan(probe)
+	plan.markLanguageSources(sources)
+	if m := plan.Streams[1]; m.Action != ActionTranscode || m.LanguageSource != LanguageFromFilename {
+		t.Errorf("Expected the tagged track to be kept, got %+v", m)
+	}
+	if tagLanguages(nil, "in.mkv", "in.mkv", probe) != nil {
+		t.Error("Expected no tagging without options")
+	}
+}
+
+func TestTargetSize(t *testing.T) {
+	for input, expected := range map[string]int64{"4GB": 4e9, "700 MB": 700e6, "1.5GiB": 1.5 * (1 << 30), "2048": 2048} {
+		if got, err := ParseSize(input); err != nil || got != expected {
+			t.Errorf("ParseSize(%q) = %d, %v; expected %d", input, got, err, expected)
+		}
+	}
+	if _, err := ParseSize("lots"); err == nil {
+		t.Error("Expected error for invalid size")
+	}
+
+	probe := &ProbeResult{
+		Format: ProbeFormat{Duration: "7200"},
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "hevc"},
+			{Index: 1, CodecType: "audio", CodecName: "dts", Tags: map[string]string{"language": "eng"}},
+		},
+	}
+	plan, err := buildPlan(&OptimizationParams{TargetSize: 4e9}, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	// 4 GB less 2% overhead and 384 kb/s of audio over two hours
+	expected := 3971
+	if plan.Encoding.BitrateKbps != expected || !plan.twoPass() {
+		t.Errorf("Expected two-pass at %d kb/s, got %+v", expected, plan.Encoding)
+	}
+	if plan.Streams[0].Action != ActionTranscode {
+		t.Errorf("Video must be re-encoded to hit a size, got %+v", plan.Streams[0])
+	}
+
+	if _, err := buildPlan(&OptimizationParams{TargetSize: 100e6}, probe); err == nil {
+		t.Error("Expected error for an unreachable target size")
+	}
+}
+
+func TestMaxHeight(t *testing.T) {
+	probe := &ProbeResult{
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "hevc", Height: 2160},
+			{Index: 1, CodecType: "audio", CodecName: "aac", Tags: map[string]string{"language": "eng"}},
+		},
+	}
+	plan, err := buildPlan(&OptimizationParams{MaxHeight: 720}, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	if plan.Streams[0].Action != ActionTranscode || plan.Streams[0].TargetCodec != "libx265" {
+		t.Fatalf("Expected oversized video to be re-encoded, got %+v", plan.Streams[0])
+	}
+	args := strings.Join(plan.OutputArgs(), " ")
+	if !strings.Contains(args, "-filter:0 scale=-2:'min(720,ih)'") {
+		t.Errorf("Expected downscale filter, got %s", args)
+	}
+
+	probe.Streams[0].Height = 720
+	plan, err = buildPlan(&OptimizationParams{MaxHeight: 720}, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	if plan.Streams[0].Action != ActionCopy {
+		t.Errorf("Expected video within the limit to be copied, got %+v", plan.Streams[0])
+	}
+}
+
+func TestCustomArgs(t *testing.T) {
+	probe := &ProbeResult{
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "h264", Height: 1080},
+		},
+	}
+	params := &OptimizationParams{
+		Video: &VideoEncoding{Transcode: true, Codec: "libx265", RateControl: RateCRF, CRF: 24},
+		CustomArgs: &CustomArgs{
+			Input:  []string{"-ss 10"},
+			Output: []string{"-tune grain", "-x265-params aq-mode=3", "-vf:0 scale=iw/2:-2", "-metadata title=Director's Cut", "-shortest"},
+		},
+	}
+	plan, err := buildPlan(params, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	args := strings.Join(plan.OutputArgs(), " ")
+	if !strings.HasSuffix(args, "-tune grain -x265-params aq-mode=3 -vf:0 scale=iw/2:-2 -metadata title=Director's Cut -shortest") {
+		t.Errorf("Expected the custom options last, got %s", args)
+	}
+	if got := strings.Join(inputArgs(&OptimizationParams{Priority: &Priority{ReadRate: 2}}, plan), " "); got != "-readrate 2 -ss 10" {
+		t.Errorf("Expected the read rate and custom input options, got %q", got)
+	}
+
+	for _, entry := range []string{
+		"tune film",                         // not an option
+		"-i /etc/passwd",                    // extra input
+		"-map 0:s",                          // stream mapping
+		"-map:v 0",                          // with a specifier
+		"-/filter:v script.txt",             // value from a file
+		"-progress pipe:2",                  // progress reporting
+		"-vf subtitles=/media/other.srt",    // absolute path
+		"-metadata comment=../secret",       // parent directory
+		"-vf movie=x.mkv[m];[in][m]overlay", // file source filter
+		"-af asendcmd=c='0 volume 2'",       // commands
+		"-hls_segment_filename seg%d.ts",    // extra output files
+	} {
+		if err := validateCustomArg(entry); err == nil {
+			t.Errorf("Expected %q to be rejected", entry)
+		}
+	}
+	params.CustomArgs = &CustomArgs{Output: []string{"-y"}}
+	if _, err := buildPlan(params, probe); err == nil {
+		t.Error("Expected a blocked option to fail the plan")
+	}
+}
+
+func TestVideoFilters(t *testing.T) {
+	probe := &ProbeResult{
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "mpeg2video", Width: 720, Height: 576},
+		},
+	}
+	params := &OptimizationParams{
+		MaxHeight: 480,
+		Filters:   &VideoFilters{Deinterlace: DeinterlaceYadif, Denoise: DenoiseHQDN3D, Crop: "704:432:8:72"},
+	}
+	plan, err := buildPlan(params, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	if plan.Streams[0].Action != ActionTranscode {
+		t.Fatalf("Expected filtered video to be re-encoded, got %s", plan.Streams[0].Action)
+	}
+	args := strings.Join(plan.OutputArgs(), " ")
+	if want := "-filter:0 yadif,crop=704:432:8:72,hqdn3d=4:3:6:4.5,scale=-2:'min(480,ih)'"; !strings.Contains(args, want) {
+		t.Errorf("Expected %q in %s", want, args)
+	}
+
+	params.Filters = &VideoFilters{Crop: CropAuto}
+	if plan, err = buildPlan(params, probe); err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	if !plan.autoCrop() || plan.Crop != nil {
+		t.Error("Expected an automatic crop to wait for detection")
+	}
+
+	log := "[Parsed_cropdetect_0] crop=720:576:0:0\n[Parsed_cropdetect_0] crop=720:432:0:72\n"
+	c := lastCrop(log)
+	if c == nil || *c != (Crop{Width: 720, Height: 432, X: 0, Y: 72}) {
+		t.Errorf("Expected the last detected crop, got %v", c)
+	}
+	if u := c.union(&Crop{Width: 704, Height: 480, X: 8, Y: 48}); *u != (Crop{Width: 720, Height: 480, X: 0, Y: 48}) {
+		t.Errorf("Expected the area holding both crops, got %v", u)
+	}
+
+	letterbox := &Crop{Width: 720, Height: 432, X: 0, Y: 72}
+	if c, err := settleCrop([]*Crop{letterbox, nil, letterbox, {Width: 720, Height: 480, X: 0, Y: 48}, nil}, 720, 576); err != nil || *c != (Crop{Width: 720, Height: 480, X: 0, Y: 48}) {
+		t.Errorf("Expected the widest picture seen, got %v, %v", c, err)
+	}
+	if _, err := settleCrop([]*Crop{letterbox, nil, nil, nil, letterbox}, 720, 576); err == nil {
+		t.Error("Expected too few readings to fail detection")
+	}
+	if c, _ := settleCrop([]*Crop{{Width: 716, Height: 572, X: 2, Y: 2}}, 720, 576); c != nil {
+		t.Errorf("Expected thin edges to be kept, got %v", c)
+	}
+	fixed := (&VideoFilters{Crop: CropAuto, Denoise: DenoiseHQDN3D}).withCrop(letterbox)
+	if fixed.Crop != "720:432:0:72" || fixed.Denoise != DenoiseHQDN3D {
+		t.Errorf("Expected the detected crop to be fixed, got %+v", fixed)
+	}
+
+	params.MaxHeight = 0
+	params.Filters = &VideoFilters{Deinterlace: DeinterlaceAuto}
+	probe.Streams[0].FieldOrder = "progressive"
+	if plan, err = buildPlan(params, probe); err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	if plan.Filters != nil || plan.Streams[0].Action != ActionCopy {
+		t.Errorf("Expected progressive video to be left alone, got %+v", plan.Streams[0])
+	}
+	probe.Streams[0].FieldOrder = "tt"
+	if plan, err = buildPlan(params, probe); err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	if !plan.autoDeinterlace() {
+		t.Error("Expected video marked interlaced to be scanned")
+	}
+	idet := "[Parsed_idet_0] Single frame detection: TFF: 40 BFF: 0 Progressive: 180 Undetermined: 30\n" +
+		"[Parsed_idet_0] Multi frame detection: TFF: 60 BFF: 2 Progressive: 170 Undetermined: 18\n"
+	if n, total := parseIdet(idet); n != 62 || total != 232 {
+		t.Errorf("Expected 62 of 232 frames interlaced, got %d of %d", n, total)
+	}
+
+	for _, f := range []VideoFilters{
+		{Deinterlace: "bwdif"},
+		{Denoise: "median"},
+		{Denoise: DenoiseNLMeans, DenoiseStrength: "max"},
+		{Crop: "704x432"},
+		{Crop: "0:432:8:72"},
+	} {
+		if err := f.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", f)
+		}
+	}
+}
+
+func TestAudioEncoding(t *testing.T) {
+	probe := &ProbeResult{
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "hevc"},
+			{Index: 1, CodecType: "audio", CodecName: "truehd", Channels: 8, Tags: map[string]string{"language": "eng"}},
+			{Index: 2, CodecType: "audio", CodecName: "eac3", Channels: 6, Tags: map[string]string{"language": "eng", "title": "Surround"}},
+			{Index: 3, CodecType: "audio", CodecName: "aac", Channels: 2, Tags: map[string]string{"language": "eng"}},
+		},
+	}
+	params := &OptimizationParams{
+		Audio: &AudioEncoding{Codec: "eac3", Passthrough: []string{"eac3", "ac3"}},
+	}
+	plan, err := buildPlan(params, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	truehd, eac3, aac := plan.Streams[1], plan.Streams[2], plan.Streams[3]
+	if truehd.Action != ActionTranscode || truehd.TargetCodec != "eac3" || truehd.Channels != 6 || truehd.Title != "5.1 Optimized" {
+		t.Errorf("Expected 7.1 TrueHD to be re-encoded to 5.1 EAC3, got %+v", truehd)
+	}
+	if eac3.Action != ActionCopy || eac3.Title != "Surround" {
+		t.Errorf("Expected EAC3 to pass through, got %+v", eac3)
+	}
+	if aac.Channels != 2 {
+		t.Errorf("Expected stereo to stay stereo, got %d channels", aac.Channels)
+	}
+	args := strings.Join(plan.OutputArgs(), " ")
+	if !strings.Contains(args, "-c:1 eac3 -b:1 640k -ac:1 6") || !strings.Contains(args, "-c:2 copy") || !strings.Contains(args, "-b:3 224k -ac:3 2") {
+		t.Errorf("Unexpected audio options %s", args)
+	}
+
+	params.Audio = &AudioEncoding{Codec: "opus", Layout: "stereo", BitrateKbps: 160, Passthrough: []string{"eac3"}}
+	if plan, err = buildPlan(params, probe); err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	for _, m := range plan.Streams[1:] {
+		if m.Action != ActionTranscode || m.TargetCodec != "libopus" || m.Channels != 2 {
+			t.Errorf("Expected a stereo Opus downmix, got %+v", m)
+		}
+	}
+	if args := strings.Join(plan.OutputArgs(), " "); !strings.Contains(args, "-b:1 160k") {
+		t.Errorf("Expected the configured bitrate in %s", args)
+	}
+
+	for _, a := range []AudioEncoding{
+		{Codec: "mp3"},
+		{Codec: "ac3", Layout: "7.1"},
+		{Codec: "aac", Layout: "quad"},
+		{Codec: "aac", BitrateKbps: -1},
+	} {
+		if err := a.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", a)
+		}
+	}
+}
+
+func TestGuardrails(t *testing.T) {
+	dv5 := []map[string]interface{}{{"side_data_type": "DOVI configuration record", "dv_profile": 5.0}}
+	probe := &ProbeResult{
+		Format: ProbeFormat{Duration: "7200"},
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "hevc", Height: 2160, SideData: dv5},
+			{Index: 1, CodecType: "audio", CodecName: "truehd", Channels: 8, Tags: map[string]string{"language": "eng"}},
+			{Index: 2, CodecType: "subtitle", CodecName: "hdmv_pgs_subtitle"},
+		},
+	}
+	params := &OptimizationParams{
+		MaxHeight: 1080,
+		Audio:     &AudioEncoding{Codec: "eac3", Passthrough: []string{"truehd"}},
+		Streams: []StreamMapping{
+			{InputIndex: 0, Action: ActionTranscode, TargetCodec: "libx265"},
+			{InputIndex: 1, Action: ActionCopy},
+			{InputIndex: 2, Action: ActionCopy},
+		},
+	}
+	plan, err := buildPlan(params, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	video, audio, subs := plan.Streams[0], plan.Streams[1], plan.Streams[2]
+	if video.Action != ActionCopy {
+		t.Errorf("Expected profile 5 video to be copied, got %s", video.Action)
+	}
+	if audio.Action != ActionTranscode || audio.TargetCodec != "eac3" || audio.Channels != 6 {
+		t.Errorf("Expected TrueHD to be re-encoded to EAC3, got %+v", audio)
+	}
+	if subs.Action != ActionDrop {
+		t.Errorf("Expected PGS subtitles to be dropped from MP4, got %s", subs.Action)
+	}
+	if len(plan.Warnings) < 3 {
+		t.Errorf("Expected a warning for each fallback, got %v", plan.Warnings)
+	}
+
+	params.Guardrails = GuardAttention
+	if _, err := buildPlan(params, probe); !errors.Is(err, ErrNeedsAttention) {
+		t.Errorf("Expected the job to need attention, got %v", err)
+	}
+	params.Guardrails = GuardFallback
+	params.TargetSize = 4 << 30
+	if _, err := buildPlan(params, probe); !errors.Is(err, ErrNeedsAttention) {
+		t.Errorf("Expected profile 5 video without a fallback to need attention, got %v", err)
+	}
+
+	foreign := &ProbeResult{
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "h264"},
+			{Index: 1, CodecType: "audio", CodecName: "aac", Channels: 2, Tags: map[string]string{"language": "jpn"}},
+		},
+	}
+	if plan, err = buildPlan(&OptimizationParams{}, foreign); err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	if plan.Streams[1].Action != ActionTranscode || plan.Streams[1].TargetCodec != TargetAudioCodec {
+		t.Errorf("Expected the only audio track to be kept, got %+v", plan.Streams[1])
+	}
+}
+
+func TestOutputName(t *testing.T) {
+	probe := &ProbeResult{
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "h264", Height: 2160},
+			{Index: 1, CodecType: "audio", CodecName: "dts", Tags: map[string]string{"language": "eng"}},
+		},
+	}
+	params := NewDefaultParams("/media/Movie (2020).mkv")
+	params.Video = &VideoEncoding{Transcode: true, Codec: "hevc_nvenc", RateControl: RateCRF, CRF: 24}
+	params.MaxHeight = 1080
+	params.OutputName = "{{.Base}} [{{.VideoCodec}}-{{.Height}}p {{.AudioCodec}}].{{.Ext}}"
+	plan, err := buildPlan(params, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	if err := applyOutputName(params, plan, probe); err != nil {
+		t.Fatalf("applyOutputName failed: %v", err)
+	}
+	if want := "/media/Movie (2020) [hevc-1080p ac3].mkv"; params.OutputFile != want {
+		t.Errorf("Expected %s, got %s", want, params.OutputFile)
+	}
+
+	params.OutputFile = "/media/Movie (2020)_optimized.mkv"
+	params.OutputName = "{{.Base}}.{{.Ext}}"
+	if err := applyOutputName(params, plan, probe); err == nil {
+		t.Error("Expected a name overwriting the source to be rejected")
+	}
+
+	// Names keep emoji, CJK and quotes, and take the configured form
+	params = NewDefaultParams("/media/Ame\u0301lie 🎬 千と千尋 'Director\u2019s Cut'.mkv")
+	params.Video = &VideoEncoding{Transcode: true, Codec: "libx265", RateControl: RateCRF, CRF: 24}
+	params.NameForm = "nfc"
+	plan, _ = buildPlan(params, probe)
+	if err := applyOutputName(params, plan, probe); err != nil {
+		t.Fatalf("applyOutputName failed: %v", err)
+	}
+	if want := "/media/Amélie 🎬 千と千尋 'Director’s Cut'_optimized.mkv"; params.OutputFile != want {
+		t.Errorf("Expected %q, got %q", want, params.OutputFile)
+	}
+	params.OutputFile = "/media/Ame\u0301lie_optimized.mkv"
+	params.OutputName = "{{.Base}}.{{.Ext}}"
+	if err := applyOutputName(params, plan, probe); err == nil {
+		t.Error("Expected the source's name in another form to be rejected")
+	}
+
+	for _, text := range []string{
+		"{{.Base}",               // syntax
+		"{{.Title}}.{{.Ext}}",    // unknown field
+		"{{.Base}}/x.{{.Ext}}",   // directory
+		"{{.Base}}.mp4",          // fixed extension
+		"{{if false}}x{{end}}  ", // empty
+	} {
+		if _, err := ParseOutputName(text); err == nil {
+			t.Errorf("Expected %q to be rejected", text)
+		}
+	}
+	if _, err := ParseOutputName(DefaultOutputName); err != nil {
+		t.Errorf("Expected the default name to parse: %v", err)
+	}
+}
+
+func TestEncodeCommand(t *testing.T) {
+	probe := &ProbeResult{Streams: []ProbeStream{{Index: 0, CodecType: "video", CodecName: "h264"}}}
+	params := NewDefaultParams(`C:\Media\Film.mkv`)
+	params.Priority = &Priority{ReadRate: 2}
+	plan, err := buildPlan(params, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	input, partial := `C:\Media\Film.mkv`, `C:\Media\.partial-Film_optimized.mkv`
+
+	// Without the script, as on Windows, ffmpeg gets the input options itself
+	cmd := encodeCommand(params, "", input, partial, plan)
+	args := cmd.Args[1:]
+	if filepath.Base(cmd.Args[0]) != "ffmpeg" || args[len(args)-1] != partial ||
+		!strings.Contains(strings.Join(args, " "), "-progress pipe:1 -readrate 2 -i "+input) {
+		t.Errorf("Unexpected ffmpeg command %q", cmd.Args)
+	}
+
+	cmd = encodeCommand(params, "scripts/optimize_media.sh", input, partial, plan)
+	if cmd.Args[1] != "scripts/optimize_media.sh" || cmd.Args[2] != input || cmd.Args[3] != partial {
+		t.Errorf("Unexpected script command %q", cmd.Args)
+	}
+	if env := strings.Join(cmd.Env, "\n"); !strings.Contains(env, inputArgsEnv+"=-readrate\n2") {
+		t.Errorf("Expected the input options in the environment, got %q", cmd.Env)
+	}
+}
+
+func TestPlaceOutput(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "movie_optimized.mp4")
+	partial := PartialPath(output)
+	if filepath.Dir(partial) != dir || filepath.Ext(partial) != ".mp4" || !IsPartial(partial) || IsPartial(output) {
+		t.Fatalf("Expected a hidden .mp4 next to the output, got %s", partial)
+	}
+
+	if err := os.WriteFile(partial, []byte("encoded"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := placeOutput(partial, output); err != nil {
+		t.Fatalf("placeOutput failed: %v", err)
+	}
+	if data, err := os.ReadFile(output); err != nil || string(data) != "encoded" {
+		t.Errorf("Expected the output in place, got %q %v", data, err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial file to be gone, got %v", err)
+	}
+	if err := placeOutput(partial, output); err == nil {
+		t.Error("Expected placing a missing partial file to fail")
+	}
+}
+
+func TestPriority(t *testing.T) {
+	probe := &ProbeResult{
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "h264", Height: 1080},
+		},
+	}
+	params := &OptimizationParams{
+		Video:    &VideoEncoding{Transcode: true, Codec: "libx265", RateControl: RateCRF, CRF: 24},
+		Priority: &Priority{Threads: 4},
+	}
+	plan, err := buildPlan(params, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	args := strings.Join(plan.OutputArgs(), " ")
+	if !strings.Contains(args, "-threads 4") || !strings.Contains(args, "pools=4") {
+		t.Errorf("Expected the thread limit for ffmpeg and x265, got %s", args)
+	}
+
+	params.Priority = &Priority{IOClass: "realtime"}
+	if _, err := buildPlan(params, probe); err == nil {
+		t.Error("Expected an unknown I/O class to be rejected")
+	}
+
+	params.Priority = &Priority{ReadRate: -1}
+	if _, err := buildPlan(params, probe); err == nil {
+		t.Error("Expected a negative read rate to be rejected")
+	}
+	if got := strings.Join((&Priority{ReadRate: 1.5}).inputArgs(), " "); got != "-readrate 1.5" {
+		t.Errorf("Expected -readrate 1.5, got %q", got)
+	}
+
+	var unlimited *Priority
+	if args := unlimited.inputArgs(); args != nil {
+		t.Errorf("Expected no input options without a priority, got %v", args)
+	}
+	if cmd := unlimited.command(context.Background(), "ffmpeg", "-i", "in.mkv"); cmd.Args[0] != "ffmpeg" || len(cmd.Args) != 3 {
+		t.Errorf("Expected no wrappers without a priority, got %v", cmd.Args)
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	cmd := (&Priority{Nice: 10, IOClass: IOClassIdle, CPUQuota: 150}).command(context.Background(), "ffmpeg", "-i", "in.mkv")
+	got := strings.Join(cmd.Args, " ")
+	for _, want := range []string{"systemd-run --scope", "-p CPUQuota=150% --", "ionice -c 3 nice -n 10 ffmpeg -i in.mkv"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q in %s", want, got)
+		}
+	}
+}
+
+func TestHardwareEncoding(t *testing.T) {
+	probe := &ProbeResult{
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "h264", Height: 1080},
+		},
+	}
+	params := &OptimizationParams{
+		Video: &VideoEncoding{Transcode: true, Codec: "hevc_nvenc", Preset: "p5", RateControl: RateCRF, CRF: 24},
+	}
+	pool, _ := gpu.NewPool([]gpu.GPU{{Index: 1, Sessions: 1}})
+
+	plan, err := buildPlan(params, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	release := plan.assignGPU(pool)
+	defer release()
+	args := strings.Join(plan.OutputArgs(), " ")
+	for _, want := range []string{"-c:0 hevc_nvenc", "-rc:0 vbr -cq:0 24 -b:0 0", "-gpu:0 1"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in %s", want, args)
+		}
+	}
+
+	// The only session is taken, so the next job encodes in software
+	plan, _ = buildPlan(params, probe)
+	plan.assignGPU(pool)
+	args = strings.Join(plan.OutputArgs(), " ")
+	if !strings.Contains(args, "-c:0 libx265") || !strings.Contains(args, "-preset:0 medium") || !strings.Contains(args, "-crf:0 24") {
+		t.Errorf("Expected a software fallback, got %s", args)
+	}
+	if len(plan.Warnings) == 0 {
+		t.Error("Expected the fallback to be reported as a warning")
+	}
+
+	// NVENC's HDR caveat no longer applies once the encode is in software
+	probe.Streams[0].ColorTransfer = "smpte2084"
+	plan, _ = buildPlan(params, probe)
+	if !hasWarning(plan.Warnings, "NVENC") {
+		t.Errorf("Expected an NVENC HDR warning, got %v", plan.Warnings)
+	}
+	plan.assignGPU(pool)
+	if hasWarning(plan.Warnings, "NVENC") || !hasWarning(plan.Warnings, "libx265 instead") {
+		t.Errorf("Expected the HDR warnings of the software encode, got %v", plan.Warnings)
+	}
+}
+
+// hasWarning reports whether any warning contains substr
+func hasWarning(warnings []string, substr string) bool {
+	for _, w := range warnings {
+		if strings.Contains(w, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSampleStarts(t *testing.T) {
+	tests := []struct {
+		duration float64
+		count    int
+		length   float64
+		want     []float64
+	}{
+		// Clips are centred on 1/4, 1/2 and 3/4 of the film
+		{7200, 3, 60, []float64{1770, 3570, 5370}},
+		{400, 3, 60, []float64{70, 170, 270}},
+		// Too short for separate clips
+		{150, 3, 60, []float64{0}},
+	}
+	for _, tt := range tests {
+		got := sampleStarts(tt.duration, tt.count, tt.length)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("sampleStarts(%v, %d, %v) = %v, want %v", tt.duration, tt.count, tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestLadder(t *testing.T) {
+	probe := &ProbeResult{
+		Streams: []ProbeStream{
+			{Index: 0, CodecType: "video", CodecName: "hevc", Height: 720},
+			{Index: 1, CodecType: "audio", CodecName: "aac", Tags: map[string]string{"language": "eng"}},
+		},
+	}
+	got := LadderRenditions(probe, DefaultLadder)
+	if len(got) != 2 || got[0].Name != "720p" || got[1].Name != "480p" {
+		t.Errorf("Expected renditions above the source to be left out, got %+v", got)
+	}
+	probe.Streams[0].Height = 360
+	if got := LadderRenditions(probe, DefaultLadder); len(got) != 1 || got[0].Name != "480p" {
+		t.Errorf("Expected the smallest rendition for a small source, got %+v", got)
+	}
+
+	// A source already in the target codec is still re-encoded so keyframes
+	// line up across renditions
+	base := &OptimizationParams{
+		InputFile: "/media/movie.mkv",
+		Video:     &VideoEncoding{Codec: "libx265", RateControl: RateCRF, CRF: 24},
+	}
+	params := renditionParams(base, DefaultLadder[1], "/media/movie_renditions", 2)
+	if params.OutputFile != filepath.Join("/media/movie_renditions", "720p.mp4") || base.Video.RateControl != RateCRF {
+		t.Fatalf("Unexpected rendition params %+v", params)
+	}
+	plan, err := buildPlan(params, probe)
+	if err != nil {
+		t.Fatalf("buildPlan failed: %v", err)
+	}
+	args := strings.Join(plan.OutputArgs(), " ")
+	for _, want := range []string{"-c:0 libx265", "-crf:0 24 -maxrate:0 3500k", "-force_key_frames:0 expr:gte(t,n_forced*2)", "min(720,ih)"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in %s", want, args)
+		}
+	}
+
+	if err := ValidateRenditions([]Rendition{{Name: "720p", Height: 720}, {Name: "720p", Height: 720}}); err == nil {
+		t.Error("Expected duplicate rendition names to be rejected")
+	}
+	if err := ValidateRenditions([]Rendition{{Name: "../720p", Height: 720}}); err == nil {
+		t.Error("Expected a rendition name with a path to be rejected")
+	}
+}
+
+func TestPackagingArgs(t *testing.T) {
+	files := []string{"/out/1080p.mp4", "/out/720p.mp4"}
+	p := Packaging{Format: PackageHLS, SegmentSeconds: 2, OutputDir: "/media/movie_hls"}
+	args := strings.Join(hlsArgs(files, true, p), " ")
+	for _, want := range []string{
+		"-map 0:v:0 -map 0:a:0 -map 1:v:0 -map 1:a:0",
+		"-hls_time 2",
+		"-hls_segment_type fmp4",
+		"-var_stream_map v:0,a:0,name:1080p v:1,a:1,name:720p",
+		filepath.Join("/media/movie_hls", "%v", "index.m3u8"),
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in %s", want, args)
+		}
+	}
+
+	// DASH shares the audio of the first file
+	args = strings.Join(dashArgs(files, true, p), " ")
+	if !strings.Contains(args, "-map 0:v:0 -map 1:v:0 -map 0:a:0") || !strings.Contains(args, "-adaptation_sets id=0,streams=v id=1,streams=a") {
+		t.Errorf("Unexpected DASH args %s", args)
+	}
+	if err := ValidatePackaging("smooth"); err == nil {
+		t.Error("Expected an unknown packaging format to be rejected")
+	}
+}
+
+func TestPreviewArgs(t *testing.T) {
+	args := strings.Join(thumbnailArgs("/media/movie.mkv", "/cache/thumb.jpg", 600), " ")
+	if !strings.Contains(args, "-ss 60.000 -i /media/movie.mkv -map 0:V:0 -frames:v 1") {
+		t.Errorf("Unexpected thumbnail args %s", args)
+	}
+
+	args = strings.Join(spriteArgs("/media/movie.mkv", "/cache/sprite.jpg", 1200), " ")
+	if strings.Count(args, "-i /media/movie.mkv") != spriteColumns*spriteRows {
+		t.Errorf("Expected one seek per tile, got %s", args)
+	}
+	for _, want := range []string{"-ss 50.000 -i", "-ss 1150.000 -i", "[11:V:0]trim=end_frame=1", "concat=n=12:v=1:a=0,tile=4x3[sprite]"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in %s", want, args)
+		}
+	}
+	if err := Preview("/media/movie.mkv", "/cache/x.jpg", "gif"); err == nil {
+		t.Error("Expected an unknown preview kind to be rejected")
+	}
+}
+
+func TestTransientOutput(t *testing.T) {
+	var tail outputTail
+	tail.add("[hevc_nvenc @ 0x55] OpenEncodeSessionEx failed: out of memory (10): (no details)")
+	tail.add("Error initializing output stream 0:0 -- Error while opening encoder")
+	if line, ok := tail.transientLine(); !ok || !strings.Contains(line, "OpenEncodeSessionEx") {
+		t.Errorf("Expected exhausted NVENC sessions to be transient, got %q", line)
+	}
+
+	for i := 0; i < stderrTailLines; i++ {
+		tail.add("frame=100")
+	}
+	if _, ok := tail.transientLine(); ok {
+		t.Error("Expected lines beyond the tail to be forgotten")
+	}
+	tail.add("[matroska @ 0x55] Unsupported codec with id 0 for input stream 3")
+	if _, ok := tail.transientLine(); ok {
+		t.Error("Expected an unsupported codec not to be transient")
+	}
+	tail.add("/mnt/nas/movie.mkv: Input/output error")
+	if _, ok := tail.transientLine(); !ok {
+		t.Error("Expected a read error to be transient")
+	}
+}
+
+func TestTimeoutLimit(t *testing.T) {
+	var none *Timeout
+	if got := none.limit(3600); got != 0 {
+		t.Errorf("Expected no limit without a timeout, got %v", got)
+	}
+
+	timeout := &Timeout{Factor: 10, Min: 30 * time.Minute}
+	tests := []struct {
+		duration float64
+		want     time.Duration
+	}{
+		{7200, 20 * time.Hour},
+		{60, 30 * time.Minute},
+		// Unknown durations only get an explicit limit
+		{0, 0},
+	}
+	for _, tt := range tests {
+		if got := timeout.limit(tt.duration); got != tt.want {
+			t.Errorf("limit(%v) = %v, want %v", tt.duration, got, tt.want)
+		}
+	}
+
+	timeout.Max = 2 * time.Hour
+	if got := timeout.limit(7200); got != 2*time.Hour {
+		t.Errorf("Expected the explicit limit to win, got %v", got)
+	}
+	if got := timeout.limit(0); got != 2*time.Hour {
+		t.Errorf("Expected the explicit limit for an unknown duration, got %v", got)
+	}
+}
+
+func TestTimeLimitExcludesPauses(t *testing.T) {
+	const limit = 100 * time.Millisecond
+	cause := fmt.Errorf("%w after %v", ErrTimedOut, limit)
+
+	// Paused from the start, well past the limit
+	if err := SetPaused(true); err != nil {
+		t.Fatalf("SetPaused failed: %v", err)
+	}
+	defer SetPaused(false)
+	ctx, cancel := withTimeLimit(context.Background(), limit, cause)
+	defer cancel()
+	time.Sleep(3 * limit)
+	if ctx.Err() != nil {
+		t.Fatalf("Expected the limit to stand still while paused, got %v", context.Cause(ctx))
+	}
+
+	// Running, then paused again with time left
+	SetPaused(false)
+	time.Sleep(limit / 2)
+	SetPaused(true)
+	time.Sleep(3 * limit)
+	if ctx.Err() != nil {
+		t.Fatalf("Expected time left after half the limit, got %v", context.Cause(ctx))
+	}
+
+	resumed := time.Now()
+	SetPaused(false)
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * limit):
+		t.Fatal("Expected the limit to expire after resuming")
+	}
+	if elapsed := time.Since(resumed); elapsed > limit {
+		t.Errorf("Expected the rest of the limit to run out within %v, took %v", limit, elapsed)
+	}
+	if !errors.Is(context.Cause(ctx), ErrTimedOut) {
+		t.Errorf("Expected the time limit as the cause, got %v", context.Cause(ctx))
+	}
+
+	// Cancelling releases the timer
+	cancel()
+	activeProcesses.Lock()
+	timers := len(activeProcesses.timers)
+	activeProcesses.Unlock()
+	if timers != 0 {
+		t.Errorf("Expected no timers left, got %d", timers)
+	}
+}
+
+func TestProgressParser(t *testing.T) {
+	start := time.Now()
+	parser := newProgressParser(start)
+	block := func(now time.Time, lines ...string) (ProgressDetail, bool) {
+		var detail ProgressDetail
+		var ok bool
+		for _, line := range lines {
+			if d, reported := parser.line(line, now); reported {
+				detail, ok = d, true
+			}
+		}
+		return detail, ok
+	}
+
+	// Nothing is reported before the duration is known
+	if _, ok := block(start, "frame=10", "progress=continue"); ok {
+		t.Error("Expected no report without a duration")
+	}
+
+	detail, ok := block(start.Add(10*time.Second),
+		"total_duration=100.000000",
+		"frame=600", "fps=60.00", "out_time_us=25000000", "out_time_ms=25000000", "speed=2.5x", "progress=continue")
+	if !ok {
+		t.Fatal("Expected a report at the end of the block")
+	}
+	if detail.Percent != 25 || detail.Frame != 600 || detail.FPS != 60 || detail.Speed != 2.5 {
+		t.Errorf("Unexpected detail: %+v", detail)
+	}
+	// 75 seconds of input left at 2.5x
+	if detail.Elapsed != 10*time.Second || detail.Remaining != 30*time.Second {
+		t.Errorf("Expected 10s elapsed and 30s remaining, got %v and %v", detail.Elapsed, detail.Remaining)
+	}
+
+	// Without a speed the estimate comes from the rate so far
+	detail, _ = block(start.Add(20*time.Second), "speed=N/A", "out_time_us=50000000", "progress=continue")
+	if detail.Speed != 0 || detail.Remaining != 20*time.Second {
+		t.Errorf("Expected 20s remaining from the elapsed time, got %v", detail.Remaining)
+	}
+
+	// libvpx writes no timestamps while it looks ahead, so the frame count
+	// gives the position until they catch up
+	parser = newProgressParser(start)
+	parser.frameRate = 25
+	detail, _ = block(start, "total_duration=100", "frame=250", "out_time_us=-9223372036854775807", "speed=N/A", "progress=continue")
+	if detail.Percent != 10 {
+		t.Errorf("Expected 10%% from 250 frames at 25fps, got %v", detail.Percent)
+	}
+	detail, _ = block(start, "frame=300", "out_time_us=9000000", "progress=continue")
+	if detail.Percent != 10 {
+		t.Errorf("Expected progress not to move back while the timestamps lag, got %v", detail.Percent)
+	}
+	detail, _ = block(start, "frame=600", "out_time_us=23000000", "progress=end")
+	if detail.Percent != 23 {
+		t.Errorf("Expected 23%% once the timestamps catch up, got %v", detail.Percent)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	var stages []string
+	var last float64
+	p := NewPipeline(func(stage string, progress float64) {
+		stages = append(stages, stage)
+		last = progress
+	}, Stage{StageProbe, 1}, Stage{StageEncode, 8}, Stage{StageVerify, 1})
+
+	p.Start(StageProbe)
+	if last != 0 {
+		t.Errorf("Expected 0%% at the start, got %v", last)
+	}
+	p.Progress(StageEncode)(50)
+	if last != 50 {
+		t.Errorf("Expected half the encode to be 50%% overall, got %v", last)
+	}
+	p.Update(StageVerify, 150)
+	if last != 100 {
+		t.Errorf("Expected progress to be capped at 100%%, got %v", last)
+	}
+
+	// Stages outside the pipeline aren't reported
+	p.Start(StageAnalyze)
+	if want := []string{StageProbe, StageEncode, StageVerify}; strings.Join(stages, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected stages %v, got %v", want, stages)
+	}
+}
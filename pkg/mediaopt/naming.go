@@ -0,0 +1,133 @@
+package mediaopt
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"media_optimizer/pkg/mediapath"
+)
+
+// DefaultOutputName is the naming template of outputs, the source's name
+// with an _optimized suffix
+const DefaultOutputName = "{{.Base}}_optimized.{{.Ext}}"
+
+// OutputName holds the fields of an output naming template, e.g.
+// "{{.Base}} [{{.VideoCodec}}-{{.Height}}p].{{.Ext}}"
+type OutputName struct {
+	// Base is the source's file name without its extension
+	Base string
+	// Ext is the output's extension without the dot, e.g. "mkv"
+	Ext string
+	// VideoCodec and AudioCodec are the codecs of the output's first video
+	// and audio streams, e.g. "hevc" and "ac3"; empty without such a stream
+	VideoCodec string
+	AudioCodec string
+	// Height is the height of the output's video in pixels, zero if unknown
+	Height int
+	// HDR is the output's HDR format, e.g. "hdr10", empty for SDR
+	HDR string
+}
+
+// ParseOutputName parses a naming template and checks that it yields a file
+// name
+func ParseOutputName(text string) (*template.Template, error) {
+	tmpl, err := template.New("output").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output name template: %v", err)
+	}
+	sample := OutputName{Base: "Movie (2020)", Ext: "mkv", VideoCodec: "hevc", AudioCodec: "ac3", Height: 1080}
+	if _, err := renderOutputName(tmpl, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// renderOutputName executes tmpl for name and checks the result is a plain
+// file name
+func renderOutputName(tmpl *template.Template, name OutputName) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, name); err != nil {
+		return "", fmt.Errorf("invalid output name template: %v", err)
+	}
+	out := strings.TrimSpace(b.String())
+	switch {
+	case out == "" || out == "." || out == "..":
+		return "", fmt.Errorf("output name template gives an empty name")
+	case strings.ContainsAny(out, `/\`):
+		return "", fmt.Errorf("output name %q must not contain a path separator", out)
+	case !strings.EqualFold(filepath.Ext(out), "."+name.Ext):
+		return "", fmt.Errorf("output name %q must end in .%s, see {{.Ext}}", out, name.Ext)
+	}
+	return out, nil
+}
+
+// outputName returns the template fields describing the output of plan for
+// the source input
+func (p *Plan) outputName(input, output string, probe *ProbeResult) OutputName {
+	name := OutputName{
+		Base: strings.TrimSuffix(filepath.Base(input), filepath.Ext(input)),
+		Ext:  strings.TrimPrefix(filepath.Ext(output), "."),
+	}
+	heights := make(map[int]int)
+	for _, s := range probe.Streams {
+		heights[s.Index] = s.Height
+	}
+	for _, m := range p.Streams {
+		if m.Action == ActionDrop {
+			continue
+		}
+		codec := m.SourceCodec
+		if m.Action == ActionTranscode {
+			codec = m.TargetCodec
+			if format, ok := encoderFormats[codec]; ok {
+				codec = format
+			} else if m.Type == "audio" {
+				codec = audioFormat(codec)
+			}
+		}
+		switch {
+		case m.Type == "video" && name.VideoCodec == "":
+			name.VideoCodec = codec
+			name.Height = heights[m.InputIndex]
+			if m.Action == ActionTranscode && p.MaxHeight > 0 {
+				name.Height = min(name.Height, p.MaxHeight)
+			}
+			name.HDR = m.HDR
+			if m.Action == ActionTranscode && p.HDRMode == HDRToneMap {
+				name.HDR = ""
+			}
+		case m.Type == "audio" && name.AudioCodec == "":
+			name.AudioCodec = codec
+		}
+	}
+	return name
+}
+
+// applyOutputName names params.OutputFile after params.OutputName, keeping
+// its directory, gives it the extension the plan's container needs and
+// spells it in params.NameForm
+func applyOutputName(params *OptimizationParams, plan *Plan, probe *ProbeResult) error {
+	params.OutputFile = plan.containerExtension(params.OutputFile)
+	output := params.OutputFile
+	if params.OutputName != "" {
+		tmpl, err := ParseOutputName(params.OutputName)
+		if err != nil {
+			return err
+		}
+		name, err := renderOutputName(tmpl, plan.outputName(params.InputFile, params.OutputFile, probe))
+		if err != nil {
+			return err
+		}
+		output = filepath.Join(filepath.Dir(params.OutputFile), name)
+	}
+	output = mediapath.NormalizeName(output, params.NameForm)
+	// Names differing only in their normalization form are one file on
+	// filesystems that normalize, such as APFS
+	if mediapath.SameName(output, filepath.Clean(params.InputFile)) {
+		return fmt.Errorf("output name %q would overwrite the source", filepath.Base(output))
+	}
+	params.OutputFile = output
+	return nil
+}
@@ -0,0 +1,16 @@
+package mediaopt
+
+import (
+	"os"
+	"strconv"
+)
+
+// MarkerEnv is set on every process the optimizer launches. Children such as
+// ffmpeg inherit it, which lets a restarted server recognise encodes left
+// behind by a previous instance.
+const MarkerEnv = "MEDIA_OPTIMIZER_OWNER"
+
+// markerValue identifies processes launched by this server instance
+func markerValue() string {
+	return strconv.Itoa(os.Getpid())
+}
@@ -0,0 +1,73 @@
+package mediaopt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SweepOrphans kills processes carrying MarkerEnv from a previous server
+// instance that is no longer running, giving them the usual grace period
+// after SIGTERM. Processes of another live instance, such as a second server
+// on the same host, are left alone. It returns the number of processes found.
+func SweepOrphans() (int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+
+	prefix := []byte(MarkerEnv + "=")
+	current := markerValue()
+	self := os.Getpid()
+
+	var orphans []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		environ, err := os.ReadFile(filepath.Join("/proc", e.Name(), "environ"))
+		if err != nil {
+			continue
+		}
+		for _, v := range bytes.Split(environ, []byte{0}) {
+			if !bytes.HasPrefix(v, prefix) {
+				continue
+			}
+			if marker := string(v[len(prefix):]); marker != current && ownerGone(marker) {
+				orphans = append(orphans, pid)
+			}
+			break
+		}
+	}
+
+	for _, pid := range orphans {
+		logInfo("Terminating orphaned process %d from a previous instance", pid)
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+
+	deadline := time.Now().Add(terminateGracePeriod)
+	for _, pid := range orphans {
+		for time.Now().Before(deadline) && syscall.Kill(pid, 0) == nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if syscall.Kill(pid, 0) == nil {
+			logInfo("Orphaned process %d ignored SIGTERM, killing", pid)
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	return len(orphans), nil
+}
+
+// ownerGone reports whether the server instance named by a MarkerEnv value
+// has exited. A value that isn't a PID can't be checked and counts as alive.
+func ownerGone(marker string) bool {
+	owner, err := strconv.Atoi(marker)
+	if err != nil || owner <= 0 {
+		return false
+	}
+	return syscall.Kill(owner, 0) == syscall.ESRCH
+}
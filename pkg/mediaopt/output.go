@@ -0,0 +1,59 @@
+package mediaopt
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// partialPrefix marks outputs still being written or verified
+const partialPrefix = ".partial-"
+
+// PartialPath returns the name output is written under until it is
+// verified: next to it, so placing it is a rename within the filesystem,
+// hidden from media servers and players, and with its extension so ffmpeg
+// and ffprobe recognise the format
+func PartialPath(output string) string {
+	return filepath.Join(filepath.Dir(output), partialPrefix+filepath.Base(output))
+}
+
+// IsPartial reports whether path is an output that was never put in place
+func IsPartial(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), partialPrefix)
+}
+
+// placeOutput puts the verified output written to partial in place at
+// output. The file is flushed to disk before the rename and the directory
+// after it, so a crash leaves either no output or the complete one.
+func placeOutput(partial, output string) error {
+	f, err := os.OpenFile(partial, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(partial, output); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(output))
+}
+
+// syncDir flushes the entries of dir to disk. Windows can't sync
+// directories, and its renames are journaled by NTFS instead.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,164 @@
+package mediaopt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Packaging formats
+const (
+	PackageHLS  = "hls"
+	PackageDASH = "dash"
+)
+
+// DefaultSegmentSeconds is the target segment length of a packaged single
+// video, whose keyframes follow the source
+const DefaultSegmentSeconds = 6.0
+
+// Packaging configures segmented output for web players
+type Packaging struct {
+	// Format is PackageHLS or PackageDASH
+	Format string
+	// SegmentSeconds is the target segment length; segments are cut at the
+	// next keyframe. Zero uses DefaultSegmentSeconds.
+	SegmentSeconds float64
+	// OutputDir receives the manifests and segments; its previous contents
+	// are replaced
+	OutputDir string
+}
+
+// ValidatePackaging checks that format is a supported packaging format
+func ValidatePackaging(format string) error {
+	if format != PackageHLS && format != PackageDASH {
+		return fmt.Errorf("packaging must be %q or %q, got %q", PackageHLS, PackageDASH, format)
+	}
+	return nil
+}
+
+// PackageDir is the default directory of the packaged output of input
+func PackageDir(input, format string) string {
+	return strings.TrimSuffix(input, filepath.Ext(input)) + "_" + format
+}
+
+// Package segments MP4 files into an HLS or DASH presentation without
+// re-encoding and returns the path of its master playlist or manifest. The
+// files are the variants of one video, e.g. ladder renditions ordered from
+// the highest quality, and are named after their file names. HLS gets one
+// media playlist per variant, each with its own audio, and fMP4 segments so
+// that HEVC plays; DASH shares the first file's audio between the variants.
+// jobID keys the packaging process for SetPaused, and cancelling ctx kills it.
+func Package(ctx context.Context, jobID string, files []string, p Packaging) (string, error) {
+	if err := ValidatePackaging(p.Format); err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("nothing to package")
+	}
+	if p.SegmentSeconds <= 0 {
+		p.SegmentSeconds = DefaultSegmentSeconds
+	}
+	probe, err := Probe(files[0])
+	if err != nil {
+		return "", fmt.Errorf("failed to probe %s: %v", files[0], err)
+	}
+	audio := len(probe.StreamsOfType("audio")) > 0
+
+	if err := os.RemoveAll(p.OutputDir); err != nil {
+		return "", fmt.Errorf("failed to clear %s: %v", p.OutputDir, err)
+	}
+	if err := os.MkdirAll(p.OutputDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", p.OutputDir, err)
+	}
+
+	args := []string{"-hide_banner", "-nostats", "-v", "error", "-y"}
+	for _, f := range files {
+		args = append(args, "-i", f)
+	}
+	var manifest string
+	if p.Format == PackageHLS {
+		manifest = filepath.Join(p.OutputDir, "master.m3u8")
+		args = append(args, hlsArgs(files, audio, p)...)
+	} else {
+		manifest = filepath.Join(p.OutputDir, "manifest.mpd")
+		args = append(args, dashArgs(files, audio, p)...)
+		args = append(args, manifest)
+	}
+
+	logInfo("Packaging job %s as %s in %s", jobID, p.Format, p.OutputDir)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stderr = &stderr
+	proc, err := startProcess(jobID, cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to start packaging: %v", err)
+	}
+	defer func() {
+		activeProcesses.Lock()
+		delete(activeProcesses.procs, jobID)
+		activeProcesses.Unlock()
+	}()
+	if err := proc.wait(); err != nil {
+		return "", fmt.Errorf("packaging failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if _, err := os.Stat(manifest); err != nil {
+		return "", fmt.Errorf("packaging wrote no manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+// hlsArgs maps every file to its own HLS variant
+func hlsArgs(files []string, audio bool, p Packaging) []string {
+	var args, variants []string
+	for i, f := range files {
+		in := strconv.Itoa(i)
+		args = append(args, "-map", in+":v:0")
+		variant := "v:" + in
+		if audio {
+			args = append(args, "-map", in+":a:0")
+			variant += ",a:" + in
+		}
+		name := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+		variants = append(variants, variant+",name:"+name)
+	}
+	return append(args,
+		"-c", "copy",
+		"-f", "hls",
+		"-hls_time", strconv.FormatFloat(p.SegmentSeconds, 'f', -1, 64),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_type", "fmp4",
+		"-hls_segment_filename", filepath.Join(p.OutputDir, "%v", "segment_%05d.m4s"),
+		"-master_pl_name", "master.m3u8",
+		"-var_stream_map", strings.Join(variants, " "),
+		filepath.Join(p.OutputDir, "%v", "index.m3u8"),
+	)
+}
+
+// dashArgs maps the video of every file and the audio of the first into
+// one adaptation set each
+func dashArgs(files []string, audio bool, p Packaging) []string {
+	var args []string
+	for i := range files {
+		args = append(args, "-map", strconv.Itoa(i)+":v:0")
+	}
+	sets := "id=0,streams=v"
+	if audio {
+		args = append(args, "-map", "0:a:0")
+		sets += " id=1,streams=a"
+	}
+	return append(args,
+		"-c", "copy",
+		"-f", "dash",
+		"-seg_duration", strconv.FormatFloat(p.SegmentSeconds, 'f', -1, 64),
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-adaptation_sets", sets,
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "segment-$RepresentationID$-$Number%05d$.m4s",
+	)
+}
@@ -0,0 +1,369 @@
+package mediaopt
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Stream actions used in a Plan
+const (
+	ActionCopy      = "copy"
+	ActionTranscode = "transcode"
+	ActionDrop      = "drop"
+)
+
+const (
+	// TargetAudioCodec is the codec the audio tracks are re-encoded to
+	TargetAudioCodec = "ac3"
+	// TargetAudioLanguage selects which audio tracks are kept
+	TargetAudioLanguage = "eng"
+	// TargetContainer is the muxer used for the optimized file
+	TargetContainer = "mp4"
+	// optimizedAudioTitle is the title written on re-encoded audio tracks
+	optimizedAudioTitle = "2.1 Optimized"
+)
+
+// dispositionFlags are the ffprobe disposition keys carried into a plan
+var dispositionFlags = []string{"default", "forced", "dub", "original", "comment", "hearing_impaired", "visual_impaired"}
+
+// StreamMapping describes what happens to one input stream
+type StreamMapping struct {
+	InputIndex int    `json:"inputIndex"`
+	Type       string `json:"type"`
+	Language   string `json:"language,omitempty"`
+	// LanguageSource is set when Language was inferred for an untagged track
+	LanguageSource string `json:"languageSource,omitempty"`
+	Title          string `json:"title,omitempty"`
+	SourceCodec    string `json:"sourceCodec"`
+	TargetCodec    string `json:"targetCodec,omitempty"`
+	Action         string `json:"action"`
+	// Channels is the output channel count of a transcoded audio stream
+	Channels int `json:"channels,omitempty"`
+	// Disposition lists output flags such as "default" or "forced"
+	Disposition []string `json:"disposition,omitempty"`
+	Reason      string   `json:"reason,omitempty"`
+	// HDR is the source's HDR format (hdr10, hlg, dolby_vision), empty for SDR
+	HDR string `json:"hdr,omitempty"`
+
+	// HDR metadata from the probe, needed to re-encode without losing it
+	colorTransfer string
+	masterDisplay string
+	maxCLL        string
+}
+
+// Plan is the set of operations the pipeline will perform on an input file
+type Plan struct {
+	Container   string          `json:"container"`
+	VideoCodec  string          `json:"videoCodec"`
+	AudioFilter string          `json:"audioFilter"`
+	Streams     []StreamMapping `json:"streams"`
+	// Fragmented writes a fragmented MP4 for non-seekable outputs such as pipes
+	Fragmented bool `json:"fragmented,omitempty"`
+	// Encoding configures re-encoded video streams
+	Encoding *VideoEncoding `json:"encoding,omitempty"`
+	// Audio configures re-encoded audio streams; nil uses DefaultAudio
+	Audio *AudioEncoding `json:"audio,omitempty"`
+	// MaxHeight downscales re-encoded video taller than this
+	MaxHeight int `json:"maxHeight,omitempty"`
+	// Filters clean up re-encoded video
+	Filters *VideoFilters `json:"filters,omitempty"`
+	// Crop is the area of the frame re-encoded video keeps, nil for all of it
+	Crop *Crop `json:"crop,omitempty"`
+	// Complexity is the source's measured complexity when Encoding was
+	// adjusted to it
+	Complexity *Complexity `json:"complexity,omitempty"`
+	// KeyframeSeconds forces a keyframe at this interval in re-encoded video
+	KeyframeSeconds float64 `json:"keyframeSeconds,omitempty"`
+	// Threads limits the encoder threads; zero lets ffmpeg decide
+	Threads int `json:"threads,omitempty"`
+	// Stamp is written to the output's container metadata when set
+	Stamp *Stamp `json:"stamp,omitempty"`
+	// CustomArgs are extra ffmpeg options from the profile
+	CustomArgs *CustomArgs `json:"customArgs,omitempty"`
+	// GPU is the device of a hardware encoder session, nil if unassigned
+	GPU *int `json:"gpu,omitempty"`
+	// PassLogFile is the stats file prefix of a two-pass encode. Without it
+	// a two-pass plan encodes in a single pass at the target bitrate.
+	PassLogFile string `json:"-"`
+	// HDRMode and ToneMap control re-encoded HDR video, see HDROptions
+	HDRMode string `json:"hdrMode,omitempty"`
+	ToneMap string `json:"toneMap,omitempty"`
+	// Warnings are problems found while planning that don't stop the job
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// BuildPlan derives the pipeline plan from probe data. It mirrors the
+// decisions made by scripts/optimize_media.sh: the first video stream is
+// copied, English audio is downmixed to stereo AC3 and everything else is
+// dropped.
+func BuildPlan(probe *ProbeResult) *Plan {
+	plan := &Plan{
+		Container:   TargetContainer,
+		AudioFilter: "volume=1.2",
+	}
+
+	videoMapped := false
+	for _, s := range probe.Streams {
+		m := StreamMapping{
+			InputIndex:  s.Index,
+			Type:        s.CodecType,
+			Language:    s.Tags["language"],
+			Title:       s.Tags["title"],
+			SourceCodec: s.CodecName,
+			Disposition: sourceDisposition(s),
+		}
+		hdrInfo(&m, s)
+
+		switch {
+		case s.CodecType == "video" && !videoMapped:
+			videoMapped = true
+			plan.VideoCodec = s.CodecName
+			m.Action = ActionCopy
+			m.TargetCodec = s.CodecName
+			if s.CodecName == "hevc" {
+				// Only the audio is touched for HEVC sources, so it gets
+				// the stronger normalisation
+				plan.AudioFilter = "dynaudnorm=f=500:g=15:p=0.95:r=0.5,volume=1.2"
+			}
+		case s.CodecType == "video":
+			m.Action = ActionDrop
+			m.Reason = "only the first video stream is kept"
+		case s.CodecType == "audio" && m.Language == TargetAudioLanguage:
+			m.Action = ActionTranscode
+			m.TargetCodec = TargetAudioCodec
+			m.Channels = 2
+			m.Title = optimizedAudioTitle
+		case s.CodecType == "audio":
+			m.Action = ActionDrop
+			m.Reason = fmt.Sprintf("language %q is not %q", m.Language, TargetAudioLanguage)
+		default:
+			m.Action = ActionDrop
+			m.Reason = fmt.Sprintf("%s streams are not kept", s.CodecType)
+		}
+
+		plan.Streams = append(plan.Streams, m)
+	}
+	return plan
+}
+
+// sourceDisposition lists the disposition flags set on a probed stream
+func sourceDisposition(s ProbeStream) []string {
+	var flags []string
+	for _, f := range dispositionFlags {
+		if s.Disposition[f] == 1 {
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
+
+// ApplyMappings replaces the plan's stream decisions with user-edited ones.
+// Every mapping must refer to a stream present in the probe; streams left out
+// are dropped. Output streams follow the order of the given mappings.
+func (p *Plan) ApplyMappings(mappings []StreamMapping, probe *ProbeResult) error {
+	streams := make(map[int]ProbeStream)
+	for _, s := range probe.Streams {
+		streams[s.Index] = s
+	}
+
+	seen := make(map[int]bool)
+	var result []StreamMapping
+	for _, m := range mappings {
+		src, ok := streams[m.InputIndex]
+		if !ok {
+			return fmt.Errorf("stream %d does not exist in the input", m.InputIndex)
+		}
+		if seen[m.InputIndex] {
+			return fmt.Errorf("stream %d is mapped more than once", m.InputIndex)
+		}
+		seen[m.InputIndex] = true
+
+		switch m.Action {
+		case ActionCopy:
+			m.TargetCodec = src.CodecName
+		case ActionTranscode:
+			if m.TargetCodec == "" {
+				return fmt.Errorf("stream %d: transcode requires a targetCodec", m.InputIndex)
+			}
+		case ActionDrop:
+		default:
+			return fmt.Errorf("stream %d: unknown action %q", m.InputIndex, m.Action)
+		}
+		for _, d := range m.Disposition {
+			if !validDisposition(d) {
+				return fmt.Errorf("stream %d: unknown disposition %q", m.InputIndex, d)
+			}
+		}
+
+		// Probe facts can't be edited
+		m.Type = src.CodecType
+		m.SourceCodec = src.CodecName
+		m.Reason = "user mapping"
+		hdrInfo(&m, src)
+		result = append(result, m)
+	}
+
+	// Record unmapped streams as dropped so the plan stays complete
+	var dropped []StreamMapping
+	for _, s := range probe.Streams {
+		if !seen[s.Index] {
+			m := StreamMapping{
+				InputIndex:  s.Index,
+				Type:        s.CodecType,
+				Language:    s.Tags["language"],
+				SourceCodec: s.CodecName,
+				Action:      ActionDrop,
+				Reason:      "not included in user mapping",
+			}
+			hdrInfo(&m, s)
+			dropped = append(dropped, m)
+		}
+	}
+	sort.Slice(dropped, func(i, j int) bool { return dropped[i].InputIndex < dropped[j].InputIndex })
+
+	p.Streams = append(result, dropped...)
+	p.VideoCodec = ""
+	for _, m := range p.Streams {
+		if m.Type == "video" && m.Action != ActionDrop {
+			p.VideoCodec = m.TargetCodec
+			break
+		}
+	}
+	return nil
+}
+
+func validDisposition(d string) bool {
+	for _, f := range dispositionFlags {
+		if d == f {
+			return true
+		}
+	}
+	return false
+}
+
+// OutputArgs returns the ffmpeg output options implementing the plan
+func (p *Plan) OutputArgs() []string {
+	movflags := "+faststart"
+	if p.Fragmented {
+		movflags = "frag_keyframe+empty_moov+default_base_moof"
+	}
+	if p.Stamp != nil {
+		// MP4 only stores tags outside its fixed set with this flag
+		movflags += "+use_metadata_tags"
+	}
+
+	pass := 0
+	if p.PassLogFile != "" && p.twoPass() {
+		pass = 2
+	}
+	args := append(p.streamArgs(pass), p.threadArgs()...)
+	args = append(args, "-f", p.Container)
+	if p.Container == "mp4" || p.Container == "mov" {
+		if p.hasDolbyVisionCopy() {
+			// ffmpeg only writes the dvcC box in unofficial mode
+			args = append(args, "-strict", "unofficial")
+		}
+		args = append(args, "-movflags", movflags)
+	}
+	if p.Stamp != nil {
+		args = append(args, p.Stamp.args()...)
+	}
+	return append(args, p.customOutputArgs()...)
+}
+
+// threadArgs returns the thread limit options of the plan, if any
+func (p *Plan) threadArgs() []string {
+	if p.Threads <= 0 {
+		return nil
+	}
+	return []string{"-threads", strconv.Itoa(p.Threads)}
+}
+
+// streamArgs maps and configures each kept stream for the given encoding
+// pass. Plans built without probe data (e.g. for piped input) fall back to
+// stream selectors.
+func (p *Plan) streamArgs(pass int) []string {
+	if len(p.Streams) == 0 {
+		a := p.Audio
+		if a == nil {
+			a = &DefaultAudio
+		}
+		channels := a.channels(2)
+		return []string{
+			"-map", "0:v:0",
+			"-map", "0:a:m:language:" + TargetAudioLanguage,
+			"-metadata:s:a", "title=" + audioTitle(channels),
+			"-metadata:s:a", "language=" + TargetAudioLanguage,
+			"-c:v", "copy",
+			"-c:a", a.Encoder(),
+			"-ac", strconv.Itoa(channels),
+			"-b:a", fmt.Sprintf("%dk", a.bitrate(channels)),
+			"-af", p.AudioFilter,
+		}
+	}
+
+	var args []string
+	out := 0
+	for _, m := range p.Streams {
+		if m.Action == ActionDrop {
+			continue
+		}
+		idx := strconv.Itoa(out)
+		args = append(args, "-map", "0:"+strconv.Itoa(m.InputIndex))
+
+		if m.Action == ActionCopy {
+			args = append(args, "-c:"+idx, "copy")
+		} else {
+			args = append(args, "-c:"+idx, m.TargetCodec)
+			if m.Type == "video" {
+				args = append(args, p.videoArgs(m, idx, pass)...)
+			}
+			if m.Type == "audio" {
+				args = append(args, "-b:"+idx, fmt.Sprintf("%dk", p.audioBitrate(m)))
+				if m.Channels > 0 {
+					args = append(args, "-ac:"+idx, strconv.Itoa(m.Channels))
+				}
+				if p.AudioFilter != "" {
+					args = append(args, "-filter:"+idx, p.AudioFilter)
+				}
+			}
+		}
+
+		if m.Language != "" {
+			args = append(args, "-metadata:s:"+idx, "language="+m.Language)
+		}
+		if m.Title != "" {
+			args = append(args, "-metadata:s:"+idx, "title="+m.Title)
+		}
+		disposition := "0"
+		if len(m.Disposition) > 0 {
+			disposition = strings.Join(m.Disposition, "+")
+		}
+		args = append(args, "-disposition:"+idx, disposition)
+		out++
+	}
+	return args
+}
+
+// Summary describes the plan in a single human readable line
+func (p *Plan) Summary() string {
+	var kept, dropped []string
+	for _, m := range p.Streams {
+		desc := fmt.Sprintf("#%d %s %s", m.InputIndex, m.Type, m.SourceCodec)
+		if m.Action == ActionDrop {
+			dropped = append(dropped, desc)
+			continue
+		}
+		if m.Action == ActionTranscode {
+			desc += "→" + m.TargetCodec
+		}
+		kept = append(kept, desc)
+	}
+	summary := "keep " + strings.Join(kept, ", ")
+	if len(dropped) > 0 {
+		summary += "; drop " + strings.Join(dropped, ", ")
+	}
+	return summary
+}
@@ -0,0 +1,97 @@
+package mediaopt
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Preview kinds
+const (
+	// PreviewThumbnail is a single frame
+	PreviewThumbnail = "thumbnail"
+	// PreviewSprite is a grid of frames from across the video
+	PreviewSprite = "sprite"
+)
+
+const (
+	// thumbnailWidth is the width of a thumbnail in pixels
+	thumbnailWidth = 480
+	// thumbnailPosition is the fraction of the duration a thumbnail is
+	// taken at, past most intros and studio logos
+	thumbnailPosition = 0.1
+	// Sprites are spriteColumns by spriteRows tiles of spriteTileWidth pixels
+	spriteTileWidth = 240
+	spriteColumns   = 4
+	spriteRows      = 3
+)
+
+// Preview writes a JPEG preview of the given kind for the video input to
+// output, which must end in .jpg
+func Preview(input, output, kind string) error {
+	if kind != PreviewThumbnail && kind != PreviewSprite {
+		return fmt.Errorf("preview must be %q or %q, got %q", PreviewThumbnail, PreviewSprite, kind)
+	}
+	probe, err := Probe(input)
+	if err != nil {
+		return fmt.Errorf("failed to probe %s: %v", input, err)
+	}
+	if len(probe.StreamsOfType("video")) == 0 {
+		return fmt.Errorf("%s has no video stream", input)
+	}
+	duration := probe.DurationSeconds()
+
+	args := thumbnailArgs(input, output, duration)
+	if kind == PreviewSprite {
+		if duration <= 0 {
+			return fmt.Errorf("duration of %s is unknown", input)
+		}
+		args = spriteArgs(input, output, duration)
+	}
+	if out, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create %s: %v: %s", kind, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// thumbnailArgs grabs one frame of the first video stream that isn't cover
+// art
+func thumbnailArgs(input, output string, duration float64) []string {
+	return []string{
+		"-v", "error", "-y",
+		"-ss", formatSeconds(duration * thumbnailPosition),
+		"-i", input,
+		"-map", "0:V:0",
+		"-frames:v", "1",
+		"-vf", "scale=" + strconv.Itoa(thumbnailWidth) + ":-2",
+		"-q:v", "4",
+		"-update", "1",
+		output,
+	}
+}
+
+// spriteArgs seeks the input once per tile, so only the frames used are
+// decoded, and tiles the frames into one image
+func spriteArgs(input, output string, duration float64) []string {
+	tiles := spriteColumns * spriteRows
+	args := []string{"-v", "error", "-y"}
+	var filters []string
+	var labels string
+	for i := 0; i < tiles; i++ {
+		at := (float64(i) + 0.5) * duration / float64(tiles)
+		args = append(args, "-ss", formatSeconds(at), "-i", input)
+		label := fmt.Sprintf("[f%d]", i)
+		filters = append(filters, fmt.Sprintf("[%d:V:0]trim=end_frame=1,scale=%d:-2,setsar=1%s", i, spriteTileWidth, label))
+		labels += label
+	}
+	filters = append(filters, fmt.Sprintf("%sconcat=n=%d:v=1:a=0,tile=%dx%d[sprite]", labels, tiles, spriteColumns, spriteRows))
+	return append(args,
+		"-filter_complex", strings.Join(filters, ";"),
+		"-map", "[sprite]",
+		"-frames:v", "1",
+		"-q:v", "5",
+		"-update", "1",
+		output,
+	)
+}
@@ -0,0 +1,124 @@
+package mediaopt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+)
+
+// I/O scheduling classes of Priority.IOClass
+const (
+	// IOClassIdle only gets disk time when no other process wants it
+	IOClassIdle = "idle"
+	// IOClassBestEffort is the default class, ordered by IOLevel
+	IOClassBestEffort = "best-effort"
+)
+
+// Priority limits the CPU and disk share of encode processes so they don't
+// starve other services on the machine, such as a media server's playback.
+// The zero value leaves the encoder unrestricted.
+type Priority struct {
+	// Nice is the niceness the encoder runs at, 1 (slightly lower priority)
+	// to 19 (lowest); zero keeps the server's
+	Nice int `json:"nice,omitempty"`
+	// IOClass is IOClassIdle or IOClassBestEffort; empty keeps the default
+	IOClass string `json:"ioClass,omitempty"`
+	// IOLevel orders best-effort I/O from 0 (highest) to 7 (lowest)
+	IOLevel int `json:"ioLevel,omitempty"`
+	// CPUQuota caps the encoder at this percentage of one core, e.g. 200
+	// for two cores, through a transient systemd scope; zero disables it
+	CPUQuota int `json:"cpuQuota,omitempty"`
+	// Threads limits ffmpeg's encoder threads; zero lets ffmpeg decide
+	Threads int `json:"threads,omitempty"`
+	// ReadRate caps how fast ffmpeg reads the input, as a multiple of its
+	// playback speed, e.g. 4 to read no faster than four times real time.
+	// It spares spinning disks and network shares; zero reads at full speed.
+	ReadRate float64 `json:"readRate,omitempty"`
+}
+
+// Validate checks that the settings are in range
+func (p *Priority) Validate() error {
+	if p.Nice < 0 || p.Nice > 19 {
+		return fmt.Errorf("nice must be between 0 and 19, got %d", p.Nice)
+	}
+	switch p.IOClass {
+	case "", IOClassIdle, IOClassBestEffort:
+	default:
+		return fmt.Errorf("ioClass must be %q or %q, got %q", IOClassIdle, IOClassBestEffort, p.IOClass)
+	}
+	if p.IOLevel < 0 || p.IOLevel > 7 {
+		return fmt.Errorf("ioLevel must be between 0 and 7, got %d", p.IOLevel)
+	}
+	if p.CPUQuota < 0 {
+		return fmt.Errorf("cpuQuota must not be negative, got %d", p.CPUQuota)
+	}
+	if p.Threads < 0 {
+		return fmt.Errorf("threads must not be negative, got %d", p.Threads)
+	}
+	if p.ReadRate < 0 {
+		return fmt.Errorf("readRate must not be negative, got %g", p.ReadRate)
+	}
+	return nil
+}
+
+// command builds the command running name with args under the priority.
+// Each wrapper execs the next, so the started process is still the leader of
+// its process group and can be tracked and terminated as before. Children,
+// such as ffmpeg started by the optimization script, inherit the limits.
+// Wrappers not available on the platform are left out. The command is
+// stopped when ctx is done.
+func (p *Priority) command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	var prefix []string
+	if p != nil && runtime.GOOS != "windows" {
+		if p.CPUQuota > 0 && runtime.GOOS == "linux" {
+			prefix = append(prefix, "systemd-run", "--scope", "--quiet", "--collect")
+			if os.Geteuid() != 0 {
+				prefix = append(prefix, "--user")
+			}
+			prefix = append(prefix, "-p", fmt.Sprintf("CPUQuota=%d%%", p.CPUQuota), "--")
+		}
+		if p.IOClass != "" && runtime.GOOS == "linux" {
+			prefix = append(prefix, "ionice")
+			if p.IOClass == IOClassIdle {
+				prefix = append(prefix, "-c", "3")
+			} else {
+				prefix = append(prefix, "-c", "2", "-n", strconv.Itoa(p.IOLevel))
+			}
+		}
+		if p.Nice > 0 {
+			prefix = append(prefix, "nice", "-n", strconv.Itoa(p.Nice))
+		}
+	}
+
+	if len(prefix) == 0 {
+		return exec.CommandContext(ctx, name, args...)
+	}
+	return exec.CommandContext(ctx, prefix[0], append(append(prefix[1:], name), args...)...)
+}
+
+// threads returns the ffmpeg thread limit, zero for none
+func (p *Priority) threads() int {
+	if p == nil {
+		return 0
+	}
+	return p.Threads
+}
+
+// readRate returns ffmpeg's -readrate value, empty for none
+func (p *Priority) readRate() string {
+	if p == nil || p.ReadRate <= 0 {
+		return ""
+	}
+	return strconv.FormatFloat(p.ReadRate, 'f', -1, 64)
+}
+
+// inputArgs returns the ffmpeg options preceding the input they limit
+func (p *Priority) inputArgs() []string {
+	if rate := p.readRate(); rate != "" {
+		return []string{"-readrate", rate}
+	}
+	return nil
+}
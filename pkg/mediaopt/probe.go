@@ -0,0 +1,158 @@
+package mediaopt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ProbeStream describes a single stream as reported by ffprobe
+type ProbeStream struct {
+	Index     int    `json:"index"`
+	CodecName string `json:"codec_name"`
+	CodecType string `json:"codec_type"`
+	Profile   string `json:"profile,omitempty"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	PixFmt    string `json:"pix_fmt,omitempty"`
+	// AvgFrameRate is the average frame rate as a fraction, e.g. "24000/1001"
+	AvgFrameRate string `json:"avg_frame_rate,omitempty"`
+	// FieldOrder is "progressive", "tt", "bb", "tb" or "bt", or empty when
+	// the container doesn't say
+	FieldOrder     string `json:"field_order,omitempty"`
+	ColorSpace     string `json:"color_space,omitempty"`
+	ColorTransfer  string `json:"color_transfer,omitempty"`
+	ColorPrimaries string `json:"color_primaries,omitempty"`
+	// SideData holds per-stream side data such as HDR mastering metadata
+	SideData      []map[string]interface{} `json:"side_data_list,omitempty"`
+	Channels      int                      `json:"channels,omitempty"`
+	ChannelLayout string                   `json:"channel_layout,omitempty"`
+	BitRate       string                   `json:"bit_rate,omitempty"`
+	Disposition   map[string]int           `json:"disposition,omitempty"`
+	Tags          map[string]string        `json:"tags,omitempty"`
+}
+
+// ProbeFormat describes the container as reported by ffprobe
+type ProbeFormat struct {
+	Filename   string            `json:"filename"`
+	FormatName string            `json:"format_name"`
+	Duration   string            `json:"duration"`
+	Size       string            `json:"size"`
+	BitRate    string            `json:"bit_rate"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+// ProbeResult is the parsed output of ffprobe for a media file
+type ProbeResult struct {
+	Format  ProbeFormat   `json:"format"`
+	Streams []ProbeStream `json:"streams"`
+}
+
+// Probe runs ffprobe against the given file and parses its JSON output
+func Probe(path string) (*ProbeResult, error) {
+	return ProbeContext(context.Background(), path)
+}
+
+// ProbeContext is Probe, killing ffprobe when ctx is done
+func ProbeContext(ctx context.Context, path string) (*ProbeResult, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		path,
+	)
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("ffprobe failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("ffprobe failed: %v", err)
+	}
+
+	var result ProbeResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %v", err)
+	}
+	return &result, nil
+}
+
+// DurationSeconds returns the container duration in seconds, or 0 if unknown
+func (p *ProbeResult) DurationSeconds() float64 {
+	d, _ := strconv.ParseFloat(p.Format.Duration, 64)
+	return d
+}
+
+// VideoFrameRate returns the average frame rate of the first video stream, or
+// 0 if unknown
+func (p *ProbeResult) VideoFrameRate() float64 {
+	for _, s := range p.Streams {
+		if s.CodecType != "video" {
+			continue
+		}
+		num, den, ok := strings.Cut(s.AvgFrameRate, "/")
+		n, _ := strconv.ParseFloat(num, 64)
+		d, _ := strconv.ParseFloat(den, 64)
+		if !ok {
+			d = 1
+		}
+		if n <= 0 || d <= 0 {
+			return 0
+		}
+		return n / d
+	}
+	return 0
+}
+
+// StreamsOfType returns the streams of the given codec type ("video", "audio", "subtitle")
+func (p *ProbeResult) StreamsOfType(codecType string) []ProbeStream {
+	var streams []ProbeStream
+	for _, s := range p.Streams {
+		if s.CodecType == codecType {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
+// HasExtension reports whether path ends in one of the allowed extensions
+func HasExtension(path string, allowed []string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, a := range allowed {
+		if ext == a {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateInput rejects files that are not on the extension allow-list or that
+// ffprobe does not recognise as containing audio or video streams
+func ValidateInput(path string, allowed []string) error {
+	if !HasExtension(path, allowed) {
+		ext := filepath.Ext(path)
+		if ext == "" {
+			ext = "(none)"
+		}
+		return fmt.Errorf("unsupported file extension %s: allowed extensions are %s", ext, strings.Join(allowed, ", "))
+	}
+
+	// Raw disc images can't be probed until they are opened at job start
+	if IsDiscImage(path) {
+		return nil
+	}
+
+	probe, err := Probe(path)
+	if err != nil {
+		return fmt.Errorf("not a recognised media file: %v", err)
+	}
+
+	if len(probe.StreamsOfType("video")) == 0 && len(probe.StreamsOfType("audio")) == 0 {
+		return fmt.Errorf("not a recognised media file: no audio or video streams found")
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package mediaopt
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// terminateGracePeriod is how long a process group gets to exit after SIGTERM
+// before it is killed outright
+const terminateGracePeriod = 5 * time.Second
+
+// trackedProcess is a started command registered in activeProcesses
+type trackedProcess struct {
+	cmd   *exec.Cmd
+	group processGroup
+	// opened is closed once group is set
+	opened chan struct{}
+	done   chan struct{}
+	err    error
+	// cancelled is set once the command's context stopped it
+	cancelled atomic.Bool
+}
+
+// startProcess starts cmd in its own process group tagged with MarkerEnv,
+// registers it under key and reaps it in the background so that callers can
+// wait for exit. A cmd made with exec.CommandContext is stopped with its
+// whole process group when the context is done: SIGTERM first, SIGKILL once
+// the command's WaitDelay, by default the grace period, expires.
+func startProcess(key string, cmd *exec.Cmd) (*trackedProcess, error) {
+	setProcessGroup(cmd)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, MarkerEnv+"="+markerValue())
+
+	p := &trackedProcess{
+		cmd:    cmd,
+		opened: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if cmd.Cancel != nil {
+		// exec only kills the leader, missing the processes it spawned
+		cmd.Cancel = func() error {
+			<-p.opened
+			p.cancelled.Store(true)
+			return p.group.signal(false)
+		}
+		if cmd.WaitDelay == 0 {
+			cmd.WaitDelay = terminateGracePeriod
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p.group = openGroup(cmd)
+	close(p.opened)
+
+	activeProcesses.Lock()
+	activeProcesses.procs[key] = p
+	if activeProcesses.paused && pausable(key) {
+		if err := p.group.suspend(true); err != nil {
+			logError("Failed to pause pid %d: %v", cmd.Process.Pid, err)
+		}
+	}
+	activeProcesses.Unlock()
+
+	go func() {
+		p.err = cmd.Wait()
+		if p.cancelled.Load() {
+			// The leader is gone, by SIGTERM or after WaitDelay by SIGKILL;
+			// whatever it left behind in the group is killed outright
+			if err := p.group.signal(true); err != nil {
+				logDebug("Kill signal failed for pid %d: %v", cmd.Process.Pid, err)
+			}
+		}
+		p.group.close()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// SetPaused stops (SIGSTOP) or continues (SIGCONT) the process groups of
+// running jobs, and their time limits with them. Processes started while
+// paused are stopped right away.
+// Streamed optimizations have a client waiting on them and keep running.
+func SetPaused(pause bool) error {
+	activeProcesses.Lock()
+	defer activeProcesses.Unlock()
+
+	activeProcesses.paused = pause
+	for t := range activeProcesses.timers {
+		if pause {
+			t.pause()
+		} else {
+			t.resume()
+		}
+	}
+	var failed []string
+	for key, p := range activeProcesses.procs {
+		if !pausable(key) {
+			continue
+		}
+		if err := p.group.suspend(pause); err != nil {
+			failed = append(failed, fmt.Sprintf("pid %d: %v", p.cmd.Process.Pid, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to signal %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// pausable reports whether the process registered under key belongs to a job
+func pausable(key string) bool {
+	return !strings.HasPrefix(key, streamKeyPrefix)
+}
+
+// wait blocks until the process has exited and returns its exit error
+func (p *trackedProcess) wait() error {
+	<-p.done
+	return p.err
+}
@@ -0,0 +1,230 @@
+package mediaopt
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// processAlive reports whether pid exists and is not a zombie
+func processAlive(pid int) bool {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesised command name
+	fields := strings.Fields(string(data[strings.LastIndex(string(data), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+// startWithGrandchild starts bash running script under ctx, which must print
+// the PID of the grandchild it spawns, and returns the tracked process and
+// that PID. A positive waitDelay replaces the grace period before SIGKILL.
+func startWithGrandchild(t *testing.T, ctx context.Context, key, script string, waitDelay time.Duration) (*trackedProcess, int) {
+	t.Helper()
+
+	cmd := exec.CommandContext(ctx, "/bin/bash", "-c", script)
+	cmd.WaitDelay = waitDelay
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Failed to create stdout pipe: %v", err)
+	}
+
+	proc, err := startProcess(key, cmd)
+	if err != nil {
+		t.Fatalf("Failed to start bash: %v", err)
+	}
+	t.Cleanup(func() {
+		activeProcesses.Lock()
+		delete(activeProcesses.procs, key)
+		activeProcesses.Unlock()
+	})
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read grandchild pid: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatalf("Invalid grandchild pid %q: %v", line, err)
+	}
+	return proc, pid
+}
+
+func TestCancelReapsGrandchildren(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	proc, grandchild := startWithGrandchild(t, ctx, "grandchild", "sleep 300 & echo $!; wait", 0)
+
+	if !processAlive(grandchild) {
+		t.Fatalf("Grandchild %d should be running before cancelling", grandchild)
+	}
+
+	cancel()
+	proc.wait()
+
+	if processAlive(proc.cmd.Process.Pid) {
+		t.Error("bash should have been terminated")
+	}
+
+	// The grandchild is reparented once bash dies, give the kernel a moment
+	deadline := time.Now().Add(2 * time.Second)
+	for processAlive(grandchild) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if processAlive(grandchild) {
+		t.Errorf("Grandchild %d should have been terminated with the process group", grandchild)
+	}
+}
+
+func TestCancelEscalatesToKill(t *testing.T) {
+	// Both ignore SIGTERM, so only the SIGKILL escalation stops them
+	ctx, cancel := context.WithCancel(context.Background())
+	proc, grandchild := startWithGrandchild(t, ctx, "stubborn", "trap '' TERM; sleep 300 & echo $!; wait", 200*time.Millisecond)
+
+	start := time.Now()
+	cancel()
+	proc.wait()
+
+	if time.Since(start) < 200*time.Millisecond {
+		t.Error("Expected cancelling to wait for the grace period before killing")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for processAlive(grandchild) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if processAlive(grandchild) {
+		t.Errorf("Grandchild %d ignoring SIGTERM should have been killed", grandchild)
+	}
+}
+
+// exitedPid returns the PID of a process that has already exited
+func exitedPid(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Failed to run true: %v", err)
+	}
+	return cmd.Process.Pid
+}
+
+// startMarked starts a long sleep carrying owner as its MarkerEnv value and
+// returns it with a channel closed once it exits
+func startMarked(t *testing.T, owner int) (*exec.Cmd, chan struct{}) {
+	t.Helper()
+	cmd := exec.Command("sleep", "300")
+	cmd.Env = append(os.Environ(), MarkerEnv+"="+strconv.Itoa(owner))
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start marked process: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	t.Cleanup(func() { cmd.Process.Kill() })
+	return cmd, done
+}
+
+func TestSweepOrphans(t *testing.T) {
+	// Simulate an encode left behind by an instance that no longer exists
+	_, done := startMarked(t, exitedPid(t))
+
+	n, err := SweepOrphans()
+	if err != nil {
+		t.Fatalf("Sweep failed: %v", err)
+	}
+	if n < 1 {
+		t.Errorf("Expected at least one orphan, found %d", n)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Orphaned process should have been terminated")
+	}
+}
+
+func TestSweepOrphansSparesLiveInstances(t *testing.T) {
+	// Another server instance still running owns this process
+	owner := exec.Command("sleep", "300")
+	if err := owner.Start(); err != nil {
+		t.Fatalf("Failed to start owner: %v", err)
+	}
+	defer func() {
+		owner.Process.Kill()
+		owner.Wait()
+	}()
+	_, done := startMarked(t, owner.Process.Pid)
+
+	if _, err := SweepOrphans(); err != nil {
+		t.Fatalf("Sweep failed: %v", err)
+	}
+	select {
+	case <-done:
+		t.Error("Process of a live instance should not have been terminated")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// processState returns the state letter from /proc/<pid>/stat, e.g. "T"
+// for a stopped process
+func processState(pid int) string {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return ""
+	}
+	// The state follows the parenthesised command name
+	fields := strings.Fields(string(data[strings.LastIndex(string(data), ")")+1:]))
+	return fields[0]
+}
+
+func TestSetPaused(t *testing.T) {
+	defer SetPaused(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer func() {
+		activeProcesses.Lock()
+		delete(activeProcesses.procs, "pause-test")
+		delete(activeProcesses.procs, "pause-test-late")
+		activeProcesses.Unlock()
+	}()
+
+	cmd := exec.CommandContext(ctx, "sleep", "300")
+	proc, err := startProcess("pause-test", cmd)
+	if err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+
+	waitState := func(pid int, want string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for processState(pid) != want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := processState(pid); got != want {
+			t.Fatalf("Expected process %d in state %s, got %q", pid, want, got)
+		}
+	}
+
+	if err := SetPaused(true); err != nil {
+		t.Fatalf("SetPaused failed: %v", err)
+	}
+	waitState(proc.cmd.Process.Pid, "T")
+
+	// Processes started while paused are stopped straight away
+	late, err := startProcess("pause-test-late", exec.CommandContext(ctx, "sleep", "300"))
+	if err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	waitState(late.cmd.Process.Pid, "T")
+
+	if err := SetPaused(false); err != nil {
+		t.Fatalf("SetPaused failed: %v", err)
+	}
+	waitState(proc.cmd.Process.Pid, "S")
+}
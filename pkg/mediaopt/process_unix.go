@@ -0,0 +1,62 @@
+//go:build !windows
+
+package mediaopt
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// processGroup is the process group a started command leads
+type processGroup struct {
+	pgid int
+}
+
+// setProcessGroup makes the command the leader of a new process group
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// openGroup returns the process group of a command started with
+// setProcessGroup
+func openGroup(cmd *exec.Cmd) processGroup {
+	return processGroup{pgid: cmd.Process.Pid}
+}
+
+// signal sends SIGTERM, or SIGKILL when kill is set, to the process group.
+// The group outlives its leader, so grandchildren such as ffmpeg spawned by
+// bash are reached after the leader exits.
+func (g processGroup) signal(kill bool) error {
+	sig := syscall.SIGTERM
+	if kill {
+		sig = syscall.SIGKILL
+	}
+	err := syscall.Kill(-g.pgid, sig)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	if err == nil && !kill {
+		// A paused group can only act on SIGTERM once it runs again
+		syscall.Kill(-g.pgid, syscall.SIGCONT)
+	}
+	return err
+}
+
+// suspend stops the process group, or continues it when stop is false
+func (g processGroup) suspend(stop bool) error {
+	sig := syscall.SIGCONT
+	if stop {
+		sig = syscall.SIGSTOP
+	}
+	err := syscall.Kill(-g.pgid, sig)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
+
+// close releases the group once its processes are gone
+func (g processGroup) close() {}
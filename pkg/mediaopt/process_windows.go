@@ -0,0 +1,96 @@
+//go:build windows
+
+package mediaopt
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	procCreateJobObject          = kernel32.NewProc("CreateJobObjectW")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = kernel32.NewProc("TerminateJobObject")
+)
+
+// processSetQuota is the access right AssignProcessToJobObject requires
+// besides PROCESS_TERMINATE
+const processSetQuota = 0x0100
+
+// processGroup holds a started command and the processes it creates in a job
+// object. Unlike taskkill /T, which follows parent process IDs, terminating
+// the job reaches children whose parent has already exited.
+type processGroup struct {
+	pid int
+	// job is zero when the job object couldn't be set up, leaving taskkill
+	job syscall.Handle
+}
+
+// setProcessGroup starts the command in a new process group
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// openGroup assigns the started command to a new job object, which the
+// processes it creates from then on join as well
+func openGroup(cmd *exec.Cmd) processGroup {
+	g := processGroup{pid: cmd.Process.Pid}
+	job, err := assignJob(g.pid)
+	if err != nil {
+		logError("Failed to track the children of pid %d: %v", g.pid, err)
+		return g
+	}
+	g.job = job
+	return g
+}
+
+// assignJob creates a job object holding the process pid
+func assignJob(pid int) (syscall.Handle, error) {
+	job, _, err := procCreateJobObject.Call(0, 0)
+	if job == 0 {
+		return 0, fmt.Errorf("failed to create job object: %v", err)
+	}
+	process, err := syscall.OpenProcess(processSetQuota|syscall.PROCESS_TERMINATE, false, uint32(pid))
+	if err != nil {
+		syscall.CloseHandle(syscall.Handle(job))
+		return 0, fmt.Errorf("failed to open process: %v", err)
+	}
+	defer syscall.CloseHandle(process)
+	if r, _, err := procAssignProcessToJobObject.Call(job, uintptr(process)); r == 0 {
+		syscall.CloseHandle(syscall.Handle(job))
+		return 0, fmt.Errorf("failed to assign job object: %v", err)
+	}
+	return syscall.Handle(job), nil
+}
+
+// signal terminates the command and its child processes. Windows has no
+// graceful equivalent of SIGTERM for console processes, so the tree is always
+// killed.
+func (g processGroup) signal(kill bool) error {
+	if g.job == 0 {
+		return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(g.pid)).Run()
+	}
+	if r, _, err := procTerminateJobObject.Call(uintptr(g.job), 1); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// suspend is not supported: Windows has no equivalent of SIGSTOP for a
+// process tree
+func (g processGroup) suspend(stop bool) error {
+	return fmt.Errorf("pausing processes is not supported on Windows")
+}
+
+// close releases the job object once its processes are gone
+func (g processGroup) close() {
+	if g.job != 0 {
+		syscall.CloseHandle(g.job)
+	}
+}
@@ -0,0 +1,107 @@
+package mediaopt
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProgressDetail is the state of a running encode as reported by ffmpeg
+type ProgressDetail struct {
+	// Percent is the share of the input's duration encoded, 0-100
+	Percent float64
+	// Frame is the number of frames written so far
+	Frame int64
+	// FPS is the current encode rate in frames per second
+	FPS float64
+	// Speed is the encode rate relative to playback, e.g. 2.5 for 2.5x
+	Speed float64
+	// Elapsed is the time since the encode started
+	Elapsed time.Duration
+	// Remaining estimates the time until the encode finishes, zero when
+	// unknown
+	Remaining time.Duration
+}
+
+// DetailCallback receives each progress report of an encode
+type DetailCallback func(ProgressDetail)
+
+// progressParser reads the key=value blocks ffmpeg writes with -progress,
+// each ending in a progress= line, along with the total_duration= line of
+// the optimization script.
+//
+// Some encoders write no timestamps for a while: libvpx holds back frames to
+// look ahead before its first packet and writes none at all in the first
+// pass of a two-pass encode. Blocks without a valid out_time then take the
+// position from the frame count when the frame rate is known, and the
+// position never moves back when the timestamps catch up.
+type progressParser struct {
+	start     time.Time
+	duration  float64 // of the input in seconds, zero when unknown
+	frameRate float64 // of the input, zero when unknown
+	outTime   float64 // seconds of the input encoded
+	timed     bool    // whether the current block had a valid out_time
+	position  float64 // seconds of the input reported so far
+	detail    ProgressDetail
+}
+
+func newProgressParser(start time.Time) *progressParser {
+	return &progressParser{start: start}
+}
+
+// line parses one line of output and returns the detail when it completes
+// a block that can be reported
+func (p *progressParser) line(text string, now time.Time) (ProgressDetail, bool) {
+	key, value, ok := strings.Cut(strings.TrimSpace(text), "=")
+	if !ok {
+		return ProgressDetail{}, false
+	}
+	value = strings.TrimSpace(value)
+	switch key {
+	case "total_duration":
+		p.duration, _ = strconv.ParseFloat(value, 64)
+	case "frame":
+		p.detail.Frame, _ = strconv.ParseInt(value, 10, 64)
+	case "fps":
+		p.detail.FPS, _ = strconv.ParseFloat(value, 64)
+	case "speed":
+		// "N/A" until the first frames are written
+		p.detail.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+	case "out_time_us", "out_time_ms":
+		// Both are in microseconds; "N/A" before the first packet
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+			p.outTime = float64(us) / 1e6
+			p.timed = true
+		}
+	case "progress":
+		timed := p.timed
+		p.timed = false
+		if p.duration <= 0 {
+			return ProgressDetail{}, false
+		}
+		return p.report(now, timed), true
+	}
+	return ProgressDetail{}, false
+}
+
+// report fills in the derived fields of the current block, timed when it had
+// a valid out_time
+func (p *progressParser) report(now time.Time, timed bool) ProgressDetail {
+	d := p.detail
+	position := p.outTime
+	if !timed && p.frameRate > 0 {
+		position = max(position, float64(d.Frame)/p.frameRate)
+	}
+	p.position = max(p.position, position)
+	d.Elapsed = now.Sub(p.start)
+	d.Percent = min(max(p.position/p.duration*100, 0), 100)
+	left := max(p.duration-p.position, 0)
+	switch {
+	case d.Speed > 0:
+		d.Remaining = time.Duration(left / d.Speed * float64(time.Second))
+	case d.Percent > 0:
+		// Extrapolate from the rate so far
+		d.Remaining = time.Duration(float64(d.Elapsed) * (100 - d.Percent) / d.Percent)
+	}
+	return d
+}
@@ -0,0 +1,91 @@
+package mediaopt
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// Supported quality metrics
+const (
+	MetricSSIM = "ssim"
+	MetricVMAF = "vmaf"
+)
+
+var (
+	ssimPattern = regexp.MustCompile(`SSIM .*All:([0-9.]+)`)
+	vmafPattern = regexp.MustCompile(`VMAF score: ([0-9.]+)`)
+)
+
+// QualityCheck configures the optional post-encode verification step
+type QualityCheck struct {
+	// Metric is MetricSSIM (0-1) or MetricVMAF (0-100)
+	Metric string
+	// Threshold is the minimum acceptable score
+	Threshold float64
+	// FailBelow fails the job instead of only flagging it
+	FailBelow bool
+}
+
+// QualityResult is the outcome of a quality verification
+type QualityResult struct {
+	Metric    string
+	Score     float64
+	Threshold float64
+	Passed    bool
+}
+
+// MeasureQuality compares the distorted (optimized) video against the
+// reference (source) using ffmpeg's ssim or libvmaf filter
+func MeasureQuality(reference, distorted, metric string) (float64, error) {
+	return measureQuality([]string{"-i", reference}, distorted, metric)
+}
+
+// measureQuality compares distorted against the reference opened with the
+// given input options, which may select a segment of a longer file
+func measureQuality(referenceInput []string, distorted, metric string) (float64, error) {
+	var filter string
+	var pattern *regexp.Regexp
+	switch metric {
+	case MetricSSIM:
+		filter, pattern = "[0:v][1:v]ssim", ssimPattern
+	case MetricVMAF:
+		filter, pattern = "[0:v][1:v]libvmaf", vmafPattern
+	default:
+		return 0, fmt.Errorf("unknown quality metric: %s", metric)
+	}
+
+	args := []string{"-hide_banner", "-nostats", "-i", distorted}
+	args = append(args, referenceInput...)
+	args = append(args, "-lavfi", filter, "-f", "null", "-")
+	cmd := exec.Command("ffmpeg", args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("%s measurement failed: %v", metric, err)
+	}
+
+	m := pattern.FindSubmatch(output)
+	if m == nil {
+		return 0, fmt.Errorf("no %s score in ffmpeg output", metric)
+	}
+	return strconv.ParseFloat(string(m[1]), 64)
+}
+
+// verifyQuality runs the configured check and reports whether the output passed
+func verifyQuality(check *QualityCheck, reference, distorted string) (*QualityResult, error) {
+	logInfo("Measuring %s between %s and %s", check.Metric, reference, distorted)
+	score, err := MeasureQuality(reference, distorted, check.Metric)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &QualityResult{
+		Metric:    check.Metric,
+		Score:     score,
+		Threshold: check.Threshold,
+		Passed:    score >= check.Threshold,
+	}
+	logInfo("Quality %s score %.4f (threshold %.4f)", check.Metric, score, check.Threshold)
+	return result, nil
+}
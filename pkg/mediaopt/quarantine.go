@@ -0,0 +1,40 @@
+package mediaopt
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrRejected marks optimizations whose output failed verification and was
+// kept at OptimizationResult.Rejected for review rather than deleted
+var ErrRejected = errors.New("output rejected")
+
+// QuarantineCheck keeps outputs that fail verification for review. Besides
+// the integrity and quality checks, the output's duration is compared with
+// the source's, which catches truncated or stretched outputs even without
+// an integrity check.
+type QuarantineCheck struct {
+	// MaxDurationChange is the largest accepted difference between the
+	// source and output durations, as a fraction of the source's, e.g. 0.05;
+	// zero skips the comparison
+	MaxDurationChange float64
+}
+
+// checkDuration rejects an output whose duration differs from the source's
+// by more than the check allows
+func (c *QuarantineCheck) checkDuration(source *ProbeResult, outputFile string) error {
+	srcDuration := source.DurationSeconds()
+	if c.MaxDurationChange <= 0 || srcDuration <= 0 {
+		return nil
+	}
+	output, err := Probe(outputFile)
+	if err != nil {
+		return fmt.Errorf("output cannot be probed: %v", err)
+	}
+	outDuration := output.DurationSeconds()
+	if change := math.Abs(outDuration-srcDuration) / srcDuration; change > c.MaxDurationChange {
+		return fmt.Errorf("output duration %.2fs differs from source %.2fs by %.1f%%", outDuration, srcDuration, change*100)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package mediaopt
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// remuxContainers maps remux target extensions to their ffmpeg muxer
+var remuxContainers = map[string]string{
+	"mp4": "mp4",
+	"m4v": "mp4",
+	"mov": "mov",
+	"mkv": "matroska",
+}
+
+// textSubtitleCodecs can be converted to mov_text for MP4/MOV outputs
+var textSubtitleCodecs = map[string]bool{
+	"subrip": true, "srt": true, "ass": true, "ssa": true,
+	"webvtt": true, "text": true, "mov_text": true,
+}
+
+// NewRemuxParams creates parameters that copy every stream of inputFile into
+// the container given by ext (e.g. "mp4" or "mkv") without re-encoding
+func NewRemuxParams(inputFile, ext string) (*OptimizationParams, error) {
+	ext = strings.TrimPrefix(strings.ToLower(ext), ".")
+	if _, ok := remuxContainers[ext]; !ok {
+		return nil, fmt.Errorf("unsupported remux container: %s", ext)
+	}
+	if IsDiscImage(inputFile) {
+		return nil, fmt.Errorf("disc images cannot be remuxed: %s", inputFile)
+	}
+
+	params := NewDefaultParams(inputFile)
+	base := strings.TrimSuffix(inputFile, filepath.Ext(inputFile))
+	params.OutputFile = base + "_optimized." + ext
+	params.Remux = true
+	return params, nil
+}
+
+// BuildRemuxPlan copies every stream into container. Streams the container
+// cannot hold are dropped, except text subtitles which are converted to the
+// container's native subtitle format.
+func BuildRemuxPlan(probe *ProbeResult, container string) *Plan {
+	plan := &Plan{Container: container}
+	mp4Family := container == "mp4" || container == "mov"
+
+	for _, s := range probe.Streams {
+		m := StreamMapping{
+			InputIndex:  s.Index,
+			Type:        s.CodecType,
+			Language:    s.Tags["language"],
+			Title:       s.Tags["title"],
+			SourceCodec: s.CodecName,
+			TargetCodec: s.CodecName,
+			Action:      ActionCopy,
+			Disposition: sourceDisposition(s),
+		}
+		hdrInfo(&m, s)
+
+		switch {
+		case s.CodecType == "video" || s.CodecType == "audio":
+			if s.CodecType == "video" && plan.VideoCodec == "" {
+				plan.VideoCodec = s.CodecName
+			}
+		case s.CodecType == "subtitle" && mp4Family && textSubtitleCodecs[s.CodecName]:
+			if s.CodecName != "mov_text" {
+				m.Action = ActionTranscode
+				m.TargetCodec = "mov_text"
+			}
+		case s.CodecType == "subtitle" && mp4Family:
+			m.Action = ActionDrop
+			m.Reason = fmt.Sprintf("%s subtitles cannot be stored in %s", s.CodecName, container)
+		case s.CodecType == "subtitle" && s.CodecName == "mov_text":
+			m.Action = ActionTranscode
+			m.TargetCodec = "srt"
+		case s.CodecType == "subtitle":
+		case s.CodecType == "attachment" && !mp4Family:
+		default:
+			m.Action = ActionDrop
+			m.Reason = fmt.Sprintf("%s streams cannot be remuxed into %s", s.CodecType, container)
+		}
+
+		if m.Action == ActionDrop {
+			m.TargetCodec = ""
+		}
+		plan.Streams = append(plan.Streams, m)
+	}
+	return plan
+}
+
+// remuxContainer returns the muxer for the output file of a remux
+func remuxContainer(outputFile string) (string, error) {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(outputFile)), ".")
+	container, ok := remuxContainers[ext]
+	if !ok {
+		return "", fmt.Errorf("unsupported remux container: %s", ext)
+	}
+	return container, nil
+}
@@ -0,0 +1,211 @@
+package mediaopt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Sample clip defaults
+const (
+	DefaultSampleClips   = 3
+	DefaultSampleSeconds = 60.0
+	// MaxSampleClips and MaxSampleSeconds bound the encode time a single
+	// request can cause
+	MaxSampleClips   = 10
+	MaxSampleSeconds = 600.0
+)
+
+// SampleOptions selects the clips encoded by EncodeSamples
+type SampleOptions struct {
+	// Clips is the number of clips, spread evenly over the input
+	Clips int
+	// Seconds is the length of each clip
+	Seconds float64
+	// OutputDir receives the clips; its previous contents are replaced
+	OutputDir string
+	// Quality scores each clip against the same part of the source when set
+	Quality *QualityCheck
+}
+
+// SampleClip is one encoded sample
+type SampleClip struct {
+	Path     string  `json:"path"`
+	Start    float64 `json:"start"`
+	Duration float64 `json:"duration"`
+	Size     int64   `json:"size"`
+	// EncodeSpeed is the clip duration divided by the encode time
+	EncodeSpeed float64 `json:"encodeSpeed"`
+	// Score is the quality metric of the clip when a check was requested
+	Score float64 `json:"score,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+// SampleReport describes the clips encoded from one input
+type SampleReport struct {
+	InputFile string       `json:"inputFile"`
+	Plan      *Plan        `json:"plan"`
+	Summary   string       `json:"summary"`
+	Duration  float64      `json:"duration"`
+	InputSize int64        `json:"inputSize"`
+	Metric    string       `json:"metric,omitempty"`
+	Clips     []SampleClip `json:"clips"`
+	// EstimatedSize extrapolates the clips' size to the whole input
+	EstimatedSize int64 `json:"estimatedSize"`
+}
+
+// EncodeSamples encodes short clips from several points of the input with
+// the optimization plan of params, so the settings can be compared on real
+// content before optimizing a library. Two-pass plans are sampled in a
+// single pass at their target bitrate.
+func EncodeSamples(params *OptimizationParams, opts SampleOptions) (*SampleReport, error) {
+	if opts.Clips <= 0 {
+		opts.Clips = DefaultSampleClips
+	}
+	if opts.Seconds <= 0 {
+		opts.Seconds = DefaultSampleSeconds
+	}
+	if opts.Clips > MaxSampleClips || opts.Seconds > MaxSampleSeconds {
+		return nil, fmt.Errorf("at most %d sample clips of %.0f seconds can be encoded", MaxSampleClips, MaxSampleSeconds)
+	}
+
+	info, err := os.Stat(params.InputFile)
+	if err != nil {
+		return nil, fmt.Errorf("input file does not exist: %s", params.InputFile)
+	}
+
+	input := params.InputFile
+	if IsDiscImage(params.InputFile) {
+		disc, err := OpenDiscImage(params.InputFile, params.TempDir)
+		if err != nil {
+			return nil, err
+		}
+		defer disc.Close()
+		input = disc.Input
+	}
+
+	probe, err := Probe(input)
+	if err != nil {
+		return nil, err
+	}
+	duration := probe.DurationSeconds()
+	if duration <= 0 {
+		return nil, fmt.Errorf("unknown duration, cannot sample %s", params.InputFile)
+	}
+
+	plan, err := buildPlan(params, probe)
+	if err != nil {
+		return nil, err
+	}
+	analyzeCrop(params, input, probe, plan)
+	analyzeInterlace(params, input, probe, plan)
+	analyzeComplexity(params, input, probe, plan)
+	releaseGPU := plan.assignGPU(params.GPUs)
+	defer releaseGPU()
+
+	if err := os.RemoveAll(opts.OutputDir); err != nil {
+		return nil, fmt.Errorf("failed to clear %s: %v", opts.OutputDir, err)
+	}
+	if err := os.MkdirAll(opts.OutputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", opts.OutputDir, err)
+	}
+
+	report := &SampleReport{
+		InputFile: params.InputFile,
+		Plan:      plan,
+		Summary:   plan.Summary(),
+		Duration:  duration,
+		InputSize: info.Size(),
+	}
+	if opts.Quality != nil {
+		report.Metric = opts.Quality.Metric
+	}
+
+	var sampled float64
+	var sampledSize int64
+	for i, start := range sampleStarts(duration, opts.Clips, opts.Seconds) {
+		if err := params.context().Err(); err != nil {
+			return nil, err
+		}
+		length := min(opts.Seconds, duration-start)
+		clip := SampleClip{
+			Path:     filepath.Join(opts.OutputDir, fmt.Sprintf("sample%d_%ds.%s", i+1, int(start), plan.Container)),
+			Start:    start,
+			Duration: length,
+		}
+		if err := encodeClip(params.context(), input, plan, params.Priority, &clip); err != nil {
+			logError("Sample encode failed for %s at %.0fs: %v", params.InputFile, start, err)
+			clip.Error = err.Error()
+			report.Clips = append(report.Clips, clip)
+			continue
+		}
+		sampled += clip.Duration
+		sampledSize += clip.Size
+
+		if opts.Quality != nil {
+			reference := []string{"-ss", formatSeconds(start), "-t", formatSeconds(length), "-i", input}
+			if clip.Score, err = measureQuality(reference, clip.Path, opts.Quality.Metric); err != nil {
+				clip.Error = err.Error()
+			}
+		}
+		report.Clips = append(report.Clips, clip)
+	}
+
+	if sampled == 0 {
+		return nil, fmt.Errorf("every sample encode failed: %s", report.Clips[0].Error)
+	}
+	report.EstimatedSize = int64(float64(sampledSize) * duration / sampled)
+	return report, nil
+}
+
+// sampleStarts spreads count clips of the given length evenly over the
+// duration, centring each on its point. An input too short for separate
+// clips is sampled once from the start.
+func sampleStarts(duration float64, count int, length float64) []float64 {
+	if duration <= float64(count)*length {
+		return []float64{0}
+	}
+	starts := make([]float64, count)
+	for i := range starts {
+		center := duration * float64(i+1) / float64(count+1)
+		starts[i] = min(max(center-length/2, 0), duration-length)
+	}
+	return starts
+}
+
+// encodeClip encodes one clip with the plan and records its size and speed
+func encodeClip(ctx context.Context, input string, plan *Plan, priority *Priority, clip *SampleClip) error {
+	args := []string{
+		"-v", "error", "-y",
+		"-ss", formatSeconds(clip.Start),
+		"-t", formatSeconds(clip.Duration),
+		"-i", input,
+	}
+	args = append(args, plan.OutputArgs()...)
+	args = append(args, clip.Path)
+
+	began := time.Now()
+	if output, err := priority.command(ctx, "ffmpeg", args...).CombinedOutput(); err != nil {
+		os.Remove(clip.Path)
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	elapsed := time.Since(began).Seconds()
+
+	info, err := os.Stat(clip.Path)
+	if err != nil {
+		return fmt.Errorf("sample output missing: %v", err)
+	}
+	clip.Size = info.Size()
+	if elapsed > 0 {
+		clip.EncodeSpeed = clip.Duration / elapsed
+	}
+	return nil
+}
+
+// formatSeconds formats a position for ffmpeg's -ss and -t options
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
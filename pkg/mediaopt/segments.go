@@ -0,0 +1,150 @@
+package mediaopt
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Segment kinds
+const (
+	SegmentBlack  = "black"
+	SegmentSilent = "silent"
+)
+
+const (
+	// DefaultSegmentMinDuration is the shortest black or silent stretch reported
+	DefaultSegmentMinDuration = 2.0
+	// blackPixelThreshold is the luma ratio below which a pixel counts as black
+	blackPixelThreshold = 0.10
+	// silenceNoise is the level below which audio counts as silent
+	silenceNoise = "-50dB"
+)
+
+var (
+	blackPattern        = regexp.MustCompile(`black_start:\s*([0-9.]+)\s+black_end:\s*([0-9.]+)`)
+	silenceStartPattern = regexp.MustCompile(`silence_start:\s*(-?[0-9.]+)`)
+	silenceEndPattern   = regexp.MustCompile(`silence_end:\s*([0-9.]+)`)
+)
+
+// Segment is a stretch of black video or silent audio
+type Segment struct {
+	Kind     string  `json:"kind"`
+	Start    float64 `json:"start"`
+	End      float64 `json:"end"`
+	Duration float64 `json:"duration"`
+}
+
+// SegmentReport lists the black and silent segments of a source
+type SegmentReport struct {
+	Segments []Segment `json:"segments"`
+	// Longest is the duration of the longest segment in seconds
+	Longest float64 `json:"longest"`
+}
+
+// DetectSegments decodes the whole input once, running blackdetect on the
+// first video stream and silencedetect on the first audio stream, and returns
+// every segment lasting at least minDuration seconds
+func DetectSegments(path string, probe *ProbeResult, minDuration float64) (*SegmentReport, error) {
+	if minDuration <= 0 {
+		minDuration = DefaultSegmentMinDuration
+	}
+	d := strconv.FormatFloat(minDuration, 'f', 2, 64)
+
+	args := []string{"-hide_banner", "-nostats", "-i", path}
+	hasVideo := len(probe.StreamsOfType("video")) > 0
+	hasAudio := len(probe.StreamsOfType("audio")) > 0
+	if !hasVideo && !hasAudio {
+		return nil, fmt.Errorf("no audio or video to analyse")
+	}
+	if hasVideo {
+		args = append(args, "-map", "0:v:0", "-vf",
+			fmt.Sprintf("blackdetect=d=%s:pix_th=%.2f", d, blackPixelThreshold))
+	}
+	if hasAudio {
+		args = append(args, "-map", "0:a:0", "-af",
+			fmt.Sprintf("silencedetect=n=%s:d=%s", silenceNoise, d))
+	}
+	args = append(args, "-f", "null", "-")
+
+	output, err := exec.Command("ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("segment detection failed: %v", err)
+	}
+	return parseSegments(string(output), probe.DurationSeconds()), nil
+}
+
+// parseSegments extracts blackdetect and silencedetect results from ffmpeg's
+// log. Silence still running at the end of the input is closed at duration.
+func parseSegments(log string, duration float64) *SegmentReport {
+	report := &SegmentReport{Segments: []Segment{}}
+	add := func(kind string, start, end float64) {
+		report.Segments = append(report.Segments, Segment{Kind: kind, Start: start, End: end, Duration: end - start})
+	}
+
+	for _, m := range blackPattern.FindAllStringSubmatch(log, -1) {
+		start, _ := strconv.ParseFloat(m[1], 64)
+		end, _ := strconv.ParseFloat(m[2], 64)
+		add(SegmentBlack, start, end)
+	}
+
+	starts := silenceStartPattern.FindAllStringSubmatch(log, -1)
+	ends := silenceEndPattern.FindAllStringSubmatch(log, -1)
+	for i, m := range starts {
+		start, _ := strconv.ParseFloat(m[1], 64)
+		if start < 0 {
+			start = 0
+		}
+		end := duration
+		if i < len(ends) {
+			end, _ = strconv.ParseFloat(ends[i][1], 64)
+		}
+		if end > start {
+			add(SegmentSilent, start, end)
+		}
+	}
+
+	sort.Slice(report.Segments, func(i, j int) bool {
+		return report.Segments[i].Start < report.Segments[j].Start
+	})
+	for _, s := range report.Segments {
+		if s.Duration > report.Longest {
+			report.Longest = s.Duration
+		}
+	}
+	return report
+}
+
+// Summary describes the report in a single line for warnings and logs
+func (r *SegmentReport) Summary() string {
+	var black, silent int
+	for _, s := range r.Segments {
+		if s.Kind == SegmentBlack {
+			black++
+		} else {
+			silent++
+		}
+	}
+	return fmt.Sprintf("%d black and %d silent segment(s), longest %.1fs", black, silent, r.Longest)
+}
+
+// analyzeSegments runs segment detection when requested. Failures are logged
+// and never fail the job.
+func analyzeSegments(params *OptimizationParams, input string, probe *ProbeResult, plan *Plan) *SegmentReport {
+	if params.DetectSegments <= 0 {
+		return nil
+	}
+
+	report, err := DetectSegments(input, probe, params.DetectSegments)
+	if err != nil {
+		logError("Black/silent segment detection failed for %s: %v", params.InputFile, err)
+		return nil
+	}
+	if len(report.Segments) > 0 {
+		plan.Warnings = append(plan.Warnings, "source has "+report.Summary())
+		logInfo("%s: %s", params.InputFile, report.Summary())
+	}
+	return report
+}
@@ -0,0 +1,79 @@
+package mediaopt
+
+import "sync"
+
+// Stages of OptimizeMedia, reported through OnStage
+const (
+	StageProbe     = "probe"
+	StageAnalyze   = "analyze"
+	StageFirstPass = "firstpass"
+	StageEncode    = "encode"
+	StageVerify    = "verify"
+)
+
+// StageCallback is told the name of each stage as it begins
+type StageCallback func(stage string)
+
+// Stage is a step of a pipeline. Its weight sets its share of the overall
+// progress relative to the other stages.
+type Stage struct {
+	Name   string
+	Weight float64
+}
+
+// Pipeline turns the progress of each stage into the overall progress of a
+// sequence of stages
+type Pipeline struct {
+	mu     sync.Mutex
+	stages []Stage
+	total  float64
+	report func(stage string, progress float64)
+}
+
+// NewPipeline creates a pipeline of the stages, reporting the current stage
+// and the overall progress (0-100) to report. Reports are serialized.
+func NewPipeline(report func(stage string, progress float64), stages ...Stage) *Pipeline {
+	p := &Pipeline{stages: stages, report: report}
+	for _, s := range stages {
+		p.total += s.Weight
+	}
+	return p
+}
+
+// Start reports the beginning of the named stage
+func (p *Pipeline) Start(name string) {
+	p.Update(name, 0)
+}
+
+// Progress returns a callback reporting the progress (0-100) of the named
+// stage
+func (p *Pipeline) Progress(name string) ProgressCallback {
+	return func(progress float64) {
+		p.Update(name, progress)
+	}
+}
+
+// Update reports the progress (0-100) of the named stage. Stages that aren't
+// part of the pipeline are ignored.
+func (p *Pipeline) Update(name string, progress float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if overall, ok := p.overall(name, progress); ok && p.report != nil {
+		p.report(name, overall)
+	}
+}
+
+func (p *Pipeline) overall(name string, progress float64) (float64, bool) {
+	if p.total <= 0 {
+		return 0, false
+	}
+	progress = min(max(progress, 0), 100)
+	var done float64
+	for _, s := range p.stages {
+		if s.Name == name {
+			return (done + s.Weight*progress/100) / p.total * 100, true
+		}
+		done += s.Weight
+	}
+	return 0, false
+}
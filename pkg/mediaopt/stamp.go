@@ -0,0 +1,41 @@
+package mediaopt
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// StampTag is the container tag holding an output's stamp
+const StampTag = "MEDIA_OPTIMIZER"
+
+// Stamp records in an output's container metadata what produced it, so
+// processed files are recognised without the job history
+type Stamp struct {
+	// Version is the version of the optimizer that wrote the output
+	Version string `json:"version"`
+	Profile string `json:"profile,omitempty"`
+	JobID   string `json:"jobId,omitempty"`
+}
+
+// args returns the ffmpeg options writing the stamp
+func (s *Stamp) args() []string {
+	data, _ := json.Marshal(s)
+	return []string{"-metadata", StampTag + "=" + string(data)}
+}
+
+// ReadStamp returns the stamp of a probed file, nil when the optimizer
+// didn't write it. Tag names are matched in any case, as containers store
+// them differently.
+func ReadStamp(probe *ProbeResult) *Stamp {
+	for key, value := range probe.Format.Tags {
+		if !strings.EqualFold(key, StampTag) {
+			continue
+		}
+		var s Stamp
+		if err := json.Unmarshal([]byte(value), &s); err != nil || s.Version == "" {
+			return nil
+		}
+		return &s
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package mediaopt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stderrTailSize bounds how much ffmpeg stderr is kept for error reporting
+const stderrTailSize = 4096
+
+// streamKeyPrefix marks streamed optimizations in activeProcesses
+const streamKeyPrefix = "stream:"
+
+// StreamOptimize reads media from r, optimizes it with ffmpeg reading pipe:0
+// and writing pipe:1, and writes the result to w. Data flows through OS pipes
+// only, so a slow reader on w stalls ffmpeg which in turn stops consuming r.
+// Cancelling ctx terminates the ffmpeg process group. priority may be nil.
+func StreamOptimize(ctx context.Context, r io.Reader, w io.Writer, priority *Priority) error {
+	// The input can't be probed ahead of time, so the default plan is used
+	// with a fragmented MP4 that needs no seeking on the output
+	plan := &Plan{
+		Container:   TargetContainer,
+		AudioFilter: "volume=1.2",
+		Fragmented:  true,
+		Threads:     priority.threads(),
+	}
+
+	args := append([]string{"-hide_banner", "-nostats", "-loglevel", "error", "-i", "pipe:0"}, plan.OutputArgs()...)
+	args = append(args, "pipe:1")
+
+	cmd := priority.command(ctx, "ffmpeg", args...)
+	cmd.Stdin = r
+	cmd.Stdout = w
+	stderr := &tailBuffer{limit: stderrTailSize}
+	cmd.Stderr = stderr
+	// Don't let a stalled body read keep Wait blocked after ffmpeg exits
+	cmd.WaitDelay = terminateGracePeriod
+
+	key := fmt.Sprintf("%s%d", streamKeyPrefix, time.Now().UnixNano())
+	proc, err := startProcess(key, cmd)
+	if err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+	defer func() {
+		activeProcesses.Lock()
+		delete(activeProcesses.procs, key)
+		activeProcesses.Unlock()
+	}()
+
+	logInfo("Streaming optimization started (%s)", key)
+	err = proc.wait()
+	if ctx.Err() != nil {
+		logInfo("Streaming optimization cancelled (%s): %v", key, ctx.Err())
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// tailBuffer is an io.Writer keeping only the last limit bytes written
+type tailBuffer struct {
+	mu    sync.Mutex
+	limit int
+	buf   []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.limit {
+		t.buf = t.buf[len(t.buf)-t.limit:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return string(t.buf)
+}
@@ -0,0 +1,90 @@
+package mediaopt
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrTimedOut marks optimizations killed for running longer than their
+// Timeout allows, such as one whose ffmpeg hung
+var ErrTimedOut = errors.New("timed out")
+
+// Timeout bounds how long an optimization may run once its input is probed
+type Timeout struct {
+	// Max is the time allowed; zero derives it from the input's duration
+	Max time.Duration
+	// Factor derives the time allowed as this multiple of the input's
+	// duration; zero allows any time when Max is unset
+	Factor float64
+	// Min is the least derived time, leaving short inputs enough for the
+	// analysis and the encoder's startup
+	Min time.Duration
+}
+
+// limit returns the time allowed for an input lasting duration seconds, zero
+// for no limit. Inputs of unknown duration only get Max.
+func (t *Timeout) limit(duration float64) time.Duration {
+	switch {
+	case t == nil:
+		return 0
+	case t.Max > 0:
+		return t.Max
+	case t.Factor <= 0 || duration <= 0:
+		return 0
+	}
+	return max(time.Duration(duration*t.Factor*float64(time.Second)), t.Min)
+}
+
+// pausableTimer calls fire once its time has passed while jobs weren't
+// paused by SetPaused, so a job held outside the schedule windows or for
+// someone streaming doesn't use up its time limit. Its fields are guarded by
+// activeProcesses.
+type pausableTimer struct {
+	fire      func()
+	remaining time.Duration
+	// timer is nil while paused
+	timer *time.Timer
+	armed time.Time
+}
+
+// withTimeLimit returns a copy of parent cancelled with cause once limit
+// has passed outside of pauses
+func withTimeLimit(parent context.Context, limit time.Duration, cause error) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	t := &pausableTimer{remaining: limit, fire: func() { cancel(cause) }}
+	activeProcesses.Lock()
+	activeProcesses.timers[t] = struct{}{}
+	if !activeProcesses.paused {
+		t.resume()
+	}
+	activeProcesses.Unlock()
+	return ctx, func() {
+		activeProcesses.Lock()
+		t.pause()
+		delete(activeProcesses.timers, t)
+		activeProcesses.Unlock()
+		cancel(nil)
+	}
+}
+
+// pause stops the timer, keeping the time left. The caller holds
+// activeProcesses.
+func (t *pausableTimer) pause() {
+	if t.timer == nil {
+		return
+	}
+	t.timer.Stop()
+	t.timer = nil
+	t.remaining -= time.Since(t.armed)
+}
+
+// resume runs the timer for the time left. The caller holds
+// activeProcesses.
+func (t *pausableTimer) resume() {
+	if t.timer != nil {
+		return
+	}
+	t.armed = time.Now()
+	t.timer = time.AfterFunc(max(t.remaining, 0), t.fire)
+}
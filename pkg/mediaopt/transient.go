@@ -0,0 +1,50 @@
+package mediaopt
+
+import (
+	"errors"
+	"regexp"
+	"sync"
+)
+
+// ErrTransient marks failures caused by the state of the machine rather than
+// the input, such as exhausted GPU encoder sessions or a read error, which
+// may not happen again when the job is rerun
+var ErrTransient = errors.New("transient failure")
+
+// transientOutput matches encoder output of transient failures
+var transientOutput = regexp.MustCompile(`(?i)` +
+	// NVENC sessions taken by other processes or the driver out of memory
+	`OpenEncodeSessionEx failed|no capable devices found|CUDA_ERROR_OUT_OF_MEMORY|` +
+	`Cannot allocate memory|` +
+	`Input/output error|Stale file handle|Resource temporarily unavailable|` +
+	`Connection (reset|refused|timed out)`)
+
+// stderrTailLines is the number of stderr lines kept to classify a failure
+const stderrTailLines = 50
+
+// outputTail keeps the last lines written by a process
+type outputTail struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (t *outputTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.lines) == stderrTailLines {
+		t.lines = t.lines[1:]
+	}
+	t.lines = append(t.lines, line)
+}
+
+// transientLine returns the last line reporting a transient failure
+func (t *outputTail) transientLine() (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.lines) - 1; i >= 0; i-- {
+		if transientOutput.MatchString(t.lines[i]) {
+			return t.lines[i], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,90 @@
+package mediaopt
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// WebMContainer is the muxer of plans encoding VP9, for web embedding
+const WebMContainer = "webm"
+
+// webmAudio is the audio encoding of WebM outputs whose settings name a codec
+// WebM can't carry
+var webmAudio = AudioEncoding{Codec: "opus"}
+
+// webmCodecs are the codecs browsers accept in WebM
+var webmCodecs = map[string]bool{
+	"vp8": true, "vp9": true, "av1": true,
+	"opus": true, "vorbis": true,
+	"webvtt": true,
+}
+
+// encodesWebM reports whether the plan re-encodes video with an encoder
+// whose output is written as WebM
+func (p *Plan) encodesWebM() bool {
+	for _, m := range p.Streams {
+		if m.Type == "video" && m.Action == ActionTranscode && isVPX(m.TargetCodec) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyWebM switches a plan encoding VP9 to the WebM container. Audio is
+// re-encoded to Opus unless it already is Opus or Vorbis, text subtitles are
+// converted to WebVTT and every other stream WebM can't hold is dropped.
+func (p *Plan) applyWebM(probe *ProbeResult) {
+	if !p.encodesWebM() {
+		return
+	}
+	p.Container = WebMContainer
+
+	a := p.Audio
+	if a == nil || !webmCodecs[a.Codec] {
+		settings := webmAudio
+		if a != nil {
+			// Keep the layout and bitrate asked for, with Opus' defaults
+			settings.Layout = a.Layout
+			settings.BitrateKbps = a.BitrateKbps
+		}
+		a = &settings
+		p.Audio = a
+	}
+	sources := make(map[int]ProbeStream)
+	for _, s := range probe.Streams {
+		sources[s.Index] = s
+	}
+
+	for i, m := range p.Streams {
+		codec := m.TargetCodec
+		if m.Action == ActionTranscode {
+			if format, ok := encoderFormats[codec]; ok {
+				codec = format
+			} else if m.Type == "audio" {
+				codec = audioFormat(codec)
+			}
+		}
+		switch {
+		case m.Action == ActionDrop || webmCodecs[codec]:
+		case m.Type == "audio":
+			p.transcodeAudio(i, a, sources[m.InputIndex].Channels)
+		case m.Type == "subtitle" && textSubtitleCodecs[m.SourceCodec]:
+			p.Streams[i].Action = ActionTranscode
+			p.Streams[i].TargetCodec = "webvtt"
+		default:
+			p.Streams[i].Action = ActionDrop
+			p.Streams[i].TargetCodec = ""
+			p.Streams[i].Reason = fmt.Sprintf("%s %s streams cannot be stored in %s", m.SourceCodec, m.Type, WebMContainer)
+		}
+	}
+}
+
+// containerExtension gives output the .webm extension of a WebM plan, which
+// web servers and players go by to recognise the file
+func (p *Plan) containerExtension(output string) string {
+	if p.Container != WebMContainer || strings.EqualFold(filepath.Ext(output), "."+WebMContainer) {
+		return output
+	}
+	return strings.TrimSuffix(output, filepath.Ext(output)) + "." + WebMContainer
+}
@@ -0,0 +1,51 @@
+package mediapath
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Top is the path above every other. On Windows, which has a root per drive
+// and share, it stands for the list of drives rather than a directory.
+const Top = "/"
+
+// IsTop reports whether raw is Top on a system where it lists the drives
+func IsTop(raw string) bool {
+	return runtime.GOOS == "windows" && (raw == Top || raw == `\`)
+}
+
+// Drives returns the roots of the drives of a Windows system, such as C:\,
+// and nil elsewhere
+func Drives() []string {
+	if runtime.GOOS != "windows" {
+		return nil
+	}
+	var drives []string
+	for letter := 'A'; letter <= 'Z'; letter++ {
+		root := string(letter) + `:\`
+		if _, err := os.Stat(root); err == nil {
+			drives = append(drives, root)
+		}
+	}
+	return drives
+}
+
+// Parent returns the directory above path, a normalized path: Top for the
+// root of a drive or share, empty for Top itself
+func Parent(path string) string {
+	if path == Top {
+		return ""
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return Top
+	}
+	return parent
+}
+
+// Contains reports whether path is root or below it. Either may be written
+// with slashes, and on Windows they compare case-insensitively.
+func Contains(root, path string) bool {
+	return contains(filepath.Clean(filepath.FromSlash(root)), filepath.Clean(filepath.FromSlash(path)))
+}
@@ -0,0 +1,134 @@
+// Package mediapath normalizes the file paths handed to the server by the
+// browser, webhooks and other clients so every package sees the same path
+// for the same file.
+package mediapath
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MediaPath is a cleaned, absolute path with symlinks resolved, together
+// with the media root containing it
+type MediaPath struct {
+	path    string
+	library string
+}
+
+// New normalizes raw and finds the root among roots that contains it.
+// Separators are converted to the platform's, "." and ".." are resolved and
+// symlinks are followed as far as the path exists. The path doesn't need to
+// be inside a root; see Within.
+func New(raw string, roots []string) (MediaPath, error) {
+	if strings.TrimSpace(raw) == "" {
+		return MediaPath{}, fmt.Errorf("empty path")
+	}
+	path, err := normalize(raw)
+	if err != nil {
+		return MediaPath{}, err
+	}
+
+	p := MediaPath{path: path}
+	for _, root := range roots {
+		r, err := normalize(root)
+		if err != nil {
+			continue
+		}
+		if contains(r, path) && len(r) > len(p.library) {
+			p.library = r
+		}
+	}
+	return p, nil
+}
+
+// Resolve is New for paths that must be inside one of roots. Any path is
+// accepted when no roots are given.
+func Resolve(raw string, roots []string) (MediaPath, error) {
+	p, err := New(raw, roots)
+	if err != nil {
+		return p, err
+	}
+	if len(roots) > 0 && !p.Within() {
+		return MediaPath{}, fmt.Errorf("path is outside the media roots: %s", raw)
+	}
+	return p, nil
+}
+
+// String returns the normalized path
+func (p MediaPath) String() string {
+	return p.path
+}
+
+// Library returns the media root containing the path, empty if none does
+func (p MediaPath) Library() string {
+	return p.library
+}
+
+// Within reports whether the path is inside a media root
+func (p MediaPath) Within() bool {
+	return p.library != ""
+}
+
+// Rel returns the path relative to its library, or the full path when it
+// isn't in one
+func (p MediaPath) Rel() string {
+	if p.library == "" {
+		return p.path
+	}
+	rel, err := filepath.Rel(p.library, p.path)
+	if err != nil {
+		return p.path
+	}
+	return rel
+}
+
+// normalize cleans raw into an absolute path and resolves symlinks in its
+// longest existing prefix, so paths of files yet to be written still compare
+// equal to their resolved directory. Names spelled in another Unicode
+// normalization form than on disk are resolved to the name on disk.
+func normalize(raw string) (string, error) {
+	path, err := filepath.Abs(filepath.FromSlash(raw))
+	if err != nil {
+		return "", fmt.Errorf("invalid path %s: %v", raw, err)
+	}
+
+	var missing []string
+	for {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+			break
+		} else if !os.IsNotExist(err) {
+			return "", fmt.Errorf("invalid path %s: %v", raw, err)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		missing = append([]string{filepath.Base(path)}, missing...)
+		path = parent
+	}
+
+	for len(missing) > 0 {
+		name := matchName(path, missing[0])
+		if name == "" {
+			break
+		}
+		resolved, err := filepath.EvalSymlinks(filepath.Join(path, name))
+		if err != nil {
+			break
+		}
+		path, missing = resolved, missing[1:]
+	}
+	return filepath.Join(append([]string{path}, missing...)...), nil
+}
+
+// contains reports whether path is root or below it
+func contains(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
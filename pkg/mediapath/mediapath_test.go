@@ -0,0 +1,126 @@
+package mediapath
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	movies := filepath.Join(dir, "movies")
+	if err := os.MkdirAll(filepath.Join(movies, "Film"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(movies, link); err != nil {
+		t.Fatal(err)
+	}
+	roots := []string{movies}
+
+	p, err := New(link+"/Film/../Film/film.mkv", roots)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	expected := filepath.Join(movies, "Film", "film.mkv")
+	if p.String() != expected || p.Library() != movies || p.Rel() != filepath.Join("Film", "film.mkv") {
+		t.Errorf("Unexpected path %q in %q (rel %q)", p.String(), p.Library(), p.Rel())
+	}
+
+	if _, err := Resolve(filepath.Join(dir, "moviesextra", "a.mkv"), roots); err == nil {
+		t.Error("Expected error for a path beside the root")
+	}
+	if _, err := Resolve(movies+"/../other.mkv", roots); err == nil {
+		t.Error("Expected error for a path escaping the root")
+	}
+	if p, err := Resolve("/anywhere/a.mkv", nil); err != nil || p.Within() {
+		t.Errorf("Expected any path without roots, got %+v %v", p, err)
+	}
+	if _, err := New(" ", roots); err == nil {
+		t.Error("Expected error for an empty path")
+	}
+}
+
+func TestUnicodeNames(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written decomposed, as macOS does on network shares
+	decomposed := filepath.Join(dir, "Cafe\u0301 Society", "Ame\u0301lie (2001).mkv")
+	others := []string{
+		filepath.Join(dir, "千と千尋の神隠し", "千と千尋の神隠し (2001).mkv"),
+		filepath.Join(dir, "🎬 Movies", "Director's Cut 'Final'.mkv"),
+	}
+	for _, path := range append(others, decomposed) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := New(filepath.Join(dir, "Café Society", "Amélie (2001).mkv"), nil)
+	if err != nil || p.String() != decomposed {
+		t.Errorf("Expected the composed name to find %q, got %q (%v)", decomposed, p.String(), err)
+	}
+	p, _ = New(filepath.Join(dir, "Café Society", "new.mkv"), nil)
+	if expected := filepath.Join(dir, "Cafe\u0301 Society", "new.mkv"); p.String() != expected {
+		t.Errorf("Expected a new file in the directory on disk, got %q", p.String())
+	}
+	for _, path := range others {
+		if p, err := New(path, []string{dir}); err != nil || p.String() != path || !p.Within() {
+			t.Errorf("Expected %q unchanged, got %q (%v)", path, p.String(), err)
+		}
+	}
+
+	if got := NormalizeName(decomposed, FormNFC); got != filepath.Join(dir, "Cafe\u0301 Society", "Amélie (2001).mkv") {
+		t.Errorf("Expected only the name composed, got %q", got)
+	}
+	if got := NormalizeName("Amélie.mkv", FormNFD); got != "Ame\u0301lie.mkv" {
+		t.Errorf("Expected the name decomposed, got %q", got)
+	}
+	if got := NormalizeName("Amélie.mkv", FormNone); got != "Amélie.mkv" {
+		t.Errorf("Expected the name kept, got %q", got)
+	}
+	if !SameName("Amélie", "Ame\u0301lie") || SameName("Amelie", "Amélie") {
+		t.Error("Expected names to compare equal only across normalization forms")
+	}
+	if err := ValidateForm("nfkc"); err == nil {
+		t.Error("Expected an unknown form to be rejected")
+	}
+}
+
+func TestParent(t *testing.T) {
+	for path, expected := range map[string]string{
+		Top:                                 "",
+		filepath.FromSlash("/media"):        Top,
+		filepath.FromSlash("/media/Film"):   filepath.FromSlash("/media"),
+		filepath.FromSlash("/media/Film/a"): filepath.FromSlash("/media/Film"),
+	} {
+		if got := Parent(path); got != expected {
+			t.Errorf("Parent(%q) = %q, expected %q", path, got, expected)
+		}
+	}
+	if IsTop("/") && Drives() == nil {
+		t.Error("Expected drives where the top level lists them")
+	}
+
+	for _, c := range []struct {
+		root, path string
+		want       bool
+	}{
+		{"/media/", "/media", true},
+		{"/media", filepath.FromSlash("/media/tv/a.mkv"), true},
+		{"/media/tv", "/media/tv/../movies/a.mkv", false},
+		{"/media/tv", "/media/tvextra/a.mkv", false},
+	} {
+		if got := Contains(c.root, c.path); got != c.want {
+			t.Errorf("Contains(%q, %q) = %v, expected %v", c.root, c.path, got, c.want)
+		}
+	}
+}
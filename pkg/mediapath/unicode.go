@@ -0,0 +1,83 @@
+package mediapath
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Unicode normalization forms of file names. macOS writes names decomposed
+// (NFD) to network shares, while browsers and most other systems send them
+// composed (NFC), so the same "Café" may be spelled two ways.
+const (
+	// FormNone keeps names as they are
+	FormNone = ""
+	FormNFC  = "nfc"
+	FormNFD  = "nfd"
+)
+
+// ValidateForm checks form is one of the normalization forms
+func ValidateForm(form string) error {
+	switch form {
+	case FormNone, FormNFC, FormNFD:
+		return nil
+	}
+	return fmt.Errorf("normalization form must be %q or %q, got %q", FormNFC, FormNFD, form)
+}
+
+// Normalize returns s in form
+func Normalize(s, form string) string {
+	switch form {
+	case FormNFC:
+		return norm.NFC.String(s)
+	case FormNFD:
+		return norm.NFD.String(s)
+	}
+	return s
+}
+
+// NormalizeName returns path with its last element in form, leaving the
+// directories, which already exist as they are spelled, alone
+func NormalizeName(path, form string) string {
+	dir, name := filepath.Split(path)
+	return dir + Normalize(name, form)
+}
+
+// SameName reports whether a and b spell the same name in any normalization
+// form
+func SameName(a, b string) bool {
+	return a == b || norm.NFC.String(a) == norm.NFC.String(b)
+}
+
+// matchName returns the entry of dir that spells name in another
+// normalization form, empty if there is none. ASCII names have a single
+// form and aren't looked up.
+func matchName(dir, name string) string {
+	if isASCII(name) || !utf8.ValidString(name) {
+		return ""
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	want := norm.NFC.String(name)
+	for _, e := range entries {
+		if norm.NFC.String(e.Name()) == want {
+			return e.Name()
+		}
+	}
+	return ""
+}
+
+// isASCII reports whether s has only ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
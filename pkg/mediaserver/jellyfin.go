@@ -0,0 +1,124 @@
+package mediaserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Media server flavours sharing the Jellyfin API
+const (
+	Jellyfin = "jellyfin"
+	Emby     = "emby"
+)
+
+// JellyfinServer refreshes items on Jellyfin or Emby, which share the
+// library update endpoint
+type JellyfinServer struct {
+	kind   string
+	url    string
+	apiKey string
+	// deleteTrickplay removes trickplay images saved next to changed files
+	deleteTrickplay bool
+	client          *http.Client
+}
+
+// NewJellyfin creates an integration for a Jellyfin or Emby server at
+// baseURL (including any "/emby" prefix), authenticating with apiKey
+func NewJellyfin(kind, baseURL, apiKey string, deleteTrickplay bool) (*JellyfinServer, error) {
+	if kind != Jellyfin && kind != Emby {
+		return nil, fmt.Errorf("unknown media server type %q", kind)
+	}
+	return &JellyfinServer{
+		kind:            kind,
+		url:             strings.TrimSuffix(baseURL, "/"),
+		apiKey:          apiKey,
+		deleteTrickplay: deleteTrickplay,
+		client:          newClient(),
+	}, nil
+}
+
+func (j *JellyfinServer) Name() string {
+	return j.kind
+}
+
+// mediaUpdate is the body of /Library/Media/Updated
+type mediaUpdate struct {
+	Updates []pathUpdate
+}
+
+type pathUpdate struct {
+	Path       string
+	UpdateType string
+}
+
+// Refresh marks path as modified so the server rescans the item, first
+// deleting its stale trickplay data when configured
+func (j *JellyfinServer) Refresh(ctx context.Context, path string) error {
+	if j.deleteTrickplay {
+		if err := removeTrickplay(path); err != nil {
+			return err
+		}
+	}
+
+	update := mediaUpdate{Updates: []pathUpdate{{Path: path, UpdateType: "Modified"}}}
+	body, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, j.url+"/Library/Media/Updated", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Emby-Token", j.apiKey)
+
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(j.kind, resp)
+}
+
+// removeTrickplay deletes the trickplay data saved with the media of a file:
+// Jellyfin's "<name>.trickplay" folder and Emby's "<name>-*.bif" files.
+// Directories are left alone.
+func removeTrickplay(path string) error {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return nil
+	}
+	stem := strings.TrimSuffix(path, filepath.Ext(path))
+
+	if err := os.RemoveAll(stem + ".trickplay"); err != nil {
+		return fmt.Errorf("removing trickplay data: %v", err)
+	}
+	bifs, err := filepath.Glob(escapeGlob(stem) + "-*.bif")
+	if err != nil {
+		return err
+	}
+	for _, bif := range bifs {
+		if err := os.Remove(bif); err != nil {
+			return fmt.Errorf("removing trickplay data: %v", err)
+		}
+	}
+	return nil
+}
+
+// escapeGlob quotes the pattern characters of a literal path
+func escapeGlob(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
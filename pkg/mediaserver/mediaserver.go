@@ -0,0 +1,52 @@
+// Package mediaserver tells media servers such as Plex to rescan the folders
+// of optimized files, so new versions show up without waiting for a
+// scheduled scan, and lists who is streaming from them.
+package mediaserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// requestTimeout bounds each API call to a media server
+const requestTimeout = 30 * time.Second
+
+// Refresher tells one media server that a file, or every file in a
+// directory, has changed
+type Refresher interface {
+	Name() string
+	Refresh(ctx context.Context, path string) error
+}
+
+// newClient returns the HTTP client shared by the integrations
+func newClient() *http.Client {
+	return &http.Client{Timeout: requestTimeout}
+}
+
+// folderOf returns path if it is a directory, else the directory holding it
+func folderOf(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return path
+	}
+	return filepath.Dir(path)
+}
+
+// within reports whether folder is root or below it
+func within(root, folder string) bool {
+	root = strings.TrimSuffix(filepath.ToSlash(root), "/")
+	folder = filepath.ToSlash(folder)
+	return root != "" && (folder == root || strings.HasPrefix(folder, root+"/"))
+}
+
+// checkStatus turns a non-2xx response into an error
+func checkStatus(server string, resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", server, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package mediaserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPlexRefresh(t *testing.T) {
+	var refreshed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Plex-Token") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/library/sections":
+			fmt.Fprint(w, `{"MediaContainer": {"Directory": [
+				{"key": "1", "title": "Movies", "Location": [{"path": "/media/movies"}]},
+				{"key": "2", "title": "TV", "Location": [{"path": "/media/tv"}]}]}}`)
+		default:
+			refreshed = append(refreshed, r.URL.Path+"?"+r.URL.Query().Get("path"))
+		}
+	}))
+	defer server.Close()
+
+	plex := NewPlex(server.URL+"/", "secret")
+	if err := plex.Refresh(context.Background(), "/media/tv/Show/Season 01/Show - S01E01.mp4"); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if len(refreshed) != 1 || refreshed[0] != "/library/sections/2/refresh?/media/tv/Show/Season 01" {
+		t.Errorf("Unexpected refresh calls: %v", refreshed)
+	}
+	if err := plex.Refresh(context.Background(), "/media/tvshows/a.mp4"); err == nil {
+		t.Error("Expected error for a folder outside every library")
+	}
+	if err := NewPlex(server.URL, "wrong").Refresh(context.Background(), "/media/tv/a.mp4"); err == nil {
+		t.Error("Expected error for a rejected token")
+	}
+}
+
+func TestJellyfinRefresh(t *testing.T) {
+	dir := t.TempDir()
+	media := filepath.Join(dir, "Movie [2019].mp4")
+	for _, f := range []string{media, filepath.Join(dir, "Movie [2019]-320-10.bif"), filepath.Join(dir, "Movie [2019].trickplay", "320 - 10x10", "0.jpg")} {
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var update mediaUpdate
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/Library/Media/Updated" || r.Header.Get("X-Emby-Token") != "key" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&update)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	jellyfin, err := NewJellyfin(Jellyfin, server.URL, "key", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jellyfin.Refresh(context.Background(), media); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if len(update.Updates) != 1 || update.Updates[0].Path != media || update.Updates[0].UpdateType != "Modified" {
+		t.Errorf("Unexpected update: %+v", update)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the media file to remain, got %d entries", len(entries))
+	}
+
+	if _, err := NewJellyfin("kodi", server.URL, "key", false); err == nil {
+		t.Error("Expected error for an unknown server type")
+	}
+}
+
+func TestPlexSessions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status/sessions" || r.Header.Get("X-Plex-Token") != "secret" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"MediaContainer": {"size": 2, "Metadata": [
+			{"title": "Pilot", "grandparentTitle": "Show", "User": {"title": "ann"}, "Player": {"state": "playing"},
+			 "TranscodeSession": {"videoDecision": "transcode", "audioDecision": "copy"}},
+			{"title": "Movie", "User": {"title": "bob"}, "Player": {"state": "paused"},
+			 "TranscodeSession": {"videoDecision": "copy", "audioDecision": "copy"}}]}}`)
+	}))
+	defer server.Close()
+
+	sessions, err := NewPlex(server.URL, "secret").Sessions(context.Background())
+	if err != nil {
+		t.Fatalf("Sessions failed: %v", err)
+	}
+	want := []Session{
+		{Server: "plex", User: "ann", Title: "Show - Pilot", Transcoding: true},
+		{Server: "plex", User: "bob", Title: "Movie", Paused: true},
+	}
+	if !reflect.DeepEqual(sessions, want) {
+		t.Errorf("Expected %+v, got %+v", want, sessions)
+	}
+}
+
+func TestJellyfinSessions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/Sessions" || r.Header.Get("X-Emby-Token") != "key" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `[
+			{"UserName": "ann", "NowPlayingItem": {"Name": "Pilot", "SeriesName": "Show"}, "PlayState": {"PlayMethod": "Transcode"}},
+			{"UserName": "bob", "PlayState": {}},
+			{"UserName": "cat", "NowPlayingItem": {"Name": "Movie"}, "PlayState": {"IsPaused": true, "PlayMethod": "DirectPlay"}}]`)
+	}))
+	defer server.Close()
+
+	jellyfin, err := NewJellyfin(Jellyfin, server.URL, "key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := jellyfin.Sessions(context.Background())
+	if err != nil {
+		t.Fatalf("Sessions failed: %v", err)
+	}
+	want := []Session{
+		{Server: "jellyfin", User: "ann", Title: "Show - Pilot", Transcoding: true},
+		{Server: "jellyfin", User: "cat", Title: "Movie", Paused: true},
+	}
+	if !reflect.DeepEqual(sessions, want) {
+		t.Errorf("Expected %+v, got %+v", want, sessions)
+	}
+}
@@ -0,0 +1,92 @@
+package mediaserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Plex refreshes Plex Media Server library sections
+type Plex struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewPlex creates a Plex integration for the server at baseURL, e.g.
+// "http://plex:32400", authenticating with token
+func NewPlex(baseURL, token string) *Plex {
+	return &Plex{url: strings.TrimSuffix(baseURL, "/"), token: token, client: newClient()}
+}
+
+func (p *Plex) Name() string {
+	return "plex"
+}
+
+// plexSections is the JSON form of /library/sections
+type plexSections struct {
+	MediaContainer struct {
+		Directory []struct {
+			Key      string `json:"key"`
+			Title    string `json:"title"`
+			Location []struct {
+				Path string `json:"path"`
+			} `json:"Location"`
+		} `json:"Directory"`
+	} `json:"MediaContainer"`
+}
+
+// Refresh runs a partial scan of the folder of path in every library
+// section containing it
+func (p *Plex) Refresh(ctx context.Context, path string) error {
+	folder := folderOf(path)
+	var sections plexSections
+	if err := p.get(ctx, "/library/sections", nil, &sections); err != nil {
+		return err
+	}
+
+	refreshed := false
+	for _, d := range sections.MediaContainer.Directory {
+		for _, loc := range d.Location {
+			if !within(loc.Path, folder) {
+				continue
+			}
+			query := url.Values{"path": {folder}}
+			if err := p.get(ctx, "/library/sections/"+url.PathEscape(d.Key)+"/refresh", query, nil); err != nil {
+				return fmt.Errorf("refreshing section %s: %v", d.Title, err)
+			}
+			refreshed = true
+			break
+		}
+	}
+	if !refreshed {
+		return fmt.Errorf("no plex library contains %s", folder)
+	}
+	return nil
+}
+
+// get calls the Plex API, decoding the JSON response into v when given
+func (p *Plex) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Plex-Token", p.token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus("plex", resp); err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
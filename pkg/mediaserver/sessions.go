@@ -0,0 +1,128 @@
+package mediaserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// Session is someone playing media from a media server
+type Session struct {
+	Server string `json:"server"`
+	User   string `json:"user,omitempty"`
+	Title  string `json:"title,omitempty"`
+	// Transcoding is set while the server converts the stream, which loads
+	// its CPU, rather than sending the file as it is
+	Transcoding bool `json:"transcoding"`
+	// Paused is set while playback is paused
+	Paused bool `json:"paused"`
+}
+
+// SessionLister lists the playback sessions of one media server
+type SessionLister interface {
+	Name() string
+	Sessions(ctx context.Context) ([]Session, error)
+}
+
+// plexSessions is the JSON form of /status/sessions
+type plexSessions struct {
+	MediaContainer struct {
+		Metadata []struct {
+			Title            string `json:"title"`
+			GrandparentTitle string `json:"grandparentTitle"`
+			User             struct {
+				Title string `json:"title"`
+			} `json:"User"`
+			Player struct {
+				State string `json:"state"`
+			} `json:"Player"`
+			TranscodeSession *struct {
+				VideoDecision string `json:"videoDecision"`
+				AudioDecision string `json:"audioDecision"`
+			} `json:"TranscodeSession"`
+		} `json:"Metadata"`
+	} `json:"MediaContainer"`
+}
+
+// Sessions lists what Plex is playing. Streams whose video and audio are
+// only remuxed for the player don't count as transcoding.
+func (p *Plex) Sessions(ctx context.Context) ([]Session, error) {
+	var resp plexSessions
+	if err := p.get(ctx, "/status/sessions", nil, &resp); err != nil {
+		return nil, err
+	}
+	var sessions []Session
+	for _, m := range resp.MediaContainer.Metadata {
+		title := m.Title
+		if m.GrandparentTitle != "" {
+			title = m.GrandparentTitle + " - " + m.Title
+		}
+		t := m.TranscodeSession
+		sessions = append(sessions, Session{
+			Server:      p.Name(),
+			User:        m.User.Title,
+			Title:       title,
+			Transcoding: t != nil && (t.VideoDecision == "transcode" || t.AudioDecision == "transcode"),
+			Paused:      m.Player.State == "paused",
+		})
+	}
+	return sessions, nil
+}
+
+// jellyfinSession is an entry of /Sessions
+type jellyfinSession struct {
+	UserName       string
+	NowPlayingItem *struct {
+		Name       string
+		SeriesName string
+	}
+	PlayState struct {
+		IsPaused   bool
+		PlayMethod string
+	}
+}
+
+// Sessions lists what Jellyfin or Emby is playing, leaving out clients that
+// are connected but idle
+func (j *JellyfinServer) Sessions(ctx context.Context) ([]Session, error) {
+	query := url.Values{"ActiveWithinSeconds": {"960"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url+"/Sessions?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Emby-Token", j.apiKey)
+
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(j.kind, resp); err != nil {
+		return nil, err
+	}
+	var entries []jellyfinSession
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	var sessions []Session
+	for _, e := range entries {
+		item := e.NowPlayingItem
+		if item == nil {
+			continue
+		}
+		title := item.Name
+		if item.SeriesName != "" {
+			title = item.SeriesName + " - " + item.Name
+		}
+		sessions = append(sessions, Session{
+			Server:      j.Name(),
+			User:        e.UserName,
+			Title:       title,
+			Transcoding: e.PlayState.PlayMethod == "Transcode",
+			Paused:      e.PlayState.IsPaused,
+		})
+	}
+	return sessions, nil
+}
@@ -0,0 +1,64 @@
+package netmount
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// filesystemType returns the type of the filesystem mounted deepest above
+// path according to /proc/self/mountinfo
+func filesystemType(path string) (string, bool) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	best, fsType := "", ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// ID parent major:minor root mountpoint options [optional...] - type source superoptions
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+		point := unescape(fields[4])
+		if (Mount{Path: point}).Contains(path) && len(point) >= len(best) {
+			best, fsType = point, fields[sep+1]
+		}
+	}
+	return fsType, best != ""
+}
+
+// unescape decodes the octal escapes mountinfo uses for spaces and other
+// special characters in paths, e.g. \040
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package netmount
+
+// filesystemType is only implemented on Linux, where /proc lists the
+// mounts; elsewhere the check relies on the share answering
+func filesystemType(path string) (string, bool) {
+	return "", false
+}
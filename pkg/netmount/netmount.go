@@ -0,0 +1,132 @@
+// Package netmount checks that network-mounted media roots are reachable, so
+// jobs on a share that dropped can be told apart from jobs that failed.
+package netmount
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Share types
+const (
+	TypeNFS = "nfs"
+	TypeSMB = "smb"
+)
+
+// DefaultTimeout bounds a reachability check when a mount sets none
+const DefaultTimeout = 5 * time.Second
+
+// Errors returned by Check
+var (
+	// ErrUnreachable means the share did not answer within the timeout
+	ErrUnreachable = errors.New("share is not responding")
+	// ErrStale means the server no longer recognizes the client's handle,
+	// e.g. after the export was restarted
+	ErrStale = errors.New("stale file handle")
+	// ErrNotMounted means the path is not on a filesystem of the share's
+	// type, so the bare mount point directory would be used instead
+	ErrNotMounted = errors.New("share is not mounted")
+)
+
+// fsTypes maps share types to the filesystem types the kernel reports
+var fsTypes = map[string][]string{
+	TypeNFS: {"nfs", "nfs4"},
+	TypeSMB: {"cifs", "smb3", "smbfs"},
+}
+
+// Mount is a media root, or a directory containing media roots, on a
+// network share
+type Mount struct {
+	Path string
+	// Type is TypeNFS or TypeSMB
+	Type    string
+	Timeout time.Duration
+}
+
+// Validate checks that the mount has an absolute path and a known type
+func (m Mount) Validate() error {
+	if !filepath.IsAbs(m.Path) {
+		return fmt.Errorf("mount path must be absolute, got %q", m.Path)
+	}
+	if _, ok := fsTypes[m.Type]; !ok {
+		return fmt.Errorf("mount %s: type must be %q or %q, got %q", m.Path, TypeNFS, TypeSMB, m.Type)
+	}
+	return nil
+}
+
+// Contains reports whether path is the mount's path or below it
+func (m Mount) Contains(path string) bool {
+	rel, err := filepath.Rel(m.Path, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Check reports whether the share is mounted and answers. A share whose
+// server is gone can block file operations indefinitely, so the check runs
+// in the background and gives up after the timeout, leaving it blocked.
+func (m Mount) Check() error {
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.check()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.Path, err)
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("%s: %w after %v", m.Path, ErrUnreachable, timeout)
+	}
+}
+
+// check lists the mount's directory and compares its filesystem type
+func (m Mount) check() error {
+	f, err := os.Open(m.Path)
+	if err == nil {
+		_, err = f.Readdirnames(1)
+		f.Close()
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if errors.Is(err, syscall.ESTALE) {
+		return ErrStale
+	}
+	if err != nil {
+		return err
+	}
+
+	fsType, ok := filesystemType(m.Path)
+	if !ok {
+		return nil
+	}
+	for _, t := range fsTypes[m.Type] {
+		if fsType == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: filesystem is %s", ErrNotMounted, fsType)
+}
+
+// Find returns the mount containing path, preferring the deepest one
+func Find(mounts []Mount, path string) (Mount, bool) {
+	var found Mount
+	ok := false
+	for _, m := range mounts {
+		if m.Contains(path) && (!ok || len(m.Path) > len(found.Path)) {
+			found, ok = m, true
+		}
+	}
+	return found, ok
+}
@@ -0,0 +1,42 @@
+package netmount
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestFind(t *testing.T) {
+	mounts := []Mount{{Path: "/mnt/nas"}, {Path: "/mnt/nas/movies"}, {Path: "/mnt/other"}}
+	if m, ok := Find(mounts, "/mnt/nas/movies/a.mkv"); !ok || m.Path != "/mnt/nas/movies" {
+		t.Errorf("Expected the deepest mount, got %+v", m)
+	}
+	if m, ok := Find(mounts, "/mnt/nas"); !ok || m.Path != "/mnt/nas" {
+		t.Errorf("Expected the mount itself, got %+v", m)
+	}
+	if _, ok := Find(mounts, "/mnt/nasty/a.mkv"); ok {
+		t.Error("Expected no mount for a sibling with a common prefix")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	m := Mount{Path: dir, Type: TypeNFS}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if err := (Mount{Path: dir, Type: "ftp"}).Validate(); err == nil {
+		t.Error("Expected an unknown type to be rejected")
+	}
+
+	// A local directory is not an NFS share
+	err := m.Check()
+	if runtime.GOOS == "linux" && !errors.Is(err, ErrNotMounted) {
+		t.Errorf("Expected ErrNotMounted, got %v", err)
+	}
+	if err := (Mount{Path: filepath.Join(dir, "missing"), Type: TypeNFS}).Check(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a missing directory to fail, got %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// telegramAPI is the default Telegram Bot API address
+const telegramAPI = "https://api.telegram.org"
+
+// discord posts events as messages through a Discord channel webhook
+type discord struct {
+	target Target
+	client *http.Client
+}
+
+func (d *discord) Send(ctx context.Context, event Event) Delivery {
+	payload := map[string]string{"content": Text(event)}
+	return postJSON(ctx, d.client, d.target.Name, d.target.URL, nil, payload)
+}
+
+// telegram sends events as messages from a bot to a chat
+type telegram struct {
+	target Target
+	client *http.Client
+}
+
+func (t *telegram) Send(ctx context.Context, event Event) Delivery {
+	api := telegramAPI
+	if t.target.URL != "" {
+		api = strings.TrimSuffix(t.target.URL, "/")
+	}
+	payload := map[string]string{"chat_id": t.target.ChatID, "text": Text(event)}
+	d := postJSON(ctx, t.client, t.target.Name, api+"/bot"+t.target.BotToken+"/sendMessage", nil, payload)
+	// Errors from the client include the URL, which holds the token
+	d.Error = strings.ReplaceAll(d.Error, t.target.BotToken, "***")
+	return d
+}
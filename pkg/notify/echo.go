@@ -0,0 +1,106 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxEchoBody caps the size of a recorded request body
+const maxEchoBody = 64 * 1024
+
+// credentialHeaders carry logins, whose values the echo endpoint never
+// records as it would show them to anyone reading it
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "X-Api-Key", "Cookie"}
+
+// redacted replaces the values of credential headers
+const redacted = "[redacted]"
+
+// EchoRequest is a request captured by the echo endpoint
+type EchoRequest struct {
+	Method     string              `json:"method"`
+	Headers    map[string][]string `json:"headers"`
+	Body       json.RawMessage     `json:"body,omitempty"`
+	RawBody    string              `json:"rawBody,omitempty"`
+	ReceivedAt time.Time           `json:"receivedAt"`
+}
+
+// Echo is a webhook fixture: POSTs are recorded and echoed back, GET lists
+// the most recent ones. Point a target at it to see exactly what a consumer
+// would receive.
+type Echo struct {
+	mu       sync.Mutex
+	limit    int
+	requests []EchoRequest
+}
+
+// NewEcho creates an echo endpoint remembering the last limit requests
+func NewEcho(limit int) *Echo {
+	return &Echo{limit: limit}
+}
+
+func (e *Echo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e.Recent())
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxEchoBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := EchoRequest{
+			Method:     r.Method,
+			Headers:    redactHeaders(r.Header),
+			ReceivedAt: time.Now(),
+		}
+		if json.Valid(body) {
+			req.Body = body
+		} else {
+			req.RawBody = string(body)
+		}
+		e.record(req)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(req)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Recent returns the recorded requests, newest first
+func (e *Echo) Recent() []EchoRequest {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	recent := make([]EchoRequest, len(e.requests))
+	for i, r := range e.requests {
+		recent[len(e.requests)-1-i] = r
+	}
+	return recent
+}
+
+func (e *Echo) record(req EchoRequest) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.requests = append(e.requests, req)
+	if len(e.requests) > e.limit {
+		e.requests = e.requests[len(e.requests)-e.limit:]
+	}
+}
+
+// redactHeaders returns a copy of header with the values of credential
+// headers replaced, so their presence still shows
+func redactHeaders(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range credentialHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			header[http.CanonicalHeaderKey(name)] = []string{redacted}
+		}
+	}
+	return header
+}
@@ -0,0 +1,55 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// email sends events as plain text mail through an SMTP server
+type email struct {
+	target Target
+}
+
+func (e *email) Send(ctx context.Context, event Event) (d Delivery) {
+	d.Target = e.target.Name
+	start := time.Now()
+	defer func() {
+		d.DurationMs = time.Since(start).Milliseconds()
+	}()
+
+	text := Text(event)
+	subject, _, _ := strings.Cut(text, "\n")
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		e.target.From, strings.Join(e.target.To, ", "), subject, event.Time.Format(time.RFC1123Z),
+		strings.ReplaceAll(text, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if e.target.Username != "" {
+		host, _, err := net.SplitHostPort(e.target.SMTPServer)
+		if err != nil {
+			d.Error = err.Error()
+			return d
+		}
+		auth = smtp.PlainAuth("", e.target.Username, e.target.Password, host)
+	}
+
+	// net/smtp has no context support, so give up waiting at the deadline
+	// and let the send finish in the background
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(e.target.SMTPServer, auth, e.target.From, e.target.To, []byte(msg))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			d.Error = err.Error()
+		}
+	case <-ctx.Done():
+		d.Error = ctx.Err().Error()
+	}
+	return d
+}
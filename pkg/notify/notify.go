@@ -0,0 +1,245 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventJobCompleted   = "job.completed"
+	EventJobFailed      = "job.failed"
+	EventBatchCompleted = "batch.completed"
+	EventDiskLow        = "disk.low"
+	// EventChecksumMismatch reports an output that changed since its job
+	EventChecksumMismatch = "checksum.mismatch"
+	EventTest             = "test"
+)
+
+// eventTypes are the events a target can subscribe to
+var eventTypes = []string{EventJobCompleted, EventJobFailed, EventBatchCompleted, EventDiskLow, EventChecksumMismatch}
+
+// deliveryTimeout bounds a single delivery attempt
+const deliveryTimeout = 10 * time.Second
+
+// Event is the payload sent to notification targets
+type Event struct {
+	Type       string `json:"event"`
+	JobID      string `json:"jobId,omitempty"`
+	SourcePath string `json:"sourcePath,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Message    string `json:"message,omitempty"`
+	// Completed and Failed count the jobs of a finished batch
+	Completed int `json:"completed,omitempty"`
+	Failed    int `json:"failed,omitempty"`
+	// Path and FreeBytes describe the volume of a low disk event; Path is
+	// also the file of a checksum mismatch
+	Path      string    `json:"path,omitempty"`
+	FreeBytes uint64    `json:"freeBytes,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Target is a configured notification destination
+type Target struct {
+	Name string `json:"name"`
+	// Type selects the backend: "webhook", "discord", "telegram" or "email"
+	Type string `json:"type"`
+	// URL is the webhook or Discord webhook URL; for Telegram it overrides
+	// the Bot API address
+	URL string `json:"url,omitempty"`
+	// Headers are added to every webhook request, e.g. for authentication
+	Headers map[string]string `json:"headers,omitempty"`
+	// Events lists the event types delivered to the target, all when empty
+	Events []string `json:"events,omitempty"`
+
+	// Telegram bot token and the chat messages are sent to
+	BotToken string `json:"botToken,omitempty"`
+	ChatID   string `json:"chatId,omitempty"`
+
+	// Email delivery through an SMTP server, e.g. "smtp.example.com:587"
+	SMTPServer string   `json:"smtpServer,omitempty"`
+	Username   string   `json:"username,omitempty"`
+	Password   string   `json:"password,omitempty"`
+	From       string   `json:"from,omitempty"`
+	To         []string `json:"to,omitempty"`
+}
+
+// wants reports whether the target subscribed to events of type t. Test
+// events always go through.
+func (t Target) wants(eventType string) bool {
+	if len(t.Events) == 0 || eventType == EventTest {
+		return true
+	}
+	for _, e := range t.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery reports the outcome of sending an event to a target
+type Delivery struct {
+	Target     string `json:"target"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Response   string `json:"response,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Backend delivers events to one target
+type Backend interface {
+	Send(ctx context.Context, event Event) Delivery
+}
+
+// Notifier fans events out to all configured targets
+type Notifier struct {
+	names    []string
+	targets  map[string]Target
+	backends map[string]Backend
+	pending  sync.WaitGroup
+}
+
+// New creates a notifier for targets, rejecting unknown types and duplicate names
+func New(targets []Target) (*Notifier, error) {
+	n := &Notifier{targets: make(map[string]Target), backends: make(map[string]Backend)}
+	client := &http.Client{Timeout: deliveryTimeout}
+
+	for _, t := range targets {
+		if t.Name == "" {
+			return nil, fmt.Errorf("notification target without a name")
+		}
+		if _, exists := n.backends[t.Name]; exists {
+			return nil, fmt.Errorf("duplicate notification target %q", t.Name)
+		}
+
+		for _, e := range t.Events {
+			if !validEvent(e) {
+				return nil, fmt.Errorf("notification target %q has unknown event %q", t.Name, e)
+			}
+		}
+
+		var backend Backend
+		switch t.Type {
+		case "webhook", "":
+			if t.URL == "" {
+				return nil, fmt.Errorf("webhook target %q has no url", t.Name)
+			}
+			backend = &webhook{target: t, client: client}
+		case "discord":
+			if t.URL == "" {
+				return nil, fmt.Errorf("discord target %q has no url", t.Name)
+			}
+			backend = &discord{target: t, client: client}
+		case "telegram":
+			if t.BotToken == "" || t.ChatID == "" {
+				return nil, fmt.Errorf("telegram target %q needs botToken and chatId", t.Name)
+			}
+			backend = &telegram{target: t, client: client}
+		case "email":
+			if t.SMTPServer == "" || t.From == "" || len(t.To) == 0 {
+				return nil, fmt.Errorf("email target %q needs smtpServer, from and to", t.Name)
+			}
+			backend = &email{target: t}
+		default:
+			return nil, fmt.Errorf("notification target %q has unknown type %q", t.Name, t.Type)
+		}
+		n.names = append(n.names, t.Name)
+		n.targets[t.Name] = t
+		n.backends[t.Name] = backend
+	}
+	return n, nil
+}
+
+// Targets returns the configured target names in config order
+func (n *Notifier) Targets() []string {
+	return append([]string{}, n.names...)
+}
+
+// Notify delivers event to every target subscribed to it in the
+// background. Failures are logged and never affect the job.
+func (n *Notifier) Notify(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, name := range n.names {
+		if !n.targets[name].wants(event.Type) {
+			continue
+		}
+		n.pending.Add(1)
+		go func(backend Backend) {
+			defer n.pending.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+			defer cancel()
+			if d := backend.Send(ctx, event); d.Error != "" {
+				log.Printf("Notification %s to %s failed: %s", event.Type, d.Target, d.Error)
+			}
+		}(n.backends[name])
+	}
+}
+
+// Wait blocks until the deliveries started by Notify have finished
+func (n *Notifier) Wait() {
+	n.pending.Wait()
+}
+
+// Test sends a sample event to the named target and waits for the result
+func (n *Notifier) Test(ctx context.Context, name string) (Delivery, error) {
+	backend, ok := n.backends[name]
+	if !ok {
+		return Delivery{}, fmt.Errorf("unknown notification target %q", name)
+	}
+	return backend.Send(ctx, SampleEvent()), nil
+}
+
+func validEvent(eventType string) bool {
+	for _, e := range eventTypes {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Text renders event as a short human readable message for chat and email
+// targets
+func Text(event Event) string {
+	var text string
+	switch event.Type {
+	case EventJobCompleted:
+		text = fmt.Sprintf("✅ Optimized %s: %s", event.Kind, event.SourcePath)
+	case EventJobFailed:
+		text = fmt.Sprintf("❌ Failed to optimize %s: %s\n%s", event.Kind, event.SourcePath, event.Error)
+	case EventBatchCompleted:
+		text = fmt.Sprintf("🏁 Batch finished: %d completed, %d failed", event.Completed, event.Failed)
+	case EventDiskLow:
+		text = fmt.Sprintf("⚠️ Low disk space on %s: %.1f GB free", event.Path, float64(event.FreeBytes)/1e9)
+	case EventChecksumMismatch:
+		text = fmt.Sprintf("⚠️ Checksum mismatch, the file may be corrupted: %s", event.Path)
+	default:
+		text = event.Type
+	}
+	if event.Message != "" {
+		text += "\n" + event.Message
+	}
+	return text
+}
+
+// SampleEvent returns the payload used for test deliveries
+func SampleEvent() Event {
+	return Event{
+		Type:       EventTest,
+		JobID:      "test",
+		SourcePath: "/media/Example Movie (2024)/Example Movie (2024).mkv",
+		Kind:       "video",
+		Status:     "completed",
+		Message:    "Test delivery from media optimizer",
+		Time:       time.Now(),
+	}
+}
@@ -0,0 +1,139 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTestDeliveryToEcho(t *testing.T) {
+	echo := NewEcho(2)
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	n, err := New([]Target{{Name: "echo", Type: "webhook", URL: server.URL, Headers: map[string]string{"Authorization": "Bearer x"}}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	d, err := n.Test(context.Background(), "echo")
+	if err != nil {
+		t.Fatalf("Test failed: %v", err)
+	}
+	if d.Error != "" || d.StatusCode != 200 {
+		t.Fatalf("Unexpected delivery %+v", d)
+	}
+
+	recent := echo.Recent()
+	if len(recent) != 1 {
+		t.Fatalf("Expected 1 recorded request, got %d", len(recent))
+	}
+	var event Event
+	if err := json.Unmarshal(recent[0].Body, &event); err != nil || event.Type != EventTest {
+		t.Errorf("Unexpected recorded body %s", recent[0].Body)
+	}
+	if recent[0].Headers["Authorization"][0] != redacted {
+		t.Errorf("Expected the configured credential header redacted, got %v", recent[0].Headers)
+	}
+
+	// Wait returns once background deliveries are done
+	n.Notify(Event{Type: EventJobCompleted, SourcePath: "/media/a.mkv"})
+	n.Wait()
+	if recent := echo.Recent(); len(recent) != 2 {
+		t.Errorf("Expected the notification delivered after Wait, got %d requests", len(recent))
+	}
+
+	if _, err := n.Test(context.Background(), "missing"); err == nil {
+		t.Error("Expected error for unknown target")
+	}
+}
+
+func TestEchoRedactsCredentials(t *testing.T) {
+	echo := NewEcho(1)
+	r := httptest.NewRequest(http.MethodPost, "/webhooks/echo", strings.NewReader(`{}`))
+	r.SetBasicAuth("admin", "secret")
+	r.Header.Set("X-API-Key", "api-key-123")
+	r.Header.Set("Cookie", "session=abc")
+	r.Header.Set("X-Event", "job.completed")
+	w := httptest.NewRecorder()
+	echo.ServeHTTP(w, r)
+
+	for _, body := range []string{w.Body.String(), fmt.Sprint(echo.Recent())} {
+		for _, secret := range []string{"secret", "YWRtaW46c2VjcmV0", "api-key-123", "session=abc"} {
+			if strings.Contains(body, secret) {
+				t.Errorf("Expected %s redacted from %s", secret, body)
+			}
+		}
+	}
+	headers := echo.Recent()[0].Headers
+	if headers["Authorization"][0] != redacted || headers["X-Api-Key"][0] != redacted || headers["X-Event"][0] != "job.completed" {
+		t.Errorf("Unexpected recorded headers %v", headers)
+	}
+	if r.Header.Get("X-API-Key") != "api-key-123" {
+		t.Error("Expected the request's own headers untouched")
+	}
+}
+
+func TestNewRejectsInvalidTargets(t *testing.T) {
+	invalid := [][]Target{
+		{{Type: "webhook", URL: "http://x"}},
+		{{Name: "a", Type: "webhook"}},
+		{{Name: "a", Type: "pigeon", URL: "http://x"}},
+		{{Name: "a", URL: "http://x"}, {Name: "a", URL: "http://y"}},
+	}
+	for _, targets := range invalid {
+		if _, err := New(targets); err == nil {
+			t.Errorf("Expected error for %+v", targets)
+		}
+	}
+}
+
+func TestChatBackendsAndRules(t *testing.T) {
+	echo := NewEcho(10)
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	n, err := New([]Target{
+		{Name: "discord", Type: "discord", URL: server.URL, Events: []string{EventJobFailed}},
+		{Name: "telegram", Type: "telegram", URL: server.URL, BotToken: "123:abc", ChatID: "42"},
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	d, err := n.Test(context.Background(), "telegram")
+	if err != nil || d.Error != "" {
+		t.Fatalf("Telegram delivery failed: %+v %v", d, err)
+	}
+	var message map[string]string
+	if err := json.Unmarshal(echo.Recent()[0].Body, &message); err != nil || message["chat_id"] != "42" || message["text"] == "" {
+		t.Errorf("Unexpected telegram body %s", echo.Recent()[0].Body)
+	}
+
+	if !n.targets["discord"].wants(EventJobFailed) || n.targets["discord"].wants(EventBatchCompleted) {
+		t.Error("Expected discord to receive only failures")
+	}
+	if !n.targets["telegram"].wants(EventDiskLow) {
+		t.Error("Expected target without rules to receive every event")
+	}
+
+	text := Text(Event{Type: EventBatchCompleted, Completed: 5, Failed: 1})
+	if !strings.Contains(text, "5 completed, 1 failed") {
+		t.Errorf("Unexpected batch text %q", text)
+	}
+
+	invalid := []Target{
+		{Name: "a", Type: "webhook", URL: "http://x", Events: []string{"job.started"}},
+		{Name: "a", Type: "telegram", BotToken: "x"},
+		{Name: "a", Type: "email", SMTPServer: "smtp:25", From: "a@b"},
+	}
+	for _, target := range invalid {
+		if _, err := New([]Target{target}); err == nil {
+			t.Errorf("Expected error for %+v", target)
+		}
+	}
+}
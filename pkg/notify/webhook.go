@@ -0,0 +1,67 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxResponseBytes caps how much of a target's response is reported back
+const maxResponseBytes = 4096
+
+// webhook posts events as JSON to a URL
+type webhook struct {
+	target Target
+	client *http.Client
+}
+
+func (w *webhook) Send(ctx context.Context, event Event) Delivery {
+	headers := map[string]string{"X-Media-Optimizer-Event": event.Type}
+	for k, v := range w.target.Headers {
+		headers[k] = v
+	}
+	return postJSON(ctx, w.client, w.target.Name, w.target.URL, headers, event)
+}
+
+// postJSON sends payload as a JSON POST and reports the response
+func postJSON(ctx context.Context, client *http.Client, target, url string, headers map[string]string, payload interface{}) (d Delivery) {
+	d.Target = target
+	start := time.Now()
+	defer func() {
+		d.DurationMs = time.Since(start).Milliseconds()
+	}()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	d.StatusCode = resp.StatusCode
+	d.Response = string(respBody)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		d.Error = fmt.Sprintf("unexpected status %s", resp.Status)
+	}
+	return d
+}
@@ -0,0 +1,327 @@
+// Package openapi generates the OpenAPI 3 document of the HTTP API from a
+// list of endpoints and the Go types of their requests and responses, so
+// the document can't drift from the JSON the handlers actually exchange.
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Version is the OpenAPI version of generated documents
+const Version = "3.0.3"
+
+// Document is an OpenAPI document
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Servers    []Server            `json:"servers,omitempty"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+// Info describes the API
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// Server is a base URL the paths are relative to
+type Server struct {
+	URL string `json:"url"`
+}
+
+// PathItem holds the operations of a path by lower case method
+type PathItem map[string]*Operation
+
+// Operation is one method of a path
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary,omitempty"`
+	Description string               `json:"description,omitempty"`
+	Tags        []string             `json:"tags,omitempty"`
+	Parameters  []Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+// Parameter is a path or query parameter
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody is the body of a request
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response is a response of an operation
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// MediaType is the schema of a body with a content type
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components holds the schemas referenced by the operations
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas,omitempty"`
+}
+
+// Schema describes a JSON value. The empty schema matches any value.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// Endpoint describes one method of a path for Generate
+type Endpoint struct {
+	Method string
+	// Path is relative to the server URL, with path parameters in braces,
+	// e.g. "/jobs/{id}/log"
+	Path        string
+	Summary     string
+	Description string
+	Tag         string
+	Query       []Parameter
+	// Request is a value of the JSON request body's type, nil if the
+	// endpoint takes no JSON body
+	Request interface{}
+	// Response is a value of the JSON response's type, nil if there is no
+	// JSON response
+	Response interface{}
+	// ContentType is the type of a response that isn't JSON, e.g.
+	// "image/jpeg"
+	ContentType string
+	// Status is the status of a successful response, 200 if zero
+	Status int
+	// Errors lists the other statuses the endpoint answers with. Their
+	// body is a plain text message.
+	Errors []int
+}
+
+// Query returns an optional query parameter of the JSON type typ
+func Query(name, typ, description string) Parameter {
+	return Parameter{Name: name, In: "query", Description: description, Schema: &Schema{Type: typ}}
+}
+
+// Generate returns the document describing the endpoints, served at the
+// base URL server
+func Generate(info Info, server string, endpoints []Endpoint) *Document {
+	doc := &Document{
+		OpenAPI: Version,
+		Info:    info,
+		Paths:   map[string]PathItem{},
+	}
+	if server != "" {
+		doc.Servers = []Server{{URL: server}}
+	}
+
+	g := &generator{schemas: map[string]*Schema{}, names: map[reflect.Type]string{}}
+	for _, e := range endpoints {
+		item := doc.Paths[e.Path]
+		if item == nil {
+			item = PathItem{}
+			doc.Paths[e.Path] = item
+		}
+		item[strings.ToLower(e.Method)] = g.operation(e)
+	}
+	doc.Components.Schemas = g.schemas
+	return doc
+}
+
+type generator struct {
+	schemas map[string]*Schema
+	names   map[reflect.Type]string
+}
+
+func (g *generator) operation(e Endpoint) *Operation {
+	op := &Operation{
+		OperationID: operationID(e.Method, e.Path),
+		Summary:     e.Summary,
+		Description: e.Description,
+		Responses:   map[string]*Response{},
+	}
+	if e.Tag != "" {
+		op.Tags = []string{e.Tag}
+	}
+	for _, name := range pathParameters(e.Path) {
+		op.Parameters = append(op.Parameters, Parameter{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}})
+	}
+	op.Parameters = append(op.Parameters, e.Query...)
+	if e.Request != nil {
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content:  map[string]MediaType{"application/json": {Schema: g.schema(reflect.TypeOf(e.Request))}},
+		}
+	}
+
+	status := e.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	resp := &Response{Description: http.StatusText(status)}
+	switch {
+	case e.Response != nil:
+		resp.Content = map[string]MediaType{"application/json": {Schema: g.schema(reflect.TypeOf(e.Response))}}
+	case e.ContentType != "":
+		resp.Content = map[string]MediaType{e.ContentType: {Schema: &Schema{Type: "string", Format: "binary"}}}
+	}
+	op.Responses[strconv.Itoa(status)] = resp
+	for _, code := range e.Errors {
+		op.Responses[strconv.Itoa(code)] = &Response{
+			Description: http.StatusText(code),
+			Content:     map[string]MediaType{"text/plain": {Schema: &Schema{Type: "string"}}},
+		}
+	}
+	return op
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema returns the schema of the JSON encoding of t. Named structs are
+// added to the components and referenced.
+func (g *generator) schema(t reflect.Type) *Schema {
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case rawType:
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + g.component(t)}
+	}
+	// Interfaces and anything else JSON can't describe in advance
+	return &Schema{}
+}
+
+// component adds a named struct to the components once and returns its
+// name there
+func (g *generator) component(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	name := t.Name()
+	if _, taken := g.schemas[name]; taken {
+		// Another package has a type of the same name
+		pkg := t.PkgPath()
+		name = pkg[strings.LastIndex(pkg, "/")+1:] + name
+	}
+	g.names[t] = name
+	// Registered before the fields so recursive types terminate
+	g.schemas[name] = &Schema{}
+	*g.schemas[name] = *g.object(t)
+	return name
+}
+
+// object returns the schema of a struct's fields as encoding/json sees
+// them, with embedded structs' fields promoted
+func (g *generator) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	g.fields(t, s)
+	sort.Strings(s.Required)
+	return s
+}
+
+func (g *generator) fields(t reflect.Type, s *Schema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.fields(ft, s)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// operationID derives an ID from the method and path, e.g. getJobsIdLog
+// for GET /jobs/{id}/log
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		id += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return id
+}
+
+// pathParameters returns the names of the parameters in braces in path
+func pathParameters(path string) []string {
+	var names []string
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			names = append(names, segment[1:len(segment)-1])
+		}
+	}
+	return names
+}
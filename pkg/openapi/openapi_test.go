@@ -0,0 +1,95 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type page struct {
+	Items []item `json:"items"`
+	Next  string `json:"next,omitempty"`
+}
+
+type base struct {
+	ID string `json:"id"`
+}
+
+type item struct {
+	base
+	Name     string            `json:"name"`
+	Size     int64             `json:"size,omitempty"`
+	Modified time.Time         `json:"modified"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Extra    interface{}       `json:"extra,omitempty"`
+	Parent   *item             `json:"parent,omitempty"`
+	Ignored  string            `json:"-"`
+	internal string
+}
+
+func TestGenerate(t *testing.T) {
+	doc := Generate(Info{Title: "Test", Version: "1"}, "/api/v1", []Endpoint{{
+		Method:   http.MethodPost,
+		Path:     "/items",
+		Request:  struct{ Name string }{},
+		Response: page{},
+		Errors:   []int{http.StatusBadRequest},
+	}, {
+		Method:      http.MethodGet,
+		Path:        "/items/{id}/thumbnail",
+		Query:       []Parameter{Query("size", "integer", "")},
+		ContentType: "image/jpeg",
+	}})
+
+	post := doc.Paths["/items"]["post"]
+	if post == nil || post.OperationID != "postItems" {
+		t.Fatalf("Expected the operation postItems, got %+v", post)
+	}
+	if schema := post.RequestBody.Content["application/json"].Schema; schema.Type != "object" || schema.Properties["Name"].Type != "string" {
+		t.Errorf("Expected an inline request schema, got %+v", schema)
+	}
+	if ref := post.Responses["200"].Content["application/json"].Schema.Ref; ref != "#/components/schemas/page" {
+		t.Errorf("Expected a reference to page, got %q", ref)
+	}
+	if post.Responses["400"].Content["text/plain"].Schema.Type != "string" {
+		t.Error("Expected a plain text error response")
+	}
+
+	get := doc.Paths["/items/{id}/thumbnail"]["get"]
+	if get.OperationID != "getItemsIdThumbnail" || len(get.Parameters) != 2 || get.Parameters[0].In != "path" || !get.Parameters[0].Required {
+		t.Errorf("Expected the path parameter id and the query parameter size, got %+v", get.Parameters)
+	}
+	if _, ok := get.Responses["200"].Content["image/jpeg"]; !ok {
+		t.Error("Expected an image response")
+	}
+
+	s := doc.Components.Schemas["item"]
+	if s == nil {
+		t.Fatal("Expected item among the components")
+	}
+	var names []string
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	if len(names) != 7 || s.Properties["id"] == nil || s.Properties["Ignored"] != nil || s.Properties["internal"] != nil {
+		t.Errorf("Expected the JSON fields with the embedded id, got %v", names)
+	}
+	if !reflect.DeepEqual(s.Required, []string{"id", "modified", "name"}) {
+		t.Errorf("Expected the fields without omitempty to be required, got %v", s.Required)
+	}
+	if m := s.Properties["modified"]; m.Type != "string" || m.Format != "date-time" {
+		t.Errorf("Expected times as date-time strings, got %+v", m)
+	}
+	if tags := s.Properties["tags"]; tags.Type != "object" || tags.AdditionalProperties.Type != "string" {
+		t.Errorf("Expected a map of strings, got %+v", tags)
+	}
+	if s.Properties["parent"].Ref != "#/components/schemas/item" {
+		t.Errorf("Expected the recursive field to reference item, got %+v", s.Properties["parent"])
+	}
+
+	if _, err := json.Marshal(doc); err != nil {
+		t.Fatal(err)
+	}
+}
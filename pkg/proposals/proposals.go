@@ -0,0 +1,185 @@
+// Package proposals keeps the jobs automated sources asked for until a user
+// approves or rejects them.
+package proposals
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"media_optimizer/pkg/jobstore"
+	"media_optimizer/pkg/uuid"
+)
+
+// Statuses of a proposal. Approved proposals become jobs and are removed.
+const (
+	StatusPending  = "pending"
+	StatusRejected = "rejected"
+)
+
+// ErrNotFound is returned for proposals that don't exist or were approved
+var ErrNotFound = errors.New("proposal not found")
+
+// Proposal is a job awaiting approval, with what a user needs to decide on it
+type Proposal struct {
+	ID      string `json:"id"`
+	Path    string `json:"path"`
+	Profile string `json:"profile,omitempty"`
+	// Origin is what proposed the job, e.g. "sonarr" or "watch <folder>"
+	Origin string `json:"origin"`
+	// Watch is the watch folder whose recipe the job follows, if any
+	Watch  string `json:"watch,omitempty"`
+	Status string `json:"status"`
+	// Source, Duration and the sizes describe the file when it could be
+	// probed; Error says why it couldn't
+	Source           *jobstore.Source `json:"source,omitempty"`
+	Duration         float64          `json:"duration,omitempty"`
+	InputBytes       int64            `json:"inputBytes,omitempty"`
+	EstimatedBytes   int64            `json:"estimatedBytes,omitempty"`
+	EstimatedSavings int64            `json:"estimatedSavings,omitempty"`
+	Error            string           `json:"error,omitempty"`
+	CreatedAt        time.Time        `json:"createdAt"`
+	// RejectedAt and RejectedBy are set once a user rejected the proposal
+	RejectedAt time.Time `json:"rejectedAt,omitempty"`
+	RejectedBy string    `json:"rejectedBy,omitempty"`
+}
+
+// Store keeps proposals in memory and persists them to a JSON file
+type Store struct {
+	mu        sync.RWMutex
+	path      string
+	proposals map[string]*Proposal
+}
+
+// Open loads the store from path, starting empty if the file does not exist
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, proposals: make(map[string]*Proposal)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proposals %s: %v", path, err)
+	}
+	var proposals []*Proposal
+	if err := json.Unmarshal(data, &proposals); err != nil {
+		return nil, fmt.Errorf("failed to parse proposals %s: %v", path, err)
+	}
+	for _, p := range proposals {
+		s.proposals[p.ID] = p
+	}
+	return s, nil
+}
+
+// Add records p as a new pending proposal and returns it with its ID
+func (s *Store) Add(p Proposal) (Proposal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p.ID = uuid.New()
+	p.Status = StatusPending
+	p.CreatedAt = time.Now()
+	s.proposals[p.ID] = &p
+	return p, s.save()
+}
+
+// Get returns the proposal with the given ID
+func (s *Store) Get(id string) (Proposal, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.proposals[id]
+	if !ok {
+		return Proposal{}, ErrNotFound
+	}
+	return *p, nil
+}
+
+// Find returns the newest proposal for path
+func (s *Store) Find(path string) (Proposal, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.sorted() {
+		if p.Path == path {
+			return p, true
+		}
+	}
+	return Proposal{}, false
+}
+
+// List returns every proposal, newest first
+func (s *Store) List() []Proposal {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.sorted()
+}
+
+// Reject marks the pending proposal with the given ID rejected by user
+func (s *Store) Reject(id, user string) (Proposal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.proposals[id]
+	if !ok {
+		return Proposal{}, ErrNotFound
+	}
+	if p.Status != StatusPending {
+		return Proposal{}, fmt.Errorf("proposal is %s", p.Status)
+	}
+	p.Status = StatusRejected
+	p.RejectedAt = time.Now()
+	p.RejectedBy = user
+	return *p, s.save()
+}
+
+// Remove deletes the proposal with the given ID, e.g. once it was approved
+func (s *Store) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.proposals[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.proposals, id)
+	return s.save()
+}
+
+// sorted returns proposal copies ordered newest first. Callers must hold
+// the lock.
+func (s *Store) sorted() []Proposal {
+	proposals := make([]Proposal, 0, len(s.proposals))
+	for _, p := range s.proposals {
+		proposals = append(proposals, *p)
+	}
+	sort.Slice(proposals, func(i, j int) bool {
+		if proposals[i].CreatedAt.Equal(proposals[j].CreatedAt) {
+			return proposals[i].ID > proposals[j].ID
+		}
+		return proposals[i].CreatedAt.After(proposals[j].CreatedAt)
+	})
+	return proposals
+}
+
+// save writes the store to disk via a temp file and rename. Callers must
+// hold the lock.
+func (s *Store) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create proposals directory: %v", err)
+	}
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode proposals: %v", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write proposals: %v", err)
+	}
+	return os.Rename(tmp, s.path)
+}
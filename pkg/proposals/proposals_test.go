@@ -0,0 +1,57 @@
+package proposals
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proposals.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	first, err := store.Add(Proposal{Path: "/media/movie.mkv", Origin: "radarr", InputBytes: 100, EstimatedSavings: 40})
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if first.ID == "" || first.Status != StatusPending || first.CreatedAt.IsZero() {
+		t.Errorf("Unexpected proposal %+v", first)
+	}
+	second, _ := store.Add(Proposal{Path: "/media/show.mkv", Origin: "sonarr"})
+
+	rejected, err := store.Reject(first.ID, "alice")
+	if err != nil {
+		t.Fatalf("Reject failed: %v", err)
+	}
+	if rejected.Status != StatusRejected || rejected.RejectedBy != "alice" || rejected.RejectedAt.IsZero() {
+		t.Errorf("Unexpected rejected proposal %+v", rejected)
+	}
+	if _, err := store.Reject(first.ID, "alice"); err == nil {
+		t.Error("Expected rejecting a rejected proposal to fail")
+	}
+
+	// Proposals survive a restart
+	store, err = Open(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	if p, ok := store.Find("/media/movie.mkv"); !ok || p.Status != StatusRejected || p.EstimatedSavings != 40 {
+		t.Errorf("Expected the rejected proposal, got %+v (%v)", p, ok)
+	}
+	if list := store.List(); len(list) != 2 {
+		t.Errorf("Expected both proposals, got %+v", list)
+	}
+
+	if err := store.Remove(second.ID); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := store.Get(second.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, ok := store.Find("/media/show.mkv"); ok {
+		t.Error("Expected no proposal for a removed path")
+	}
+}
@@ -0,0 +1,163 @@
+// Package proxy adapts requests for serving behind reverse proxies such as
+// nginx or Traefik: X-Forwarded-* headers of trusted proxies are applied to
+// the request, and the app can be mounted under a URL prefix.
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Forwarding headers applied from trusted proxies and removed from other
+// requests
+const (
+	HeaderFor   = "X-Forwarded-For"
+	HeaderHost  = "X-Forwarded-Host"
+	HeaderProto = "X-Forwarded-Proto"
+)
+
+// Trusted is the set of proxies whose forwarding headers are believed
+type Trusted struct {
+	nets []*net.IPNet
+}
+
+// NewTrusted parses proxy addresses, each an IP or a CIDR range such as
+// "10.0.0.0/8"
+func NewTrusted(entries []string) (*Trusted, error) {
+	t := &Trusted{}
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			t.nets = append(t.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy range %q", entry)
+		}
+		t.nets = append(t.nets, n)
+	}
+	return t, nil
+}
+
+// Contains reports whether ip is a trusted proxy
+func (t *Trusted) Contains(ip net.IP) bool {
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler applies the forwarding headers of requests from trusted proxies:
+// RemoteAddr becomes the client's address, Host the forwarded host and
+// URL.Scheme the forwarded protocol. Other requests lose these headers, so
+// handlers can't be misled by a client setting them.
+func (t *Trusted) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, port, err := net.SplitHostPort(r.RemoteAddr)
+		peer := net.ParseIP(host)
+		if err != nil || peer == nil || !t.Contains(peer) {
+			r.Header.Del(HeaderFor)
+			r.Header.Del(HeaderHost)
+			r.Header.Del(HeaderProto)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		if client := t.client(r.Header.Values(HeaderFor)); client != nil {
+			r.RemoteAddr = net.JoinHostPort(client.String(), port)
+		}
+		if host := first(r.Header.Get(HeaderHost)); host != "" {
+			r.Host = host
+		}
+		switch proto := strings.ToLower(first(r.Header.Get(HeaderProto))); proto {
+		case "http", "https":
+			r.URL.Scheme = proto
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// client returns the address that reached the first trusted proxy: the
+// last entry of X-Forwarded-For not added by a trusted proxy itself
+func (t *Trusted) client(values []string) net.IP {
+	var hops []string
+	for _, v := range values {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	var client net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !t.Contains(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// first returns the first of comma separated values, which a chain of
+// proxies may append to
+func first(value string) string {
+	v, _, _ := strings.Cut(value, ",")
+	return strings.TrimSpace(v)
+}
+
+// Scheme returns "https" or "http" for the request as the client sent it
+func Scheme(r *http.Request) string {
+	if r.URL.Scheme != "" {
+		return r.URL.Scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// StripPrefix serves the app mounted at prefix, e.g. "/optimizer". Requests
+// below prefix reach next without it, and prefix itself redirects to
+// prefix + "/". Requests outside prefix are served unchanged, for proxies
+// that strip the prefix themselves.
+func StripPrefix(prefix string, next http.Handler) http.Handler {
+	if prefix == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix {
+			target := prefix + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		path, ok := strings.CutPrefix(r.URL.Path, prefix+"/")
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.URL.Path = "/" + path
+		if raw, ok := strings.CutPrefix(r.URL.RawPath, prefix+"/"); ok {
+			r.URL.RawPath = "/" + raw
+		} else {
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
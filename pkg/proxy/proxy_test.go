@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedHandler(t *testing.T) {
+	trusted, err := NewTrusted([]string{"10.0.0.0/8", "192.168.1.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen *http.Request
+	handler := trusted.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+	}))
+
+	tests := []struct {
+		name, remote, forwardedFor, host, proto string
+		wantRemote, wantHost, wantScheme        string
+	}{
+		{"trusted proxy", "10.1.2.3:5000", "203.0.113.7", "media.example.com", "https", "203.0.113.7:5000", "media.example.com", "https"},
+		{"chain of proxies", "192.168.1.5:5000", "198.51.100.1, 203.0.113.7, 10.0.0.2", "", "", "203.0.113.7:5000", "internal:8080", "http"},
+		{"spoofed by a client", "203.0.113.9:5000", "127.0.0.1", "evil.example.com", "https", "203.0.113.9:5000", "internal:8080", "http"},
+		{"unparsable hop", "10.1.2.3:5000", "junk, 203.0.113.7", "", "", "203.0.113.7:5000", "internal:8080", "http"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = "internal:8080"
+		r.RemoteAddr = tt.remote
+		r.Header.Set(HeaderFor, tt.forwardedFor)
+		if tt.host != "" {
+			r.Header.Set(HeaderHost, tt.host)
+		}
+		if tt.proto != "" {
+			r.Header.Set(HeaderProto, tt.proto)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if seen.RemoteAddr != tt.wantRemote || seen.Host != tt.wantHost || Scheme(seen) != tt.wantScheme {
+			t.Errorf("%s: got %s %s %s, want %s %s %s", tt.name, seen.RemoteAddr, seen.Host, Scheme(seen), tt.wantRemote, tt.wantHost, tt.wantScheme)
+		}
+	}
+	if seen.Header.Get(HeaderFor) != "junk, 203.0.113.7" {
+		t.Error("Expected the headers of trusted proxies to be kept")
+	}
+
+	if _, err := NewTrusted([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Expected an invalid range to be rejected")
+	}
+	if _, err := NewTrusted([]string{"proxy.local"}); err == nil {
+		t.Error("Expected a host name to be rejected")
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	var path string
+	handler := StripPrefix("/optimizer", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+	}))
+
+	for request, want := range map[string]string{
+		"/optimizer/api/v1/jobs": "/api/v1/jobs",
+		"/optimizer/":            "/",
+		// Proxies may strip the prefix themselves
+		"/api/v1/jobs": "/api/v1/jobs",
+		"/optimizerx":  "/optimizerx",
+	} {
+		path = ""
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, request, nil))
+		if path != want {
+			t.Errorf("%s: expected %s, got %s", request, want, path)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/optimizer?x=1", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/optimizer/?x=1" {
+		t.Errorf("Expected a redirect to the app's root, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,160 @@
+// Package quarantine keeps outputs that failed verification out of the
+// media library until someone reviews them and approves or discards them.
+package quarantine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"media_optimizer/pkg/trash"
+)
+
+// ErrNotFound is returned for entries that were never quarantined or have
+// been approved or discarded
+var ErrNotFound = errors.New("not in quarantine")
+
+// entryFile holds the metadata of an entry next to the quarantined file
+const entryFile = "entry.json"
+
+// Entry is one quarantined output
+type Entry struct {
+	// ID is the ID of the job that wrote the output
+	ID         string `json:"id"`
+	SourcePath string `json:"sourcePath"`
+	// OutputPath is where the output is put when approved
+	OutputPath string `json:"outputPath"`
+	// Path is where the output is kept meanwhile, for review
+	Path string `json:"path"`
+	// Reason is the verification failure
+	Reason        string    `json:"reason"`
+	Size          int64     `json:"size"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+}
+
+// Store moves outputs into a directory with one subdirectory per entry
+type Store struct {
+	dir string
+}
+
+// Open uses dir for quarantined outputs
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create quarantine directory: %v", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Put moves the output at path into quarantine under the ID of entry, whose
+// SourcePath, OutputPath and Reason describe it
+func (s *Store) Put(entry Entry, path string) (Entry, error) {
+	if !validID(entry.ID) {
+		return Entry{}, fmt.Errorf("invalid quarantine id %q", entry.ID)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	entryDir := filepath.Join(s.dir, entry.ID)
+	if _, err := os.Stat(entryDir); err == nil {
+		return Entry{}, fmt.Errorf("quarantine entry %s already exists", entry.ID)
+	}
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		return Entry{}, fmt.Errorf("failed to create quarantine entry: %v", err)
+	}
+
+	entry.Path = filepath.Join(entryDir, filepath.Base(entry.OutputPath))
+	entry.Size = info.Size()
+	entry.QuarantinedAt = time.Now()
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(entryDir, entryFile), data, 0644)
+	}
+	if err == nil {
+		err = trash.Move(path, entry.Path)
+	}
+	if err != nil {
+		os.RemoveAll(entryDir)
+		return Entry{}, fmt.Errorf("failed to quarantine %s: %v", path, err)
+	}
+	return entry, nil
+}
+
+// Get returns the entry with the given id
+func (s *Store) Get(id string) (Entry, error) {
+	if !validID(id) {
+		return Entry{}, ErrNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, id, entryFile))
+	if os.IsNotExist(err) {
+		return Entry{}, ErrNotFound
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return Entry{}, fmt.Errorf("invalid quarantine entry %s: %v", id, err)
+	}
+	return entry, nil
+}
+
+// List returns every entry, most recently quarantined first
+func (s *Store) List() ([]Entry, error) {
+	dirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := []Entry{}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		if entry, err := s.Get(d.Name()); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].QuarantinedAt.After(entries[j].QuarantinedAt)
+	})
+	return entries, nil
+}
+
+// Approve moves the output with the given id to its output path and removes
+// the entry. It fails when something else occupies that path.
+func (s *Store) Approve(id string) (Entry, error) {
+	entry, err := s.Get(id)
+	if err != nil {
+		return Entry{}, err
+	}
+	if _, err := os.Lstat(entry.OutputPath); err == nil {
+		return Entry{}, fmt.Errorf("%s already exists", entry.OutputPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(entry.OutputPath), 0755); err != nil {
+		return Entry{}, err
+	}
+	if err := trash.Move(entry.Path, entry.OutputPath); err != nil {
+		return Entry{}, fmt.Errorf("failed to approve %s: %v", entry.OutputPath, err)
+	}
+	return entry, os.RemoveAll(filepath.Join(s.dir, id))
+}
+
+// Discard deletes the output with the given id and its entry
+func (s *Store) Discard(id string) (Entry, error) {
+	entry, err := s.Get(id)
+	if err != nil {
+		return Entry{}, err
+	}
+	return entry, os.RemoveAll(filepath.Join(s.dir, id))
+}
+
+// validID rejects IDs that would escape the quarantine directory
+func validID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
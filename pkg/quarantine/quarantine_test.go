@@ -0,0 +1,67 @@
+package quarantine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutApproveDiscard(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(filepath.Join(dir, "quarantine"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	output := filepath.Join(dir, "movie_optimized.mkv")
+	partial := filepath.Join(dir, ".partial-movie_optimized.mkv")
+	os.WriteFile(partial, []byte("optimized"), 0644)
+	entry, err := store.Put(Entry{ID: "job1", SourcePath: filepath.Join(dir, "movie.mkv"), OutputPath: output, Reason: "truncated"}, partial)
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Expected the output to be moved, got %v", err)
+	}
+	if entry.Size != 9 || filepath.Base(entry.Path) != "movie_optimized.mkv" || entry.Reason != "truncated" {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+	if entries, _ := store.List(); len(entries) != 1 || entries[0].Path != entry.Path {
+		t.Errorf("Expected the entry listed, got %+v", entries)
+	}
+
+	// A file at the output path blocks the approval
+	os.WriteFile(output, []byte("other"), 0644)
+	if _, err := store.Approve("job1"); err == nil {
+		t.Error("Expected Approve over an existing file to fail")
+	}
+	os.Remove(output)
+	if _, err := store.Approve("job1"); err != nil {
+		t.Fatalf("Approve failed: %v", err)
+	}
+	if data, _ := os.ReadFile(output); string(data) != "optimized" {
+		t.Errorf("Expected the output in place, got %q", data)
+	}
+	if _, err := store.Get("job1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the entry to be gone, got %v", err)
+	}
+
+	os.WriteFile(partial, []byte("optimized"), 0644)
+	entry, err = store.Put(Entry{ID: "job2", OutputPath: filepath.Join(dir, "other.mkv")}, partial)
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := store.Discard("job2"); err != nil {
+		t.Fatalf("Discard failed: %v", err)
+	}
+	if _, err := os.Stat(entry.Path); !os.IsNotExist(err) {
+		t.Errorf("Expected the output to be deleted, got %v", err)
+	}
+	if _, err := store.Discard("job2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a discarded entry, got %v", err)
+	}
+	if _, err := store.Get("../job1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an invalid id, got %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := New(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("10.0.0.1"); !ok {
+			t.Fatalf("Expected request %d of the burst to be allowed", i+1)
+		}
+	}
+	ok, wait := l.Allow("10.0.0.1")
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("Expected the fourth request to wait 500ms, got %v %v", ok, wait)
+	}
+	if ok, _ := l.Allow("10.0.0.2"); !ok {
+		t.Error("Expected other clients to have their own bucket")
+	}
+
+	now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("10.0.0.1"); !ok {
+			t.Errorf("Expected request %d after a second to be allowed", i+1)
+		}
+	}
+	if ok, _ := l.Allow("10.0.0.1"); ok {
+		t.Error("Expected the refill to be limited to the rate")
+	}
+
+	// Idle clients are dropped once refilled
+	now = now.Add(sweepInterval)
+	l.Allow("10.0.0.3")
+	if len(l.clients) != 1 {
+		t.Errorf("Expected only the new client after a sweep, got %d", len(l.clients))
+	}
+
+	var nilLimiter *Limiter
+	if ok, _ := nilLimiter.Allow("10.0.0.1"); !ok {
+		t.Error("Expected a nil limiter to allow everything")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	l := New(1, 1)
+	handler := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	codes := []int{}
+	for _, remote := range []string{"192.0.2.1:1000", "192.0.2.1:2000", "192.0.2.2:1000"} {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/browse", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		codes = append(codes, w.Code)
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("Expected Retry-After: 1, got %q", w.Header().Get("Retry-After"))
+		}
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests || codes[2] != http.StatusOK {
+		t.Errorf("Expected the second request of a client to be limited, got %v", codes)
+	}
+}
@@ -0,0 +1,144 @@
+package rebuild
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Deployment modes
+const (
+	// ModeAuto picks ModeDocker inside a container and ModeSystemd otherwise
+	ModeAuto = "auto"
+	// ModeSystemd pulls the source, rebuilds the binary and restarts the unit
+	ModeSystemd = "systemd"
+	// ModeDocker optionally pulls a new image and exits so the container
+	// runtime restarts the server
+	ModeDocker = "docker"
+)
+
+// DefaultRestartCode is the exit status used to ask the container runtime
+// for a restart (EX_TEMPFAIL)
+const DefaultRestartCode = 75
+
+// Strategy updates the running server in a way that suits how it is deployed
+type Strategy interface {
+	// Name is the deployment mode the strategy implements
+	Name() string
+	Rebuild() RebuildResult
+}
+
+// DockerOptions configures the container deployment strategy
+type DockerOptions struct {
+	// Image is pulled before exiting, e.g. "ghcr.io/org/media-optimizer".
+	// Empty skips the pull and only restarts.
+	Image string
+	// Tag defaults to "latest"
+	Tag string
+	// RestartCode is the exit status; zero means DefaultRestartCode
+	RestartCode int
+}
+
+// NewStrategy returns the strategy for mode, detecting containers for
+// ModeAuto
+func NewStrategy(mode string, docker DockerOptions) (Strategy, error) {
+	if mode == "" || mode == ModeAuto {
+		mode = ModeSystemd
+		if InContainer() {
+			mode = ModeDocker
+		}
+	}
+	switch mode {
+	case ModeSystemd:
+		return systemdStrategy{}, nil
+	case ModeDocker:
+		if docker.Tag == "" {
+			docker.Tag = "latest"
+		}
+		if docker.RestartCode == 0 {
+			docker.RestartCode = DefaultRestartCode
+		}
+		return &DockerStrategy{opts: docker}, nil
+	default:
+		return nil, fmt.Errorf("unknown deployment mode %q", mode)
+	}
+}
+
+// systemdStrategy is the original git pull, build and service restart
+type systemdStrategy struct{}
+
+func (systemdStrategy) Name() string { return ModeSystemd }
+
+func (systemdStrategy) Rebuild() RebuildResult { return ExecuteRebuild() }
+
+// DockerStrategy replaces rebuilding in place, which is meaningless in an
+// image, with an image pull and a restart-expected exit
+type DockerStrategy struct {
+	opts DockerOptions
+}
+
+func (d *DockerStrategy) Name() string { return ModeDocker }
+
+// ImageRef returns the image reference that is pulled, or "" for none
+func (d *DockerStrategy) ImageRef() string {
+	if d.opts.Image == "" {
+		return ""
+	}
+	return d.opts.Image + ":" + d.opts.Tag
+}
+
+// Rebuild pulls the configured image through the docker CLI, which needs the
+// host's docker socket mounted into the container. A pulled image is only
+// used once the container is recreated, e.g. by watchtower or compose.
+func (d *DockerStrategy) Rebuild() RebuildResult {
+	result := RebuildResult{Success: false}
+
+	if ref := d.ImageRef(); ref != "" {
+		log.Printf("Pulling image %s...", ref)
+		cmd := exec.Command("docker", "pull", ref)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			result.Error = fmt.Errorf("failed to pull %s: %v", ref, err)
+			result.Message = "Failed to pull image"
+			return result
+		}
+	}
+
+	result.Success = true
+	result.ExitCode = d.opts.RestartCode
+	result.Message = fmt.Sprintf("Exiting with status %d for the container to be restarted", d.opts.RestartCode)
+	return result
+}
+
+// InContainer reports whether the process runs inside a Docker, Podman or
+// Kubernetes container
+func InContainer() bool {
+	return inContainer("/", os.Getenv("container"))
+}
+
+// inContainer checks the container markers below root; env is the value of
+// $container, which Podman and systemd-nspawn set
+func inContainer(root, env string) bool {
+	if env != "" {
+		return true
+	}
+	for _, marker := range []string{".dockerenv", "run/.containerenv"} {
+		if _, err := os.Stat(root + marker); err == nil {
+			return true
+		}
+	}
+	data, err := os.ReadFile(root + "proc/1/cgroup")
+	if err != nil {
+		return false
+	}
+	cgroup := string(data)
+	for _, runtime := range []string{"docker", "kubepods", "containerd", "libpod"} {
+		if strings.Contains(cgroup, runtime) {
+			return true
+		}
+	}
+	return false
+}
@@ -184,6 +184,9 @@ type RebuildResult struct {
 	Success bool
 	Message string
 	Error   error
+	// ExitCode is non-zero when the server should exit with it to be
+	// restarted by its supervisor
+	ExitCode int
 }
 
 // ExecuteRebuild performs the rebuild process
@@ -0,0 +1,59 @@
+package rebuild
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInContainer(t *testing.T) {
+	root := t.TempDir() + "/"
+	if inContainer(root, "") {
+		t.Fatal("Expected no container without markers")
+	}
+	if !inContainer(root, "podman") {
+		t.Error("Expected $container to mark a container")
+	}
+
+	cgroup := filepath.Join(root, "proc", "1", "cgroup")
+	os.MkdirAll(filepath.Dir(cgroup), 0755)
+	os.WriteFile(cgroup, []byte("0::/system.slice/media-optimizer.service\n"), 0644)
+	if inContainer(root, "") {
+		t.Error("Expected a systemd cgroup not to mark a container")
+	}
+	os.WriteFile(cgroup, []byte("0::/docker/4f2a9c\n"), 0644)
+	if !inContainer(root, "") {
+		t.Error("Expected a docker cgroup to mark a container")
+	}
+
+	other := t.TempDir() + "/"
+	os.WriteFile(filepath.Join(other, ".dockerenv"), nil, 0644)
+	if !inContainer(other, "") {
+		t.Error("Expected /.dockerenv to mark a container")
+	}
+}
+
+func TestNewStrategy(t *testing.T) {
+	s, err := NewStrategy(ModeDocker, DockerOptions{Image: "example/media-optimizer"})
+	if err != nil {
+		t.Fatalf("NewStrategy failed: %v", err)
+	}
+	docker := s.(*DockerStrategy)
+	if ref := docker.ImageRef(); ref != "example/media-optimizer:latest" {
+		t.Errorf("Expected the latest tag by default, got %q", ref)
+	}
+
+	// Without an image the strategy only asks for a restart
+	s, _ = NewStrategy(ModeDocker, DockerOptions{})
+	result := s.Rebuild()
+	if !result.Success || result.ExitCode != DefaultRestartCode {
+		t.Errorf("Expected a restart with status %d, got %+v", DefaultRestartCode, result)
+	}
+
+	if s, _ := NewStrategy(ModeSystemd, DockerOptions{}); s.Name() != ModeSystemd {
+		t.Errorf("Expected the systemd strategy, got %s", s.Name())
+	}
+	if _, err := NewStrategy("kubernetes", DockerOptions{}); err == nil {
+		t.Error("Expected an unknown mode to be rejected")
+	}
+}
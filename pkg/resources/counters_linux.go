@@ -0,0 +1,44 @@
+package resources
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// readCounters reads the cumulative CPU, memory and disk counters from /proc
+func readCounters() (counters, error) {
+	c := counters{time: time.Now()}
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return c, err
+	}
+	if c.cpuBusy, c.cpuTotal, err = parseStat(data); err != nil {
+		return c, err
+	}
+	if data, err = os.ReadFile("/proc/meminfo"); err != nil {
+		return c, err
+	}
+	if c.memTotal, c.memAvailable, err = parseMeminfo(data); err != nil {
+		return c, err
+	}
+	// Disk statistics are missing in some containers; CPU and memory still
+	// count then
+	if data, err = os.ReadFile("/proc/diskstats"); err == nil {
+		c.diskBusy = parseDiskstats(data, wholeDisk)
+	}
+	return c, nil
+}
+
+// wholeDisk reports whether the block device name is a disk rather than a
+// partition, loop or RAM device, whose activity a disk already counts or
+// that doesn't wait on hardware
+func wholeDisk(name string) bool {
+	if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "zram") {
+		return false
+	}
+	// Partitions appear under their disk in /sys/block
+	_, err := os.Stat(filepath.Join("/sys/block", name))
+	return err == nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package resources
+
+// readCounters is only implemented on Linux, where /proc exposes the
+// counters
+func readCounters() (counters, error) {
+	return counters{}, ErrUnsupported
+}
@@ -0,0 +1,267 @@
+// Package resources samples how busy the host is, so that new jobs can wait
+// while other programs, such as a media server transcoding for a viewer,
+// need the CPU, memory or disks.
+package resources
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnsupported is returned by NewMonitor on platforms it can't sample
+var ErrUnsupported = errors.New("resource monitoring is only supported on Linux")
+
+// Sample is the use of the host's resources over a sampling interval, each a
+// fraction from 0 to 1
+type Sample struct {
+	Time time.Time `json:"time"`
+	// CPU is the share of time the CPUs were busy
+	CPU float64 `json:"cpu"`
+	// Memory is the share of memory not available to new programs
+	Memory float64 `json:"memory"`
+	// Disk is the share of time the busiest disk was serving requests
+	Disk float64 `json:"disk"`
+}
+
+// Limits are the use of each resource above which the host is under
+// pressure, fractions from 0 to 1. Zero ignores a resource.
+type Limits struct {
+	CPU    float64
+	Memory float64
+	Disk   float64
+}
+
+// Pressure describes the resources s uses beyond the limits, e.g. "cpu 93%",
+// empty when there are none
+func (l Limits) Pressure(s Sample) []string {
+	var reasons []string
+	check := func(name string, used, limit float64) {
+		if limit > 0 && used > limit {
+			reasons = append(reasons, fmt.Sprintf("%s %.0f%%", name, used*100))
+		}
+	}
+	check("cpu", s.CPU, l.CPU)
+	check("memory", s.Memory, l.Memory)
+	check("disk", s.Disk, l.Disk)
+	return reasons
+}
+
+// counters are the cumulative readings samples are computed from
+type counters struct {
+	time time.Time
+	// cpuBusy and cpuTotal are in clock ticks summed over all CPUs
+	cpuBusy, cpuTotal uint64
+	// memTotal and memAvailable are in kB
+	memTotal, memAvailable uint64
+	// diskBusy holds the milliseconds each disk spent serving requests
+	diskBusy map[string]uint64
+}
+
+// sample returns the use of resources between the readings prev and cur
+func sample(prev, cur counters) Sample {
+	s := Sample{Time: cur.time}
+	if cur.cpuTotal > prev.cpuTotal && cur.cpuBusy >= prev.cpuBusy {
+		s.CPU = float64(cur.cpuBusy-prev.cpuBusy) / float64(cur.cpuTotal-prev.cpuTotal)
+	}
+	if cur.memTotal > 0 && cur.memAvailable <= cur.memTotal {
+		s.Memory = 1 - float64(cur.memAvailable)/float64(cur.memTotal)
+	}
+	if elapsed := cur.time.Sub(prev.time).Milliseconds(); elapsed > 0 {
+		for disk, busy := range cur.diskBusy {
+			before, ok := prev.diskBusy[disk]
+			if !ok || busy < before {
+				continue
+			}
+			s.Disk = max(s.Disk, min(float64(busy-before)/float64(elapsed), 1))
+		}
+	}
+	return s
+}
+
+// parseStat returns the busy and total CPU time from /proc/stat. Time spent
+// idle or waiting for I/O counts as not busy.
+func parseStat(data []byte) (busy, total uint64, err error) {
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, fmt.Errorf("unexpected /proc/stat line %q", line)
+	}
+	// Guest time is already included in user and nice
+	if len(fields) > 9 {
+		fields = fields[:9]
+	}
+	var idle uint64
+	for i, f := range fields[1:] {
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid /proc/stat field %q: %v", f, err)
+		}
+		total += n
+		// idle and iowait
+		if i == 3 || i == 4 {
+			idle += n
+		}
+	}
+	return total - idle, total, nil
+}
+
+// parseMeminfo returns the total and available memory from /proc/meminfo
+func parseMeminfo(data []byte) (total, available uint64, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total, err = strconv.ParseUint(fields[1], 10, 64)
+		case "MemAvailable:":
+			available, err = strconv.ParseUint(fields[1], 10, 64)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid /proc/meminfo line %q: %v", scanner.Text(), err)
+		}
+	}
+	if total == 0 {
+		return 0, 0, fmt.Errorf("no MemTotal in /proc/meminfo")
+	}
+	return total, available, nil
+}
+
+// parseDiskstats returns the milliseconds spent serving requests of the
+// devices in /proc/diskstats that disk accepts
+func parseDiskstats(data []byte, disk func(name string) bool) map[string]uint64 {
+	busy := map[string]uint64{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// major minor name, then the I/O ticks as the tenth statistic
+		if len(fields) < 13 || !disk(fields[2]) {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[12], 10, 64); err == nil {
+			busy[fields[2]] = n
+		}
+	}
+	return busy
+}
+
+// Monitor samples the host at an interval and holds back work while it is
+// under pressure. A nil Monitor never holds anything back.
+type Monitor struct {
+	limits   Limits
+	interval time.Duration
+	read     func() (counters, error)
+	onChange func(pressure []string)
+
+	mu       sync.Mutex
+	latest   Sample
+	pressure []string
+	// ready holds the start of the next waiter. Each sample without
+	// pressure puts one back, so that waiting work starts one piece at a
+	// time and each start is judged by a sample taken after the last.
+	ready chan struct{}
+}
+
+// NewMonitor creates a monitor for the limits sampling every interval.
+// onChange may be nil and is called when the host comes under pressure, with
+// its reasons, and when it no longer is, with none.
+func NewMonitor(limits Limits, interval time.Duration, onChange func(pressure []string)) (*Monitor, error) {
+	if _, err := readCounters(); err != nil {
+		return nil, err
+	}
+	m := &Monitor{
+		limits:   limits,
+		interval: interval,
+		read:     readCounters,
+		onChange: onChange,
+		ready:    make(chan struct{}, 1),
+	}
+	// Work may start until a sample says otherwise
+	m.ready <- struct{}{}
+	return m, nil
+}
+
+// Run samples the host every interval until ctx is done
+func (m *Monitor) Run(ctx context.Context) {
+	prev, err := m.read()
+	if err != nil {
+		slog.Error("Failed to sample resources", "error", err)
+	}
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cur, err := m.read()
+		if err != nil {
+			slog.Error("Failed to sample resources", "error", err)
+			continue
+		}
+		m.update(sample(prev, cur))
+		prev = cur
+	}
+}
+
+// update records s and lets the next waiter start if the host isn't under
+// pressure
+func (m *Monitor) update(s Sample) {
+	pressure := m.limits.Pressure(s)
+	m.mu.Lock()
+	changed := (len(pressure) > 0) != (len(m.pressure) > 0)
+	m.latest, m.pressure = s, pressure
+	m.mu.Unlock()
+
+	if changed && m.onChange != nil {
+		m.onChange(pressure)
+	}
+	if len(pressure) == 0 {
+		select {
+		case m.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Latest returns the last sample and what it found under pressure. The
+// sample is zero until the first interval has passed, and for a nil Monitor.
+func (m *Monitor) Latest() (Sample, []string) {
+	if m == nil {
+		return Sample{}, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latest, m.pressure
+}
+
+// UnderPressure reports whether the last sample exceeded a limit
+func (m *Monitor) UnderPressure() bool {
+	_, pressure := m.Latest()
+	return len(pressure) > 0
+}
+
+// Wait blocks until work may start or ctx is done. While several wait, one
+// is let through per sample without pressure.
+func (m *Monitor) Wait(ctx context.Context) error {
+	if m == nil {
+		return nil
+	}
+	select {
+	case <-m.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
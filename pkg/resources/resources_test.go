@@ -0,0 +1,142 @@
+package resources
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseStat(t *testing.T) {
+	data := []byte("cpu  100 20 30 800 50 0 0 0 40 0\ncpu0 50 10 15 400 25 0 0 0 20 0\n")
+	busy, total, err := parseStat(data)
+	if err != nil {
+		t.Fatalf("parseStat failed: %v", err)
+	}
+	// Guest time is left out, idle and iowait aren't busy
+	if busy != 150 || total != 1000 {
+		t.Errorf("Expected 150 busy of 1000, got %d of %d", busy, total)
+	}
+
+	if _, _, err := parseStat([]byte("intr 1 2 3\n")); err == nil {
+		t.Error("Expected an error without the cpu line")
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	data := []byte("MemTotal:       16000000 kB\nMemFree:         1000000 kB\nMemAvailable:    4000000 kB\n")
+	total, available, err := parseMeminfo(data)
+	if err != nil {
+		t.Fatalf("parseMeminfo failed: %v", err)
+	}
+	if total != 16000000 || available != 4000000 {
+		t.Errorf("Expected 4000000 of 16000000 kB available, got %d of %d", available, total)
+	}
+
+	if _, _, err := parseMeminfo([]byte("MemFree: 1 kB\n")); err == nil {
+		t.Error("Expected an error without MemTotal")
+	}
+}
+
+func TestParseDiskstats(t *testing.T) {
+	data := []byte(`   8       0 sda 100 0 800 50 200 0 1600 70 0 1234 120 0 0 0 0
+   8       1 sda1 90 0 700 40 180 0 1500 60 0 1100 100 0 0 0 0
+   7       0 loop0 5 0 10 1 0 0 0 0 0 3 1 0 0 0 0
+`)
+	got := parseDiskstats(data, func(name string) bool { return name == "sda" })
+	if want := map[string]uint64{"sda": 1234}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestSample(t *testing.T) {
+	start := time.Now()
+	prev := counters{
+		time:     start,
+		cpuBusy:  1000,
+		cpuTotal: 4000,
+		diskBusy: map[string]uint64{"sda": 5000, "sdb": 100},
+	}
+	cur := counters{
+		time:         start.Add(10 * time.Second),
+		cpuBusy:      1900,
+		cpuTotal:     5000,
+		memTotal:     1000,
+		memAvailable: 250,
+		diskBusy:     map[string]uint64{"sda": 7000, "sdb": 9100, "sdc": 10},
+	}
+	s := sample(prev, cur)
+	if s.CPU != 0.9 {
+		t.Errorf("Expected 90%% CPU, got %v", s.CPU)
+	}
+	if s.Memory != 0.75 {
+		t.Errorf("Expected 75%% memory, got %v", s.Memory)
+	}
+	// The busiest disk counts, and a disk busy through several queues
+	// at once can't exceed the interval
+	if s.Disk != 0.9 {
+		t.Errorf("Expected 90%% disk, got %v", s.Disk)
+	}
+
+	cur.diskBusy["sda"] = 20000
+	if s := sample(prev, cur); s.Disk != 1 {
+		t.Errorf("Expected disk use capped at 100%%, got %v", s.Disk)
+	}
+}
+
+func TestPressure(t *testing.T) {
+	limits := Limits{CPU: 0.8, Memory: 0.9}
+	if got := limits.Pressure(Sample{CPU: 0.5, Memory: 0.5, Disk: 1}); len(got) != 0 {
+		t.Errorf("Expected no pressure, got %v", got)
+	}
+	got := limits.Pressure(Sample{CPU: 0.93, Memory: 0.95})
+	if want := []string{"cpu 93%", "memory 95%"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestMonitorWait(t *testing.T) {
+	var changes [][]string
+	m := &Monitor{
+		limits:   Limits{CPU: 0.8},
+		onChange: func(pressure []string) { changes = append(changes, pressure) },
+		ready:    make(chan struct{}, 1),
+	}
+	m.ready <- struct{}{}
+
+	// The first start goes through before any sample
+	if err := m.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+
+	m.update(Sample{CPU: 0.95})
+	if !m.UnderPressure() {
+		t.Error("Expected pressure above the CPU limit")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.Wait(ctx); err == nil {
+		t.Fatal("Expected Wait to block under pressure")
+	}
+
+	// A sample without pressure lets one waiter through
+	m.update(Sample{CPU: 0.2})
+	m.update(Sample{CPU: 0.3})
+	if err := m.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.Wait(ctx); err == nil {
+		t.Error("Expected the second waiter to wait for the next sample")
+	}
+
+	if len(changes) != 2 || len(changes[0]) != 1 || len(changes[1]) != 0 {
+		t.Errorf("Expected a change into and out of pressure, got %v", changes)
+	}
+
+	var none *Monitor
+	if err := none.Wait(ctx); err != nil || none.UnderPressure() {
+		t.Error("Expected a nil monitor not to hold anything back")
+	}
+}
@@ -0,0 +1,366 @@
+// Package schedule restricts background work to configured time windows,
+// such as only encoding overnight on weekdays.
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CheckInterval is how often a running Gate re-evaluates its schedule
+const CheckInterval = 30 * time.Second
+
+// dayNames maps the accepted day names to time.Weekday
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a daily period in local time, e.g. 01:00 to 07:00. A window whose
+// End is before its Start runs past midnight, and equal times cover the whole
+// day. Days lists the days the window starts on ("mon" to "sun"); empty means
+// every day.
+type Window struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// window is a parsed Window with times in minutes after midnight
+type window struct {
+	days       [7]bool
+	start, end int
+}
+
+// Schedule is a set of windows. Work is allowed while any window is open, or
+// at all times when there are none.
+type Schedule struct {
+	windows []window
+}
+
+// New parses windows into a schedule
+func New(windows []Window) (*Schedule, error) {
+	s := &Schedule{}
+	for i, w := range windows {
+		parsed, err := parseWindow(w)
+		if err != nil {
+			return nil, fmt.Errorf("window %d: %v", i+1, err)
+		}
+		s.windows = append(s.windows, parsed)
+	}
+	return s, nil
+}
+
+func parseWindow(w Window) (window, error) {
+	var parsed window
+	var err error
+	if parsed.start, err = parseClock(w.Start); err != nil {
+		return parsed, err
+	}
+	if parsed.end, err = parseClock(w.End); err != nil {
+		return parsed, err
+	}
+	if len(w.Days) == 0 {
+		for i := range parsed.days {
+			parsed.days[i] = true
+		}
+	}
+	for _, name := range w.Days {
+		day, ok := dayNames[strings.ToLower(name)[:min(3, len(name))]]
+		if !ok {
+			return parsed, fmt.Errorf("unknown day %q", name)
+		}
+		parsed.days[day] = true
+	}
+	return parsed, nil
+}
+
+// parseClock converts "HH:MM" into minutes after midnight
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Always reports whether the schedule has no windows and never closes
+func (s *Schedule) Always() bool {
+	return s == nil || len(s.windows) == 0
+}
+
+// Open reports whether work is allowed at t
+func (s *Schedule) Open(t time.Time) bool {
+	if s.Always() {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	for _, w := range s.windows {
+		switch {
+		case w.start == w.end:
+			if w.days[today] {
+				return true
+			}
+		case w.start < w.end:
+			if w.days[today] && minute >= w.start && minute < w.end {
+				return true
+			}
+		default:
+			// Spans midnight: the evening of a listed day or the early
+			// hours after one
+			if w.days[today] && minute >= w.start || w.days[yesterday] && minute < w.end {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NextOpen returns the first minute at or after t when work is allowed, or
+// the zero time if no window ever opens
+func (s *Schedule) NextOpen(t time.Time) time.Time {
+	if s.Open(t) {
+		return t
+	}
+	next := t.Truncate(time.Minute)
+	for i := 0; i < 8*24*60; i++ {
+		next = next.Add(time.Minute)
+		if s.Open(next) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// Period is a stretch of time when work is allowed
+type Period struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Periods returns the stretches between from and to when work is allowed,
+// in order, with overlapping windows merged. A schedule without windows has
+// none, as it never closes.
+func (s *Schedule) Periods(from, to time.Time) []Period {
+	if s.Always() || !from.Before(to) {
+		return nil
+	}
+	var periods []Period
+	// Start a day early for windows running past midnight into from
+	day := time.Date(from.Year(), from.Month(), from.Day()-1, 0, 0, 0, 0, from.Location())
+	for ; day.Before(to); day = day.AddDate(0, 0, 1) {
+		for _, w := range s.windows {
+			if !w.days[day.Weekday()] {
+				continue
+			}
+			p := Period{Start: day, End: day.AddDate(0, 0, 1)}
+			if w.start != w.end {
+				p.Start = clock(day, w.start)
+				p.End = clock(day, w.end)
+				if w.end < w.start {
+					p.End = clock(day.AddDate(0, 0, 1), w.end)
+				}
+			}
+			if p.Start.Before(from) {
+				p.Start = from
+			}
+			if p.End.After(to) {
+				p.End = to
+			}
+			if p.Start.Before(p.End) {
+				periods = append(periods, p)
+			}
+		}
+	}
+
+	sort.Slice(periods, func(i, j int) bool { return periods[i].Start.Before(periods[j].Start) })
+	var merged []Period
+	for _, p := range periods {
+		if last := len(merged) - 1; last >= 0 && !p.Start.After(merged[last].End) {
+			if p.End.After(merged[last].End) {
+				merged[last].End = p.End
+			}
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+// clock returns the time minute minutes into the day of midnight
+func clock(midnight time.Time, minute int) time.Time {
+	return time.Date(midnight.Year(), midnight.Month(), midnight.Day(), 0, minute, 0, 0, midnight.Location())
+}
+
+// Gate lets work through while its schedule is open and it isn't held or
+// blocked. Run keeps it up to date and reports every transition to onChange.
+type Gate struct {
+	schedule *Schedule
+	onChange func(open bool)
+	// changing serializes transitions so onChange sees them in order
+	changing sync.Mutex
+
+	mu        sync.Mutex
+	open      bool
+	scheduled bool
+	held      bool
+	// blocks are the reasons the gate is blocked for, see Block
+	blocks map[string]bool
+	// opened is closed when the gate next opens
+	opened chan struct{}
+}
+
+// NewGate creates a gate for s in the state of the current time. onChange
+// may be nil and is only called for later transitions.
+func NewGate(s *Schedule, onChange func(open bool)) *Gate {
+	g := &Gate{
+		schedule: s,
+		onChange: onChange,
+		blocks:   map[string]bool{},
+		opened:   make(chan struct{}),
+	}
+	g.scheduled = s.Open(time.Now())
+	g.open = g.scheduled
+	if g.open {
+		close(g.opened)
+	}
+	return g
+}
+
+// Run re-evaluates the schedule every CheckInterval until ctx is done
+func (g *Gate) Run(ctx context.Context) {
+	if g.schedule.Always() {
+		return
+	}
+	ticker := time.NewTicker(CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			g.update(now)
+		}
+	}
+}
+
+// update opens or closes the gate for the time now
+func (g *Gate) update(now time.Time) {
+	g.changing.Lock()
+	defer g.changing.Unlock()
+	g.mu.Lock()
+	g.scheduled = g.schedule.Open(now)
+	g.transition()
+}
+
+// Hold closes the gate regardless of the schedule, e.g. while an operator
+// pauses the work, until it is called with false
+func (g *Gate) Hold(held bool) {
+	g.changing.Lock()
+	defer g.changing.Unlock()
+	g.mu.Lock()
+	g.held = held
+	g.transition()
+}
+
+// Block closes the gate for reason, e.g. someone streaming from a media
+// server, until it is called with blocked false. Unlike Hold, which stands
+// for an operator pausing the work, blocks follow conditions the server
+// watches, and the gate opens once none is left.
+func (g *Gate) Block(reason string, blocked bool) {
+	g.changing.Lock()
+	defer g.changing.Unlock()
+	g.mu.Lock()
+	if blocked {
+		g.blocks[reason] = true
+	} else {
+		delete(g.blocks, reason)
+	}
+	g.transition()
+}
+
+// Blocks returns the reasons the gate is blocked for, sorted
+func (g *Gate) Blocks() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var reasons []string
+	for reason := range g.blocks {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// Held reports whether the gate is held closed
+func (g *Gate) Held() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.held
+}
+
+// transition opens or closes the gate for the schedule and the hold and
+// reports a change to onChange. Callers must hold g.mu, which it unlocks.
+func (g *Gate) transition() {
+	open := g.scheduled && !g.held && len(g.blocks) == 0
+	if open == g.open {
+		g.mu.Unlock()
+		return
+	}
+	g.open = open
+	if open {
+		close(g.opened)
+	} else {
+		g.opened = make(chan struct{})
+	}
+	g.mu.Unlock()
+
+	if g.onChange != nil {
+		g.onChange(open)
+	}
+}
+
+// IsOpen reports whether work is currently allowed
+func (g *Gate) IsOpen() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.open
+}
+
+// NextOpen returns when the gate opens next, see Schedule.NextOpen. It is
+// the zero time while the gate is held or blocked, which nothing schedules.
+func (g *Gate) NextOpen() time.Time {
+	if g.Held() || len(g.Blocks()) > 0 {
+		return time.Time{}
+	}
+	return g.schedule.NextOpen(time.Now())
+}
+
+// Schedule returns the schedule the gate follows
+func (g *Gate) Schedule() *Schedule {
+	return g.schedule
+}
+
+// Wait blocks until the gate is open or ctx is done
+func (g *Gate) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	opened := g.opened
+	g.mu.Unlock()
+
+	select {
+	case <-opened:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,151 @@
+package schedule
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// at returns a local time on the week of Monday 2024-01-01
+func at(day, hour, minute int) time.Time {
+	return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+}
+
+func TestOpen(t *testing.T) {
+	s, err := New([]Window{
+		{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "01:00", End: "07:00"},
+		{Days: []string{"Saturday"}, Start: "22:00", End: "08:00"},
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	cases := []struct {
+		time time.Time
+		open bool
+	}{
+		{at(1, 0, 59), false}, // Monday before the window
+		{at(1, 1, 0), true},
+		{at(1, 6, 59), true},
+		{at(1, 7, 0), false},
+		{at(6, 3, 0), false}, // Saturday has no early window
+		{at(6, 22, 30), true},
+		{at(7, 7, 59), true}, // Saturday's window runs into Sunday
+		{at(7, 8, 0), false},
+		{at(7, 23, 0), false},
+	}
+	for _, c := range cases {
+		if got := s.Open(c.time); got != c.open {
+			t.Errorf("Open(%s) = %v, expected %v", c.time.Format("Mon 15:04"), got, c.open)
+		}
+	}
+
+	if next := s.NextOpen(at(1, 12, 30)); !next.Equal(at(2, 1, 0)) {
+		t.Errorf("Expected the next window on Tuesday 01:00, got %s", next)
+	}
+
+	if _, err := New([]Window{{Start: "25:00", End: "07:00"}}); err == nil {
+		t.Error("Expected an invalid time to be rejected")
+	}
+	if _, err := New([]Window{{Days: []string{"someday"}, Start: "01:00", End: "07:00"}}); err == nil {
+		t.Error("Expected an unknown day to be rejected")
+	}
+	if empty, _ := New(nil); !empty.Open(at(3, 19, 0)) {
+		t.Error("Expected a schedule without windows to be always open")
+	}
+}
+
+func TestPeriods(t *testing.T) {
+	s, err := New([]Window{
+		{Days: []string{"mon", "tue"}, Start: "01:00", End: "07:00"},
+		{Days: []string{"tue"}, Start: "06:00", End: "08:00"},
+		{Days: []string{"sun"}, Start: "22:00", End: "02:00"},
+		{Days: []string{"wed"}, Start: "00:00", End: "00:00"},
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	// From Sunday 23:00, inside Sunday's window, which Monday's continues
+	sunday := time.Date(2023, 12, 31, 23, 0, 0, 0, time.Local)
+	got := s.Periods(sunday, at(3, 12, 0))
+	expected := []Period{
+		{sunday, at(1, 7, 0)},
+		{at(2, 1, 0), at(2, 8, 0)}, // Tuesday's windows overlap
+		{at(3, 0, 0), at(3, 12, 0)},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Periods = %v, expected %v", got, expected)
+	}
+
+	if periods := s.Periods(at(1, 8, 0), at(1, 20, 0)); len(periods) != 0 {
+		t.Errorf("Expected no periods on Monday daytime, got %v", periods)
+	}
+	if empty, _ := New(nil); empty.Periods(at(1, 0, 0), at(8, 0, 0)) != nil {
+		t.Error("Expected a schedule without windows to have no periods")
+	}
+}
+
+func TestGate(t *testing.T) {
+	s, _ := New([]Window{{Start: "01:00", End: "07:00"}})
+	var changes []bool
+	g := NewGate(s, func(open bool) { changes = append(changes, open) })
+
+	g.update(at(1, 12, 0))
+	if g.IsOpen() {
+		t.Fatal("Expected the gate to close outside the window")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := g.Wait(ctx); err == nil {
+		t.Error("Expected Wait to block while closed")
+	}
+
+	done := make(chan error)
+	go func() { done <- g.Wait(context.Background()) }()
+	g.update(at(2, 2, 0))
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Wait failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Wait to return once the gate opened")
+	}
+	if len(changes) == 0 || !changes[len(changes)-1] {
+		t.Errorf("Expected the opening to be reported, got %v", changes)
+	}
+	// A hold closes the gate inside the window until it is released
+	before := len(changes)
+	g.Hold(true)
+	g.update(at(2, 3, 0))
+	if g.IsOpen() || !g.NextOpen().IsZero() {
+		t.Error("Expected a held gate to stay closed")
+	}
+	g.Hold(false)
+	if !g.IsOpen() {
+		t.Error("Expected the gate to open once released inside the window")
+	}
+	if got := changes[before:]; len(got) != 2 || got[0] || !got[1] {
+		t.Errorf("Expected the hold and its release to be reported, got %v", got)
+	}
+
+	// Blocks close the gate until the last is lifted, independent of a hold
+	g.Block("streaming", true)
+	g.Block("backup", true)
+	if g.IsOpen() || g.Held() {
+		t.Error("Expected a blocked gate to be closed but not held")
+	}
+	if got := g.Blocks(); !reflect.DeepEqual(got, []string{"backup", "streaming"}) {
+		t.Errorf("Expected both blocks, got %v", got)
+	}
+	g.Block("streaming", false)
+	if g.IsOpen() {
+		t.Error("Expected the gate to stay closed while blocked for another reason")
+	}
+	g.Block("backup", false)
+	if !g.IsOpen() {
+		t.Error("Expected the gate to open once no block is left")
+	}
+}
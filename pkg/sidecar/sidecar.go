@@ -0,0 +1,88 @@
+// Package sidecar finds the files media servers keep next to a video, such
+// as subtitles, NFO metadata and artwork, and names them after another video
+package sidecar
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultExtensions are the sidecar file types when none are configured
+var DefaultExtensions = []string{".srt", ".ass", ".ssa", ".sub", ".idx", ".vtt", ".nfo", ".jpg", ".jpeg", ".png", ".tbn"}
+
+// folderArtwork names artwork belonging to a whole folder rather than one
+// video, as Kodi and Jellyfin name it
+var folderArtwork = map[string]bool{
+	"poster": true, "folder": true, "cover": true, "fanart": true, "backdrop": true,
+	"banner": true, "landscape": true, "thumb": true, "logo": true, "clearlogo": true,
+	"clearart": true, "disc": true,
+}
+
+// Transfer is a sidecar of a source and its path next to the output
+type Transfer struct {
+	From string
+	To   string
+	// Shared is folder artwork other videos of the directory may use, which
+	// should be copied rather than moved
+	Shared bool
+}
+
+// Plan returns the sidecars of source with one of extensions, or
+// DefaultExtensions when empty, and where they belong next to output. Files
+// named after the source, like movie.en.srt or movie-poster.jpg, are
+// renamed after the output. Folder artwork such as poster.jpg is only
+// included when the output is in another directory. Nothing is returned
+// when the output has the source's name and directory.
+func Plan(source, output string, extensions []string) ([]Transfer, error) {
+	if len(extensions) == 0 {
+		extensions = DefaultExtensions
+	}
+	srcDir, dstDir := filepath.Dir(source), filepath.Dir(output)
+	srcStem, dstStem := stem(source), stem(output)
+	if srcDir == dstDir && srcStem == dstStem {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var transfers []Transfer
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !hasExtension(name, extensions) {
+			continue
+		}
+		switch {
+		case len(name) > len(srcStem) && strings.HasPrefix(name, srcStem) && (name[len(srcStem)] == '.' || name[len(srcStem)] == '-'):
+			transfers = append(transfers, Transfer{
+				From: filepath.Join(srcDir, name),
+				To:   filepath.Join(dstDir, dstStem+name[len(srcStem):]),
+			})
+		case srcDir != dstDir && folderArtwork[strings.ToLower(stem(name))]:
+			transfers = append(transfers, Transfer{
+				From:   filepath.Join(srcDir, name),
+				To:     filepath.Join(dstDir, name),
+				Shared: true,
+			})
+		}
+	}
+	return transfers, nil
+}
+
+// stem returns the file name of path without its extension
+func stem(path string) string {
+	name := filepath.Base(path)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+func hasExtension(name string, extensions []string) bool {
+	ext := filepath.Ext(name)
+	for _, e := range extensions {
+		if strings.EqualFold(ext, e) {
+			return true
+		}
+	}
+	return false
+}
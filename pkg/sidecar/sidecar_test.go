@@ -0,0 +1,70 @@
+package sidecar
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"Movie.mkv", "Movie.en.srt", "Movie.EN.forced.SRT", "Movie.nfo", "Movie-poster.jpg",
+		"poster.jpg", "fanart.jpg", "Movie 2.srt", "Movie_optimized.mkv", "notes.txt", "Other.nfo",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("a"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "Movie.nfo.d"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	source := filepath.Join(dir, "Movie.mkv")
+
+	transfers, err := Plan(source, filepath.Join(dir, "Movie_optimized.mkv"), nil)
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	got := map[string]Transfer{}
+	for _, tr := range transfers {
+		got[filepath.Base(tr.From)] = tr
+	}
+	for from, to := range map[string]string{
+		"Movie.en.srt":        "Movie_optimized.en.srt",
+		"Movie.EN.forced.SRT": "Movie_optimized.EN.forced.SRT",
+		"Movie.nfo":           "Movie_optimized.nfo",
+		"Movie-poster.jpg":    "Movie_optimized-poster.jpg",
+	} {
+		if tr, ok := got[from]; !ok || tr.To != filepath.Join(dir, to) || tr.Shared {
+			t.Errorf("Expected %s to become %s, got %+v", from, to, tr)
+		}
+	}
+	if len(got) != 4 {
+		t.Errorf("Expected only the sidecars named after the source in its directory, got %+v", transfers)
+	}
+
+	// Folder artwork follows outputs to another directory
+	dst := filepath.Join(dir, "done", "Movie.mkv")
+	transfers, err = Plan(source, dst, []string{".srt", ".jpg"})
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	got = map[string]Transfer{}
+	for _, tr := range transfers {
+		got[filepath.Base(tr.From)] = tr
+	}
+	if tr := got["poster.jpg"]; !tr.Shared || tr.To != filepath.Join(dir, "done", "poster.jpg") {
+		t.Errorf("Expected poster.jpg to be shared, got %+v", tr)
+	}
+	if tr := got["Movie.en.srt"]; tr.To != filepath.Join(dir, "done", "Movie.en.srt") {
+		t.Errorf("Expected the subtitle to keep its name, got %+v", tr)
+	}
+	if _, ok := got["Movie.nfo"]; ok || len(got) != 5 {
+		t.Errorf("Expected the configured extensions only, got %+v", transfers)
+	}
+
+	// An output taking the source's place keeps its sidecars
+	if transfers, _ := Plan(source, filepath.Join(dir, "Movie.mp4"), nil); len(transfers) != 0 {
+		t.Errorf("Expected nothing to do for a replaced source, got %+v", transfers)
+	}
+}
@@ -0,0 +1,445 @@
+package stats
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"media_optimizer/pkg/jobstore"
+)
+
+// maxTopErrors caps the error categories listed per heatmap cell
+const maxTopErrors = 3
+
+// maxCategoryBytes caps the length of an error category
+const maxCategoryBytes = 120
+
+var (
+	// "Movie.2019.1080p.BluRay.x264-GROUP" → GROUP
+	suffixGroup = regexp.MustCompile(`-([A-Za-z0-9]+)$`)
+	// "[Group] Show - 01" → Group
+	prefixGroup = regexp.MustCompile(`^\[([^\]]+)\]`)
+	// Strips volatile details such as paths, numbers and quoted values
+	errorNoise = regexp.MustCompile(`(/[^\s:]+)|("[^"]*")|([0-9]+(\.[0-9]+)?)`)
+)
+
+// ErrorCount is an error category and how often it occurred
+type ErrorCount struct {
+	Error string `json:"error"`
+	Count int    `json:"count"`
+}
+
+// Cell is the failure summary for one value of a source attribute
+type Cell struct {
+	Value       string       `json:"value"`
+	Total       int          `json:"total"`
+	Failed      int          `json:"failed"`
+	FailureRate float64      `json:"failureRate"`
+	TopErrors   []ErrorCount `json:"topErrors,omitempty"`
+}
+
+// Heatmap groups failure summaries by source attribute
+// ("videoCodec", "container", "releaseGroup", "resolution")
+type Heatmap map[string][]Cell
+
+// FailureHeatmap aggregates finished jobs by source attribute so systematic
+// failures stand out. Cells are sorted by failure rate, then volume.
+func FailureHeatmap(records []jobstore.Record) Heatmap {
+	type acc struct {
+		total, failed int
+		errors        map[string]int
+	}
+	cells := make(map[string]map[string]*acc)
+
+	for _, r := range records {
+		if r.Status != "completed" && r.Status != "failed" {
+			continue
+		}
+		for attr, value := range attributes(r) {
+			if cells[attr] == nil {
+				cells[attr] = make(map[string]*acc)
+			}
+			a := cells[attr][value]
+			if a == nil {
+				a = &acc{errors: make(map[string]int)}
+				cells[attr][value] = a
+			}
+			a.total++
+			if r.Status == "failed" {
+				a.failed++
+				a.errors[ErrorCategory(r.Error)]++
+			}
+		}
+	}
+
+	heatmap := make(Heatmap)
+	for attr, values := range cells {
+		for value, a := range values {
+			cell := Cell{
+				Value:       value,
+				Total:       a.total,
+				Failed:      a.failed,
+				FailureRate: float64(a.failed) / float64(a.total),
+			}
+			for e, n := range a.errors {
+				cell.TopErrors = append(cell.TopErrors, ErrorCount{Error: e, Count: n})
+			}
+			sort.Slice(cell.TopErrors, func(i, j int) bool {
+				if cell.TopErrors[i].Count != cell.TopErrors[j].Count {
+					return cell.TopErrors[i].Count > cell.TopErrors[j].Count
+				}
+				return cell.TopErrors[i].Error < cell.TopErrors[j].Error
+			})
+			if len(cell.TopErrors) > maxTopErrors {
+				cell.TopErrors = cell.TopErrors[:maxTopErrors]
+			}
+			heatmap[attr] = append(heatmap[attr], cell)
+		}
+		sort.Slice(heatmap[attr], func(i, j int) bool {
+			a, b := heatmap[attr][i], heatmap[attr][j]
+			if a.FailureRate != b.FailureRate {
+				return a.FailureRate > b.FailureRate
+			}
+			if a.Total != b.Total {
+				return a.Total > b.Total
+			}
+			return a.Value < b.Value
+		})
+	}
+	return heatmap
+}
+
+// attributes extracts the heatmap dimensions of a record. Unknown values are
+// reported as "unknown" so jobs that failed before probing still count.
+func attributes(r jobstore.Record) map[string]string {
+	attrs := map[string]string{
+		"videoCodec":   "unknown",
+		"container":    strings.TrimPrefix(strings.ToLower(filepath.Ext(r.SourcePath)), "."),
+		"releaseGroup": ReleaseGroup(r.SourcePath),
+		"resolution":   "unknown",
+	}
+	if attrs["container"] == "" {
+		attrs["container"] = "unknown"
+	}
+	if attrs["releaseGroup"] == "" {
+		attrs["releaseGroup"] = "none"
+	}
+	if s := r.Source; s != nil {
+		if s.VideoCodec != "" {
+			attrs["videoCodec"] = s.VideoCodec
+		}
+		if s.Container != "" {
+			attrs["container"] = s.Container
+		}
+		if s.Height > 0 {
+			attrs["resolution"] = resolutionClass(s.Height)
+		}
+	}
+	return attrs
+}
+
+// ReleaseGroup extracts the release group from scene-style file names
+func ReleaseGroup(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if m := prefixGroup.FindStringSubmatch(name); m != nil {
+		return m[1]
+	}
+	if m := suffixGroup.FindStringSubmatch(name); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// ErrorCategory reduces an error message to a stable form by dropping paths,
+// numbers and quoted values, so identical failures on different files group
+func ErrorCategory(msg string) string {
+	if msg == "" {
+		return "unknown error"
+	}
+	category := errorNoise.ReplaceAllString(msg, "…")
+	if len(category) > maxCategoryBytes {
+		// Cut before the rune that crosses the limit
+		n := maxCategoryBytes
+		for n > 0 && !utf8.RuneStart(category[n]) {
+			n--
+		}
+		category = category[:n]
+	}
+	return strings.TrimSpace(category)
+}
+
+// resolutionClass buckets a frame height into the usual marketing names
+func resolutionClass(height int) string {
+	switch {
+	case height >= 2000:
+		return "2160p"
+	case height >= 1000:
+		return "1080p"
+	case height >= 700:
+		return "720p"
+	case height >= 560:
+		return "576p"
+	default:
+		return fmt.Sprintf("%dp", height)
+	}
+}
+
+// Totals summarises what a set of jobs achieved
+type Totals struct {
+	Jobs      int `json:"jobs"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+	// InputBytes and OutputBytes sum the sizes of completed jobs
+	InputBytes  int64 `json:"inputBytes"`
+	OutputBytes int64 `json:"outputBytes"`
+	BytesSaved  int64 `json:"bytesSaved"`
+	// AverageCompressionRatio is the mean output/input size ratio of
+	// completed jobs, e.g. 0.6 for files shrunk by 40%
+	AverageCompressionRatio float64 `json:"averageCompressionRatio"`
+	// EncodeHours is the total processing time of finished jobs
+	EncodeHours float64 `json:"encodeHours"`
+}
+
+// HistoryTotals aggregates sizes and processing time over records
+func HistoryTotals(records []jobstore.Record) Totals {
+	var t Totals
+	var ratios float64
+	var sized int
+	for _, r := range records {
+		t.Jobs++
+		switch r.Status {
+		case "completed":
+			t.Completed++
+		case "failed":
+			t.Failed++
+		}
+		if !r.StartedAt.IsZero() && r.FinishedAt.After(r.StartedAt) {
+			t.EncodeHours += r.FinishedAt.Sub(r.StartedAt).Hours()
+		}
+		if r.Status != "completed" || r.InputBytes <= 0 || r.OutputBytes <= 0 {
+			continue
+		}
+		t.InputBytes += r.InputBytes
+		t.OutputBytes += r.OutputBytes
+		ratios += float64(r.OutputBytes) / float64(r.InputBytes)
+		sized++
+	}
+	t.BytesSaved = t.InputBytes - t.OutputBytes
+	if sized > 0 {
+		t.AverageCompressionRatio = ratios / float64(sized)
+	}
+	return t
+}
+
+// AverageDuration returns the mean processing time of the completed jobs of
+// kind and how many there were, zero if there were none
+func AverageDuration(records []jobstore.Record, kind string) (time.Duration, int) {
+	var total time.Duration
+	var count int
+	for _, r := range records {
+		if r.Kind != kind || r.Status != "completed" || r.StartedAt.IsZero() || !r.FinishedAt.After(r.StartedAt) {
+			continue
+		}
+		total += r.FinishedAt.Sub(r.StartedAt)
+		count++
+	}
+	if count == 0 {
+		return 0, 0
+	}
+	return total / time.Duration(count), count
+}
+
+// Bucket sizes of a series
+const (
+	BucketDay   = "day"
+	BucketWeek  = "week"
+	BucketMonth = "month"
+)
+
+// MaxBuckets caps the length of a series
+const MaxBuckets = 1000
+
+// Point summarises the jobs that finished in one bucket of a series
+type Point struct {
+	// Start is the beginning of the bucket, midnight in the series' location
+	Start     time.Time `json:"start"`
+	Jobs      int       `json:"jobs"`
+	Completed int       `json:"completed"`
+	Failed    int       `json:"failed"`
+	// FailureRate is the share of the bucket's jobs that failed
+	FailureRate float64 `json:"failureRate"`
+	// BytesSaved sums the size reduction of completed jobs
+	BytesSaved  int64   `json:"bytesSaved"`
+	EncodeHours float64 `json:"encodeHours"`
+}
+
+// Series buckets the completed and failed jobs that finished in [since,
+// until) by their finish time, in buckets of a day, week (starting Monday)
+// or month in loc. Buckets without jobs are included so the series can be
+// charted as is.
+func Series(records []jobstore.Record, since, until time.Time, bucket string, loc *time.Location) ([]Point, error) {
+	if !until.After(since) {
+		return nil, fmt.Errorf("until must be after since")
+	}
+	start := bucketStart(since.In(loc), bucket)
+	if start.IsZero() {
+		return nil, fmt.Errorf("unknown bucket %q, expected day, week or month", bucket)
+	}
+
+	var points []Point
+	index := make(map[int64]int)
+	for t := start; t.Before(until); t = nextBucket(t, bucket) {
+		if len(points) == MaxBuckets {
+			return nil, fmt.Errorf("more than %d %ss between since and until", MaxBuckets, bucket)
+		}
+		index[t.Unix()] = len(points)
+		points = append(points, Point{Start: t})
+	}
+
+	for _, r := range records {
+		if r.Status != "completed" && r.Status != "failed" {
+			continue
+		}
+		if r.FinishedAt.Before(since) || !r.FinishedAt.Before(until) {
+			continue
+		}
+		p := &points[index[bucketStart(r.FinishedAt.In(loc), bucket).Unix()]]
+		p.Jobs++
+		if r.Status == "failed" {
+			p.Failed++
+		} else {
+			p.Completed++
+			if r.InputBytes > 0 && r.OutputBytes > 0 {
+				p.BytesSaved += r.InputBytes - r.OutputBytes
+			}
+		}
+		if !r.StartedAt.IsZero() && r.FinishedAt.After(r.StartedAt) {
+			p.EncodeHours += r.FinishedAt.Sub(r.StartedAt).Hours()
+		}
+	}
+	for i := range points {
+		if points[i].Jobs > 0 {
+			points[i].FailureRate = float64(points[i].Failed) / float64(points[i].Jobs)
+		}
+	}
+	return points, nil
+}
+
+// bucketStart returns the start of the bucket holding t, zero for an
+// unknown bucket size
+func bucketStart(t time.Time, bucket string) time.Time {
+	year, month, day := t.Date()
+	switch bucket {
+	case BucketDay:
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	case BucketWeek:
+		// Monday is day 0
+		weekday := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-weekday, 0, 0, 0, 0, t.Location())
+	case BucketMonth:
+		return time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Time{}
+}
+
+// nextBucket returns the start of the bucket after the one starting at t
+func nextBucket(t time.Time, bucket string) time.Time {
+	switch bucket {
+	case BucketWeek:
+		return t.AddDate(0, 0, 7)
+	case BucketMonth:
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// ProfileStats compares what the completed jobs of one profile achieved
+type ProfileStats struct {
+	// Profile is the profile's name, "default" for jobs without one
+	Profile string `json:"profile"`
+	// Jobs counts the completed jobs with known sizes
+	Jobs        int   `json:"jobs"`
+	InputBytes  int64 `json:"inputBytes"`
+	OutputBytes int64 `json:"outputBytes"`
+	BytesSaved  int64 `json:"bytesSaved"`
+	// AverageCompressionRatio is the mean output/input size ratio, lower
+	// is smaller
+	AverageCompressionRatio float64 `json:"averageCompressionRatio"`
+	// Quality holds the verified quality per metric, for jobs whose
+	// quality was checked
+	Quality []QualityStats `json:"quality,omitempty"`
+}
+
+// QualityStats averages the quality scores of one metric
+type QualityStats struct {
+	Metric       string  `json:"metric"`
+	Jobs         int     `json:"jobs"`
+	AverageScore float64 `json:"averageScore"`
+	MinScore     float64 `json:"minScore"`
+	// Passed counts the jobs that met their threshold
+	Passed int `json:"passed"`
+}
+
+// ByProfile aggregates the sizes and quality scores of completed jobs per
+// profile, sorted by profile name
+func ByProfile(records []jobstore.Record) []ProfileStats {
+	type acc struct {
+		stats   ProfileStats
+		ratios  float64
+		quality map[string]*QualityStats
+	}
+	profiles := make(map[string]*acc)
+	for _, r := range records {
+		if r.Status != "completed" || r.InputBytes <= 0 || r.OutputBytes <= 0 {
+			continue
+		}
+		name := r.Profile
+		if name == "" {
+			name = "default"
+		}
+		a := profiles[name]
+		if a == nil {
+			a = &acc{stats: ProfileStats{Profile: name}, quality: make(map[string]*QualityStats)}
+			profiles[name] = a
+		}
+		a.stats.Jobs++
+		a.stats.InputBytes += r.InputBytes
+		a.stats.OutputBytes += r.OutputBytes
+		a.ratios += float64(r.OutputBytes) / float64(r.InputBytes)
+
+		if r.Quality == nil {
+			continue
+		}
+		q := a.quality[r.Quality.Metric]
+		if q == nil {
+			q = &QualityStats{Metric: r.Quality.Metric, MinScore: r.Quality.Score}
+			a.quality[r.Quality.Metric] = q
+		}
+		q.Jobs++
+		// Summed until the average is taken below
+		q.AverageScore += r.Quality.Score
+		q.MinScore = min(q.MinScore, r.Quality.Score)
+		if r.Quality.Passed {
+			q.Passed++
+		}
+	}
+
+	result := make([]ProfileStats, 0, len(profiles))
+	for _, a := range profiles {
+		s := a.stats
+		s.BytesSaved = s.InputBytes - s.OutputBytes
+		s.AverageCompressionRatio = a.ratios / float64(s.Jobs)
+		for _, q := range a.quality {
+			q.AverageScore /= float64(q.Jobs)
+			s.Quality = append(s.Quality, *q)
+		}
+		sort.Slice(s.Quality, func(i, j int) bool { return s.Quality[i].Metric < s.Quality[j].Metric })
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Profile < result[j].Profile })
+	return result
+}
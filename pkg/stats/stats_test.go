@@ -0,0 +1,168 @@
+package stats
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"media_optimizer/pkg/jobstore"
+)
+
+func TestReleaseGroup(t *testing.T) {
+	tests := map[string]string{
+		"/m/Movie.2019.1080p.BluRay.x264-SPARKS.mkv": "SPARKS",
+		"/m/[SubsPlease] Show - 01 (1080p).mkv":      "SubsPlease",
+		"/m/home video.mp4":                          "",
+	}
+	for path, expected := range tests {
+		if got := ReleaseGroup(path); got != expected {
+			t.Errorf("ReleaseGroup(%q) = %q, expected %q", path, got, expected)
+		}
+	}
+}
+
+func TestErrorCategoryTruncation(t *testing.T) {
+	// The limit falls inside a multi-byte rune at every offset
+	for _, prefix := range []string{"", "a", "ab"} {
+		category := ErrorCategory(prefix + strings.Repeat("é", 100))
+		if !utf8.ValidString(category) || len(category) > maxCategoryBytes {
+			t.Errorf("Prefix %q: expected valid UTF-8 of at most %d bytes, got %q", prefix, maxCategoryBytes, category)
+		}
+	}
+}
+
+func TestFailureHeatmap(t *testing.T) {
+	vc1 := &jobstore.Source{VideoCodec: "vc1", Height: 1080}
+	h264 := &jobstore.Source{VideoCodec: "h264", Height: 720}
+	records := []jobstore.Record{
+		{SourcePath: "/m/a-GRP.mkv", Status: "failed", Error: "crop filter failed on /m/a-GRP.mkv", Source: vc1},
+		{SourcePath: "/m/b-GRP.mkv", Status: "failed", Error: "crop filter failed on /m/b-GRP.mkv", Source: vc1},
+		{SourcePath: "/m/c.mp4", Status: "completed", Source: h264},
+		{SourcePath: "/m/d.mp4", Status: "processing", Source: h264},
+	}
+
+	heatmap := FailureHeatmap(records)
+
+	codecs := heatmap["videoCodec"]
+	if len(codecs) != 2 || codecs[0].Value != "vc1" || codecs[0].FailureRate != 1 {
+		t.Fatalf("Expected vc1 to top the codec heatmap, got %+v", codecs)
+	}
+	if len(codecs[0].TopErrors) != 1 || codecs[0].TopErrors[0].Count != 2 {
+		t.Errorf("Expected both failures to share one error category, got %+v", codecs[0].TopErrors)
+	}
+	if groups := heatmap["releaseGroup"]; groups[0].Value != "GRP" {
+		t.Errorf("Expected release group GRP first, got %+v", groups)
+	}
+}
+
+func TestHistoryTotals(t *testing.T) {
+	start := time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC)
+	records := []jobstore.Record{
+		{Status: "completed", InputBytes: 1000, OutputBytes: 500, StartedAt: start, FinishedAt: start.Add(time.Hour)},
+		{Status: "completed", InputBytes: 400, OutputBytes: 300, StartedAt: start, FinishedAt: start.Add(30 * time.Minute)},
+		{Status: "failed", InputBytes: 800, StartedAt: start, FinishedAt: start.Add(30 * time.Minute)},
+		{Status: "queued"},
+	}
+	totals := HistoryTotals(records)
+	if totals.Jobs != 4 || totals.Completed != 2 || totals.Failed != 1 {
+		t.Errorf("Unexpected counts %+v", totals)
+	}
+	if totals.BytesSaved != 600 || totals.AverageCompressionRatio != 0.625 || totals.EncodeHours != 2 {
+		t.Errorf("Unexpected totals %+v", totals)
+	}
+}
+
+func TestAverageDuration(t *testing.T) {
+	start := time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC)
+	records := []jobstore.Record{
+		{Kind: "video", Status: "completed", StartedAt: start, FinishedAt: start.Add(time.Hour)},
+		{Kind: "video", Status: "completed", StartedAt: start, FinishedAt: start.Add(2 * time.Hour)},
+		{Kind: "video", Status: "failed", StartedAt: start, FinishedAt: start.Add(10 * time.Hour)},
+		{Kind: "video", Status: "completed"},
+		{Kind: "image", Status: "completed", StartedAt: start, FinishedAt: start.Add(time.Minute)},
+	}
+	if average, count := AverageDuration(records, "video"); average != 90*time.Minute || count != 2 {
+		t.Errorf("Expected 1h30m over 2 video jobs, got %v over %d", average, count)
+	}
+	if average, count := AverageDuration(records, "audio"); average != 0 || count != 0 {
+		t.Errorf("Expected no audio jobs, got %v over %d", average, count)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(days int, hour int) time.Time {
+		return day.AddDate(0, 0, days).Add(time.Duration(hour) * time.Hour)
+	}
+	records := []jobstore.Record{
+		{Status: "completed", InputBytes: 1000, OutputBytes: 400, StartedAt: at(0, 8), FinishedAt: at(0, 10)},
+		{Status: "failed", StartedAt: at(0, 11), FinishedAt: at(0, 12)},
+		{Status: "completed", InputBytes: 500, OutputBytes: 400, StartedAt: at(2, 23), FinishedAt: at(3, 1)},
+		{Status: "processing", StartedAt: at(1, 1)},
+		{Status: "completed", FinishedAt: at(10, 0)},
+	}
+
+	points, err := Series(records, day, at(4, 0), BucketDay, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 4 {
+		t.Fatalf("Expected 4 days, got %+v", points)
+	}
+	first := points[0]
+	if first.Jobs != 2 || first.Completed != 1 || first.Failed != 1 || first.FailureRate != 0.5 || first.BytesSaved != 600 || first.EncodeHours != 3 {
+		t.Errorf("Unexpected first day %+v", first)
+	}
+	if points[1].Jobs != 0 || points[2].Jobs != 0 {
+		t.Errorf("Expected empty days in between, got %+v", points)
+	}
+	// Jobs count on the day they finished
+	if points[3].Jobs != 1 || points[3].BytesSaved != 100 || points[3].EncodeHours != 2 {
+		t.Errorf("Unexpected last day %+v", points[3])
+	}
+
+	// 2024-05-01 is a Wednesday, so the week starts on April 29
+	weeks, err := Series(records, day, at(14, 0), BucketWeek, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(weeks) != 3 || !weeks[0].Start.Equal(time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC)) || weeks[0].Jobs != 3 || weeks[1].Jobs != 1 {
+		t.Errorf("Unexpected weeks %+v", weeks)
+	}
+
+	if _, err := Series(records, day, at(1, 0), "hour", time.UTC); err == nil {
+		t.Error("Expected an unknown bucket to be rejected")
+	}
+	if _, err := Series(records, at(1, 0), day, BucketDay, time.UTC); err == nil {
+		t.Error("Expected an empty range to be rejected")
+	}
+	if _, err := Series(records, day, day.AddDate(10, 0, 0), BucketDay, time.UTC); err == nil {
+		t.Error("Expected too many buckets to be rejected")
+	}
+}
+
+func TestByProfile(t *testing.T) {
+	records := []jobstore.Record{
+		{Status: "completed", Profile: "hevc", InputBytes: 1000, OutputBytes: 500, Quality: &jobstore.Quality{Metric: "vmaf", Score: 94, Passed: true}},
+		{Status: "completed", Profile: "hevc", InputBytes: 1000, OutputBytes: 700, Quality: &jobstore.Quality{Metric: "vmaf", Score: 90}},
+		{Status: "completed", Profile: "av1", InputBytes: 2000, OutputBytes: 600},
+		{Status: "completed", InputBytes: 100, OutputBytes: 90},
+		{Status: "failed", Profile: "av1", InputBytes: 2000},
+		{Status: "completed", Profile: "av1"},
+	}
+	profiles := ByProfile(records)
+	if len(profiles) != 3 || profiles[0].Profile != "av1" || profiles[1].Profile != "default" || profiles[2].Profile != "hevc" {
+		t.Fatalf("Unexpected profiles %+v", profiles)
+	}
+	av1, hevc := profiles[0], profiles[2]
+	if av1.Jobs != 1 || av1.AverageCompressionRatio != 0.3 || av1.BytesSaved != 1400 || len(av1.Quality) != 0 {
+		t.Errorf("Unexpected av1 stats %+v", av1)
+	}
+	if hevc.Jobs != 2 || hevc.AverageCompressionRatio != 0.6 || hevc.BytesSaved != 800 {
+		t.Errorf("Unexpected hevc stats %+v", hevc)
+	}
+	if len(hevc.Quality) != 1 || hevc.Quality[0].AverageScore != 92 || hevc.Quality[0].MinScore != 90 || hevc.Quality[0].Passed != 1 {
+		t.Errorf("Unexpected hevc quality %+v", hevc.Quality)
+	}
+}
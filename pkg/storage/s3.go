@@ -0,0 +1,394 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"media_optimizer/pkg/throttle"
+)
+
+const (
+	// minPartSize is the part size of multipart uploads, raised for files
+	// that would need more than maxParts parts
+	minPartSize = 64 << 20
+	maxParts    = 10000
+	// unsignedPayload lets bodies be streamed without hashing them first
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3Options configures an S3 or S3-compatible (e.g. MinIO) bucket
+type S3Options struct {
+	// Endpoint is the server URL, e.g. http://minio:9000, addressed with
+	// path-style requests. Without it AWS is used with virtual-hosted
+	// requests.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to every key, e.g. "media/"
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3 is a Backend storing objects in a bucket
+type S3 struct {
+	opts     S3Options
+	base     *url.URL
+	client   *http.Client
+	partSize int64
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewS3 creates a client for the bucket
+func NewS3(opts S3Options) (*S3, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("s3: bucket is required")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.Prefix != "" && !strings.HasSuffix(opts.Prefix, "/") {
+		opts.Prefix += "/"
+	}
+
+	raw := opts.Endpoint
+	if raw == "" {
+		raw = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", opts.Bucket, opts.Region)
+	} else {
+		raw = strings.TrimSuffix(raw, "/") + "/" + opts.Bucket
+	}
+	base, err := url.Parse(raw)
+	if err != nil || base.Host == "" || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", opts.Endpoint)
+	}
+	return &S3{opts: opts, base: base, client: http.DefaultClient, partSize: minPartSize, now: time.Now}, nil
+}
+
+// Stat returns the size and modification time of the object at key
+func (s *S3) Stat(ctx context.Context, key string) (Object, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, -1)
+	if err != nil {
+		return Object{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Object{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// List returns the objects and common prefixes directly below prefix
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.opts.Prefix + prefix},
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, -1)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			CommonPrefixes []struct {
+				Prefix string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: invalid list response: %v", err)
+		}
+
+		for _, p := range result.CommonPrefixes {
+			objects = append(objects, Object{Key: strings.TrimPrefix(p.Prefix, s.opts.Prefix), IsDir: true})
+		}
+		for _, c := range result.Contents {
+			key := strings.TrimPrefix(c.Key, s.opts.Prefix)
+			// Folder placeholder objects created by some clients
+			if key == prefix || strings.HasSuffix(key, "/") {
+				continue
+			}
+			objects = append(objects, Object{Key: key, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Download streams the object at key into dst
+func (s *S3) Download(ctx context.Context, key, dst string, progress Progress) error {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, -1)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := writeFile(dst, resp.Body, resp.ContentLength, progress); err != nil {
+		return fmt.Errorf("s3: download of %s failed: %v", key, err)
+	}
+	return nil
+}
+
+// Upload writes src to key, in parts when it is larger than the part size
+func (s *S3) Upload(ctx context.Context, src, key string, progress Progress) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	partSize := s.partSize
+	if size > partSize*maxParts {
+		partSize = (size + maxParts - 1) / maxParts
+	}
+	if size <= partSize {
+		resp, err := s.do(ctx, http.MethodPut, key, nil, &progressReader{r: throttle.Reads().Reader(f), total: size, progress: progress}, size)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	return s.uploadParts(ctx, f, size, partSize, key, progress)
+}
+
+// uploadParts runs a multipart upload, aborting it on failure so the bucket
+// doesn't keep the parts
+func (s *S3) uploadParts(ctx context.Context, f *os.File, size, partSize int64, key string, progress Progress) error {
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("s3: invalid multipart upload response: %v", err)
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var parts []part
+	var done int64
+	for offset, number := int64(0), 1; offset < size; offset, number = offset+partSize, number+1 {
+		length := min(partSize, size-offset)
+		body := &progressReader{r: throttle.Reads().Reader(io.NewSectionReader(f, offset, length)), done: done, total: size, progress: progress}
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiated.UploadID}}
+		resp, err := s.do(ctx, http.MethodPut, key, query, body, length)
+		if err != nil {
+			s.abort(key, initiated.UploadID)
+			return err
+		}
+		resp.Body.Close()
+		parts = append(parts, part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		done += length
+	}
+
+	complete, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	resp, err = s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}}, bytes.NewReader(complete), int64(len(complete)))
+	if err != nil {
+		s.abort(key, initiated.UploadID)
+		return err
+	}
+	defer resp.Body.Close()
+	// Completion can fail after a 200 status, reported in the body
+	body, _ := io.ReadAll(resp.Body)
+	if bytes.Contains(body, []byte("<Error>")) {
+		s.abort(key, initiated.UploadID)
+		return fmt.Errorf("s3: completing the upload of %s failed: %s", key, body)
+	}
+	return nil
+}
+
+// abort discards the parts of a failed multipart upload
+func (s *S3) abort(key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if resp, err := s.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, -1); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// Delete removes the object at key
+func (s *S3) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, -1)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request for key and returns the response if its status
+// is 2xx. size is the body length, -1 for requests without one.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := *s.base
+	if key != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.opts.Prefix + key
+	} else if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	s.sign(req, unsignedPayload)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %w: %v", ErrUnavailable, err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("s3: %s: %w", s.opts.Prefix+key, ErrNotFound)
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	err = fmt.Errorf("s3: %s %s: %s: %s", method, s.opts.Prefix+key, resp.Status, strings.TrimSpace(string(message)))
+	if unavailableStatus(resp.StatusCode) {
+		err = fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return nil, err
+}
+
+// sign adds an AWS Signature Version 4 Authorization header covering the
+// host and every header already set on the request
+func (s *S3) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.EscapedPath(), false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.opts.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.opts.SecretKey), day)
+	key = hmacSHA256(key, s.opts.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.opts.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key as SigV4 requires, which also
+// makes it the request's query string
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, and
+// slashes unless encodeSlash is set. Existing escapes in a path are decoded
+// first so they aren't encoded twice.
+func uriEncode(s string, encodeSlash bool) string {
+	if !encodeSlash {
+		if unescaped, err := url.PathUnescape(s); err == nil {
+			s = unescaped
+		}
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,740 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"media_optimizer/pkg/throttle"
+)
+
+// SFTP packet types, from version 3 of the protocol
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpStat     = 17
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpProtocol = 3
+)
+
+// SFTP open flags, status codes and attribute flags
+const (
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+
+	sftpAttrSize        = 0x1
+	sftpAttrUIDGID      = 0x2
+	sftpAttrPermissions = 0x4
+	sftpAttrTimes       = 0x8
+	sftpAttrExtended    = 0x80000000
+)
+
+// File type bits of SFTP permissions
+const (
+	modeType    = 0170000
+	modeDir     = 0040000
+	modeSymlink = 0120000
+)
+
+const (
+	// sftpChunk is the size of each read and write request
+	sftpChunk = 32 << 10
+	// sftpWindow is the number of requests in flight during a transfer, so
+	// throughput isn't bound by the round trip time
+	sftpWindow = 64
+	// maxSFTPPacket rejects corrupt packet lengths
+	maxSFTPPacket = 1 << 20
+)
+
+var errShortPacket = errors.New("sftp: short packet")
+
+// SFTPOptions configures a directory on an SSH server, e.g. a seedbox. The
+// connection runs the system ssh client, so authentication uses its keys,
+// agent and ~/.ssh/config; passwords aren't supported.
+type SFTPOptions struct {
+	Host string
+	// Port is 22 when zero
+	Port     int
+	Username string
+	// KeyFile is the private key passed to ssh -i
+	KeyFile string
+	// Dir is the directory keys are relative to, the login directory when
+	// empty
+	Dir string
+}
+
+// SFTP is a Backend storing files on an SSH server
+type SFTP struct {
+	opts SFTPOptions
+	// dial starts a session with the server's sftp subsystem, replaced in
+	// tests
+	dial func(ctx context.Context) (io.ReadWriteCloser, error)
+}
+
+// NewSFTP creates a client for the server
+func NewSFTP(opts SFTPOptions) (*SFTP, error) {
+	if opts.Host == "" || strings.HasPrefix(opts.Host, "-") {
+		return nil, fmt.Errorf("sftp: invalid host %q", opts.Host)
+	}
+	if opts.Port < 0 || opts.Port > 65535 {
+		return nil, fmt.Errorf("sftp: invalid port %d", opts.Port)
+	}
+	s := &SFTP{opts: opts}
+	s.dial = s.dialSSH
+	return s, nil
+}
+
+// sshArgs returns the arguments running the sftp subsystem on the server
+func (s *SFTP) sshArgs() []string {
+	args := []string{"-o", "BatchMode=yes", "-o", "ServerAliveInterval=15"}
+	if s.opts.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(s.opts.Port))
+	}
+	if s.opts.KeyFile != "" {
+		args = append(args, "-i", s.opts.KeyFile)
+	}
+	if s.opts.Username != "" {
+		args = append(args, "-l", s.opts.Username)
+	}
+	return append(args, "-s", "--", s.opts.Host, "sftp")
+}
+
+// sshConn is an ssh process whose stdin and stdout carry the session
+type sshConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	once   sync.Once
+	err    error
+}
+
+func (s *SFTP) dialSSH(ctx context.Context) (io.ReadWriteCloser, error) {
+	c := &sshConn{cmd: exec.CommandContext(ctx, "ssh", s.sshArgs()...)}
+	c.cmd.Stderr = &c.stderr
+	var err error
+	if c.stdin, err = c.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if c.stdout, err = c.cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err := c.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("sftp: failed to start ssh: %v", err)
+	}
+	return c, nil
+}
+
+// Read returns ssh's error output once the session ends
+func (c *sshConn) Read(b []byte) (int, error) {
+	n, err := c.stdout.Read(b)
+	if err == io.EOF {
+		c.wait()
+		if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+			return n, errors.New(msg)
+		}
+	}
+	return n, err
+}
+
+func (c *sshConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+func (c *sshConn) Close() error {
+	c.stdin.Close()
+	c.wait()
+	return nil
+}
+
+func (c *sshConn) wait() {
+	c.once.Do(func() {
+		c.err = c.cmd.Wait()
+	})
+}
+
+// path returns the server path of key
+func (s *SFTP) path(key string) string {
+	if s.opts.Dir == "" {
+		if key == "" {
+			return "."
+		}
+		return key
+	}
+	return path.Join(s.opts.Dir, key)
+}
+
+// Stat returns the size and modification time of the file at key
+func (s *SFTP) Stat(ctx context.Context, key string) (Object, error) {
+	sess, err := s.open(ctx)
+	if err != nil {
+		return Object{}, err
+	}
+	defer sess.close()
+	attrs, err := sess.stat(s.path(key))
+	if err != nil {
+		return Object{}, err
+	}
+	return attrs.object(key), nil
+}
+
+// List returns the files and directories directly below prefix. Symbolic
+// links are listed as what they point to.
+func (s *SFTP) List(ctx context.Context, prefix string) ([]Object, error) {
+	sess, err := s.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.close()
+	dir := s.path(prefix)
+	entries, err := sess.readdir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []Object
+	for _, entry := range entries {
+		if entry.name == "." || entry.name == ".." {
+			continue
+		}
+		attrs := entry.attrs
+		if attrs.mode&modeType == modeSymlink {
+			if attrs, err = sess.stat(path.Join(dir, entry.name)); err != nil {
+				// Dangling links are left out
+				continue
+			}
+		}
+		objects = append(objects, attrs.object(prefix+entry.name))
+	}
+	return objects, nil
+}
+
+// Download copies the file at key into dst
+func (s *SFTP) Download(ctx context.Context, key, dst string, progress Progress) error {
+	sess, err := s.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer sess.close()
+	src := s.path(key)
+	attrs, err := sess.stat(src)
+	if err != nil {
+		return err
+	}
+	handle, err := sess.openFile(src, sftpFlagRead)
+	if err != nil {
+		return err
+	}
+	defer sess.closeHandle(handle)
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	err = sess.readFile(handle, f, attrs.size, progress)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("sftp: download of %s failed: %v", key, err)
+	}
+	return nil
+}
+
+// Upload copies src to key, replacing any file there
+func (s *SFTP) Upload(ctx context.Context, src, key string, progress Progress) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	sess, err := s.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer sess.close()
+	handle, err := sess.openFile(s.path(key), sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc)
+	if err != nil {
+		return err
+	}
+	if err := sess.writeFile(handle, f, info.Size(), progress); err != nil {
+		sess.closeHandle(handle)
+		return fmt.Errorf("sftp: upload of %s failed: %v", key, err)
+	}
+	// Servers may only report write errors when the file is closed
+	return sess.closeHandle(handle)
+}
+
+// Delete removes the file at key
+func (s *SFTP) Delete(ctx context.Context, key string) error {
+	sess, err := s.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer sess.close()
+	id := sess.request(sftpRemove, func(p *packetWriter) { p.str(s.path(key)) })
+	return sess.expectStatus(id, s.path(key))
+}
+
+// sftpSession is one connection to the server. Requests are written and
+// their responses read by a single goroutine.
+type sftpSession struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	id   uint32
+	err  error
+}
+
+// open starts a session and negotiates the protocol version
+func (s *SFTP) open(ctx context.Context) (*sftpSession, error) {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sess := &sftpSession{conn: conn, r: bufio.NewReaderSize(conn, 64<<10)}
+	var p packetWriter
+	p.u32(sftpProtocol)
+	sess.send(sftpInit, p.b)
+	typ, _, err := sess.recvPacket()
+	if err == nil && typ != sftpVersion {
+		err = fmt.Errorf("sftp: unexpected packet %d instead of the version", typ)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sess, nil
+}
+
+func (sess *sftpSession) close() {
+	sess.conn.Close()
+}
+
+// send writes a packet, keeping the first error for the next receive
+func (sess *sftpSession) send(typ byte, payload []byte) {
+	if sess.err != nil {
+		return
+	}
+	packet := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(payload)))
+	packet[4] = typ
+	if _, err := sess.conn.Write(append(packet, payload...)); err != nil {
+		sess.err = fmt.Errorf("sftp: %w: %v", ErrUnavailable, err)
+	}
+}
+
+// request sends a request built by fill and returns its ID
+func (sess *sftpSession) request(typ byte, fill func(p *packetWriter)) uint32 {
+	sess.id++
+	var p packetWriter
+	p.u32(sess.id)
+	fill(&p)
+	sess.send(typ, p.b)
+	return sess.id
+}
+
+func (sess *sftpSession) recvPacket() (byte, *packetReader, error) {
+	if sess.err != nil {
+		return 0, nil, sess.err
+	}
+	var header [5]byte
+	if _, err := io.ReadFull(sess.r, header[:]); err != nil {
+		return 0, nil, fmt.Errorf("sftp: %w: connection lost: %v", ErrUnavailable, err)
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > maxSFTPPacket {
+		return 0, nil, fmt.Errorf("sftp: invalid packet length %d", length)
+	}
+	body := make([]byte, length-1)
+	if _, err := io.ReadFull(sess.r, body); err != nil {
+		return 0, nil, fmt.Errorf("sftp: %w: connection lost: %v", ErrUnavailable, err)
+	}
+	return header[4], &packetReader{b: body}, nil
+}
+
+// recv reads the next response and its request ID
+func (sess *sftpSession) recv() (byte, uint32, *packetReader, error) {
+	typ, p, err := sess.recvPacket()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	id := p.u32()
+	return typ, id, p, p.err
+}
+
+// response reads the response to request id, which must come next
+func (sess *sftpSession) response(id uint32) (byte, *packetReader, error) {
+	typ, got, p, err := sess.recv()
+	if err == nil && got != id {
+		err = fmt.Errorf("sftp: response to request %d instead of %d", got, id)
+	}
+	return typ, p, err
+}
+
+// expectStatus reads the response to request id and returns its error
+func (sess *sftpSession) expectStatus(id uint32, target string) error {
+	typ, p, err := sess.response(id)
+	if err != nil {
+		return err
+	}
+	if typ != sftpStatus {
+		return fmt.Errorf("sftp: unexpected packet %d instead of a status", typ)
+	}
+	return statusError(p, target)
+}
+
+// statusError returns the error of a status packet, nil for success
+func statusError(p *packetReader, target string) error {
+	code := p.u32()
+	msg := p.str()
+	if p.err != nil {
+		return p.err
+	}
+	switch code {
+	case sftpOK:
+		return nil
+	case sftpEOF:
+		return io.EOF
+	case sftpNoSuchFile:
+		return fmt.Errorf("sftp: %s: %w", target, ErrNotFound)
+	}
+	return fmt.Errorf("sftp: %s: %s (code %d)", target, msg, code)
+}
+
+// expect reads the response to request id, which must be of type want
+// unless it is an error status
+func (sess *sftpSession) expect(id uint32, want byte, target string) (*packetReader, error) {
+	typ, p, err := sess.response(id)
+	switch {
+	case err != nil:
+		return nil, err
+	case typ == sftpStatus:
+		if err := statusError(p, target); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("sftp: %s: unexpected success status", target)
+	case typ != want:
+		return nil, fmt.Errorf("sftp: unexpected packet %d instead of %d", typ, want)
+	}
+	return p, nil
+}
+
+func (sess *sftpSession) stat(target string) (sftpAttributes, error) {
+	id := sess.request(sftpStat, func(p *packetWriter) { p.str(target) })
+	p, err := sess.expect(id, sftpAttrs, target)
+	if err != nil {
+		return sftpAttributes{}, err
+	}
+	attrs := readAttrs(p)
+	return attrs, p.err
+}
+
+func (sess *sftpSession) openFile(target string, flags uint32) (string, error) {
+	id := sess.request(sftpOpen, func(p *packetWriter) {
+		p.str(target)
+		p.u32(flags)
+		p.u32(0) // no attributes
+	})
+	p, err := sess.expect(id, sftpHandle, target)
+	if err != nil {
+		return "", err
+	}
+	handle := p.str()
+	return handle, p.err
+}
+
+func (sess *sftpSession) closeHandle(handle string) error {
+	id := sess.request(sftpClose, func(p *packetWriter) { p.str(handle) })
+	return sess.expectStatus(id, "close")
+}
+
+// sftpEntry is a directory entry
+type sftpEntry struct {
+	name  string
+	attrs sftpAttributes
+}
+
+func (sess *sftpSession) readdir(dir string) ([]sftpEntry, error) {
+	id := sess.request(sftpOpendir, func(p *packetWriter) { p.str(dir) })
+	p, err := sess.expect(id, sftpHandle, dir)
+	if err != nil {
+		return nil, err
+	}
+	handle := p.str()
+	if p.err != nil {
+		return nil, p.err
+	}
+	defer sess.closeHandle(handle)
+
+	var entries []sftpEntry
+	for {
+		id := sess.request(sftpReaddir, func(p *packetWriter) { p.str(handle) })
+		p, err := sess.expect(id, sftpName, dir)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		count := p.u32()
+		for i := uint32(0); i < count && p.err == nil; i++ {
+			name := p.str()
+			p.str() // long name, as printed by ls -l
+			entries = append(entries, sftpEntry{name: name, attrs: readAttrs(p)})
+		}
+		if p.err != nil {
+			return nil, p.err
+		}
+	}
+}
+
+// readFile reads size bytes of the open file into f, keeping sftpWindow
+// requests in flight. Short reads are requested again from where they
+// ended.
+func (sess *sftpSession) readFile(handle string, f *os.File, size int64, progress Progress) error {
+	type chunk struct{ offset, length int64 }
+	pending := map[uint32]chunk{}
+	request := func(c chunk) {
+		id := sess.request(sftpRead, func(p *packetWriter) {
+			p.str(handle)
+			p.u64(uint64(c.offset))
+			p.u32(uint32(c.length))
+		})
+		pending[id] = c
+	}
+
+	var next, done int64
+	for next < size || len(pending) > 0 {
+		for next < size && len(pending) < sftpWindow {
+			length := min(sftpChunk, size-next)
+			request(chunk{next, length})
+			next += length
+		}
+
+		typ, id, p, err := sess.recv()
+		if err != nil {
+			return err
+		}
+		c, ok := pending[id]
+		if !ok {
+			return fmt.Errorf("sftp: response to unknown request %d", id)
+		}
+		delete(pending, id)
+		if typ == sftpStatus {
+			if err := statusError(p, "read"); err == io.EOF {
+				return fmt.Errorf("file ended at %d of %d bytes", c.offset, size)
+			} else if err != nil {
+				return err
+			}
+			return fmt.Errorf("sftp: unexpected success status")
+		}
+		if typ != sftpData {
+			return fmt.Errorf("sftp: unexpected packet %d instead of data", typ)
+		}
+		data := p.bytes()
+		if p.err != nil {
+			return p.err
+		}
+		if int64(len(data)) > c.length {
+			return fmt.Errorf("sftp: received %d bytes for a %d byte read", len(data), c.length)
+		}
+		throttle.Writes().Wait(len(data))
+		if _, err := f.WriteAt(data, c.offset); err != nil {
+			return err
+		}
+		if n := int64(len(data)); n < c.length {
+			request(chunk{c.offset + n, c.length - n})
+		}
+		done += int64(len(data))
+		if progress != nil {
+			progress(done, size)
+		}
+	}
+	return nil
+}
+
+// writeFile writes size bytes of f to the open file, keeping sftpWindow
+// requests in flight
+func (sess *sftpSession) writeFile(handle string, f *os.File, size int64, progress Progress) error {
+	pending := map[uint32]int64{}
+	var next, done int64
+	for next < size || len(pending) > 0 {
+		for next < size && len(pending) < sftpWindow {
+			data := make([]byte, min(sftpChunk, size-next))
+			throttle.Reads().Wait(len(data))
+			if _, err := f.ReadAt(data, next); err != nil {
+				return err
+			}
+			offset := next
+			id := sess.request(sftpWrite, func(p *packetWriter) {
+				p.str(handle)
+				p.u64(uint64(offset))
+				p.bytes(data)
+			})
+			pending[id] = int64(len(data))
+			next += int64(len(data))
+		}
+
+		typ, id, p, err := sess.recv()
+		if err != nil {
+			return err
+		}
+		length, ok := pending[id]
+		if !ok {
+			return fmt.Errorf("sftp: response to unknown request %d", id)
+		}
+		delete(pending, id)
+		if typ != sftpStatus {
+			return fmt.Errorf("sftp: unexpected packet %d instead of a status", typ)
+		}
+		if err := statusError(p, "write"); err != nil {
+			return err
+		}
+		done += length
+		if progress != nil {
+			progress(done, size)
+		}
+	}
+	return nil
+}
+
+// sftpAttributes holds the attributes this client uses
+type sftpAttributes struct {
+	size    int64
+	mode    uint32
+	modTime time.Time
+}
+
+func (a sftpAttributes) object(key string) Object {
+	if a.mode&modeType == modeDir {
+		if key != "" && !strings.HasSuffix(key, "/") {
+			key += "/"
+		}
+		return Object{Key: key, IsDir: true, ModTime: a.modTime}
+	}
+	return Object{Key: key, Size: a.size, ModTime: a.modTime}
+}
+
+func readAttrs(p *packetReader) sftpAttributes {
+	var a sftpAttributes
+	flags := p.u32()
+	if flags&sftpAttrSize != 0 {
+		a.size = int64(p.u64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		p.u32()
+		p.u32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		a.mode = p.u32()
+	}
+	if flags&sftpAttrTimes != 0 {
+		p.u32() // access time
+		a.modTime = time.Unix(int64(p.u32()), 0)
+	}
+	if flags&sftpAttrExtended != 0 {
+		for n := p.u32(); n > 0 && p.err == nil; n-- {
+			p.str()
+			p.str()
+		}
+	}
+	return a
+}
+
+// packetWriter encodes SFTP packet fields
+type packetWriter struct {
+	b []byte
+}
+
+func (p *packetWriter) u32(v uint32) {
+	p.b = binary.BigEndian.AppendUint32(p.b, v)
+}
+
+func (p *packetWriter) u64(v uint64) {
+	p.b = binary.BigEndian.AppendUint64(p.b, v)
+}
+
+func (p *packetWriter) str(s string) {
+	p.u32(uint32(len(s)))
+	p.b = append(p.b, s...)
+}
+
+func (p *packetWriter) bytes(b []byte) {
+	p.u32(uint32(len(b)))
+	p.b = append(p.b, b...)
+}
+
+// packetReader decodes SFTP packet fields, keeping the first error
+type packetReader struct {
+	b   []byte
+	err error
+}
+
+func (p *packetReader) u32() uint32 {
+	if len(p.b) < 4 {
+		p.err = errShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint32(p.b)
+	p.b = p.b[4:]
+	return v
+}
+
+func (p *packetReader) u64() uint64 {
+	if len(p.b) < 8 {
+		p.err = errShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint64(p.b)
+	p.b = p.b[8:]
+	return v
+}
+
+func (p *packetReader) bytes() []byte {
+	n := p.u32()
+	if p.err != nil || uint32(len(p.b)) < n {
+		p.err = errShortPacket
+		return nil
+	}
+	v := p.b[:n]
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *packetReader) str() string {
+	return string(p.bytes())
+}
@@ -0,0 +1,151 @@
+// Package storage reads media from and writes results to remote storage.
+// Remote files are addressed as <type>://<root>/<key>, where root names a
+// configured remote and key is the object's path within it.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"media_optimizer/pkg/throttle"
+)
+
+// Backend types, which are also the schemes of their paths
+const (
+	TypeS3     = "s3"
+	TypeSFTP   = "sftp"
+	TypeWebDAV = "webdav"
+)
+
+// Types lists the backend types
+var Types = []string{TypeS3, TypeSFTP, TypeWebDAV}
+
+// Errors returned by backends
+var (
+	// ErrNotFound is returned for keys that don't exist
+	ErrNotFound = errors.New("not found")
+	// ErrUnavailable means the remote could not be reached or failed on its
+	// side, so the request may succeed later
+	ErrUnavailable = errors.New("remote unavailable")
+)
+
+// Object is a file or, with IsDir, a common prefix in a remote
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Progress reports the bytes transferred so far out of total, which is zero
+// when unknown
+type Progress func(done, total int64)
+
+// Backend is a remote holding media files
+type Backend interface {
+	// Stat returns the object at key
+	Stat(ctx context.Context, key string) (Object, error)
+	// List returns the objects and directories directly below the prefix,
+	// which is empty or ends in a slash
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Download copies the object at key into the local file dst
+	Download(ctx context.Context, key, dst string, progress Progress) error
+	// Upload copies the local file src to key, replacing any object there
+	Upload(ctx context.Context, src, key string, progress Progress) error
+	Delete(ctx context.Context, key string) error
+}
+
+// Path is a parsed remote path
+type Path struct {
+	Type string
+	Root string
+	Key  string
+}
+
+// ParsePath splits a remote path. ok is false for local paths.
+func ParsePath(raw string) (p Path, ok bool, err error) {
+	scheme, rest, found := strings.Cut(raw, "://")
+	if !found || !validType(scheme) {
+		return Path{}, false, nil
+	}
+	root, key, _ := strings.Cut(rest, "/")
+	if root == "" {
+		return Path{}, true, fmt.Errorf("remote path %s has no root name", raw)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "." || part == ".." {
+			return Path{}, true, fmt.Errorf("remote path %s must not contain %q", raw, part)
+		}
+	}
+	return Path{Type: scheme, Root: root, Key: key}, true, nil
+}
+
+func validType(t string) bool {
+	for _, known := range Types {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRemote reports whether raw is a remote path
+func IsRemote(raw string) bool {
+	_, ok, _ := ParsePath(raw)
+	return ok
+}
+
+// String formats the path as <type>://<root>/<key>
+func (p Path) String() string {
+	return p.Type + "://" + p.Root + "/" + p.Key
+}
+
+// Join returns the path of key in the same remote
+func (p Path) Join(key string) Path {
+	return Path{Type: p.Type, Root: p.Root, Key: key}
+}
+
+// unavailableStatus reports whether an HTTP status means the server is
+// overloaded or failing rather than rejecting the request
+func unavailableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// writeFile copies r into the new file dst, removing it again on failure
+func writeFile(dst string, r io.Reader, total int64, progress Progress) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(throttle.Writes().Writer(f), &progressReader{r: r, total: total, progress: progress})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// progressReader reports the bytes read through it
+type progressReader struct {
+	r        io.Reader
+	done     int64
+	total    int64
+	progress Progress
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 && p.progress != nil {
+		p.done += int64(n)
+		p.progress(p.done, p.total)
+	}
+	return n, err
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"media_optimizer/pkg/throttle"
+)
+
+// propfindBody asks for the properties List and Stat need
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/></prop></propfind>`
+
+// WebDAVOptions configures a WebDAV share, e.g. a seedbox's web file access
+type WebDAVOptions struct {
+	// URL is the share's base URL, keys are relative to it
+	URL      string
+	Username string
+	Password string
+}
+
+// WebDAV is a Backend storing files on a WebDAV server
+type WebDAV struct {
+	opts   WebDAVOptions
+	base   *url.URL
+	client *http.Client
+}
+
+// NewWebDAV creates a client for the share
+func NewWebDAV(opts WebDAVOptions) (*WebDAV, error) {
+	base, err := url.Parse(opts.URL)
+	if err != nil || base.Host == "" || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, fmt.Errorf("webdav: invalid url %q", opts.URL)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+	base.RawPath = ""
+	return &WebDAV{opts: opts, base: base, client: http.DefaultClient}, nil
+}
+
+// Stat returns the size and modification time of the file at key
+func (d *WebDAV) Stat(ctx context.Context, key string) (Object, error) {
+	objects, err := d.propfind(ctx, key, "0")
+	if err != nil {
+		return Object{}, err
+	}
+	if len(objects) == 0 {
+		return Object{}, fmt.Errorf("webdav: %s: %w", key, ErrNotFound)
+	}
+	return objects[0], nil
+}
+
+// List returns the files and collections directly below prefix
+func (d *WebDAV) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects, err := d.propfind(ctx, prefix, "1")
+	if err != nil {
+		return nil, err
+	}
+	// The response includes the collection itself
+	kept := objects[:0]
+	for _, obj := range objects {
+		if obj.Key != prefix && obj.Key != "" {
+			kept = append(kept, obj)
+		}
+	}
+	return kept, nil
+}
+
+// propfind returns the resource at key and, with depth "1", its members.
+// Keys of collections end in a slash.
+func (d *WebDAV) propfind(ctx context.Context, key, depth string) ([]Object, error) {
+	req, err := d.request(ctx, "PROPFIND", key, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := d.do(req, key)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Responses []struct {
+			Href     string `xml:"DAV: href"`
+			Propstat []struct {
+				Status string `xml:"DAV: status"`
+				Prop   struct {
+					Collection    *struct{} `xml:"DAV: resourcetype>collection"`
+					ContentLength int64     `xml:"DAV: getcontentlength"`
+					LastModified  string    `xml:"DAV: getlastmodified"`
+				} `xml:"DAV: prop"`
+			} `xml:"DAV: propstat"`
+		} `xml:"DAV: response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("webdav: invalid PROPFIND response: %v", err)
+	}
+
+	var objects []Object
+	for _, r := range result.Responses {
+		obj := Object{Key: d.key(r.Href)}
+		for _, ps := range r.Propstat {
+			// Properties the server doesn't have are listed with a 404
+			if !strings.Contains(ps.Status, " 200") {
+				continue
+			}
+			if ps.Prop.Collection != nil {
+				obj.IsDir = true
+			}
+			obj.Size = ps.Prop.ContentLength
+			obj.ModTime, _ = http.ParseTime(ps.Prop.LastModified)
+		}
+		if obj.IsDir && obj.Key != "" && !strings.HasSuffix(obj.Key, "/") {
+			obj.Key += "/"
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+// key returns the key of an href from a PROPFIND response, which is a path
+// or a full URL
+func (d *WebDAV) key(href string) string {
+	if u, err := url.Parse(href); err == nil {
+		href = u.Path
+	}
+	return strings.TrimPrefix(href, d.base.Path)
+}
+
+// Download streams the file at key into dst
+func (d *WebDAV) Download(ctx context.Context, key, dst string, progress Progress) error {
+	req, err := d.request(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.do(req, key)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := writeFile(dst, resp.Body, resp.ContentLength, progress); err != nil {
+		return fmt.Errorf("webdav: download of %s failed: %v", key, err)
+	}
+	return nil
+}
+
+// Upload writes src to key, creating missing parent collections when the
+// server refuses the file without them
+func (d *WebDAV) Upload(ctx context.Context, src, key string, progress Progress) error {
+	err := d.put(ctx, src, key, progress)
+	if statusErr, ok := err.(*webdavStatusError); ok && statusErr.code == http.StatusConflict {
+		if err := d.mkcolAll(ctx, key); err != nil {
+			return err
+		}
+		err = d.put(ctx, src, key, progress)
+	}
+	return err
+}
+
+func (d *WebDAV) put(ctx context.Context, src, key string, progress Progress) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := d.request(ctx, http.MethodPut, key, &progressReader{r: throttle.Reads().Reader(f), total: info.Size(), progress: progress})
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	if info.Size() == 0 {
+		req.Body = http.NoBody
+	}
+	resp, err := d.do(req, key)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// mkcolAll creates the collections above key, ignoring those that exist
+func (d *WebDAV) mkcolAll(ctx context.Context, key string) error {
+	parts := strings.Split(key, "/")
+	for i := 1; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/") + "/"
+		req, err := d.request(ctx, "MKCOL", dir, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := d.do(req, dir)
+		if statusErr, ok := err.(*webdavStatusError); ok && statusErr.code == http.StatusMethodNotAllowed {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// Delete removes the file at key
+func (d *WebDAV) Delete(ctx context.Context, key string) error {
+	req, err := d.request(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.do(req, key)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// request creates an authenticated request for key
+func (d *WebDAV) request(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	u := *d.base
+	u.Path += key
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if d.opts.Username != "" {
+		req.SetBasicAuth(d.opts.Username, d.opts.Password)
+	}
+	return req, nil
+}
+
+// webdavStatusError is a response with an unexpected status
+type webdavStatusError struct {
+	method, key string
+	code        int
+	status      string
+	message     string
+}
+
+func (e *webdavStatusError) Error() string {
+	return fmt.Sprintf("webdav: %s %s: %s: %s", e.method, e.key, e.status, e.message)
+}
+
+// Unwrap makes server failures match ErrUnavailable
+func (e *webdavStatusError) Unwrap() error {
+	if unavailableStatus(e.code) {
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// do sends the request and returns the response if its status is 2xx
+func (d *WebDAV) do(req *http.Request, key string) (*http.Response, error) {
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("webdav: %w: %v", ErrUnavailable, err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("webdav: %s: %w", key, ErrNotFound)
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return nil, &webdavStatusError{
+		method:  req.Method,
+		key:     key,
+		code:    resp.StatusCode,
+		status:  resp.Status,
+		message: strings.TrimSpace(string(message)),
+	}
+}
@@ -0,0 +1,138 @@
+// Package throttle limits the disk bandwidth of the server's own file
+// copies, such as remote transfers, checksums and moves between filesystems,
+// so that they leave spinning disks and network shares usable for others.
+package throttle
+
+import (
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxChunk bounds a single read or write, so that slow limits pace copies
+// smoothly rather than in bursts of large buffers
+const maxChunk = 256 << 10
+
+// Limiter lets bytes through at a sustained rate shared by all its users.
+// A nil limiter doesn't limit.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+// New returns a limiter allowing bytesPerSecond, nil if it is zero or less
+func New(bytesPerSecond float64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := math.Max(bytesPerSecond, maxChunk)
+	return &Limiter{
+		rate:   bytesPerSecond,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// Wait blocks until n more bytes may pass. Concurrent callers are served in
+// turn, so together they stay within the rate.
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := l.now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	// Taking the tokens ahead queues later callers behind this one
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+// Reader returns r limited by l
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{r: r, l: l}
+}
+
+// Writer returns w limited by l
+func (l *Limiter) Writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &writer{w: w, l: l}
+}
+
+type reader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+	n, err := r.r.Read(p)
+	r.l.Wait(n)
+	return n, err
+}
+
+type writer struct {
+	w io.Writer
+	l *Limiter
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxChunk)]
+		w.l.Wait(len(chunk))
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// reads and writes limit the file copies of the whole process
+var reads, writes atomic.Pointer[Limiter]
+
+// Configure sets the limits of the process's file reads and writes in bytes
+// per second, zero for none
+func Configure(readBytesPerSecond, writeBytesPerSecond float64) {
+	reads.Store(New(readBytesPerSecond))
+	writes.Store(New(writeBytesPerSecond))
+}
+
+// Reads returns the limiter of the process's file reads, nil without a limit
+func Reads() *Limiter {
+	return reads.Load()
+}
+
+// Writes returns the limiter of the process's file writes, nil without a
+// limit
+func Writes() *Limiter {
+	return writes.Load()
+}
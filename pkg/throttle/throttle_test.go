@@ -0,0 +1,101 @@
+package throttle
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// fakeClock advances only when the limiter sleeps
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+func newFake(bytesPerSecond float64) (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := New(bytesPerSecond)
+	l.last = clock.now
+	l.now = func() time.Time { return clock.now }
+	l.sleep = clock.sleep
+	return l, clock
+}
+
+func TestWait(t *testing.T) {
+	l, clock := newFake(1 << 20)
+
+	// The first second's worth passes at once
+	l.Wait(1 << 20)
+	if clock.slept != 0 {
+		t.Errorf("Expected the burst to pass, slept %s", clock.slept)
+	}
+	// Then bytes pass at the rate
+	l.Wait(512 << 10)
+	if clock.slept != 500*time.Millisecond {
+		t.Errorf("Expected to sleep 500ms, slept %s", clock.slept)
+	}
+	l.Wait(2 << 20)
+	if clock.slept != 2500*time.Millisecond {
+		t.Errorf("Expected to sleep 2.5s in total, slept %s", clock.slept)
+	}
+
+	// Idle time refills no more than the burst
+	clock.now = clock.now.Add(time.Hour)
+	clock.slept = 0
+	l.Wait(3 << 20)
+	if clock.slept != 2*time.Second {
+		t.Errorf("Expected to sleep 2s after idling, slept %s", clock.slept)
+	}
+}
+
+func TestNoLimit(t *testing.T) {
+	if New(0) != nil || New(-1) != nil {
+		t.Error("Expected no limiter without a rate")
+	}
+	var l *Limiter
+	l.Wait(1 << 30)
+	var buf bytes.Buffer
+	if l.Reader(&buf) != io.Reader(&buf) || l.Writer(&buf) != io.Writer(&buf) {
+		t.Error("Expected a nil limiter to return its reader and writer")
+	}
+
+	Configure(0, 1e6)
+	if Reads() != nil || Writes() == nil {
+		t.Errorf("Expected only writes to be limited, got %v %v", Reads(), Writes())
+	}
+	Configure(0, 0)
+}
+
+func TestCopy(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3<<20)
+
+	l, clock := newFake(1 << 20)
+	var out bytes.Buffer
+	if _, err := io.Copy(l.Writer(&out), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("Expected the written data unchanged")
+	}
+	if clock.slept != 2*time.Second {
+		t.Errorf("Expected writing 3 MiB at 1 MiB/s to sleep 2s, slept %s", clock.slept)
+	}
+
+	l, clock = newFake(1 << 20)
+	out.Reset()
+	if _, err := io.Copy(&out, l.Reader(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("Expected the read data unchanged")
+	}
+	if clock.slept != 2*time.Second {
+		t.Errorf("Expected reading 3 MiB at 1 MiB/s to sleep 2s, slept %s", clock.slept)
+	}
+}
@@ -0,0 +1,216 @@
+// Package trash keeps originals replaced by optimized files for a retention
+// period so that a replacement can be undone.
+package trash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"media_optimizer/pkg/throttle"
+)
+
+// ErrNotFound is returned for entries that were never trashed or have been
+// purged
+var ErrNotFound = errors.New("not in trash")
+
+// entryFile holds the metadata of an entry next to the trashed file
+const entryFile = "entry.json"
+
+// Entry is one trashed file
+type Entry struct {
+	ID string `json:"id"`
+	// OriginalPath is where the file is restored to
+	OriginalPath string    `json:"originalPath"`
+	Size         int64     `json:"size"`
+	TrashedAt    time.Time `json:"trashedAt"`
+	// ExpiresAt is when the entry is purged, zero to keep it
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+// Store moves files into a directory with one subdirectory per entry
+type Store struct {
+	dir       string
+	retention time.Duration
+}
+
+// Open uses dir for trashed files, which are purged retention after being
+// trashed; zero keeps them until restored
+func Open(dir string, retention time.Duration) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create trash directory: %v", err)
+	}
+	return &Store{dir: dir, retention: retention}, nil
+}
+
+// Put moves the file at path into the trash under id, e.g. the ID of the
+// job that replaced it
+func (s *Store) Put(id, path string) (Entry, error) {
+	if !validID(id) {
+		return Entry{}, fmt.Errorf("invalid trash id %q", id)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Entry{}, err
+	}
+	if info.IsDir() {
+		return Entry{}, fmt.Errorf("%s is a directory", path)
+	}
+
+	entryDir := filepath.Join(s.dir, id)
+	if _, err := os.Stat(entryDir); err == nil {
+		return Entry{}, fmt.Errorf("trash entry %s already exists", id)
+	}
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		return Entry{}, fmt.Errorf("failed to create trash entry: %v", err)
+	}
+
+	entry := Entry{ID: id, OriginalPath: path, Size: info.Size(), TrashedAt: time.Now()}
+	if s.retention > 0 {
+		entry.ExpiresAt = entry.TrashedAt.Add(s.retention)
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(entryDir, entryFile), data, 0644)
+	}
+	if err == nil {
+		err = Move(path, s.filePath(entry))
+	}
+	if err != nil {
+		os.RemoveAll(entryDir)
+		return Entry{}, fmt.Errorf("failed to trash %s: %v", path, err)
+	}
+	return entry, nil
+}
+
+// Get returns the entry with the given id
+func (s *Store) Get(id string) (Entry, error) {
+	if !validID(id) {
+		return Entry{}, ErrNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, id, entryFile))
+	if os.IsNotExist(err) {
+		return Entry{}, ErrNotFound
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return Entry{}, fmt.Errorf("invalid trash entry %s: %v", id, err)
+	}
+	return entry, nil
+}
+
+// List returns every entry, most recently trashed first
+func (s *Store) List() ([]Entry, error) {
+	dirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := []Entry{}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		if entry, err := s.Get(d.Name()); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].TrashedAt.After(entries[j].TrashedAt)
+	})
+	return entries, nil
+}
+
+// Restore moves the file with the given id back to its original path and
+// removes the entry. It fails when something else occupies that path.
+func (s *Store) Restore(id string) (Entry, error) {
+	entry, err := s.Get(id)
+	if err != nil {
+		return Entry{}, err
+	}
+	if _, err := os.Lstat(entry.OriginalPath); err == nil {
+		return Entry{}, fmt.Errorf("%s already exists", entry.OriginalPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(entry.OriginalPath), 0755); err != nil {
+		return Entry{}, err
+	}
+	if err := Move(s.filePath(entry), entry.OriginalPath); err != nil {
+		return Entry{}, fmt.Errorf("failed to restore %s: %v", entry.OriginalPath, err)
+	}
+	return entry, os.RemoveAll(filepath.Join(s.dir, id))
+}
+
+// Purge deletes the entries that expired by now and returns them
+func (s *Store) Purge(now time.Time) ([]Entry, error) {
+	entries, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	var purged []Entry
+	for _, entry := range entries {
+		if entry.ExpiresAt.IsZero() || now.Before(entry.ExpiresAt) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.dir, entry.ID)); err != nil {
+			return purged, err
+		}
+		purged = append(purged, entry)
+	}
+	return purged, nil
+}
+
+// filePath is where the trashed file of entry is kept
+func (s *Store) filePath(entry Entry) string {
+	return filepath.Join(s.dir, entry.ID, filepath.Base(entry.OriginalPath))
+}
+
+// validID rejects IDs that would escape the trash directory
+func validID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
+
+// Move renames src to dst, falling back to copying when they are on
+// different filesystems
+func Move(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".partial"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(throttle.Writes().Writer(out), throttle.Reads().Reader(in)); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Chtimes(dst, info.ModTime(), info.ModTime())
+	return os.Remove(src)
+}
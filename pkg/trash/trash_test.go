@@ -0,0 +1,74 @@
+package trash
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPutRestorePurge(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(filepath.Join(dir, "trash"), time.Hour)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	original := filepath.Join(dir, "movie.mkv")
+	os.WriteFile(original, []byte("original"), 0644)
+	entry, err := store.Put("job1", original)
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := os.Stat(original); !os.IsNotExist(err) {
+		t.Errorf("Expected the original to be moved, got %v", err)
+	}
+	if entry.Size != 8 || entry.ExpiresAt.Sub(entry.TrashedAt) != time.Hour {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+	if _, err := store.Put("job1", original); err == nil {
+		t.Error("Expected a second Put of a missing file to fail")
+	}
+
+	// A file at the original path blocks the restore
+	os.WriteFile(original, []byte("optimized"), 0644)
+	if _, err := store.Restore("job1"); err == nil {
+		t.Error("Expected Restore over an existing file to fail")
+	}
+	os.Remove(original)
+	if _, err := store.Restore("job1"); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if data, _ := os.ReadFile(original); string(data) != "original" {
+		t.Errorf("Expected the original back, got %q", data)
+	}
+	if _, err := store.Get("job1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the entry to be gone, got %v", err)
+	}
+
+	// Only expired entries are purged
+	store.Put("job2", original)
+	if purged, err := store.Purge(time.Now()); err != nil || len(purged) != 0 {
+		t.Errorf("Expected nothing purged yet, got %+v (%v)", purged, err)
+	}
+	purged, err := store.Purge(time.Now().Add(2 * time.Hour))
+	if err != nil || len(purged) != 1 || purged[0].ID != "job2" {
+		t.Errorf("Expected job2 purged, got %+v (%v)", purged, err)
+	}
+	if entries, _ := store.List(); len(entries) != 0 {
+		t.Errorf("Expected an empty trash, got %+v", entries)
+	}
+}
+
+func TestInvalidID(t *testing.T) {
+	store, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for _, id := range []string{"", "..", "a/b"} {
+		if _, err := store.Get(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q): expected ErrNotFound, got %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+// Package upload receives files in chunks into an inbox directory. Uploads
+// survive restarts: their data and state are kept in the inbox's .uploads
+// directory until the last chunk arrives, so clients resume them from the
+// offset they reached.
+package upload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"media_optimizer/pkg/uuid"
+)
+
+// stateDir is the inbox directory holding the uploads in progress
+const stateDir = ".uploads"
+
+var (
+	// ErrNotFound is returned for uploads that don't exist, were completed
+	// before a restart or belong to another user
+	ErrNotFound = errors.New("upload not found")
+	// ErrOffset is returned for chunks not starting where the upload stands
+	ErrOffset = errors.New("chunk does not start at the received offset")
+	// ErrBusy is returned for chunks of an upload receiving another chunk
+	ErrBusy = errors.New("upload is receiving another chunk")
+	// ErrTooLarge is returned for chunks past the announced size
+	ErrTooLarge = errors.New("chunk exceeds the upload's size")
+)
+
+// Upload is a file being received
+type Upload struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Size is the announced size of the file, Received how much of it
+	// arrived
+	Size     int64 `json:"size"`
+	Received int64 `json:"received"`
+	// Path is where the completed file was put in the inbox
+	Path string `json:"path,omitempty"`
+	// Optimize queues a job for the completed file with Profile
+	Optimize bool   `json:"optimize,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+	// User started the upload; only they may continue it
+	User      string    `json:"user,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Complete reports whether the whole file arrived
+func (u Upload) Complete() bool {
+	return u.Path != ""
+}
+
+// Store keeps the uploads into an inbox
+type Store struct {
+	mu      sync.Mutex
+	dir     string
+	expiry  time.Duration
+	uploads map[string]*Upload
+	busy    map[string]bool
+}
+
+// Open loads the uploads in progress of the inbox dir. Uploads without a
+// chunk for expiry are discarded; zero keeps them.
+func Open(dir string, expiry time.Duration) (*Store, error) {
+	s := &Store{dir: dir, expiry: expiry, uploads: make(map[string]*Upload), busy: make(map[string]bool)}
+	if err := os.MkdirAll(filepath.Join(dir, stateDir), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %v", err)
+	}
+	states, err := filepath.Glob(filepath.Join(dir, stateDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range states {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upload %s: %v", path, err)
+		}
+		var u Upload
+		if err := json.Unmarshal(data, &u); err != nil {
+			return nil, fmt.Errorf("failed to parse upload %s: %v", path, err)
+		}
+		// Chunks written after the last saved state are received again
+		if info, err := os.Stat(s.partPath(u.ID)); err == nil && info.Size() > u.Received {
+			os.Truncate(s.partPath(u.ID), u.Received)
+		}
+		s.uploads[u.ID] = &u
+	}
+	return s, nil
+}
+
+// Create starts an upload of the file u names and returns it with its ID
+func (s *Store) Create(u Upload) (Upload, error) {
+	name := strings.TrimSpace(u.Name)
+	if name == "" || name != filepath.Base(name) || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return Upload{}, fmt.Errorf("invalid file name %q", u.Name)
+	}
+	if u.Size <= 0 {
+		return Upload{}, fmt.Errorf("size must be positive, got %d", u.Size)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	u.ID = uuid.New()
+	u.Name = name
+	u.Received = 0
+	u.Path = ""
+	u.CreatedAt = time.Now()
+	u.UpdatedAt = u.CreatedAt
+	f, err := os.Create(s.partPath(u.ID))
+	if err != nil {
+		return Upload{}, fmt.Errorf("failed to create upload: %v", err)
+	}
+	f.Close()
+	if err := s.save(&u); err != nil {
+		os.Remove(s.partPath(u.ID))
+		return Upload{}, err
+	}
+	s.uploads[u.ID] = &u
+	return u, nil
+}
+
+// Get returns the upload with the given ID of user
+func (s *Store) Get(id, user string) (Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok || u.User != user {
+		return Upload{}, ErrNotFound
+	}
+	return *u, nil
+}
+
+// Write appends the chunk read from r to the upload with the given ID of
+// user. The chunk must start at offset, the size received so far. What
+// arrived of a chunk cut short is kept, for the client to resume from the
+// returned upload's Received. Once the file is complete it is moved into
+// the inbox, named after the upload or with a number added when the name
+// is taken.
+func (s *Store) Write(id, user string, offset int64, r io.Reader) (Upload, error) {
+	s.mu.Lock()
+	u, ok := s.uploads[id]
+	switch {
+	case !ok || u.User != user:
+		s.mu.Unlock()
+		return Upload{}, ErrNotFound
+	case s.busy[id]:
+		s.mu.Unlock()
+		return *u, ErrBusy
+	case u.Complete():
+		s.mu.Unlock()
+		return *u, fmt.Errorf("upload is complete")
+	case offset != u.Received:
+		s.mu.Unlock()
+		return *u, fmt.Errorf("%w: expected %d, got %d", ErrOffset, u.Received, offset)
+	}
+	s.busy[id] = true
+	size := u.Size
+	s.mu.Unlock()
+
+	n, writeErr := s.append(id, offset, size, r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.busy, id)
+	u.Received = offset + n
+	u.UpdatedAt = time.Now()
+	if writeErr == nil && u.Received == u.Size {
+		writeErr = s.finish(u)
+	}
+	if err := s.save(u); err != nil && writeErr == nil {
+		writeErr = err
+	}
+	if u.Complete() {
+		os.Remove(s.statePath(id))
+	}
+	return *u, writeErr
+}
+
+// append writes r to the part file of an upload at offset, up to the
+// upload's size, and returns how many bytes it kept
+func (s *Store) append(id string, offset, size int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.partPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, size-offset))
+	if err == nil {
+		// Anything left is past the announced size, which drops the chunk
+		var extra [1]byte
+		if m, _ := r.Read(extra[:]); m > 0 {
+			n, err = 0, ErrTooLarge
+			f.Truncate(offset)
+		}
+	}
+	if syncErr := f.Sync(); err == nil {
+		err = syncErr
+	}
+	return n, err
+}
+
+// finish moves a complete upload into the inbox. Callers must hold the lock.
+func (s *Store) finish(u *Upload) error {
+	ext := filepath.Ext(u.Name)
+	base := strings.TrimSuffix(u.Name, ext)
+	for i := 0; ; i++ {
+		path := filepath.Join(s.dir, u.Name)
+		if i > 0 {
+			path = filepath.Join(s.dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		}
+		if _, err := os.Lstat(path); err == nil {
+			continue
+		}
+		if err := os.Rename(s.partPath(u.ID), path); err != nil {
+			return fmt.Errorf("failed to move upload into the inbox: %v", err)
+		}
+		u.Path = path
+		return nil
+	}
+}
+
+// Remove discards the upload with the given ID of user, and what it
+// received
+func (s *Store) Remove(id, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok || u.User != user {
+		return ErrNotFound
+	}
+	if s.busy[id] {
+		return ErrBusy
+	}
+	s.remove(id)
+	return nil
+}
+
+// expire discards the uploads without a chunk for the expiry. Callers must
+// hold the lock.
+func (s *Store) expire() {
+	if s.expiry <= 0 {
+		return
+	}
+	for id, u := range s.uploads {
+		if !s.busy[id] && time.Since(u.UpdatedAt) > s.expiry {
+			s.remove(id)
+		}
+	}
+}
+
+// remove forgets an upload and deletes its files in progress. Callers must
+// hold the lock.
+func (s *Store) remove(id string) {
+	if !s.uploads[id].Complete() {
+		os.Remove(s.partPath(id))
+		os.Remove(s.statePath(id))
+	}
+	delete(s.uploads, id)
+}
+
+// save writes the state of an upload in progress via a temp file and
+// rename. Callers must hold the lock.
+func (s *Store) save(u *Upload) error {
+	if u.Complete() {
+		return nil
+	}
+	data, err := json.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode upload: %v", err)
+	}
+	tmp := s.statePath(u.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write upload: %v", err)
+	}
+	return os.Rename(tmp, s.statePath(u.ID))
+}
+
+func (s *Store) partPath(id string) string {
+	return filepath.Join(s.dir, stateDir, id+".part")
+}
+
+func (s *Store) statePath(id string) string {
+	return filepath.Join(s.dir, stateDir, id+".json")
+}
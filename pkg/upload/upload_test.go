@@ -0,0 +1,113 @@
+package upload
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingReader returns its data, then an error as a dropped connection does
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	for _, name := range []string{"", "../movie.mp4", ".hidden.mp4", `a\b.mp4`} {
+		if _, err := store.Create(Upload{Name: name, Size: 10}); err == nil {
+			t.Errorf("Expected name %q to be rejected", name)
+		}
+	}
+	if _, err := store.Create(Upload{Name: "clip.mp4"}); err == nil {
+		t.Error("Expected an empty upload to be rejected")
+	}
+
+	u, err := store.Create(Upload{Name: "clip.mp4", Size: 10, Optimize: true, User: "alice"})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := store.Get(u.ID, "bob"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected another user's upload to be out of reach, got %v", err)
+	}
+
+	// A chunk cut short keeps what arrived
+	u, err = store.Write(u.ID, "alice", 0, &failingReader{strings.NewReader("0123")})
+	if err == nil || u.Received != 4 {
+		t.Fatalf("Expected 4 bytes of a failed chunk, got %d (%v)", u.Received, err)
+	}
+	if _, err := store.Write(u.ID, "alice", 0, strings.NewReader("0123")); !errors.Is(err, ErrOffset) {
+		t.Errorf("Expected ErrOffset for a chunk at the wrong offset, got %v", err)
+	}
+
+	// The upload resumes after a restart
+	store, err = Open(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	if got, err := store.Get(u.ID, "alice"); err != nil || got.Received != 4 || !got.Optimize {
+		t.Fatalf("Expected the upload at 4 bytes, got %+v (%v)", got, err)
+	}
+	if got, err := store.Write(u.ID, "alice", 4, strings.NewReader("456789x")); !errors.Is(err, ErrTooLarge) || got.Received != 4 {
+		t.Errorf("Expected ErrTooLarge to drop the chunk, got %d (%v)", got.Received, err)
+	}
+	if got, err := store.Write(u.ID, "alice", 4, strings.NewReader("456789")); err != nil || got.Path != filepath.Join(dir, "clip.mp4") {
+		t.Fatalf("Expected the upload in clip.mp4, got %+v (%v)", got, err)
+	}
+
+	// Another upload of the name doesn't replace the file
+	u, err = store.Create(Upload{Name: "clip.mp4", Size: 3, User: "alice"})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	u, err = store.Write(u.ID, "alice", 0, strings.NewReader("new"))
+	if err != nil || !u.Complete() || u.Path != filepath.Join(dir, "clip (1).mp4") {
+		t.Fatalf("Expected the upload in clip (1).mp4, got %+v (%v)", u, err)
+	}
+	if data, _ := os.ReadFile(u.Path); string(data) != "new" {
+		t.Errorf("Expected the uploaded data, got %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "clip.mp4")); string(data) != "0123456789" {
+		t.Errorf("Expected the resumed upload's data, got %q", data)
+	}
+	if _, err := store.Write(u.ID, "alice", 3, strings.NewReader("x")); err == nil {
+		t.Error("Expected a complete upload to take no more chunks")
+	}
+
+	if err := store.Remove(u.ID, "alice"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := os.Stat(u.Path); err != nil {
+		t.Errorf("Expected removing a complete upload to keep its file: %v", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := Open(dir, time.Millisecond)
+	stale, _ := store.Create(Upload{Name: "stale.mp4", Size: 10})
+	time.Sleep(5 * time.Millisecond)
+	store.Create(Upload{Name: "fresh.mp4", Size: 10})
+	if _, err := store.Get(stale.ID, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the stale upload to be discarded, got %v", err)
+	}
+	if _, err := os.Stat(store.partPath(stale.ID)); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale upload's data to be deleted, got %v", err)
+	}
+}
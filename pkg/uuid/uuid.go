@@ -0,0 +1,45 @@
+// Package uuid generates the identifiers of jobs.
+//
+// They are version 7 UUIDs (RFC 9562): the first 48 bits are the creation
+// time in milliseconds, so IDs sort roughly in creation order, and the rest
+// is random.
+package uuid
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// New returns a new version 7 UUID in its canonical form, e.g.
+// "01890a5d-ac96-774b-bcce-b302099a8057"
+func New() string {
+	return newAt(time.Now())
+}
+
+func newAt(t time.Time) string {
+	var u [16]byte
+	if _, err := rand.Read(u[6:]); err != nil {
+		// crypto/rand doesn't fail on supported platforms
+		panic(fmt.Sprintf("uuid: failed to read random bytes: %v", err))
+	}
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(t.UnixMilli()))
+	copy(u[:6], ms[2:])
+	u[6] = 0x70 | u[6]&0x0f // version 7
+	u[8] = 0x80 | u[8]&0x3f // RFC 9562 variant
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
@@ -0,0 +1,30 @@
+package uuid
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+var canonical = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNew(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := New()
+		if !canonical.MatchString(id) {
+			t.Fatalf("Expected a canonical version 7 UUID, got %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("Duplicate UUID %s", id)
+		}
+		seen[id] = true
+	}
+
+	// The timestamp prefix orders IDs of different milliseconds
+	at := time.UnixMilli(1700000000000)
+	first, second := newAt(at), newAt(at.Add(time.Millisecond))
+	if first[:13] != "018bcfe5-6800" || first >= second {
+		t.Errorf("Expected time-ordered IDs, got %s and %s", first, second)
+	}
+}
@@ -0,0 +1,184 @@
+// Package watch polls folders for new files. A file is reported once it has
+// stopped changing between two polls, so files still being copied or
+// downloaded into a folder aren't picked up half written. Polling works the
+// same on local disks and network shares, where change notifications are
+// unreliable.
+package watch
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"media_optimizer/pkg/exclude"
+)
+
+// Folder is a watched directory
+type Folder struct {
+	Path string
+	// Recursive also watches the folder's subdirectories
+	Recursive bool
+	// Extensions are the lower-case extensions, with the dot, of the files
+	// reported; empty reports every file
+	Extensions []string
+	// Exclude leaves out the files and directories it excludes
+	Exclude *exclude.Rules
+}
+
+// Handler receives a settled file and the index of the folder it is in. It
+// returns false to have the file reported again at the next poll, e.g. while
+// it can't tell yet whether to act on it.
+type Handler func(folder int, path string) bool
+
+// state is what a poll saw of a file
+type state struct {
+	size    int64
+	modTime time.Time
+	// reported is set once the handler was called for this state
+	reported bool
+}
+
+// Watcher polls folders and reports their settled files. It is safe for
+// concurrent use.
+type Watcher struct {
+	folders []Folder
+	handler Handler
+
+	mu    sync.Mutex
+	files map[string]state
+}
+
+// New returns a watcher reporting the settled files of folders to handler
+func New(folders []Folder, handler Handler) *Watcher {
+	return &Watcher{folders: folders, handler: handler, files: make(map[string]state)}
+}
+
+// Run polls the folders every interval until ctx is cancelled. Files
+// already in the folders are reported once they have settled too.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.Poll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll lists the folders once, reporting the files unchanged since the last
+// poll that weren't reported yet. A file that changes afterwards, e.g. one
+// replaced by a new copy, is reported again once it settles.
+func (w *Watcher) Poll() {
+	current := make(map[string]state)
+	for _, folder := range w.folders {
+		for path, s := range list(folder) {
+			current[path] = s
+		}
+	}
+
+	w.mu.Lock()
+	var settled []string
+	for path, s := range current {
+		prev, ok := w.files[path]
+		if ok && prev.size == s.size && prev.modTime.Equal(s.modTime) {
+			s.reported = prev.reported
+			if !s.reported {
+				settled = append(settled, path)
+				s.reported = true
+			}
+		}
+		current[path] = s
+	}
+	// Files gone since the last poll are forgotten with the old map
+	w.files = current
+	w.mu.Unlock()
+
+	for _, path := range settled {
+		if w.handler(w.folderOf(path), path) {
+			continue
+		}
+		w.mu.Lock()
+		if s, ok := w.files[path]; ok {
+			s.reported = false
+			w.files[path] = s
+		}
+		w.mu.Unlock()
+	}
+}
+
+// folderOf returns the index of the folder path was found in, preferring
+// the most specific one when folders nest
+func (w *Watcher) folderOf(path string) int {
+	best, length := -1, -1
+	for i, folder := range w.folders {
+		root := filepath.Clean(folder.Path)
+		if within(root, path, folder.Recursive) && len(root) > length {
+			best, length = i, len(root)
+		}
+	}
+	return best
+}
+
+// within reports whether path is a file of the folder root
+func within(root, path string, recursive bool) bool {
+	dir := filepath.Dir(path)
+	if !recursive {
+		return dir == root
+	}
+	rel, err := filepath.Rel(root, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// list returns the files of folder with a wanted extension. Hidden files,
+// such as the partial files of copies in progress, are skipped, as are
+// unreadable directories.
+func list(folder Folder) map[string]state {
+	files := make(map[string]state)
+	root := filepath.Clean(folder.Path)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() && path != root {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		hidden := strings.HasPrefix(d.Name(), ".")
+		if d.IsDir() {
+			if path != root && (hidden || !folder.Recursive) || folder.Exclude.SkipDir(path) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if hidden || !d.Type().IsRegular() || !wanted(path, folder.Extensions) || folder.Exclude.Matches(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files[path] = state{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	return files
+}
+
+// wanted reports whether path has one of extensions, or any extension when
+// there are none
+func wanted(path string, extensions []string) bool {
+	if len(extensions) == 0 {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPoll(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		return path
+	}
+
+	var reported []string
+	accept := true
+	w := New([]Folder{
+		{Path: root, Extensions: []string{".mkv"}},
+		{Path: filepath.Join(root, "tv"), Recursive: true, Extensions: []string{".mkv"}},
+	}, func(folder int, path string) bool {
+		reported = append(reported, filepath.Base(path))
+		if filepath.Base(path) == "show.mkv" && folder != 1 {
+			t.Errorf("Expected show.mkv in folder 1, got %d", folder)
+		}
+		return accept
+	})
+
+	movie := write("movie.mkv", "a")
+	write(".partial.mkv", "a")
+	write("notes.txt", "a")
+	write("sub/skipped.mkv", "a")
+	write("tv/season/show.mkv", "a")
+
+	w.Poll()
+	if len(reported) != 0 {
+		t.Fatalf("Expected nothing before files settle, got %v", reported)
+	}
+	w.Poll()
+	if len(reported) != 2 {
+		t.Fatalf("Expected movie.mkv and show.mkv, got %v", reported)
+	}
+	w.Poll()
+	if len(reported) != 2 {
+		t.Fatalf("Expected settled files to be reported once, got %v", reported)
+	}
+
+	// A changed file is reported again once it settles
+	if err := os.Chtimes(movie, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to touch file: %v", err)
+	}
+	w.Poll()
+	if len(reported) != 2 {
+		t.Fatalf("Expected the changed file to settle first, got %v", reported)
+	}
+	w.Poll()
+	if len(reported) != 3 || reported[2] != "movie.mkv" {
+		t.Fatalf("Expected movie.mkv to be reported again, got %v", reported)
+	}
+
+	// Files the handler declines come back at the next poll
+	accept = false
+	write("later.mkv", "a")
+	w.Poll()
+	w.Poll()
+	w.Poll()
+	if len(reported) != 5 || reported[3] != "later.mkv" || reported[4] != "later.mkv" {
+		t.Fatalf("Expected later.mkv to be reported until accepted, got %v", reported)
+	}
+	accept = true
+	w.Poll()
+	w.Poll()
+	if len(reported) != 6 {
+		t.Fatalf("Expected later.mkv to stop once accepted, got %v", reported)
+	}
+}
@@ -0,0 +1,146 @@
+// Package wsproto defines the messages clients send over the /ws WebSocket
+// and validates them before they reach a handler.
+//
+// A client message is a JSON object {"v": 1, "type": ..., "id": ..., "data":
+// {...}}. "v" is the protocol version, 1 if omitted; "id" is optional and
+// echoed in the replies so clients can match them to their requests. Each
+// type has its own data, whose unknown fields are rejected like those of the
+// envelope.
+package wsproto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Version is the protocol version the server speaks
+const Version = 1
+
+// maxIDLength bounds the correlation ID echoed back to the client
+const maxIDLength = 128
+
+// Types of client messages
+const (
+	// TypeOptimize starts a job
+	TypeOptimize = "optimize"
+	// TypeJobs queries the job history
+	TypeJobs = "jobs"
+	// TypeSubscribe follows jobs started elsewhere, e.g. before a reconnect
+	TypeSubscribe = "subscribe"
+)
+
+// types are the known client message types
+var types = map[string]bool{
+	TypeOptimize:  true,
+	TypeJobs:      true,
+	TypeSubscribe: true,
+}
+
+// Codes of error replies
+const (
+	CodeInvalidJSON        = "invalid_json"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeUnknownType        = "unknown_type"
+	CodeInvalidData        = "invalid_data"
+	CodeForbidden          = "forbidden"
+	CodeRateLimited        = "rate_limited"
+	CodeRejected           = "rejected"
+	CodeConflict           = "conflict"
+	CodeNotFound           = "not_found"
+	CodeInternal           = "internal"
+)
+
+// Error is a message the server refuses, with the code of the error reply
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func errorf(code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Request is a message from a client
+type Request struct {
+	V    int             `json:"v"`
+	Type string          `json:"type"`
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Validator is implemented by message data with constraints beyond its
+// JSON shape
+type Validator interface {
+	Validate() error
+}
+
+// Parse decodes and checks the envelope of a client message. Errors are
+// *Error.
+func Parse(raw []byte) (*Request, error) {
+	var req Request
+	if err := decodeStrict(raw, &req); err != nil {
+		return nil, errorf(CodeInvalidJSON, "invalid message: %v", err)
+	}
+	if req.V == 0 {
+		req.V = Version
+	}
+	if req.V != Version {
+		return &req, errorf(CodeUnsupportedVersion, "unsupported protocol version %d, the server speaks %d", req.V, Version)
+	}
+	if len(req.ID) > maxIDLength {
+		return &req, errorf(CodeInvalidData, "id longer than %d characters", maxIDLength)
+	}
+	if !types[req.Type] {
+		return &req, errorf(CodeUnknownType, "unknown message type %q, expected one of %s", req.Type, knownTypes())
+	}
+	return &req, nil
+}
+
+// Decode decodes the message's data into v and validates it. Errors are
+// *Error.
+func (r *Request) Decode(v interface{}) error {
+	if len(r.Data) == 0 || string(r.Data) == "null" {
+		return errorf(CodeInvalidData, "%s message without data", r.Type)
+	}
+	if err := decodeStrict(r.Data, v); err != nil {
+		return errorf(CodeInvalidData, "invalid %s data: %v", r.Type, err)
+	}
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return errorf(CodeInvalidData, "invalid %s data: %v", r.Type, err)
+		}
+	}
+	return nil
+}
+
+// decodeStrict decodes a single JSON object, rejecting unknown fields and
+// trailing data
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return errors.New("trailing data after the object")
+	}
+	return nil
+}
+
+func knownTypes() string {
+	var names []string
+	for name := range types {
+		names = append(names, fmt.Sprintf("%q", name))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
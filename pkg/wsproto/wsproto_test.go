@@ -0,0 +1,85 @@
+package wsproto
+
+import (
+	"errors"
+	"testing"
+)
+
+type optimizeData struct {
+	Path string `json:"path"`
+}
+
+func (d *optimizeData) Validate() error {
+	if d.Path == "" {
+		return errors.New("path is required")
+	}
+	return nil
+}
+
+func TestParse(t *testing.T) {
+	req, err := Parse([]byte(`{"type": "optimize", "id": "42", "data": {"path": "/media/a.mkv"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.V != Version || req.ID != "42" {
+		t.Errorf("Expected version %d and id 42, got %+v", Version, req)
+	}
+	var data optimizeData
+	if err := req.Decode(&data); err != nil || data.Path != "/media/a.mkv" {
+		t.Errorf("Expected the path, got %q %v", data.Path, err)
+	}
+
+	for _, typ := range []string{TypeOptimize, TypeJobs, TypeSubscribe} {
+		if _, err := Parse([]byte(`{"type": "` + typ + `"}`)); err != nil {
+			t.Errorf("%s: %v", typ, err)
+		}
+	}
+
+	for raw, code := range map[string]string{
+		`not json`:                                   CodeInvalidJSON,
+		`["optimize"]`:                               CodeInvalidJSON,
+		`{"type": "optimize", "jobId": "x"}`:         CodeInvalidJSON,
+		`{"type": "jobs"} {"type": "jobs"}`:          CodeInvalidJSON,
+		`{"v": 2, "type": "jobs"}`:                   CodeUnsupportedVersion,
+		`{"type": "reboot"}`:                         CodeUnknownType,
+		`{"type": {"nested": true}}`:                 CodeInvalidJSON,
+		`{"type": "jobs", "id": "` + longID() + `"}`: CodeInvalidData,
+	} {
+		_, err := Parse([]byte(raw))
+		var protoErr *Error
+		if !errors.As(err, &protoErr) || protoErr.Code != code {
+			t.Errorf("%s: expected %s, got %v", raw, code, err)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for raw, ok := range map[string]bool{
+		`{"type": "optimize", "data": {"path": "/a.mkv"}}`:            true,
+		`{"type": "optimize"}`:                                        false,
+		`{"type": "optimize", "data": null}`:                          false,
+		`{"type": "optimize", "data": "/a.mkv"}`:                      false,
+		`{"type": "optimize", "data": {"path": 1}}`:                   false,
+		`{"type": "optimize", "data": {"path": "/a.mkv", "x": true}}`: false,
+		`{"type": "optimize", "data": {}}`:                            false,
+	} {
+		req, err := Parse([]byte(raw))
+		if err != nil {
+			t.Fatalf("%s: %v", raw, err)
+		}
+		var data optimizeData
+		err = req.Decode(&data)
+		var protoErr *Error
+		if ok != (err == nil) || (err != nil && (!errors.As(err, &protoErr) || protoErr.Code != CodeInvalidData)) {
+			t.Errorf("%s: expected ok %v, got %v", raw, ok, err)
+		}
+	}
+}
+
+func longID() string {
+	id := make([]byte, maxIDLength+1)
+	for i := range id {
+		id[i] = 'a'
+	}
+	return string(id)
+}
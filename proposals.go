@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"media_optimizer/pkg/auth"
+	"media_optimizer/pkg/config"
+	"media_optimizer/pkg/cost"
+	"media_optimizer/pkg/mediaopt"
+	"media_optimizer/pkg/proposals"
+	"media_optimizer/pkg/storage"
+)
+
+// errProposalRejected is returned for files whose proposal was rejected and
+// that haven't changed since
+var errProposalRejected = errors.New("a proposal for this file was rejected")
+
+// proposeJob records the request of an automated source as a proposal a
+// user approves or rejects, instead of queueing it. A file already proposed
+// returns the pending proposal.
+func proposeJob(request OptimizeRequest) (proposals.Proposal, error) {
+	kind, err := validateRequest(&request)
+	if err != nil {
+		return proposals.Proposal{}, err
+	}
+	if p, ok := proposalStore.Find(request.Path); ok {
+		if p.Status == proposals.StatusPending {
+			return p, nil
+		}
+		if info, err := os.Stat(request.Path); err == nil && info.ModTime().Before(p.RejectedAt) {
+			return p, errProposalRejected
+		}
+	}
+
+	proposal := proposals.Proposal{
+		Path:    request.Path,
+		Profile: request.Profile,
+		Origin:  request.origin,
+	}
+	if request.recipe != nil {
+		proposal.Watch = request.recipe.Path
+	}
+	if encodesVideo(kind) && !storage.IsRemote(request.Path) {
+		estimateProposal(&proposal)
+	}
+	return proposalStore.Add(proposal)
+}
+
+// estimateProposal probes the proposed file for its attributes and the
+// space the job would save
+func estimateProposal(p *proposals.Proposal) {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		p.Error = err.Error()
+		return
+	}
+	probe, err := mediaopt.Probe(p.Path)
+	if err != nil {
+		p.Error = err.Error()
+		return
+	}
+	p.Source = sourceInfo(probe)
+	p.Duration = probe.DurationSeconds()
+	p.InputBytes = info.Size()
+	p.EstimatedBytes = mediaopt.EstimateOutputSize(probe, info.Size())
+	p.EstimatedSavings = max(p.InputBytes-p.EstimatedBytes, 0)
+}
+
+// handleProposals serves GET /api/proposals, the jobs automated sources
+// proposed, and POST /api/proposals/{id}/approve or reject
+func handleProposals(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(apiPath(r), "/proposals")
+	if rest == "" || rest == "/" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status := r.URL.Query().Get("status")
+		visible := []proposals.Proposal{}
+		for _, p := range proposalStore.List() {
+			if (status == "" || p.Status == status) && authenticator.AllowedPath(r.Context(), p.Path) {
+				visible = append(visible, p)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"proposals": visible})
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	if action != "approve" && action != "reject" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	review.Lock()
+	defer review.Unlock()
+	proposal, err := proposalStore.Get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !authenticator.AllowedPath(r.Context(), proposal.Path) {
+		http.Error(w, errPathNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+	if proposal.Status != proposals.StatusPending {
+		http.Error(w, "proposal is "+proposal.Status, http.StatusConflict)
+		return
+	}
+	user, _ := auth.FromContext(r.Context())
+
+	if action == "reject" {
+		proposal, err = proposalStore.Reject(id, user.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Proposal rejected", "proposal", id, "path", proposal.Path, "user", user.Name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(proposal)
+		return
+	}
+
+	// The body is optional and only confirms the cost of cloud jobs
+	var confirm struct {
+		ConfirmCost bool `json:"confirmCost"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&confirm); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request := OptimizeRequest{Path: proposal.Path, Profile: proposal.Profile, ConfirmCost: confirm.ConfirmCost}
+	request.user = user
+	request.origin = proposal.Origin + ", approved"
+	if proposal.Watch != "" {
+		request.recipe = watchFolder(proposal.Watch)
+	}
+	job, err := enqueueJob(request, nil)
+	switch {
+	case errors.Is(err, cost.ErrBudgetExceeded):
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+		return
+	case errors.Is(err, cost.ErrConfirmationRequired):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), rejectStatus(err))
+		return
+	}
+	if err := proposalStore.Remove(id); err != nil {
+		slog.Error("Failed to remove approved proposal", "proposal", id, "error", err)
+	}
+	slog.Info("Proposal approved", "proposal", id, "job", job.ID, "path", job.SourcePath, "user", user.Name)
+
+	record, _ := jobStore.Get(job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(record)
+}
+
+// watchFolder returns the configured watch folder at path, nil when it was
+// removed from the configuration since
+func watchFolder(path string) *config.WatchFolder {
+	for i := range cfg.Watch.Folders {
+		if cfg.Watch.Folders[i].Path == path {
+			return &cfg.Watch.Folders[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"media_optimizer/pkg/auth"
+	"media_optimizer/pkg/jobevents"
+	"media_optimizer/pkg/jobstore"
+	"media_optimizer/pkg/quarantine"
+)
+
+// quarantineOutput moves the output a job's verification rejected into
+// quarantine, to be approved to the path the job would have written it to
+func quarantineOutput(job *OptimizationJob, output, rejected string, staged bool, reason error) error {
+	if staged {
+		output = filepath.Join(filepath.Dir(job.SourcePath), filepath.Base(output))
+	}
+	entry, err := quarantineStore.Put(quarantine.Entry{
+		ID:         job.ID,
+		SourcePath: job.SourcePath,
+		OutputPath: output,
+		Reason:     reason.Error(),
+	}, rejected)
+	if err != nil {
+		return err
+	}
+	if job.log != nil {
+		job.log.Printf("Output quarantined: %s", entry.Path)
+	}
+	recordEvent(job.ID, jobevents.TypeQuarantined, "", entry.Path)
+	return nil
+}
+
+// handleQuarantine serves GET /api/quarantine, the outputs awaiting review,
+// and POST /api/quarantine/{id}/approve or discard
+func handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(apiPath(r), "/quarantine")
+	if rest == "" || rest == "/" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		entries, err := quarantineStore.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		visible := []quarantine.Entry{}
+		for _, entry := range entries {
+			if authenticator.AllowedPath(r.Context(), entry.SourcePath) {
+				visible = append(visible, entry)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"entries": visible})
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	if action != "approve" && action != "discard" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	review.Lock()
+	defer review.Unlock()
+	entry, err := quarantineStore.Get(id)
+	if errors.Is(err, quarantine.ErrNotFound) {
+		http.Error(w, "output not in quarantine", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !authenticator.AllowedPath(r.Context(), entry.SourcePath) {
+		http.Error(w, errPathNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+
+	user, _ := auth.FromContext(r.Context())
+	if action == "discard" {
+		if _, err := quarantineStore.Discard(id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		updateQuarantined(id, func(r *jobstore.Record) {
+			r.Status = "discarded"
+		})
+		slog.Info("Quarantined output discarded", "job", id, "path", entry.OutputPath)
+		recordEvent(id, jobevents.TypeDiscarded, user.Name, "")
+	} else {
+		if _, err := quarantineStore.Approve(id); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		sum := fileChecksum(entry.OutputPath)
+		updateQuarantined(id, func(r *jobstore.Record) {
+			r.Status = "completed"
+			r.Error = ""
+			r.OutputPath = entry.OutputPath
+			r.OutputBytes = entry.Size
+			r.OutputSHA256 = sum
+		})
+		slog.Info("Quarantined output approved", "job", id, "path", entry.OutputPath)
+		recordEvent(id, jobevents.TypeApproved, user.Name, entry.OutputPath)
+		refreshes.Add(1)
+		go func() {
+			defer refreshes.Done()
+			refreshMediaServers(entry.OutputPath)
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// updateQuarantined records the review of a quarantined output in its job's
+// history record
+func updateQuarantined(id string, fn func(*jobstore.Record)) {
+	if err := jobStore.Update(id, func(r *jobstore.Record) {
+		fn(r)
+		r.ReviewedAt = time.Now()
+	}); err != nil {
+		slog.Error("Failed to update job history", "job", id, "error", err)
+	}
+}
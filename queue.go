@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"media_optimizer/pkg/auth"
+	"media_optimizer/pkg/jobevents"
+	"media_optimizer/pkg/mediaserver"
+	"media_optimizer/pkg/resources"
+)
+
+// QueueState is the answer of GET /api/queue: the jobs of this run, oldest
+// first, until they are cleared or the path is queued again
+type QueueState struct {
+	// Paused is set while the queue is paused through the API
+	Paused bool `json:"paused"`
+	// Resources is the latest sample of the host when it is monitored, and
+	// Pressure what holds new jobs back, see config resources
+	Resources *resources.Sample `json:"resources,omitempty"`
+	Pressure  []string          `json:"pressure,omitempty"`
+	// Streams are the media server streams the work makes way for, see
+	// config sessions
+	Streams []mediaserver.Session `json:"streams,omitempty"`
+	Jobs    []*OptimizationJob    `json:"jobs"`
+}
+
+// QueueResult is the outcome of a bulk queue operation for one job
+type QueueResult struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// Status is the job's status after the operation, that of the new job
+	// for a retry
+	Status string `json:"status"`
+	// RetryID is the job queued by a retry
+	RetryID string `json:"retryId,omitempty"`
+	// Error explains why the operation failed for the job
+	Error string `json:"error,omitempty"`
+}
+
+// QueueResponse answers the bulk queue operations
+type QueueResponse struct {
+	Paused  bool          `json:"paused"`
+	Results []QueueResult `json:"results"`
+}
+
+// handleQueue serves /api/queue and the bulk operations under it:
+// POST /api/queue/pause, resume, cancel, clear and retry
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(strings.TrimPrefix(apiPath(r), "/queue"), "/")
+	if action == "" {
+		handleQueueState(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var results []QueueResult
+	switch action {
+	case "pause", "resume":
+		// The queue is shared, so keys limited to paths can't hold it
+		if user, ok := auth.FromContext(r.Context()); ok && len(user.Paths) > 0 {
+			http.Error(w, "pausing the queue requires access to all paths", http.StatusForbidden)
+			return
+		}
+		results = pauseQueue(r, action == "pause")
+	case "cancel":
+		results = cancelQueue(r)
+	case "clear":
+		statuses := []string{"completed"}
+		if value := r.URL.Query().Get("status"); value != "" {
+			statuses = strings.Split(value, ",")
+		}
+		for _, status := range statuses {
+			if !jobFinished(status) {
+				http.Error(w, fmt.Sprintf("only finished jobs can be cleared, not %q", status), http.StatusBadRequest)
+				return
+			}
+		}
+		results = clearQueue(r, statuses)
+	case "retry":
+		results = retryQueue(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	slog.Info("Bulk queue operation", "action", action, "jobs", len(results), "user", userName(r.Context()))
+
+	if results == nil {
+		results = []QueueResult{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(QueueResponse{Paused: workGate.Held(), Results: results})
+}
+
+// handleQueueState lists the jobs of this run
+func handleQueueState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jobs := queueJobs(r)
+	if jobs == nil {
+		jobs = []*OptimizationJob{}
+	}
+
+	state := QueueState{Paused: workGate.Held(), Jobs: jobs}
+	if sample, pressure := resourceMonitor.Latest(); !sample.Time.IsZero() {
+		state.Resources, state.Pressure = &sample, pressure
+	}
+	streams.Lock()
+	state.Streams = streams.sessions
+	streams.Unlock()
+
+	// Encoded under the lock as running jobs keep changing
+	var buf bytes.Buffer
+	activeJobs.RLock()
+	err := json.NewEncoder(&buf).Encode(state)
+	activeJobs.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf.Bytes())
+}
+
+// queueJobs returns the jobs of this run the request may act on, oldest
+// first as job IDs are time-ordered
+func queueJobs(r *http.Request) []*OptimizationJob {
+	var jobs []*OptimizationJob
+	activeJobs.RLock()
+	for _, job := range activeJobs.jobs {
+		if authenticator.AllowedPath(r.Context(), job.SourcePath) {
+			jobs = append(jobs, job)
+		}
+	}
+	activeJobs.RUnlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+// queueResult returns the job's current state as a result
+func queueResult(job *OptimizationJob) QueueResult {
+	activeJobs.RLock()
+	defer activeJobs.RUnlock()
+	return QueueResult{ID: job.ID, Path: job.SourcePath, Status: job.Status}
+}
+
+// running reports whether a job in status has been started and not
+// finished
+func running(status string) bool {
+	return status == "processing" || status == "paused"
+}
+
+// pauseQueue holds or releases the queued jobs and pauses or resumes the
+// encoders of running ones. Image and audio jobs run on while paused.
+func pauseQueue(r *http.Request, pause bool) []QueueResult {
+	workGate.Hold(pause)
+
+	var results []QueueResult
+	for _, job := range queueJobs(r) {
+		result := queueResult(job)
+		if jobFinished(result.Status) {
+			continue
+		}
+		if pause && result.Status == "processing" && !pausable(job) {
+			result.Error = "running image and audio jobs can't be paused"
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// cancelQueue cancels the unfinished jobs. Queued jobs are dropped and the
+// encoders of running video jobs killed; image and audio jobs can only be
+// cancelled before they start.
+func cancelQueue(r *http.Request) []QueueResult {
+	var results []QueueResult
+	for _, job := range queueJobs(r) {
+		result := queueResult(job)
+		switch {
+		case jobFinished(result.Status):
+			continue
+		case running(result.Status) && !pausable(job):
+			result.Error = "running image and audio jobs can't be cancelled"
+		default:
+			// The job's context stops its processes
+			job.cancel()
+			user, _ := auth.FromContext(r.Context())
+			recordEvent(job.ID, jobevents.TypeCancelled, user.Name, "was "+result.Status)
+			result.Status = "cancelled"
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// clearQueue drops the finished jobs in one of statuses from the queue.
+// Their records stay in the job history.
+func clearQueue(r *http.Request, statuses []string) []QueueResult {
+	var results []QueueResult
+	for _, job := range queueJobs(r) {
+		activeJobs.Lock()
+		for _, status := range statuses {
+			if job.Status == status && activeJobs.jobs[job.ID] == job {
+				delete(activeJobs.jobs, job.ID)
+				results = append(results, QueueResult{ID: job.ID, Path: job.SourcePath, Status: job.Status})
+				break
+			}
+		}
+		activeJobs.Unlock()
+	}
+	return results
+}
+
+// retryQueue queues the failed jobs again with their original requests, on
+// behalf of the requesting user
+func retryQueue(r *http.Request) []QueueResult {
+	var results []QueueResult
+	for _, job := range queueJobs(r) {
+		result := queueResult(job)
+		if result.Status != "failed" {
+			continue
+		}
+		request := job.request
+		request.user, _ = auth.FromContext(r.Context())
+		request.origin = "retry of " + job.ID
+		retry, err := enqueueJob(request, nil)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Status = "queued"
+			result.RetryID = retry.ID
+			recordEvent(job.ID, jobevents.TypeRetry, request.user.Name, "queued again as "+retry.ID)
+		}
+		results = append(results, result)
+	}
+	return results
+}
@@ -7,14 +7,6 @@ NICE_LEVEL=10     # Nice level for CPU priority
 IO_CLASS="realtime"  # I/O class (none, realtime, best-effort, idle)
 IO_PRIORITY=5     # I/O priority (0-7, 7 being lowest)
 
-# Function to sanitize filename for temporary files
-sanitize_filename() {
-    local filename="$1"
-    # Remove special characters and replace spaces with underscores
-    echo "$filename" | tr -cd '[:alnum:]._-' | tr ' ' '_'
-}
-
-
 # Function to process a single file
 process_file() {
     input_file="$1"
@@ -22,7 +14,7 @@ process_file() {
     dirname=$(dirname "$input_file")
     extension="${filename##*.}"
     basename="${filename%.*}"
-    output_file="${dirname}/${basename}_optimized.${extension}"
+    output_file="${2:-${dirname}/${basename}_optimized.${extension}}"
     temp_dir="/tmp/ffmpeg_processing"
     echo "Checking video codec..."
     codec=$(ffprobe -v error -select_streams v:0 -show_entries stream=codec_name -of default=nw=1:nk=1 "$input_file" 2>&1)
@@ -35,7 +27,7 @@ process_file() {
     ionice -c "$IO_CLASS" -n "$IO_PRIORITY" -p $$
 
     # Calculate optimal thread count based on file size
-    file_size=$(stat -c %s "$input_file")
+    file_size=$(stat -c %s "$input_file" 2>/dev/null || echo 0)
     if [ "$file_size" -gt 10737418240 ]; then  # 10GB
         thread_count=$((THREADS - 1))
     else
@@ -46,7 +38,10 @@ process_file() {
     # Create sanitized temporary filename
     temp_id="$(date +%s%N)"
     # temp_output="${temp_dir}/temp_${temp_id}.${extension}"
-    temp_output="${temp_dir}/temp_${temp_id}.mp4"
+    # The encode is written next to the output, hidden, so moving it into
+    # place is a rename on the same filesystem rather than a copy that
+    # players could catch half done
+    temp_output="$(dirname "$output_file")/.temp_${temp_id}.${output_file##*.}"
     progress_file="${temp_dir}/progress_${temp_id}.txt"
     
     echo "Processing file: $input_file"
@@ -69,15 +64,28 @@ process_file() {
     # Get duration for progress calculation
     duration=$(ffprobe -v quiet -show_entries format=duration -of default=noprint_wrappers=1:nokey=1 "$input_file")
     echo "total_duration=$duration" > "$progress_file"
+    # The server reads the duration and ffmpeg's progress blocks from stdout
+    echo "total_duration=$duration"
 
+    # Options preceding the input supplied by the server, one per line, such
+    # as a read rate sparing slow disks and network shares
+    input_args=()
+    if [ -n "$MEDIA_OPTIMIZER_INPUT_ARGS" ]; then
+        mapfile -t input_args <<< "$MEDIA_OPTIMIZER_INPUT_ARGS"
+    fi
+
+    # Output options supplied by the server take precedence over the defaults
+    if [ ${#ffmpeg_output_args[@]} -gt 0 ]; then
+        echo "Using stream mapping supplied by the caller..."
+        ffmpeg -loglevel debug -nostats -progress pipe:1 "${input_args[@]}" -i "$input_file" "${ffmpeg_output_args[@]}" "$temp_output"
     # Only process audio if codec is HEVC
-    if [ "$codec" = "hevc" ]; then
+    elif [ "$codec" = "hevc" ]; then
         echo "Video already in HEVC format, processing audio only..."
-        ffmpeg -loglevel debug -i "$input_file" -map 0:v:0 -map 0:a:m:language:eng -metadata:s:a title="2.1 Optimized" -metadata:s:a language=eng -c:v copy -c:a ac3 -ac 2 -b:a 384k -af "dynaudnorm=f=500:g=15:p=0.95:r=0.5,volume=1.2" -f mp4 -movflags +faststart "$temp_output"
+        ffmpeg -loglevel debug -nostats -progress pipe:1 "${input_args[@]}" -i "$input_file" -map 0:v:0 -map 0:a:m:language:eng -metadata:s:a title="2.1 Optimized" -metadata:s:a language=eng -c:v copy -c:a ac3 -ac 2 -b:a 384k -af "dynaudnorm=f=500:g=15:p=0.95:r=0.5,volume=1.2" -f mp4 -movflags +faststart "$temp_output"
     else
         echo "Converting video to HEVC..."
-        ffmpeg -loglevel debug -i "$input_file" -map 0:v:0 -map 0:a:m:language:eng -metadata:s:a title="2.1 Optimized" -metadata:s:a language=eng -c:v copy -c:a ac3 -ac 2 -b:a 384k -af "volume=1.2" -f mp4 -movflags +faststart "$temp_output"
-        # ffmpeg -loglevel debug -i "$input_file" -map 0:v:0 -map 0:a:m:language:eng -metadata:s:a title="2.1 Optimized" -metadata:s:a language=eng -c:v libx265 -preset medium -crf 26 -c:a ac3 -ac 2 -b:a 384k -af "dynaudnorm=f=500:g=15:p=0.95:r=0.5,volume=1.2" -f mp4 -movflags +faststart "$temp_output"
+        ffmpeg -loglevel debug -nostats -progress pipe:1 "${input_args[@]}" -i "$input_file" -map 0:v:0 -map 0:a:m:language:eng -metadata:s:a title="2.1 Optimized" -metadata:s:a language=eng -c:v copy -c:a ac3 -ac 2 -b:a 384k -af "volume=1.2" -f mp4 -movflags +faststart "$temp_output"
+        # ffmpeg -loglevel debug -nostats -progress pipe:1 -i "$input_file" -map 0:v:0 -map 0:a:m:language:eng -metadata:s:a title="2.1 Optimized" -metadata:s:a language=eng -c:v libx265 -preset medium -crf 26 -c:a ac3 -ac 2 -b:a 384k -af "dynaudnorm=f=500:g=15:p=0.95:r=0.5,volume=1.2" -f mp4 -movflags +faststart "$temp_output"
     fi    
 
 
@@ -96,16 +104,25 @@ process_file() {
 
 # Main script
 if [ -z "$1" ]; then
-    echo "Usage: $0 <input_file>"
+    echo "Usage: $0 <input_file> [output_file] [ffmpeg output options...]"
     exit 1
 fi
 
 input_file="$1"
+output_arg="$2"
+shift $(( $# < 2 ? $# : 2 ))
+ffmpeg_output_args=("$@")
 
-if [ ! -f "$input_file" ]; then
-    echo "Error: Input file does not exist"
-    exit 1
-fi
+# Disc images are passed as ffmpeg protocol URLs rather than plain files
+case "$input_file" in
+    bluray:*|concat:*) ;;
+    *)
+        if [ ! -f "$input_file" ]; then
+            echo "Error: Input file does not exist"
+            exit 1
+        fi
+        ;;
+esac
 
 # Process the file
-process_file "$input_file"
+process_file "$input_file" "$output_arg"
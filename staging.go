@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"media_optimizer/pkg/config"
+	"media_optimizer/pkg/mediaopt"
+	"media_optimizer/pkg/netmount"
+	"media_optimizer/pkg/storage"
+	"media_optimizer/pkg/throttle"
+)
+
+// stagingDir holds the local copies of staged jobs while they run
+func stagingDir() string {
+	if cfg.Staging.Dir != "" {
+		return cfg.Staging.Dir
+	}
+	return filepath.Join(cfg.DataDir, "staging")
+}
+
+// stagedJob reports whether a video job with a local source is transcoded
+// from a copy in stagingDir
+func stagedJob(job *OptimizationJob) bool {
+	switch cfg.Staging.Mode {
+	case config.StagingAlways:
+		return true
+	case config.StagingNetwork:
+		_, ok := netmount.Find(mounts, job.SourcePath)
+		return ok
+	}
+	return false
+}
+
+// stageSource copies the source of a job into a new directory in
+// stagingDir, which the job then reads from and writes its output to.
+// cleanup removes the directory with the copies.
+func stageSource(job *OptimizationJob, progress storage.Progress) (cleanup func(), err error) {
+	info, err := os.Stat(job.SourcePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(stagingDir(), 0755); err != nil {
+		return nil, err
+	}
+	free, err := mediaopt.FreeSpace(stagingDir())
+	if err != nil {
+		return nil, fmt.Errorf("failed to check free space on %s: %v", stagingDir(), err)
+	}
+	if free < uint64(info.Size()) {
+		return nil, fmt.Errorf("insufficient space to stage the source on %s: need %d bytes, have %d free", stagingDir(), info.Size(), free)
+	}
+
+	dir, err := os.MkdirTemp(stagingDir(), "job-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup = func() {
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Warn("Failed to remove staged job files", "dir", dir, "error", err)
+		}
+	}
+
+	local := filepath.Join(dir, filepath.Base(job.SourcePath))
+	if err := copyFile(job.ctx, local, job.SourcePath, progress); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to stage source: %w", err)
+	}
+	job.input = local
+	if job.log != nil {
+		job.log.Printf("Staged %s in %s", job.SourcePath, local)
+	}
+	return cleanup, nil
+}
+
+// unstageOutput copies the output of a staged job next to the source and
+// returns its path there
+func unstageOutput(job *OptimizationJob, output string, progress storage.Progress) (string, error) {
+	final := filepath.Join(filepath.Dir(job.SourcePath), filepath.Base(output))
+	if final == job.SourcePath {
+		return "", fmt.Errorf("output %s would overwrite the source", final)
+	}
+	if err := copyFile(job.ctx, final, output, progress); err != nil {
+		return "", fmt.Errorf("failed to copy output back: %w", err)
+	}
+	if job.log != nil {
+		job.log.Printf("Copied output to %s", final)
+	}
+	return final, nil
+}
+
+// copyFile copies src to dst through a partial file flushed to disk and
+// renamed into place once complete, so dst is never left half written. The
+// copy is throttled and stops when ctx is cancelled.
+func copyFile(ctx context.Context, dst, src string, progress storage.Progress) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := mediaopt.PartialPath(dst)
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	r := &copyReader{ctx: ctx, r: throttle.Reads().Reader(in), total: info.Size(), progress: progress}
+	_, err = io.Copy(throttle.Writes().Writer(out), r)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// copyReader reports the progress of a copy and ends it once ctx is done
+type copyReader struct {
+	ctx      context.Context
+	r        io.Reader
+	done     int64
+	total    int64
+	progress storage.Progress
+}
+
+func (c *copyReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.r.Read(b)
+	if n > 0 && c.progress != nil {
+		c.done += int64(n)
+		c.progress(c.done, c.total)
+	}
+	return n, err
+}
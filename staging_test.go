@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"media_optimizer/pkg/config"
+	"media_optimizer/pkg/mediaopt"
+)
+
+// stagingTest is a source to stage in a library and the staging directory
+type stagingTest struct {
+	source  string
+	staging string
+}
+
+func newStagingTest(t *testing.T) stagingTest {
+	t.Helper()
+	dir := t.TempDir()
+	st := stagingTest{
+		source:  filepath.Join(dir, "media", "movie.mkv"),
+		staging: filepath.Join(dir, "staging"),
+	}
+	if err := os.MkdirAll(filepath.Dir(st.source), 0755); err != nil {
+		t.Fatalf("Failed to create library: %v", err)
+	}
+	if err := os.WriteFile(st.source, []byte("source movie"), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	useConfig(t, func(c *config.Config) {
+		c.Staging.Mode = config.StagingAlways
+		c.Staging.Dir = st.staging
+	})
+	return st
+}
+
+// job returns a video job of the source running in ctx
+func (st stagingTest) job(ctx context.Context) *OptimizationJob {
+	return &OptimizationJob{SourcePath: st.source, Kind: KindVideo, Status: "processing", ctx: ctx}
+}
+
+// entries lists the staging directory
+func (st stagingTest) entries(t *testing.T) []string {
+	t.Helper()
+	entries, err := os.ReadDir(st.staging)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("Failed to list staging directory: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestStagedJob(t *testing.T) {
+	st := newStagingTest(t)
+	job := st.job(context.Background())
+	for mode, staged := range map[string]bool{
+		config.StagingAlways: true,
+		config.StagingOff:    false,
+		// No network mounts are configured
+		config.StagingNetwork: false,
+	} {
+		cfg.Staging.Mode = mode
+		if got := stagedJob(job); got != staged {
+			t.Errorf("Staging mode %s: expected staged %v, got %v", mode, staged, got)
+		}
+	}
+}
+
+func TestStageSourceAndOutput(t *testing.T) {
+	st := newStagingTest(t)
+	job := st.job(context.Background())
+
+	var done, total int64
+	cleanup, err := stageSource(job, func(d, t int64) { done, total = d, t })
+	if err != nil {
+		t.Fatalf("stageSource failed: %v", err)
+	}
+	if filepath.Dir(filepath.Dir(job.input)) != st.staging || filepath.Base(job.input) != "movie.mkv" {
+		t.Errorf("Expected the source staged in a job directory of %s, got %s", st.staging, job.input)
+	}
+	if data, err := os.ReadFile(job.input); err != nil || string(data) != "source movie" {
+		t.Errorf("Unexpected staged copy %q: %v", data, err)
+	}
+	if done != total || total != int64(len("source movie")) {
+		t.Errorf("Expected the stage-in progress to complete, got %d of %d", done, total)
+	}
+
+	// The output is written beside the staged copy and copied back beside
+	// the source
+	output := filepath.Join(filepath.Dir(job.input), "movie_optimized.mkv")
+	if err := os.WriteFile(output, []byte("optimized"), 0644); err != nil {
+		t.Fatalf("Failed to write output: %v", err)
+	}
+	final, err := unstageOutput(job, output, nil)
+	if err != nil {
+		t.Fatalf("unstageOutput failed: %v", err)
+	}
+	if expected := filepath.Join(filepath.Dir(st.source), "movie_optimized.mkv"); final != expected {
+		t.Errorf("Expected the output at %s, got %s", expected, final)
+	}
+	if data, err := os.ReadFile(final); err != nil || string(data) != "optimized" {
+		t.Errorf("Unexpected output copy %q: %v", data, err)
+	}
+	if _, err := os.Stat(mediaopt.PartialPath(final)); !os.IsNotExist(err) {
+		t.Errorf("Expected no partial output left, got %v", err)
+	}
+
+	cleanup()
+	if entries := st.entries(t); len(entries) != 0 {
+		t.Errorf("Expected the staging directory empty after cleanup, got %v", entries)
+	}
+	if _, err := os.Stat(st.source); err != nil {
+		t.Errorf("Expected the source kept: %v", err)
+	}
+}
+
+func TestStageSourceCleansUpOnFailure(t *testing.T) {
+	st := newStagingTest(t)
+
+	// A job cancelled while copying leaves nothing behind
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	job := st.job(ctx)
+	if _, err := stageSource(job, nil); err == nil {
+		t.Fatal("Expected staging of a cancelled job to fail")
+	}
+	if job.input != "" {
+		t.Errorf("Expected no staged input, got %s", job.input)
+	}
+	if entries := st.entries(t); len(entries) != 0 {
+		t.Errorf("Expected the staging directory empty, got %v", entries)
+	}
+
+	// So does a missing source
+	job = st.job(context.Background())
+	job.SourcePath = filepath.Join(filepath.Dir(st.source), "missing.mkv")
+	if _, err := stageSource(job, nil); err == nil {
+		t.Error("Expected staging of a missing source to fail")
+	}
+	if entries := st.entries(t); len(entries) != 0 {
+		t.Errorf("Expected the staging directory empty, got %v", entries)
+	}
+}
+
+func TestUnstageOutputFailures(t *testing.T) {
+	st := newStagingTest(t)
+	job := st.job(context.Background())
+	cleanup, err := stageSource(job, nil)
+	if err != nil {
+		t.Fatalf("stageSource failed: %v", err)
+	}
+	defer cleanup()
+
+	// An output named like the source must not replace it
+	if _, err := unstageOutput(job, job.input, nil); err == nil {
+		t.Error("Expected an output overwriting the source to be refused")
+	}
+	if data, _ := os.ReadFile(st.source); string(data) != "source movie" {
+		t.Errorf("Expected the source untouched, got %q", data)
+	}
+
+	// A copy cancelled midway leaves no partial or final output
+	output := filepath.Join(filepath.Dir(job.input), "movie_optimized.mkv")
+	if err := os.WriteFile(output, []byte("optimized"), 0644); err != nil {
+		t.Fatalf("Failed to write output: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	job.ctx = ctx
+	if _, err := unstageOutput(job, output, nil); err == nil {
+		t.Fatal("Expected a cancelled copy to fail")
+	}
+	final := filepath.Join(filepath.Dir(st.source), "movie_optimized.mkv")
+	for _, path := range []string{final, mediaopt.PartialPath(final)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected no %s after a failed copy, got %v", path, err)
+		}
+	}
+}
+
+func TestStagedPackagingSkipsStageOut(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.Checksums.Enabled = false })
+	job := &OptimizationJob{SourcePath: "/media/movie.mkv", Kind: KindVideo, Packaging: mediaopt.PackageHLS}
+	var progress float64
+	job.onProgress = func(p float64) { progress = p }
+	pipeline := videoPipeline(job, false, true, false)
+
+	// Packages are written next to the source from the staged output, so
+	// there's nothing to copy back
+	pipeline.Update(stageStageOut, 50)
+	if job.Stage != "" || progress != 0 {
+		t.Errorf("Expected no stage-out for a packaged job, got stage %q at %.0f%%", job.Stage, progress)
+	}
+	pipeline.Update(stagePackage, 100)
+	if job.Stage != stagePackage || progress != 100 {
+		t.Errorf("Expected packaging to finish the pipeline, got stage %q at %.0f%%", job.Stage, progress)
+	}
+	pipeline.Update(stageStageIn, 100)
+	if job.Stage != stageStageIn {
+		t.Errorf("Expected the source staged in, got stage %q", job.Stage)
+	}
+
+	// Without packaging the output is copied back last
+	job.Packaging = ""
+	pipeline = videoPipeline(job, false, true, false)
+	pipeline.Update(stageStageOut, 100)
+	if job.Stage != stageStageOut || progress != 100 {
+		t.Errorf("Expected stage-out to finish the pipeline, got stage %q at %.0f%%", job.Stage, progress)
+	}
+}
@@ -1,22 +1,43 @@
+// Set by the page when served under a reverse proxy's base path
+const basePath = window.BASE_PATH || '';
 let currentPath = '/';
 let selectedPath = null;
 let ws = null;
 let reconnectAttempts = 0;
 const maxReconnectAttempts = 30; // 30 seconds
 let reconnectInterval = null;
+// Jobs whose progress is shown, followed again after a reconnect
+const followedJobs = new Set();
+const finishedStatuses = ['completed', 'failed', 'cancelled', 'undone', 'attention', 'timed-out'];
 
 function initWebSocket() {
-    ws = new WebSocket(`ws://${window.location.host}/ws`);
+    ws = new WebSocket(`${window.location.protocol === 'https:' ? 'wss' : 'ws'}://${window.location.host}${basePath}/ws`);
     
     ws.onmessage = function(event) {
         const data = JSON.parse(event.data);
         console.log('WebSocket message received:', data);
         
         if (data.type === 'status' || data.type === 'progress') {
+            if (data.jobId) {
+                if (finishedStatuses.includes(data.status)) {
+                    followedJobs.delete(data.jobId);
+                } else {
+                    followedJobs.add(data.jobId);
+                }
+            }
             updateProgress({
                 progress: data.progress,
-                status: data.status
+                status: data.status,
+                error: data.error,
+                data: data.data,
+                speed: data.speed,
+                fps: data.fps,
+                elapsed: data.elapsed,
+                eta: data.eta
             });
+        } else if (data.type === 'error') {
+            document.querySelector('.progress-container').style.display = 'block';
+            document.querySelector('.status').textContent = `Error: ${data.error}`;
         }
     };
 
@@ -27,6 +48,9 @@ function initWebSocket() {
             clearInterval(reconnectInterval);
             reconnectInterval = null;
             attemptReconnect();
+        } else if (followedJobs.size > 0) {
+            // Pick the running jobs up again once the connection is back
+            setTimeout(initWebSocket, 2000);
         }
     };
 
@@ -40,6 +64,10 @@ function initWebSocket() {
         if (document.getElementById('rebuildModal').style.display === 'flex') {
             stopReconnecting();
             window.location.reload(); // Reload the page to ensure fresh state
+            return;
+        }
+        if (followedJobs.size > 0) {
+            ws.send(JSON.stringify({ v: 1, type: 'subscribe', data: { jobIds: [...followedJobs] } }));
         }
     };
 }
@@ -65,7 +93,7 @@ function attemptReconnect() {
     console.log(`Reconnection attempt ${reconnectAttempts}/${maxReconnectAttempts}`);
 
     // Try to connect to the server
-    fetch('/')
+    fetch(`${basePath}/`)
         .then(response => {
             if (response.ok) {
                 console.log('Server is responding, attempting WebSocket reconnection');
@@ -83,6 +111,21 @@ function attemptReconnect() {
         });
 }
 
+const stageLabels = {
+    download: 'Downloading source',
+    'stage-in': 'Copying source to local storage',
+    probe: 'Probing source',
+    analyze: 'Analyzing video',
+    firstpass: 'Analyzing bitrate (first pass)',
+    encode: 'Encoding',
+    verify: 'Verifying output',
+    package: 'Packaging',
+    upload: 'Uploading output',
+    'stage-out': 'Copying output next to the source',
+    checksum: 'Computing checksums',
+    replace: 'Replacing original'
+};
+
 function updateProgress(data) {
     const progressContainer = document.querySelector('.progress-container');
     const progressBar = document.querySelector('.progress');
@@ -92,92 +135,244 @@ function updateProgress(data) {
     progressBar.style.width = `${data.progress}%`;
     
     let statusText = 'Processing...';
+    if (data.status === 'processing') {
+        const stage = data.data && !Array.isArray(data.data) ? stageLabels[data.data.stage] : null;
+        statusText = `${stage || 'Processing'} (${Math.floor(data.progress || 0)}%)`;
+        const details = [];
+        if (data.speed) details.push(`${data.speed.toFixed(1)}x`);
+        if (data.fps) details.push(`${Math.round(data.fps)} fps`);
+        if (data.elapsed) details.push(`${formatDuration(data.elapsed)} elapsed`);
+        if (data.eta) details.push(`about ${formatDuration(data.eta)} left`);
+        if (details.length) statusText += ` (${details.join(', ')})`;
+    }
     if (data.status === 'completed') {
         statusText = 'Optimization completed successfully!';
     } else if (data.status === 'failed') {
         statusText = `Optimization failed: ${data.error || 'Unknown error'}`;
+    } else if (data.status === 'attention') {
+        statusText = `Needs attention, nothing was written: ${data.error || ''}`;
+    } else if (data.status === 'timed-out') {
+        statusText = `Optimization timed out: ${data.error || ''}`;
+    } else if (data.status === 'retryable') {
+        statusText = `Failed, retrying shortly: ${data.error || ''}`;
     } else if (data.status === 'queued') {
         statusText = 'Queued for optimization...';
+    } else if (data.status === 'cancelled') {
+        statusText = 'Optimization cancelled';
+    } else if (data.status === 'paused') {
+        statusText = 'Paused until the next scheduled window or until the queue is resumed...';
+    }
+    // Ladder jobs report each rendition
+    if (Array.isArray(data.data) && data.status !== 'failed' && data.status !== 'attention' && data.status !== 'timed-out') {
+        const renditions = data.data.map(r => `${r.name} ${r.status === 'queued' ? 'queued' : r.progress + '%'}`);
+        statusText += ` (${renditions.join(', ')})`;
     }
     
     status.textContent = statusText;
 }
 
-async function loadFiles(path) {
+async function loadFiles(path, offset = 0) {
     try {
-        const response = await fetch('/api/browse', {
+        const response = await fetch(basePath + '/api/v1/browse', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json',
             },
-            body: JSON.stringify({ path }),
+            body: JSON.stringify({ path, offset }),
         });
-        const files = await response.json();
-        displayFiles(files);
+        const page = await response.json();
         currentPath = path;
+        displayFiles(page, offset > 0);
         document.querySelector('.current-path').textContent = `Current path: ${currentPath}`;
     } catch (error) {
         console.error('Error loading files:', error);
     }
 }
 
-function displayFiles(files) {
+function formatDuration(seconds) {
+    const h = Math.floor(seconds / 3600);
+    const m = Math.floor(seconds % 3600 / 60);
+    const s = Math.floor(seconds % 60);
+    if (h > 0) return `${h}h ${m}m`;
+    if (m > 0) return `${m}m ${s}s`;
+    return `${s}s`;
+}
+
+function formatSize(bytes) {
+    const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    let i = 0;
+    while (bytes >= 1000 && i < units.length - 1) {
+        bytes /= 1000;
+        i++;
+    }
+    return `${bytes.toFixed(i === 0 ? 0 : 1)} ${units[i]}`;
+}
+
+function displayFiles(page, append) {
     const fileList = document.querySelector('.file-list');
-    fileList.innerHTML = '';
-
-    if (currentPath !== '/') {
-        const parentItem = document.createElement('li');
-        parentItem.className = 'file-item';
-        parentItem.innerHTML = '<span class="file-icon">📁</span> ..';
-        parentItem.onclick = () => {
-            const parentPath = currentPath.split('/').slice(0, -1).join('/') || '/';
-            loadFiles(parentPath);
-        };
-        fileList.appendChild(parentItem);
-    }
-
-    files.forEach(file => {
-        const item = document.createElement('li');
-        item.className = 'file-item';
-        item.innerHTML = `<span class="file-icon">${file.isDir ? '📁' : '📄'}</span> ${file.name}`;
-
-        item.onclick = () => {
-            if (file.isDir) {
-                loadFiles(file.path);
+    const more = fileList.querySelector('.more-files');
+    if (more) more.remove();
+
+    if (!append) {
+        fileList.innerHTML = '';
+        document.querySelector('.preview').style.display = 'none';
+        // The server knows the parent of drive letters, shares and remotes
+        if (page.parent) {
+            const parentItem = document.createElement('li');
+            parentItem.className = 'file-item';
+            parentItem.innerHTML = '<span class="file-icon">📁</span> ..';
+            parentItem.onclick = () => loadFiles(page.parent);
+            fileList.appendChild(parentItem);
+        }
+    }
+
+    page.files.forEach(file => fileList.appendChild(fileItem(file, file.name)));
+
+    const next = page.offset + page.files.length;
+    if (next < page.total) {
+        const moreItem = document.createElement('li');
+        moreItem.className = 'file-item more-files';
+        moreItem.textContent = `Show more (${page.total - next} remaining)`;
+        moreItem.onclick = () => loadFiles(currentPath, next);
+        fileList.appendChild(moreItem);
+    }
+}
+
+function fileItem(file, label) {
+    const item = document.createElement('li');
+    item.className = 'file-item';
+    item.innerHTML = `<span class="file-icon">${file.isDir ? '📁' : '📄'}</span> `;
+    item.appendChild(document.createTextNode(label));
+    if (!file.isDir) {
+        item.innerHTML += `<span class="file-size">${formatSize(file.size)}</span>`;
+    }
+
+    item.onclick = () => {
+        if (file.isDir) {
+            loadFiles(file.path);
+        } else {
+            selectedPath = file.path;
+            document.querySelectorAll('.file-item').forEach(i => i.classList.remove('selected'));
+            item.classList.add('selected');
+            document.getElementById('optimizeBtn').disabled = false;
+            document.getElementById('remuxBtn').disabled = false;
+            // Remote sources only support video and remux jobs
+            document.getElementById('ladderBtn').disabled = isRemote(file.path);
+            if (isRemote(file.path)) {
+                document.querySelector('.preview').style.display = 'none';
             } else {
-                selectedPath = file.path;
-                document.querySelectorAll('.file-item').forEach(i => i.classList.remove('selected'));
-                item.classList.add('selected');
-                document.getElementById('optimizeBtn').disabled = false;
+                showPreview(file.path, 'thumbnail');
             }
-        };
+        }
+    };
+    return item;
+}
+
+function isRemote(path) {
+    return /^[a-z0-9]+:\/\//.test(path);
+}
+
+function showPreview(path, type) {
+    const preview = document.querySelector('.preview');
+    const img = document.getElementById('previewImg');
+    img.onload = () => { preview.style.display = 'block'; };
+    img.onerror = () => { preview.style.display = 'none'; };
+    img.onclick = () => showPreview(path, type === 'thumbnail' ? 'sprite' : 'thumbnail');
+    img.src = `${basePath}/api/v1/thumbnail?path=${encodeURIComponent(path)}&type=${type}`;
+}
 
-        fileList.appendChild(item);
-    });
+async function searchFiles(event) {
+    event.preventDefault();
+    const pattern = document.getElementById('searchInput').value.trim();
+    if (!pattern) {
+        loadFiles(currentPath);
+        return;
+    }
+
+    try {
+        const response = await fetch(basePath + '/api/v1/search', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({ pattern }),
+        });
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+        const result = await response.json();
+
+        const fileList = document.querySelector('.file-list');
+        fileList.innerHTML = '';
+        const backItem = document.createElement('li');
+        backItem.className = 'file-item';
+        backItem.innerHTML = '<span class="file-icon">📁</span> Back to folder';
+        backItem.onclick = () => loadFiles(currentPath);
+        fileList.appendChild(backItem);
+        result.matches.forEach(match => {
+            fileList.appendChild(fileItem({ path: match.path, size: match.size, isDir: false }, match.path));
+        });
+
+        const more = result.truncated ? ', showing the first ' + result.matches.length : '';
+        document.querySelector('.current-path').textContent = `Search results for "${pattern}"${more}`;
+    } catch (error) {
+        alert('Search failed: ' + error.message);
+    }
 }
 
 async function optimizeSelected() {
     if (!selectedPath) return;
+    await startOptimization(selectedPath);
+}
+
+async function remuxSelected() {
+    if (!selectedPath) return;
+    await startOptimization(selectedPath, 'remux', 'mp4');
+}
+
+async function ladderSelected() {
+    if (!selectedPath) return;
+    await startOptimization(selectedPath, 'ladder');
+}
+
+async function optimizeFolder() {
+    await startOptimization(currentPath, 'image');
+}
+
+async function transcodeMusicFolder() {
+    await startOptimization(currentPath, 'audio');
+}
+
+async function startOptimization(path, mode, container, confirmCost = false) {
 
     try {
         // First send the HTTP request
-        const response = await fetch('/api/optimize', {
+        const response = await fetch(basePath + '/api/v1/optimize', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json',
             },
-            body: JSON.stringify({ path: selectedPath }),
+            body: JSON.stringify({ path, mode, container, confirmCost }),
         });
         
         if (!response.ok) {
-            throw new Error('Failed to start optimization');
+            const message = (await response.text()).trim();
+            // Expensive cloud jobs need an explicit go-ahead
+            if (response.status === 409 && !confirmCost) {
+                if (confirm(`${message}\n\nStart the job anyway?`)) {
+                    await startOptimization(path, mode, container, true);
+                }
+                return;
+            }
+            throw new Error(message || 'Failed to start optimization');
         }
 
         // Then send the WebSocket message
         if (ws && ws.readyState === WebSocket.OPEN) {
             ws.send(JSON.stringify({
+                v: 1,
                 type: 'optimize',
-                data: { path: selectedPath }
+                data: { path, mode, container, confirmCost }
             }));
         } else {
             console.error('WebSocket is not connected');
@@ -193,6 +388,139 @@ async function optimizeSelected() {
     }
 }
 
+// Shows the logged in user's favorite directories to jump to
+async function loadFavorites() {
+    try {
+        const response = await fetch(basePath + '/api/v1/favorites');
+        const { favorites } = await response.json();
+        const list = document.querySelector('.favorite-list');
+        list.innerHTML = '';
+        favorites.forEach(favorite => {
+            const item = document.createElement('span');
+            item.className = 'favorite';
+            item.title = favorite.path;
+            item.textContent = favorite.name;
+            item.onclick = () => loadFiles(favorite.path);
+
+            const remove = document.createElement('span');
+            remove.className = 'favorite-remove';
+            remove.textContent = '×';
+            remove.title = 'Remove from the favorites';
+            remove.onclick = event => {
+                event.stopPropagation();
+                removeFavorite(favorite.id);
+            };
+            item.appendChild(remove);
+            list.appendChild(item);
+        });
+    } catch (error) {
+        console.error('Error loading favorites:', error);
+    }
+}
+
+async function addFavorite() {
+    try {
+        const response = await fetch(basePath + '/api/v1/favorites', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({ path: currentPath }),
+        });
+        if (!response.ok) {
+            throw new Error((await response.text()).trim());
+        }
+        loadFavorites();
+    } catch (error) {
+        alert('Error adding favorite: ' + error.message);
+    }
+}
+
+async function removeFavorite(id) {
+    try {
+        const response = await fetch(`${basePath}/api/v1/favorites/${encodeURIComponent(id)}`, { method: 'DELETE' });
+        if (!response.ok) {
+            throw new Error((await response.text()).trim());
+        }
+        loadFavorites();
+    } catch (error) {
+        alert('Error removing favorite: ' + error.message);
+    }
+}
+
+// Hides the actions the logged in user's role doesn't allow; the server
+// enforces the roles either way
+async function loadUser() {
+    try {
+        const response = await fetch(basePath + '/api/v1/me');
+        const user = await response.json();
+        if (user.role === 'viewer') {
+            ['optimizeBtn', 'remuxBtn', 'ladderBtn', 'optimizeFolderBtn', 'musicFolderBtn'].forEach(id => {
+                document.getElementById(id).style.display = 'none';
+            });
+        }
+        if (user.role !== 'admin') {
+            document.getElementById('rebuildBtn').style.display = 'none';
+            return;
+        }
+        loadNotifyTargets();
+    } catch (error) {
+        console.error('Error loading user:', error);
+    }
+}
+
+async function loadNotifyTargets() {
+    try {
+        const response = await fetch(basePath + '/api/v1/notify/targets');
+        const { targets } = await response.json();
+        if (!targets || targets.length === 0) return;
+
+        const list = document.querySelector('.notify-list');
+        list.innerHTML = '';
+        targets.forEach(name => {
+            const item = document.createElement('li');
+            item.className = 'notify-item';
+
+            const label = document.createElement('span');
+            label.textContent = name;
+            const button = document.createElement('button');
+            button.className = 'button';
+            button.textContent = 'Send Test';
+            const result = document.createElement('span');
+            result.className = 'notify-result';
+            button.onclick = () => testNotifyTarget(name, result);
+
+            item.append(label, button, result);
+            list.appendChild(item);
+        });
+        document.querySelector('.notify-targets').style.display = 'block';
+    } catch (error) {
+        console.error('Error loading notification targets:', error);
+    }
+}
+
+async function testNotifyTarget(name, result) {
+    result.textContent = 'Sending...';
+    try {
+        const response = await fetch(basePath + '/api/v1/notify/test', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({ target: name }),
+        });
+        if (!response.ok) {
+            throw new Error((await response.text()).trim());
+        }
+        const delivery = await response.json();
+        result.textContent = delivery.error
+            ? `Failed: ${delivery.error} (${delivery.durationMs} ms)`
+            : `OK: HTTP ${delivery.statusCode} in ${delivery.durationMs} ms`;
+    } catch (error) {
+        result.textContent = `Error: ${error.message}`;
+    }
+}
+
 async function rebuild() {
     const rebuildBtn = document.getElementById('rebuildBtn');
     rebuildBtn.disabled = true;
@@ -202,7 +530,7 @@ async function rebuild() {
     reconnectAttempts = 0;
 
     try {
-        const response = await fetch('/api/rebuild', {
+        const response = await fetch(basePath + '/api/v1/rebuild', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json',
@@ -226,6 +554,14 @@ async function rebuild() {
 document.addEventListener('DOMContentLoaded', () => {
     initWebSocket();
     loadFiles('/');
+    loadUser();
+    loadFavorites();
+    document.getElementById('favoriteBtn').onclick = addFavorite;
     document.getElementById('optimizeBtn').onclick = optimizeSelected;
+    document.getElementById('remuxBtn').onclick = remuxSelected;
+    document.getElementById('ladderBtn').onclick = ladderSelected;
+    document.getElementById('optimizeFolderBtn').onclick = optimizeFolder;
+    document.getElementById('musicFolderBtn').onclick = transcodeMusicFolder;
     document.getElementById('rebuildBtn').onclick = rebuild;
+    document.querySelector('.search').onsubmit = searchFiles;
 });
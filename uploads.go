@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"media_optimizer/pkg/auth"
+	"media_optimizer/pkg/upload"
+)
+
+// UploadRequest is the payload of POST /api/upload
+type UploadRequest struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Optimize queues a job for the file once it arrived, with Profile or
+	// the profile the directory policies select
+	Optimize bool   `json:"optimize,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+}
+
+// UploadState is an upload and, once it completed with optimize set, the
+// job queued for it
+type UploadState struct {
+	upload.Upload
+	JobID string `json:"jobId,omitempty"`
+	// JobError says why no job could be queued for the completed file
+	JobError string `json:"jobError,omitempty"`
+	// Error says why a chunk was refused or cut short
+	Error string `json:"error,omitempty"`
+}
+
+// handleUpload serves chunked uploads into the inbox: POST /api/upload
+// starts one, PUT /api/upload/{id}?offset=n sends a chunk, GET
+// /api/upload/{id} tells where to resume and DELETE /api/upload/{id}
+// discards it
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if uploadStore == nil {
+		http.Error(w, "no upload.dir configured", http.StatusConflict)
+		return
+	}
+	user, _ := auth.FromContext(r.Context())
+	id := strings.TrimPrefix(strings.TrimPrefix(apiPath(r), "/upload"), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createUpload(w, r, user)
+		return
+	}
+
+	var state UploadState
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		state.Upload, err = uploadStore.Get(id, user.Name)
+	case http.MethodPut:
+		var offset int64
+		offset, err = strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil {
+			http.Error(w, "offset must be the number of bytes received so far", http.StatusBadRequest)
+			return
+		}
+		state.Upload, err = uploadStore.Write(id, user.Name, offset, r.Body)
+		if err == nil && state.Complete() {
+			slog.Info("Upload complete", "path", state.Path, "size", state.Size, "user", user.Name)
+			if state.Optimize {
+				queueUpload(&state, user)
+			}
+		}
+	case http.MethodDelete:
+		err := uploadStore.Remove(id, user.Name)
+		switch {
+		case errors.Is(err, upload.ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := http.StatusOK
+	switch {
+	case errors.Is(err, upload.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, upload.ErrOffset), errors.Is(err, upload.ErrBusy):
+		// The state tells the client where to resume
+		status = http.StatusConflict
+	case errors.Is(err, upload.ErrTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case err != nil && state.ID == "":
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case err != nil:
+		// A chunk cut short keeps what arrived
+		slog.Warn("Upload chunk incomplete", "upload", id, "received", state.Received, "error", err)
+		status = http.StatusBadRequest
+	}
+	if err != nil {
+		state.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(state)
+}
+
+// createUpload starts an upload into the inbox
+func createUpload(w http.ResponseWriter, r *http.Request, user auth.User) {
+	var request UploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cfg.Upload.MaxBytes > 0 && request.Size > cfg.Upload.MaxBytes {
+		http.Error(w, fmt.Sprintf("size must not exceed %d bytes", cfg.Upload.MaxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !authenticator.AllowedPath(r.Context(), cfg.Upload.Dir) {
+		http.Error(w, errPathNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+	if request.Optimize {
+		if mediaType(request.Name) == "" {
+			http.Error(w, "not a media file: "+request.Name, http.StatusBadRequest)
+			return
+		}
+		if _, ok := cfg.Profiles[request.Profile]; request.Profile != "" && !ok {
+			http.Error(w, "unknown profile: "+request.Profile, http.StatusBadRequest)
+			return
+		}
+	}
+
+	u, err := uploadStore.Create(upload.Upload{
+		Name:     request.Name,
+		Size:     request.Size,
+		Optimize: request.Optimize,
+		Profile:  request.Profile,
+		User:     user.Name,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("Upload started", "upload", u.ID, "name", u.Name, "size", u.Size, "user", user.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(UploadState{Upload: u})
+}
+
+// queueUpload queues the job of a completed upload, recording its ID or
+// why it couldn't be queued
+func queueUpload(state *UploadState, user auth.User) {
+	request := OptimizeRequest{Path: state.Path, Profile: state.Profile}
+	request.user = user
+	request.origin = "upload"
+	job, err := enqueueJob(request, nil)
+	if err != nil {
+		slog.Warn("Failed to queue uploaded file", "path", state.Path, "error", err)
+		state.JobError = err.Error()
+		return
+	}
+	state.JobID = job.ID
+}
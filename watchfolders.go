@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"media_optimizer/pkg/config"
+	"media_optimizer/pkg/jobevents"
+	"media_optimizer/pkg/mediaopt"
+	"media_optimizer/pkg/watch"
+)
+
+// startWatching polls the configured watch folders in the background
+func startWatching() {
+	if len(cfg.Watch.Folders) == 0 {
+		return
+	}
+	folders := make([]watch.Folder, len(cfg.Watch.Folders))
+	for i, f := range cfg.Watch.Folders {
+		folders[i] = watch.Folder{Path: f.Path, Recursive: f.Recursive, Extensions: cfg.AllowedExtensions, Exclude: excludes}
+		slog.Info("Watching folder", "path", f.Path, "profile", f.Profile, "destination", f.Destination, "actions", f.Actions)
+	}
+	watcher := watch.New(folders, queueWatched)
+	go watcher.Run(context.Background(), time.Duration(cfg.Watch.IntervalSeconds)*time.Second)
+}
+
+// queueWatched queues a video job following the folder's recipe for a
+// settled file of a watched folder, or proposes it when proposals are
+// enabled. Files the job history already covers or stamped as outputs
+// are skipped, and possible outputs of running jobs are looked at again
+// once the jobs finish.
+func queueWatched(index int, path string) bool {
+	if index < 0 {
+		return true
+	}
+	folder := &cfg.Watch.Folders[index]
+	info, err := os.Stat(path)
+	if err != nil {
+		// Gone again, e.g. moved on by another tool
+		return true
+	}
+	known, busy := watchedBefore(path, info.ModTime())
+	if known {
+		return true
+	}
+	if busy {
+		return false
+	}
+	// Outputs carry a stamp, which outlives a lost job history
+	if probe, err := mediaopt.Probe(path); err == nil && mediaopt.ReadStamp(probe) != nil {
+		return true
+	}
+
+	request := OptimizeRequest{Path: path, Profile: folder.Profile}
+	request.origin = "watch " + folder.Path
+	request.recipe = folder
+	if cfg.Proposals.Enabled {
+		proposal, err := proposeJob(request)
+		switch {
+		case errors.Is(err, errProposalRejected):
+		case err != nil:
+			slog.Warn("Rejected watched file", "folder", folder.Path, "path", path, "error", err)
+		default:
+			slog.Info("Proposed watched file", "folder", folder.Path, "path", path, "proposal", proposal.ID)
+		}
+		return true
+	}
+	_, err = enqueueJob(request, nil)
+	var conflict *jobConflictError
+	switch {
+	case errors.As(err, &conflict):
+	case err != nil:
+		slog.Warn("Rejected watched file", "folder", folder.Path, "path", path, "error", err)
+	default:
+		slog.Info("Queued watched file", "folder", folder.Path, "path", path)
+	}
+	return true
+}
+
+// watchedBefore reports whether the job history already covers the file at
+// path, last modified at modTime, as the output of a job or a source that
+// hasn't changed since its job. busy is set when the file may be the output
+// of a job still running, which isn't recorded until it finishes.
+func watchedBefore(path string, modTime time.Time) (known, busy bool) {
+	for _, r := range jobStore.List() {
+		if r.OutputPath == path || (r.SourcePath == path && modTime.Before(r.CreatedAt)) {
+			return true, false
+		}
+	}
+
+	// Outputs are written next to their source, named after it
+	name := filepath.Base(path)
+	activeJobs.RLock()
+	defer activeJobs.RUnlock()
+	for _, job := range activeJobs.jobs {
+		if jobFinished(job.Status) || job.SourcePath == path || filepath.Dir(job.SourcePath) != filepath.Dir(path) {
+			continue
+		}
+		source := filepath.Base(job.SourcePath)
+		if strings.HasPrefix(name, strings.TrimSuffix(source, filepath.Ext(source))) {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// runRecipe applies the file post-actions of a watch folder's recipe to a
+// completed job: the output is moved to the folder's destination, then the
+// source is moved to the trash or the archive. It returns where the output
+// ends up, which stays output when it couldn't be moved.
+func runRecipe(job *OptimizationJob, folder *config.WatchFolder, output string) (string, error) {
+	rel := watchedDir(folder.Path, job.SourcePath)
+	if folder.Destination != "" {
+		dst := filepath.Join(folder.Destination, rel, filepath.Base(output))
+		if err := moveNew(job.ctx, output, dst); err != nil {
+			return output, fmt.Errorf("failed to move output to %s: %v", folder.Destination, err)
+		}
+		output = dst
+		recipeDone(job, "moved output to "+dst)
+	}
+
+	switch {
+	case folder.Has(config.WatchDeleteSource):
+		if _, err := trashStore.Put(job.ID, job.SourcePath); err != nil {
+			return output, fmt.Errorf("failed to delete source: %v", err)
+		}
+		recipeDone(job, "moved source to the trash")
+	case folder.Has(config.WatchArchive):
+		dst := filepath.Join(folder.ArchiveDir, rel, filepath.Base(job.SourcePath))
+		if err := moveNew(job.ctx, job.SourcePath, dst); err != nil {
+			return output, fmt.Errorf("failed to archive source: %v", err)
+		}
+		recipeDone(job, "archived source to "+dst)
+	}
+	return output, nil
+}
+
+// recipeDone records a post-action in the job's log and audit trail
+func recipeDone(job *OptimizationJob, action string) {
+	if job.log != nil {
+		job.log.Printf("Recipe: %s", action)
+	}
+	recordEvent(job.ID, jobevents.TypePostAction, "", action)
+}
+
+// watchedDir returns the directory of path relative to the watch folder
+// root, "" for files directly in it
+func watchedDir(root, path string) string {
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Dir(path))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return rel
+}
+
+// moveNew moves src to dst, which must not exist yet, creating its
+// directory. Across filesystems the file is copied and the original removed.
+func moveNew(ctx context.Context, src, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(ctx, dst, src, nil); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}